@@ -2,40 +2,67 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/promql"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/buildinfo"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/netutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
 )
 
-var httpListenAddr = flag.String("httpListenAddr", ":8428", "TCP address to listen for http connections")
+var (
+	httpListenAddr = flag.String("httpListenAddr", ":8428", "TCP address to listen for http connections. It is ignored if both -httpListenAddr.select and -httpListenAddr.insert are set. "+
+		"Multiple comma-separated addresses may be set, e.g. `[::]:8428,127.0.0.1:8429`. IPv6 is used only for addresses with IPv6 host")
+	httpListenAddrSelect = flag.String("httpListenAddr.select", "", "Optional TCP address to listen for http connections to query endpoints only. "+
+		"Data ingestion endpoints return 404 Not Found at this address. Multiple comma-separated addresses may be set. See also -httpListenAddr.insert")
+	httpListenAddrInsert = flag.String("httpListenAddr.insert", "", "Optional TCP address to listen for http connections to data ingestion, deletion and snapshot endpoints only. "+
+		"Query endpoints return 404 Not Found at this address. Multiple comma-separated addresses may be set. See also -httpListenAddr.select")
+)
 
 func main() {
 	flag.Parse()
 	buildinfo.Init()
 	logger.Init()
-	logger.Infof("starting VictoraMetrics at %q...", *httpListenAddr)
+	las := getListenAddrs()
+	var addrs []string
+	for _, la := range las {
+		addrs = append(addrs, la.addr)
+	}
+	logger.Infof("starting VictoraMetrics at %q...", addrs)
 	startTime := time.Now()
-	vmstorage.Init()
+
+	// Start serving http requests before opening the storage, so /health and /ready pages
+	// reflect the startup progress. Other requests are rejected until SetReady is called.
+	httpserver.SetStartupPhase("initializing storage")
+	for _, la := range las {
+		go httpserver.Serve(la.addr, la.rh)
+	}
+	vmstorage.Init(promql.ResetRollupResultCacheIfNeeded)
+	httpserver.SetStartupPhase("loading query caches")
 	vmselect.Init()
+	httpserver.SetStartupPhase("initializing data ingestion")
 	vminsert.Init()
-
-	go httpserver.Serve(*httpListenAddr, requestHandler)
+	httpserver.SetReady()
 	logger.Infof("started VictoriaMetrics in %s", time.Since(startTime))
 
 	sig := procutil.WaitForSigterm()
 	logger.Infof("received signal %s", sig)
 
-	logger.Infof("gracefully shutting down webservice at %q", *httpListenAddr)
 	startTime = time.Now()
-	if err := httpserver.Stop(*httpListenAddr); err != nil {
-		logger.Fatalf("cannot stop the webservice: %s", err)
+	for _, addr := range addrs {
+		logger.Infof("gracefully shutting down webservice at %q", addr)
+		if err := httpserver.Stop(addr); err != nil {
+			logger.Fatalf("cannot stop the webservice: %s", err)
+		}
 	}
 	vminsert.Stop()
 	logger.Infof("successfully shut down the webservice in %s", time.Since(startTime))
@@ -46,10 +73,120 @@ func main() {
 	logger.Infof("the VictoriaMetrics has been stopped in %s", time.Since(startTime))
 }
 
-func requestHandler(w http.ResponseWriter, r *http.Request) bool {
+type listenAddr struct {
+	// addr may contain comma-separated list of addresses served by rh.
+	addr string
+	rh   httpserver.RequestHandler
+}
+
+// getListenAddrs returns addresses to listen for http connections with the corresponding request handlers.
+//
+// -httpListenAddr serves all the endpoints. It isn't used if both -httpListenAddr.select and -httpListenAddr.insert are set.
+func getListenAddrs() []listenAddr {
+	var las []listenAddr
+	seenAddrs := make(map[string]bool)
+	add := func(flagName, addr string, rh httpserver.RequestHandler) {
+		addrs := netutil.ParseListenAddrs(addr)
+		if len(addrs) == 0 {
+			return
+		}
+		for _, a := range addrs {
+			if seenAddrs[a] {
+				logger.Fatalf("-%s=%q must contain addresses, which differ from each other and from the addresses set via other -httpListenAddr* command-line flags; %q is repeated", flagName, addr, a)
+			}
+			seenAddrs[a] = true
+		}
+		las = append(las, listenAddr{
+			addr: addr,
+			rh:   rh,
+		})
+	}
+	if len(*httpListenAddrSelect) == 0 || len(*httpListenAddrInsert) == 0 {
+		add("httpListenAddr", *httpListenAddr, requestHandler)
+	}
+	add("httpListenAddr.select", *httpListenAddrSelect, selectRequestHandler)
+	add("httpListenAddr.insert", *httpListenAddrInsert, insertRequestHandler)
+	if len(las) == 0 {
+		logger.Fatalf("-httpListenAddr cannot be empty")
+	}
+	return las
+}
+
+// selectRequestHandler serves query endpoints only.
+func selectRequestHandler(w http.ResponseWriter, r *http.Request) bool {
+	if tenant.IsEnabled() {
+		if strings.HasPrefix(r.URL.Path, "/select/") {
+			return tenantRequestHandler(w, r, "/select/", vmselect.RequestHandler)
+		}
+		return notFoundHandler(w, r)
+	}
+	if vmselect.RequestHandler(w, r) {
+		return true
+	}
+	return notFoundHandler(w, r)
+}
+
+// insertRequestHandler serves data ingestion, deletion and snapshot endpoints only.
+func insertRequestHandler(w http.ResponseWriter, r *http.Request) bool {
+	if tenant.IsEnabled() {
+		if strings.HasPrefix(r.URL.Path, "/insert/") {
+			return tenantRequestHandler(w, r, "/insert/", vminsertRequestHandler)
+		}
+		if vmstorage.RequestHandler(w, r) {
+			return true
+		}
+		return notFoundHandler(w, r)
+	}
+	if vminsertRequestHandler(w, r) {
+		return true
+	}
+	if vmstorage.RequestHandler(w, r) {
+		return true
+	}
+	return notFoundHandler(w, r)
+}
+
+// vminsertRequestHandler serves data ingestion and deletion endpoints.
+func vminsertRequestHandler(w http.ResponseWriter, r *http.Request) bool {
 	if vminsert.RequestHandler(w, r) {
 		return true
 	}
+	return vmselect.AdminRequestHandler(w, r)
+}
+
+// tenantRequestHandler passes r scoped to the tenant from "<prefix><accountID>/..." path to rh.
+func tenantRequestHandler(w http.ResponseWriter, r *http.Request, prefix string, rh httpserver.RequestHandler) bool {
+	rNew, err := tenant.NewRequest(r, prefix)
+	if err != nil {
+		httpserver.Errorf(w, "%s", err)
+		return true
+	}
+	if rh(w, rNew) {
+		return true
+	}
+	return notFoundHandler(w, r)
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) bool {
+	http.Error(w, fmt.Sprintf("unsupported path requested: %q", r.URL.Path), http.StatusNotFound)
+	return true
+}
+
+func requestHandler(w http.ResponseWriter, r *http.Request) bool {
+	if tenant.IsEnabled() {
+		// Data ingestion and query endpoints are served only for tenants.
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/insert/"):
+			return tenantRequestHandler(w, r, "/insert/", vminsertRequestHandler)
+		case strings.HasPrefix(r.URL.Path, "/select/"):
+			return tenantRequestHandler(w, r, "/select/", vmselect.RequestHandler)
+		default:
+			return vmstorage.RequestHandler(w, r)
+		}
+	}
+	if vminsertRequestHandler(w, r) {
+		return true
+	}
 	if vmselect.RequestHandler(w, r) {
 		return true
 	}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+)
+
+func TestSelectInsertRequestHandlers(t *testing.T) {
+	path := "TestSelectInsertRequestHandlers"
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+	dataPathOrig := *vmstorage.DataPath
+	*vmstorage.DataPath = path
+	defer func() {
+		*vmstorage.DataPath = dataPathOrig
+	}()
+	vmselect.Init()
+	defer vmselect.Stop()
+
+	f := func(rh func(w http.ResponseWriter, r *http.Request) bool, method, url string, notFoundExpected bool) {
+		t.Helper()
+		r := httptest.NewRequest(method, url, nil)
+		w := httptest.NewRecorder()
+		if !rh(w, r) {
+			t.Fatalf("unexpected false result for %s %q", method, url)
+		}
+		if notFound := w.Code == http.StatusNotFound; notFound != notFoundExpected {
+			t.Fatalf("unexpected status code for %s %q; got %d; notFoundExpected=%v", method, url, w.Code, notFoundExpected)
+		}
+	}
+
+	// Data ingestion, deletion and snapshot endpoints mustn't be served at the address for query endpoints
+	f(selectRequestHandler, "POST", "/api/v1/write", true)
+	f(selectRequestHandler, "POST", "/api/v1/import", true)
+	f(selectRequestHandler, "POST", "/write", true)
+	f(selectRequestHandler, "POST", "/api/v1/admin/tsdb/delete_series?match[]=foo", true)
+	f(selectRequestHandler, "DELETE", "/api/v1/series?match[]=foo", true)
+	f(selectRequestHandler, "GET", "/snapshot/create", true)
+
+	// Influx query endpoint is served at the address for query endpoints
+	f(selectRequestHandler, "GET", "/query", false)
+	f(insertRequestHandler, "GET", "/query", true)
+
+	// Deletion endpoints are served at the address for data ingestion
+	f(insertRequestHandler, "POST", "/api/v1/admin/tsdb/delete_series?match[]=foo", false)
+	f(insertRequestHandler, "DELETE", "/api/v1/series?match[]=foo", false)
+	f(insertRequestHandler, "GET", "/api/v1/query?query=foo", true)
+}
@@ -3,10 +3,12 @@ package common
 import (
 	"fmt"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
 )
 
 // InsertCtx contains common bits for data points insertion.
@@ -15,6 +17,31 @@ type InsertCtx struct {
 
 	mrs            []storage.MetricRow
 	metricNamesBuf []byte
+
+	relabelLabels     []prompb.Label
+	relabelMetricName storage.MetricName
+
+	// accountID is the tenant for the currently processed request. See SetAccountID.
+	accountID    string
+	tenantLabels []prompb.Label
+
+	// rateLimitClient is the client, which sent the currently processed request.
+	// Rows flushed via FlushBufs are registered at it if it isn't nil.
+	rateLimitClient *ratelimiter.Client
+}
+
+// SetRateLimitClient sets the client for registering rows flushed via FlushBufs.
+//
+// It must be called with nil c after the request from the client is processed.
+func (ctx *InsertCtx) SetRateLimitClient(c *ratelimiter.Client) {
+	ctx.rateLimitClient = c
+}
+
+// SetAccountID sets tenant's accountID, which is added to all the rows written to ctx via tenant.Label.
+//
+// It must be called with empty accountID after the request from the tenant is processed.
+func (ctx *InsertCtx) SetAccountID(accountID string) {
+	ctx.accountID = accountID
 }
 
 // Reset resets ctx for future fill with rowsLen rows.
@@ -35,9 +62,35 @@ func (ctx *InsertCtx) Reset(rowsLen int) {
 	}
 	ctx.mrs = ctx.mrs[:0]
 	ctx.metricNamesBuf = ctx.metricNamesBuf[:0]
+
+	for i := range ctx.relabelLabels {
+		label := &ctx.relabelLabels[i]
+		label.Name = nil
+		label.Value = nil
+	}
+	ctx.relabelLabels = ctx.relabelLabels[:0]
+
+	for i := range ctx.tenantLabels {
+		label := &ctx.tenantLabels[i]
+		label.Name = nil
+		label.Value = nil
+	}
+	ctx.tenantLabels = ctx.tenantLabels[:0]
 }
 
+// marshalMetricNameRaw returns nil if the sample must be dropped according to -relabelConfig.
 func (ctx *InsertCtx) marshalMetricNameRaw(prefix []byte, labels []prompb.Label) []byte {
+	if prcs := getRelabelConfigs(); len(prcs) > 0 {
+		labels = ctx.applyRelabeling(prefix, labels, prcs)
+		if labels == nil {
+			return nil
+		}
+		prefix = nil
+	}
+	if len(ctx.accountID) > 0 {
+		labels = ctx.setTenantLabel(prefix, labels)
+		prefix = nil
+	}
 	start := len(ctx.metricNamesBuf)
 	ctx.metricNamesBuf = append(ctx.metricNamesBuf, prefix...)
 	ctx.metricNamesBuf = storage.MarshalMetricNameRaw(ctx.metricNamesBuf, labels)
@@ -45,18 +98,46 @@ func (ctx *InsertCtx) marshalMetricNameRaw(prefix []byte, labels []prompb.Label)
 	return metricNameRaw[:len(metricNameRaw):len(metricNameRaw)]
 }
 
+// setTenantLabel returns labels from prefix and labels with tenant.Label set to ctx.accountID.
+//
+// tenant.Label from the ingested data is dropped, so the tenant cannot write series for other tenants.
+func (ctx *InsertCtx) setTenantLabel(prefix []byte, labels []prompb.Label) []prompb.Label {
+	tmpLabels := ctx.appendPrefixLabels(ctx.tenantLabels[:0], prefix)
+	tmpLabels = append(tmpLabels, labels...)
+	n := 0
+	for _, label := range tmpLabels {
+		if string(label.Name) != tenant.Label {
+			tmpLabels[n] = label
+			n++
+		}
+	}
+	tmpLabels = tmpLabels[:n]
+	tmpLabels = appendLabel(tmpLabels, tenantLabelName, bytesutil.ToUnsafeBytes(ctx.accountID))
+	ctx.tenantLabels = tmpLabels
+	return tmpLabels
+}
+
+var tenantLabelName = []byte(tenant.Label)
+
 // WriteDataPoint writes (timestamp, value) with the given prefix and lables into ctx buffer.
 func (ctx *InsertCtx) WriteDataPoint(prefix []byte, labels []prompb.Label, timestamp int64, value float64) {
 	metricNameRaw := ctx.marshalMetricNameRaw(prefix, labels)
+	if metricNameRaw == nil {
+		return
+	}
 	ctx.addRow(metricNameRaw, timestamp, value)
 }
 
 // WriteDataPointExt writes (timestamp, value) with the given metricNameRaw and labels into ctx buffer.
 //
 // It returns metricNameRaw for the given labels if len(metricNameRaw) == 0.
+// nil is returned if the sample is dropped according to -relabelConfig.
 func (ctx *InsertCtx) WriteDataPointExt(metricNameRaw []byte, labels []prompb.Label, timestamp int64, value float64) []byte {
 	if len(metricNameRaw) == 0 {
 		metricNameRaw = ctx.marshalMetricNameRaw(nil, labels)
+		if metricNameRaw == nil {
+			return nil
+		}
 	}
 	ctx.addRow(metricNameRaw, timestamp, value)
 	return metricNameRaw
@@ -98,6 +179,13 @@ func (ctx *InsertCtx) AddLabel(name, value string) {
 
 // FlushBufs flushes buffered rows to the underlying storage.
 func (ctx *InsertCtx) FlushBufs() error {
+	if c := ctx.rateLimitClient; c != nil {
+		if err := c.Register(len(ctx.mrs)); err != nil {
+			// Do not wrap the error, so the client receives 429 status code with Retry-After header.
+			return err
+		}
+	}
+	ctx.mrs = pushStreamAggr(ctx.mrs)
 	if err := vmstorage.AddRows(ctx.mrs); err != nil {
 		return fmt.Errorf("cannot store metrics: %s", err)
 	}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+)
+
+// MaxSizeReader limits the number of bytes, which may be read from the underlying reader.
+//
+// It must wrap decompressing readers, so the limit applies to the decompressed data.
+// This protects from decompression bombs, since the underlying reader isn't read past the limit.
+type MaxSizeReader struct {
+	r       io.Reader
+	maxSize int64
+	n       int64
+	err     error
+}
+
+// NewMaxSizeReader returns a reader, which fails when more than maxSize bytes are read from r.
+//
+// The reader isn't limited if maxSize <= 0.
+func NewMaxSizeReader(r io.Reader, maxSize int64) *MaxSizeReader {
+	return &MaxSizeReader{
+		r:       r,
+		maxSize: maxSize,
+	}
+}
+
+// Read implements io.Reader.
+func (mr *MaxSizeReader) Read(p []byte) (int, error) {
+	if mr.err != nil {
+		return 0, mr.err
+	}
+	if mr.maxSize <= 0 {
+		return mr.r.Read(p)
+	}
+	// Allow reading a single byte past maxSize in order to detect too big requests.
+	if remaining := mr.maxSize + 1 - mr.n; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := mr.r.Read(p)
+	mr.n += int64(n)
+	if mr.n > mr.maxSize {
+		mr.err = NewTooBigRequestError(mr.maxSize)
+		return 0, mr.err
+	}
+	return n, err
+}
+
+// Err returns non-nil error if more than maxSize bytes were read from mr.
+//
+// The returned error must be passed to httpserver.Errorf without wrapping,
+// so the client receives 413 Request Entity Too Large response.
+func (mr *MaxSizeReader) Err() error {
+	return mr.err
+}
+
+// NewTooBigRequestError returns an error for requests exceeding maxSize bytes.
+func NewTooBigRequestError(maxSize int64) error {
+	return &httpserver.ErrorWithStatusCode{
+		Err:        fmt.Errorf("too big request; it mustn't exceed %d bytes after decompression", maxSize),
+		StatusCode: http.StatusRequestEntityTooLarge,
+	}
+}
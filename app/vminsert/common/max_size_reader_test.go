@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+)
+
+func TestMaxSizeReader(t *testing.T) {
+	f := func(s string, maxSize int64, tooBigExpected bool) {
+		t.Helper()
+		mr := NewMaxSizeReader(strings.NewReader(s), maxSize)
+		data, err := ioutil.ReadAll(mr)
+		if !tooBigExpected {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(data) != s {
+				t.Fatalf("unexpected data read; got %q; want %q", data, s)
+			}
+			if mr.Err() != nil {
+				t.Fatalf("unexpected non-nil Err(): %s", mr.Err())
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if int64(len(data)) > maxSize {
+			t.Fatalf("too much data read; got %d bytes; mustn't exceed %d bytes", len(data), maxSize)
+		}
+		if err != mr.Err() {
+			t.Fatalf("unexpected error; got %v; want %v", err, mr.Err())
+		}
+		checkTooBigRequestError(t, err)
+	}
+
+	f("", 0, false)
+	f("", 10, false)
+	f("foobar", 6, false)
+	f("foobar", 100, false)
+	f("foobar", 5, true)
+
+	// The reader isn't limited if maxSize <= 0
+	f("foobar", 0, false)
+	f("foobar", -1, false)
+}
+
+func TestMaxSizeReaderGzipBomb(t *testing.T) {
+	// Prepare highly compressible data, which decompresses to 16MB.
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	zeros := make([]byte, 1024*1024)
+	for i := 0; i < 16; i++ {
+		if _, err := zw.Write(zeros); err != nil {
+			t.Fatalf("cannot write gzipped data: %s", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %s", err)
+	}
+	compressedLen := bb.Len()
+
+	cr := &countingReader{
+		r: &bb,
+	}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		t.Fatalf("cannot create gzip reader: %s", err)
+	}
+	const maxSize = 1024 * 1024
+	mr := NewMaxSizeReader(zr, maxSize)
+	n, err := io.Copy(ioutil.Discard, mr)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	checkTooBigRequestError(t, err)
+	if n > maxSize {
+		t.Fatalf("too much data read; got %d bytes; mustn't exceed %d bytes", n, maxSize)
+	}
+	// The compressed stream mustn't be read past the limit.
+	if cr.n >= compressedLen/2 {
+		t.Fatalf("too much compressed data read; got %d bytes out of %d bytes", cr.n, compressedLen)
+	}
+}
+
+func checkTooBigRequestError(t *testing.T, err error) {
+	t.Helper()
+	esc, ok := err.(*httpserver.ErrorWithStatusCode)
+	if !ok {
+		t.Fatalf("unexpected error type; got %T; want %T", err, esc)
+	}
+	if esc.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status code; got %d; want %d", esc.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
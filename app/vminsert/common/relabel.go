@@ -0,0 +1,127 @@
+package common
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promrelabel"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var relabelConfig = flag.String("relabelConfig", "", "Optional path to YAML file with Prometheus-compatible `relabel_configs` for the ingested samples. "+
+	"The file is re-read on SIGHUP. See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config")
+
+// InitRelabel initializes relabeling of the ingested samples if -relabelConfig is set.
+//
+// MustStopRelabel must be called when relabeling is no longer needed.
+func InitRelabel() {
+	if len(*relabelConfig) == 0 {
+		return
+	}
+	prcs, err := promrelabel.LoadRelabelConfigs(*relabelConfig)
+	if err != nil {
+		logger.Fatalf("cannot load -relabelConfig=%q: %s", *relabelConfig, err)
+	}
+	relabelConfigs.Store(prcs)
+
+	sighupCh := procutil.NewSighupChan()
+	relabelReloaderWG.Add(1)
+	go func() {
+		defer relabelReloaderWG.Done()
+		for {
+			select {
+			case <-relabelReloaderStopCh:
+				return
+			case <-sighupCh:
+			}
+			logger.Infof("SIGHUP received; reloading -relabelConfig=%q", *relabelConfig)
+			prcs, err := promrelabel.LoadRelabelConfigs(*relabelConfig)
+			if err != nil {
+				logger.Errorf("cannot reload -relabelConfig=%q; continuing using the previous config: %s", *relabelConfig, err)
+				continue
+			}
+			relabelConfigs.Store(prcs)
+			logger.Infof("successfully reloaded -relabelConfig=%q", *relabelConfig)
+		}
+	}()
+}
+
+// MustStopRelabel stops the -relabelConfig reloader.
+func MustStopRelabel() {
+	if len(*relabelConfig) == 0 {
+		return
+	}
+	close(relabelReloaderStopCh)
+	relabelReloaderWG.Wait()
+}
+
+var (
+	relabelConfigs        atomic.Value
+	relabelReloaderStopCh = make(chan struct{})
+	relabelReloaderWG     sync.WaitGroup
+)
+
+func getRelabelConfigs() []promrelabel.ParsedRelabelConfig {
+	prcs, _ := relabelConfigs.Load().([]promrelabel.ParsedRelabelConfig)
+	return prcs
+}
+
+// applyRelabeling applies prcs to the labels obtained from prefix and labels.
+//
+// prefix may contain labels marshaled with storage.MarshalMetricNameRaw.
+// nil is returned if the sample must be dropped.
+func (ctx *InsertCtx) applyRelabeling(prefix []byte, labels []prompb.Label, prcs []promrelabel.ParsedRelabelConfig) []prompb.Label {
+	tmpLabels := ctx.appendPrefixLabels(ctx.relabelLabels[:0], prefix)
+	for i := range labels {
+		label := &labels[i]
+		name := label.Name
+		if len(name) == 0 {
+			name = metricNameLabel
+		}
+		tmpLabels = appendLabel(tmpLabels, name, label.Value)
+	}
+	ctx.relabelLabels = tmpLabels
+
+	result := promrelabel.ApplyRelabelConfigs(tmpLabels, prcs)
+	if len(result) == 0 || !promrelabel.HasMetricName(result) {
+		// Drop samples without labels or without metric name, since they cannot be queried.
+		relabelMetricsDropped.Inc()
+		return nil
+	}
+	return result
+}
+
+// appendPrefixLabels appends labels marshaled with storage.MarshalMetricNameRaw in prefix to dst.
+func (ctx *InsertCtx) appendPrefixLabels(dst []prompb.Label, prefix []byte) []prompb.Label {
+	if len(prefix) == 0 {
+		return dst
+	}
+	mn := &ctx.relabelMetricName
+	if err := mn.UnmarshalRaw(prefix); err != nil {
+		logger.Panicf("BUG: cannot unmarshal labels from prefix: %s", err)
+	}
+	if len(mn.MetricGroup) > 0 {
+		dst = appendLabel(dst, metricNameLabel, mn.MetricGroup)
+	}
+	for i := range mn.Tags {
+		tag := &mn.Tags[i]
+		dst = appendLabel(dst, tag.Key, tag.Value)
+	}
+	return dst
+}
+
+func appendLabel(dst []prompb.Label, name, value []byte) []prompb.Label {
+	return append(dst, prompb.Label{
+		Name:  name,
+		Value: value,
+	})
+}
+
+var metricNameLabel = bytesutil.ToUnsafeBytes("__name__")
+
+var relabelMetricsDropped = metrics.NewCounter(`vm_relabel_metrics_dropped_total`)
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"flag"
+	"io/ioutil"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/streamaggr"
+)
+
+var streamAggrConfig = flag.String("streamAggr.config", "", "Optional path to YAML file with streaming aggregation rules for the ingested samples. "+
+	"The file is re-read on SIGHUP. The state of unchanged rules is preserved on reload")
+
+// InitStreamAggr initializes streaming aggregation if -streamAggr.config is set.
+//
+// MustStopStreamAggr must be called when streaming aggregation is no longer needed.
+func InitStreamAggr() {
+	if len(*streamAggrConfig) == 0 {
+		return
+	}
+	sas, err := streamaggr.LoadFromFile(*streamAggrConfig, pushAggregatedRows)
+	if err != nil {
+		logger.Fatalf("cannot load -streamAggr.config=%q: %s", *streamAggrConfig, err)
+	}
+	streamAggrs = sas
+
+	sighupCh := procutil.NewSighupChan()
+	streamAggrReloaderWG.Add(1)
+	go func() {
+		defer streamAggrReloaderWG.Done()
+		for {
+			select {
+			case <-streamAggrReloaderStopCh:
+				return
+			case <-sighupCh:
+			}
+			logger.Infof("SIGHUP received; reloading -streamAggr.config=%q", *streamAggrConfig)
+			if err := reloadStreamAggr(); err != nil {
+				logger.Errorf("cannot reload -streamAggr.config=%q; continuing using the previous config: %s", *streamAggrConfig, err)
+			}
+		}
+	}()
+}
+
+func reloadStreamAggr() error {
+	data, err := ioutil.ReadFile(*streamAggrConfig)
+	if err != nil {
+		return err
+	}
+	streamAggrsLock.RLock()
+	sasPrev := streamAggrs
+	streamAggrsLock.RUnlock()
+	sas, err := sasPrev.Reload(data)
+	if err != nil {
+		return err
+	}
+
+	// Wait for in-flight pushes to sasPrev while swapping the aggregators, so removed aggregators can be stopped safely.
+	streamAggrsLock.Lock()
+	streamAggrs = sas
+	streamAggrsLock.Unlock()
+	sasPrev.MustStopRemoved(sas)
+	logger.Infof("successfully reloaded -streamAggr.config=%q", *streamAggrConfig)
+	return nil
+}
+
+// MustStopStreamAggr stops streaming aggregation and flushes the aggregated state.
+func MustStopStreamAggr() {
+	if len(*streamAggrConfig) == 0 {
+		return
+	}
+	close(streamAggrReloaderStopCh)
+	streamAggrReloaderWG.Wait()
+	streamAggrsLock.Lock()
+	sas := streamAggrs
+	streamAggrs = nil
+	streamAggrsLock.Unlock()
+	sas.MustStop()
+}
+
+var (
+	// streamAggrsLock protects streamAggrs. It is held in read mode during pushes to streamAggrs,
+	// so the aggregators aren't stopped while they are in use.
+	streamAggrsLock sync.RWMutex
+	streamAggrs     *streamaggr.Aggregators
+
+	streamAggrReloaderStopCh = make(chan struct{})
+	streamAggrReloaderWG     sync.WaitGroup
+)
+
+// pushStreamAggr pushes mrs to streaming aggregation if it is enabled and returns rows, which must be stored.
+func pushStreamAggr(mrs []storage.MetricRow) []storage.MetricRow {
+	streamAggrsLock.RLock()
+	defer streamAggrsLock.RUnlock()
+	if streamAggrs == nil {
+		return mrs
+	}
+	return streamAggrs.Push(mrs)
+}
+
+func pushAggregatedRows(mrs []storage.MetricRow) {
+	if err := vmstorage.AddRows(mrs); err != nil {
+		logger.Errorf("cannot store aggregated samples: %s", err)
+	}
+}
@@ -0,0 +1,151 @@
+package csvimport
+
+import (
+	"testing"
+)
+
+func TestParseColumnDescriptorsSuccess(t *testing.T) {
+	f := func(s string, cdsExpected []ColumnDescriptor) {
+		t.Helper()
+		cds, err := ParseColumnDescriptors(s)
+		if err != nil {
+			t.Fatalf("unexpected error on ParseColumnDescriptors(%q): %s", s, err)
+		}
+		if len(cds) != len(cdsExpected) {
+			t.Fatalf("unexpected number of column descriptors for %q; got %d; want %d", s, len(cds), len(cdsExpected))
+		}
+		for i := range cds {
+			cd := &cds[i]
+			cdExpected := &cdsExpected[i]
+			if cd.TagName != cdExpected.TagName {
+				t.Fatalf("unexpected TagName at position %d for %q; got %q; want %q", i, s, cd.TagName, cdExpected.TagName)
+			}
+			if cd.MetricName != cdExpected.MetricName {
+				t.Fatalf("unexpected MetricName at position %d for %q; got %q; want %q", i, s, cd.MetricName, cdExpected.MetricName)
+			}
+			if (cd.ParseTimestamp == nil) != (cdExpected.ParseTimestamp == nil) {
+				t.Fatalf("unexpected ParseTimestamp at position %d for %q; got nil=%v; want nil=%v",
+					i, s, cd.ParseTimestamp == nil, cdExpected.ParseTimestamp == nil)
+			}
+		}
+	}
+
+	f("1:metric:foo", []ColumnDescriptor{
+		{
+			MetricName: "foo",
+		},
+	})
+	f("1:time:unix_s,2:label:host,3:metric:temperature", []ColumnDescriptor{
+		{
+			ParseTimestamp: parseUnixTimestampSeconds,
+		},
+		{
+			TagName: "host",
+		},
+		{
+			MetricName: "temperature",
+		},
+	})
+
+	// Skipped columns
+	f("3:metric:bar,1:label:foo", []ColumnDescriptor{
+		{
+			TagName: "foo",
+		},
+		{},
+		{
+			MetricName: "bar",
+		},
+	})
+
+	// Multiple metric columns
+	f("1:metric:foo,2:metric:bar,4:time:rfc3339", []ColumnDescriptor{
+		{
+			MetricName: "foo",
+		},
+		{
+			MetricName: "bar",
+		},
+		{},
+		{
+			ParseTimestamp: parseRFC3339,
+		},
+	})
+}
+
+func TestParseColumnDescriptorsFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		cds, err := ParseColumnDescriptors(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error for ParseColumnDescriptors(%q)", s)
+		}
+		if cds != nil {
+			t.Fatalf("expecting nil cds; got %v", cds)
+		}
+	}
+
+	// Empty string
+	f("")
+
+	// Missing metric column
+	f("1:time:unix_s")
+	f("1:label:foo")
+
+	// Invalid column position
+	f("foo:metric:bar")
+	f("0:metric:bar")
+	f("-1:metric:bar")
+	f("1000000:metric:bar")
+
+	// Duplicate column position
+	f("1:metric:foo,1:label:bar")
+
+	// Invalid column type
+	f("1:foobar:x")
+
+	// Missing extension
+	f("1:metric")
+	f("1:metric:")
+	f("1:label:,2:metric:foo")
+
+	// Invalid time format
+	f("1:time:foobar,2:metric:x")
+
+	// Duplicate time column
+	f("1:time:unix_s,2:time:unix_ms,3:metric:x")
+}
+
+func TestParseTimestamp(t *testing.T) {
+	f := func(parseTimestamp func(s string) (int64, error), s string, tsExpected int64) {
+		t.Helper()
+		ts, err := parseTimestamp(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if ts != tsExpected {
+			t.Fatalf("unexpected timestamp for %q; got %d; want %d", s, ts, tsExpected)
+		}
+	}
+
+	f(parseUnixTimestampSeconds, "1600000000", 1600000000000)
+	f(parseUnixTimestampSeconds, "1600000000.123", 1600000000123)
+	f(parseUnixTimestampSeconds, "0", 0)
+	f(parseUnixTimestampMilliseconds, "1600000000123", 1600000000123)
+	f(parseUnixTimestampNanoseconds, "1600000000123000000", 1600000000123)
+	f(parseRFC3339, "2020-09-13T12:26:40Z", 1600000000000)
+	f(parseRFC3339, "2020-09-13T14:26:40.123+02:00", 1600000000123)
+
+	fe := func(parseTimestamp func(s string) (int64, error), s string) {
+		t.Helper()
+		if _, err := parseTimestamp(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	fe(parseUnixTimestampSeconds, "")
+	fe(parseUnixTimestampSeconds, "foo")
+	fe(parseUnixTimestampSeconds, "1e30")
+	fe(parseUnixTimestampMilliseconds, "bar")
+	fe(parseUnixTimestampNanoseconds, "baz")
+	fe(parseRFC3339, "1600000000")
+}
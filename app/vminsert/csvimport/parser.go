@@ -0,0 +1,217 @@
+package csvimport
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rows contains parsed csv rows.
+type Rows struct {
+	Rows []Row
+
+	tagsPool   []Tag
+	fieldsPool []string
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Release references to objects, so they can be GC'ed.
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+
+	for i := range rs.fieldsPool {
+		rs.fieldsPool[i] = ""
+	}
+	rs.fieldsPool = rs.fieldsPool[:0]
+}
+
+// Unmarshal unmarshals csv lines from s according to the given cds.
+//
+// Every metric column in a csv line results in a separate row.
+// Rows with empty metric values are skipped.
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) Unmarshal(s string, cds []ColumnDescriptor) error {
+	rs.Reset()
+	for len(s) > 0 {
+		line := s
+		n := strings.IndexByte(s, '\n')
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) == 0 {
+			// Skip empty line
+			continue
+		}
+		if err := rs.unmarshalLine(line, cds); err != nil {
+			return fmt.Errorf("cannot parse csv line %q: %s", line, err)
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalLine(line string, cds []ColumnDescriptor) error {
+	fieldsStart := len(rs.fieldsPool)
+	var err error
+	rs.fieldsPool, err = appendFields(rs.fieldsPool, line)
+	if err != nil {
+		return err
+	}
+	fields := rs.fieldsPool[fieldsStart:]
+	if len(fields) < len(cds) {
+		return fmt.Errorf("too few columns; got %d; want at least %d", len(fields), len(cds))
+	}
+
+	// Collect timestamp and tags.
+	var timestamp int64
+	tagsStart := len(rs.tagsPool)
+	for i := range cds {
+		cd := &cds[i]
+		switch {
+		case cd.ParseTimestamp != nil:
+			ts, err := cd.ParseTimestamp(fields[i])
+			if err != nil {
+				return fmt.Errorf("cannot parse timestamp from column #%d: %s", i+1, err)
+			}
+			timestamp = ts
+		case cd.TagName != "":
+			if cap(rs.tagsPool) > len(rs.tagsPool) {
+				rs.tagsPool = rs.tagsPool[:len(rs.tagsPool)+1]
+			} else {
+				rs.tagsPool = append(rs.tagsPool, Tag{})
+			}
+			tag := &rs.tagsPool[len(rs.tagsPool)-1]
+			tag.Key = cd.TagName
+			tag.Value = fields[i]
+		}
+	}
+	var tags []Tag
+	if tagsNew := rs.tagsPool[tagsStart:]; len(tagsNew) > 0 {
+		tags = tagsNew[:len(tagsNew):len(tagsNew)]
+	}
+
+	// Create a row per each non-empty metric column.
+	for i := range cds {
+		cd := &cds[i]
+		if cd.MetricName == "" {
+			continue
+		}
+		s := fields[i]
+		if len(s) == 0 {
+			// Skip missing value.
+			continue
+		}
+		v, err := parseFloat64(s)
+		if err != nil {
+			return fmt.Errorf("cannot parse metric value for %q from column #%d: %s", cd.MetricName, i+1, err)
+		}
+		if cap(rs.Rows) > len(rs.Rows) {
+			rs.Rows = rs.Rows[:len(rs.Rows)+1]
+		} else {
+			rs.Rows = append(rs.Rows, Row{})
+		}
+		r := &rs.Rows[len(rs.Rows)-1]
+		r.Metric = cd.MetricName
+		r.Tags = tags
+		r.Value = v
+		r.Timestamp = timestamp
+	}
+	return nil
+}
+
+// appendFields appends comma-separated fields from line to dst and returns the result.
+//
+// Fields may be enclosed in double quotes. Double quotes inside quoted fields
+// must be escaped with another double quote.
+func appendFields(dst []string, line string) ([]string, error) {
+	for {
+		if len(line) > 0 && line[0] == '"' {
+			field, tail, err := readQuotedField(line[1:])
+			if err != nil {
+				return dst, err
+			}
+			dst = append(dst, field)
+			if len(tail) == 0 {
+				return dst, nil
+			}
+			if tail[0] != ',' {
+				return dst, fmt.Errorf("missing comma after quoted field %q", field)
+			}
+			line = tail[1:]
+			continue
+		}
+		n := strings.IndexByte(line, ',')
+		if n < 0 {
+			return append(dst, line), nil
+		}
+		dst = append(dst, line[:n])
+		line = line[n+1:]
+	}
+}
+
+// readQuotedField reads quoted field from s, which starts after the opening quote.
+//
+// It returns the unquoted field and the tail after the closing quote.
+func readQuotedField(s string) (string, string, error) {
+	n := strings.IndexByte(s, '"')
+	if n < 0 {
+		return "", s, fmt.Errorf("missing closing quote for %q", s)
+	}
+	if n+1 >= len(s) || s[n+1] != '"' {
+		// Fast path - the field has no escaped quotes.
+		return s[:n], s[n+1:], nil
+	}
+
+	// Slow path - unescape double quotes.
+	var b []byte
+	for {
+		b = append(b, s[:n+1]...)
+		s = s[n+2:]
+		n = strings.IndexByte(s, '"')
+		if n < 0 {
+			return "", s, fmt.Errorf("missing closing quote for %q", s)
+		}
+		if n+1 >= len(s) || s[n+1] != '"' {
+			b = append(b, s[:n]...)
+			return string(b), s[n+1:], nil
+		}
+	}
+}
+
+// Row represents a single metric row.
+type Row struct {
+	Metric    string
+	Tags      []Tag
+	Value     float64
+	Timestamp int64
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Value = 0
+	r.Timestamp = 0
+}
+
+// Tag represents metric tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
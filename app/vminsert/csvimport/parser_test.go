@@ -0,0 +1,180 @@
+package csvimport
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(format, s string) {
+		t.Helper()
+		cds, err := ParseColumnDescriptors(format)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", format, err)
+		}
+		var rs Rows
+		if err := rs.Unmarshal(s, cds); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+
+		// Try again
+		if err := rs.Unmarshal(s, cds); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+
+	// Too few columns
+	f("3:metric:foo", "1,2")
+	f("1:metric:foo,2:label:bar", "123")
+
+	// Invalid value
+	f("1:metric:foo", "bar")
+
+	// Invalid timestamp
+	f("1:metric:foo,2:time:unix_s", "123,foobar")
+	f("1:metric:foo,2:time:rfc3339", "123,1600000000")
+	f("1:metric:foo,2:time:unix_ms", "123,")
+
+	// Invalid quotes
+	f("1:metric:foo,2:label:bar", `123,"baz`)
+	f("1:metric:foo,2:label:bar", `123,"baz"x`)
+	f("1:metric:foo,2:label:bar", `123,"baz""`)
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(format, s string, rowsExpected []Row) {
+		t.Helper()
+		cds, err := ParseColumnDescriptors(format)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", format, err)
+		}
+		var rs Rows
+		if err := rs.Unmarshal(s, cds); err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rs.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v\nwant\n%+v", rs.Rows, rowsExpected)
+		}
+
+		// Try unmarshaling again
+		if err := rs.Unmarshal(s, cds); err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rs.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v\nwant\n%+v", rs.Rows, rowsExpected)
+		}
+
+		rs.Reset()
+		if len(rs.Rows) != 0 {
+			t.Fatalf("non-empty rows after reset: %+v", rs.Rows)
+		}
+	}
+
+	// Empty lines
+	f("1:metric:foo", "", nil)
+	f("1:metric:foo", "\n\r\n", nil)
+
+	// Single metric
+	f("1:metric:foo", "123", []Row{{
+		Metric: "foo",
+		Value:  123,
+	}})
+	f("1:time:unix_s,2:label:host,3:metric:temperature", "1600000000,foo.bar,12.5\n1600000001,baz,-3\r\n", []Row{
+		{
+			Metric: "temperature",
+			Tags: []Tag{{
+				Key:   "host",
+				Value: "foo.bar",
+			}},
+			Value:     12.5,
+			Timestamp: 1600000000000,
+		},
+		{
+			Metric: "temperature",
+			Tags: []Tag{{
+				Key:   "host",
+				Value: "baz",
+			}},
+			Value:     -3,
+			Timestamp: 1600000001000,
+		},
+	})
+
+	// Various timestamp units
+	f("1:metric:foo,2:time:unix_ms", "1,1600000000123", []Row{{
+		Metric:    "foo",
+		Value:     1,
+		Timestamp: 1600000000123,
+	}})
+	f("1:metric:foo,2:time:rfc3339", "1,2020-09-13T12:26:40Z", []Row{{
+		Metric:    "foo",
+		Value:     1,
+		Timestamp: 1600000000000,
+	}})
+
+	// Multiple metric columns with ignored columns
+	f("2:metric:foo,4:metric:bar,5:label:x", "skip,1,skip,2,y,extra", []Row{
+		{
+			Metric: "foo",
+			Tags: []Tag{{
+				Key:   "x",
+				Value: "y",
+			}},
+			Value: 1,
+		},
+		{
+			Metric: "bar",
+			Tags: []Tag{{
+				Key:   "x",
+				Value: "y",
+			}},
+			Value: 2,
+		},
+	})
+
+	// Missing value cells must be skipped
+	f("1:metric:foo,2:label:x", ",y\n2,z", []Row{{
+		Metric: "foo",
+		Tags: []Tag{{
+			Key:   "x",
+			Value: "z",
+		}},
+		Value: 2,
+	}})
+	f("1:metric:foo,2:metric:bar", ",2\n3,", []Row{
+		{
+			Metric: "bar",
+			Value:  2,
+		},
+		{
+			Metric: "foo",
+			Value:  3,
+		},
+	})
+
+	// Empty label values
+	f("1:metric:foo,2:label:x", "1,", []Row{{
+		Metric: "foo",
+		Tags: []Tag{{
+			Key:   "x",
+			Value: "",
+		}},
+		Value: 1,
+	}})
+
+	// Quoted fields
+	f("1:metric:foo,2:label:x,3:label:y", `"1.5","a,b","c""d"""`, []Row{{
+		Metric: "foo",
+		Tags: []Tag{
+			{
+				Key:   "x",
+				Value: "a,b",
+			},
+			{
+				Key:   "y",
+				Value: `c"d"`,
+			},
+		},
+		Value: 1.5,
+	}})
+}
@@ -0,0 +1,206 @@
+package csvimport
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="csv"}`)
+
+// InsertHandler processes csv data from req.
+//
+// The columns are described in `format` query arg. See ParseColumnDescriptors for details.
+// The number of ingested rows is written to w on success.
+//
+// maxSize limits the size of the request body after decompression.
+func InsertHandler(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	return concurrencylimiter.Do(func() error {
+		return insertHandlerInternal(w, req, maxSize)
+	})
+}
+
+func insertHandlerInternal(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	csvReadCalls.Inc()
+
+	// Do not use req.FormValue, since it may read the request body.
+	format := req.URL.Query().Get("format")
+	if len(format) == 0 {
+		return fmt.Errorf("missing `format` query arg")
+	}
+	cds, err := ParseColumnDescriptors(format)
+	if err != nil {
+		return fmt.Errorf("cannot parse `format` query arg %q: %s", format, err)
+	}
+
+	r := req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := getGzipReader(r)
+		if err != nil {
+			return fmt.Errorf("cannot read gzipped csv data: %s", err)
+		}
+		defer putGzipReader(zr)
+		r = zr
+	}
+	mr := common.NewMaxSizeReader(r, maxSize)
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(req))
+	ctx.Common.SetAccountID(tenant.GetAccountID(req.Context()))
+	for ctx.Read(mr, cds) {
+		if err := ctx.InsertRows(); err != nil {
+			return err
+		}
+	}
+	if err := mr.Err(); err != nil {
+		return err
+	}
+	if err := ctx.Error(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status":"success","rowsInserted":%d}`, ctx.rowsInserted)
+	return nil
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	ic := &ctx.Common
+	ic.Reset(len(rows))
+	for i := range rows {
+		r := &rows[i]
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		ic.WriteDataPoint(nil, ic.Labels, r.Timestamp, r.Value)
+	}
+	rowsInserted.Add(len(rows))
+	ctx.rowsInserted += len(rows)
+	return ic.FlushBufs()
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	v := gzipReaderPool.Get()
+	if v == nil {
+		return gzip.NewReader(r)
+	}
+	zr := v.(*gzip.Reader)
+	if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+func putGzipReader(zr *gzip.Reader) {
+	_ = zr.Close()
+	gzipReaderPool.Put(zr)
+}
+
+var gzipReaderPool sync.Pool
+
+func (ctx *pushCtx) Read(r io.Reader, cds []ColumnDescriptor) bool {
+	if ctx.err != nil {
+		return false
+	}
+	ctx.reqBuf, ctx.tailBuf, ctx.err = common.ReadLinesBlock(r, ctx.reqBuf, ctx.tailBuf)
+	if ctx.err != nil {
+		if ctx.err != io.EOF {
+			csvReadErrors.Inc()
+			ctx.err = fmt.Errorf("cannot read csv data: %s", ctx.err)
+		}
+		return false
+	}
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf), cds); err != nil {
+		csvUnmarshalErrors.Inc()
+		ctx.err = fmt.Errorf("cannot unmarshal csv data with size %d: %s", len(ctx.reqBuf), err)
+		return false
+	}
+
+	// Set missing timestamps to the current time.
+	currentTs := time.Now().UnixNano() / 1e6
+	for i := range ctx.Rows.Rows {
+		row := &ctx.Rows.Rows[i]
+		if row.Timestamp == 0 {
+			row.Timestamp = currentTs
+		}
+	}
+	return true
+}
+
+var (
+	csvReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="csv"}`)
+	csvReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="csv"}`)
+	csvUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="csv"}`)
+)
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf  []byte
+	tailBuf []byte
+
+	rowsInserted int
+
+	err error
+}
+
+func (ctx *pushCtx) Error() error {
+	if ctx.err == io.EOF {
+		return nil
+	}
+	return ctx.err
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
+
+	ctx.reqBuf = ctx.reqBuf[:0]
+	ctx.tailBuf = ctx.tailBuf[:0]
+
+	ctx.rowsInserted = 0
+
+	ctx.err = nil
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
@@ -0,0 +1,193 @@
+package datadog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/valyala/fastjson"
+)
+
+// Request represents DataDog submit metrics request.
+//
+// See https://docs.datadoghq.com/api/latest/metrics/#submit-metrics
+type Request struct {
+	Series []Series
+
+	pointsPool []Point
+	tagsPool   []string
+}
+
+// Reset resets req.
+func (req *Request) Reset() {
+	// Release references to objects, so they can be GC'ed.
+
+	for i := range req.Series {
+		req.Series[i].reset()
+	}
+	req.Series = req.Series[:0]
+
+	req.pointsPool = req.pointsPool[:0]
+
+	for i := range req.tagsPool {
+		req.tagsPool[i] = ""
+	}
+	req.tagsPool = req.tagsPool[:0]
+}
+
+// Unmarshal unmarshals DataDog series from v.
+//
+// v must be unchanged until req is in use.
+func (req *Request) Unmarshal(v *fastjson.Value) error {
+	req.Reset()
+	if v.Type() != fastjson.TypeObject {
+		return fmt.Errorf("expecting JSON object; got %s", v.Type())
+	}
+	sv := v.Get("series")
+	if sv == nil {
+		return fmt.Errorf("missing `series`")
+	}
+	a, err := sv.Array()
+	if err != nil {
+		return fmt.Errorf("invalid `series`: %s", err)
+	}
+	for i, o := range a {
+		dst := req.Series
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Series{})
+		}
+		s := &dst[len(dst)-1]
+		req.Series = dst
+		if err := req.unmarshalSeries(s, o); err != nil {
+			return fmt.Errorf("cannot unmarshal series #%d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+func (req *Request) unmarshalSeries(s *Series, o *fastjson.Value) error {
+	s.reset()
+	if o.Type() != fastjson.TypeObject {
+		return fmt.Errorf("expecting JSON object; got %s", o.Type())
+	}
+	metric, err := getString(o, "metric")
+	if err != nil {
+		return err
+	}
+	if len(metric) == 0 {
+		return fmt.Errorf("`metric` cannot be empty")
+	}
+	s.Metric = metric
+	if s.Host, err = getString(o, "host"); err != nil {
+		return err
+	}
+	if s.Device, err = getString(o, "device"); err != nil {
+		return err
+	}
+
+	if pv := o.Get("points"); pv != nil {
+		points, err := pv.Array()
+		if err != nil {
+			return fmt.Errorf("invalid `points`: %s", err)
+		}
+		pointsStart := len(req.pointsPool)
+		for _, p := range points {
+			pa, err := p.Array()
+			if err != nil {
+				return fmt.Errorf("invalid point: %s", err)
+			}
+			if len(pa) != 2 {
+				return fmt.Errorf("unexpected number of items in the point; got %d; want 2", len(pa))
+			}
+			ts, err := pa[0].Float64()
+			if err != nil {
+				return fmt.Errorf("invalid point timestamp: %s", err)
+			}
+			value, err := pa[1].Float64()
+			if err != nil {
+				return fmt.Errorf("invalid point value: %s", err)
+			}
+			req.pointsPool = append(req.pointsPool, Point{
+				Timestamp: ts,
+				Value:     value,
+			})
+		}
+		pointsNew := req.pointsPool[pointsStart:]
+		s.Points = pointsNew[:len(pointsNew):len(pointsNew)]
+	}
+
+	if tv := o.Get("tags"); tv != nil && tv.Type() != fastjson.TypeNull {
+		tags, err := tv.Array()
+		if err != nil {
+			return fmt.Errorf("invalid `tags`: %s", err)
+		}
+		tagsStart := len(req.tagsPool)
+		for _, t := range tags {
+			tag, err := t.StringBytes()
+			if err != nil {
+				return fmt.Errorf("invalid tag: %s", err)
+			}
+			req.tagsPool = append(req.tagsPool, bytesutil.ToUnsafeString(tag))
+		}
+		tagsNew := req.tagsPool[tagsStart:]
+		s.Tags = tagsNew[:len(tagsNew):len(tagsNew)]
+	}
+	return nil
+}
+
+// getString returns string value for the given key in o.
+//
+// An empty string is returned if the key is missing or contains null.
+func getString(o *fastjson.Value, key string) (string, error) {
+	v := o.Get(key)
+	if v == nil || v.Type() == fastjson.TypeNull {
+		return "", nil
+	}
+	b, err := v.StringBytes()
+	if err != nil {
+		return "", fmt.Errorf("invalid `%s`: %s", key, err)
+	}
+	return bytesutil.ToUnsafeString(b), nil
+}
+
+// Series is a single DataDog time series.
+type Series struct {
+	Metric string
+	Host   string
+	Device string
+	Points []Point
+
+	// Tags contain tags in the form `tag:value` or `tag`.
+	//
+	// Use SplitTag for obtaining the tag name and value.
+	Tags []string
+}
+
+func (s *Series) reset() {
+	s.Metric = ""
+	s.Host = ""
+	s.Device = ""
+	s.Points = nil
+	s.Tags = nil
+}
+
+// Point is a single DataDog point.
+type Point struct {
+	// Timestamp is the point timestamp in seconds.
+	Timestamp float64
+	Value     float64
+}
+
+// SplitTag splits DataDog tag into tag name and tag value.
+//
+// Tags without value, i.e. `tag` instead of `tag:value`, are returned
+// with `no_label_value` value, since labels with empty values are ignored by VictoriaMetrics.
+func SplitTag(tag string) (string, string) {
+	n := strings.IndexByte(tag, ':')
+	if n < 0 {
+		return tag, "no_label_value"
+	}
+	return tag[:n], tag[n+1:]
+}
@@ -0,0 +1,157 @@
+package datadog
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+func TestRequestUnmarshalFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var req Request
+		v, err := fastjson.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %s: %s", s, err)
+		}
+		if err := req.Unmarshal(v); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s", s)
+		}
+
+		// Try again
+		if err := req.Unmarshal(v); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s", s)
+		}
+	}
+
+	// Invalid json type
+	f(`1`)
+	f(`[]`)
+	f(`null`)
+
+	// Missing or invalid series
+	f(`{}`)
+	f(`{"series":1}`)
+	f(`{"series":[1]}`)
+
+	// Invalid metric
+	f(`{"series":[{"points":[[1,2]]}]}`)
+	f(`{"series":[{"metric":"","points":[[1,2]]}]}`)
+	f(`{"series":[{"metric":123,"points":[[1,2]]}]}`)
+
+	// Invalid host
+	f(`{"series":[{"metric":"foo","host":1}]}`)
+
+	// Invalid points
+	f(`{"series":[{"metric":"foo","points":1}]}`)
+	f(`{"series":[{"metric":"foo","points":[1]}]}`)
+	f(`{"series":[{"metric":"foo","points":[[1]]}]}`)
+	f(`{"series":[{"metric":"foo","points":[[1,2,3]]}]}`)
+	f(`{"series":[{"metric":"foo","points":[["1",2]]}]}`)
+	f(`{"series":[{"metric":"foo","points":[[1,"2"]]}]}`)
+
+	// Invalid tags
+	f(`{"series":[{"metric":"foo","tags":"a:b"}]}`)
+	f(`{"series":[{"metric":"foo","tags":[1]}]}`)
+}
+
+func TestRequestUnmarshalSuccess(t *testing.T) {
+	f := func(s string, reqExpected *Request) {
+		t.Helper()
+		var req Request
+		v, err := fastjson.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %s: %s", s, err)
+		}
+		if err := req.Unmarshal(v); err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		if !reflect.DeepEqual(req.Series, reqExpected.Series) {
+			t.Fatalf("unexpected series when parsing %s;\ngot\n%+v\nwant\n%+v", s, req.Series, reqExpected.Series)
+		}
+
+		// Try unmarshaling again
+		if err := req.Unmarshal(v); err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		if !reflect.DeepEqual(req.Series, reqExpected.Series) {
+			t.Fatalf("unexpected series when parsing %s;\ngot\n%+v\nwant\n%+v", s, req.Series, reqExpected.Series)
+		}
+	}
+
+	// Empty series
+	f(`{"series":[]}`, &Request{})
+
+	// Minimal series
+	f(`{"series":[{"metric":"foo"}]}`, &Request{
+		Series: []Series{{
+			Metric: "foo",
+		}},
+	})
+
+	// Full series
+	f(`{
+		"series": [
+			{
+				"host": "test.example.com",
+				"interval": 20,
+				"metric": "system.load.1",
+				"points": [[1575317847, 0.5], [1575317867.5, 1]],
+				"tags": ["environment:test", "bare", "url:http://foo"],
+				"type": "rate",
+				"device": "sda1"
+			},
+			{
+				"metric": "bar",
+				"host": null,
+				"tags": null,
+				"points": [[1575317847, -2.5]]
+			}
+		]
+	}`, &Request{
+		Series: []Series{
+			{
+				Metric: "system.load.1",
+				Host:   "test.example.com",
+				Device: "sda1",
+				Points: []Point{
+					{
+						Timestamp: 1575317847,
+						Value:     0.5,
+					},
+					{
+						Timestamp: 1575317867.5,
+						Value:     1,
+					},
+				},
+				Tags: []string{"environment:test", "bare", "url:http://foo"},
+			},
+			{
+				Metric: "bar",
+				Points: []Point{{
+					Timestamp: 1575317847,
+					Value:     -2.5,
+				}},
+			},
+		},
+	})
+}
+
+func TestSplitTag(t *testing.T) {
+	f := func(tag, nameExpected, valueExpected string) {
+		t.Helper()
+		name, value := SplitTag(tag)
+		if name != nameExpected {
+			t.Fatalf("unexpected tag name for %q; got %q; want %q", tag, name, nameExpected)
+		}
+		if value != valueExpected {
+			t.Fatalf("unexpected tag value for %q; got %q; want %q", tag, value, valueExpected)
+		}
+	}
+	f("foo:bar", "foo", "bar")
+	f("url:http://foo:80", "url", "http://foo:80")
+	f("foo:", "foo", "")
+	f("foo", "foo", "no_label_value")
+	f("", "", "no_label_value")
+}
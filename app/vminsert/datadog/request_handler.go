@@ -0,0 +1,212 @@
+package datadog
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/valyala/fastjson"
+)
+
+var metricNamePrefix = flag.String("datadog.metricNamePrefix", "", "Optional prefix to add to metric names ingested via DataDog protocol")
+
+var rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="datadog"}`)
+
+// InsertHandler processes DataDog submit metrics requests.
+//
+// See https://docs.datadoghq.com/api/latest/metrics/#submit-metrics
+func InsertHandler(req *http.Request, maxSize int64) error {
+	return concurrencylimiter.Do(func() error {
+		return insertHandlerInternal(req, maxSize)
+	})
+}
+
+func insertHandlerInternal(req *http.Request, maxSize int64) error {
+	datadogReadCalls.Inc()
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(req))
+	ctx.Common.SetAccountID(tenant.GetAccountID(req.Context()))
+	if err := ctx.Read(req, maxSize); err != nil {
+		return err
+	}
+	return ctx.InsertRows()
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	series := ctx.Request.Series
+	rowsLen := 0
+	for i := range series {
+		rowsLen += len(series[i].Points)
+	}
+	ic := &ctx.Common
+	ic.Reset(rowsLen)
+	for i := range series {
+		s := &series[i]
+		ic.Labels = ic.Labels[:0]
+		ctx.metricNameBuf = append(ctx.metricNameBuf[:0], *metricNamePrefix...)
+		ctx.metricNameBuf = append(ctx.metricNameBuf, s.Metric...)
+		ic.AddLabel("", bytesutil.ToUnsafeString(ctx.metricNameBuf))
+		if s.Host != "" {
+			ic.AddLabel("host", s.Host)
+		}
+		if s.Device != "" {
+			ic.AddLabel("device", s.Device)
+		}
+		for _, tag := range s.Tags {
+			name, value := SplitTag(tag)
+			if name == "host" && s.Host != "" {
+				// The `host` label is already set above.
+				continue
+			}
+			ic.AddLabel(name, value)
+		}
+		var metricNameRaw []byte
+		for _, pt := range s.Points {
+			timestamp := int64(pt.Timestamp * 1000)
+			metricNameRaw = ic.WriteDataPointExt(metricNameRaw, ic.Labels, timestamp, pt.Value)
+		}
+	}
+	rowsInserted.Add(rowsLen)
+	return ic.FlushBufs()
+}
+
+func (ctx *pushCtx) Read(req *http.Request, maxSize int64) error {
+	var err error
+	ctx.reqBuf, err = readBody(ctx.reqBuf[:0], req, maxSize)
+	if err != nil {
+		datadogReadErrors.Inc()
+		if _, ok := err.(*httpserver.ErrorWithStatusCode); ok {
+			// Do not wrap the error, so the client receives its status code.
+			return err
+		}
+		return fmt.Errorf("cannot read DataDog series data: %s", err)
+	}
+	v, err := ctx.parser.ParseBytes(ctx.reqBuf)
+	if err != nil {
+		datadogUnmarshalErrors.Inc()
+		return fmt.Errorf("cannot parse DataDog series data with size %d: %s", len(ctx.reqBuf), err)
+	}
+	if err := ctx.Request.Unmarshal(v); err != nil {
+		datadogUnmarshalErrors.Inc()
+		return fmt.Errorf("cannot unmarshal DataDog series data with size %d: %s", len(ctx.reqBuf), err)
+	}
+	return nil
+}
+
+// readBody appends the request body from req to dst and returns the result.
+//
+// The body is transparently decompressed if it has `Content-Encoding: deflate`
+// (used by DataDog agent) or `Content-Encoding: gzip`.
+func readBody(dst []byte, req *http.Request, maxSize int64) ([]byte, error) {
+	r := io.Reader(req.Body)
+	switch req.Header.Get("Content-Encoding") {
+	case "deflate":
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return dst, fmt.Errorf("cannot read deflated data: %s", err)
+		}
+		defer func() {
+			_ = zr.Close()
+		}()
+		r = zr
+	case "gzip":
+		zr, err := getGzipReader(r)
+		if err != nil {
+			return dst, fmt.Errorf("cannot read gzipped data: %s", err)
+		}
+		defer putGzipReader(zr)
+		r = zr
+	}
+	bb := bytesutil.ByteBuffer{
+		B: dst,
+	}
+	mr := common.NewMaxSizeReader(r, maxSize)
+	if _, err := io.Copy(&bb, mr); err != nil {
+		if mrErr := mr.Err(); mrErr != nil {
+			return bb.B, mrErr
+		}
+		return bb.B, err
+	}
+	return bb.B, nil
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	v := gzipReaderPool.Get()
+	if v == nil {
+		return gzip.NewReader(r)
+	}
+	zr := v.(*gzip.Reader)
+	if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+func putGzipReader(zr *gzip.Reader) {
+	_ = zr.Close()
+	gzipReaderPool.Put(zr)
+}
+
+var gzipReaderPool sync.Pool
+
+var (
+	datadogReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="datadog"}`)
+	datadogReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="datadog"}`)
+	datadogUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="datadog"}`)
+)
+
+type pushCtx struct {
+	Request Request
+	Common  common.InsertCtx
+
+	parser        fastjson.Parser
+	reqBuf        []byte
+	metricNameBuf []byte
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Request.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
+	ctx.reqBuf = ctx.reqBuf[:0]
+	ctx.metricNameBuf = ctx.metricNameBuf[:0]
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
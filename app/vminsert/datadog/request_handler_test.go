@@ -0,0 +1,144 @@
+package datadog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+)
+
+func TestReadBodySuccess(t *testing.T) {
+	f := func(body []byte, contentEncoding, bodyExpected string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://localhost/api/v1/series", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		b, err := readBody(nil, req, 1024)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(b) != bodyExpected {
+			t.Fatalf("unexpected body; got %q; want %q", b, bodyExpected)
+		}
+	}
+
+	s := `{"series":[{"metric":"foo","points":[[123,1]],"tags":["a:b"]}]}`
+	f([]byte(s), "", s)
+	f(deflateData(s), "deflate", s)
+	f(gzipData(s), "gzip", s)
+	f(nil, "", "")
+}
+
+func TestReadBodyFailure(t *testing.T) {
+	f := func(body []byte, contentEncoding string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://localhost/api/v1/series", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		if _, err := readBody(nil, req, 10); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Too big body
+	f([]byte("01234567890"), "")
+	f(deflateData("01234567890"), "deflate")
+	f(gzipData("01234567890"), "gzip")
+
+	// Invalid compressed data
+	f([]byte("foobar"), "deflate")
+	f([]byte("foobar"), "gzip")
+
+	// Truncated compressed data
+	data := deflateData("foobar")
+	f(data[:len(data)-3], "deflate")
+	data = gzipData("foobar")
+	f(data[:len(data)-5], "gzip")
+}
+
+func TestReadBodyTooBig(t *testing.T) {
+	f := func(body []byte, contentEncoding string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://localhost/api/v1/series", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		_, err = readBody(nil, req, 1024)
+		esc, ok := err.(*httpserver.ErrorWithStatusCode)
+		if !ok {
+			t.Fatalf("unexpected error; got %v; want %T", err, esc)
+		}
+		if esc.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("unexpected status code; got %d; want %d", esc.StatusCode, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	// The limit applies to decompressed data
+	s := strings.Repeat("x", 1025)
+	f([]byte(s), "")
+	f(deflateData(s), "deflate")
+	f(gzipData(s), "gzip")
+}
+
+func TestInsertHandlerTooBigRequest(t *testing.T) {
+	s := strings.Repeat("x", 1025)
+	f := func(body []byte, contentEncoding string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/datadog/api/v1/series", bytes.NewReader(body))
+		if contentEncoding != "" {
+			r.Header.Set("Content-Encoding", contentEncoding)
+		}
+		err := insertHandlerInternal(r, 1024)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		w := httptest.NewRecorder()
+		httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	f([]byte(s), "")
+	f(gzipData(s), "gzip")
+}
+
+func deflateData(s string) []byte {
+	var bb bytes.Buffer
+	zw := zlib.NewWriter(&bb)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return bb.Bytes()
+}
+
+func gzipData(s string) []byte {
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return bb.Bytes()
+}
@@ -0,0 +1,467 @@
+package graphite
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+var aggrConfig = flag.String("graphite.aggrConfig", "", "Optional path to YAML file with carbon-style aggregation rules for metrics ingested via Graphite plaintext protocol. "+
+	"Metrics matching a rule are aggregated over its interval before being stored. The file is re-read on SIGHUP")
+
+// aggrFlushDelay is the delay for flushing the aggregated intervals after their end.
+//
+// It gives a chance for samples buffered by clients and by Read to reach the aggregation.
+const aggrFlushDelay = 2 * flushTimeout
+
+// AggrRule is a carbon-style aggregation rule for Graphite metrics.
+//
+// It is similar to a section from carbon's storage-aggregation.conf.
+type AggrRule struct {
+	// Pattern is a regexp for matching Graphite metric names.
+	Pattern string `yaml:"pattern"`
+
+	// Method is the aggregation method. Supported methods: sum, avg, min, max, last.
+	Method string `yaml:"method"`
+
+	// Interval is the aggregation interval. The intervals are aligned to wall-clock boundaries.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// InitAggr initializes aggregation for Graphite metrics if -graphite.aggrConfig is set.
+//
+// MustStopAggr must be called when the aggregation is no longer needed.
+func InitAggr() {
+	if len(*aggrConfig) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(*aggrConfig)
+	if err != nil {
+		logger.Fatalf("cannot read -graphite.aggrConfig=%q: %s", *aggrConfig, err)
+	}
+	var prev aggregators
+	as, err := prev.reload(data, pushAggregatedRows)
+	if err != nil {
+		logger.Fatalf("cannot load -graphite.aggrConfig=%q: %s", *aggrConfig, err)
+	}
+	globalAggregators = as
+
+	sighupCh := procutil.NewSighupChan()
+	aggrReloaderWG.Add(1)
+	go func() {
+		defer aggrReloaderWG.Done()
+		for {
+			select {
+			case <-aggrReloaderStopCh:
+				return
+			case <-sighupCh:
+			}
+			logger.Infof("SIGHUP received; reloading -graphite.aggrConfig=%q", *aggrConfig)
+			if err := reloadAggr(); err != nil {
+				logger.Errorf("cannot reload -graphite.aggrConfig=%q; continuing using the previous config: %s", *aggrConfig, err)
+			}
+		}
+	}()
+}
+
+func reloadAggr() error {
+	data, err := ioutil.ReadFile(*aggrConfig)
+	if err != nil {
+		return err
+	}
+	globalAggregatorsLock.RLock()
+	asPrev := globalAggregators
+	globalAggregatorsLock.RUnlock()
+	as, err := asPrev.reload(data, pushAggregatedRows)
+	if err != nil {
+		return err
+	}
+
+	// Wait for in-flight pushes to asPrev while swapping the aggregators, so removed aggregators can be stopped safely.
+	globalAggregatorsLock.Lock()
+	globalAggregators = as
+	globalAggregatorsLock.Unlock()
+	asPrev.mustStopRemoved(as)
+	logger.Infof("successfully reloaded -graphite.aggrConfig=%q", *aggrConfig)
+	return nil
+}
+
+// MustStopAggr stops the aggregation and flushes the aggregated state including incomplete intervals.
+func MustStopAggr() {
+	if len(*aggrConfig) == 0 {
+		return
+	}
+	close(aggrReloaderStopCh)
+	aggrReloaderWG.Wait()
+	globalAggregatorsLock.Lock()
+	as := globalAggregators
+	globalAggregators = nil
+	globalAggregatorsLock.Unlock()
+	as.mustStop()
+}
+
+var (
+	// globalAggregatorsLock protects globalAggregators. It is held in read mode during pushes to globalAggregators,
+	// so the aggregators aren't stopped while they are in use.
+	globalAggregatorsLock sync.RWMutex
+	globalAggregators     *aggregators
+
+	aggrReloaderStopCh = make(chan struct{})
+	aggrReloaderWG     sync.WaitGroup
+)
+
+// pushAggr pushes rows to the aggregation if it is enabled and returns rows, which must be stored.
+func pushAggr(rows []Row) []Row {
+	globalAggregatorsLock.RLock()
+	defer globalAggregatorsLock.RUnlock()
+	if globalAggregators == nil {
+		return rows
+	}
+	return globalAggregators.push(rows)
+}
+
+func pushAggregatedRows(rows []Row) {
+	var ic common.InsertCtx
+	ic.Reset(len(rows))
+	for i := range rows {
+		r := &rows[i]
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		ic.WriteDataPoint(nil, ic.Labels, r.Timestamp, r.Value)
+	}
+	rowsInserted.Add(len(rows))
+	if err := ic.FlushBufs(); err != nil {
+		logger.Errorf("cannot store aggregated Graphite metrics: %s", err)
+	}
+}
+
+// aggregators aggregates Graphite rows according to the list of rules.
+//
+// The first matching rule wins.
+type aggregators struct {
+	as []*aggregator
+}
+
+// reload returns new aggregators for the given YAML data.
+//
+// The state of aggregators with unchanged rules is preserved in the returned aggregators.
+// The aggregators for removed rules remain running, so as may be used until in-flight push calls finish.
+// as.mustStopRemoved must be called with the returned aggregators after that. as remains unchanged on error.
+func (as *aggregators) reload(data []byte, pushFunc func(rows []Row)) (*aggregators, error) {
+	var rules []AggrRule
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("cannot parse aggregation rules: %s", err)
+	}
+	prevAggregators := make(map[AggrRule]*aggregator, len(as.as))
+	for _, ag := range as.as {
+		prevAggregators[ag.rule] = ag
+	}
+	var dst, newAggregators []*aggregator
+	reused := make(map[*aggregator]bool)
+	for i, rule := range rules {
+		if ag := prevAggregators[rule]; ag != nil && !reused[ag] {
+			reused[ag] = true
+			dst = append(dst, ag)
+			continue
+		}
+		ag, err := newAggregator(rule, pushFunc)
+		if err != nil {
+			for _, ag := range newAggregators {
+				ag.mustStop()
+			}
+			return nil, fmt.Errorf("cannot initialize rule #%d: %s", i+1, err)
+		}
+		dst = append(dst, ag)
+		newAggregators = append(newAggregators, ag)
+	}
+	return &aggregators{
+		as: dst,
+	}, nil
+}
+
+// mustStopRemoved stops aggregators from as, which are missing in asNew, and flushes their state.
+//
+// as mustn't be used after the call.
+func (as *aggregators) mustStopRemoved(asNew *aggregators) {
+	used := make(map[*aggregator]bool, len(asNew.as))
+	for _, ag := range asNew.as {
+		used[ag] = true
+	}
+	for _, ag := range as.as {
+		if !used[ag] {
+			ag.mustStop()
+		}
+	}
+}
+
+func (as *aggregators) mustStop() {
+	for _, ag := range as.as {
+		ag.mustStop()
+	}
+}
+
+// push pushes rows to as and returns rows, which don't match any rule.
+//
+// The returned rows are stored in rows.
+func (as *aggregators) push(rows []Row) []Row {
+	if len(as.as) == 0 {
+		return rows
+	}
+	dst := rows[:0]
+	for i := range rows {
+		r := &rows[i]
+		ag := as.getAggregator(r.Metric)
+		if ag == nil {
+			dst = append(dst, *r)
+			continue
+		}
+		ag.push(r)
+	}
+	return dst
+}
+
+func (as *aggregators) getAggregator(metric string) *aggregator {
+	for _, ag := range as.as {
+		if ag.re.MatchString(metric) {
+			return ag
+		}
+	}
+	return nil
+}
+
+type aggregator struct {
+	rule     AggrRule
+	re       *regexp.Regexp
+	interval int64
+
+	pushFunc func(rows []Row)
+
+	mu sync.Mutex
+	m  map[string]*aggrSeries
+
+	// flushedUntil is the end of the last flushed interval.
+	// Samples for the already flushed intervals are dropped.
+	flushedUntil int64
+
+	keyBuf []byte
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+type aggrSeries struct {
+	metric string
+	tags   []Tag
+
+	// states contains aggregation states for interval starts.
+	states map[int64]*aggrState
+}
+
+type aggrState struct {
+	sum           float64
+	count         uint64
+	min           float64
+	max           float64
+	last          float64
+	lastTimestamp int64
+}
+
+func newAggregator(rule AggrRule, pushFunc func(rows []Row)) (*aggregator, error) {
+	if len(rule.Pattern) == 0 {
+		return nil, fmt.Errorf("missing `pattern` option")
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `pattern: %q`: %s", rule.Pattern, err)
+	}
+	switch rule.Method {
+	case "sum", "avg", "min", "max", "last":
+	default:
+		return nil, fmt.Errorf("unsupported `method: %q`; supported methods: sum, avg, min, max, last", rule.Method)
+	}
+	if rule.Interval < time.Second {
+		return nil, fmt.Errorf("`interval` must be at least 1s; got %s", rule.Interval)
+	}
+	interval := rule.Interval.Nanoseconds() / 1e6
+	delay := aggrFlushDelay.Nanoseconds() / 1e6
+	ag := &aggregator{
+		rule:         rule,
+		re:           re,
+		interval:     interval,
+		pushFunc:     pushFunc,
+		m:            make(map[string]*aggrSeries),
+		flushedUntil: alignTimestamp(timestampFromTime(time.Now())-delay, interval),
+		stopCh:       make(chan struct{}),
+	}
+	ag.wg.Add(1)
+	go func() {
+		defer ag.wg.Done()
+		ag.runFlusher()
+	}()
+	return ag, nil
+}
+
+// alignTimestamp returns the start of the interval containing the given timestamp.
+//
+// Intervals are aligned to wall-clock boundaries, so they remain the same across restarts.
+func alignTimestamp(timestamp, interval int64) int64 {
+	n := timestamp % interval
+	if n < 0 {
+		n += interval
+	}
+	return timestamp - n
+}
+
+func timestampFromTime(t time.Time) int64 {
+	return t.UnixNano() / 1e6
+}
+
+func (ag *aggregator) runFlusher() {
+	delay := aggrFlushDelay.Nanoseconds() / 1e6
+	for {
+		now := timestampFromTime(time.Now())
+		nextFlush := alignTimestamp(now-delay, ag.interval) + ag.interval + delay
+		t := time.NewTimer(time.Duration(nextFlush-now) * time.Millisecond)
+		select {
+		case <-ag.stopCh:
+			t.Stop()
+			return
+		case <-t.C:
+			ag.flush(nextFlush - delay)
+		}
+	}
+}
+
+func (ag *aggregator) mustStop() {
+	close(ag.stopCh)
+	ag.wg.Wait()
+
+	// Flush incomplete intervals, so their samples aren't lost.
+	ag.flush(math.MaxInt64)
+}
+
+func (ag *aggregator) push(r *Row) {
+	start := alignTimestamp(r.Timestamp, ag.interval)
+
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	if start < ag.flushedUntil {
+		aggrLateSamplesDropped.Inc()
+		return
+	}
+	key := append(ag.keyBuf[:0], r.Metric...)
+	for i := range r.Tags {
+		tag := &r.Tags[i]
+		key = append(key, ';')
+		key = append(key, tag.Key...)
+		key = append(key, '=')
+		key = append(key, tag.Value...)
+	}
+	ag.keyBuf = key
+	s := ag.m[string(key)]
+	if s == nil {
+		// Copy metric and tags, since they refer to the request buffer.
+		s = &aggrSeries{
+			metric: string(append([]byte{}, r.Metric...)),
+			states: make(map[int64]*aggrState),
+		}
+		for i := range r.Tags {
+			tag := &r.Tags[i]
+			s.tags = append(s.tags, Tag{
+				Key:   string(append([]byte{}, tag.Key...)),
+				Value: string(append([]byte{}, tag.Value...)),
+			})
+		}
+		ag.m[string(key)] = s
+	}
+	st := s.states[start]
+	if st == nil {
+		st = &aggrState{
+			min:           math.Inf(1),
+			max:           math.Inf(-1),
+			lastTimestamp: math.MinInt64,
+		}
+		s.states[start] = st
+	}
+	v := r.Value
+	st.sum += v
+	st.count++
+	if v < st.min {
+		st.min = v
+	}
+	if v > st.max {
+		st.max = v
+	}
+	if r.Timestamp >= st.lastTimestamp {
+		st.last = v
+		st.lastTimestamp = r.Timestamp
+	}
+}
+
+// flush passes the aggregated values for intervals ending until the given timestamp to pushFunc.
+//
+// The aggregated values have timestamps of their interval starts.
+func (ag *aggregator) flush(until int64) {
+	var rows []Row
+	ag.mu.Lock()
+	for key, s := range ag.m {
+		for start, st := range s.states {
+			if start > until-ag.interval {
+				continue
+			}
+			rows = append(rows, Row{
+				Metric:    s.metric,
+				Tags:      s.tags,
+				Value:     st.value(ag.rule.Method),
+				Timestamp: start,
+			})
+			delete(s.states, start)
+		}
+		if len(s.states) == 0 {
+			delete(ag.m, key)
+		}
+	}
+	if until > ag.flushedUntil {
+		ag.flushedUntil = until
+	}
+	ag.mu.Unlock()
+
+	if len(rows) > 0 {
+		ag.pushFunc(rows)
+	}
+}
+
+func (st *aggrState) value(method string) float64 {
+	switch method {
+	case "sum":
+		return st.sum
+	case "avg":
+		return st.sum / float64(st.count)
+	case "min":
+		return st.min
+	case "max":
+		return st.max
+	case "last":
+		return st.last
+	default:
+		logger.Panicf("BUG: unexpected aggregation method %q", method)
+		return 0
+	}
+}
+
+var aggrLateSamplesDropped = metrics.NewCounter(`vm_graphite_aggr_late_samples_dropped_total`)
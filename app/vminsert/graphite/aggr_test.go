@@ -0,0 +1,237 @@
+package graphite
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestAggregatorsReloadFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var prev aggregators
+		as, err := prev.reload([]byte(s), func(rows []Row) {})
+		if err == nil {
+			as.mustStop()
+			t.Fatalf("expecting non-nil error for config\n%s", s)
+		}
+	}
+
+	// Invalid yaml
+	f(`foo`)
+	f(`- pattern: foo
+  unknown_option: bar`)
+
+	// Missing pattern
+	f(`- method: sum
+  interval: 1m`)
+
+	// Invalid pattern
+	f(`- pattern: 'foo('
+  method: sum
+  interval: 1m`)
+
+	// Missing or unsupported method
+	f(`- pattern: foo
+  interval: 1m`)
+	f(`- pattern: foo
+  method: median
+  interval: 1m`)
+
+	// Missing or too small interval
+	f(`- pattern: foo
+  method: sum`)
+	f(`- pattern: foo
+  method: sum
+  interval: 100ms`)
+}
+
+func TestAlignTimestamp(t *testing.T) {
+	f := func(timestamp, interval, resultExpected int64) {
+		t.Helper()
+		result := alignTimestamp(timestamp, interval)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for alignTimestamp(%d, %d); got %d; want %d", timestamp, interval, result, resultExpected)
+		}
+	}
+	f(0, 60e3, 0)
+	f(59999, 60e3, 0)
+	f(60e3, 60e3, 60e3)
+	f(1560272508123, 60e3, 1560272460000)
+	f(-1, 60e3, -60e3)
+}
+
+// base is the timestamp for samples in tests. It is far in the future,
+// so the samples aren't flushed by background flushers during the tests.
+const base = 4102444800000
+
+func TestAggregatorsPush(t *testing.T) {
+	var mu sync.Mutex
+	var result []Row
+	pushFunc := func(rows []Row) {
+		mu.Lock()
+		result = append(result, rows...)
+		mu.Unlock()
+	}
+	var prev aggregators
+	as, err := prev.reload([]byte(`
+- pattern: '\.count$'
+  method: sum
+  interval: 1m
+- pattern: '^foo\.'
+  method: max
+  interval: 10s
+- pattern: '^foo\.'
+  method: min
+  interval: 1m
+- pattern: '\.avg$'
+  method: avg
+  interval: 1m
+- pattern: '\.last$'
+  method: last
+  interval: 1m
+`), pushFunc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer as.mustStop()
+
+	rows := []Row{
+		// The first matching rule wins.
+		{Metric: "foo.count", Value: 1, Timestamp: base + 60e3},
+		{Metric: "foo.count", Value: 2, Timestamp: base + 119999},
+		{Metric: "foo.count", Value: 4, Timestamp: base + 120e3},
+		{Metric: "bar.count", Tags: []Tag{{Key: "dc", Value: "x"}}, Value: 10, Timestamp: base + 61e3},
+		{Metric: "bar.count", Tags: []Tag{{Key: "dc", Value: "y"}}, Value: 20, Timestamp: base + 62e3},
+		{Metric: "foo.bar", Value: 3, Timestamp: base + 61e3},
+		{Metric: "foo.bar", Value: 5, Timestamp: base + 65e3},
+		{Metric: "foo.bar", Value: 1, Timestamp: base + 71e3},
+		{Metric: "x.avg", Value: 1, Timestamp: base + 60e3},
+		{Metric: "x.avg", Value: 2, Timestamp: base + 70e3},
+		{Metric: "x.last", Value: 2, Timestamp: base + 70e3},
+		{Metric: "x.last", Value: 1, Timestamp: base + 60e3},
+
+		// Rows without matching rules are passed through.
+		{Metric: "baz", Value: 42, Timestamp: base + 60e3},
+	}
+	rows = as.push(rows)
+	rowsExpected := []Row{
+		{Metric: "baz", Value: 42, Timestamp: base + 60e3},
+	}
+	if !reflect.DeepEqual(rows, rowsExpected) {
+		t.Fatalf("unexpected rows;\ngot\n%+v\nwant\n%+v", rows, rowsExpected)
+	}
+
+	// Only complete intervals are flushed.
+	for _, ag := range as.as {
+		ag.flush(base + 120e3)
+	}
+	resultExpected := []Row{
+		{Metric: "bar.count", Tags: []Tag{{Key: "dc", Value: "x"}}, Value: 10, Timestamp: base + 60e3},
+		{Metric: "bar.count", Tags: []Tag{{Key: "dc", Value: "y"}}, Value: 20, Timestamp: base + 60e3},
+		{Metric: "foo.bar", Value: 5, Timestamp: base + 60e3},
+		{Metric: "foo.bar", Value: 1, Timestamp: base + 70e3},
+		{Metric: "foo.count", Value: 3, Timestamp: base + 60e3},
+		{Metric: "x.avg", Value: 1.5, Timestamp: base + 60e3},
+		{Metric: "x.last", Value: 2, Timestamp: base + 60e3},
+	}
+	checkRows(t, result, resultExpected)
+
+	// Samples for the flushed intervals are dropped.
+	result = nil
+	rows = as.push([]Row{
+		{Metric: "foo.count", Value: 100, Timestamp: base + 100e3},
+	})
+	if len(rows) != 0 {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	for _, ag := range as.as {
+		ag.flush(base + 180e3)
+	}
+	checkRows(t, result, []Row{
+		{Metric: "foo.count", Value: 4, Timestamp: base + 120e3},
+	})
+}
+
+func TestAggregatorsReloadPreserveState(t *testing.T) {
+	var mu sync.Mutex
+	var result []Row
+	pushFunc := func(rows []Row) {
+		mu.Lock()
+		result = append(result, rows...)
+		mu.Unlock()
+	}
+	var prev aggregators
+	as, err := prev.reload([]byte(`
+- pattern: '^foo'
+  method: sum
+  interval: 1m
+- pattern: '^bar'
+  method: sum
+  interval: 1m
+`), pushFunc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	as.push([]Row{
+		{Metric: "foo", Value: 1, Timestamp: base + 60e3},
+		{Metric: "bar", Value: 2, Timestamp: base + 60e3},
+	})
+
+	// Invalid config leaves the previous state unchanged.
+	if _, err := as.reload([]byte(`foo`), pushFunc); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if len(result) != 0 {
+		t.Fatalf("unexpected flushed rows: %+v", result)
+	}
+
+	// The removed rule keeps running until mustStopRemoved call, so in-flight pushes aren't lost.
+	asPrev := as
+	as, err = asPrev.reload([]byte(`
+- pattern: '^foo'
+  method: sum
+  interval: 1m
+`), pushFunc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	asPrev.push([]Row{
+		{Metric: "bar", Value: 5, Timestamp: base + 62e3},
+	})
+	if len(result) != 0 {
+		t.Fatalf("unexpected flushed rows before stopping removed aggregators: %+v", result)
+	}
+
+	// The removed rule is flushed, while the state of the unchanged rule is preserved.
+	asPrev.mustStopRemoved(as)
+	checkRows(t, result, []Row{
+		{Metric: "bar", Value: 7, Timestamp: base + 60e3},
+	})
+	result = nil
+	as.push([]Row{
+		{Metric: "foo", Value: 3, Timestamp: base + 61e3},
+	})
+	as.mustStop()
+	checkRows(t, result, []Row{
+		{Metric: "foo", Value: 4, Timestamp: base + 60e3},
+	})
+}
+
+func checkRows(t *testing.T, rows, rowsExpected []Row) {
+	t.Helper()
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := &rows[i], &rows[j]
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		return a.Value < b.Value
+	})
+	if !reflect.DeepEqual(rows, rowsExpected) {
+		t.Fatalf("unexpected rows;\ngot\n%+v\nwant\n%+v", rows, rowsExpected)
+	}
+}
@@ -67,21 +67,22 @@ func (r *Row) unmarshal(s string, tagsPool []Tag) ([]Tag, error) {
 	metricAndTags := s[:n]
 	tail := s[n+1:]
 
-	n = strings.IndexByte(metricAndTags, ';')
+	noEscapeChars := strings.IndexByte(metricAndTags, '\\') < 0
+	n = nextUnescapedChar(metricAndTags, ';', noEscapeChars)
 	if n < 0 {
 		// No tags
-		r.Metric = metricAndTags
+		r.Metric = unescapeTagValue(metricAndTags, noEscapeChars)
 	} else {
 		// Tags found
-		r.Metric = metricAndTags[:n]
+		r.Metric = unescapeTagValue(metricAndTags[:n], noEscapeChars)
 		tagsStart := len(tagsPool)
-		var err error
-		tagsPool, err = unmarshalTags(tagsPool, metricAndTags[n+1:])
-		if err != nil {
-			return tagsPool, fmt.Errorf("cannot umarshal tags: %s", err)
+		tagsPool = unmarshalTags(tagsPool, metricAndTags[n+1:], noEscapeChars)
+		if tags := tagsPool[tagsStart:]; len(tags) > 0 {
+			r.Tags = tags[:len(tags):len(tags)]
 		}
-		tags := tagsPool[tagsStart:]
-		r.Tags = tags[:len(tags):len(tags)]
+	}
+	if len(r.Metric) == 0 {
+		return tagsPool, fmt.Errorf("metric cannot be empty in %q", s)
 	}
 
 	n = strings.IndexByte(tail, ' ')
@@ -126,28 +127,53 @@ func unmarshalRows(dst []Row, s string, tagsPool []Tag) ([]Row, []Tag, error) {
 	return dst, tagsPool, nil
 }
 
-func unmarshalTags(dst []Tag, s string) ([]Tag, error) {
+// unmarshalTags appends tags from s to dst and returns the result.
+//
+// Tags without `=` and tags with empty keys are ignored.
+// The last value wins for duplicate tag keys.
+//
+// See https://graphite.readthedocs.io/en/latest/tags.html#carbon
+func unmarshalTags(dst []Tag, s string, noEscapeChars bool) []Tag {
+	tagsStart := len(dst)
 	for {
-		if cap(dst) > len(dst) {
-			dst = dst[:len(dst)+1]
-		} else {
-			dst = append(dst, Tag{})
+		tagStr := s
+		n := nextUnescapedChar(s, ';', noEscapeChars)
+		if n >= 0 {
+			tagStr = s[:n]
+			s = s[n+1:]
 		}
-		tag := &dst[len(dst)-1]
-
-		n := strings.IndexByte(s, ';')
+		dst = appendTag(dst, tagsStart, tagStr, noEscapeChars)
 		if n < 0 {
-			// The last tag found
-			if err := tag.unmarshal(s); err != nil {
-				return dst[:len(dst)-1], err
-			}
-			return dst, nil
+			return dst
 		}
-		if err := tag.unmarshal(s[:n]); err != nil {
-			return dst[:len(dst)-1], err
+	}
+}
+
+func appendTag(dst []Tag, tagsStart int, s string, noEscapeChars bool) []Tag {
+	n := nextUnescapedChar(s, '=', noEscapeChars)
+	if n <= 0 {
+		// Ignore tags without value or with empty key.
+		return dst
+	}
+	key := unescapeTagValue(s[:n], noEscapeChars)
+	value := unescapeTagValue(s[n+1:], noEscapeChars)
+	tags := dst[tagsStart:]
+	for i := range tags {
+		if tags[i].Key == key {
+			// Duplicate tag - the last value wins.
+			tags[i].Value = value
+			return dst
 		}
-		s = s[n+1:]
 	}
+	if cap(dst) > len(dst) {
+		dst = dst[:len(dst)+1]
+	} else {
+		dst = append(dst, Tag{})
+	}
+	tag := &dst[len(dst)-1]
+	tag.Key = key
+	tag.Value = value
+	return dst
 }
 
 // Tag is a graphite tag.
@@ -161,16 +187,68 @@ func (t *Tag) reset() {
 	t.Value = ""
 }
 
-func (t *Tag) unmarshal(s string) error {
-	t.reset()
-	n := strings.IndexByte(s, '=')
+// unescapeTagValue removes backslashes in front of `;`, `=` and `\` chars in s.
+func unescapeTagValue(s string, noEscapeChars bool) string {
+	if noEscapeChars {
+		// Fast path - no escape chars.
+		return s
+	}
+	n := strings.IndexByte(s, '\\')
+	if n < 0 {
+		return s
+	}
+
+	// Slow path. Remove escape chars.
+	dst := make([]byte, 0, len(s))
+	for {
+		dst = append(dst, s[:n]...)
+		s = s[n+1:]
+		if len(s) == 0 {
+			return string(append(dst, '\\'))
+		}
+		ch := s[0]
+		if ch != ';' && ch != '=' && ch != '\\' {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, ch)
+		s = s[1:]
+		n = strings.IndexByte(s, '\\')
+		if n < 0 {
+			return string(append(dst, s...))
+		}
+	}
+}
+
+// nextUnescapedChar returns the index of the first ch in s, which isn't escaped with backslash.
+//
+// -1 is returned if s has no unescaped ch.
+func nextUnescapedChar(s string, ch byte, noEscapeChars bool) int {
+	if noEscapeChars {
+		// Fast path: just search for ch in s, since s has no escape chars.
+		return strings.IndexByte(s, ch)
+	}
+
+	sOrig := s
+again:
+	n := strings.IndexByte(s, ch)
 	if n < 0 {
-		return fmt.Errorf("missing tag value for %q", s)
+		return -1
+	}
+	if n == 0 {
+		return len(sOrig) - len(s) + n
+	}
+	if s[n-1] != '\\' {
+		return len(sOrig) - len(s) + n
+	}
+	nOrig := n
+	slashes := 0
+	for n > 0 && s[n-1] == '\\' {
+		slashes++
+		n--
 	}
-	t.Key = s[:n]
-	if len(t.Key) == 0 {
-		return fmt.Errorf("tag key cannot be empty for %q", s)
+	if slashes&1 == 0 {
+		return len(sOrig) - len(s) + nOrig
 	}
-	t.Value = s[n+1:]
-	return nil
+	s = s[nOrig+1:]
+	goto again
 }
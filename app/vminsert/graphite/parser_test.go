@@ -28,12 +28,49 @@ func TestRowsUnmarshalFailure(t *testing.T) {
 	// Invalid multiline
 	f("aaa\nbbb 123 34")
 
-	// missing tag
-	f("aa; 12 34")
+	// Missing metric
+	f(" 12 34")
+	f(";foo=bar 12 34")
+}
+
+func TestNextUnescapedChar(t *testing.T) {
+	f := func(s string, ch byte, noUnescape bool, nExpected int) {
+		t.Helper()
+		n := nextUnescapedChar(s, ch, noUnescape)
+		if n != nExpected {
+			t.Fatalf("unexpected n for nextUnescapedChar(%q, '%c', %v); got %d; want %d", s, ch, noUnescape, n, nExpected)
+		}
+	}
 
-	// missing tag value
-	f("aa;bb 23 34")
-	f("aa;=dsd 234 45")
+	f("", ';', true, -1)
+	f("", ';', false, -1)
+	f(";", ';', true, 0)
+	f(";", ';', false, 0)
+	f("x;y", ';', true, 1)
+	f("x;y", ';', false, 1)
+	f(`x\;;y`, ';', true, 2)
+	f(`x\;;y`, ';', false, 3)
+	f(`\\;`, ';', false, 2)
+	f(`\\\;`, ';', false, -1)
+	f(`\\\=a=a`, '=', false, 5)
+	f(`a\`, ';', false, -1)
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	f := func(s, sExpected string) {
+		t.Helper()
+		ss := unescapeTagValue(s, false)
+		if ss != sExpected {
+			t.Fatalf("unexpected value for %q; got %q; want %q", s, ss, sExpected)
+		}
+	}
+
+	f("", "")
+	f("foo.bar", "foo.bar")
+	f(`\a\b`, `\a\b`)
+	f(`\`, `\`)
+	f(`foo\`, `foo\`)
+	f(`foo\;bar\=baz\\x`, `foo;bar=baz\x`)
 }
 
 func TestRowsUnmarshalSuccess(t *testing.T) {
@@ -115,6 +152,108 @@ func TestRowsUnmarshalSuccess(t *testing.T) {
 		}},
 	})
 
+	// Empty tag values
+	f("foo;aa=;bb= 1 2", &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags: []Tag{
+				{
+					Key:   "aa",
+					Value: "",
+				},
+				{
+					Key:   "bb",
+					Value: "",
+				},
+			},
+			Value:     1,
+			Timestamp: 2,
+		}},
+	})
+
+	// Tags without values and with empty keys must be ignored
+	f("aa; 12 34", &Rows{
+		Rows: []Row{{
+			Metric:    "aa",
+			Value:     12,
+			Timestamp: 34,
+		}},
+	})
+	f("aa;bb 23 34", &Rows{
+		Rows: []Row{{
+			Metric:    "aa",
+			Value:     23,
+			Timestamp: 34,
+		}},
+	})
+	f("aa;=dsd;;x=y;z 234 45", &Rows{
+		Rows: []Row{{
+			Metric: "aa",
+			Tags: []Tag{{
+				Key:   "x",
+				Value: "y",
+			}},
+			Value:     234,
+			Timestamp: 45,
+		}},
+	})
+
+	// Duplicate tags - the last value wins
+	f("foo;region=us;dc=east;region=eu 12.3 1600000000", &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags: []Tag{
+				{
+					Key:   "region",
+					Value: "eu",
+				},
+				{
+					Key:   "dc",
+					Value: "east",
+				},
+			},
+			Value:     12.3,
+			Timestamp: 1600000000,
+		}},
+	})
+
+	// Escaped semicolons in metric names and tags
+	f(`foo\;bar;region=us\;east;d\=c=x 1 2`, &Rows{
+		Rows: []Row{{
+			Metric: "foo;bar",
+			Tags: []Tag{
+				{
+					Key:   "region",
+					Value: "us;east",
+				},
+				{
+					Key:   "d=c",
+					Value: "x",
+				},
+			},
+			Value:     1,
+			Timestamp: 2,
+		}},
+	})
+	f(`foo\;bar 1 2`, &Rows{
+		Rows: []Row{{
+			Metric:    "foo;bar",
+			Value:     1,
+			Timestamp: 2,
+		}},
+	})
+	f(`foo\\;a=b 1 2`, &Rows{
+		Rows: []Row{{
+			Metric: `foo\`,
+			Tags: []Tag{{
+				Key:   "a",
+				Value: "b",
+			}},
+			Value:     1,
+			Timestamp: 2,
+		}},
+	})
+
 	// Multi lines
 	f("foo 0.3 2\nbar.baz 0.34 43\n", &Rows{
 		Rows: []Row{
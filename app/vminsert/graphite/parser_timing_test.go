@@ -22,3 +22,21 @@ cpu.usage_irq 0.34432 1234556768
 		}
 	})
 }
+
+func BenchmarkRowsUnmarshalWithTags(b *testing.B) {
+	s := `cpu.usage_user;region=us;dc=east 1.23 1234556768
+cpu.usage_system;region=us;dc=east 23.344 1234556768
+cpu.usage_iowait;region=us;dc=west 3.3443 1234556769
+cpu.usage_irq;region=eu;dc=north 0.34432 1234556768
+`
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var rows Rows
+		for pb.Next() {
+			if err := rows.Unmarshal(s); err != nil {
+				panic(fmt.Errorf("cannot unmarshal %q: %s", s, err))
+			}
+		}
+	})
+}
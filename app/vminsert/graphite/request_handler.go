@@ -37,7 +37,7 @@ func insertHandlerInternal(r io.Reader) error {
 }
 
 func (ctx *pushCtx) InsertRows() error {
-	rows := ctx.Rows.Rows
+	rows := pushAggr(ctx.Rows.Rows)
 	ic := &ctx.Common
 	ic.Reset(len(rows))
 	for i := range rows {
@@ -9,6 +9,7 @@ import (
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/netutil"
 	"github.com/VictoriaMetrics/metrics"
 )
 
@@ -20,35 +21,40 @@ var (
 	writeErrorsUDP   = metrics.NewCounter(`vm_graphite_request_errors_total{name="write", net="udp"}`)
 )
 
-// Serve starts graphite server on the given addr.
-func Serve(addr string) {
-	logger.Infof("starting TCP Graphite server at %q", addr)
-	lnTCP, err := net.Listen("tcp4", addr)
-	if err != nil {
-		logger.Fatalf("cannot start TCP Graphite server at %q: %s", addr, err)
-	}
-	listenerTCP = lnTCP
+// Serve starts graphite server on the given addrs.
+//
+// addrs may contain comma-separated list of addresses to listen to.
+func Serve(addrs string) {
+	var wg sync.WaitGroup
+	for _, addr := range netutil.ParseListenAddrs(addrs) {
+		logger.Infof("starting TCP Graphite server at %q", addr)
+		lnTCP, err := net.Listen(netutil.GetTCPNetwork(addr), addr)
+		if err != nil {
+			logger.Fatalf("cannot start TCP Graphite server at %q: %s", addr, err)
+		}
+		logger.Infof("starting UDP Graphite server at %q", addr)
+		lnUDP, err := net.ListenPacket(netutil.GetUDPNetwork(addr), addr)
+		if err != nil {
+			logger.Fatalf("cannot start UDP Graphite server at %q: %s", addr, err)
+		}
+		listenersLock.Lock()
+		listenersTCP = append(listenersTCP, lnTCP)
+		listenersUDP = append(listenersUDP, lnUDP)
+		listenersLock.Unlock()
 
-	logger.Infof("starting UDP Graphite server at %q", addr)
-	lnUDP, err := net.ListenPacket("udp4", addr)
-	if err != nil {
-		logger.Fatalf("cannot start UDP Graphite server at %q: %s", addr, err)
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			serveTCP(lnTCP)
+			logger.Infof("stopped TCP Graphite server at %q", addr)
+		}(addr)
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			serveUDP(lnUDP)
+			logger.Infof("stopped UDP Graphite server at %q", addr)
+		}(addr)
 	}
-	listenerUDP = lnUDP
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		serveTCP(listenerTCP)
-		logger.Infof("stopped TCP Graphite server at %q", addr)
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		serveUDP(listenerUDP)
-		logger.Infof("stopped UDP Graphite server at %q", addr)
-	}()
 	wg.Wait()
 }
 
@@ -120,18 +126,25 @@ func serveUDP(ln net.PacketConn) {
 }
 
 var (
-	listenerTCP net.Listener
-	listenerUDP net.PacketConn
+	listenersLock sync.Mutex
+	listenersTCP  []net.Listener
+	listenersUDP  []net.PacketConn
 )
 
 // Stop stops the server.
 func Stop() {
-	logger.Infof("stopping TCP Graphite server at %q...", listenerTCP.Addr())
-	if err := listenerTCP.Close(); err != nil {
-		logger.Errorf("cannot close TCP Graphite server: %s", err)
+	listenersLock.Lock()
+	for _, ln := range listenersTCP {
+		logger.Infof("stopping TCP Graphite server at %q...", ln.Addr())
+		if err := ln.Close(); err != nil {
+			logger.Errorf("cannot close TCP Graphite server: %s", err)
+		}
 	}
-	logger.Infof("stopping UDP Graphite server at %q...", listenerUDP.LocalAddr())
-	if err := listenerUDP.Close(); err != nil {
-		logger.Errorf("cannot close UDP Graphite server: %s", err)
+	for _, ln := range listenersUDP {
+		logger.Infof("stopping UDP Graphite server at %q...", ln.LocalAddr())
+		if err := ln.Close(); err != nil {
+			logger.Errorf("cannot close UDP Graphite server: %s", err)
+		}
 	}
+	listenersLock.Unlock()
 }
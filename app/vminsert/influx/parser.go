@@ -50,6 +50,47 @@ func (rs *Rows) Unmarshal(s string) error {
 	return err
 }
 
+// UnmarshalSkipInvalid unmarshals influx line protocol rows from s, skipping malformed lines.
+//
+// errFunc is called with the error for every skipped line, so it doesn't prevent from unmarshaling the remaining lines.
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) UnmarshalSkipInvalid(s string, errFunc func(err error)) {
+	dst := rs.Rows[:0]
+	tagsPool := rs.tagsPool[:0]
+	fieldsPool := rs.fieldsPool[:0]
+	for len(s) > 0 {
+		line := s
+		n := strings.IndexByte(s, '\n')
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		if len(line) == 0 {
+			// Skip empty line
+			continue
+		}
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Row{})
+		}
+		r := &dst[len(dst)-1]
+		var err error
+		tagsPool, fieldsPool, err = r.unmarshal(line, tagsPool, fieldsPool)
+		if err != nil {
+			r.reset()
+			dst = dst[:len(dst)-1]
+			errFunc(err)
+		}
+	}
+	rs.Rows = dst
+	rs.tagsPool = tagsPool
+	rs.fieldsPool = fieldsPool
+}
+
 // Row is a single influx row.
 type Row struct {
 	Measurement string
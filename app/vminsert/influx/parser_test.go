@@ -349,3 +349,68 @@ func TestRowsUnmarshalSuccess(t *testing.T) {
 		},
 	})
 }
+
+func TestRowsUnmarshalSkipInvalid(t *testing.T) {
+	f := func(s string, rowsExpected *Rows, errorsExpected int) {
+		t.Helper()
+		var rows Rows
+		for i := 0; i < 2; i++ {
+			errors := 0
+			rows.UnmarshalSkipInvalid(s, func(err error) {
+				errors++
+			})
+			if errors != errorsExpected {
+				t.Fatalf("unexpected number of errors for %q; got %d; want %d", s, errors, errorsExpected)
+			}
+			if len(rows.Rows) == 0 && len(rowsExpected.Rows) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+				t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+			}
+		}
+	}
+
+	// Empty lines
+	f("", &Rows{}, 0)
+	f("\n\n", &Rows{}, 0)
+
+	// Only malformed lines
+	f("foo\nbar,baz=1\n", &Rows{}, 2)
+
+	// Malformed line between valid lines
+	f("foo,x=y a=1 123\nbar,baz\nfoo b=2\n", &Rows{
+		Rows: []Row{
+			{
+				Measurement: "foo",
+				Tags: []Tag{{
+					Key:   "x",
+					Value: "y",
+				}},
+				Fields: []Field{{
+					Key:   "a",
+					Value: 1,
+				}},
+				Timestamp: 123,
+			},
+			{
+				Measurement: "foo",
+				Fields: []Field{{
+					Key:   "b",
+					Value: 2,
+				}},
+			},
+		},
+	}, 1)
+
+	// Malformed last line without trailing newline
+	f("foo a=1\nbar x=", &Rows{
+		Rows: []Row{{
+			Measurement: "foo",
+			Fields: []Field{{
+				Key:   "a",
+				Value: 1,
+			}},
+		}},
+	}, 1)
+}
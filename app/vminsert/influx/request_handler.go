@@ -12,27 +12,33 @@ import (
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/influxutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
 	"github.com/VictoriaMetrics/metrics"
 )
 
-var (
-	measurementFieldSeparator = flag.String("influxMeasurementFieldSeparator", ".", "Separator for `{measurement}{separator}{field_name}` metric name when inserted via Influx line protocol")
-)
+var orgLabel = flag.String("influx.orgLabel", "", "Label name for storing `org` query arg from Influx v2 write API. The org isn't stored if empty")
 
 var rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="influx"}`)
 
 // InsertHandler processes remote write for influx line protocol.
 //
+// Both Influx v1 write API (/write) and Influx v2 write API (/api/v2/write) are supported.
+//
 // See https://github.com/influxdata/influxdb/blob/4cbdc197b8117fee648d62e2e5be75c6575352f0/tsdb/README.md
-func InsertHandler(req *http.Request) error {
+// and https://docs.influxdata.com/influxdb/v2.0/api/#operation/PostWrite
+//
+// maxSize limits the size of the request body after decompression.
+func InsertHandler(req *http.Request, maxSize int64) error {
 	return concurrencylimiter.Do(func() error {
-		return insertHandlerInternal(req)
+		return insertHandlerInternal(req, maxSize)
 	})
 }
 
-func insertHandlerInternal(req *http.Request) error {
+func insertHandlerInternal(req *http.Request, maxSize int64) error {
 	influxReadCalls.Inc()
 
 	r := req.Body
@@ -44,38 +50,94 @@ func insertHandlerInternal(req *http.Request) error {
 		defer putGzipReader(zr)
 		r = zr
 	}
+	mr := common.NewMaxSizeReader(r, maxSize)
 
 	q := req.URL.Query()
-	tsMultiplier := int64(1e6)
-	switch q.Get("precision") {
-	case "ns":
-		tsMultiplier = 1e6
-	case "u":
-		tsMultiplier = 1e3
-	case "ms":
-		tsMultiplier = 1
-	case "s":
-		tsMultiplier = -1e3
-	case "m":
-		tsMultiplier = -1e3 * 60
-	case "h":
-		tsMultiplier = -1e3 * 3600
-	}
+	tsMultiplier := getTimestampMultiplier(q.Get("precision"))
 
 	// Read db tag from https://docs.influxdata.com/influxdb/v1.7/tools/api/#write-http-endpoint
+	// Influx v2 write API passes bucket instead of db, so use it as db.
+	// See https://docs.influxdata.com/influxdb/v2.0/api/#operation/PostWrite
 	db := q.Get("db")
+	if db == "" {
+		db = q.Get("bucket")
+	}
+	org := q.Get("org")
 
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
-	for ctx.Read(r, tsMultiplier) {
-		if err := ctx.InsertRows(db); err != nil {
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(req))
+	ctx.Common.SetAccountID(tenant.GetAccountID(req.Context()))
+	for ctx.Read(mr, tsMultiplier) {
+		if err := ctx.InsertRows(db, org); err != nil {
 			return err
 		}
 	}
+	if err := mr.Err(); err != nil {
+		return err
+	}
 	return ctx.Error()
 }
 
-func (ctx *pushCtx) InsertRows(db string) error {
+// insertLines processes complete Influx line protocol lines received via UDP.
+//
+// Timestamps are treated as nanoseconds, since UDP packets have no precision arg.
+// Malformed lines are skipped, so they don't prevent from storing the remaining lines from data.
+// The error for the first malformed line is returned.
+func insertLines(data []byte) error {
+	return concurrencylimiter.Do(func() error {
+		return insertLinesInternal(data)
+	})
+}
+
+func insertLinesInternal(data []byte) error {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	invalidLines := 0
+	var firstErr error
+	ctx.Rows.UnmarshalSkipInvalid(bytesutil.ToUnsafeString(data), func(err error) {
+		influxUnmarshalErrors.Inc()
+		if firstErr == nil {
+			firstErr = err
+		}
+		invalidLines++
+	})
+	adjustTimestamps(ctx.Rows.Rows, 1e6)
+	if err := ctx.InsertRows("", ""); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return fmt.Errorf("skipped %d malformed lines out of %d lines; the first error: %s", invalidLines, invalidLines+len(ctx.Rows.Rows), firstErr)
+	}
+	return nil
+}
+
+// getTimestampMultiplier returns timestamp multiplier for the given precision.
+//
+// Positive multiplier is the divisor for converting timestamps to milliseconds,
+// while negative multiplier is the negated factor for such a conversion.
+//
+// Both Influx v1 precisions (n, u, ms, s, m, h) and Influx v2 precisions (ns, us, ms, s) are supported.
+// Timestamps are treated as nanoseconds for unknown precision.
+func getTimestampMultiplier(precision string) int64 {
+	switch precision {
+	case "u", "us", "µ":
+		return 1e3
+	case "ms":
+		return 1
+	case "s":
+		return -1e3
+	case "m":
+		return -1e3 * 60
+	case "h":
+		return -1e3 * 3600
+	default:
+		// ns
+		return 1e6
+	}
+}
+
+func (ctx *pushCtx) InsertRows(db, org string) error {
 	rows := ctx.Rows.Rows
 	rowsLen := 0
 	for i := range rows {
@@ -86,14 +148,19 @@ func (ctx *pushCtx) InsertRows(db string) error {
 	for i := range rows {
 		r := &rows[i]
 		ic.Labels = ic.Labels[:0]
-		ic.AddLabel("db", db)
+		if databaseLabel := influxutil.DatabaseLabel(); len(databaseLabel) > 0 && db != "" {
+			ic.AddLabel(databaseLabel, db)
+		}
+		if len(*orgLabel) > 0 && org != "" {
+			ic.AddLabel(*orgLabel, org)
+		}
 		for j := range r.Tags {
 			tag := &r.Tags[j]
 			ic.AddLabel(tag.Key, tag.Value)
 		}
 		ctx.metricNameBuf = storage.MarshalMetricNameRaw(ctx.metricNameBuf[:0], ic.Labels)
 		ctx.metricGroupBuf = append(ctx.metricGroupBuf[:0], r.Measurement...)
-		ctx.metricGroupBuf = append(ctx.metricGroupBuf, *measurementFieldSeparator...)
+		ctx.metricGroupBuf = append(ctx.metricGroupBuf, influxutil.MeasurementFieldSeparator()...)
 		metricGroupPrefixLen := len(ctx.metricGroupBuf)
 		for j := range r.Fields {
 			f := &r.Fields[j]
@@ -145,11 +212,18 @@ func (ctx *pushCtx) Read(r io.Reader, tsMultiplier int64) bool {
 		return false
 	}
 
-	// Adjust timestamps according to tsMultiplier
+	adjustTimestamps(ctx.Rows.Rows, tsMultiplier)
+	return true
+}
+
+// adjustTimestamps converts timestamps for rows to milliseconds according to tsMultiplier.
+//
+// Zero timestamps are substituted with the current time.
+func adjustTimestamps(rows []Row, tsMultiplier int64) {
 	currentTs := time.Now().UnixNano() / 1e6
 	if tsMultiplier >= 1 {
-		for i := range ctx.Rows.Rows {
-			row := &ctx.Rows.Rows[i]
+		for i := range rows {
+			row := &rows[i]
 			if row.Timestamp == 0 {
 				row.Timestamp = currentTs
 			} else {
@@ -158,8 +232,8 @@ func (ctx *pushCtx) Read(r io.Reader, tsMultiplier int64) bool {
 		}
 	} else if tsMultiplier < 0 {
 		tsMultiplier = -tsMultiplier
-		for i := range ctx.Rows.Rows {
-			row := &ctx.Rows.Rows[i]
+		for i := range rows {
+			row := &rows[i]
 			if row.Timestamp == 0 {
 				row.Timestamp = currentTs
 			} else {
@@ -167,7 +241,6 @@ func (ctx *pushCtx) Read(r io.Reader, tsMultiplier int64) bool {
 			}
 		}
 	}
-	return true
 }
 
 var (
@@ -198,6 +271,8 @@ func (ctx *pushCtx) Error() error {
 func (ctx *pushCtx) reset() {
 	ctx.Rows.Reset()
 	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
 
 	ctx.reqBuf = ctx.reqBuf[:0]
 	ctx.tailBuf = ctx.tailBuf[:0]
@@ -0,0 +1,68 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+)
+
+func TestGetTimestampMultiplier(t *testing.T) {
+	f := func(precision string, tsMultiplierExpected int64) {
+		t.Helper()
+		tsMultiplier := getTimestampMultiplier(precision)
+		if tsMultiplier != tsMultiplierExpected {
+			t.Fatalf("unexpected tsMultiplier for precision=%q; got %d; want %d", precision, tsMultiplier, tsMultiplierExpected)
+		}
+	}
+
+	// Default precision
+	f("", 1e6)
+	f("foobar", 1e6)
+
+	// Influx v1 precisions
+	f("n", 1e6)
+	f("u", 1e3)
+	f("ms", 1)
+	f("s", -1e3)
+	f("m", -1e3*60)
+	f("h", -1e3*3600)
+
+	// Influx v2 precisions
+	f("ns", 1e6)
+	f("us", 1e3)
+}
+
+func TestInsertHandlerTooBigGzipRequest(t *testing.T) {
+	// Prepare gzipped request, which decompresses to 16MB.
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	zeros := make([]byte, 1024*1024)
+	for i := 0; i < 16; i++ {
+		if _, err := zw.Write(zeros); err != nil {
+			t.Fatalf("cannot write gzipped data: %s", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %s", err)
+	}
+	compressedLen := bb.Len()
+
+	r := httptest.NewRequest("POST", "/write", &bb)
+	r.Header.Set("Content-Encoding", "gzip")
+	err := insertHandlerInternal(r, 100*1024)
+	esc, ok := err.(*httpserver.ErrorWithStatusCode)
+	if !ok {
+		t.Fatalf("unexpected error; got %v; want %T", err, esc)
+	}
+	if esc.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status code; got %d; want %d", esc.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	// The request body mustn't be read past the limit.
+	if bb.Len() < compressedLen/2 {
+		t.Fatalf("too much compressed data read; got %d bytes out of %d bytes", compressedLen-bb.Len(), compressedLen)
+	}
+}
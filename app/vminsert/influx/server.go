@@ -0,0 +1,255 @@
+package influx
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/netutil"
+	"github.com/VictoriaMetrics/metrics"
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+var (
+	writeRequestsUDP = metrics.NewCounter(`vm_influx_requests_total{name="write", net="udp"}`)
+	writeErrorsUDP   = metrics.NewCounter(`vm_influx_request_errors_total{name="write", net="udp"}`)
+
+	partialLinesDropped = metrics.NewCounter(`vm_influx_udp_partial_lines_dropped_total`)
+)
+
+// partialLineTimeout is the maximum duration to wait for the remaining part of the line split across UDP packets.
+const partialLineTimeout = 10 * time.Second
+
+// maxPartialLineSize is the maximum size of the line split across UDP packets.
+const maxPartialLineSize = 1024 * 1024
+
+// Serve starts UDP server for Influx line protocol on the given addrs.
+//
+// addrs may contain comma-separated list of addresses to listen to.
+//
+// Every line must end with '\n'. Lines split across UDP packets from the same sender are joined.
+// Incomplete lines are dropped after partialLineTimeout.
+func Serve(addrs string) {
+	cleanerWG.Add(1)
+	go func() {
+		defer cleanerWG.Done()
+		runPartialLinesCleaner(cleanerStopCh)
+	}()
+
+	var wg sync.WaitGroup
+	for _, addr := range netutil.ParseListenAddrs(addrs) {
+		logger.Infof("starting UDP Influx server at %q", addr)
+		lnUDP, err := net.ListenPacket(netutil.GetUDPNetwork(addr), addr)
+		if err != nil {
+			logger.Fatalf("cannot start UDP Influx server at %q: %s", addr, err)
+		}
+		listenersLock.Lock()
+		listenersUDP = append(listenersUDP, lnUDP)
+		listenersLock.Unlock()
+
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			serveUDP(lnUDP, insertLines)
+			logger.Infof("stopped UDP Influx server at %q", addr)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// serveUDP reads UDP packets from ln and passes complete lines from them to insert.
+//
+// Packets are read by a single goroutine and are processed by gomaxprocs workers.
+// Packets from the same sender are always processed by the same worker in the order they were received,
+// so lines split across packets are joined in the right order.
+func serveUDP(ln net.PacketConn, insert func(lines []byte) error) {
+	gomaxprocs := runtime.GOMAXPROCS(-1)
+	workChs := make([]chan *udpPacket, gomaxprocs)
+	var wg sync.WaitGroup
+	for i := range workChs {
+		workCh := make(chan *udpPacket, 16)
+		workChs[i] = workCh
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var linesBuf []byte
+			for p := range workCh {
+				linesBuf = partialLines.getLines(linesBuf[:0], p.addr, p.data.B, time.Now())
+				putUDPPacket(p)
+				if len(linesBuf) == 0 {
+					continue
+				}
+				if err := insert(linesBuf); err != nil {
+					writeErrorsUDP.Inc()
+					logger.Errorf("error in UDP Influx conn %q<->%q: %s", ln.LocalAddr(), p.addr, err)
+					continue
+				}
+			}
+		}()
+	}
+
+	var bb bytesutil.ByteBuffer
+	bb.B = bytesutil.Resize(bb.B, 64*1024)
+	for {
+		bb.B = bb.B[:cap(bb.B)]
+		n, addr, err := ln.ReadFrom(bb.B)
+		if err != nil {
+			writeErrorsUDP.Inc()
+			if ne, ok := err.(net.Error); ok {
+				if ne.Temporary() {
+					time.Sleep(time.Second)
+					continue
+				}
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					break
+				}
+			}
+			logger.Errorf("cannot read Influx UDP data: %s", err)
+			continue
+		}
+		writeRequestsUDP.Inc()
+		p := getUDPPacket()
+		p.addr = addr.String()
+		p.data.B = append(p.data.B[:0], bb.B[:n]...)
+		workChs[xxhash.Sum64String(p.addr)%uint64(len(workChs))] <- p
+	}
+	for _, workCh := range workChs {
+		close(workCh)
+	}
+	wg.Wait()
+}
+
+// udpPacket is a UDP packet received from addr.
+type udpPacket struct {
+	addr string
+	data bytesutil.ByteBuffer
+}
+
+func getUDPPacket() *udpPacket {
+	v := udpPacketPool.Get()
+	if v == nil {
+		return &udpPacket{}
+	}
+	return v.(*udpPacket)
+}
+
+func putUDPPacket(p *udpPacket) {
+	p.addr = ""
+	p.data.Reset()
+	udpPacketPool.Put(p)
+}
+
+var udpPacketPool sync.Pool
+
+func runPartialLinesCleaner(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case t := <-ticker.C:
+			partialLines.dropStale(t)
+		}
+	}
+}
+
+var (
+	listenersLock sync.Mutex
+	listenersUDP  []net.PacketConn
+
+	partialLines = newPartialLinesMap()
+
+	cleanerStopCh = make(chan struct{})
+	cleanerWG     sync.WaitGroup
+)
+
+// Stop stops the server.
+func Stop() {
+	listenersLock.Lock()
+	for _, ln := range listenersUDP {
+		logger.Infof("stopping UDP Influx server at %q...", ln.LocalAddr())
+		if err := ln.Close(); err != nil {
+			logger.Errorf("cannot close UDP Influx server: %s", err)
+		}
+	}
+	listenersLock.Unlock()
+	close(cleanerStopCh)
+	cleanerWG.Wait()
+}
+
+// partialLinesMap holds the incomplete last line per each UDP sender until the remaining part of the line is received.
+type partialLinesMap struct {
+	mu sync.Mutex
+	m  map[string]*partialLine
+}
+
+type partialLine struct {
+	buf        []byte
+	lastUpdate time.Time
+}
+
+func newPartialLinesMap() *partialLinesMap {
+	return &partialLinesMap{
+		m: make(map[string]*partialLine),
+	}
+}
+
+// getLines appends complete lines from data received from addr at the given time to dst and returns the result.
+//
+// The incomplete line from the previous packet received from addr is prepended to data,
+// while the incomplete last line in data is held until the next packet from addr.
+func (plm *partialLinesMap) getLines(dst []byte, addr string, data []byte, now time.Time) []byte {
+	n := bytes.LastIndexByte(data, '\n')
+	plm.mu.Lock()
+	defer plm.mu.Unlock()
+
+	pl := plm.m[addr]
+	if n < 0 {
+		// The packet doesn't contain line ends, so append it to the incomplete line.
+		if pl == nil {
+			pl = &partialLine{}
+			plm.m[addr] = pl
+		}
+		pl.buf = append(pl.buf, data...)
+		pl.lastUpdate = now
+		if len(pl.buf) > maxPartialLineSize {
+			partialLinesDropped.Inc()
+			delete(plm.m, addr)
+		}
+		return dst
+	}
+	if pl != nil {
+		dst = append(dst, pl.buf...)
+	}
+	dst = append(dst, data[:n+1]...)
+	tail := data[n+1:]
+	if len(tail) == 0 {
+		delete(plm.m, addr)
+		return dst
+	}
+	if pl == nil {
+		pl = &partialLine{}
+		plm.m[addr] = pl
+	}
+	pl.buf = append(pl.buf[:0], tail...)
+	pl.lastUpdate = now
+	return dst
+}
+
+// dropStale drops incomplete lines, which weren't updated during partialLineTimeout before now.
+func (plm *partialLinesMap) dropStale(now time.Time) {
+	plm.mu.Lock()
+	for addr, pl := range plm.m {
+		if now.Sub(pl.lastUpdate) > partialLineTimeout {
+			partialLinesDropped.Inc()
+			delete(plm.m, addr)
+		}
+	}
+	plm.mu.Unlock()
+}
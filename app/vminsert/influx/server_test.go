@@ -0,0 +1,119 @@
+package influx
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPartialLinesMapGetLines(t *testing.T) {
+	plm := newPartialLinesMap()
+	now := time.Unix(1000, 0)
+	f := func(addr, data, linesExpected string) {
+		t.Helper()
+		lines := plm.getLines(nil, addr, []byte(data), now)
+		if string(lines) != linesExpected {
+			t.Fatalf("unexpected lines for %q from %q; got %q; want %q", data, addr, lines, linesExpected)
+		}
+	}
+
+	// Complete lines
+	f("a", "foo x=1\nbar y=2\n", "foo x=1\nbar y=2\n")
+
+	// Line split across packets
+	f("a", "foo x=1\nbar ", "foo x=1\n")
+	f("a", "y=", "")
+	f("a", "2\nbaz z=3\n", "bar y=2\nbaz z=3\n")
+
+	// Incomplete lines are held per each sender
+	f("a", "foo x", "")
+	f("b", "bar y", "")
+	f("b", "=2\n", "bar y=2\n")
+	f("a", "=1\n", "foo x=1\n")
+	if len(plm.m) != 0 {
+		t.Fatalf("unexpected incomplete lines left: %d", len(plm.m))
+	}
+}
+
+func TestPartialLinesMapDropStale(t *testing.T) {
+	plm := newPartialLinesMap()
+	now := time.Unix(1000, 0)
+	plm.getLines(nil, "a", []byte("foo x="), now)
+	plm.getLines(nil, "b", []byte("bar y="), now.Add(partialLineTimeout))
+
+	// Only the line from "a" is stale.
+	plm.dropStale(now.Add(partialLineTimeout + time.Second))
+	if len(plm.m) != 1 {
+		t.Fatalf("unexpected number of incomplete lines; got %d; want 1", len(plm.m))
+	}
+	lines := plm.getLines(nil, "a", []byte("1\n"), now)
+	if string(lines) != "1\n" {
+		t.Fatalf("unexpected lines after dropping the stale incomplete line; got %q; want %q", lines, "1\n")
+	}
+	lines = plm.getLines(nil, "b", []byte("2\n"), now)
+	if string(lines) != "bar y=2\n" {
+		t.Fatalf("unexpected lines for non-stale incomplete line; got %q; want %q", lines, "bar y=2\n")
+	}
+}
+
+func TestServeUDPJoinsSplitLines(t *testing.T) {
+	ln, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen UDP: %s", err)
+	}
+	var mu sync.Mutex
+	var result []byte
+	doneCh := make(chan struct{})
+	go func() {
+		serveUDP(ln, func(lines []byte) error {
+			mu.Lock()
+			result = append(result, lines...)
+			mu.Unlock()
+			return nil
+		})
+		close(doneCh)
+	}()
+
+	conn, err := net.Dial("udp4", ln.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot dial UDP: %s", err)
+	}
+	defer conn.Close()
+
+	// Send lines split at arbitrary positions across many packets.
+	// The lines must be joined in the order the packets were sent.
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		expected = append(expected, fmt.Sprintf("foo,tag=%d x=%d\n", i, i)...)
+	}
+	for tail := expected; len(tail) > 0; {
+		n := 7
+		if n > len(tail) {
+			n = len(tail)
+		}
+		if _, err := conn.Write(tail[:n]); err != nil {
+			t.Fatalf("cannot send UDP packet: %s", err)
+		}
+		tail = tail[n:]
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(result)
+		mu.Unlock()
+		if n >= len(expected) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ln.Close(); err != nil {
+		t.Fatalf("cannot close UDP listener: %s", err)
+	}
+	<-doneCh
+	if string(result) != string(expected) {
+		t.Fatalf("unexpected lines;\ngot\n%s\nwant\n%s", result, expected)
+	}
+}
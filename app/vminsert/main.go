@@ -3,52 +3,156 @@ package vminsert
 import (
 	"flag"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/csvimport"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/datadog"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/graphite"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/influx"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/native"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/opentsdbhttp"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/prometheus"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/prometheusimport"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/promscrape"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/promwal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/statsd"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/vmimport"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/influxutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 	"github.com/VictoriaMetrics/metrics"
 )
 
 var (
-	graphiteListenAddr   = flag.String("graphiteListenAddr", "", "TCP and UDP address to listen for Graphite plaintext data. Usually :2003 must be set. Doesn't work if empty")
-	opentsdbListenAddr   = flag.String("opentsdbListenAddr", "", "TCP and UDP address to listen for OpentTSDB put messages. Usually :4242 must be set. Doesn't work if empty")
-	maxInsertRequestSize = flag.Int("maxInsertRequestSize", 32*1024*1024, "The maximum size of a single insert request in bytes")
+	graphiteListenAddr   = flag.String("graphiteListenAddr", "", "TCP and UDP address to listen for Graphite plaintext data. Usually :2003 must be set. Doesn't work if empty. Multiple comma-separated addresses may be set")
+	opentsdbListenAddr   = flag.String("opentsdbListenAddr", "", "TCP and UDP address to listen for OpentTSDB put messages. Usually :4242 must be set. Doesn't work if empty. Multiple comma-separated addresses may be set")
+	influxUDPListenAddr  = flag.String("influxListenAddr.udp", "", "UDP address to listen for Influx line protocol data. Usually :8089 must be set. Doesn't work if empty. Multiple comma-separated addresses may be set")
+	statsdListenAddr     = flag.String("statsdListenAddr", "", "TCP and UDP address to listen for statsd metrics. Usually :8125 must be set. Doesn't work if empty. Multiple comma-separated addresses may be set")
+	maxInsertRequestSize = flag.Int("maxInsertRequestSize", 32*1024*1024, "The maximum size in bytes of a single insert request after decompression "+
+		"for protocols, which read the whole request into memory: Prometheus remote_write, OpenTSDB HTTP put and DataDog. "+
+		"Bigger requests are rejected with 413 Request Entity Too Large. The limit may be overridden per protocol with -prometheus.maxRequestSize, "+
+		"-opentsdbhttp.maxRequestSize and -datadog.maxRequestSize")
+
+	prometheusMaxRequestSize = flag.Int("prometheus.maxRequestSize", 0, "The maximum size in bytes of a single Prometheus remote_write request after decompression. -maxInsertRequestSize is used if set to 0")
+	influxMaxRequestSize     = flag.Int("influx.maxRequestSize", 0, "The maximum size in bytes of a single Influx line protocol request after decompression. "+
+		"Requests are processed in a streaming manner, so they aren't limited if set to 0")
+	importMaxRequestSize = flag.Int("import.maxRequestSize", 0, "The maximum size in bytes of a single request to /api/v1/import* endpoints after decompression. "+
+		"Requests are processed in a streaming manner, so they aren't limited if set to 0")
+	opentsdbhttpMaxRequestSize = flag.Int("opentsdbhttp.maxRequestSize", 0, "The maximum size in bytes of a single OpenTSDB HTTP put request after decompression. -maxInsertRequestSize is used if set to 0")
+	datadogMaxRequestSize      = flag.Int("datadog.maxRequestSize", 0, "The maximum size in bytes of a single DataDog request after decompression. -maxInsertRequestSize is used if set to 0")
+
+	prometheusWALImportAuthKey = flag.String("import.prometheusWALAuthKey", "", "authKey for importing Prometheus WAL from -import.prometheusWALRootDir via /api/v1/import/prometheus-wal. "+
+		"The endpoint is disabled if the flag isn't set")
 )
 
+// getMaxRequestSize returns the per-protocol maxSize if it is set. Otherwise -maxInsertRequestSize is returned.
+func getMaxRequestSize(maxSize *int) int64 {
+	if *maxSize > 0 {
+		return int64(*maxSize)
+	}
+	return int64(*maxInsertRequestSize)
+}
+
+// getMaxStreamRequestSize returns the per-protocol maxSize for protocols, which process requests in a streaming manner.
+//
+// Such requests aren't limited by default, since they aren't read into memory at once.
+func getMaxStreamRequestSize(maxSize *int) int64 {
+	return int64(*maxSize)
+}
+
 // Init initializes vminsert.
 func Init() {
 	concurrencylimiter.Init()
+	ratelimiter.Init()
+	common.InitRelabel()
+	common.InitStreamAggr()
 	if len(*graphiteListenAddr) > 0 {
+		graphite.InitAggr()
 		go graphite.Serve(*graphiteListenAddr)
 	}
 	if len(*opentsdbListenAddr) > 0 {
 		go opentsdb.Serve(*opentsdbListenAddr)
 	}
+	if len(*statsdListenAddr) > 0 {
+		go statsd.Serve(*statsdListenAddr)
+	}
+	if len(*influxUDPListenAddr) > 0 {
+		go influx.Serve(*influxUDPListenAddr)
+	}
+	promscrape.Init(pushScrapedData, vmstorage.AddMetricsMetadata)
+}
+
+func pushScrapedData(wr *prompb.WriteRequest) {
+	if err := prometheus.Push(wr); err != nil {
+		logger.Errorf("cannot store scraped samples: %s", err)
+	}
 }
 
 // Stop stops vminsert.
 func Stop() {
+	promscrape.Stop()
 	if len(*graphiteListenAddr) > 0 {
 		graphite.Stop()
+		graphite.MustStopAggr()
 	}
 	if len(*opentsdbListenAddr) > 0 {
 		opentsdb.Stop()
 	}
+	if len(*statsdListenAddr) > 0 {
+		statsd.Stop()
+	}
+	if len(*influxUDPListenAddr) > 0 {
+		influx.Stop()
+	}
+	common.MustStopStreamAggr()
+	common.MustStopRelabel()
 }
 
 // RequestHandler is a handler for Prometheus remote storage write API
 func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 	path := strings.Replace(r.URL.Path, "//", "/", -1)
+	if path == "/api/v1/series" && isDatadogSeriesRequest(r) {
+		// DataDog agent sends data to /api/v1/series, which clashes with Prometheus series API.
+		// Distinguish DataDog requests by POST method and JSON body.
+		path = "/datadog/api/v1/series"
+	}
+	if insertPaths[path] && vmstorage.IsReadOnly() {
+		readOnlyRequestErrors.Inc()
+		err := &httpserver.ErrorWithStatusCode{
+			Err:        storage.ErrReadOnly,
+			StatusCode: http.StatusServiceUnavailable,
+		}
+		httpserver.Errorf(w, "cannot process %q: %s", r.URL.Path, err)
+		return true
+	}
+	if insertPaths[path] {
+		if c := ratelimiter.GetClient(r); c != nil {
+			if d := c.RetryAfter(); d > 0 {
+				rateLimitedRequestErrors.Inc()
+				// Do not log the error in order to prevent from log flooding by throttled clients.
+				// The number of throttled requests is exported via metrics instead.
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+				errStr := fmt.Sprintf("cannot process %q: the client exceeds -insert.maxRowsPerSecondPerIP=%d; retry after %.3f seconds",
+					r.URL.Path, ratelimiter.MaxRowsPerSecondPerIP(), d.Seconds())
+				http.Error(w, errStr, http.StatusTooManyRequests)
+				return true
+			}
+		}
+	}
 	switch path {
 	case "/api/v1/write":
 		prometheusWriteRequests.Inc()
-		if err := prometheus.InsertHandler(r, int64(*maxInsertRequestSize)); err != nil {
+		if err := prometheus.InsertHandler(w, r, getMaxRequestSize(prometheusMaxRequestSize)); err != nil {
 			prometheusWriteErrors.Inc()
 			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
 			return true
@@ -57,18 +161,102 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 		return true
 	case "/write", "/api/v2/write":
 		influxWriteRequests.Inc()
-		if err := influx.InsertHandler(r); err != nil {
+		if !influxutil.CheckAuth(w, r) {
+			influxWriteErrors.Inc()
+			return true
+		}
+		if err := influx.InsertHandler(r, getMaxStreamRequestSize(influxMaxRequestSize)); err != nil {
 			influxWriteErrors.Inc()
 			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
 			return true
 		}
 		w.WriteHeader(http.StatusNoContent)
 		return true
-	case "/query":
-		// Emulate fake response for influx query.
-		// This is required for TSBS benchmark.
-		influxQueryRequests.Inc()
-		fmt.Fprintf(w, `{"results":[{"series":[{"values":[]}]}]}`)
+	case "/api/v1/import":
+		vmimportRequests.Inc()
+		if err := vmimport.InsertHandler(r, getMaxStreamRequestSize(importMaxRequestSize)); err != nil {
+			vmimportErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/api/v1/import/csv":
+		csvImportRequests.Inc()
+		if err := csvimport.InsertHandler(w, r, getMaxStreamRequestSize(importMaxRequestSize)); err != nil {
+			csvImportErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	case "/api/v1/import/native":
+		nativeImportRequests.Inc()
+		if err := native.InsertHandler(r, getMaxStreamRequestSize(importMaxRequestSize)); err != nil {
+			nativeImportErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/api/v1/import/prometheus":
+		prometheusImportRequests.Inc()
+		if err := prometheusimport.InsertHandler(r, getMaxStreamRequestSize(importMaxRequestSize)); err != nil {
+			prometheusImportErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/api/v1/import/prometheus-wal":
+		if len(*prometheusWALImportAuthKey) == 0 {
+			// The endpoint reads local files, so it is disabled by default.
+			return false
+		}
+		prometheusWALImportRequests.Inc()
+		authKey := r.FormValue("authKey")
+		if authKey != *prometheusWALImportAuthKey {
+			prometheusWALImportErrors.Inc()
+			httpserver.Errorf(w, "invalid authKey %q. It must match the value from -import.prometheusWALAuthKey command line flag", authKey)
+			return true
+		}
+		if err := promwal.InsertHandler(r); err != nil {
+			prometheusWALImportErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/api/put":
+		opentsdbhttpPutRequests.Inc()
+		if err := opentsdbhttp.InsertHandler(w, r, getMaxRequestSize(opentsdbhttpMaxRequestSize)); err != nil {
+			opentsdbhttpPutErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	case "/datadog/api/v1/series":
+		datadogWriteRequests.Inc()
+		if err := datadog.InsertHandler(r, getMaxRequestSize(datadogMaxRequestSize)); err != nil {
+			datadogWriteErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		// DataDog agent expects 202 Accepted response.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"status":"ok"}`)
+		return true
+	case "/datadog/api/v1/validate", "/api/v1/validate":
+		// DataDog agent validates the API key on startup.
+		datadogValidateRequests.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"valid":true}`)
+		return true
+	case "/datadog/intake", "/datadog/intake/", "/intake", "/intake/":
+		// DataDog agent sends host metadata to /intake. It isn't stored.
+		datadogIntakeRequests.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{}`)
 		return true
 	default:
 		// This is not our link
@@ -76,12 +264,58 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 	}
 }
 
+// insertPaths contains paths for data ingestion, which are rejected while the storage is in read-only mode.
+var insertPaths = map[string]bool{
+	"/api/v1/write":                 true,
+	"/write":                        true,
+	"/api/v2/write":                 true,
+	"/api/v1/import":                true,
+	"/api/v1/import/csv":            true,
+	"/api/v1/import/native":         true,
+	"/api/v1/import/prometheus":     true,
+	"/api/v1/import/prometheus-wal": true,
+	"/api/put":                      true,
+	"/datadog/api/v1/series":        true,
+}
+
+func isDatadogSeriesRequest(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	contentType := r.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/json")
+}
+
 var (
+	readOnlyRequestErrors    = metrics.NewCounter(`vm_http_request_errors_total{path="*", reason="read_only"}`)
+	rateLimitedRequestErrors = metrics.NewCounter(`vm_http_request_errors_total{path="*", reason="rate_limit"}`)
+
 	prometheusWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/write", protocol="prometheus"}`)
 	prometheusWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/write", protocol="prometheus"}`)
 
 	influxWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="/write", protocol="influx"}`)
 	influxWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/write", protocol="influx"}`)
 
-	influxQueryRequests = metrics.NewCounter(`vm_http_requests_total{path="/query", protocol="influx"}`)
+	vmimportRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/import", protocol="vmimport"}`)
+	vmimportErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/import", protocol="vmimport"}`)
+
+	csvImportRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/import/csv", protocol="csv"}`)
+	csvImportErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/import/csv", protocol="csv"}`)
+
+	nativeImportRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/import/native", protocol="native"}`)
+	nativeImportErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/import/native", protocol="native"}`)
+
+	prometheusImportRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/import/prometheus", protocol="prometheusimport"}`)
+	prometheusImportErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/import/prometheus", protocol="prometheusimport"}`)
+
+	prometheusWALImportRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/import/prometheus-wal", protocol="promwal"}`)
+	prometheusWALImportErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/import/prometheus-wal", protocol="promwal"}`)
+
+	opentsdbhttpPutRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/put", protocol="opentsdb-http"}`)
+	opentsdbhttpPutErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/put", protocol="opentsdb-http"}`)
+
+	datadogWriteRequests    = metrics.NewCounter(`vm_http_requests_total{path="/datadog/api/v1/series", protocol="datadog"}`)
+	datadogWriteErrors      = metrics.NewCounter(`vm_http_request_errors_total{path="/datadog/api/v1/series", protocol="datadog"}`)
+	datadogValidateRequests = metrics.NewCounter(`vm_http_requests_total{path="/datadog/api/v1/validate", protocol="datadog"}`)
+	datadogIntakeRequests   = metrics.NewCounter(`vm_http_requests_total{path="/datadog/intake", protocol="datadog"}`)
 )
@@ -0,0 +1,118 @@
+package native
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+// The maximum size of marshaled metric name in native format.
+const maxMetricNameSize = 64 * 1024
+
+// The maximum size of marshaled block in native format.
+const maxBlockSize = 4 * 1024 * 1024
+
+// Block is a single block of samples in native format.
+type Block struct {
+	MetricName storage.MetricName
+	Timestamps []int64
+	Values     []float64
+
+	b   storage.Block
+	buf []byte
+}
+
+// Reset resets b.
+func (b *Block) Reset() {
+	b.MetricName.Reset()
+	b.Timestamps = b.Timestamps[:0]
+	b.Values = b.Values[:0]
+	b.b.Reset()
+	b.buf = b.buf[:0]
+}
+
+// readTimeRange reads the time range from the start of native format stream
+// produced by /api/v1/export/native.
+func readTimeRange(r io.Reader) (storage.TimeRange, error) {
+	var tr storage.TimeRange
+	var buf [16]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return tr, fmt.Errorf("cannot read time range: %s", err)
+	}
+	tr.MinTimestamp = encoding.UnmarshalInt64(buf[:8])
+	tr.MaxTimestamp = encoding.UnmarshalInt64(buf[8:])
+	if tr.MinTimestamp > tr.MaxTimestamp {
+		return tr, fmt.Errorf("start time cannot exceed end time; got %d vs %d", tr.MinTimestamp, tr.MaxTimestamp)
+	}
+	return tr, nil
+}
+
+// readBlock reads the next block from r into dst.
+//
+// Samples outside tr are dropped from dst.
+// io.EOF is returned if r has no more blocks.
+func readBlock(dst *Block, r io.Reader, tr storage.TimeRange) error {
+	dst.Reset()
+	var sizeBuf [4]byte
+
+	// Read metricName.
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("cannot read metricName size: %s", err)
+	}
+	size := encoding.UnmarshalUint32(sizeBuf[:])
+	if size > maxMetricNameSize {
+		return fmt.Errorf("too big metricName size: %d; cannot exceed %d", size, maxMetricNameSize)
+	}
+	dst.buf = bytesutil.Resize(dst.buf, int(size))
+	if _, err := io.ReadFull(r, dst.buf); err != nil {
+		return fmt.Errorf("cannot read metricName with size %d: %s", size, err)
+	}
+	if err := dst.MetricName.Unmarshal(dst.buf); err != nil {
+		return fmt.Errorf("cannot unmarshal metricName: %s", err)
+	}
+
+	// Read block.
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		return fmt.Errorf("cannot read block size for metricName %s: %s", &dst.MetricName, err)
+	}
+	size = encoding.UnmarshalUint32(sizeBuf[:])
+	if size > maxBlockSize {
+		return fmt.Errorf("too big block size for metricName %s: %d; cannot exceed %d", &dst.MetricName, size, maxBlockSize)
+	}
+	dst.buf = bytesutil.Resize(dst.buf, int(size))
+	if _, err := io.ReadFull(r, dst.buf); err != nil {
+		return fmt.Errorf("cannot read block with size %d for metricName %s: %s", size, &dst.MetricName, err)
+	}
+	tail, err := dst.b.UnmarshalPortable(dst.buf)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal block for metricName %s: %s", &dst.MetricName, err)
+	}
+	if len(tail) > 0 {
+		return fmt.Errorf("unexpected non-empty tail left after unmarshaling block for metricName %s; len(tail)=%d", &dst.MetricName, len(tail))
+	}
+	if err := dst.b.UnmarshalData(); err != nil {
+		return fmt.Errorf("cannot unmarshal block data for metricName %s: %s", &dst.MetricName, err)
+	}
+
+	// Drop samples outside tr.
+	timestamps := dst.b.Timestamps()
+	values := dst.b.Values()
+	i := 0
+	for i < len(timestamps) && timestamps[i] < tr.MinTimestamp {
+		i++
+	}
+	j := len(timestamps)
+	for j > i && timestamps[j-1] > tr.MaxTimestamp {
+		j--
+	}
+	dst.Timestamps = append(dst.Timestamps[:0], timestamps[i:j]...)
+	dst.Values = decimal.AppendDecimalToFloat(dst.Values[:0], values[i:j], dst.b.Scale())
+	return nil
+}
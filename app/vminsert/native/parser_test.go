@@ -0,0 +1,137 @@
+package native
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func marshalTestBlock(dst []byte, metricGroup string, timestamps, values []int64) []byte {
+	var mn storage.MetricName
+	mn.MetricGroup = []byte(metricGroup)
+	mn.AddTag("job", "test")
+	metricName := mn.Marshal(nil)
+
+	var b storage.Block
+	var tsid storage.TSID
+	b.Init(&tsid, timestamps, values, 0, 64)
+	blockData := b.MarshalPortable(nil)
+
+	dst = encoding.MarshalUint32(dst, uint32(len(metricName)))
+	dst = append(dst, metricName...)
+	dst = encoding.MarshalUint32(dst, uint32(len(blockData)))
+	dst = append(dst, blockData...)
+	return dst
+}
+
+func marshalTestTimeRange(dst []byte, start, end int64) []byte {
+	dst = encoding.MarshalInt64(dst, start)
+	dst = encoding.MarshalInt64(dst, end)
+	return dst
+}
+
+func TestReadTimeRange(t *testing.T) {
+	data := marshalTestTimeRange(nil, 10, 20)
+	tr, err := readTimeRange(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	trExpected := storage.TimeRange{
+		MinTimestamp: 10,
+		MaxTimestamp: 20,
+	}
+	if tr != trExpected {
+		t.Fatalf("unexpected time range; got %+v; want %+v", tr, trExpected)
+	}
+
+	// Truncated time range
+	if _, err := readTimeRange(bytes.NewReader(data[:10])); err == nil {
+		t.Fatalf("expecting non-nil error for truncated time range")
+	}
+
+	// Invalid time range
+	data = marshalTestTimeRange(nil, 20, 10)
+	if _, err := readTimeRange(bytes.NewReader(data)); err == nil {
+		t.Fatalf("expecting non-nil error for invalid time range")
+	}
+}
+
+func TestReadBlockSuccess(t *testing.T) {
+	tr := storage.TimeRange{
+		MinTimestamp: 2000,
+		MaxTimestamp: 4000,
+	}
+	var data []byte
+	data = marshalTestBlock(data, "foo", []int64{1000, 2000, 3000, 4000, 5000}, []int64{1, 2, 3, 4, 5})
+	data = marshalTestBlock(data, "bar", []int64{4000, 4001}, []int64{-10, 10})
+	data = marshalTestBlock(data, "baz", []int64{5000, 6000}, []int64{1, 2})
+	r := bytes.NewReader(data)
+
+	f := func(metricGroupExpected string, timestampsExpected []int64, valuesExpected []float64) {
+		t.Helper()
+		var b Block
+		if err := readBlock(&b, r, tr); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(b.MetricName.MetricGroup) != metricGroupExpected {
+			t.Fatalf("unexpected metric group; got %q; want %q", b.MetricName.MetricGroup, metricGroupExpected)
+		}
+		if tagValue := b.MetricName.GetTagValue("job"); string(tagValue) != "test" {
+			t.Fatalf("unexpected job tag value; got %q; want %q", tagValue, "test")
+		}
+		if len(b.Timestamps) != len(timestampsExpected) || (len(b.Timestamps) > 0 && !reflect.DeepEqual(b.Timestamps, timestampsExpected)) {
+			t.Fatalf("unexpected timestamps; got %v; want %v", b.Timestamps, timestampsExpected)
+		}
+		if len(b.Values) != len(valuesExpected) || (len(b.Values) > 0 && !reflect.DeepEqual(b.Values, valuesExpected)) {
+			t.Fatalf("unexpected values; got %v; want %v", b.Values, valuesExpected)
+		}
+	}
+	f("foo", []int64{2000, 3000, 4000}, []float64{2, 3, 4})
+	f("bar", []int64{4000}, []float64{-10})
+	f("baz", nil, nil)
+
+	var b Block
+	if err := readBlock(&b, r, tr); err != io.EOF {
+		t.Fatalf("expecting io.EOF; got %v", err)
+	}
+}
+
+func TestReadBlockFailure(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		tr := storage.TimeRange{
+			MinTimestamp: 0,
+			MaxTimestamp: 1e12,
+		}
+		var b Block
+		err := readBlock(&b, bytes.NewReader(data), tr)
+		if err == nil || err == io.EOF {
+			t.Fatalf("expecting non-nil error; got %v", err)
+		}
+	}
+
+	data := marshalTestBlock(nil, "foo", []int64{1, 2, 3}, []int64{4, 5, 6})
+
+	// Truncated data
+	for i := 1; i < len(data); i++ {
+		f(data[:i])
+	}
+
+	// Too big metricName
+	f(encoding.MarshalUint32(nil, maxMetricNameSize+1))
+
+	// Invalid metricName
+	dataInvalid := encoding.MarshalUint32(nil, 3)
+	dataInvalid = append(dataInvalid, "foo"...)
+	f(dataInvalid)
+
+	// Unsupported block version
+	dataInvalid = append([]byte{}, data...)
+	metricNameSize := encoding.UnmarshalUint32(dataInvalid)
+	dataInvalid[4+metricNameSize+4]++
+	f(dataInvalid)
+}
@@ -0,0 +1,181 @@
+package native
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	rowsInserted   = metrics.NewCounter(`vm_rows_inserted_total{type="native"}`)
+	blocksInserted = metrics.NewCounter(`vm_blocks_inserted_total{type="native"}`)
+)
+
+// InsertHandler processes data in native format from req.
+//
+// The data must be obtained from /api/v1/export/native.
+//
+// Every block is read and unpacked in full before its samples are passed to the storage
+// in a single call, so a truncated or malformed block isn't inserted at all, while
+// all the preceding blocks are inserted. This isn't a storage-level transaction:
+// the storage may still drop or fail to store some samples from the block, e.g. samples
+// outside the retention or samples for series exceeding the configured limits.
+// Re-sending blocks after a failure may result in duplicate samples, which are removed
+// if `-dedup.minScrapeInterval` is set.
+//
+// maxSize limits the size of the request body after decompression.
+func InsertHandler(req *http.Request, maxSize int64) error {
+	return concurrencylimiter.Do(func() error {
+		return insertHandlerInternal(req, maxSize)
+	})
+}
+
+func insertHandlerInternal(req *http.Request, maxSize int64) error {
+	nativeReadCalls.Inc()
+
+	r := req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := getGzipReader(r)
+		if err != nil {
+			return fmt.Errorf("cannot read gzipped native data: %s", err)
+		}
+		defer putGzipReader(zr)
+		r = zr
+	}
+	mr := common.NewMaxSizeReader(r, maxSize)
+
+	ctx := getPushCtx(mr)
+	defer putPushCtx(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(req))
+	ctx.Common.SetAccountID(tenant.GetAccountID(req.Context()))
+	tr, err := readTimeRange(ctx.br)
+	if err != nil {
+		nativeReadErrors.Inc()
+		if mrErr := mr.Err(); mrErr != nil {
+			return mrErr
+		}
+		return err
+	}
+	for {
+		if err := readBlock(&ctx.Block, ctx.br, tr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if mrErr := mr.Err(); mrErr != nil {
+				nativeReadErrors.Inc()
+				return mrErr
+			}
+			nativeUnmarshalErrors.Inc()
+			return err
+		}
+		if err := ctx.InsertBlock(); err != nil {
+			return err
+		}
+	}
+}
+
+// InsertBlock passes all the samples from ctx.Block to the storage in a single call.
+func (ctx *pushCtx) InsertBlock() error {
+	b := &ctx.Block
+	if len(b.Timestamps) == 0 {
+		// Nothing to insert.
+		return nil
+	}
+	ic := &ctx.Common
+	ic.Reset(len(b.Timestamps))
+	ic.Labels = ic.Labels[:0]
+	mn := &b.MetricName
+	ic.AddLabel("", bytesutil.ToUnsafeString(mn.MetricGroup))
+	for i := range mn.Tags {
+		tag := &mn.Tags[i]
+		ic.AddLabel(bytesutil.ToUnsafeString(tag.Key), bytesutil.ToUnsafeString(tag.Value))
+	}
+	var metricNameRaw []byte
+	values := b.Values
+	for i, ts := range b.Timestamps {
+		metricNameRaw = ic.WriteDataPointExt(metricNameRaw, ic.Labels, ts, values[i])
+	}
+	rowsInserted.Add(len(b.Timestamps))
+	blocksInserted.Inc()
+	return ic.FlushBufs()
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	v := gzipReaderPool.Get()
+	if v == nil {
+		return gzip.NewReader(r)
+	}
+	zr := v.(*gzip.Reader)
+	if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+func putGzipReader(zr *gzip.Reader) {
+	_ = zr.Close()
+	gzipReaderPool.Put(zr)
+}
+
+var gzipReaderPool sync.Pool
+
+var (
+	nativeReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="native"}`)
+	nativeReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="native"}`)
+	nativeUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="native"}`)
+)
+
+type pushCtx struct {
+	Block  Block
+	Common common.InsertCtx
+
+	br *bufio.Reader
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Block.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
+	ctx.br.Reset(nil)
+}
+
+func getPushCtx(r io.Reader) *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		ctx.br.Reset(r)
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			ctx := v.(*pushCtx)
+			ctx.br.Reset(r)
+			return ctx
+		}
+		return &pushCtx{
+			br: bufio.NewReaderSize(r, 64*1024),
+		}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
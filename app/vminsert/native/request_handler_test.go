@@ -0,0 +1,78 @@
+package native
+
+import (
+	"bytes"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestInsertHandlerTruncatedBlock(t *testing.T) {
+	path := "TestInsertHandlerTruncatedBlock"
+	if err := flag.Set("storageDataPath", path); err != nil {
+		t.Fatalf("cannot set storageDataPath: %s", err)
+	}
+	vmstorage.Init(func(mrs []storage.MetricRow) {})
+	defer func() {
+		vmstorage.Stop()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+	concurrencylimiter.Init()
+
+	ts := time.Now().Add(-time.Hour).UnixNano() / 1e6
+	timestamps := []int64{ts, ts + 1000, ts + 2000}
+	values := []int64{1, 2, 3}
+	data := marshalTestTimeRange(nil, ts-1000, ts+3000)
+	data = marshalTestBlock(data, "foo", timestamps, values)
+	blockStart := len(data)
+	data = marshalTestBlock(data, "bar", timestamps, values)
+	// Cut the last block in the middle of its data.
+	data = data[:blockStart+(len(data)-blockStart)/2]
+
+	req := httptest.NewRequest("POST", "/api/v1/import/native", bytes.NewReader(data))
+	if err := InsertHandler(req, int64(len(data))); err == nil {
+		t.Fatalf("expecting non-nil error for the truncated block")
+	}
+	vmstorage.Storage.DebugFlush()
+
+	// searchRows returns the number of rows for the given metric.
+	searchRows := func(metricGroup string) int {
+		t.Helper()
+		tfs := storage.NewTagFilters()
+		if err := tfs.Add(nil, []byte(metricGroup), false, false); err != nil {
+			t.Fatalf("cannot add tag filter: %s", err)
+		}
+		tr := storage.TimeRange{
+			MinTimestamp: ts - 1000,
+			MaxTimestamp: ts + 3000,
+		}
+		rows := 0
+		var sr storage.Search
+		sr.Init(vmstorage.Storage, []*storage.TagFilters{tfs}, tr, 1e5)
+		for sr.NextMetricBlock() {
+			rows += sr.MetricBlock.Block.RowsCount()
+		}
+		if err := sr.Error(); err != nil {
+			t.Fatalf("unexpected error in search: %s", err)
+		}
+		sr.MustClose()
+		return rows
+	}
+
+	// The block preceding the truncated one must be inserted in full.
+	if n := searchRows("foo"); n != len(timestamps) {
+		t.Fatalf("unexpected number of rows for the complete block; got %d; want %d", n, len(timestamps))
+	}
+	// No samples from the truncated block may be inserted.
+	if n := searchRows("bar"); n != 0 {
+		t.Fatalf("unexpected number of rows for the truncated block; got %d; want 0", n)
+	}
+}
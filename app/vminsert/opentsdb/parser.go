@@ -43,6 +43,54 @@ func (rs *Rows) Unmarshal(s string) error {
 	return err
 }
 
+// UnmarshalSkipInvalid unmarshals OpenTSDB put rows from s, skipping malformed lines.
+//
+// Lines with telnet commands other than `put`, such as `version` or `stats`, are passed to cmdFunc
+// without leading and trailing whitespace. errFunc is called with the error for every malformed put line,
+// so it doesn't prevent from unmarshaling the remaining lines.
+//
+// See http://opentsdb.net/docs/build/html/api_telnet/index.html
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) UnmarshalSkipInvalid(s string, cmdFunc func(cmd string), errFunc func(err error)) {
+	dst := rs.Rows[:0]
+	tagsPool := rs.tagsPool[:0]
+	for len(s) > 0 {
+		line := s
+		n := strings.IndexByte(s, '\n')
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			// Skip empty line
+			continue
+		}
+		if line != "put" && !strings.HasPrefix(line, "put ") {
+			cmdFunc(line)
+			continue
+		}
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Row{})
+		}
+		r := &dst[len(dst)-1]
+		var err error
+		tagsPool, err = r.unmarshal(line, tagsPool)
+		if err != nil {
+			r.reset()
+			dst = dst[:len(dst)-1]
+			errFunc(err)
+		}
+	}
+	rs.Rows = dst
+	rs.tagsPool = tagsPool
+}
+
 // Row is a single OpenTSDB row.
 type Row struct {
 	Metric    string
@@ -201,3 +201,65 @@ func TestRowsUnmarshalSuccess(t *testing.T) {
 		},
 	})
 }
+
+func TestRowsUnmarshalSkipInvalid(t *testing.T) {
+	f := func(s string, rowsExpected *Rows, cmdsExpected []string, errorsExpected int) {
+		t.Helper()
+		var rows Rows
+		for i := 0; i < 2; i++ {
+			var cmds []string
+			errors := 0
+			rows.UnmarshalSkipInvalid(s, func(cmd string) {
+				cmds = append(cmds, cmd)
+			}, func(err error) {
+				errors++
+			})
+			if errors != errorsExpected {
+				t.Fatalf("unexpected number of errors for %q; got %d; want %d", s, errors, errorsExpected)
+			}
+			if !reflect.DeepEqual(cmds, cmdsExpected) {
+				t.Fatalf("unexpected commands for %q; got %q; want %q", s, cmds, cmdsExpected)
+			}
+			if len(rows.Rows) == 0 && len(rowsExpected.Rows) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+				t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+			}
+		}
+	}
+
+	// Empty lines
+	f("", &Rows{}, nil, 0)
+	f("\n\r\n", &Rows{}, nil, 0)
+
+	// Only malformed lines
+	f("put\nput aaa 123\nput aaa 123 4.5 =foo\n", &Rows{}, nil, 3)
+
+	// Commands
+	f("version\n stats \r\nfoo bar\n", &Rows{}, []string{"version", "stats", "foo bar"}, 0)
+
+	// Malformed line and commands between valid lines
+	f("put foo 2 1 a=b\nversion\nput aaa\nput bar 3 4 x=y", &Rows{
+		Rows: []Row{
+			{
+				Metric:    "foo",
+				Value:     1,
+				Timestamp: 2,
+				Tags: []Tag{{
+					Key:   "a",
+					Value: "b",
+				}},
+			},
+			{
+				Metric:    "bar",
+				Value:     4,
+				Timestamp: 3,
+				Tags: []Tag{{
+					Key:   "x",
+					Value: "y",
+				}},
+			},
+		},
+	}, []string{"version"}, 1)
+}
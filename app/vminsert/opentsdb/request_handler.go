@@ -5,19 +5,28 @@ import (
 	"io"
 	"net"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/buildinfo"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/metrics"
 )
 
-var rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="opentsdb"}`)
+var (
+	rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="opentsdb"}`)
+	rowsInvalid  = metrics.NewCounter(`vm_rows_invalid_total{type="opentsdb"}`)
+)
 
 // insertHandler processes remote write for OpenTSDB put protocol.
 //
+// Replies to `version` and `stats` telnet commands are written to r if it implements io.Writer.
+//
 // See http://opentsdb.net/docs/build/html/api_telnet/put.html
 func insertHandler(r io.Reader) error {
 	return concurrencylimiter.Do(func() error {
@@ -28,14 +37,64 @@ func insertHandler(r io.Reader) error {
 func insertHandlerInternal(r io.Reader) error {
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
+	w, _ := r.(io.Writer)
 	for ctx.Read(r) {
 		if err := ctx.InsertRows(); err != nil {
 			return err
 		}
+		if err := ctx.WriteReplies(w); err != nil {
+			return err
+		}
 	}
 	return ctx.Error()
 }
 
+// WriteReplies writes replies to telnet commands read by the last ctx.Read call to w.
+//
+// Replies are dropped if w is nil.
+func (ctx *pushCtx) WriteReplies(w io.Writer) error {
+	if len(ctx.replyBuf) == 0 || w == nil {
+		return nil
+	}
+	if _, err := w.Write(ctx.replyBuf); err != nil {
+		return fmt.Errorf("cannot write reply to telnet command: %s", err)
+	}
+	return nil
+}
+
+// appendCommandReply appends reply to the given telnet command to dst and returns the result.
+//
+// Clients such as tcollector send `version` command for checking the connection, so they must obtain a reply.
+// Unknown commands are counted as invalid rows like malformed put lines.
+func appendCommandReply(dst []byte, cmd string, currentTimestamp int64) []byte {
+	name := cmd
+	if n := strings.IndexByte(cmd, ' '); n >= 0 {
+		name = cmd[:n]
+	}
+	switch name {
+	case "version":
+		return append(dst, "VictoriaMetrics "+buildinfo.Version+"\n"...)
+	case "stats":
+		dst = appendStat(dst, "rows_inserted", currentTimestamp, rowsInserted.Get())
+		dst = appendStat(dst, "rows_invalid", currentTimestamp, rowsInvalid.Get())
+		return dst
+	default:
+		rowsInvalid.Inc()
+		return append(dst, "unknown command: "+name+".  Try `help'.\n"...)
+	}
+}
+
+func appendStat(dst []byte, name string, currentTimestamp int64, value uint64) []byte {
+	dst = append(dst, "vm."...)
+	dst = append(dst, name...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, currentTimestamp, 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, value, 10)
+	dst = append(dst, " type=opentsdb\n"...)
+	return dst
+}
+
 func (ctx *pushCtx) InsertRows() error {
 	rows := ctx.Rows.Rows
 	ic := &ctx.Common
@@ -83,25 +142,48 @@ func (ctx *pushCtx) Read(r io.Reader) bool {
 			return false
 		}
 	}
-	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf)); err != nil {
+	ctx.replyBuf = ctx.replyBuf[:0]
+	currentTimestamp := time.Now().Unix()
+	invalidLines := 0
+	var firstErr error
+	ctx.Rows.UnmarshalSkipInvalid(bytesutil.ToUnsafeString(ctx.reqBuf), func(cmd string) {
+		ctx.replyBuf = appendCommandReply(ctx.replyBuf, cmd, currentTimestamp)
+	}, func(err error) {
+		// Malformed lines are skipped, so they don't break the connection with the remaining valid lines.
+		rowsInvalid.Inc()
+		if firstErr == nil {
+			firstErr = err
+		}
+		invalidLines++
+	})
+	if invalidLines > 0 {
 		opentsdbUnmarshalErrors.Inc()
-		ctx.err = fmt.Errorf("cannot unmarshal OpenTSDB put protocol data with size %d: %s", len(ctx.reqBuf), err)
-		return false
+		logger.Errorf("skipped %d malformed OpenTSDB put lines out of %d lines; the first error: %s", invalidLines, invalidLines+len(ctx.Rows.Rows), firstErr)
 	}
 
-	// Convert timestamps from seconds to milliseconds
+	// Convert timestamps in seconds to milliseconds. Timestamps in milliseconds are left as is.
 	for i := range ctx.Rows.Rows {
-		ctx.Rows.Rows[i].Timestamp *= 1e3
+		r := &ctx.Rows.Rows[i]
+		if r.Timestamp&secondMask == 0 {
+			r.Timestamp *= 1e3
+		}
 	}
 	return true
 }
 
+// secondMask is used for distinguishing timestamps in seconds and in milliseconds.
+//
+// Timestamps in seconds fit 32 bits, while timestamps in milliseconds don't.
+// See http://opentsdb.net/docs/javadoc/net/opentsdb/core/Const.html#SECOND_MASK
+const secondMask int64 = 0x7FFFFFFF00000000
+
 type pushCtx struct {
 	Rows   Rows
 	Common common.InsertCtx
 
-	reqBuf  []byte
-	tailBuf []byte
+	reqBuf   []byte
+	tailBuf  []byte
+	replyBuf []byte
 
 	err error
 }
@@ -118,6 +200,7 @@ func (ctx *pushCtx) reset() {
 	ctx.Common.Reset(0)
 	ctx.reqBuf = ctx.reqBuf[:0]
 	ctx.tailBuf = ctx.tailBuf[:0]
+	ctx.replyBuf = ctx.replyBuf[:0]
 
 	ctx.err = nil
 }
@@ -0,0 +1,67 @@
+package opentsdb
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPushCtxRead(t *testing.T) {
+	f := func(s string, timestampsExpected []int64, replyPrefixesExpected []string) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		if !ctx.Read(strings.NewReader(s)) {
+			t.Fatalf("unexpected error when reading %q: %s", s, ctx.Error())
+		}
+		var timestamps []int64
+		for _, r := range ctx.Rows.Rows {
+			timestamps = append(timestamps, r.Timestamp)
+		}
+		if !reflect.DeepEqual(timestamps, timestampsExpected) {
+			t.Fatalf("unexpected timestamps for %q; got %d; want %d", s, timestamps, timestampsExpected)
+		}
+		var bb bytes.Buffer
+		if err := ctx.WriteReplies(&bb); err != nil {
+			t.Fatalf("unexpected error when writing replies: %s", err)
+		}
+		var replies []string
+		if bb.Len() > 0 {
+			replies = strings.Split(strings.TrimSuffix(bb.String(), "\n"), "\n")
+		}
+		if len(replies) != len(replyPrefixesExpected) {
+			t.Fatalf("unexpected replies for %q; got %q; want prefixes %q", s, replies, replyPrefixesExpected)
+		}
+		for i, reply := range replies {
+			if !strings.HasPrefix(reply, replyPrefixesExpected[i]) {
+				t.Fatalf("unexpected reply #%d for %q; got %q; want prefix %q", i, s, reply, replyPrefixesExpected[i])
+			}
+		}
+	}
+
+	// Timestamps in seconds and in milliseconds
+	f("put foo 1560277292 1 a=b\nput foo 1560277292123 2 a=b\n", []int64{1560277292000, 1560277292123}, nil)
+
+	// Malformed lines are skipped
+	f("put foo 123 1 a=b\nput bar\nput foo 456 2 a=b\n", []int64{123000, 456000}, nil)
+
+	// Commands
+	f("version\nput foo 123 1 a=b\nstats\nfoobar\n", []int64{123000}, []string{
+		"VictoriaMetrics ",
+		"vm.rows_inserted ",
+		"vm.rows_invalid ",
+		"unknown command: foobar.",
+	})
+}
+
+func TestWriteRepliesNilWriter(t *testing.T) {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	if !ctx.Read(strings.NewReader("version\n")) {
+		t.Fatalf("unexpected error: %s", ctx.Error())
+	}
+	if err := ctx.WriteReplies(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,229 @@
+package opentsdbhttp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/valyala/fastjson"
+)
+
+// Rows contains parsed OpenTSDB rows.
+type Rows struct {
+	Rows []Row
+
+	// Errors contains records, which couldn't be parsed.
+	Errors []RowError
+
+	tagsPool []Tag
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Release references to objects, so they can be GC'ed.
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+
+	for i := range rs.Errors {
+		rs.Errors[i].reset()
+	}
+	rs.Errors = rs.Errors[:0]
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+}
+
+// Unmarshal unmarshals OpenTSDB put rows from av.
+//
+// av may contain either a single JSON object or a JSON array of objects.
+// Records, which cannot be parsed, are put into rs.Errors, while the remaining
+// records are put into rs.Rows.
+//
+// See http://opentsdb.net/docs/build/html/api_http/put.html
+//
+// av must be unchanged until rs is in use.
+func (rs *Rows) Unmarshal(av *fastjson.Value) error {
+	rs.Reset()
+	switch av.Type() {
+	case fastjson.TypeObject:
+		rs.unmarshalRow(av)
+	case fastjson.TypeArray:
+		a, _ := av.Array()
+		for _, o := range a {
+			rs.unmarshalRow(o)
+		}
+	default:
+		return fmt.Errorf("expecting JSON object or JSON array; got %s", av.Type())
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalRow(o *fastjson.Value) {
+	dst := rs.Rows
+	if cap(dst) > len(dst) {
+		dst = dst[:len(dst)+1]
+	} else {
+		dst = append(dst, Row{})
+	}
+	r := &dst[len(dst)-1]
+	tagsPool, err := r.unmarshal(o, rs.tagsPool)
+	if err != nil {
+		r.reset()
+		rs.Rows = dst[:len(dst)-1]
+		rs.Errors = append(rs.Errors, RowError{
+			Datapoint: o,
+			Err:       err,
+		})
+		return
+	}
+	rs.Rows = dst
+	rs.tagsPool = tagsPool
+}
+
+// RowError contains a record, which couldn't be parsed.
+type RowError struct {
+	// Datapoint is the original record.
+	Datapoint *fastjson.Value
+
+	// Err is the reason why Datapoint couldn't be parsed.
+	Err error
+}
+
+func (re *RowError) reset() {
+	re.Datapoint = nil
+	re.Err = nil
+}
+
+// Row is a single OpenTSDB row.
+type Row struct {
+	Metric    string
+	Tags      []Tag
+	Value     float64
+	Timestamp int64
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Value = 0
+	r.Timestamp = 0
+}
+
+func (r *Row) unmarshal(o *fastjson.Value, tagsPool []Tag) ([]Tag, error) {
+	r.reset()
+	if o.Type() != fastjson.TypeObject {
+		return tagsPool, fmt.Errorf("expecting JSON object; got %s", o.Type())
+	}
+	m := o.Get("metric")
+	if m == nil {
+		return tagsPool, fmt.Errorf("missing `metric`")
+	}
+	metric, err := m.StringBytes()
+	if err != nil {
+		return tagsPool, fmt.Errorf("invalid `metric`: %s", err)
+	}
+	if len(metric) == 0 {
+		return tagsPool, fmt.Errorf("`metric` cannot be empty")
+	}
+	r.Metric = bytesutil.ToUnsafeString(metric)
+
+	if ts := o.Get("timestamp"); ts != nil {
+		// Zero timestamp is substituted with the current time by the caller.
+		f, err := getFloat64(ts)
+		if err != nil {
+			return tagsPool, fmt.Errorf("invalid `timestamp`: %s", err)
+		}
+		r.Timestamp = int64(f)
+	}
+
+	v := o.Get("value")
+	if v == nil {
+		return tagsPool, fmt.Errorf("missing `value`")
+	}
+	r.Value, err = getFloat64(v)
+	if err != nil {
+		return tagsPool, fmt.Errorf("invalid `value`: %s", err)
+	}
+
+	t := o.Get("tags")
+	if t == nil {
+		return tagsPool, nil
+	}
+	tags, err := t.Object()
+	if err != nil {
+		return tagsPool, fmt.Errorf("invalid `tags`: %s", err)
+	}
+	tagsStart := len(tagsPool)
+	tagsPool, err = unmarshalTags(tagsPool, tags)
+	if err != nil {
+		return tagsPool[:tagsStart], fmt.Errorf("cannot unmarshal tags: %s", err)
+	}
+	tagsNew := tagsPool[tagsStart:]
+	r.Tags = tagsNew[:len(tagsNew):len(tagsNew)]
+	return tagsPool, nil
+}
+
+// getFloat64 returns the numeric value from v.
+//
+// OpenTSDB agents may send numbers as strings, so such values are parsed as well.
+// Only finite numbers are accepted.
+func getFloat64(v *fastjson.Value) (float64, error) {
+	switch v.Type() {
+	case fastjson.TypeNumber:
+		return v.Float64()
+	case fastjson.TypeString:
+		b, _ := v.StringBytes()
+		f, err := strconv.ParseFloat(bytesutil.ToUnsafeString(b), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			// v is formatted as JSON string, so the error message may be embedded into JSON responses as is.
+			return 0, fmt.Errorf("cannot parse %s as a finite number", v)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("expecting number or string; got %s", v.Type())
+	}
+}
+
+func unmarshalTags(dst []Tag, o *fastjson.Object) ([]Tag, error) {
+	var err error
+	o.Visit(func(k []byte, v *fastjson.Value) {
+		if err != nil {
+			return
+		}
+		if len(k) == 0 {
+			err = fmt.Errorf("tag key cannot be empty")
+			return
+		}
+		value, e := v.StringBytes()
+		if e != nil {
+			err = fmt.Errorf("invalid value for tag %q: %s", k, e)
+			return
+		}
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Tag{})
+		}
+		tag := &dst[len(dst)-1]
+		tag.Key = bytesutil.ToUnsafeString(k)
+		tag.Value = bytesutil.ToUnsafeString(value)
+	})
+	return dst, err
+}
+
+// Tag is an OpenTSDB tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
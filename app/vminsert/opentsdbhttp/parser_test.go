@@ -0,0 +1,228 @@
+package opentsdbhttp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var rows Rows
+		v, err := fastjson.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %s: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s", s)
+		}
+
+		// Try again
+		if err := rows.Unmarshal(v); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s", s)
+		}
+	}
+
+	// Invalid json type
+	f(`1`)
+	f(`"foo"`)
+	f(`null`)
+}
+
+func TestRowsUnmarshalInvalidRows(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var rows Rows
+		v, err := fastjson.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %s: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		if len(rows.Rows) != 0 {
+			t.Fatalf("expecting zero rows; got %d rows: %+v", len(rows.Rows), rows.Rows)
+		}
+		if len(rows.Errors) != 1 {
+			t.Fatalf("expecting a single error; got %d errors: %+v", len(rows.Errors), rows.Errors)
+		}
+	}
+
+	// Object instead of array item
+	f(`[1]`)
+
+	// Missing metric
+	f(`{"timestamp":1,"value":2,"tags":{"a":"b"}}`)
+	f(`{"metric":"","timestamp":1,"value":2}`)
+	f(`{"metric":123,"timestamp":1,"value":2}`)
+
+	// Missing value
+	f(`{"metric":"foo","timestamp":1}`)
+
+	// Invalid value
+	f(`{"metric":"foo","timestamp":1,"value":"bar"}`)
+	f(`{"metric":"foo","timestamp":1,"value":true}`)
+	f(`{"metric":"foo","timestamp":1,"value":""}`)
+	f(`{"metric":"foo","timestamp":1,"value":"12abc"}`)
+	f(`{"metric":"foo","timestamp":1,"value":"Inf"}`)
+
+	// Invalid timestamp
+	f(`{"metric":"foo","timestamp":"bar","value":1}`)
+	f(`{"metric":"foo","timestamp":[],"value":1}`)
+
+	// Invalid tags
+	f(`{"metric":"foo","timestamp":1,"value":1,"tags":[]}`)
+	f(`{"metric":"foo","timestamp":1,"value":1,"tags":{"a":1}}`)
+	f(`{"metric":"foo","timestamp":1,"value":1,"tags":{"":"b"}}`)
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(s string, rowsExpected *Rows, errorsExpected int) {
+		t.Helper()
+		var rows Rows
+		v, err := fastjson.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %s: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %s: %s", v, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+		if len(rows.Errors) != errorsExpected {
+			t.Fatalf("unexpected number of errors; got %d; want %d; errors: %+v", len(rows.Errors), errorsExpected, rows.Errors)
+		}
+
+		// Try unmarshaling again
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %s: %s", v, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+		if len(rows.Errors) != errorsExpected {
+			t.Fatalf("unexpected number of errors; got %d; want %d; errors: %+v", len(rows.Errors), errorsExpected, rows.Errors)
+		}
+
+		rows.Reset()
+		if len(rows.Rows) != 0 {
+			t.Fatalf("non-empty rows after reset: %+v", rows.Rows)
+		}
+		if len(rows.Errors) != 0 {
+			t.Fatalf("non-empty errors after reset: %+v", rows.Errors)
+		}
+	}
+
+	// Empty array
+	f(`[]`, &Rows{}, 0)
+
+	// Single object
+	f(`{"metric":"foobar","timestamp":789,"value":-123.456,"tags":{"a":"b"}}`, &Rows{
+		Rows: []Row{{
+			Metric:    "foobar",
+			Value:     -123.456,
+			Timestamp: 789,
+			Tags: []Tag{{
+				Key:   "a",
+				Value: "b",
+			}},
+		}},
+	}, 0)
+
+	// Missing timestamp and tags
+	f(`{"metric":"foobar","value":1}`, &Rows{
+		Rows: []Row{{
+			Metric: "foobar",
+			Value:  1,
+		}},
+	}, 0)
+
+	// Numbers as strings
+	f(`{"metric":"foobar","timestamp":"789","value":"12.5"}`, &Rows{
+		Rows: []Row{{
+			Metric:    "foobar",
+			Value:     12.5,
+			Timestamp: 789,
+		}},
+	}, 0)
+
+	// Zero values as strings
+	f(`[{"metric":"foo","value":"0.0"},{"metric":"bar","value":"-0"},{"metric":"baz","timestamp":"0.0","value":"-0.0e3"}]`, &Rows{
+		Rows: []Row{
+			{
+				Metric: "foo",
+			},
+			{
+				Metric: "bar",
+			},
+			{
+				Metric: "baz",
+			},
+		},
+	}, 0)
+
+	// Non-finite numbers as strings must be rejected
+	f(`[{"metric":"foo","value":"NaN"},{"metric":"bar","value":"-Inf"},{"metric":"baz","value":"1e400"},{"metric":"qux","value":"1e-3"}]`, &Rows{
+		Rows: []Row{{
+			Metric: "qux",
+			Value:  1e-3,
+		}},
+	}, 3)
+
+	// Array
+	f(`[{"metric":"foo","timestamp":2,"value":0.3,"tags":{"a":"b","x":""}},{"metric":"bar.baz","timestamp":43,"value":0.34,"tags":{"a":"b"}}]`, &Rows{
+		Rows: []Row{
+			{
+				Metric:    "foo",
+				Value:     0.3,
+				Timestamp: 2,
+				Tags: []Tag{
+					{
+						Key:   "a",
+						Value: "b",
+					},
+					{
+						Key:   "x",
+						Value: "",
+					},
+				},
+			},
+			{
+				Metric:    "bar.baz",
+				Value:     0.34,
+				Timestamp: 43,
+				Tags: []Tag{{
+					Key:   "a",
+					Value: "b",
+				}},
+			},
+		},
+	}, 0)
+
+	// Malformed records in the middle of array must be skipped
+	f(`[{"metric":"foo","timestamp":2,"value":1,"tags":{"a":"b"}},{"metric":"bad","value":"xx","tags":{"c":"d"}},{"timestamp":3,"value":4},{"metric":"bar","timestamp":3,"value":2,"tags":{"e":"f"}}]`, &Rows{
+		Rows: []Row{
+			{
+				Metric:    "foo",
+				Value:     1,
+				Timestamp: 2,
+				Tags: []Tag{{
+					Key:   "a",
+					Value: "b",
+				}},
+			},
+			{
+				Metric:    "bar",
+				Value:     2,
+				Timestamp: 3,
+				Tags: []Tag{{
+					Key:   "e",
+					Value: "f",
+				}},
+			},
+		},
+	}, 2)
+}
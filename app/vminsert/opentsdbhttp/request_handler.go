@@ -0,0 +1,235 @@
+package opentsdbhttp
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/valyala/fastjson"
+)
+
+var (
+	rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="opentsdb-http"}`)
+	rowsInvalid  = metrics.NewCounter(`vm_rows_invalid_total{type="opentsdb-http"}`)
+)
+
+// InsertHandler processes HTTP OpenTSDB put requests.
+//
+// The response is written to w on success. If `details` query arg is set,
+// then the response contains per-datapoint errors.
+//
+// See http://opentsdb.net/docs/build/html/api_http/put.html
+func InsertHandler(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	return concurrencylimiter.Do(func() error {
+		return insertHandlerInternal(w, req, maxSize)
+	})
+}
+
+func insertHandlerInternal(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	opentsdbReadCalls.Inc()
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(req))
+	ctx.Common.SetAccountID(tenant.GetAccountID(req.Context()))
+	if err := ctx.Read(req, maxSize); err != nil {
+		return err
+	}
+	if err := ctx.InsertRows(); err != nil {
+		return err
+	}
+
+	rows := &ctx.Rows
+	rowsInvalid.Add(len(rows.Errors))
+	_, details := req.URL.Query()["details"]
+	if details {
+		w.Header().Set("Content-Type", "application/json")
+		if len(rows.Errors) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		writeDetailsResponse(w, rows)
+		return nil
+	}
+	if len(rows.Errors) > 0 {
+		re := &rows.Errors[0]
+		return fmt.Errorf("cannot parse %d out of %d datapoints; pass `details` query arg for obtaining all the errors; the first error: %s; datapoint: %s",
+			len(rows.Errors), len(rows.Errors)+len(rows.Rows), re.Err, re.Datapoint)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func writeDetailsResponse(w io.Writer, rows *Rows) {
+	fmt.Fprintf(w, `{"success":%d,"failed":%d,"errors":[`, len(rows.Rows), len(rows.Errors))
+	for i := range rows.Errors {
+		re := &rows.Errors[i]
+		if i > 0 {
+			fmt.Fprintf(w, `,`)
+		}
+		// Go-quoted strings aren't always valid JSON strings, so the error is escaped with encoding/json.
+		errJSON, _ := json.Marshal(re.Err.Error())
+		fmt.Fprintf(w, `{"datapoint":%s,"error":%s}`, re.Datapoint, errJSON)
+	}
+	fmt.Fprintf(w, `]}`)
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	ic := &ctx.Common
+	ic.Reset(len(rows))
+	for i := range rows {
+		r := &rows[i]
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		ic.WriteDataPoint(nil, ic.Labels, r.Timestamp, r.Value)
+	}
+	rowsInserted.Add(len(rows))
+	return ic.FlushBufs()
+}
+
+// secondMask is used for distinguishing timestamps in seconds and in milliseconds.
+//
+// Timestamps in seconds fit 32 bits, while timestamps in milliseconds don't.
+// See http://opentsdb.net/docs/javadoc/net/opentsdb/core/Const.html#SECOND_MASK
+const secondMask int64 = 0x7FFFFFFF00000000
+
+func (ctx *pushCtx) Read(req *http.Request, maxSize int64) error {
+	var err error
+	ctx.reqBuf, err = readBody(ctx.reqBuf[:0], req, maxSize)
+	if err != nil {
+		opentsdbReadErrors.Inc()
+		if _, ok := err.(*httpserver.ErrorWithStatusCode); ok {
+			// Do not wrap the error, so the client receives its status code.
+			return err
+		}
+		return fmt.Errorf("cannot read OpenTSDB http put data: %s", err)
+	}
+	v, err := ctx.parser.ParseBytes(ctx.reqBuf)
+	if err != nil {
+		opentsdbUnmarshalErrors.Inc()
+		return fmt.Errorf("cannot parse OpenTSDB http put data with size %d: %s", len(ctx.reqBuf), err)
+	}
+	if err := ctx.Rows.Unmarshal(v); err != nil {
+		opentsdbUnmarshalErrors.Inc()
+		return fmt.Errorf("cannot unmarshal OpenTSDB http put data with size %d: %s", len(ctx.reqBuf), err)
+	}
+
+	// Convert timestamps in seconds to milliseconds and fill missing timestamps with the current time.
+	currentTs := time.Now().UnixNano() / 1e6
+	for i := range ctx.Rows.Rows {
+		r := &ctx.Rows.Rows[i]
+		if r.Timestamp == 0 {
+			r.Timestamp = currentTs
+		} else if r.Timestamp&secondMask == 0 {
+			r.Timestamp *= 1e3
+		}
+	}
+	return nil
+}
+
+// readBody appends the request body from req to dst and returns the result.
+//
+// The body is transparently decompressed if it has `Content-Encoding: gzip`.
+func readBody(dst []byte, req *http.Request, maxSize int64) ([]byte, error) {
+	r := io.Reader(req.Body)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := getGzipReader(r)
+		if err != nil {
+			return dst, fmt.Errorf("cannot read gzipped data: %s", err)
+		}
+		defer putGzipReader(zr)
+		r = zr
+	}
+	bb := bytesutil.ByteBuffer{
+		B: dst,
+	}
+	mr := common.NewMaxSizeReader(r, maxSize)
+	if _, err := io.Copy(&bb, mr); err != nil {
+		if mrErr := mr.Err(); mrErr != nil {
+			return bb.B, mrErr
+		}
+		return bb.B, err
+	}
+	return bb.B, nil
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	v := gzipReaderPool.Get()
+	if v == nil {
+		return gzip.NewReader(r)
+	}
+	zr := v.(*gzip.Reader)
+	if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+func putGzipReader(zr *gzip.Reader) {
+	_ = zr.Close()
+	gzipReaderPool.Put(zr)
+}
+
+var gzipReaderPool sync.Pool
+
+var (
+	opentsdbReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="opentsdb-http"}`)
+	opentsdbReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="opentsdb-http"}`)
+	opentsdbUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="opentsdb-http"}`)
+)
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	parser fastjson.Parser
+	reqBuf []byte
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
+	ctx.reqBuf = ctx.reqBuf[:0]
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
@@ -0,0 +1,150 @@
+package opentsdbhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/valyala/fastjson"
+)
+
+func TestReadBodySuccess(t *testing.T) {
+	f := func(body []byte, contentEncoding, bodyExpected string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://localhost/api/put", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		b, err := readBody(nil, req, 1024)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(b) != bodyExpected {
+			t.Fatalf("unexpected body; got %q; want %q", b, bodyExpected)
+		}
+	}
+
+	s := `[{"metric":"foo","timestamp":123,"value":1,"tags":{"a":"b"}}]`
+	f([]byte(s), "", s)
+	f(gzipData(s), "gzip", s)
+	f(nil, "", "")
+}
+
+func TestReadBodyFailure(t *testing.T) {
+	f := func(body []byte, contentEncoding string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://localhost/api/put", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		if _, err := readBody(nil, req, 10); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Too big body
+	f([]byte("01234567890"), "")
+	f(gzipData("01234567890"), "gzip")
+
+	// Invalid gzip data
+	f([]byte("foobar"), "gzip")
+
+	// Truncated gzip data
+	data := gzipData("foobar")
+	f(data[:len(data)-5], "gzip")
+}
+
+func TestWriteDetailsResponse(t *testing.T) {
+	s := `[{"metric":"foo","timestamp":2,"value":1},{"metric":"bar"},{"metric":"baz","value":2}]`
+	v, err := fastjson.Parse(s)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	var rows Rows
+	if err := rows.Unmarshal(v); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var bb bytes.Buffer
+	writeDetailsResponse(&bb, &rows)
+	respExpected := `{"success":2,"failed":1,"errors":[{"datapoint":{"metric":"bar"},"error":"missing ` + "`value`" + `"}]}`
+	if bb.String() != respExpected {
+		t.Fatalf("unexpected response;\ngot\n%s\nwant\n%s", bb.String(), respExpected)
+	}
+	if _, err := fastjson.Parse(bb.String()); err != nil {
+		t.Fatalf("response must be valid json; got error: %s", err)
+	}
+}
+
+func TestWriteDetailsResponseEscaping(t *testing.T) {
+	// Go-quoted strings contain \x escape sequences for such values, which are invalid in JSON.
+	s := `[{"metric":"foo","value":"\u0001\u00ff"},{"metric":"bar","value":1,"tags":{"\u0002":1}}]`
+	v, err := fastjson.Parse(s)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	var rows Rows
+	if err := rows.Unmarshal(v); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var bb bytes.Buffer
+	writeDetailsResponse(&bb, &rows)
+	resp, err := fastjson.Parse(bb.String())
+	if err != nil {
+		t.Fatalf("response must be valid json; got error: %s; response:\n%s", err, bb.String())
+	}
+	errs := resp.GetArray("errors")
+	if len(errs) != 2 {
+		t.Fatalf("unexpected number of errors; got %d; want 2; response:\n%s", len(errs), bb.String())
+	}
+	for i, e := range errs {
+		errExpected := rows.Errors[i].Err.Error()
+		if got := string(e.GetStringBytes("error")); got != errExpected {
+			t.Fatalf("unexpected error #%d; got %q; want %q", i, got, errExpected)
+		}
+	}
+}
+
+func TestInsertHandlerTooBigRequest(t *testing.T) {
+	s := strings.Repeat("x", 1025)
+	f := func(body []byte, contentEncoding string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/put", bytes.NewReader(body))
+		if contentEncoding != "" {
+			r.Header.Set("Content-Encoding", contentEncoding)
+		}
+		err := insertHandlerInternal(httptest.NewRecorder(), r, 1024)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		w := httptest.NewRecorder()
+		httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	f([]byte(s), "")
+	f(gzipData(s), "gzip")
+}
+
+func gzipData(s string) []byte {
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return bb.Bytes()
+}
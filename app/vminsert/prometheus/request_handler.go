@@ -8,15 +8,27 @@ import (
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
 	"github.com/VictoriaMetrics/metrics"
 )
 
 var rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="prometheus"}`)
 
 // InsertHandler processes remote write for prometheus.
-func InsertHandler(r *http.Request, maxSize int64) error {
+//
+// Both remote write 1.0 and remote write 2.0 protocols are supported.
+// The protocol is detected via Content-Type request header.
+func InsertHandler(w http.ResponseWriter, r *http.Request, maxSize int64) error {
+	isV2, err := isRemoteWriteV2(r)
+	if err != nil {
+		return err
+	}
 	return concurrencylimiter.Do(func() error {
+		if isV2 {
+			return insertHandlerV2(w, r, maxSize)
+		}
 		return insertHandlerInternal(r, maxSize)
 	})
 }
@@ -24,10 +36,26 @@ func InsertHandler(r *http.Request, maxSize int64) error {
 func insertHandlerInternal(r *http.Request, maxSize int64) error {
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(r))
+	ctx.Common.SetAccountID(tenant.GetAccountID(r.Context()))
 	if err := ctx.Read(r, maxSize); err != nil {
 		return err
 	}
-	timeseries := ctx.req.Timeseries
+	return ctx.push(ctx.req.Timeseries, rowsInserted)
+}
+
+// Push writes wr to the storage in the same way as remote write requests are written.
+//
+// It is used for pushing the data scraped from Prometheus targets.
+func Push(wr *prompb.WriteRequest) error {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	return ctx.push(wr.Timeseries, rowsScraped)
+}
+
+var rowsScraped = metrics.NewCounter(`vm_rows_inserted_total{type="promscrape"}`)
+
+func (ctx *pushCtx) push(timeseries []prompb.TimeSeries, rowsInserted *metrics.Counter) error {
 	rowsLen := 0
 	for i := range timeseries {
 		rowsLen += len(timeseries[i].Samples)
@@ -55,6 +83,8 @@ type pushCtx struct {
 
 func (ctx *pushCtx) reset() {
 	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
 	ctx.req.Reset()
 	ctx.reqBuf = ctx.reqBuf[:0]
 }
@@ -66,6 +96,10 @@ func (ctx *pushCtx) Read(r *http.Request, maxSize int64) error {
 	ctx.reqBuf, err = prompb.ReadSnappy(ctx.reqBuf[:0], r.Body, maxSize)
 	if err != nil {
 		prometheusReadErrors.Inc()
+		if err == prompb.ErrTooBigRequest {
+			// Return the error with 413 status code without wrapping.
+			return common.NewTooBigRequestError(maxSize)
+		}
 		return fmt.Errorf("cannot read prompb.WriteRequest: %s", err)
 	}
 	if err = ctx.req.Unmarshal(ctx.reqBuf); err != nil {
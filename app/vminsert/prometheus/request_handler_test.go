@@ -0,0 +1,34 @@
+package prometheus
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/golang/snappy"
+)
+
+func TestInsertHandlerTooBigRequest(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappy.Encode(nil, data)))
+		r.Header.Set("Content-Type", "application/x-protobuf")
+		err := insertHandlerInternal(r, 1024)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		w := httptest.NewRecorder()
+		httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	// Too big unpacked request
+	f(make([]byte, 1025))
+
+	// Too big packed request
+	f(bytes.Repeat([]byte("foobarbaz"), 10*1024))
+}
@@ -0,0 +1,76 @@
+package prometheus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func BenchmarkPushCtxRead(b *testing.B) {
+	var data []byte
+	for i := 0; i < 1000; i++ {
+		var ts []byte
+		ts = appendLabel(ts, "__name__", "node_cpu_seconds_total")
+		ts = appendLabel(ts, "instance", fmt.Sprintf("host-%d:9100", i))
+		ts = appendSample(ts, float64(i), 1570000000000)
+		data = appendBytesField(data, 1, ts)
+	}
+	body := snappy.Encode(nil, data)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.RunParallel(func(pb *testing.PB) {
+		var br bytes.Reader
+		r := &http.Request{
+			Body: ioutil.NopCloser(&br),
+		}
+		for pb.Next() {
+			br.Reset(body)
+			ctx := getPushCtx()
+			if err := ctx.Read(r, 32*1024*1024); err != nil {
+				panic(fmt.Errorf("unexpected error: %s", err))
+			}
+			if len(ctx.req.Timeseries) != 1000 {
+				panic(fmt.Errorf("unexpected number of time series; got %d; want 1000", len(ctx.req.Timeseries)))
+			}
+			putPushCtx(ctx)
+		}
+	})
+}
+
+// The following functions marshal prompb.WriteRequest, since prompb doesn't contain marshaling code.
+
+func appendLabel(dst []byte, name, value string) []byte {
+	var label []byte
+	label = appendBytesField(label, 1, []byte(name))
+	label = appendBytesField(label, 2, []byte(value))
+	return appendBytesField(dst, 1, label)
+}
+
+func appendSample(dst []byte, value float64, timestamp int64) []byte {
+	var sample []byte
+	sample = appendVarint(sample, 1<<3|1)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(value))
+	sample = append(sample, buf[:]...)
+	sample = appendVarint(sample, 2<<3)
+	sample = appendVarint(sample, uint64(timestamp))
+	return appendBytesField(dst, 2, sample)
+}
+
+func appendBytesField(dst []byte, fieldNum uint64, data []byte) []byte {
+	dst = appendVarint(dst, fieldNum<<3|2)
+	dst = appendVarint(dst, uint64(len(data)))
+	return append(dst, data...)
+}
+
+func appendVarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
@@ -0,0 +1,250 @@
+package prometheus
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Protobuf message names, which may be passed in `proto` parameter of Content-Type header.
+const (
+	protoV1 = "prometheus.WriteRequest"
+	protoV2 = "io.prometheus.write.v2.Request"
+)
+
+// isRemoteWriteV2 returns true if r contains remote write 2.0 request.
+//
+// Requests without `proto` parameter in Content-Type header are treated as remote write 1.0 requests
+// according to the remote write 2.0 spec, so older senders continue working.
+func isRemoteWriteV2(r *http.Request) (bool, error) {
+	contentType := r.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		return false, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-protobuf" {
+		// Be lenient to senders with improper Content-Type.
+		return false, nil
+	}
+	switch params["proto"] {
+	case "", protoV1:
+		return false, nil
+	case protoV2:
+		return true, nil
+	default:
+		return false, &httpserver.ErrorWithStatusCode{
+			Err:        fmt.Errorf("unsupported remote write protobuf message %q in Content-Type header; supported messages: %q, %q", params["proto"], protoV1, protoV2),
+			StatusCode: http.StatusUnsupportedMediaType,
+		}
+	}
+}
+
+var (
+	rowsInsertedV2              = metrics.NewCounter(`vm_rows_inserted_total{type="prometheus_v2"}`)
+	histogramsIgnoredV2         = metrics.NewCounter(`vm_rows_ignored_total{type="prometheus_v2_native_histograms"}`)
+	exemplarsIgnoredV2          = metrics.NewCounter(`vm_rows_ignored_total{type="prometheus_v2_exemplars"}`)
+	prometheusReadCallsV2       = metrics.NewCounter(`vm_read_calls_total{name="prometheus_v2"}`)
+	prometheusReadErrorsV2      = metrics.NewCounter(`vm_read_errors_total{name="prometheus_v2"}`)
+	prometheusUnmarshalErrorsV2 = metrics.NewCounter(`vm_unmarshal_errors_total{name="prometheus_v2"}`)
+)
+
+func insertHandlerV2(w http.ResponseWriter, r *http.Request, maxSize int64) error {
+	ctx := getPushCtxV2()
+	defer putPushCtxV2(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(r))
+	ctx.Common.SetAccountID(tenant.GetAccountID(r.Context()))
+	if err := ctx.Read(r, maxSize); err != nil {
+		return err
+	}
+	samplesWritten, err := ctx.push()
+	if err != nil {
+		return err
+	}
+
+	// Native histograms and exemplars aren't supported, so they are reported as not written.
+	// The sender mustn't retry the request in this case, since it has been successfully processed.
+	h := w.Header()
+	h.Set("X-Prometheus-Remote-Write-Samples-Written", strconv.Itoa(samplesWritten))
+	h.Set("X-Prometheus-Remote-Write-Histograms-Written", "0")
+	h.Set("X-Prometheus-Remote-Write-Exemplars-Written", "0")
+	return nil
+}
+
+type pushCtxV2 struct {
+	Common common.InsertCtx
+
+	req    prompb.WriteRequestV2
+	reqBuf []byte
+
+	labels       []prompb.Label
+	target       []metricsmetadata.Label
+	metadataRows []metricsmetadata.Row
+}
+
+func (ctx *pushCtxV2) reset() {
+	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
+	ctx.req.Reset()
+	ctx.reqBuf = ctx.reqBuf[:0]
+
+	for i := range ctx.labels {
+		ctx.labels[i] = prompb.Label{}
+	}
+	ctx.labels = ctx.labels[:0]
+	ctx.target = ctx.target[:0]
+	ctx.metadataRows = ctx.metadataRows[:0]
+}
+
+func (ctx *pushCtxV2) Read(r *http.Request, maxSize int64) error {
+	prometheusReadCallsV2.Inc()
+
+	var err error
+	ctx.reqBuf, err = prompb.ReadSnappy(ctx.reqBuf[:0], r.Body, maxSize)
+	if err != nil {
+		prometheusReadErrorsV2.Inc()
+		if err == prompb.ErrTooBigRequest {
+			// Return the error with 413 status code without wrapping.
+			return common.NewTooBigRequestError(maxSize)
+		}
+		return fmt.Errorf("cannot read prompb.WriteRequestV2: %s", err)
+	}
+	if err = ctx.req.Unmarshal(ctx.reqBuf); err != nil {
+		prometheusUnmarshalErrorsV2.Inc()
+		return fmt.Errorf("cannot unmarshal prompb.WriteRequestV2 with size %d bytes: %s", len(ctx.reqBuf), err)
+	}
+	return nil
+}
+
+// push writes samples and metadata from ctx.req to the storage and returns the number of written samples.
+func (ctx *pushCtxV2) push() (int, error) {
+	req := &ctx.req
+	rowsLen := 0
+	for i := range req.Timeseries {
+		rowsLen += len(req.Timeseries[i].Samples)
+	}
+	ic := &ctx.Common
+	ic.Reset(rowsLen)
+	histogramsCount := 0
+	exemplarsCount := 0
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		var err error
+		ctx.labels, err = req.AppendLabels(ctx.labels[:0], ts.LabelsRefs)
+		if err != nil {
+			prometheusUnmarshalErrorsV2.Inc()
+			return 0, fmt.Errorf("cannot obtain labels for time series #%d: %s", i, err)
+		}
+		if err := ctx.addMetadata(ts); err != nil {
+			prometheusUnmarshalErrorsV2.Inc()
+			return 0, fmt.Errorf("cannot obtain metadata for time series #%d: %s", i, err)
+		}
+		var metricNameRaw []byte
+		for j := range ts.Samples {
+			s := &ts.Samples[j]
+			metricNameRaw = ic.WriteDataPointExt(metricNameRaw, ctx.labels, s.Timestamp, s.Value)
+		}
+		histogramsCount += ts.HistogramsCount
+		exemplarsCount += len(ts.Exemplars)
+	}
+	if err := ic.FlushBufs(); err != nil {
+		return 0, err
+	}
+	rowsInsertedV2.Add(rowsLen)
+	histogramsIgnoredV2.Add(histogramsCount)
+	exemplarsIgnoredV2.Add(exemplarsCount)
+	return rowsLen, nil
+}
+
+// addMetadata stores metadata for ts in the storage.
+//
+// The metadata is stored for the target identified by `job` and `instance` labels of ts,
+// since remote write requests don't contain scrape targets.
+func (ctx *pushCtxV2) addMetadata(ts *prompb.TimeSeriesV2) error {
+	md := &ts.Metadata
+	if md.Type == prompb.MetricTypeV2Unspecified && md.HelpRef == 0 && md.UnitRef == 0 {
+		return nil
+	}
+	help, err := ctx.req.Symbol(md.HelpRef)
+	if err != nil {
+		return fmt.Errorf("cannot obtain help: %s", err)
+	}
+	unit, err := ctx.req.Symbol(md.UnitRef)
+	if err != nil {
+		return fmt.Errorf("cannot obtain unit: %s", err)
+	}
+	var metricName string
+	ctx.target = ctx.target[:0]
+	for _, label := range ctx.labels {
+		switch string(label.Name) {
+		case "__name__":
+			metricName = string(label.Value)
+		case "instance", "job":
+			ctx.target = append(ctx.target, metricsmetadata.Label{
+				Name:  string(label.Name),
+				Value: string(label.Value),
+			})
+		}
+	}
+	if len(metricName) == 0 {
+		return nil
+	}
+	if len(ctx.target) == 2 && ctx.target[0].Name > ctx.target[1].Name {
+		// Target labels must be sorted by name.
+		ctx.target[0], ctx.target[1] = ctx.target[1], ctx.target[0]
+	}
+	ctx.metadataRows = append(ctx.metadataRows[:0], metricsmetadata.Row{
+		MetricFamilyName: getMetricFamilyName(metricName, md.Type),
+		Type:             md.Type.String(),
+		Help:             string(help),
+		Unit:             string(unit),
+	})
+	vmstorage.AddMetricsMetadata(ctx.target, ctx.metadataRows)
+	return nil
+}
+
+// getMetricFamilyName returns metric family name for the given metricName with the given type.
+//
+// Remote write 2.0 sends metadata for each series, so suffixes for histogram and summary series
+// are removed in order to attach the metadata to the metric family like in Prometheus exposition format.
+func getMetricFamilyName(metricName string, mt prompb.MetricTypeV2) string {
+	var suffixes []string
+	switch mt {
+	case prompb.MetricTypeV2Histogram, prompb.MetricTypeV2GaugeHistogram:
+		suffixes = []string{"_bucket", "_sum", "_count", "_created"}
+	case prompb.MetricTypeV2Summary:
+		suffixes = []string{"_sum", "_count", "_created"}
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(metricName, suffix) {
+			return metricName[:len(metricName)-len(suffix)]
+		}
+	}
+	return metricName
+}
+
+func getPushCtxV2() *pushCtxV2 {
+	if v := pushCtxV2Pool.Get(); v != nil {
+		return v.(*pushCtxV2)
+	}
+	return &pushCtxV2{}
+}
+
+func putPushCtxV2(ctx *pushCtxV2) {
+	ctx.reset()
+	pushCtxV2Pool.Put(ctx)
+}
+
+var pushCtxV2Pool sync.Pool
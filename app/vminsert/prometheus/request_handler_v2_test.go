@@ -0,0 +1,84 @@
+package prometheus
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/golang/snappy"
+)
+
+func TestIsRemoteWriteV2(t *testing.T) {
+	f := func(contentType string, resultExpected, errExpected bool) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/v1/write", nil)
+		if len(contentType) > 0 {
+			r.Header.Set("Content-Type", contentType)
+		}
+		result, err := isRemoteWriteV2(r)
+		if (err != nil) != errExpected {
+			t.Fatalf("unexpected error for Content-Type %q: %v", contentType, err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for Content-Type %q; got %v; want %v", contentType, result, resultExpected)
+		}
+	}
+
+	// Remote write 1.0
+	f("", false, false)
+	f("application/x-protobuf", false, false)
+	f("application/x-protobuf;proto=prometheus.WriteRequest", false, false)
+	f("application/octet-stream", false, false)
+
+	// Remote write 2.0
+	f("application/x-protobuf;proto=io.prometheus.write.v2.Request", true, false)
+	f("application/x-protobuf; proto=io.prometheus.write.v2.Request", true, false)
+
+	// Unsupported protobuf message
+	f("application/x-protobuf;proto=foo.Bar", false, true)
+}
+
+func TestGetMetricFamilyName(t *testing.T) {
+	f := func(metricName string, mt prompb.MetricTypeV2, resultExpected string) {
+		t.Helper()
+		result := getMetricFamilyName(metricName, mt)
+		if result != resultExpected {
+			t.Fatalf("unexpected metric family name for %q with type %q; got %q; want %q", metricName, mt, result, resultExpected)
+		}
+	}
+	f("foo", prompb.MetricTypeV2Unspecified, "foo")
+	f("foo_total", prompb.MetricTypeV2Counter, "foo_total")
+	f("foo_count", prompb.MetricTypeV2Gauge, "foo_count")
+	f("foo_bucket", prompb.MetricTypeV2Histogram, "foo")
+	f("foo_sum", prompb.MetricTypeV2Histogram, "foo")
+	f("foo_count", prompb.MetricTypeV2GaugeHistogram, "foo")
+	f("foo_count", prompb.MetricTypeV2Summary, "foo")
+	f("foo_bucket", prompb.MetricTypeV2Summary, "foo_bucket")
+	f("foo", prompb.MetricTypeV2Summary, "foo")
+}
+
+func TestInsertHandlerV2TooBigRequest(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappy.Encode(nil, data)))
+		r.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+		w := httptest.NewRecorder()
+		err := insertHandlerV2(w, r, 1024)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	// Too big unpacked request
+	f(make([]byte, 1025))
+
+	// Too big packed request
+	f(bytes.Repeat([]byte("foobarbaz"), 10*1024))
+}
@@ -0,0 +1,434 @@
+package prometheusimport
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+)
+
+// Rows contains parsed Prometheus exposition format rows.
+type Rows struct {
+	Rows []Row
+
+	// Metadata contains metric families metadata from `# TYPE`, `# HELP` and `# UNIT` lines.
+	//
+	// Consecutive lines for the same metric family are merged into a single item.
+	Metadata []metricsmetadata.Row
+
+	// IsEOF is set to true after `# EOF` line is found in OpenMetrics exposition format.
+	//
+	// The data after `# EOF` line must be ignored.
+	IsEOF bool
+
+	tagsPool []Tag
+
+	// createdFamilies contains names of counter, histogram, summary and gaugehistogram metric families,
+	// which may have `_created` samples.
+	//
+	// It persists across Unmarshal calls, since `# TYPE` lines and samples may be split between blocks.
+	createdFamilies map[string]struct{}
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Reset items, so they can be GC'ed
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+	rs.resetMetadata()
+	rs.IsEOF = false
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+
+	for k := range rs.createdFamilies {
+		delete(rs.createdFamilies, k)
+	}
+}
+
+func (rs *Rows) resetMetadata() {
+	for i := range rs.Metadata {
+		rs.Metadata[i] = metricsmetadata.Row{}
+	}
+	rs.Metadata = rs.Metadata[:0]
+}
+
+// Unmarshal unmarshals Prometheus exposition format rows from s.
+//
+// If isOpenMetrics is set, then s is parsed in OpenMetrics format. In this case timestamps are in seconds
+// and rs.IsEOF is set after the `# EOF` line is found.
+// Exemplars are ignored. `_created` samples for counters, histograms and summaries are skipped,
+// since they contain metric creation time instead of measurements.
+//
+// See https://github.com/prometheus/docs/blob/master/content/docs/instrumenting/exposition_formats.md#text-based-format
+// and https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) Unmarshal(s string, isOpenMetrics bool) error {
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+	rs.resetMetadata()
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+	for len(s) > 0 && !rs.IsEOF {
+		line := s
+		n := strings.IndexByte(s, '\n')
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		if err := rs.unmarshalLine(line, isOpenMetrics); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalLine(s string, isOpenMetrics bool) error {
+	s = strings.TrimSuffix(s, "\r")
+	if !isOpenMetrics {
+		s = skipLeadingWhitespace(s)
+	}
+	if len(s) == 0 {
+		// Skip empty line
+		return nil
+	}
+	if s[0] == '#' {
+		return rs.unmarshalComment(s, isOpenMetrics)
+	}
+	if cap(rs.Rows) > len(rs.Rows) {
+		rs.Rows = rs.Rows[:len(rs.Rows)+1]
+	} else {
+		rs.Rows = append(rs.Rows, Row{})
+	}
+	r := &rs.Rows[len(rs.Rows)-1]
+	var err error
+	rs.tagsPool, err = r.unmarshal(s, rs.tagsPool, isOpenMetrics)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal %q: %s", s, err)
+	}
+	if rs.isCreatedSample(r.Metric) {
+		// Skip the sample with metric creation time.
+		r.reset()
+		rs.Rows = rs.Rows[:len(rs.Rows)-1]
+	}
+	return nil
+}
+
+// unmarshalComment processes `# ...` line from s.
+//
+// `# TYPE`, `# HELP` and `# UNIT` lines are put into rs.Metadata. Other comments are ignored.
+// `# TYPE` lines are also used for detecting `_created` samples.
+func (rs *Rows) unmarshalComment(s string, isOpenMetrics bool) error {
+	if isOpenMetrics && s == "# EOF" {
+		rs.IsEOF = true
+		return nil
+	}
+	s = skipLeadingWhitespace(s[1:])
+	var kind string
+	switch {
+	case strings.HasPrefix(s, "TYPE"):
+		kind = "TYPE"
+	case strings.HasPrefix(s, "HELP"):
+		kind = "HELP"
+	case strings.HasPrefix(s, "UNIT"):
+		kind = "UNIT"
+	default:
+		return nil
+	}
+	s = s[len(kind):]
+	if len(s) > 0 && s[0] != ' ' && s[0] != '\t' {
+		// Regular comment starting with TYPE, HELP or UNIT word such as `# TYPES ...`
+		return nil
+	}
+	s = skipLeadingWhitespace(s)
+	family := s
+	value := ""
+	if n := strings.IndexAny(s, " \t"); n >= 0 {
+		family = s[:n]
+		value = s[n+1:]
+	}
+	if len(family) == 0 && kind != "TYPE" {
+		// Ignore `# HELP` and `# UNIT` lines without metric family.
+		return nil
+	}
+	switch kind {
+	case "TYPE":
+		value = strings.TrimSpace(value)
+		if len(value) == 0 {
+			if isOpenMetrics {
+				return fmt.Errorf("missing metric type in `# TYPE %s` line", s)
+			}
+			return nil
+		}
+		switch value {
+		case "counter", "histogram", "summary", "gaugehistogram":
+			if rs.createdFamilies == nil {
+				rs.createdFamilies = make(map[string]struct{})
+			}
+			if _, ok := rs.createdFamilies[family]; !ok {
+				// Copy family, since it refers to s, which may be overwritten after the Unmarshal call.
+				rs.createdFamilies[string(append([]byte(nil), family...))] = struct{}{}
+			}
+		}
+		rs.getMetadata(family).Type = value
+	case "HELP":
+		rs.getMetadata(family).Help = unescapeHelp(value)
+	case "UNIT":
+		rs.getMetadata(family).Unit = strings.TrimSpace(value)
+	}
+	return nil
+}
+
+// getMetadata returns metadata item for the given metric family.
+//
+// The last item is returned if it belongs to the same metric family, since metadata lines go together.
+func (rs *Rows) getMetadata(family string) *metricsmetadata.Row {
+	if len(rs.Metadata) > 0 {
+		md := &rs.Metadata[len(rs.Metadata)-1]
+		if md.MetricFamilyName == family {
+			return md
+		}
+	}
+	rs.Metadata = append(rs.Metadata, metricsmetadata.Row{
+		MetricFamilyName: family,
+	})
+	return &rs.Metadata[len(rs.Metadata)-1]
+}
+
+// unescapeHelp unescapes `\\`, `\n` and `\"` sequences in the help text s.
+func unescapeHelp(s string) string {
+	n := strings.IndexByte(s, '\\')
+	if n < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	b = append(b, s[:n]...)
+	s = s[n:]
+	for len(s) > 0 {
+		ch := s[0]
+		if ch != '\\' || len(s) == 1 {
+			b = append(b, ch)
+			s = s[1:]
+			continue
+		}
+		switch s[1] {
+		case '\\':
+			b = append(b, '\\')
+		case 'n':
+			b = append(b, '\n')
+		case '"':
+			b = append(b, '"')
+		default:
+			b = append(b, s[:2]...)
+		}
+		s = s[2:]
+	}
+	return string(b)
+}
+
+func (rs *Rows) isCreatedSample(metric string) bool {
+	family := strings.TrimSuffix(metric, "_created")
+	if len(family) == len(metric) {
+		return false
+	}
+	if _, ok := rs.createdFamilies[family]; ok {
+		return true
+	}
+	// The family name for counters may end with `_total` in `# TYPE` line.
+	_, ok := rs.createdFamilies[family+"_total"]
+	return ok
+}
+
+// Row is a single Prometheus exposition format row.
+type Row struct {
+	Metric    string
+	Tags      []Tag
+	Value     float64
+	Timestamp int64
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Value = 0
+	r.Timestamp = 0
+}
+
+func (r *Row) unmarshal(s string, tagsPool []Tag, isOpenMetrics bool) ([]Tag, error) {
+	r.reset()
+	n := strings.IndexAny(s, "{ \t")
+	if n < 0 {
+		return tagsPool, fmt.Errorf("missing value")
+	}
+	r.Metric = s[:n]
+	if len(r.Metric) == 0 {
+		return tagsPool, fmt.Errorf("metric cannot be empty")
+	}
+	s = s[n:]
+	if s[0] == '{' {
+		tagsStart := len(tagsPool)
+		var err error
+		tagsPool, s, err = unmarshalTags(tagsPool, s[1:])
+		if err != nil {
+			return tagsPool, err
+		}
+		if tags := tagsPool[tagsStart:]; len(tags) > 0 {
+			r.Tags = tags[:len(tags):len(tags)]
+		}
+	}
+	s = skipLeadingWhitespace(s)
+	if n := strings.Index(s, " # "); n >= 0 && isOpenMetrics {
+		// Ignore exemplar.
+		s = s[:n]
+	}
+	s = strings.TrimRight(s, " \t")
+	if len(s) == 0 {
+		return tagsPool, fmt.Errorf("missing value")
+	}
+	valueStr := s
+	timestampStr := ""
+	if n := strings.IndexAny(s, " \t"); n >= 0 {
+		valueStr = s[:n]
+		timestampStr = skipLeadingWhitespace(s[n+1:])
+	}
+	v, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return tagsPool, fmt.Errorf("cannot parse value %q: %s", valueStr, err)
+	}
+	r.Value = v
+	if len(timestampStr) == 0 {
+		return tagsPool, nil
+	}
+	if isOpenMetrics {
+		// OpenMetrics timestamps are in seconds.
+		ts, err := strconv.ParseFloat(timestampStr, 64)
+		if err != nil {
+			return tagsPool, fmt.Errorf("cannot parse timestamp %q: %s", timestampStr, err)
+		}
+		r.Timestamp = int64(math.Round(ts * 1e3))
+	} else {
+		// Prometheus timestamps are in milliseconds.
+		ts, err := strconv.ParseInt(timestampStr, 10, 64)
+		if err != nil {
+			return tagsPool, fmt.Errorf("cannot parse timestamp %q: %s", timestampStr, err)
+		}
+		r.Timestamp = ts
+	}
+	return tagsPool, nil
+}
+
+// unmarshalTags appends tags from s to dst and returns the result with the tail after the closing `}`.
+//
+// s must contain `name="value",...}` tags.
+func unmarshalTags(dst []Tag, s string) ([]Tag, string, error) {
+	for {
+		s = skipLeadingWhitespace(s)
+		if len(s) > 0 && s[0] == '}' {
+			return dst, s[1:], nil
+		}
+		n := strings.IndexByte(s, '=')
+		if n < 0 {
+			return dst, s, fmt.Errorf("missing `=` after tag name in %q", s)
+		}
+		key := strings.TrimSpace(s[:n])
+		if len(key) == 0 {
+			return dst, s, fmt.Errorf("tag name cannot be empty")
+		}
+		s = skipLeadingWhitespace(s[n+1:])
+		if len(s) == 0 || s[0] != '"' {
+			return dst, s, fmt.Errorf("tag value for %q must start with `\"`", key)
+		}
+		value, tail, err := unquoteTagValue(s[1:])
+		if err != nil {
+			return dst, s, fmt.Errorf("cannot parse tag value for %q: %s", key, err)
+		}
+		s = skipLeadingWhitespace(tail)
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Tag{})
+		}
+		tag := &dst[len(dst)-1]
+		tag.Key = key
+		tag.Value = value
+		if len(s) > 0 && s[0] == ',' {
+			s = s[1:]
+			continue
+		}
+		if len(s) > 0 && s[0] == '}' {
+			return dst, s[1:], nil
+		}
+		return dst, s, fmt.Errorf("missing `,` or `}` after tag %q", key)
+	}
+}
+
+// unquoteTagValue returns the tag value from s until the closing `"` and the tail after it.
+//
+// `\\`, `\"` and `\n` escape sequences are unescaped.
+func unquoteTagValue(s string) (string, string, error) {
+	n := strings.IndexAny(s, "\"\\")
+	if n < 0 {
+		return "", s, fmt.Errorf("missing closing `\"`")
+	}
+	if s[n] == '"' {
+		// Fast path - no escape sequences.
+		return s[:n], s[n+1:], nil
+	}
+
+	// Slow path - unescape the value.
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return string(b), s[i+1:], nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", s, fmt.Errorf("missing closing `\"`")
+			}
+			switch s[i] {
+			case 'n':
+				b = append(b, '\n')
+			case '\\', '"':
+				b = append(b, s[i])
+			default:
+				b = append(b, '\\', s[i])
+			}
+		default:
+			b = append(b, c)
+		}
+	}
+	return "", s, fmt.Errorf("missing closing `\"`")
+}
+
+// Tag is a Prometheus tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
+
+func skipLeadingWhitespace(s string) string {
+	for len(s) > 0 && (s[0] == ' ' || s[0] == '\t') {
+		s = s[1:]
+	}
+	return s
+}
@@ -0,0 +1,324 @@
+package prometheusimport
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(s string, isOpenMetrics bool) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s, isOpenMetrics); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+
+		// Try again
+		rows.Reset()
+		if err := rows.Unmarshal(s, isOpenMetrics); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+
+	// Missing value
+	f("foo", false)
+	f("foo ", false)
+	f("foo{bar=\"baz\"}", false)
+	f("foo{bar=\"baz\"} # {trace_id=\"abc\"} 1", true)
+
+	// Invalid value
+	f("foo bar", false)
+
+	// Invalid timestamp
+	f("foo 1 bar", false)
+	f("foo 1 1.5", false)
+	f("foo 1 bar", true)
+
+	// Missing metric
+	f("{bar=\"baz\"} 1", false)
+
+	// Invalid tags
+	f("foo{bar} 1", false)
+	f("foo{bar=baz} 1", false)
+	f("foo{=\"baz\"} 1", false)
+	f("foo{bar=\"baz} 1", false)
+	f("foo{bar=\"baz\\\"} 1", false)
+	f("foo{bar=\"baz\" x=\"y\"} 1", false)
+
+	// Invalid multiline
+	f("foo 1\nbar", false)
+
+	// Missing type in OpenMetrics
+	f("# TYPE foo", true)
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(s string, isOpenMetrics bool, rowsExpected *Rows) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s, isOpenMetrics); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+		if rows.IsEOF != rowsExpected.IsEOF {
+			t.Fatalf("unexpected IsEOF; got %v; want %v", rows.IsEOF, rowsExpected.IsEOF)
+		}
+
+		// Try unmarshaling again
+		rows.Reset()
+		if err := rows.Unmarshal(s, isOpenMetrics); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+
+		rows.Reset()
+		if len(rows.Rows) != 0 {
+			t.Fatalf("non-empty rows after reset: %+v", rows.Rows)
+		}
+	}
+
+	// Empty line
+	f("", false, &Rows{})
+	f("\n\n", false, &Rows{})
+
+	// Comments and metadata
+	f("# HELP foo Some help\n# TYPE foo gauge\n#comment\n", false, &Rows{})
+
+	// Single line
+	f("foobar -123.456", false, &Rows{
+		Rows: []Row{{
+			Metric: "foobar",
+			Value:  -123.456,
+		}},
+	})
+	f("  foo_bar:baz 1e3 789\r\n", false, &Rows{
+		Rows: []Row{{
+			Metric:    "foo_bar:baz",
+			Value:     1000,
+			Timestamp: 789,
+		}},
+	})
+
+	// Special values
+	f("foo +Inf\nbar -Inf", false, &Rows{
+		Rows: []Row{
+			{
+				Metric: "foo",
+				Value:  math.Inf(1),
+			},
+			{
+				Metric: "bar",
+				Value:  math.Inf(-1),
+			},
+		},
+	})
+
+	// Tags
+	f(`foo{bar="baz",x="a \"b\" \\ c\nd", y = "" ,} 1 2`, false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags: []Tag{
+				{
+					Key:   "bar",
+					Value: "baz",
+				},
+				{
+					Key:   "x",
+					Value: "a \"b\" \\ c\nd",
+				},
+				{
+					Key:   "y",
+					Value: "",
+				},
+			},
+			Value:     1,
+			Timestamp: 2,
+		}},
+	})
+	f(`foo{} 1`, false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Value:  1,
+		}},
+	})
+	f(`foo{bar="a,b} c"} 1`, false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags: []Tag{{
+				Key:   "bar",
+				Value: "a,b} c",
+			}},
+			Value: 1,
+		}},
+	})
+
+	// OpenMetrics with exemplars, timestamps in seconds and `# EOF`
+	f(`# TYPE foo counter
+# UNIT foo seconds
+# HELP foo Some help
+foo_total{a="b"} 12 1.5 # {trace_id="abc"} 1 1.2
+foo_created{a="b"} 1.2345e9
+bar_created 3
+# EOF
+baz 1
+`, true, &Rows{
+		Rows: []Row{
+			{
+				Metric: "foo_total",
+				Tags: []Tag{{
+					Key:   "a",
+					Value: "b",
+				}},
+				Value:     12,
+				Timestamp: 1500,
+			},
+			{
+				Metric: "bar_created",
+				Value:  3,
+			},
+		},
+		IsEOF: true,
+	})
+
+	// `_created` samples for histograms and for counters with `_total` in `# TYPE`
+	f(`# TYPE foo histogram
+foo_bucket{le="+Inf"} 1
+foo_created 123
+# TYPE bar_total counter
+bar_total 2
+bar_created 456
+`, false, &Rows{
+		Rows: []Row{
+			{
+				Metric: "foo_bucket",
+				Tags: []Tag{{
+					Key:   "le",
+					Value: "+Inf",
+				}},
+				Value: 1,
+			},
+			{
+				Metric: "bar_total",
+				Value:  2,
+			},
+		},
+	})
+
+	// `# EOF` isn't special in Prometheus format
+	f("# EOF\nfoo 1", false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Value:  1,
+		}},
+	})
+}
+
+func TestRowsUnmarshalTypeAcrossCalls(t *testing.T) {
+	var rows Rows
+	if err := rows.Unmarshal("# TYPE foo counter\nfoo_total 1\n", true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rows.Rows) != 1 {
+		t.Fatalf("unexpected number of rows; got %d; want 1", len(rows.Rows))
+	}
+	if err := rows.Unmarshal("foo_created 123\n# EOF\n", true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rows.Rows) != 0 {
+		t.Fatalf("unexpected rows: %+v", rows.Rows)
+	}
+	if !rows.IsEOF {
+		t.Fatalf("expecting IsEOF to be set")
+	}
+}
+
+func TestRowsUnmarshalReusedBuffer(t *testing.T) {
+	var rows Rows
+	buf := []byte("# TYPE foo counter\nfoo_total{a=\"b\"} 1\n")
+	if err := rows.Unmarshal(bytesutil.ToUnsafeString(buf), false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tagsPoolLen := len(rows.tagsPool)
+
+	// Overwrite buf like common.ReadLinesBlock does for the next block.
+	buf = append(buf[:0], "# TYPE xxx gauge\nbar_total{a=\"b\"} 2\n"...)
+	if err := rows.Unmarshal(bytesutil.ToUnsafeString(buf), false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rows.tagsPool) != tagsPoolLen {
+		t.Fatalf("tagsPool must be reset between Unmarshal calls; got %d items; want %d items", len(rows.tagsPool), tagsPoolLen)
+	}
+	if err := rows.Unmarshal("foo_created 123\nxxx_created 456\n", false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rows.Rows) != 1 || rows.Rows[0].Metric != "xxx_created" {
+		t.Fatalf("unexpected rows; got %+v; want only xxx_created row", rows.Rows)
+	}
+}
+
+func TestRowsUnmarshalMetadata(t *testing.T) {
+	f := func(s string, isOpenMetrics bool, metadataExpected []metricsmetadata.Row) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s, isOpenMetrics); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Metadata, metadataExpected) {
+			t.Fatalf("unexpected metadata;\ngot\n%+v\nwant\n%+v", rows.Metadata, metadataExpected)
+		}
+		rows.Reset()
+		if len(rows.Metadata) != 0 {
+			t.Fatalf("non-empty metadata after reset: %+v", rows.Metadata)
+		}
+	}
+
+	// No metadata
+	f("foo 1\n# some comment\n# TYPES aren't metadata\n", false, nil)
+
+	// Help and type for a single family
+	f("# HELP foo Some help\n# TYPE foo gauge\nfoo 1\n", false, []metricsmetadata.Row{{
+		MetricFamilyName: "foo",
+		Type:             "gauge",
+		Help:             "Some help",
+	}})
+
+	// Escaped help
+	f(`# HELP foo Multi\nline \\ help`, false, []metricsmetadata.Row{{
+		MetricFamilyName: "foo",
+		Help:             "Multi\nline \\ help",
+	}})
+
+	// Missing type in Prometheus format is ignored
+	f("# TYPE foo\n# HELP foo\n", false, []metricsmetadata.Row{{
+		MetricFamilyName: "foo",
+	}})
+
+	// Multiple families with units in OpenMetrics format
+	f(`# TYPE foo counter
+# UNIT foo seconds
+# HELP foo Total time
+foo_total 1
+# TYPE bar gauge
+bar 2
+# EOF
+`, true, []metricsmetadata.Row{
+		{
+			MetricFamilyName: "foo",
+			Type:             "counter",
+			Help:             "Total time",
+			Unit:             "seconds",
+		},
+		{
+			MetricFamilyName: "bar",
+			Type:             "gauge",
+		},
+	})
+}
@@ -0,0 +1,197 @@
+package prometheusimport
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="prometheusimport"}`)
+
+// InsertHandler processes data in Prometheus exposition format from req.
+//
+// The data is parsed in OpenMetrics format if req has `application/openmetrics-text` Content-Type.
+//
+// maxSize limits the size of the request body after decompression.
+func InsertHandler(req *http.Request, maxSize int64) error {
+	return concurrencylimiter.Do(func() error {
+		return insertHandlerInternal(req, maxSize)
+	})
+}
+
+func insertHandlerInternal(req *http.Request, maxSize int64) error {
+	prometheusReadCalls.Inc()
+
+	isOpenMetrics := strings.HasPrefix(req.Header.Get("Content-Type"), "application/openmetrics-text")
+	r := req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := getGzipReader(r)
+		if err != nil {
+			return fmt.Errorf("cannot read gzipped Prometheus exposition data: %s", err)
+		}
+		defer putGzipReader(zr)
+		r = zr
+	}
+	mr := common.NewMaxSizeReader(r, maxSize)
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(req))
+	ctx.Common.SetAccountID(tenant.GetAccountID(req.Context()))
+	for ctx.Read(mr, isOpenMetrics) {
+		if err := ctx.InsertRows(); err != nil {
+			return err
+		}
+		vmstorage.AddMetricsMetadata(nil, ctx.Rows.Metadata)
+	}
+	if err := mr.Err(); err != nil {
+		return err
+	}
+	if err := ctx.Error(); err != nil {
+		return err
+	}
+	if isOpenMetrics && !ctx.Rows.IsEOF {
+		prometheusUnmarshalErrors.Inc()
+		return fmt.Errorf("missing `# EOF` line in the end of OpenMetrics data")
+	}
+	return nil
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	ic := &ctx.Common
+	ic.Reset(len(rows))
+	for i := range rows {
+		r := &rows[i]
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		ic.WriteDataPoint(nil, ic.Labels, r.Timestamp, r.Value)
+	}
+	rowsInserted.Add(len(rows))
+	return ic.FlushBufs()
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	v := gzipReaderPool.Get()
+	if v == nil {
+		return gzip.NewReader(r)
+	}
+	zr := v.(*gzip.Reader)
+	if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+func putGzipReader(zr *gzip.Reader) {
+	_ = zr.Close()
+	gzipReaderPool.Put(zr)
+}
+
+var gzipReaderPool sync.Pool
+
+func (ctx *pushCtx) Read(r io.Reader, isOpenMetrics bool) bool {
+	if ctx.err != nil || ctx.Rows.IsEOF {
+		// The data after `# EOF` line is ignored.
+		return false
+	}
+	ctx.reqBuf, ctx.tailBuf, ctx.err = common.ReadLinesBlock(r, ctx.reqBuf, ctx.tailBuf)
+	if ctx.err != nil {
+		if ctx.err != io.EOF {
+			prometheusReadErrors.Inc()
+			ctx.err = fmt.Errorf("cannot read Prometheus exposition data: %s", ctx.err)
+		}
+		return false
+	}
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf), isOpenMetrics); err != nil {
+		prometheusUnmarshalErrors.Inc()
+		ctx.err = fmt.Errorf("cannot unmarshal Prometheus exposition data with size %d: %s", len(ctx.reqBuf), err)
+		return false
+	}
+
+	// Set missing timestamps to the current time.
+	currentTs := time.Now().UnixNano() / 1e6
+	for i := range ctx.Rows.Rows {
+		row := &ctx.Rows.Rows[i]
+		if row.Timestamp == 0 {
+			row.Timestamp = currentTs
+		}
+	}
+	return true
+}
+
+var (
+	prometheusReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="prometheusimport"}`)
+	prometheusReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="prometheusimport"}`)
+	prometheusUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="prometheusimport"}`)
+)
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf  []byte
+	tailBuf []byte
+
+	err error
+}
+
+func (ctx *pushCtx) Error() error {
+	if ctx.err == io.EOF {
+		return nil
+	}
+	return ctx.err
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
+
+	ctx.reqBuf = ctx.reqBuf[:0]
+	ctx.tailBuf = ctx.tailBuf[:0]
+
+	ctx.err = nil
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
@@ -0,0 +1,432 @@
+package promscrape
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promrelabel"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultScrapeInterval = time.Minute
+	defaultScrapeTimeout  = 10 * time.Second
+	defaultMetricsPath    = "/metrics"
+	defaultScheme         = "http"
+)
+
+// Config represents Prometheus config with `scrape_configs` section.
+//
+// Other sections such as `rule_files` or `remote_write` are ignored.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/
+type Config struct {
+	Global        GlobalConfig   `yaml:"global,omitempty"`
+	ScrapeConfigs []ScrapeConfig `yaml:"scrape_configs,omitempty"`
+
+	// baseDir is used for resolving relative paths in file_sd_configs.
+	baseDir string
+}
+
+// GlobalConfig represents `global` section of Prometheus config.
+type GlobalConfig struct {
+	ScrapeInterval time.Duration     `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  time.Duration     `yaml:"scrape_timeout,omitempty"`
+	ExternalLabels map[string]string `yaml:"external_labels,omitempty"`
+}
+
+// ScrapeConfig represents an item in `scrape_configs` section of Prometheus config.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#scrape_config
+type ScrapeConfig struct {
+	JobName              string                      `yaml:"job_name"`
+	ScrapeInterval       time.Duration               `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout        time.Duration               `yaml:"scrape_timeout,omitempty"`
+	MetricsPath          string                      `yaml:"metrics_path,omitempty"`
+	HonorLabels          bool                        `yaml:"honor_labels,omitempty"`
+	HonorTimestamps      *bool                       `yaml:"honor_timestamps,omitempty"`
+	Scheme               string                      `yaml:"scheme,omitempty"`
+	Params               map[string][]string         `yaml:"params,omitempty"`
+	StaticConfigs        []StaticConfig              `yaml:"static_configs,omitempty"`
+	FileSDConfigs        []FileSDConfig              `yaml:"file_sd_configs,omitempty"`
+	RelabelConfigs       []promrelabel.RelabelConfig `yaml:"relabel_configs,omitempty"`
+	MetricRelabelConfigs []promrelabel.RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
+}
+
+// StaticConfig represents a group of targets with common labels.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#static_config
+type StaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// FileSDConfig represents file-based service discovery config.
+//
+// The files must contain a list of StaticConfig items in YAML or JSON format.
+// The last path segment in Files may contain a glob pattern such as `targets/*.json`.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#file_sd_config
+type FileSDConfig struct {
+	Files []string `yaml:"files"`
+}
+
+// ScrapeWork represents a unit of work for scraping a single target.
+type ScrapeWork struct {
+	// ScrapeURL is the full url for scraping the target.
+	ScrapeURL string
+
+	// JobName is the job_name from the scrape config the target belongs to.
+	JobName string
+
+	ScrapeInterval  time.Duration
+	ScrapeTimeout   time.Duration
+	HonorLabels     bool
+	HonorTimestamps bool
+
+	// Labels contains labels to add to every scraped metric.
+	//
+	// It contains at least `job` and `instance` labels.
+	Labels []prompb.Label
+
+	// MetricRelabelConfigs contains parsed `metric_relabel_configs`.
+	MetricRelabelConfigs []promrelabel.ParsedRelabelConfig
+}
+
+// key returns a string identifying sw.
+//
+// ScrapeWork items with the same key are scraped in the same way.
+func (sw *ScrapeWork) key() string {
+	var b []byte
+	b = append(b, fmt.Sprintf("url=%s, interval=%s, timeout=%s, honorLabels=%v, honorTimestamps=%v, labels={",
+		sw.ScrapeURL, sw.ScrapeInterval, sw.ScrapeTimeout, sw.HonorLabels, sw.HonorTimestamps)...)
+	for i, label := range sw.Labels {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, fmt.Sprintf("%s=%q", label.Name, label.Value)...)
+	}
+	b = append(b, "}, metricRelabelConfigs=["...)
+	for i := range sw.MetricRelabelConfigs {
+		b = append(b, sw.MetricRelabelConfigs[i].String()...)
+		b = append(b, ';')
+	}
+	b = append(b, ']')
+	return string(b)
+}
+
+// loadConfig loads Prometheus config from the given path.
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", path, err)
+	}
+	var cfg Config
+	if err := cfg.parse(data, path); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %s", path, err)
+	}
+	return &cfg, nil
+}
+
+func (cfg *Config) parse(data []byte, path string) error {
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("cannot obtain abs path for %q: %s", path, err)
+	}
+	cfg.baseDir = filepath.Dir(absPath)
+	jobNames := make(map[string]bool, len(cfg.ScrapeConfigs))
+	for i := range cfg.ScrapeConfigs {
+		jobName := cfg.ScrapeConfigs[i].JobName
+		if len(jobName) == 0 {
+			return fmt.Errorf("missing `job_name` in `scrape_config` #%d", i+1)
+		}
+		if jobNames[jobName] {
+			return fmt.Errorf("duplicate `job_name` %q in `scrape_configs`", jobName)
+		}
+		jobNames[jobName] = true
+	}
+	return nil
+}
+
+// getScrapeWorks returns ScrapeWork items for all the targets from cfg.
+//
+// Files from file_sd_configs are read on every call.
+func (cfg *Config) getScrapeWorks() ([]ScrapeWork, error) {
+	var dst []ScrapeWork
+	for i := range cfg.ScrapeConfigs {
+		var err error
+		dst, err = cfg.appendScrapeWorks(dst, &cfg.ScrapeConfigs[i])
+		if err != nil {
+			return nil, fmt.Errorf("error in `scrape_config` for job_name=%q: %s", cfg.ScrapeConfigs[i].JobName, err)
+		}
+	}
+	return dst, nil
+}
+
+func (cfg *Config) appendScrapeWorks(dst []ScrapeWork, sc *ScrapeConfig) ([]ScrapeWork, error) {
+	scrapeInterval := sc.ScrapeInterval
+	if scrapeInterval <= 0 {
+		scrapeInterval = cfg.Global.ScrapeInterval
+		if scrapeInterval <= 0 {
+			scrapeInterval = defaultScrapeInterval
+		}
+	}
+	scrapeTimeout := sc.ScrapeTimeout
+	if scrapeTimeout <= 0 {
+		scrapeTimeout = cfg.Global.ScrapeTimeout
+		if scrapeTimeout <= 0 {
+			scrapeTimeout = defaultScrapeTimeout
+		}
+	}
+	if scrapeTimeout > scrapeInterval {
+		// Limit the timeout by the interval like Prometheus does, so scrapes don't overlap.
+		scrapeTimeout = scrapeInterval
+	}
+	metricsPath := sc.MetricsPath
+	if len(metricsPath) == 0 {
+		metricsPath = defaultMetricsPath
+	}
+	scheme := sc.Scheme
+	if len(scheme) == 0 {
+		scheme = defaultScheme
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unsupported `scheme` %q; supported values: http, https", scheme)
+	}
+	honorTimestamps := true
+	if sc.HonorTimestamps != nil {
+		honorTimestamps = *sc.HonorTimestamps
+	}
+	relabelConfigs, err := promrelabel.ParseRelabelConfigs(sc.RelabelConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `relabel_configs`: %s", err)
+	}
+	metricRelabelConfigs, err := promrelabel.ParseRelabelConfigs(sc.MetricRelabelConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `metric_relabel_configs`: %s", err)
+	}
+	swc := &scrapeWorkConfig{
+		jobName:              sc.JobName,
+		scrapeInterval:       scrapeInterval,
+		scrapeTimeout:        scrapeTimeout,
+		metricsPath:          metricsPath,
+		scheme:               scheme,
+		params:               sc.Params,
+		honorLabels:          sc.HonorLabels,
+		honorTimestamps:      honorTimestamps,
+		externalLabels:       cfg.Global.ExternalLabels,
+		relabelConfigs:       relabelConfigs,
+		metricRelabelConfigs: metricRelabelConfigs,
+	}
+
+	for i := range sc.StaticConfigs {
+		dst, err = swc.appendScrapeWorks(dst, &sc.StaticConfigs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range sc.FileSDConfigs {
+		stcs, err := readFileSDConfig(cfg.baseDir, &sc.FileSDConfigs[i])
+		if err != nil {
+			return nil, err
+		}
+		for j := range stcs {
+			dst, err = swc.appendScrapeWorks(dst, &stcs[j])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return dst, nil
+}
+
+// readFileSDConfig reads static configs from files referred by sdc.
+//
+// Relative paths are resolved against baseDir.
+func readFileSDConfig(baseDir string, sdc *FileSDConfig) ([]StaticConfig, error) {
+	var dst []StaticConfig
+	for _, pattern := range sdc.Files {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in `file_sd_config`: %s", pattern, err)
+		}
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read `file_sd_config` from %q: %s", path, err)
+			}
+			var stcs []StaticConfig
+			if err := yaml.UnmarshalStrict(data, &stcs); err != nil {
+				return nil, fmt.Errorf("cannot parse `file_sd_config` from %q: %s", path, err)
+			}
+			dst = append(dst, stcs...)
+		}
+	}
+	return dst, nil
+}
+
+type scrapeWorkConfig struct {
+	jobName              string
+	scrapeInterval       time.Duration
+	scrapeTimeout        time.Duration
+	metricsPath          string
+	scheme               string
+	params               map[string][]string
+	honorLabels          bool
+	honorTimestamps      bool
+	externalLabels       map[string]string
+	relabelConfigs       []promrelabel.ParsedRelabelConfig
+	metricRelabelConfigs []promrelabel.ParsedRelabelConfig
+}
+
+func (swc *scrapeWorkConfig) appendScrapeWorks(dst []ScrapeWork, stc *StaticConfig) ([]ScrapeWork, error) {
+	for _, target := range stc.Targets {
+		if len(target) == 0 {
+			return nil, fmt.Errorf("`targets` cannot contain empty values")
+		}
+		labels := swc.getTargetLabels(target, stc.Labels)
+		labels = promrelabel.ApplyRelabelConfigs(labels, swc.relabelConfigs)
+		if labels == nil {
+			// The target is dropped by relabeling.
+			continue
+		}
+		sw, err := swc.newScrapeWork(labels)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create scrape work for target %q: %s", target, err)
+		}
+		if sw == nil {
+			// The target has no `__address__` after relabeling.
+			continue
+		}
+		dst = append(dst, *sw)
+	}
+	return dst, nil
+}
+
+// getTargetLabels returns labels for the target before relabeling.
+func (swc *scrapeWorkConfig) getTargetLabels(target string, extraLabels map[string]string) []prompb.Label {
+	m := map[string]string{
+		"job":              swc.jobName,
+		"__address__":      target,
+		"__scheme__":       swc.scheme,
+		"__metrics_path__": swc.metricsPath,
+	}
+	for k, args := range swc.params {
+		if len(args) > 0 {
+			m["__param_"+k] = args[0]
+		}
+	}
+	for k, v := range extraLabels {
+		m[k] = v
+	}
+	return getSortedLabels(m)
+}
+
+// newScrapeWork returns ScrapeWork for the given target labels obtained after relabeling.
+//
+// nil is returned if labels have no `__address__`.
+func (swc *scrapeWorkConfig) newScrapeWork(labels []prompb.Label) (*ScrapeWork, error) {
+	m := make(map[string]string, len(labels))
+	for _, label := range labels {
+		m[string(label.Name)] = string(label.Value)
+	}
+	address := m["__address__"]
+	if len(address) == 0 {
+		return nil, nil
+	}
+	if strings.Contains(address, "/") {
+		return nil, fmt.Errorf("`__address__` cannot contain `/`; got %q", address)
+	}
+	scheme := m["__scheme__"]
+	if len(scheme) == 0 {
+		scheme = swc.scheme
+	}
+	hostPort := address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		// Add the default port like Prometheus does.
+		if scheme == "https" {
+			hostPort += ":443"
+		} else {
+			hostPort += ":80"
+		}
+	}
+	metricsPath := m["__metrics_path__"]
+	if !strings.HasPrefix(metricsPath, "/") {
+		metricsPath = "/" + metricsPath
+	}
+	params := make(url.Values)
+	for k, args := range swc.params {
+		params[k] = append([]string{}, args...)
+	}
+	for k, v := range m {
+		if strings.HasPrefix(k, "__param_") {
+			name := k[len("__param_"):]
+			if args := params[name]; len(args) > 0 {
+				args[0] = v
+			} else {
+				params[name] = []string{v}
+			}
+		}
+	}
+	scrapeURL := scheme + "://" + hostPort + metricsPath
+	if len(params) > 0 {
+		scrapeURL += "?" + params.Encode()
+	}
+	if _, err := url.Parse(scrapeURL); err != nil {
+		return nil, fmt.Errorf("invalid scrape url %q: %s", scrapeURL, err)
+	}
+	if _, ok := m["instance"]; !ok {
+		m["instance"] = address
+	}
+
+	// Remove labels starting with `__`, since they are used only during relabeling.
+	for k := range m {
+		if strings.HasPrefix(k, "__") {
+			delete(m, k)
+		}
+	}
+	for k, v := range swc.externalLabels {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	return &ScrapeWork{
+		ScrapeURL:            scrapeURL,
+		JobName:              swc.jobName,
+		ScrapeInterval:       swc.scrapeInterval,
+		ScrapeTimeout:        swc.scrapeTimeout,
+		HonorLabels:          swc.honorLabels,
+		HonorTimestamps:      swc.honorTimestamps,
+		Labels:               getSortedLabels(m),
+		MetricRelabelConfigs: swc.metricRelabelConfigs,
+	}, nil
+}
+
+func getSortedLabels(m map[string]string) []prompb.Label {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	labels := make([]prompb.Label, 0, len(keys))
+	for _, k := range keys {
+		labels = append(labels, prompb.Label{
+			Name:  []byte(k),
+			Value: []byte(m[k]),
+		})
+	}
+	return labels
+}
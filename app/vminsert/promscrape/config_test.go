@@ -0,0 +1,264 @@
+package promscrape
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetScrapeWorksSuccess(t *testing.T) {
+	f := func(data string, swsExpected []string) {
+		t.Helper()
+		var cfg Config
+		if err := cfg.parse([]byte(data), "prometheus.yml"); err != nil {
+			t.Fatalf("cannot parse config: %s", err)
+		}
+		sws, err := cfg.getScrapeWorks()
+		if err != nil {
+			t.Fatalf("cannot obtain scrape works: %s", err)
+		}
+		var result []string
+		for i := range sws {
+			result = append(result, scrapeWorkString(&sws[i]))
+		}
+		if strings.Join(result, "\n") != strings.Join(swsExpected, "\n") {
+			t.Fatalf("unexpected scrape works;\ngot\n%s\nwant\n%s", strings.Join(result, "\n"), strings.Join(swsExpected, "\n"))
+		}
+	}
+
+	// Empty config
+	f(``, nil)
+
+	// Defaults
+	f(`
+scrape_configs:
+- job_name: foo
+  static_configs:
+  - targets: ["host1:1234", "host2"]
+`, []string{
+		`http://host1:1234/metrics 1m0s 10s {instance="host1:1234",job="foo"}`,
+		`http://host2:80/metrics 1m0s 10s {instance="host2",job="foo"}`,
+	})
+
+	// Global and per-job settings
+	f(`
+global:
+  scrape_interval: 15s
+  scrape_timeout: 20s
+  external_labels:
+    dc: abc
+rule_files: ["ignored.yml"]
+scrape_configs:
+- job_name: foo
+  static_configs:
+  - targets: ["host1:1234"]
+    labels:
+      env: prod
+- job_name: bar
+  scrape_interval: 30s
+  scrape_timeout: 5s
+  scheme: https
+  metrics_path: /federate
+  params:
+    "match[]": ['{job="x"}']
+  static_configs:
+  - targets: ["host2"]
+`, []string{
+		`http://host1:1234/metrics 15s 15s {dc="abc",env="prod",instance="host1:1234",job="foo"}`,
+		`https://host2:443/federate?match%5B%5D=%7Bjob%3D%22x%22%7D 30s 5s {dc="abc",instance="host2",job="bar"}`,
+	})
+
+	// Relabeling
+	f(`
+scrape_configs:
+- job_name: foo
+  relabel_configs:
+  - source_labels: [__address__]
+    regex: "drop-.+"
+    action: drop
+  - source_labels: [__address__]
+    regex: "(.+):.+"
+    target_label: instance
+  - source_labels: [env]
+    target_label: __param_env
+  - source_labels: [__meta_unused]
+    target_label: unused
+  static_configs:
+  - targets: ["host1:1234", "drop-host:80"]
+    labels:
+      env: dev
+`, []string{
+		`http://host1:1234/metrics?env=dev 1m0s 10s {env="dev",instance="host1",job="foo"}`,
+	})
+}
+
+func TestGetScrapeWorksFileSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestGetScrapeWorksFileSD")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("cannot write %q: %s", name, err)
+		}
+	}
+	writeFile("prometheus.yml", `
+scrape_configs:
+- job_name: foo
+  scrape_interval: 10s
+  file_sd_configs:
+  - files: ["targets/*.json", "targets.yml"]
+`)
+	if err := os.Mkdir(filepath.Join(dir, "targets"), 0755); err != nil {
+		t.Fatalf("cannot create targets dir: %s", err)
+	}
+	writeFile("targets/a.json", `[{"targets": ["host1:80"], "labels": {"x": "y"}}]`)
+	writeFile("targets.yml", `
+- targets: ["host2:80"]
+`)
+
+	cfg, err := loadConfig(filepath.Join(dir, "prometheus.yml"))
+	if err != nil {
+		t.Fatalf("cannot load config: %s", err)
+	}
+	sws, err := cfg.getScrapeWorks()
+	if err != nil {
+		t.Fatalf("cannot obtain scrape works: %s", err)
+	}
+	var result []string
+	for i := range sws {
+		result = append(result, scrapeWorkString(&sws[i]))
+	}
+	resultExpected := []string{
+		`http://host1:80/metrics 10s 10s {instance="host1:80",job="foo",x="y"}`,
+		`http://host2:80/metrics 10s 10s {instance="host2:80",job="foo"}`,
+	}
+	if strings.Join(result, "\n") != strings.Join(resultExpected, "\n") {
+		t.Fatalf("unexpected scrape works;\ngot\n%s\nwant\n%s", strings.Join(result, "\n"), strings.Join(resultExpected, "\n"))
+	}
+
+	// Targets must be re-read from files on every call.
+	writeFile("targets.yml", `[]`)
+	sws, err = cfg.getScrapeWorks()
+	if err != nil {
+		t.Fatalf("cannot obtain scrape works: %s", err)
+	}
+	if len(sws) != 1 {
+		t.Fatalf("unexpected number of scrape works after updating file_sd; got %d; want 1", len(sws))
+	}
+
+	// Invalid file contents
+	writeFile("targets.yml", `foobar`)
+	if _, err := cfg.getScrapeWorks(); err == nil {
+		t.Fatalf("expecting non-nil error for invalid file_sd contents")
+	}
+}
+
+func TestGetScrapeWorksFailure(t *testing.T) {
+	f := func(data string) {
+		t.Helper()
+		var cfg Config
+		if err := cfg.parse([]byte(data), "prometheus.yml"); err != nil {
+			return
+		}
+		if _, err := cfg.getScrapeWorks(); err == nil {
+			t.Fatalf("expecting non-nil error for config\n%s", data)
+		}
+	}
+
+	// Invalid yaml
+	f(`foobar`)
+
+	// Missing job_name
+	f(`
+scrape_configs:
+- static_configs:
+  - targets: ["foo"]
+`)
+
+	// Duplicate job_name
+	f(`
+scrape_configs:
+- job_name: foo
+- job_name: foo
+`)
+
+	// Unsupported scheme
+	f(`
+scrape_configs:
+- job_name: foo
+  scheme: ftp
+  static_configs:
+  - targets: ["foo"]
+`)
+
+	// Invalid relabel config
+	f(`
+scrape_configs:
+- job_name: foo
+  relabel_configs:
+  - action: keep
+  static_configs:
+  - targets: ["foo"]
+`)
+
+	// Invalid address
+	f(`
+scrape_configs:
+- job_name: foo
+  static_configs:
+  - targets: ["foo/bar"]
+`)
+}
+
+func TestScrapeWorkKey(t *testing.T) {
+	var cfg Config
+	data := `
+scrape_configs:
+- job_name: foo
+  static_configs:
+  - targets: ["host1", "host2"]
+`
+	if err := cfg.parse([]byte(data), "prometheus.yml"); err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+	sws, err := cfg.getScrapeWorks()
+	if err != nil {
+		t.Fatalf("cannot obtain scrape works: %s", err)
+	}
+	if sws[0].key() == sws[1].key() {
+		t.Fatalf("distinct targets must have distinct keys; got %q", sws[0].key())
+	}
+	sw := sws[0]
+	sw.ScrapeInterval = time.Hour
+	if sw.key() == sws[0].key() {
+		t.Fatalf("changed scrape interval must change the key; got %q", sw.key())
+	}
+}
+
+func scrapeWorkString(sw *ScrapeWork) string {
+	var b []byte
+	b = append(b, sw.ScrapeURL...)
+	b = append(b, ' ')
+	b = append(b, sw.ScrapeInterval.String()...)
+	b = append(b, ' ')
+	b = append(b, sw.ScrapeTimeout.String()...)
+	b = append(b, " {"...)
+	for i, label := range sw.Labels {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, label.Name...)
+		b = append(b, `="`...)
+		b = append(b, label.Value...)
+		b = append(b, '"')
+	}
+	b = append(b, '}')
+	return string(b)
+}
@@ -0,0 +1,185 @@
+package promscrape
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	promscrapeConfigFile = flag.String("promscrape.config", "", "Optional path to Prometheus config file with scrape_configs section containing targets to scrape. "+
+		"Only static_configs and file_sd_configs are supported. The file is re-read on SIGHUP. "+
+		"See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#scrape_config")
+	fileSDCheckInterval = flag.Duration("promscrape.fileSDCheckInterval", 30*time.Second, "Interval for checking for changes in file_sd_configs")
+)
+
+// Init starts scraping Prometheus targets from -promscrape.config if it is set.
+//
+// pushData is called for pushing the scraped data to the storage.
+// pushMetadata is called for pushing the scraped metrics metadata to the storage.
+//
+// Stop must be called when scraping is no longer needed.
+func Init(pushData func(wr *prompb.WriteRequest), pushMetadata func(target []metricsmetadata.Label, rows []metricsmetadata.Row)) {
+	if len(*promscrapeConfigFile) == 0 {
+		return
+	}
+	cfg, err := loadConfig(*promscrapeConfigFile)
+	if err != nil {
+		logger.Fatalf("cannot load -promscrape.config=%q: %s", *promscrapeConfigFile, err)
+	}
+	sws, err := cfg.getScrapeWorks()
+	if err != nil {
+		logger.Fatalf("cannot obtain scrape targets from -promscrape.config=%q: %s", *promscrapeConfigFile, err)
+	}
+	sg := newScraperGroup(pushData, pushMetadata)
+	sg.update(sws)
+
+	sighupCh := procutil.NewSighupChan()
+	scraperWG.Add(1)
+	go func() {
+		defer scraperWG.Done()
+		ticker := time.NewTicker(*fileSDCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-scraperStopCh:
+				sg.stop()
+				return
+			case <-sighupCh:
+				logger.Infof("SIGHUP received; reloading -promscrape.config=%q", *promscrapeConfigFile)
+				cfgNew, err := loadConfig(*promscrapeConfigFile)
+				if err != nil {
+					configReloadErrors.Inc()
+					logger.Errorf("cannot reload -promscrape.config=%q; continuing using the previous config: %s", *promscrapeConfigFile, err)
+					continue
+				}
+				cfg = cfgNew
+				configReloads.Inc()
+			case <-ticker.C:
+				// Re-read files from file_sd_configs.
+			}
+			sws, err := cfg.getScrapeWorks()
+			if err != nil {
+				logger.Errorf("cannot obtain scrape targets from -promscrape.config=%q; continuing scraping the previous targets: %s", *promscrapeConfigFile, err)
+				continue
+			}
+			sg.update(sws)
+		}
+	}()
+}
+
+// Stop stops scraping Prometheus targets.
+func Stop() {
+	if len(*promscrapeConfigFile) == 0 {
+		return
+	}
+	close(scraperStopCh)
+	scraperWG.Wait()
+}
+
+var (
+	scraperStopCh = make(chan struct{})
+	scraperWG     sync.WaitGroup
+)
+
+var (
+	configReloads      = metrics.NewCounter(`vm_promscrape_config_reloads_total`)
+	configReloadErrors = metrics.NewCounter(`vm_promscrape_config_reload_errors_total`)
+)
+
+// scraperGroup manages scrape loops for the targets.
+type scraperGroup struct {
+	pushData     func(wr *prompb.WriteRequest)
+	pushMetadata func(target []metricsmetadata.Label, rows []metricsmetadata.Row)
+	m            map[string]*scraper
+	wg           sync.WaitGroup
+}
+
+type scraper struct {
+	stopCh  chan struct{}
+	removed uint32
+}
+
+func newScraperGroup(pushData func(wr *prompb.WriteRequest), pushMetadata func(target []metricsmetadata.Label, rows []metricsmetadata.Row)) *scraperGroup {
+	return &scraperGroup{
+		pushData:     pushData,
+		pushMetadata: pushMetadata,
+		m:            make(map[string]*scraper),
+	}
+}
+
+// update starts scrape loops for new targets from sws and stops scrape loops for the targets missing in sws.
+//
+// Scrape loops for unchanged targets continue running.
+func (sg *scraperGroup) update(sws []ScrapeWork) {
+	swsMap := make(map[string]*ScrapeWork, len(sws))
+	for i := range sws {
+		sw := &sws[i]
+		key := sw.key()
+		// Duplicate targets are scraped only once.
+		swsMap[key] = sw
+	}
+
+	removed := 0
+	for key, sc := range sg.m {
+		if _, ok := swsMap[key]; ok {
+			continue
+		}
+		atomic.StoreUint32(&sc.removed, 1)
+		close(sc.stopCh)
+		delete(sg.m, key)
+		removed++
+	}
+	added := 0
+	for key, sw := range swsMap {
+		if _, ok := sg.m[key]; ok {
+			continue
+		}
+		sc := &scraper{
+			stopCh: make(chan struct{}),
+		}
+		sg.m[key] = sc
+		sg.startScraper(sc, sw)
+		added++
+	}
+	if added > 0 || removed > 0 {
+		logger.Infof("promscrape: added %d targets, removed %d targets; the total number of targets is %d", added, removed, len(sg.m))
+	}
+}
+
+func (sg *scraperGroup) startScraper(sc *scraper, cfg *ScrapeWork) {
+	c := newClient(cfg)
+	sw := &scrapeWork{
+		Config:       *cfg,
+		ReadData:     c.ReadData,
+		PushData:     sg.pushData,
+		PushMetadata: sg.pushMetadata,
+		prevUp:       1,
+	}
+	atomic.AddUint64(&scrapersActive, 1)
+	sg.wg.Add(1)
+	go func() {
+		defer sg.wg.Done()
+		sw.run(sc.stopCh, func() bool {
+			return atomic.LoadUint32(&sc.removed) != 0
+		})
+		c.closeIdleConnections()
+		atomic.AddUint64(&scrapersActive, ^uint64(0))
+	}()
+}
+
+// stop stops all the scrape loops in sg.
+func (sg *scraperGroup) stop() {
+	for key, sc := range sg.m {
+		close(sc.stopCh)
+		delete(sg.m, key)
+	}
+	sg.wg.Wait()
+}
@@ -0,0 +1,51 @@
+package promscrape
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestScraperGroupUpdateMetricRelabelConfigs(t *testing.T) {
+	sg := newScraperGroup(func(wr *prompb.WriteRequest) {}, func(target []metricsmetadata.Label, rows []metricsmetadata.Row) {})
+	defer sg.stop()
+
+	newScrapeWork := func(jobName, metricRelabelConfigs string) ScrapeWork {
+		return ScrapeWork{
+			ScrapeURL:            "http://" + jobName + ".invalid/metrics",
+			JobName:              jobName,
+			ScrapeInterval:       time.Hour,
+			ScrapeTimeout:        time.Second,
+			Labels:               newTestLabels(`job="` + jobName + `"`),
+			MetricRelabelConfigs: mustParseRelabelConfigs(metricRelabelConfigs),
+		}
+	}
+	swFoo := newScrapeWork("foo", `[{"action":"drop","source_labels":["__name__"],"regex":"a"}]`)
+	swBar := newScrapeWork("bar", `[{"action":"drop","source_labels":["__name__"],"regex":"a"}]`)
+	sg.update([]ScrapeWork{swFoo, swBar})
+	if len(sg.m) != 2 {
+		t.Fatalf("unexpected number of scrapers; got %d; want 2", len(sg.m))
+	}
+	scFoo := sg.m[swFoo.key()]
+	scBar := sg.m[swBar.key()]
+
+	// Changing metric_relabel_configs for the `bar` job must restart only its scrape loop.
+	swBarNew := newScrapeWork("bar", `[{"action":"keep","source_labels":["__name__"],"regex":"b"}]`)
+	sg.update([]ScrapeWork{swFoo, swBarNew})
+	if len(sg.m) != 2 {
+		t.Fatalf("unexpected number of scrapers; got %d; want 2", len(sg.m))
+	}
+	if sc := sg.m[swFoo.key()]; sc != scFoo {
+		t.Fatalf("the scraper for unchanged job must continue running")
+	}
+	if sc := sg.m[swBarNew.key()]; sc == nil || sc == scBar {
+		t.Fatalf("the scraper for the job with updated metric_relabel_configs must be restarted")
+	}
+	select {
+	case <-scBar.stopCh:
+	default:
+		t.Fatalf("the previous scraper for the job with updated metric_relabel_configs must be stopped")
+	}
+}
@@ -0,0 +1,374 @@
+package promscrape
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/prometheusimport"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promrelabel"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxScrapeSize = flag.Int("promscrape.maxScrapeSize", 16*1024*1024, "The maximum size of scrape response in bytes to process from Prometheus targets. "+
+	"Bigger responses are rejected")
+
+// scrapeWork scrapes a single target.
+type scrapeWork struct {
+	// Config is the scrape config for the target.
+	Config ScrapeWork
+
+	// ReadData must append the scraped response body to dst and return the result.
+	ReadData func(dst []byte) ([]byte, error)
+
+	// PushData is called for pushing the scraped data to the storage.
+	PushData func(wr *prompb.WriteRequest)
+
+	// PushMetadata is called for pushing the scraped metrics metadata to the storage.
+	//
+	// Metadata isn't pushed if PushMetadata is nil.
+	PushMetadata func(target []metricsmetadata.Label, rows []metricsmetadata.Row)
+
+	bodyBuf     []byte
+	prevBodyBuf []byte
+
+	rows   prometheusimport.Rows
+	wr     prompb.WriteRequest
+	labels []prompb.Label
+	values []prompb.Sample
+
+	// target contains target labels for the pushed metadata.
+	target []metricsmetadata.Label
+
+	// prevUp is the value of `up` metric for the previous scrape.
+	prevUp int
+
+	// samplesDropped counts samples dropped by metric_relabel_configs for the job.
+	samplesDropped *metrics.Counter
+}
+
+// run scrapes the target every sw.Config.ScrapeInterval until stopCh is closed.
+//
+// Staleness marks are pushed for all the previously scraped series if isRemoved returns true after stopCh is closed.
+func (sw *scrapeWork) run(stopCh <-chan struct{}, isRemoved func() bool) {
+	// Spread scrapes for distinct targets over the scrape interval in order to avoid load spikes.
+	interval := sw.Config.ScrapeInterval
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(sw.Config.key()))
+	offset := time.Duration(h.Sum64() % uint64(interval))
+	timer := time.NewTimer(offset)
+	select {
+	case <-stopCh:
+		timer.Stop()
+		return
+	case <-timer.C:
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timestamp := time.Now()
+	sw.scrapeAndLogError(timestamp)
+	for {
+		select {
+		case <-stopCh:
+			if isRemoved() {
+				sw.sendStaleMarkers(time.Now())
+			}
+			return
+		case timestamp = <-ticker.C:
+			sw.scrapeAndLogError(timestamp)
+		}
+	}
+}
+
+func (sw *scrapeWork) scrapeAndLogError(timestamp time.Time) {
+	err := sw.scrapeInternal(timestamp)
+	up := 1
+	if err != nil {
+		up = 0
+	}
+	if up == 0 && sw.prevUp != 0 {
+		// Log only state changes in order to reduce the amount of logs for unavailable targets.
+		logger.Errorf("error when scraping %q from job %q: %s", sw.Config.ScrapeURL, sw.Config.JobName, err)
+	}
+	sw.prevUp = up
+}
+
+func (sw *scrapeWork) scrapeInternal(timestamp time.Time) error {
+	scrapesTotal.Inc()
+	ts := timestamp.UnixNano() / 1e6
+	startTime := time.Now()
+	var err error
+	sw.bodyBuf, err = sw.ReadData(sw.bodyBuf[:0])
+	if err == nil {
+		err = sw.rows.Unmarshal(bytesutil.ToUnsafeString(sw.bodyBuf), false)
+		if err != nil {
+			err = fmt.Errorf("cannot parse response from %q: %s", sw.Config.ScrapeURL, err)
+		}
+	}
+	duration := time.Since(startTime)
+	up := 1
+	if err != nil {
+		scrapesFailed.Inc()
+		up = 0
+		sw.rows.Reset()
+	}
+
+	sw.resetWriteRequest()
+	samplesScraped := len(sw.rows.Rows)
+	for i := range sw.rows.Rows {
+		sw.addRow(&sw.rows.Rows[i], ts)
+	}
+	samplesPostRelabeling := len(sw.wr.Timeseries)
+	if n := samplesScraped - samplesPostRelabeling; n > 0 {
+		sw.getSamplesDroppedCounter().Add(n)
+	}
+	sw.addAutoTimeseries("up", float64(up), ts)
+	sw.addAutoTimeseries("scrape_duration_seconds", duration.Seconds(), ts)
+	sw.addAutoTimeseries("scrape_samples_scraped", float64(samplesScraped), ts)
+	sw.addAutoTimeseries("scrape_samples_post_metric_relabeling", float64(samplesPostRelabeling), ts)
+	sw.PushData(&sw.wr)
+	samplesScrapedTotal.Add(samplesScraped)
+	if sw.PushMetadata != nil && len(sw.rows.Metadata) > 0 {
+		sw.PushMetadata(sw.getTarget(), sw.rows.Metadata)
+	}
+
+	if err == nil {
+		// Remember the response body for sending staleness marks when the target is removed.
+		sw.bodyBuf, sw.prevBodyBuf = sw.prevBodyBuf, sw.bodyBuf
+	}
+	sw.rows.Reset()
+	sw.resetWriteRequest()
+	return err
+}
+
+// sendStaleMarkers pushes Prometheus staleness marks for the series from the last successful scrape
+// and for the automatically generated series.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/basics/#staleness
+func (sw *scrapeWork) sendStaleMarkers(timestamp time.Time) {
+	ts := timestamp.UnixNano() / 1e6
+	sw.resetWriteRequest()
+	if err := sw.rows.Unmarshal(bytesutil.ToUnsafeString(sw.prevBodyBuf), false); err == nil {
+		for i := range sw.rows.Rows {
+			sw.addRow(&sw.rows.Rows[i], ts)
+		}
+	}
+	for _, name := range []string{"up", "scrape_duration_seconds", "scrape_samples_scraped", "scrape_samples_post_metric_relabeling"} {
+		sw.addAutoTimeseries(name, 0, ts)
+	}
+	for i := range sw.wr.Timeseries {
+		samples := sw.wr.Timeseries[i].Samples
+		for j := range samples {
+			samples[j].Timestamp = ts
+			samples[j].Value = decimal.StaleNaN
+		}
+	}
+	sw.PushData(&sw.wr)
+	sw.rows.Reset()
+	sw.resetWriteRequest()
+}
+
+// getSamplesDroppedCounter returns the counter for samples dropped by metric_relabel_configs for sw.Config.JobName.
+func (sw *scrapeWork) getSamplesDroppedCounter() *metrics.Counter {
+	if sw.samplesDropped == nil {
+		name := fmt.Sprintf(`vm_promscrape_metric_relabel_dropped_samples_total{job=%q}`, sw.Config.JobName)
+		sw.samplesDropped = metrics.GetOrCreateCounter(name)
+	}
+	return sw.samplesDropped
+}
+
+// getTarget returns target labels for sw.
+func (sw *scrapeWork) getTarget() []metricsmetadata.Label {
+	if sw.target == nil {
+		for _, label := range sw.Config.Labels {
+			sw.target = append(sw.target, metricsmetadata.Label{
+				Name:  string(label.Name),
+				Value: string(label.Value),
+			})
+		}
+	}
+	return sw.target
+}
+
+func (sw *scrapeWork) resetWriteRequest() {
+	for i := range sw.wr.Timeseries {
+		ts := &sw.wr.Timeseries[i]
+		ts.Labels = nil
+		ts.Samples = nil
+	}
+	sw.wr.Timeseries = sw.wr.Timeseries[:0]
+	for i := range sw.labels {
+		label := &sw.labels[i]
+		label.Name = nil
+		label.Value = nil
+	}
+	sw.labels = sw.labels[:0]
+	sw.values = sw.values[:0]
+}
+
+// addRow adds r to sw.wr after applying target labels and metric_relabel_configs.
+func (sw *scrapeWork) addRow(r *prometheusimport.Row, timestamp int64) {
+	labelsStart := len(sw.labels)
+	sw.labels = appendLabel(sw.labels, "__name__", r.Metric)
+	for i := range r.Tags {
+		tag := &r.Tags[i]
+		sw.labels = appendLabel(sw.labels, tag.Key, tag.Value)
+	}
+	sw.labels = appendTargetLabels(sw.labels, labelsStart, sw.Config.Labels, sw.Config.HonorLabels)
+	labels := sw.labels[labelsStart:len(sw.labels):len(sw.labels)]
+	labels = promrelabel.ApplyRelabelConfigs(labels, sw.Config.MetricRelabelConfigs)
+	if len(labels) == 0 || !promrelabel.HasMetricName(labels) {
+		// Drop samples without labels or without metric name.
+		return
+	}
+	if sw.Config.HonorTimestamps && r.Timestamp > 0 {
+		timestamp = r.Timestamp
+	}
+	sw.addTimeseries(labels, r.Value, timestamp)
+}
+
+// addAutoTimeseries adds automatically generated series with the given name and target labels to sw.wr.
+//
+// metric_relabel_configs aren't applied to these series like in Prometheus.
+func (sw *scrapeWork) addAutoTimeseries(name string, value float64, timestamp int64) {
+	labelsStart := len(sw.labels)
+	sw.labels = appendLabel(sw.labels, "__name__", name)
+	sw.labels = append(sw.labels, sw.Config.Labels...)
+	labels := sw.labels[labelsStart:len(sw.labels):len(sw.labels)]
+	sw.addTimeseries(labels, value, timestamp)
+}
+
+func (sw *scrapeWork) addTimeseries(labels []prompb.Label, value float64, timestamp int64) {
+	sw.values = append(sw.values, prompb.Sample{
+		Value:     value,
+		Timestamp: timestamp,
+	})
+	tss := sw.wr.Timeseries
+	if cap(tss) > len(tss) {
+		tss = tss[:len(tss)+1]
+	} else {
+		tss = append(tss, prompb.TimeSeries{})
+	}
+	ts := &tss[len(tss)-1]
+	ts.Labels = labels
+	ts.Samples = sw.values[len(sw.values)-1:]
+	sw.wr.Timeseries = tss
+}
+
+// appendTargetLabels appends targetLabels to dst, while taking into account dst[offset:] labels scraped from the target.
+//
+// Scraped labels are preserved on conflicts if honorLabels is set. Otherwise conflicting scraped labels
+// are renamed to `exported_<name>` like Prometheus does.
+func appendTargetLabels(dst []prompb.Label, offset int, targetLabels []prompb.Label, honorLabels bool) []prompb.Label {
+	scrapedLabels := dst[offset:]
+	for _, targetLabel := range targetLabels {
+		var conflicting *prompb.Label
+		for i := range scrapedLabels {
+			if string(scrapedLabels[i].Name) == string(targetLabel.Name) {
+				conflicting = &scrapedLabels[i]
+				break
+			}
+		}
+		if conflicting == nil {
+			dst = append(dst, targetLabel)
+			continue
+		}
+		if honorLabels {
+			continue
+		}
+		conflicting.Name = append([]byte("exported_"), conflicting.Name...)
+		dst = append(dst, targetLabel)
+	}
+	return dst
+}
+
+func appendLabel(dst []prompb.Label, name, value string) []prompb.Label {
+	return append(dst, prompb.Label{
+		Name:  bytesutil.ToUnsafeBytes(name),
+		Value: bytesutil.ToUnsafeBytes(value),
+	})
+}
+
+var (
+	scrapesTotal        = metrics.NewCounter(`vm_promscrape_scrapes_total`)
+	scrapesFailed       = metrics.NewCounter(`vm_promscrape_scrapes_failed_total`)
+	samplesScrapedTotal = metrics.NewCounter(`vm_promscrape_scraped_samples_total`)
+)
+
+// client reads data from the target.
+type client struct {
+	hc        *http.Client
+	scrapeURL string
+	timeout   string
+}
+
+func newClient(sw *ScrapeWork) *client {
+	return &client{
+		hc: &http.Client{
+			Timeout: sw.ScrapeTimeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: 1,
+			},
+		},
+		scrapeURL: sw.ScrapeURL,
+		timeout:   strconv.FormatFloat(sw.ScrapeTimeout.Seconds(), 'f', -1, 64),
+	}
+}
+
+// ReadData appends response body from c.scrapeURL to dst and returns the result.
+func (c *client) ReadData(dst []byte) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.scrapeURL, nil)
+	if err != nil {
+		return dst, fmt.Errorf("cannot create request for %q: %s", c.scrapeURL, err)
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=1,*/*;q=0.1")
+	req.Header.Set("User-Agent", "VictoriaMetrics")
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", c.timeout)
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return dst, fmt.Errorf("cannot fetch %q: %s", c.scrapeURL, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return dst, fmt.Errorf("unexpected status code returned from %q: %d; expecting %d", c.scrapeURL, resp.StatusCode, http.StatusOK)
+	}
+	dstLen := len(dst)
+	bb := bytes.NewBuffer(dst)
+	if _, err := bb.ReadFrom(io.LimitReader(resp.Body, int64(*maxScrapeSize)+1)); err != nil {
+		return dst, fmt.Errorf("cannot read response from %q: %s", c.scrapeURL, err)
+	}
+	dst = bb.Bytes()
+	if len(dst)-dstLen > *maxScrapeSize {
+		return dst[:dstLen], fmt.Errorf("the response from %q exceeds -promscrape.maxScrapeSize=%d bytes", c.scrapeURL, *maxScrapeSize)
+	}
+	return dst, nil
+}
+
+// closeIdleConnections closes idle connections to the target.
+func (c *client) closeIdleConnections() {
+	if tr, ok := c.hc.Transport.(*http.Transport); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// scrapersActive is the number of active scrape loops.
+var scrapersActive uint64
+
+var _ = metrics.NewGauge(`vm_promscrape_active_scrapers`, func() float64 {
+	return float64(atomic.LoadUint64(&scrapersActive))
+})
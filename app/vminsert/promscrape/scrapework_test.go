@@ -0,0 +1,351 @@
+package promscrape
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promrelabel"
+)
+
+func TestScrapeWorkScrapeInternalFailure(t *testing.T) {
+	dataExpected := `
+up{job="foo",instance="host:80"} 0 123000
+scrape_duration_seconds{job="foo",instance="host:80"} 0 123000
+scrape_samples_scraped{job="foo",instance="host:80"} 0 123000
+scrape_samples_post_metric_relabeling{job="foo",instance="host:80"} 0 123000
+`
+	sw := &scrapeWork{
+		Config: ScrapeWork{
+			Labels: newTestLabels(`job="foo",instance="host:80"`),
+		},
+	}
+	readDataCalls := 0
+	sw.ReadData = func(dst []byte) ([]byte, error) {
+		readDataCalls++
+		return dst, fmt.Errorf("error when reading data")
+	}
+	pushDataCalls := 0
+	var pushDataErr error
+	sw.PushData = func(wr *prompb.WriteRequest) {
+		if err := expectEqualTimeseries(wr.Timeseries, dataExpected); err != nil {
+			pushDataErr = fmt.Errorf("unexpected data pushed: %s\ndata: %s", err, timeseriesToString(wr.Timeseries))
+		}
+		pushDataCalls++
+	}
+	timestamp := time.Unix(123, 0)
+	if err := sw.scrapeInternal(timestamp); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if pushDataErr != nil {
+		t.Fatalf("unexpected error: %s", pushDataErr)
+	}
+	if readDataCalls != 1 {
+		t.Fatalf("unexpected number of readData calls; got %d; want %d", readDataCalls, 1)
+	}
+	if pushDataCalls != 1 {
+		t.Fatalf("unexpected number of pushData calls; got %d; want %d", pushDataCalls, 1)
+	}
+}
+
+func TestScrapeWorkScrapeInternalSuccess(t *testing.T) {
+	f := func(data string, cfg *ScrapeWork, dataExpected string) {
+		t.Helper()
+
+		sw := &scrapeWork{
+			Config: *cfg,
+		}
+		sw.ReadData = func(dst []byte) ([]byte, error) {
+			return append(dst, data...), nil
+		}
+		pushDataCalls := 0
+		var pushDataErr error
+		sw.PushData = func(wr *prompb.WriteRequest) {
+			pushDataCalls++
+			if err := expectEqualTimeseries(wr.Timeseries, dataExpected); err != nil {
+				pushDataErr = fmt.Errorf("unexpected data pushed: %s\ndata: %s", err, timeseriesToString(wr.Timeseries))
+			}
+		}
+		timestamp := time.Unix(123, 0)
+		if err := sw.scrapeInternal(timestamp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if pushDataErr != nil {
+			t.Fatalf("unexpected error: %s", pushDataErr)
+		}
+		if pushDataCalls != 1 {
+			t.Fatalf("unexpected number of pushData calls; got %d; want %d", pushDataCalls, 1)
+		}
+	}
+
+	f(``, &ScrapeWork{}, `
+up 1 123000
+scrape_samples_scraped 0 123000
+scrape_duration_seconds 0 123000
+scrape_samples_post_metric_relabeling 0 123000
+`)
+	f(`
+foo{bar="baz"} 34.45 3
+abc -2
+`, &ScrapeWork{
+		Labels: newTestLabels(`job="xx",instance="foo.com"`),
+	}, `
+foo{bar="baz",job="xx",instance="foo.com"} 34.45 123000
+abc{job="xx",instance="foo.com"} -2 123000
+up{job="xx",instance="foo.com"} 1 123000
+scrape_samples_scraped{job="xx",instance="foo.com"} 2 123000
+scrape_duration_seconds{job="xx",instance="foo.com"} 0 123000
+scrape_samples_post_metric_relabeling{job="xx",instance="foo.com"} 2 123000
+`)
+
+	// honor_timestamps
+	f(`
+foo{bar="baz"} 34.45 3
+abc -2
+`, &ScrapeWork{
+		HonorTimestamps: true,
+	}, `
+foo{bar="baz"} 34.45 3
+abc -2 123000
+up 1 123000
+scrape_samples_scraped 2 123000
+scrape_duration_seconds 0 123000
+scrape_samples_post_metric_relabeling 2 123000
+`)
+
+	// Conflicting labels without honor_labels
+	f(`
+foo{job="orig",bar="baz"} 34.45
+`, &ScrapeWork{
+		Labels: newTestLabels(`job="xx",instance="foo.com"`),
+	}, `
+foo{exported_job="orig",bar="baz",job="xx",instance="foo.com"} 34.45 123000
+up{job="xx",instance="foo.com"} 1 123000
+scrape_samples_scraped{job="xx",instance="foo.com"} 1 123000
+scrape_duration_seconds{job="xx",instance="foo.com"} 0 123000
+scrape_samples_post_metric_relabeling{job="xx",instance="foo.com"} 1 123000
+`)
+
+	// Conflicting labels with honor_labels
+	f(`
+foo{job="orig",bar="baz"} 34.45
+`, &ScrapeWork{
+		HonorLabels: true,
+		Labels:      newTestLabels(`job="xx",instance="foo.com"`),
+	}, `
+foo{job="orig",bar="baz",instance="foo.com"} 34.45 123000
+up{job="xx",instance="foo.com"} 1 123000
+scrape_samples_scraped{job="xx",instance="foo.com"} 1 123000
+scrape_duration_seconds{job="xx",instance="foo.com"} 0 123000
+scrape_samples_post_metric_relabeling{job="xx",instance="foo.com"} 1 123000
+`)
+
+	// metric_relabel_configs
+	f(`
+foo{bar="baz"} 34.44
+bar{a="b",c="d"} -3e4
+`, &ScrapeWork{
+		Labels:               newTestLabels(`job="xx"`),
+		MetricRelabelConfigs: mustParseRelabelConfigs(`[{"action":"drop","source_labels":["__name__"],"regex":"foo"},{"action":"labeldrop","regex":"c"}]`),
+	}, `
+bar{a="b",job="xx"} -3e4 123000
+up{job="xx"} 1 123000
+scrape_samples_scraped{job="xx"} 2 123000
+scrape_duration_seconds{job="xx"} 0 123000
+scrape_samples_post_metric_relabeling{job="xx"} 1 123000
+`)
+}
+
+func TestScrapeWorkMetricRelabelSamplesDropped(t *testing.T) {
+	sw := &scrapeWork{
+		Config: ScrapeWork{
+			JobName:              "TestScrapeWorkMetricRelabelSamplesDropped",
+			Labels:               newTestLabels(`job="xx"`),
+			MetricRelabelConfigs: mustParseRelabelConfigs(`[{"action":"keep","source_labels":["__name__","a"],"regex":"foo;.+|bar;b"}]`),
+		},
+	}
+	sw.ReadData = func(dst []byte) ([]byte, error) {
+		return append(dst, "foo{a=\"x\"} 1\nfoo 2\nbar{a=\"b\"} 3\nbar{a=\"c\"} 4\nbaz 5\n"...), nil
+	}
+	sw.PushData = func(wr *prompb.WriteRequest) {}
+	f := func(nExpected uint64) {
+		t.Helper()
+		if err := sw.scrapeInternal(time.Unix(123, 0)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n := sw.getSamplesDroppedCounter().Get(); n != nExpected {
+			t.Fatalf("unexpected number of dropped samples; got %d; want %d", n, nExpected)
+		}
+	}
+	f(3)
+	f(6)
+}
+
+func TestScrapeWorkSendStaleMarkers(t *testing.T) {
+	sw := &scrapeWork{
+		Config: ScrapeWork{
+			Labels: newTestLabels(`job="xx"`),
+		},
+	}
+	sw.ReadData = func(dst []byte) ([]byte, error) {
+		return append(dst, "foo{bar=\"baz\"} 12\n"...), nil
+	}
+	sw.PushData = func(wr *prompb.WriteRequest) {}
+	if err := sw.scrapeInternal(time.Unix(123, 0)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var names []string
+	sw.PushData = func(wr *prompb.WriteRequest) {
+		for _, ts := range wr.Timeseries {
+			for _, s := range ts.Samples {
+				if !decimal.IsStaleNaN(s.Value) {
+					t.Fatalf("expecting staleness mark for %s; got %v", labelsToString(ts.Labels), s.Value)
+				}
+				if s.Timestamp != 456000 {
+					t.Fatalf("unexpected timestamp for %s; got %d; want %d", labelsToString(ts.Labels), s.Timestamp, 456000)
+				}
+			}
+			names = append(names, labelsToString(ts.Labels))
+		}
+	}
+	sw.sendStaleMarkers(time.Unix(456, 0))
+	namesExpected := []string{
+		`foo{bar="baz",job="xx"}`,
+		`up{job="xx"}`,
+		`scrape_duration_seconds{job="xx"}`,
+		`scrape_samples_scraped{job="xx"}`,
+		`scrape_samples_post_metric_relabeling{job="xx"}`,
+	}
+	if strings.Join(names, "\n") != strings.Join(namesExpected, "\n") {
+		t.Fatalf("unexpected series with staleness marks;\ngot\n%s\nwant\n%s", strings.Join(names, "\n"), strings.Join(namesExpected, "\n"))
+	}
+}
+
+func newTestLabels(s string) []prompb.Label {
+	var labels []prompb.Label
+	if len(s) == 0 {
+		return labels
+	}
+	for _, kv := range strings.Split(s, ",") {
+		n := strings.IndexByte(kv, '=')
+		labels = append(labels, prompb.Label{
+			Name:  []byte(kv[:n]),
+			Value: []byte(strings.Trim(kv[n+1:], `"`)),
+		})
+	}
+	return labels
+}
+
+func mustParseRelabelConfigs(s string) []promrelabel.ParsedRelabelConfig {
+	rcs, err := promrelabel.ParseRelabelConfigsData([]byte(s))
+	if err != nil {
+		panic(fmt.Errorf("cannot parse %q: %s", s, err))
+	}
+	return rcs
+}
+
+// expectEqualTimeseries verifies whether tss match data in Prometheus text exposition format.
+//
+// The order of series is ignored, while scrape_duration_seconds values are skipped,
+// since they depend on the scrape duration.
+func expectEqualTimeseries(tss []prompb.TimeSeries, data string) error {
+	var sw scrapeWork
+	if err := sw.rows.Unmarshal(data, false); err != nil {
+		return fmt.Errorf("cannot parse expected data: %s", err)
+	}
+	m := make(map[string]string, len(sw.rows.Rows))
+	for _, r := range sw.rows.Rows {
+		sw.addRow(&r, 0)
+		ts := &sw.wr.Timeseries[len(sw.wr.Timeseries)-1]
+		ts.Samples[0].Timestamp = r.Timestamp
+		m[labelsToString(ts.Labels)] = sampleToString(r.Metric, ts.Samples[0])
+	}
+	if len(tss) != len(m) {
+		return fmt.Errorf("unexpected number of series; got %d; want %d", len(tss), len(m))
+	}
+	for _, ts := range tss {
+		key := labelsToString(ts.Labels)
+		sExpected, ok := m[key]
+		if !ok {
+			return fmt.Errorf("unexpected series %s", key)
+		}
+		if len(ts.Samples) != 1 {
+			return fmt.Errorf("unexpected number of samples for %s; got %d; want 1", key, len(ts.Samples))
+		}
+		if s := sampleToString(string(ts.Labels[0].Value), ts.Samples[0]); s != sExpected {
+			return fmt.Errorf("unexpected sample for %s; got %s; want %s", key, s, sExpected)
+		}
+	}
+	return nil
+}
+
+func sampleToString(name string, s prompb.Sample) string {
+	if name == "scrape_duration_seconds" || math.IsNaN(s.Value) {
+		return fmt.Sprintf("%d", s.Timestamp)
+	}
+	return fmt.Sprintf("%g %d", s.Value, s.Timestamp)
+}
+
+func labelsToString(labels []prompb.Label) string {
+	var name string
+	var a []string
+	for _, label := range labels {
+		if string(label.Name) == "__name__" {
+			name = string(label.Value)
+			continue
+		}
+		a = append(a, fmt.Sprintf("%s=%q", label.Name, label.Value))
+	}
+	return name + "{" + strings.Join(a, ",") + "}"
+}
+
+func timeseriesToString(tss []prompb.TimeSeries) string {
+	var a []string
+	for _, ts := range tss {
+		a = append(a, fmt.Sprintf("%s %v", labelsToString(ts.Labels), ts.Samples))
+	}
+	return strings.Join(a, "\n")
+}
+
+func TestScrapeWorkPushMetadata(t *testing.T) {
+	sw := &scrapeWork{
+		Config: ScrapeWork{
+			Labels: newTestLabels(`instance="host:80",job="xx"`),
+		},
+	}
+	sw.ReadData = func(dst []byte) ([]byte, error) {
+		return append(dst, "# HELP foo Foo help\n# TYPE foo counter\nfoo 12\nbar 3\n"...), nil
+	}
+	sw.PushData = func(wr *prompb.WriteRequest) {}
+	var targets [][]metricsmetadata.Label
+	var rows []metricsmetadata.Row
+	sw.PushMetadata = func(target []metricsmetadata.Label, rs []metricsmetadata.Row) {
+		targets = append(targets, target)
+		rows = append(rows, rs...)
+	}
+	if err := sw.scrapeInternal(time.Unix(123, 0)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	targetsExpected := [][]metricsmetadata.Label{{
+		{Name: "instance", Value: "host:80"},
+		{Name: "job", Value: "xx"},
+	}}
+	if !reflect.DeepEqual(targets, targetsExpected) {
+		t.Fatalf("unexpected targets;\ngot\n%+v\nwant\n%+v", targets, targetsExpected)
+	}
+	rowsExpected := []metricsmetadata.Row{{
+		MetricFamilyName: "foo",
+		Type:             "counter",
+		Help:             "Foo help",
+	}}
+	if !reflect.DeepEqual(rows, rowsExpected) {
+		t.Fatalf("unexpected metadata;\ngot\n%+v\nwant\n%+v", rows, rowsExpected)
+	}
+}
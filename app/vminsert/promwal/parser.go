@@ -0,0 +1,616 @@
+package promwal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/golang/snappy"
+)
+
+// Prometheus WAL segments consist of pages. Every page contains fragments of records.
+//
+// See https://github.com/prometheus/prometheus/blob/main/tsdb/docs/format/wal.md
+const (
+	pageSize         = 32 * 1024
+	recordHeaderSize = 7
+)
+
+// Fragment types stored in the lower bits of the first byte of fragment header.
+const (
+	fragmentPageTerm = 0
+	fragmentFull     = 1
+	fragmentFirst    = 2
+	fragmentMiddle   = 3
+	fragmentLast     = 4
+
+	fragmentTypeMask = 0x07
+	snappyMask       = 0x08
+	zstdMask         = 0x10
+)
+
+// Record types.
+//
+// See https://github.com/prometheus/prometheus/blob/main/tsdb/record/record.go
+const (
+	recordSeries                = 1
+	recordSamples               = 2
+	recordTombstones            = 3
+	recordHistogramSamples      = 7
+	recordFloatHistogramSamples = 8
+)
+
+const checkpointPrefix = "checkpoint."
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// getSegments returns paths to segments for the WAL at dir in the order they must be read.
+//
+// Segments from the last checkpoint are returned first. They are followed by segments,
+// which aren't covered by the checkpoint.
+func getSegments(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Prometheus WAL directory: %s", err)
+	}
+	checkpointDir := ""
+	checkpointIndex := -1
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() || !strings.HasPrefix(name, checkpointPrefix) {
+			continue
+		}
+		// Incomplete checkpoints have .tmp suffix, so they are skipped here.
+		n, err := strconv.Atoi(name[len(checkpointPrefix):])
+		if err != nil {
+			continue
+		}
+		if n > checkpointIndex {
+			checkpointDir = filepath.Join(dir, name)
+			checkpointIndex = n
+		}
+	}
+	var segments []string
+	if checkpointIndex >= 0 {
+		checkpointSegments, err := listSegments(checkpointDir, -1)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, checkpointSegments...)
+	}
+	walSegments, err := listSegments(dir, checkpointIndex)
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, walSegments...)
+	return segments, nil
+}
+
+// listSegments returns sorted paths to segments at dir with indexes bigger than minIndex.
+func listSegments(dir string, minIndex int) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory with Prometheus WAL segments: %s", err)
+	}
+	type segment struct {
+		path  string
+		index int
+	}
+	var segments []segment
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		n, err := strconv.Atoi(fi.Name())
+		if err != nil || n <= minIndex {
+			continue
+		}
+		segments = append(segments, segment{
+			path:  filepath.Join(dir, fi.Name()),
+			index: n,
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].index < segments[j].index
+	})
+	paths := make([]string, len(segments))
+	for i, s := range segments {
+		paths[i] = s.path
+	}
+	return paths, nil
+}
+
+// row is a sample with series labels.
+type row struct {
+	labels    []prompb.Label
+	timestamp int64
+	value     float64
+}
+
+// walStats contains stats for the WAL read by readWAL.
+type walStats struct {
+	segments int
+	series   int
+	rows     int
+
+	// deletedSamples is the number of samples skipped because of tombstones.
+	deletedSamples int
+
+	// unknownSeriesSamples is the number of samples skipped because of missing Series record.
+	unknownSeriesSamples int
+
+	// histogramRecords is the number of skipped records with native histograms.
+	histogramRecords int
+
+	// importedRecords is the number of skipped records, which have been imported before the start position.
+	importedRecords int
+}
+
+// walPosition is a position in Prometheus WAL.
+type walPosition struct {
+	// Segment is the path to the segment relative to the WAL directory.
+	Segment string `json:"segment"`
+
+	// Offset is the offset in the segment after the last read record.
+	Offset int `json:"offset"`
+}
+
+// readWAL calls f for samples from Prometheus WAL at dir, which are located after the start position.
+//
+// f is called with the position after the record containing the passed rows.
+// Zero start position means reading the WAL from the beginning.
+//
+// The WAL is read in two passes. The first pass collects series and tombstones, so the second pass
+// could skip samples for unknown series and samples deleted via tombstones.
+func readWAL(dir string, start walPosition, f func(rows []row, pos walPosition) error) (*walStats, error) {
+	segments, err := getSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("cannot find Prometheus WAL segments at %q", dir)
+	}
+	startIdx := 0
+	if len(start.Segment) > 0 {
+		startIdx = -1
+		for i, path := range segments {
+			if relativeSegmentPath(dir, path) == start.Segment {
+				startIdx = i
+				break
+			}
+		}
+		if startIdx < 0 {
+			return nil, fmt.Errorf("cannot find segment %q, which was imported last time, in Prometheus WAL at %q; "+
+				"the WAL has been truncated by Prometheus after the previous import, so it cannot be resumed without duplicate samples", start.Segment, dir)
+		}
+	}
+	var ws walStats
+	ws.segments = len(segments)
+
+	logger.Infof("reading series and tombstones from %d Prometheus WAL segments at %q", len(segments), dir)
+	seriesByRef := make(map[uint64][]prompb.Label)
+	tombstonesByRef := make(map[uint64][]tombstone)
+	var seriesBuf []series
+	var tombstonesBuf []tombstone
+	var rr recordReader
+	for _, path := range segments {
+		err := rr.readSegment(path, func(rec []byte, off int) error {
+			var err error
+			switch rec[0] {
+			case recordSeries:
+				seriesBuf, err = unmarshalSeries(seriesBuf[:0], rec)
+				for _, s := range seriesBuf {
+					seriesByRef[s.ref] = s.labels
+				}
+			case recordTombstones:
+				tombstonesBuf, err = unmarshalTombstones(tombstonesBuf[:0], rec)
+				for _, t := range tombstonesBuf {
+					tombstonesByRef[t.ref] = append(tombstonesByRef[t.ref], t)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("error in Prometheus WAL segment %q: %s", path, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	ws.series = len(seriesByRef)
+	logger.Infof("found %d series and tombstones for %d series in Prometheus WAL at %q", len(seriesByRef), len(tombstonesByRef), dir)
+
+	var samples []sample
+	var rows []row
+	rr = recordReader{}
+	for i, path := range segments {
+		if i < startIdx {
+			logger.Infof("skipping Prometheus WAL segment %q (%d of %d), since it has been already imported", path, i+1, len(segments))
+			continue
+		}
+		segment := relativeSegmentPath(dir, path)
+		minOffset := 0
+		if segment == start.Segment {
+			minOffset = start.Offset
+		}
+		rowsStart := ws.rows
+		err := rr.readSegment(path, func(rec []byte, off int) error {
+			if off <= minOffset {
+				ws.importedRecords++
+				return nil
+			}
+			switch rec[0] {
+			case recordSamples:
+			case recordHistogramSamples, recordFloatHistogramSamples:
+				ws.histogramRecords++
+				return nil
+			default:
+				return nil
+			}
+			var err error
+			samples, err = unmarshalSamples(samples[:0], rec)
+			if err != nil {
+				return fmt.Errorf("error in Prometheus WAL segment %q: %s", path, err)
+			}
+			rows = rows[:0]
+			for _, s := range samples {
+				labels, ok := seriesByRef[s.ref]
+				if !ok {
+					ws.unknownSeriesSamples++
+					continue
+				}
+				if isDeleted(tombstonesByRef[s.ref], s.timestamp) {
+					ws.deletedSamples++
+					continue
+				}
+				rows = append(rows, row{
+					labels:    labels,
+					timestamp: s.timestamp,
+					value:     s.value,
+				})
+			}
+			if len(rows) == 0 {
+				return nil
+			}
+			ws.rows += len(rows)
+			return f(rows, walPosition{
+				Segment: segment,
+				Offset:  off,
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("read %d samples from Prometheus WAL segment %q (%d of %d)", ws.rows-rowsStart, path, i+1, len(segments))
+	}
+	return &ws, nil
+}
+
+// relativeSegmentPath returns the path to the segment at path relative to the WAL directory at dir.
+func relativeSegmentPath(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		logger.Panicf("BUG: segment %q must be located inside Prometheus WAL directory %q: %s", path, dir, err)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func isDeleted(tombstones []tombstone, timestamp int64) bool {
+	for _, t := range tombstones {
+		if timestamp >= t.minTimestamp && timestamp <= t.maxTimestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// recordReader reads records from Prometheus WAL segments.
+//
+// Records may span page boundaries, but they never span segment boundaries,
+// since Prometheus starts a new segment for a record, which doesn't fit the current segment.
+type recordReader struct {
+	// rec contains fragments for the currently assembled record.
+	rec []byte
+
+	// pending is set if rec contains incomplete record.
+	pending bool
+
+	// flags contains the header of the first fragment for the currently assembled record.
+	flags byte
+
+	buf []byte
+}
+
+// readSegment calls f for every record in the segment at path with the offset after the record.
+//
+// The rest of the segment is skipped on torn or corrupted data, since Prometheus drops such data on startup too.
+func (rr *recordReader) readSegment(path string, f func(rec []byte, off int) error) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read Prometheus WAL segment: %s", err)
+	}
+	rr.rec = rr.rec[:0]
+	rr.pending = false
+	off := 0
+	for off < len(data) {
+		pageRemaining := pageSize - off%pageSize
+		flags := data[off]
+		if flags == fragmentPageTerm {
+			// The rest of the page must be padded with zeros.
+			end := off + pageRemaining
+			if end > len(data) {
+				end = len(data)
+			}
+			if !isZeros(data[off:end]) {
+				rr.skipSegmentTail(path, off, "non-zero page padding")
+				return nil
+			}
+			off = end
+			continue
+		}
+		if pageRemaining < recordHeaderSize {
+			rr.skipSegmentTail(path, off, "fragment header crosses page boundary")
+			return nil
+		}
+		if len(data)-off < recordHeaderSize {
+			rr.skipSegmentTail(path, off, "torn fragment header")
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[off+1:]))
+		crc := binary.BigEndian.Uint32(data[off+3:])
+		if recordHeaderSize+length > pageRemaining {
+			rr.skipSegmentTail(path, off, "fragment crosses page boundary")
+			return nil
+		}
+		if recordHeaderSize+length > len(data)-off {
+			rr.skipSegmentTail(path, off, "torn fragment")
+			return nil
+		}
+		fragment := data[off+recordHeaderSize : off+recordHeaderSize+length]
+		if c := crc32.Checksum(fragment, castagnoliTable); c != crc {
+			rr.skipSegmentTail(path, off, fmt.Sprintf("checksum mismatch; got %08X; want %08X", c, crc))
+			return nil
+		}
+
+		switch flags & fragmentTypeMask {
+		case fragmentFull, fragmentFirst:
+			if rr.pending {
+				logger.Errorf("dropping incomplete record before offset %d in Prometheus WAL segment %q", off, path)
+			}
+			rr.rec = append(rr.rec[:0], fragment...)
+			rr.flags = flags
+			rr.pending = true
+		case fragmentMiddle, fragmentLast:
+			if !rr.pending {
+				rr.skipSegmentTail(path, off, "missing the first fragment for the record")
+				return nil
+			}
+			rr.rec = append(rr.rec, fragment...)
+		default:
+			rr.skipSegmentTail(path, off, fmt.Sprintf("unexpected fragment type %d", flags&fragmentTypeMask))
+			return nil
+		}
+		off += recordHeaderSize + length
+		if typ := flags & fragmentTypeMask; typ == fragmentFirst || typ == fragmentMiddle {
+			continue
+		}
+
+		rr.pending = false
+		rec, err := rr.decompress()
+		if err != nil {
+			logger.Errorf("skipping record before offset %d in Prometheus WAL segment %q: %s", off, path, err)
+			continue
+		}
+		if len(rec) == 0 {
+			continue
+		}
+		if err := f(rec, off); err != nil {
+			return err
+		}
+	}
+	if rr.pending {
+		logger.Errorf("dropping incomplete record at the end of Prometheus WAL segment %q", path)
+		rr.rec = rr.rec[:0]
+		rr.pending = false
+	}
+	return nil
+}
+
+func (rr *recordReader) decompress() ([]byte, error) {
+	var err error
+	switch {
+	case rr.flags&snappyMask != 0:
+		rr.buf, err = snappy.Decode(rr.buf[:cap(rr.buf)], rr.rec)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress snappy-compressed record: %s", err)
+		}
+		return rr.buf, nil
+	case rr.flags&zstdMask != 0:
+		rr.buf, err = encoding.DecompressZSTD(rr.buf[:0], rr.rec)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress zstd-compressed record: %s", err)
+		}
+		return rr.buf, nil
+	default:
+		return rr.rec, nil
+	}
+}
+
+func (rr *recordReader) skipSegmentTail(path string, off int, reason string) {
+	logger.Errorf("skipping the rest of Prometheus WAL segment %q starting at offset %d: %s", path, off, reason)
+	rr.rec = rr.rec[:0]
+	rr.pending = false
+}
+
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// series is a series from Series record.
+type series struct {
+	ref    uint64
+	labels []prompb.Label
+}
+
+// unmarshalSeries appends series from Series record rec to dst and returns the result.
+//
+// The returned labels don't refer to rec.
+func unmarshalSeries(dst []series, rec []byte) ([]series, error) {
+	d := decoder{b: rec[1:]}
+	for len(d.b) > 0 && d.err == nil {
+		ref := d.be64()
+		labelsLen := d.uvarint()
+		if d.err == nil && labelsLen > uint64(len(d.b)) {
+			return dst, fmt.Errorf("too many labels in series with ref %d: %d", ref, labelsLen)
+		}
+		labels := make([]prompb.Label, 0, labelsLen)
+		for i := uint64(0); i < labelsLen && d.err == nil; i++ {
+			name := d.uvarintBytes()
+			value := d.uvarintBytes()
+			labels = append(labels, prompb.Label{
+				Name:  append([]byte{}, name...),
+				Value: append([]byte{}, value...),
+			})
+		}
+		dst = append(dst, series{
+			ref:    ref,
+			labels: labels,
+		})
+	}
+	if d.err != nil {
+		return dst, fmt.Errorf("cannot unmarshal Series record: %s", d.err)
+	}
+	return dst, nil
+}
+
+// sample is a sample from Samples record.
+type sample struct {
+	ref       uint64
+	timestamp int64
+	value     float64
+}
+
+// unmarshalSamples appends samples from Samples record rec to dst and returns the result.
+func unmarshalSamples(dst []sample, rec []byte) ([]sample, error) {
+	d := decoder{b: rec[1:]}
+	if len(d.b) == 0 {
+		return dst, nil
+	}
+	baseRef := d.be64()
+	baseTimestamp := int64(d.be64())
+	for len(d.b) > 0 && d.err == nil {
+		dRef := d.varint()
+		dTimestamp := d.varint()
+		value := d.be64()
+		dst = append(dst, sample{
+			ref:       uint64(int64(baseRef) + dRef),
+			timestamp: baseTimestamp + dTimestamp,
+			value:     math.Float64frombits(value),
+		})
+	}
+	if d.err != nil {
+		return dst, fmt.Errorf("cannot unmarshal Samples record: %s", d.err)
+	}
+	return dst, nil
+}
+
+// tombstone marks samples in the time range [minTimestamp ... maxTimestamp] for series with the given ref as deleted.
+type tombstone struct {
+	ref          uint64
+	minTimestamp int64
+	maxTimestamp int64
+}
+
+// unmarshalTombstones appends tombstones from Tombstones record rec to dst and returns the result.
+func unmarshalTombstones(dst []tombstone, rec []byte) ([]tombstone, error) {
+	d := decoder{b: rec[1:]}
+	for len(d.b) > 0 && d.err == nil {
+		ref := d.be64()
+		minTimestamp := d.varint()
+		maxTimestamp := d.varint()
+		dst = append(dst, tombstone{
+			ref:          ref,
+			minTimestamp: minTimestamp,
+			maxTimestamp: maxTimestamp,
+		})
+	}
+	if d.err != nil {
+		return dst, fmt.Errorf("cannot unmarshal Tombstones record: %s", d.err)
+	}
+	return dst, nil
+}
+
+// decoder decodes values encoded by Prometheus WAL records.
+//
+// The first error is stored in err. Subsequent calls return zero values after the error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) be64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = fmt.Errorf("too short buffer for uint64; got %d bytes", len(d.b))
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("cannot unmarshal uvarint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("cannot unmarshal varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uvarintBytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = fmt.Errorf("too short buffer for string with length %d; got %d bytes", n, len(d.b))
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
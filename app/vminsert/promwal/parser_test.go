@@ -0,0 +1,410 @@
+package promwal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/golang/snappy"
+)
+
+// testWALWriter writes records in Prometheus WAL format.
+type testWALWriter struct {
+	data []byte
+}
+
+func (w *testWALWriter) writeRecord(rec []byte, compress bool) {
+	var flags byte
+	if compress {
+		rec = snappy.Encode(nil, rec)
+		flags = snappyMask
+	}
+	for i := 0; i == 0 || len(rec) > 0; i++ {
+		pageRemaining := pageSize - len(w.data)%pageSize
+		if pageRemaining <= recordHeaderSize {
+			w.padPage()
+			pageRemaining = pageSize
+		}
+		n := pageRemaining - recordHeaderSize
+		if n > len(rec) {
+			n = len(rec)
+		}
+		fragment := rec[:n]
+		rec = rec[n:]
+		typ := byte(fragmentMiddle)
+		switch {
+		case i == 0 && len(rec) == 0:
+			typ = fragmentFull
+		case i == 0:
+			typ = fragmentFirst
+		case len(rec) == 0:
+			typ = fragmentLast
+		}
+		w.data = append(w.data, typ|flags)
+		w.data = appendBE16(w.data, uint16(len(fragment)))
+		w.data = appendBE32(w.data, crc32.Checksum(fragment, castagnoliTable))
+		w.data = append(w.data, fragment...)
+	}
+}
+
+func (w *testWALWriter) padPage() {
+	if n := len(w.data) % pageSize; n > 0 {
+		w.data = append(w.data, make([]byte, pageSize-n)...)
+	}
+}
+
+func appendBE16(dst []byte, v uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return append(dst, b[:]...)
+}
+
+func appendBE32(dst []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(dst, b[:]...)
+}
+
+func appendBE64(dst []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(dst, b[:]...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(dst, b[:n]...)
+}
+
+func appendVarint(dst []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	return append(dst, b[:n]...)
+}
+
+func marshalTestSeries(ref uint64, labels ...string) []byte {
+	rec := []byte{recordSeries}
+	rec = appendBE64(rec, ref)
+	rec = appendUvarint(rec, uint64(len(labels)/2))
+	for _, s := range labels {
+		rec = appendUvarint(rec, uint64(len(s)))
+		rec = append(rec, s...)
+	}
+	return rec
+}
+
+func marshalTestSamples(samples ...sample) []byte {
+	rec := []byte{recordSamples}
+	if len(samples) == 0 {
+		return rec
+	}
+	baseRef := samples[0].ref
+	baseTimestamp := samples[0].timestamp
+	rec = appendBE64(rec, baseRef)
+	rec = appendBE64(rec, uint64(baseTimestamp))
+	for _, s := range samples {
+		rec = appendVarint(rec, int64(s.ref)-int64(baseRef))
+		rec = appendVarint(rec, s.timestamp-baseTimestamp)
+		rec = appendBE64(rec, math.Float64bits(s.value))
+	}
+	return rec
+}
+
+func marshalTestTombstones(tombstones ...tombstone) []byte {
+	rec := []byte{recordTombstones}
+	for _, t := range tombstones {
+		rec = appendBE64(rec, t.ref)
+		rec = appendVarint(rec, t.minTimestamp)
+		rec = appendVarint(rec, t.maxTimestamp)
+	}
+	return rec
+}
+
+func writeTestSegment(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("cannot create directory for %q: %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+}
+
+func TestUnmarshalRecords(t *testing.T) {
+	ss, err := unmarshalSeries(nil, append(marshalTestSeries(1, "__name__", "foo", "job", "bar"), marshalTestSeries(5)[1:]...))
+	if err != nil {
+		t.Fatalf("cannot unmarshal series: %s", err)
+	}
+	if len(ss) != 2 || ss[0].ref != 1 || ss[1].ref != 5 || len(ss[1].labels) != 0 {
+		t.Fatalf("unexpected series: %+v", ss)
+	}
+	if labelsString(ss[0].labels) != `{__name__="foo",job="bar"}` {
+		t.Fatalf("unexpected labels: %s", labelsString(ss[0].labels))
+	}
+
+	samplesExpected := []sample{
+		{ref: 10, timestamp: 1000, value: 1.5},
+		{ref: 3, timestamp: 900, value: -2},
+		{ref: 12, timestamp: 2000, value: math.Inf(1)},
+	}
+	samples, err := unmarshalSamples(nil, marshalTestSamples(samplesExpected...))
+	if err != nil {
+		t.Fatalf("cannot unmarshal samples: %s", err)
+	}
+	if !reflect.DeepEqual(samples, samplesExpected) {
+		t.Fatalf("unexpected samples;\ngot\n%+v\nwant\n%+v", samples, samplesExpected)
+	}
+	samples, err = unmarshalSamples(nil, marshalTestSamples())
+	if err != nil || len(samples) != 0 {
+		t.Fatalf("unexpected result for empty Samples record; samples=%+v, err=%v", samples, err)
+	}
+
+	tombstonesExpected := []tombstone{
+		{ref: 1, minTimestamp: math.MinInt64, maxTimestamp: math.MaxInt64},
+		{ref: 2, minTimestamp: -10, maxTimestamp: 20},
+	}
+	tombstones, err := unmarshalTombstones(nil, marshalTestTombstones(tombstonesExpected...))
+	if err != nil {
+		t.Fatalf("cannot unmarshal tombstones: %s", err)
+	}
+	if !reflect.DeepEqual(tombstones, tombstonesExpected) {
+		t.Fatalf("unexpected tombstones;\ngot\n%+v\nwant\n%+v", tombstones, tombstonesExpected)
+	}
+
+	// Truncated records must be rejected.
+	rec := marshalTestSeries(1, "__name__", "foo")
+	if _, err := unmarshalSeries(nil, rec[:len(rec)-1]); err == nil {
+		t.Fatalf("expecting non-nil error for truncated Series record")
+	}
+	rec = marshalTestSamples(samplesExpected...)
+	if _, err := unmarshalSamples(nil, rec[:len(rec)-1]); err == nil {
+		t.Fatalf("expecting non-nil error for truncated Samples record")
+	}
+	rec = marshalTestTombstones(tombstonesExpected...)
+	if _, err := unmarshalTombstones(nil, rec[:len(rec)-1]); err == nil {
+		t.Fatalf("expecting non-nil error for truncated Tombstones record")
+	}
+}
+
+func TestRecordReader(t *testing.T) {
+	path := "TestRecordReader"
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	// Records bigger than a page must be split into fragments.
+	var recs [][]byte
+	for i, n := range []int{10, pageSize, 3 * pageSize, 0, pageSize - 2*recordHeaderSize, 100} {
+		rec := make([]byte, n+1)
+		for j := range rec {
+			rec[j] = byte(i + j)
+		}
+		recs = append(recs, rec)
+	}
+	var w testWALWriter
+	for i, rec := range recs {
+		w.writeRecord(rec, i%2 == 1)
+	}
+	f := func(segments [][]byte, recsExpected [][]byte) {
+		t.Helper()
+		var rr recordReader
+		var recsRead [][]byte
+		for i, data := range segments {
+			segmentPath := filepath.Join(path, fmt.Sprintf("%08d", i))
+			writeTestSegment(t, segmentPath, data)
+			err := rr.readSegment(segmentPath, func(rec []byte, off int) error {
+				recsRead = append(recsRead, append([]byte{}, rec...))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if len(recsRead) != len(recsExpected) {
+			t.Fatalf("unexpected number of records read; got %d; want %d", len(recsRead), len(recsExpected))
+		}
+		for i := range recsRead {
+			if string(recsRead[i]) != string(recsExpected[i]) {
+				t.Fatalf("unexpected record #%d; got %d bytes; want %d bytes", i, len(recsRead[i]), len(recsExpected[i]))
+			}
+		}
+	}
+	f([][]byte{w.data}, recs)
+
+	// Records never span segment boundaries, so the record split between segments must be dropped
+	// together with the rest of the next segment.
+	f([][]byte{w.data[:2*pageSize], w.data[2*pageSize:]}, recs[:2])
+
+	// Torn record at the end of the segment must be skipped.
+	f([][]byte{w.data[:len(w.data)-50]}, recs[:len(recs)-1])
+
+	// Corrupted data must be skipped until the end of the segment.
+	data := append([]byte{}, w.data...)
+	data[recordHeaderSize+5]++
+	f([][]byte{data}, nil)
+	data = append([]byte{}, w.data...)
+	data[len(data)-10]++
+	f([][]byte{data}, recs[:len(recs)-1])
+
+	// The next segment must be read after the corrupted segment.
+	var wNext testWALWriter
+	wNext.writeRecord(recs[0], false)
+	f([][]byte{data, wNext.data}, append(recs[:len(recs)-1:len(recs)-1], recs[0]))
+
+	// Incomplete record at the end of the segment must be dropped if the next segment starts with a new record.
+	f([][]byte{w.data[:2*pageSize], wNext.data}, append(recs[:2:2], recs[0]))
+}
+
+func TestReadWAL(t *testing.T) {
+	path := "TestReadWAL"
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	// The checkpoint contains series and samples from segments 0 and 1.
+	var w testWALWriter
+	w.writeRecord(marshalTestSeries(1, "__name__", "foo", "instance", "a"), false)
+	w.writeRecord(marshalTestSeries(2, "__name__", "foo", "instance", "b"), true)
+	w.writeRecord(marshalTestSamples(sample{ref: 1, timestamp: 1000, value: 1}, sample{ref: 2, timestamp: 1000, value: 10}), false)
+	writeTestSegment(t, filepath.Join(path, "checkpoint.00000001", "00000000"), w.data)
+
+	// Segments covered by the checkpoint and incomplete checkpoints must be ignored.
+	w = testWALWriter{}
+	w.writeRecord(marshalTestSeries(1, "__name__", "ignored"), false)
+	w.writeRecord(marshalTestSamples(sample{ref: 1, timestamp: 500, value: 123}), false)
+	writeTestSegment(t, filepath.Join(path, "00000000"), w.data)
+	writeTestSegment(t, filepath.Join(path, "00000001"), w.data)
+	writeTestSegment(t, filepath.Join(path, "checkpoint.00000002.tmp", "00000000"), w.data)
+
+	// Samples for series 2 must be deleted since 3000 by tombstones,
+	// while all the samples for series 3 must be deleted.
+	w = testWALWriter{}
+	w.writeRecord(marshalTestSeries(3, "__name__", "bar"), false)
+	w.writeRecord(marshalTestSamples(sample{ref: 2, timestamp: 2000, value: 20}, sample{ref: 3, timestamp: 2000, value: 5}), false)
+	w.writeRecord(marshalTestTombstones(tombstone{ref: 2, minTimestamp: 3000, maxTimestamp: math.MaxInt64}), false)
+	w.writeRecord(marshalTestTombstones(tombstone{ref: 3, minTimestamp: math.MinInt64, maxTimestamp: math.MaxInt64}), false)
+	writeTestSegment(t, filepath.Join(path, "00000002"), w.data)
+
+	// Big record spans pages in segment 3. It contains samples for unknown series 42.
+	w = testWALWriter{}
+	var samples []sample
+	for i := 0; i < 5000; i++ {
+		samples = append(samples, sample{ref: 1, timestamp: int64(10000 + i*1000), value: float64(i)})
+	}
+	samples = append(samples, sample{ref: 42, timestamp: 10000, value: 1}, sample{ref: 2, timestamp: 3000, value: 30})
+	w.writeRecord(marshalTestSamples(samples...), false)
+	w.writeRecord([]byte{recordHistogramSamples, 1, 2, 3}, false)
+	w.writeRecord(marshalTestSamples(sample{ref: 2, timestamp: 2500, value: 25}), true)
+	writeTestSegment(t, filepath.Join(path, "00000003"), w.data)
+
+	// Records never span segments, so the incomplete record at the end of segment 4
+	// and the rest of the record at the start of segment 5 must be dropped.
+	w = testWALWriter{}
+	w.writeRecord(marshalTestSamples(samples...), false)
+	writeTestSegment(t, filepath.Join(path, "00000004"), w.data[:pageSize])
+	writeTestSegment(t, filepath.Join(path, "00000005"), w.data[pageSize:])
+
+	// The last segment contains torn record.
+	w = testWALWriter{}
+	w.writeRecord(marshalTestSamples(sample{ref: 1, timestamp: 1e9, value: 1}), false)
+	writeTestSegment(t, filepath.Join(path, "00000006"), w.data[:len(w.data)-1])
+
+	var rows []string
+	var positions []walPosition
+	var positionRows []int
+	ws, err := readWAL(path, walPosition{}, func(rs []row, pos walPosition) error {
+		for _, r := range rs {
+			rows = append(rows, fmt.Sprintf("%s %v %d", labelsString(r.labels), r.value, r.timestamp))
+		}
+		positions = append(positions, pos)
+		positionRows = append(positionRows, len(rows))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rowsExpected := []string{
+		`{__name__="foo",instance="a"} 1 1000`,
+		`{__name__="foo",instance="b"} 10 1000`,
+		`{__name__="foo",instance="b"} 20 2000`,
+	}
+	for _, s := range samples[:5000] {
+		rowsExpected = append(rowsExpected, fmt.Sprintf(`{__name__="foo",instance="a"} %v %d`, s.value, s.timestamp))
+	}
+	rowsExpected = append(rowsExpected, `{__name__="foo",instance="b"} 25 2500`)
+	if len(rows) != len(rowsExpected) {
+		t.Fatalf("unexpected number of rows; got %d; want %d", len(rows), len(rowsExpected))
+	}
+	for i := range rows {
+		if rows[i] != rowsExpected[i] {
+			t.Fatalf("unexpected row #%d; got %s; want %s", i, rows[i], rowsExpected[i])
+		}
+	}
+	wsExpected := &walStats{
+		segments:             6,
+		series:               3,
+		rows:                 5004,
+		deletedSamples:       2,
+		unknownSeriesSamples: 1,
+		histogramRecords:     1,
+	}
+	if !reflect.DeepEqual(ws, wsExpected) {
+		t.Fatalf("unexpected stats;\ngot\n%+v\nwant\n%+v", ws, wsExpected)
+	}
+
+	// Reading from the position passed to f must return only the rows after it.
+	for i, pos := range positions {
+		var rowsNext []string
+		ws, err := readWAL(path, pos, func(rs []row, pos walPosition) error {
+			for _, r := range rs {
+				rowsNext = append(rowsNext, fmt.Sprintf("%s %v %d", labelsString(r.labels), r.value, r.timestamp))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error when reading from position %+v: %s", pos, err)
+		}
+		got := strings.Join(rowsNext, "\n")
+		want := strings.Join(rows[positionRows[i]:], "\n")
+		if got != want {
+			t.Fatalf("unexpected rows when reading from position %+v;\ngot\n%s\nwant\n%s", pos, got, want)
+		}
+		if ws.importedRecords == 0 {
+			t.Fatalf("expecting non-zero number of skipped records when reading from position %+v", pos)
+		}
+	}
+
+	// Missing segment from the position must result in error.
+	if _, err := readWAL(path, walPosition{Segment: "00000042"}, func(rs []row, pos walPosition) error { return nil }); err == nil {
+		t.Fatalf("expecting non-nil error for missing segment")
+	}
+
+	// Missing WAL must result in error.
+	if _, err := readWAL(path+"/missing", walPosition{}, func(rs []row, pos walPosition) error { return nil }); err == nil {
+		t.Fatalf("expecting non-nil error for missing WAL")
+	}
+}
+
+func labelsString(labels []prompb.Label) string {
+	s := "{"
+	for i, label := range labels {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("%s=%q", label.Name, label.Value)
+	}
+	return s + "}"
+}
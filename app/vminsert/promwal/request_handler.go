@@ -0,0 +1,223 @@
+package promwal
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+var rootDir = flag.String("import.prometheusWALRootDir", "", "The directory with Prometheus WAL directories, which may be imported via /api/v1/import/prometheus-wal. "+
+	"The `path` query arg must point to a directory inside it")
+
+var rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="promwal"}`)
+
+// InsertHandler imports samples from Prometheus WAL directory at the path from `path` query arg.
+//
+// The path must be located inside -import.prometheusWALRootDir. Prometheus mustn't write to the WAL during the import.
+//
+// The position of the last imported record is stored under -storageDataPath, so repeated import of the same WAL,
+// e.g. after a failure, imports only the samples, which weren't imported before.
+func InsertHandler(req *http.Request) error {
+	return concurrencylimiter.Do(func() error {
+		return insertHandlerInternal(req)
+	})
+}
+
+func insertHandlerInternal(req *http.Request) error {
+	if accountID := tenant.GetAccountID(req.Context()); len(accountID) > 0 {
+		return fmt.Errorf("Prometheus WAL cannot be imported by tenant %s", accountID)
+	}
+	dir, err := getWALDir(*rootDir, req.FormValue("path"))
+	if err != nil {
+		return err
+	}
+	if !startImport(dir) {
+		return fmt.Errorf("Prometheus WAL at %q is already being imported", dir)
+	}
+	defer finishImport(dir)
+
+	statePath := getImportStatePath(dir)
+	pos, err := readImportState(statePath)
+	if err != nil {
+		return err
+	}
+	startTime := time.Now()
+	if len(pos.Segment) > 0 {
+		logger.Infof("resuming the import of Prometheus WAL from %q after offset %d in segment %q; remove %q for importing the WAL from scratch",
+			dir, pos.Offset, pos.Segment, statePath)
+	} else {
+		logger.Infof("importing Prometheus WAL from %q", dir)
+	}
+	var ic common.InsertCtx
+	lastSaveTime := startTime
+	ws, err := readWAL(dir, pos, func(rows []row, rowsPos walPosition) error {
+		ic.Reset(len(rows))
+		for i := range rows {
+			r := &rows[i]
+			ic.WriteDataPoint(nil, r.labels, r.timestamp, r.value)
+		}
+		if err := ic.FlushBufs(); err != nil {
+			return err
+		}
+		rowsInserted.Add(len(rows))
+		pos = rowsPos
+		if time.Since(lastSaveTime) < importStateSaveInterval {
+			return nil
+		}
+		lastSaveTime = time.Now()
+		return writeImportState(statePath, dir, pos)
+	})
+	// Save the position for the successfully imported samples even on error, so the next import could resume from it.
+	if errSave := writeImportState(statePath, dir, pos); errSave != nil && err == nil {
+		err = errSave
+	}
+	if err != nil {
+		return fmt.Errorf("cannot import Prometheus WAL from %q: %s", dir, err)
+	}
+	logger.Infof("imported %d samples for %d series from %d Prometheus WAL segments at %q in %.3f seconds; "+
+		"skipped %d deleted samples, %d samples for unknown series, %d records with native histograms and %d records imported previously",
+		ws.rows, ws.series, ws.segments, dir, time.Since(startTime).Seconds(),
+		ws.deletedSamples, ws.unknownSeriesSamples, ws.histogramRecords, ws.importedRecords)
+	return nil
+}
+
+// importStateSaveInterval is the interval for saving the import position during the import.
+//
+// Samples imported during this interval may be imported again if VictoriaMetrics is stopped abruptly during the import.
+const importStateSaveInterval = time.Second
+
+var (
+	importsInProgress     = make(map[string]bool)
+	importsInProgressLock sync.Mutex
+)
+
+// startImport returns false if the WAL at dir is already being imported.
+func startImport(dir string) bool {
+	importsInProgressLock.Lock()
+	defer importsInProgressLock.Unlock()
+	if importsInProgress[dir] {
+		return false
+	}
+	importsInProgress[dir] = true
+	return true
+}
+
+func finishImport(dir string) {
+	importsInProgressLock.Lock()
+	delete(importsInProgress, dir)
+	importsInProgressLock.Unlock()
+}
+
+// importState is the state of the import for Prometheus WAL stored in a file under -storageDataPath.
+type importState struct {
+	// Dir is the WAL directory. It simplifies locating the file for the given WAL.
+	Dir string `json:"dir"`
+
+	// Position is the position after the last imported record.
+	Position walPosition `json:"position"`
+}
+
+// getImportStatePath returns the path to the file with import state for the WAL at dir.
+func getImportStatePath(dir string) string {
+	return filepath.Join(*vmstorage.DataPath, "promwal", fmt.Sprintf("%016X.json", xxhash.Sum64String(dir)))
+}
+
+// readImportState reads import position from the file at path.
+//
+// Zero position is returned if the file doesn't exist.
+func readImportState(path string) (walPosition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return walPosition{}, nil
+		}
+		return walPosition{}, fmt.Errorf("cannot read Prometheus WAL import state: %s", err)
+	}
+	var st importState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return walPosition{}, fmt.Errorf("cannot parse Prometheus WAL import state from %q: %s", path, err)
+	}
+	return st.Position, nil
+}
+
+// writeImportState atomically writes import position for the WAL at dir to the file at path.
+func writeImportState(path, dir string, pos walPosition) error {
+	if len(pos.Segment) == 0 {
+		// Nothing has been imported yet.
+		return nil
+	}
+	data, err := json.Marshal(&importState{
+		Dir:      dir,
+		Position: pos,
+	})
+	if err != nil {
+		logger.Panicf("BUG: cannot marshal Prometheus WAL import state: %s", err)
+	}
+	if err := fs.MkdirAllIfNotExist(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("cannot create directory for Prometheus WAL import state: %s", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return fmt.Errorf("cannot remove %q: %s", tmpPath, err)
+	}
+	if err := fs.WriteFile(tmpPath, data); err != nil {
+		return fmt.Errorf("cannot write Prometheus WAL import state: %s", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("cannot rename %q to %q: %s", tmpPath, path, err)
+	}
+	fs.MustSyncPath(filepath.Dir(path))
+	return nil
+}
+
+// getWALDir returns the absolute path for the given path, which must be located inside root.
+//
+// Relative path is resolved against root. Symlinks are resolved, so they cannot point outside root.
+func getWALDir(root, path string) (string, error) {
+	if len(root) == 0 {
+		return "", fmt.Errorf("-import.prometheusWALRootDir must be set for importing Prometheus WAL")
+	}
+	if len(path) == 0 {
+		return "", fmt.Errorf("missing `path` query arg with Prometheus WAL directory")
+	}
+	rootAbs, err := resolvePath(root)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve -import.prometheusWALRootDir=%q: %s", root, err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(rootAbs, path)
+	}
+	dir, err := resolvePath(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve path=%q: %s", path, err)
+	}
+	rel, err := filepath.Rel(rootAbs, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path=%q must be located inside -import.prometheusWALRootDir=%q", path, root)
+	}
+	return dir, nil
+}
+
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
@@ -0,0 +1,159 @@
+package promwal
+
+import (
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+)
+
+func TestGetWALDir(t *testing.T) {
+	path := "TestGetWALDir"
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+	for _, dir := range []string{path + "/root/prom/wal", path + "/other/wal"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("cannot create %q: %s", dir, err)
+		}
+	}
+	if err := os.Symlink("../other", path+"/root/link"); err != nil {
+		t.Fatalf("cannot create symlink: %s", err)
+	}
+	root := path + "/root"
+	rootAbs, err := filepath.Abs(root)
+	if err != nil {
+		t.Fatalf("cannot obtain absolute path for %q: %s", root, err)
+	}
+
+	f := func(walPath, dirExpected string) {
+		t.Helper()
+		dir, err := getWALDir(root, walPath)
+		if err != nil {
+			t.Fatalf("unexpected error for path=%q: %s", walPath, err)
+		}
+		if dir != dirExpected {
+			t.Fatalf("unexpected dir for path=%q; got %q; want %q", walPath, dir, dirExpected)
+		}
+	}
+	f("prom/wal", rootAbs+"/prom/wal")
+	f("prom/../prom/wal", rootAbs+"/prom/wal")
+	f(rootAbs+"/prom/wal", rootAbs+"/prom/wal")
+	f(".", rootAbs)
+
+	fError := func(root, walPath string) {
+		t.Helper()
+		if _, err := getWALDir(root, walPath); err == nil {
+			t.Fatalf("expecting non-nil error for root=%q, path=%q", root, walPath)
+		}
+	}
+	fError("", "prom/wal")
+	fError(root, "")
+	fError(root, "../other/wal")
+	fError(root, "link/wal")
+	fError(root, "/etc")
+	fError(root, "missing")
+}
+
+func TestInsertHandlerTenant(t *testing.T) {
+	r := httptest.NewRequest("POST", "/insert/1/api/v1/import/prometheus-wal?path=wal", nil)
+	r, err := tenant.NewRequest(r, "/insert/")
+	if err != nil {
+		t.Fatalf("cannot create tenant request: %s", err)
+	}
+	if err := insertHandlerInternal(r); err == nil {
+		t.Fatalf("expecting non-nil error for tenant request")
+	}
+}
+
+func TestInsertHandlerRepeatedImport(t *testing.T) {
+	path := "TestInsertHandlerRepeatedImport"
+	if err := flag.Set("storageDataPath", path+"/data"); err != nil {
+		t.Fatalf("cannot set storageDataPath: %s", err)
+	}
+	vmstorage.Init(func(mrs []storage.MetricRow) {})
+	defer func() {
+		vmstorage.Stop()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+	rootDirOrig := *rootDir
+	*rootDir = path
+	defer func() {
+		*rootDir = rootDirOrig
+	}()
+
+	ts := time.Now().Add(-time.Hour).UnixNano() / 1e6
+	var w testWALWriter
+	w.writeRecord(marshalTestSeries(1, "__name__", "foo"), false)
+	w.writeRecord(marshalTestSamples(sample{ref: 1, timestamp: ts, value: 1}), false)
+	w.writeRecord(marshalTestSamples(sample{ref: 1, timestamp: ts + 1000, value: 2}), false)
+	writeTestSegment(t, filepath.Join(path, "wal", "00000000"), w.data)
+
+	importWAL := func() {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/v1/import/prometheus-wal?path=wal", nil)
+		if err := insertHandlerInternal(r); err != nil {
+			t.Fatalf("cannot import WAL: %s", err)
+		}
+		vmstorage.Storage.DebugFlush()
+	}
+	// searchRows returns the number of stored rows for foo.
+	searchRows := func() int {
+		t.Helper()
+		tfs := storage.NewTagFilters()
+		if err := tfs.Add(nil, []byte("foo"), false, false); err != nil {
+			t.Fatalf("cannot add tag filter: %s", err)
+		}
+		tr := storage.TimeRange{
+			MinTimestamp: ts - 1000,
+			MaxTimestamp: ts + 10000,
+		}
+		rows := 0
+		var sr storage.Search
+		sr.Init(vmstorage.Storage, []*storage.TagFilters{tfs}, tr, 1e5)
+		for sr.NextMetricBlock() {
+			rows += sr.MetricBlock.Block.RowsCount()
+		}
+		if err := sr.Error(); err != nil {
+			t.Fatalf("unexpected error in search: %s", err)
+		}
+		sr.MustClose()
+		return rows
+	}
+
+	importWAL()
+	if n := searchRows(); n != 2 {
+		t.Fatalf("unexpected number of rows after the first import; got %d; want 2", n)
+	}
+
+	// Repeated import mustn't store duplicate samples.
+	importWAL()
+	if n := searchRows(); n != 2 {
+		t.Fatalf("unexpected number of rows after the repeated import; got %d; want 2", n)
+	}
+
+	// Only new samples must be imported after the WAL is extended.
+	w.writeRecord(marshalTestSamples(sample{ref: 1, timestamp: ts + 2000, value: 3}), false)
+	writeTestSegment(t, filepath.Join(path, "wal", "00000000"), w.data)
+	w = testWALWriter{}
+	w.writeRecord(marshalTestSamples(sample{ref: 1, timestamp: ts + 3000, value: 4}), false)
+	writeTestSegment(t, filepath.Join(path, "wal", "00000001"), w.data)
+	importWAL()
+	if n := searchRows(); n != 4 {
+		t.Fatalf("unexpected number of rows after the import of the extended WAL; got %d; want 4", n)
+	}
+	importWAL()
+	if n := searchRows(); n != 4 {
+		t.Fatalf("unexpected number of rows after the repeated import of the extended WAL; got %d; want 4", n)
+	}
+}
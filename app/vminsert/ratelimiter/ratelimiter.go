@@ -0,0 +1,220 @@
+// Package ratelimiter limits the ingestion rate per client IP.
+package ratelimiter
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	maxRowsPerSecondPerIP = flag.Int("insert.maxRowsPerSecondPerIP", 0, "The maximum number of rows per second, which may be ingested via HTTP from a single client IP. "+
+		"Requests from clients exceeding the limit are rejected with 429 Too Many Requests and Retry-After header. Big requests and streams are rejected "+
+		"in the middle if the client exceeds the limit, so the rows ingested before the rejection are stored. The limit is disabled if set to 0. "+
+		"See also -insert.rateLimitIPHeader and -insert.rateLimitMaxIPs")
+	rateLimitIPHeader = flag.String("insert.rateLimitIPHeader", "", "Optional HTTP request header containing client IP for -insert.maxRowsPerSecondPerIP, for example X-Forwarded-For. "+
+		"The first IP in the header is used. The remote address of the connection is used if the header is empty or missing. "+
+		"Set it only if VictoriaMetrics is located behind a trusted proxy, since clients may put arbitrary values into the header")
+	rateLimitMaxIPs = flag.Int("insert.rateLimitMaxIPs", 100000, "The maximum number of recently seen client IPs tracked by -insert.maxRowsPerSecondPerIP. "+
+		"The least recently seen IPs are evicted when the limit is exceeded, so the memory usage remains bounded during floods from spoofed IPs")
+)
+
+var limiter *Limiter
+
+// Init initializes the rate limiter from command-line flags.
+//
+// Init must be called after flag.Parse call.
+func Init() {
+	if *maxRowsPerSecondPerIP <= 0 {
+		return
+	}
+	if *rateLimitMaxIPs <= 0 {
+		logger.Fatalf("invalid `-insert.rateLimitMaxIPs`: %d; it must be positive", *rateLimitMaxIPs)
+	}
+	limiter = NewLimiter(float64(*maxRowsPerSecondPerIP), *rateLimitMaxIPs)
+	metrics.NewGauge(`vm_insert_ratelimit_tracked_ips`, func() float64 {
+		return float64(limiter.Len())
+	})
+}
+
+// MaxRowsPerSecondPerIP returns the value of -insert.maxRowsPerSecondPerIP flag.
+func MaxRowsPerSecondPerIP() int {
+	return *maxRowsPerSecondPerIP
+}
+
+// GetClient returns rate limiting state for the client sending r.
+//
+// nil is returned if -insert.maxRowsPerSecondPerIP isn't set.
+func GetClient(r *http.Request) *Client {
+	if limiter == nil {
+		return nil
+	}
+	return limiter.GetClient(getClientIP(r, *rateLimitIPHeader))
+}
+
+// getClientIP returns IP of the client sending r.
+//
+// The first IP from the header is used if it isn't empty.
+func getClientIP(r *http.Request, header string) string {
+	if header != "" {
+		v := r.Header.Get(header)
+		if n := strings.IndexByte(v, ','); n >= 0 {
+			v = v[:n]
+		}
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var (
+	rowsAllowed       = metrics.NewCounter(`vm_insert_ratelimit_rows_allowed_total`)
+	requestsThrottled = metrics.NewCounter(`vm_insert_ratelimit_requests_throttled_total`)
+	rowsThrottled     = metrics.NewCounter(`vm_insert_ratelimit_rows_throttled_total`)
+)
+
+// Limiter limits the rows rate per client IP with token buckets.
+//
+// The number of tracked IPs is limited. The least recently seen IPs are evicted
+// when the limit is reached.
+type Limiter struct {
+	rowsPerSecond float64
+	maxIPs        int
+
+	mu sync.Mutex
+
+	// ll contains *Client items ordered by access time. The most recently accessed items are at the front.
+	ll *list.List
+
+	m map[string]*list.Element
+
+	// currentTime is used for obtaining the current time. It is overridden in tests.
+	currentTime func() time.Time
+}
+
+// NewLimiter returns new Limiter for rowsPerSecond per IP, which tracks up to maxIPs IPs.
+func NewLimiter(rowsPerSecond float64, maxIPs int) *Limiter {
+	return &Limiter{
+		rowsPerSecond: rowsPerSecond,
+		maxIPs:        maxIPs,
+		ll:            list.New(),
+		m:             make(map[string]*list.Element),
+		currentTime:   time.Now,
+	}
+}
+
+// Len returns the number of tracked IPs.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	n := l.ll.Len()
+	l.mu.Unlock()
+	return n
+}
+
+// GetClient returns rate limiting state for the given ip.
+func (l *Limiter) GetClient(ip string) *Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el := l.m[ip]; el != nil {
+		l.ll.MoveToFront(el)
+		return el.Value.(*Client)
+	}
+	c := &Client{
+		ip:         ip,
+		l:          l,
+		tokens:     l.rowsPerSecond,
+		lastUpdate: l.currentTime(),
+	}
+	l.m[ip] = l.ll.PushFront(c)
+	for l.ll.Len() > l.maxIPs {
+		el := l.ll.Back()
+		l.ll.Remove(el)
+		delete(l.m, el.Value.(*Client).ip)
+	}
+	return c
+}
+
+// Client is the token bucket for a single client IP.
+//
+// The bucket contains up to a second worth of rows. It may go into debt,
+// since the number of rows in a batch is known only after the batch is parsed.
+type Client struct {
+	ip string
+	l  *Limiter
+
+	mu         sync.Mutex
+	tokens     float64
+	lastUpdate time.Time
+}
+
+// RetryAfter returns the duration the client must wait before sending more rows.
+//
+// Zero is returned if the client may send rows now.
+func (c *Client) RetryAfter() time.Duration {
+	c.mu.Lock()
+	d := c.retryAfterLocked()
+	c.mu.Unlock()
+	if d > 0 {
+		requestsThrottled.Inc()
+	}
+	return d
+}
+
+// Register registers a batch of n rows ingested by the client.
+//
+// An error with 429 status code and Retry-After duration is returned if the client exceeds the limit.
+// The batch isn't registered in this case, so it must be rejected.
+// This limits the rate of rows in big requests and long-living streams on a per-batch basis
+// without blocking the caller.
+func (c *Client) Register(n int) error {
+	c.mu.Lock()
+	d := c.retryAfterLocked()
+	if d > 0 {
+		c.mu.Unlock()
+		requestsThrottled.Inc()
+		rowsThrottled.Add(n)
+		return &httpserver.ErrorWithStatusCode{
+			Err: fmt.Errorf("the client exceeds -insert.maxRowsPerSecondPerIP=%g; dropping %d rows; retry after %.3f seconds",
+				c.l.rowsPerSecond, n, d.Seconds()),
+			StatusCode: http.StatusTooManyRequests,
+			RetryAfter: d,
+		}
+	}
+	c.tokens -= float64(n)
+	c.mu.Unlock()
+	rowsAllowed.Add(n)
+	return nil
+}
+
+func (c *Client) retryAfterLocked() time.Duration {
+	tokens := c.refillLocked()
+	if tokens > 0 {
+		return 0
+	}
+	secs := (1 - tokens) / c.l.rowsPerSecond
+	return time.Duration(secs * float64(time.Second))
+}
+
+func (c *Client) refillLocked() float64 {
+	ct := c.l.currentTime()
+	c.tokens += ct.Sub(c.lastUpdate).Seconds() * c.l.rowsPerSecond
+	if c.tokens > c.l.rowsPerSecond {
+		c.tokens = c.l.rowsPerSecond
+	}
+	c.lastUpdate = ct
+	return c.tokens
+}
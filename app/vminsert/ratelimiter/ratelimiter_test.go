@@ -0,0 +1,138 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+)
+
+func TestClientRetryAfter(t *testing.T) {
+	ct := time.Unix(1e9, 0)
+	l := NewLimiter(100, 10)
+	l.currentTime = func() time.Time {
+		return ct
+	}
+	f := func(retryAfterExpected time.Duration) {
+		t.Helper()
+		c := l.GetClient("1.2.3.4")
+		retryAfter := c.RetryAfter()
+		if retryAfter != retryAfterExpected {
+			t.Fatalf("unexpected RetryAfter; got %s; want %s", retryAfter, retryAfterExpected)
+		}
+	}
+
+	// The new client may send rows.
+	f(0)
+
+	// The client goes into debt, since the number of rows in the batch is known after parsing it.
+	mustRegister(t, l.GetClient("1.2.3.4"), 299)
+	f(2 * time.Second)
+
+	// The bucket is refilled with time.
+	ct = ct.Add(time.Second)
+	f(time.Second)
+	ct = ct.Add(time.Second + 10*time.Millisecond)
+	f(0)
+
+	// The bucket cannot contain more than a second worth of rows.
+	ct = ct.Add(time.Hour)
+	mustRegister(t, l.GetClient("1.2.3.4"), 101)
+	f(20 * time.Millisecond)
+
+	// Other clients aren't affected.
+	if retryAfter := l.GetClient("5.6.7.8").RetryAfter(); retryAfter != 0 {
+		t.Fatalf("unexpected RetryAfter for another client; got %s; want 0", retryAfter)
+	}
+}
+
+func TestClientRegisterRejectsBatches(t *testing.T) {
+	ct := time.Unix(1e9, 0)
+	l := NewLimiter(100, 10)
+	l.currentTime = func() time.Time {
+		return ct
+	}
+	c := l.GetClient("1.2.3.4")
+
+	// The first batch fits the bucket.
+	mustRegister(t, c, 100)
+
+	// The next batch of the same request is rejected until the bucket is refilled,
+	// so big requests cannot exceed the limit.
+	err := c.Register(100)
+	esc, ok := err.(*httpserver.ErrorWithStatusCode)
+	if !ok {
+		t.Fatalf("expecting *httpserver.ErrorWithStatusCode; got %T: %v", err, err)
+	}
+	if esc.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status code; got %d; want %d", esc.StatusCode, http.StatusTooManyRequests)
+	}
+	if esc.RetryAfter != 10*time.Millisecond {
+		t.Fatalf("unexpected RetryAfter; got %s; want %s", esc.RetryAfter, 10*time.Millisecond)
+	}
+
+	// The rejected batch isn't registered, so the client may send rows after the bucket is refilled.
+	ct = ct.Add(20 * time.Millisecond)
+	mustRegister(t, c, 100)
+}
+
+func mustRegister(t *testing.T, c *Client, n int) {
+	t.Helper()
+	if err := c.Register(n); err != nil {
+		t.Fatalf("unexpected error when registering %d rows: %s", n, err)
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	l := NewLimiter(10, 2)
+	mustRegister(t, l.GetClient("a"), 100)
+	mustRegister(t, l.GetClient("b"), 100)
+
+	// Access "a", so "b" becomes the least recently seen client.
+	l.GetClient("a")
+	l.GetClient("c")
+	if n := l.Len(); n != 2 {
+		t.Fatalf("unexpected number of tracked IPs; got %d; want 2", n)
+	}
+	if l.GetClient("a").RetryAfter() == 0 {
+		t.Fatalf("expecting non-zero RetryAfter for the recently seen client")
+	}
+	// The evicted client starts with a full bucket.
+	if retryAfter := l.GetClient("b").RetryAfter(); retryAfter != 0 {
+		t.Fatalf("unexpected RetryAfter for the evicted client; got %s; want 0", retryAfter)
+	}
+	if n := l.Len(); n != 2 {
+		t.Fatalf("unexpected number of tracked IPs; got %d; want 2", n)
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	f := func(remoteAddr, header, headerValue, ipExpected string) {
+		t.Helper()
+		r := &http.Request{
+			RemoteAddr: remoteAddr,
+			Header:     make(http.Header),
+		}
+		if headerValue != "" {
+			r.Header.Set("X-Forwarded-For", headerValue)
+		}
+		ip := getClientIP(r, header)
+		if ip != ipExpected {
+			t.Fatalf("unexpected ip; got %q; want %q", ip, ipExpected)
+		}
+	}
+	f("1.2.3.4:5678", "", "", "1.2.3.4")
+	f("[::1]:5678", "", "", "::1")
+	f("1.2.3.4", "", "", "1.2.3.4")
+
+	// The header is ignored if it isn't configured.
+	f("1.2.3.4:5678", "", "5.6.7.8", "1.2.3.4")
+
+	// The first IP from the header is used.
+	f("1.2.3.4:5678", "X-Forwarded-For", "5.6.7.8", "5.6.7.8")
+	f("1.2.3.4:5678", "X-Forwarded-For", " 5.6.7.8 , 10.0.0.1", "5.6.7.8")
+
+	// The remote address is used if the header is missing.
+	f("1.2.3.4:5678", "X-Forwarded-For", "", "1.2.3.4")
+}
@@ -0,0 +1,197 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// timerQuantiles contains quantiles calculated for timers on every flush.
+var timerQuantiles = []float64{0.5, 0.9, 0.99}
+
+// aggregator aggregates statsd rows over flush interval.
+type aggregator struct {
+	mu sync.Mutex
+	m  map[string]*aggrState
+
+	keyBuf []byte
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		m: make(map[string]*aggrState),
+	}
+}
+
+// aggrState is the aggregation state for a single statsd metric.
+type aggrState struct {
+	typ  string
+	name string
+	tags []Tag
+
+	// updated is set if the state has been updated since the last flush.
+	updated bool
+
+	// value is the sum for counters and the last value for gauges.
+	value float64
+
+	// count is the number of timer samples adjusted by sample rate.
+	count  float64
+	values []float64
+
+	set map[string]struct{}
+}
+
+// Add adds rows to a.
+func (a *aggregator) Add(rows []Row) {
+	a.mu.Lock()
+	for i := range rows {
+		a.addRow(&rows[i])
+	}
+	a.mu.Unlock()
+}
+
+func (a *aggregator) addRow(r *Row) {
+	typ := r.Type
+	if typ == typeHistogram || typ == typeDistribution {
+		typ = typeTimer
+	}
+	a.keyBuf = marshalKey(a.keyBuf[:0], typ, r.Metric, r.Tags)
+	st := a.m[string(a.keyBuf)]
+	if st == nil {
+		st = &aggrState{
+			typ:  typ,
+			name: copyString(r.Metric),
+			tags: copyTags(r.Tags),
+		}
+		if typ == typeSet {
+			st.set = make(map[string]struct{})
+		}
+		a.m[string(a.keyBuf)] = st
+	}
+	st.updated = true
+	switch typ {
+	case typeCounter:
+		st.value += r.Value / r.SampleRate
+	case typeGauge:
+		if r.IsDelta {
+			st.value += r.Value
+		} else {
+			st.value = r.Value
+		}
+	case typeTimer:
+		st.count += 1 / r.SampleRate
+		st.values = append(st.values, r.Value)
+	case typeSet:
+		if _, ok := st.set[r.RawValue]; !ok {
+			st.set[copyString(r.RawValue)] = struct{}{}
+		}
+	}
+}
+
+// Flush calls f for every aggregated sample and resets per-interval state.
+//
+// Counters, timers and sets are reported only if they were updated since the previous flush,
+// while gauges are reported on every flush like statsd does.
+//
+// tags passed to f must be used only until f returns.
+func (a *aggregator) Flush(f func(name string, tags []Tag, value float64)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var tagsBuf []Tag
+	for key, st := range a.m {
+		if st.typ == typeGauge {
+			f(st.name, st.tags, st.value)
+			st.updated = false
+			continue
+		}
+		if !st.updated {
+			// Drop states for metrics without updates during the last flush interval.
+			delete(a.m, key)
+			continue
+		}
+		switch st.typ {
+		case typeCounter:
+			f(st.name, st.tags, st.value)
+			st.value = 0
+		case typeTimer:
+			values := st.values
+			sort.Float64s(values)
+			sum := float64(0)
+			for _, v := range values {
+				sum += v
+			}
+			f(st.name+"_count", st.tags, st.count)
+			f(st.name+"_sum", st.tags, sum)
+			f(st.name+"_min", st.tags, values[0])
+			f(st.name+"_max", st.tags, values[len(values)-1])
+			for _, q := range timerQuantiles {
+				tagsBuf = append(tagsBuf[:0], st.tags...)
+				tagsBuf = append(tagsBuf, Tag{
+					Key:   "quantile",
+					Value: strconv.FormatFloat(q, 'g', -1, 64),
+				})
+				f(st.name, tagsBuf, quantile(values, q))
+			}
+			st.count = 0
+			st.values = st.values[:0]
+		case typeSet:
+			f(st.name, st.tags, float64(len(st.set)))
+			st.set = make(map[string]struct{})
+		}
+		st.updated = false
+	}
+}
+
+// quantile returns q quantile for the sorted values using nearest-rank method.
+func quantile(values []float64, q float64) float64 {
+	n := int(math.Ceil(q*float64(len(values)))) - 1
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(values) {
+		n = len(values) - 1
+	}
+	return values[n]
+}
+
+func marshalKey(dst []byte, typ, name string, tags []Tag) []byte {
+	dst = append(dst, typ...)
+	dst = append(dst, 0)
+	dst = append(dst, name...)
+	if len(tags) == 0 {
+		return dst
+	}
+	if !sort.SliceIsSorted(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key }) {
+		// Sort tags in order to obtain the same key for distinct tag orders.
+		// It is safe to sort tags in place, since they belong to the parsed row.
+		sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	}
+	for i := range tags {
+		tag := &tags[i]
+		dst = append(dst, 0)
+		dst = append(dst, tag.Key...)
+		dst = append(dst, 0)
+		dst = append(dst, tag.Value...)
+	}
+	return dst
+}
+
+func copyTags(tags []Tag) []Tag {
+	if len(tags) == 0 {
+		return nil
+	}
+	dst := make([]Tag, len(tags))
+	for i := range tags {
+		dst[i].Key = copyString(tags[i].Key)
+		dst[i].Value = copyString(tags[i].Value)
+	}
+	return dst
+}
+
+// copyString returns a copy of s, which doesn't refer to the original buffer.
+func copyString(s string) string {
+	return string(append([]byte(nil), s...))
+}
@@ -0,0 +1,129 @@
+package statsd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAggregatorFlush(t *testing.T) {
+	a := newAggregator()
+	f := func(data string, resultExpected []string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(data); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", data, err)
+		}
+		a.Add(rows.Rows)
+		var result []string
+		a.Flush(func(name string, tags []Tag, value float64) {
+			var tagsStr []string
+			for _, tag := range tags {
+				tagsStr = append(tagsStr, fmt.Sprintf("%s=%q", tag.Key, tag.Value))
+			}
+			result = append(result, fmt.Sprintf("%s{%s} %g", name, strings.Join(tagsStr, ","), value))
+		})
+		sort.Strings(result)
+		sort.Strings(resultExpected)
+		if strings.Join(result, "\n") != strings.Join(resultExpected, "\n") {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", strings.Join(result, "\n"), strings.Join(resultExpected, "\n"))
+		}
+	}
+
+	// Empty aggregator
+	f("", nil)
+
+	// Counters are summed and scaled by the inverse sample rate
+	f(`
+foo:1|c
+foo:2|c
+foo:1|c|@0.1
+foo:5|c|#env:prod,dc:east
+foo:5|c|#dc:east,env:prod
+`, []string{
+		`foo{} 13`,
+		`foo{dc="east",env="prod"} 10`,
+	})
+
+	// Counters without updates aren't reported, since they are reset after the flush
+	f("", nil)
+
+	// Gauges are reported on every flush and support relative updates
+	f(`
+g:10|g
+g:-3|g
+g:+1|g
+h:5|g
+h:7|g
+`, []string{
+		`g{} 8`,
+		`h{} 7`,
+	})
+	f("g:+2|g", []string{
+		`g{} 10`,
+		`h{} 7`,
+	})
+
+	// Timers
+	f(`
+t:1|ms
+t:5|ms
+t:3|ms|@0.5
+t:2|h
+t:4|d
+`, []string{
+		`g{} 10`,
+		`h{} 7`,
+		`t_count{} 6`,
+		`t_sum{} 15`,
+		`t_min{} 1`,
+		`t_max{} 5`,
+		`t{quantile="0.5"} 3`,
+		`t{quantile="0.9"} 5`,
+		`t{quantile="0.99"} 5`,
+	})
+
+	// Sets contain the number of unique values during the flush interval
+	f(`
+s:alice|s
+s:bob|s
+s:alice|s
+t:10|ms|#a:b
+`, []string{
+		`g{} 10`,
+		`h{} 7`,
+		`s{} 2`,
+		`t_count{a="b"} 1`,
+		`t_sum{a="b"} 10`,
+		`t_min{a="b"} 10`,
+		`t_max{a="b"} 10`,
+		`t{a="b",quantile="0.5"} 10`,
+		`t{a="b",quantile="0.9"} 10`,
+		`t{a="b",quantile="0.99"} 10`,
+	})
+	f("s:carol|s", []string{
+		`g{} 10`,
+		`h{} 7`,
+		`s{} 1`,
+	})
+}
+
+func TestQuantile(t *testing.T) {
+	f := func(values []float64, q, resultExpected float64) {
+		t.Helper()
+		result := quantile(values, q)
+		if result != resultExpected {
+			t.Fatalf("unexpected quantile(%v, %g); got %g; want %g", values, q, result, resultExpected)
+		}
+	}
+
+	f([]float64{1}, 0, 1)
+	f([]float64{1}, 0.5, 1)
+	f([]float64{1}, 1, 1)
+	f([]float64{1, 2, 3, 4}, 0, 1)
+	f([]float64{1, 2, 3, 4}, 0.5, 2)
+	f([]float64{1, 2, 3, 4}, 0.75, 3)
+	f([]float64{1, 2, 3, 4}, 0.9, 4)
+	f([]float64{1, 2, 3, 4}, 1, 4)
+}
@@ -0,0 +1,257 @@
+package statsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/datadog"
+)
+
+// Rows contains parsed statsd rows.
+type Rows struct {
+	Rows []Row
+
+	tagsPool []Tag
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Reset items, so they can be GC'ed
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+}
+
+// Unmarshal unmarshals statsd lines from s.
+//
+// See https://github.com/statsd/statsd/blob/master/docs/metric_types.md
+// and https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) Unmarshal(s string) error {
+	var err error
+	rs.Rows, rs.tagsPool, err = unmarshalRows(rs.Rows[:0], s, rs.tagsPool[:0])
+	if err != nil {
+		return err
+	}
+	return err
+}
+
+// Metric types supported by statsd.
+const (
+	typeCounter = "c"
+	typeGauge   = "g"
+	typeTimer   = "ms"
+	typeSet     = "s"
+
+	// typeHistogram and typeDistribution are DogStatsD types, which are processed as timers.
+	typeHistogram    = "h"
+	typeDistribution = "d"
+)
+
+// Row is a single statsd row.
+type Row struct {
+	Metric string
+	Tags   []Tag
+
+	// Type is the metric type such as `c`, `g`, `ms` or `s`.
+	Type string
+
+	// Value is the numeric value for the row. It is unset for sets.
+	Value float64
+
+	// RawValue is the value as it is sent by the client. It is used for sets.
+	RawValue string
+
+	// IsDelta is set for gauges with explicit sign in front of the value.
+	// Such gauges increment or decrement the previous value.
+	IsDelta bool
+
+	// SampleRate is the sample rate from `@rate` section. It is set to 1 if the section is missing.
+	SampleRate float64
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Type = ""
+	r.Value = 0
+	r.RawValue = ""
+	r.IsDelta = false
+	r.SampleRate = 0
+}
+
+func (r *Row) unmarshal(s string, tagsPool []Tag) ([]Tag, error) {
+	r.reset()
+	n := strings.IndexByte(s, ':')
+	if n < 0 {
+		return tagsPool, fmt.Errorf("cannot find `:` between metric and value in %q", s)
+	}
+	r.Metric = s[:n]
+	if len(r.Metric) == 0 {
+		return tagsPool, fmt.Errorf("metric cannot be empty in %q", s)
+	}
+	tail := s[n+1:]
+
+	n = strings.IndexByte(tail, '|')
+	if n < 0 {
+		return tagsPool, fmt.Errorf("cannot find `|` between value and type in %q", s)
+	}
+	r.RawValue = tail[:n]
+	tail = tail[n+1:]
+	n = strings.IndexByte(tail, '|')
+	if n < 0 {
+		r.Type = tail
+		tail = ""
+	} else {
+		r.Type = tail[:n]
+		tail = tail[n+1:]
+	}
+	switch r.Type {
+	case typeCounter, typeGauge, typeTimer, typeHistogram, typeDistribution:
+		v, err := strconv.ParseFloat(r.RawValue, 64)
+		if err != nil {
+			return tagsPool, fmt.Errorf("cannot parse value %q in %q: %s", r.RawValue, s, err)
+		}
+		r.Value = v
+		if r.Type == typeGauge && len(r.RawValue) > 0 && (r.RawValue[0] == '+' || r.RawValue[0] == '-') {
+			r.IsDelta = true
+		}
+	case typeSet:
+		if len(r.RawValue) == 0 {
+			return tagsPool, fmt.Errorf("set value cannot be empty in %q", s)
+		}
+	default:
+		return tagsPool, fmt.Errorf("unsupported metric type %q in %q; supported types: c, g, ms, h, d, s", r.Type, s)
+	}
+
+	r.SampleRate = 1
+	for len(tail) > 0 {
+		section := tail
+		n = strings.IndexByte(tail, '|')
+		if n >= 0 {
+			section = tail[:n]
+			tail = tail[n+1:]
+		} else {
+			tail = ""
+		}
+		if len(section) == 0 {
+			continue
+		}
+		switch section[0] {
+		case '@':
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil {
+				return tagsPool, fmt.Errorf("cannot parse sample rate %q in %q: %s", section, s, err)
+			}
+			if rate <= 0 || rate > 1 {
+				return tagsPool, fmt.Errorf("sample rate must be in the range (0..1]; got %q in %q", section, s)
+			}
+			r.SampleRate = rate
+		case '#':
+			tagsStart := len(tagsPool)
+			tagsPool = unmarshalTags(tagsPool, section[1:])
+			if tags := tagsPool[tagsStart:]; len(tags) > 0 {
+				r.Tags = tags[:len(tags):len(tags)]
+			}
+		default:
+			// Ignore unknown sections such as DogStatsD container id `c:...` or timestamp `T...`.
+		}
+	}
+	return tagsPool, nil
+}
+
+func unmarshalRows(dst []Row, s string, tagsPool []Tag) ([]Row, []Tag, error) {
+	for len(s) > 0 {
+		n := strings.IndexByte(s, '\n')
+		line := s
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) == 0 {
+			// Skip empty line
+			continue
+		}
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Row{})
+		}
+		r := &dst[len(dst)-1]
+		var err error
+		tagsPool, err = r.unmarshal(line, tagsPool)
+		if err != nil {
+			return dst, tagsPool, err
+		}
+	}
+	return dst, tagsPool, nil
+}
+
+// unmarshalTags appends DogStatsD tags from s to dst and returns the result.
+//
+// Tags are delimited by `,`, while tag key is delimited from tag value by `:`.
+// Tags without value are split in the same way as DataDog tags - see datadog.SplitTag.
+// Tags with empty keys are ignored. The last value wins for duplicate tag keys.
+func unmarshalTags(dst []Tag, s string) []Tag {
+	tagsStart := len(dst)
+	for len(s) > 0 {
+		tagStr := s
+		n := strings.IndexByte(s, ',')
+		if n >= 0 {
+			tagStr = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		dst = appendTag(dst, tagsStart, tagStr)
+	}
+	return dst
+}
+
+func appendTag(dst []Tag, tagsStart int, s string) []Tag {
+	key, value := datadog.SplitTag(s)
+	if len(key) == 0 {
+		// Ignore tags with empty key.
+		return dst
+	}
+	tags := dst[tagsStart:]
+	for i := range tags {
+		if tags[i].Key == key {
+			// Duplicate tag - the last value wins.
+			tags[i].Value = value
+			return dst
+		}
+	}
+	if cap(dst) > len(dst) {
+		dst = dst[:len(dst)+1]
+	} else {
+		dst = append(dst, Tag{})
+	}
+	tag := &dst[len(dst)-1]
+	tag.Key = key
+	tag.Value = value
+	return dst
+}
+
+// Tag is a statsd tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
@@ -0,0 +1,225 @@
+package statsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+
+		// Try again
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+
+	// Missing value
+	f("aaa")
+	f("aaa:")
+
+	// Missing type
+	f("aaa:123")
+
+	// Missing metric
+	f(":123|c")
+
+	// Invalid value
+	f("aaa:foo|c")
+	f("aaa:|g")
+
+	// Empty set value
+	f("aaa:|s")
+
+	// Unsupported type
+	f("aaa:123|x")
+	f("aaa:123|")
+
+	// Invalid sample rate
+	f("aaa:123|c|@foo")
+	f("aaa:123|c|@0")
+	f("aaa:123|c|@1.5")
+
+	// Invalid multiline
+	f("aaa:1|c\nbbb")
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(s string, rowsExpected *Rows) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+
+		// Try unmarshaling again
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+
+		rows.Reset()
+		if len(rows.Rows) != 0 {
+			t.Fatalf("non-empty rows after reset: %+v", rows.Rows)
+		}
+	}
+
+	// Empty line
+	f("", &Rows{})
+	f("\n\n", &Rows{})
+
+	// Counter
+	f("foo.bar:123|c", &Rows{
+		Rows: []Row{{
+			Metric:     "foo.bar",
+			Type:       "c",
+			Value:      123,
+			RawValue:   "123",
+			SampleRate: 1,
+		}},
+	})
+
+	// Counter with sample rate
+	f("foo:2|c|@0.1\n", &Rows{
+		Rows: []Row{{
+			Metric:     "foo",
+			Type:       "c",
+			Value:      2,
+			RawValue:   "2",
+			SampleRate: 0.1,
+		}},
+	})
+
+	// Gauges
+	f("foo:-12.5|g\r\nbar:+3|g\nbaz:4|g", &Rows{
+		Rows: []Row{
+			{
+				Metric:     "foo",
+				Type:       "g",
+				Value:      -12.5,
+				RawValue:   "-12.5",
+				IsDelta:    true,
+				SampleRate: 1,
+			},
+			{
+				Metric:     "bar",
+				Type:       "g",
+				Value:      3,
+				RawValue:   "+3",
+				IsDelta:    true,
+				SampleRate: 1,
+			},
+			{
+				Metric:     "baz",
+				Type:       "g",
+				Value:      4,
+				RawValue:   "4",
+				SampleRate: 1,
+			},
+		},
+	})
+
+	// Timers, histograms, distributions and sets
+	f("t:320|ms|@0.5\nh:1|h\nd:2|d\nusers:alice|s", &Rows{
+		Rows: []Row{
+			{
+				Metric:     "t",
+				Type:       "ms",
+				Value:      320,
+				RawValue:   "320",
+				SampleRate: 0.5,
+			},
+			{
+				Metric:     "h",
+				Type:       "h",
+				Value:      1,
+				RawValue:   "1",
+				SampleRate: 1,
+			},
+			{
+				Metric:     "d",
+				Type:       "d",
+				Value:      2,
+				RawValue:   "2",
+				SampleRate: 1,
+			},
+			{
+				Metric:     "users",
+				Type:       "s",
+				RawValue:   "alice",
+				SampleRate: 1,
+			},
+		},
+	})
+
+	// DogStatsD tags
+	f("foo:1|c|@0.5|#env:prod,dc:east", &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags: []Tag{
+				{
+					Key:   "env",
+					Value: "prod",
+				},
+				{
+					Key:   "dc",
+					Value: "east",
+				},
+			},
+			Type:       "c",
+			Value:      1,
+			RawValue:   "1",
+			SampleRate: 0.5,
+		}},
+	})
+
+	// Tags with empty keys must be ignored; the last value wins for duplicate tags
+	f("foo:1|g|#novalue,:x,a:b,a:c,url:http://foo", &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags: []Tag{
+				{
+					Key:   "novalue",
+					Value: "no_label_value",
+				},
+				{
+					Key:   "a",
+					Value: "c",
+				},
+				{
+					Key:   "url",
+					Value: "http://foo",
+				},
+			},
+			Type:       "g",
+			Value:      1,
+			RawValue:   "1",
+			SampleRate: 1,
+		}},
+	})
+
+	// Unknown sections must be ignored
+	f("foo:1|c|#a:b|c:container-id|T1656581400", &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags: []Tag{{
+				Key:   "a",
+				Value: "b",
+			}},
+			Type:       "c",
+			Value:      1,
+			RawValue:   "1",
+			SampleRate: 1,
+		}},
+	})
+}
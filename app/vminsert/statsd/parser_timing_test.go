@@ -0,0 +1,42 @@
+package statsd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkRowsUnmarshal(b *testing.B) {
+	s := `cpu.usage_user:1.23|g
+requests.count:1|c|@0.1
+request.duration:320|ms
+users.unique:alice|s
+`
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var rows Rows
+		for pb.Next() {
+			if err := rows.Unmarshal(s); err != nil {
+				panic(fmt.Errorf("cannot unmarshal %q: %s", s, err))
+			}
+		}
+	})
+}
+
+func BenchmarkRowsUnmarshalWithTags(b *testing.B) {
+	s := `cpu.usage_user:1.23|g|#region:us,dc:east
+requests.count:1|c|@0.1|#region:us,dc:east
+request.duration:320|ms|#region:us,dc:west
+users.unique:alice|s|#region:eu,dc:north
+`
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var rows Rows
+		for pb.Next() {
+			if err := rows.Unmarshal(s); err != nil {
+				panic(fmt.Errorf("cannot unmarshal %q: %s", s, err))
+			}
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package statsd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var flushInterval = flag.Duration("statsd.flushInterval", 10*time.Second, "Interval for flushing aggregated statsd metrics to the storage")
+
+var (
+	rowsReceived = metrics.NewCounter(`vm_statsd_rows_received_total`)
+	rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="statsd"}`)
+)
+
+// aggr aggregates all the received statsd rows until the next flush.
+var aggr = newAggregator()
+
+// insertHandler processes statsd lines from r.
+//
+// See https://github.com/statsd/statsd/blob/master/docs/metric_types.md
+func insertHandler(r io.Reader) error {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	for ctx.Read(r) {
+		aggr.Add(ctx.Rows.Rows)
+		rowsReceived.Add(len(ctx.Rows.Rows))
+	}
+	return ctx.Error()
+}
+
+// insertPacket processes statsd lines from a single UDP packet.
+func insertPacket(data []byte) error {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(data)); err != nil {
+		statsdUnmarshalErrors.Inc()
+		return fmt.Errorf("cannot unmarshal statsd data with size %d: %s", len(data), err)
+	}
+	aggr.Add(ctx.Rows.Rows)
+	rowsReceived.Add(len(ctx.Rows.Rows))
+	return nil
+}
+
+// runFlusher flushes the aggregated data to the storage every -statsd.flushInterval until stopCh is closed.
+func runFlusher(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(*flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			// Flush the remaining data before returning.
+			flush(time.Now())
+			return
+		case t := <-ticker.C:
+			flush(t)
+		}
+	}
+}
+
+func flush(t time.Time) {
+	err := concurrencylimiter.Do(func() error {
+		return flushInternal(t)
+	})
+	if err != nil {
+		logger.Errorf("cannot flush statsd metrics: %s", err)
+	}
+}
+
+func flushInternal(t time.Time) error {
+	timestamp := t.UnixNano() / 1e6
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ic := &ctx.Common
+	ic.Reset(0)
+	rows := 0
+	aggr.Flush(func(name string, tags []Tag, value float64) {
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", name)
+		for i := range tags {
+			tag := &tags[i]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		ic.WriteDataPoint(nil, ic.Labels, timestamp, value)
+		rows++
+	})
+	rowsInserted.Add(rows)
+	return ic.FlushBufs()
+}
+
+const flushTimeout = 3 * time.Second
+
+func (ctx *pushCtx) Read(r io.Reader) bool {
+	statsdReadCalls.Inc()
+	if ctx.err != nil {
+		return false
+	}
+	if c, ok := r.(net.Conn); ok {
+		if err := c.SetReadDeadline(time.Now().Add(flushTimeout)); err != nil {
+			statsdReadErrors.Inc()
+			ctx.err = fmt.Errorf("cannot set read deadline: %s", err)
+			return false
+		}
+	}
+	ctx.reqBuf, ctx.tailBuf, ctx.err = common.ReadLinesBlock(r, ctx.reqBuf, ctx.tailBuf)
+	if ctx.err != nil {
+		if ne, ok := ctx.err.(net.Error); ok && ne.Timeout() {
+			// Process the read data on timeout and try reading again.
+			ctx.err = nil
+		} else {
+			if ctx.err != io.EOF {
+				statsdReadErrors.Inc()
+				ctx.err = fmt.Errorf("cannot read statsd data: %s", ctx.err)
+			}
+			return false
+		}
+	}
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf)); err != nil {
+		statsdUnmarshalErrors.Inc()
+		ctx.err = fmt.Errorf("cannot unmarshal statsd data with size %d: %s", len(ctx.reqBuf), err)
+		return false
+	}
+	return true
+}
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf  []byte
+	tailBuf []byte
+
+	err error
+}
+
+func (ctx *pushCtx) Error() error {
+	if ctx.err == io.EOF {
+		return nil
+	}
+	return ctx.err
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.reqBuf = ctx.reqBuf[:0]
+	ctx.tailBuf = ctx.tailBuf[:0]
+
+	ctx.err = nil
+}
+
+var (
+	statsdReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="statsd"}`)
+	statsdReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="statsd"}`)
+	statsdUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="statsd"}`)
+)
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
@@ -0,0 +1,165 @@
+package statsd
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/netutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	writeRequestsTCP = metrics.NewCounter(`vm_statsd_requests_total{name="write", net="tcp"}`)
+	writeErrorsTCP   = metrics.NewCounter(`vm_statsd_request_errors_total{name="write", net="tcp"}`)
+
+	writeRequestsUDP = metrics.NewCounter(`vm_statsd_requests_total{name="write", net="udp"}`)
+	writeErrorsUDP   = metrics.NewCounter(`vm_statsd_request_errors_total{name="write", net="udp"}`)
+)
+
+// Serve starts statsd server on the given addrs.
+//
+// addrs may contain comma-separated list of addresses to listen to.
+//
+// The received metrics are aggregated and flushed to the storage every -statsd.flushInterval.
+func Serve(addrs string) {
+	flusherWG.Add(1)
+	go func() {
+		defer flusherWG.Done()
+		runFlusher(flusherStopCh)
+	}()
+
+	var wg sync.WaitGroup
+	for _, addr := range netutil.ParseListenAddrs(addrs) {
+		logger.Infof("starting TCP statsd server at %q", addr)
+		lnTCP, err := net.Listen(netutil.GetTCPNetwork(addr), addr)
+		if err != nil {
+			logger.Fatalf("cannot start TCP statsd server at %q: %s", addr, err)
+		}
+		logger.Infof("starting UDP statsd server at %q", addr)
+		lnUDP, err := net.ListenPacket(netutil.GetUDPNetwork(addr), addr)
+		if err != nil {
+			logger.Fatalf("cannot start UDP statsd server at %q: %s", addr, err)
+		}
+		listenersLock.Lock()
+		listenersTCP = append(listenersTCP, lnTCP)
+		listenersUDP = append(listenersUDP, lnUDP)
+		listenersLock.Unlock()
+
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			serveTCP(lnTCP)
+			logger.Infof("stopped TCP statsd server at %q", addr)
+		}(addr)
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			serveUDP(lnUDP)
+			logger.Infof("stopped UDP statsd server at %q", addr)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+func serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok {
+				if ne.Temporary() {
+					time.Sleep(time.Second)
+					continue
+				}
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					break
+				}
+				logger.Fatalf("unrecoverable error when accepting TCP statsd connections: %s", err)
+			}
+			logger.Fatalf("unexpected error when accepting TCP statsd connections: %s", err)
+		}
+		go func() {
+			writeRequestsTCP.Inc()
+			if err := insertHandler(c); err != nil {
+				writeErrorsTCP.Inc()
+				logger.Errorf("error in TCP statsd conn %q<->%q: %s", c.LocalAddr(), c.RemoteAddr(), err)
+			}
+			_ = c.Close()
+		}()
+	}
+}
+
+func serveUDP(ln net.PacketConn) {
+	gomaxprocs := runtime.GOMAXPROCS(-1)
+	var wg sync.WaitGroup
+	for i := 0; i < gomaxprocs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var bb bytesutil.ByteBuffer
+			bb.B = bytesutil.Resize(bb.B, 64*1024)
+			for {
+				bb.Reset()
+				bb.B = bb.B[:cap(bb.B)]
+				n, addr, err := ln.ReadFrom(bb.B)
+				if err != nil {
+					writeErrorsUDP.Inc()
+					if ne, ok := err.(net.Error); ok {
+						if ne.Temporary() {
+							time.Sleep(time.Second)
+							continue
+						}
+						if strings.Contains(err.Error(), "use of closed network connection") {
+							break
+						}
+					}
+					logger.Errorf("cannot read statsd UDP data: %s", err)
+					continue
+				}
+				bb.B = bb.B[:n]
+				writeRequestsUDP.Inc()
+				// Every UDP packet contains whole lines, so parse it directly.
+				if err := insertPacket(bb.B); err != nil {
+					writeErrorsUDP.Inc()
+					logger.Errorf("error in UDP statsd conn %q<->%q: %s", ln.LocalAddr(), addr, err)
+					continue
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+var (
+	listenersLock sync.Mutex
+	listenersTCP  []net.Listener
+	listenersUDP  []net.PacketConn
+
+	flusherStopCh = make(chan struct{})
+	flusherWG     sync.WaitGroup
+)
+
+// Stop stops the server.
+func Stop() {
+	listenersLock.Lock()
+	for _, ln := range listenersTCP {
+		logger.Infof("stopping TCP statsd server at %q...", ln.Addr())
+		if err := ln.Close(); err != nil {
+			logger.Errorf("cannot close TCP statsd server: %s", err)
+		}
+	}
+	for _, ln := range listenersUDP {
+		logger.Infof("stopping UDP statsd server at %q...", ln.LocalAddr())
+		if err := ln.Close(); err != nil {
+			logger.Errorf("cannot close UDP statsd server: %s", err)
+		}
+	}
+	listenersLock.Unlock()
+	// Flush the aggregated data after closing the listeners.
+	close(flusherStopCh)
+	flusherWG.Wait()
+}
@@ -0,0 +1,170 @@
+package vmimport
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// Rows contains parsed rows from `/api/v1/export` response.
+type Rows struct {
+	Rows []Row
+
+	// MissingMetricNameLines is the number of lines skipped during the last Unmarshal call because of missing `__name__` label.
+	MissingMetricNameLines int
+
+	tagsPool       []Tag
+	valuesPool     []float64
+	timestampsPool []int64
+
+	p fastjson.Parser
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Reset items, so they can be GC'ed
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+	rs.MissingMetricNameLines = 0
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+
+	rs.valuesPool = rs.valuesPool[:0]
+	rs.timestampsPool = rs.timestampsPool[:0]
+}
+
+// Unmarshal unmarshals JSON lines from s in the format returned by `/api/v1/export`:
+//
+//	{"metric":{"__name__":"foo","job":"bar"},"values":[1,2],"timestamps":[1000,2000]}
+//
+// Lines without `__name__` label are skipped. The number of skipped lines is stored in rs.MissingMetricNameLines.
+func (rs *Rows) Unmarshal(s string) error {
+	rs.Reset()
+	for len(s) > 0 {
+		line := s
+		n := strings.IndexByte(s, '\n')
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			// Skip empty line
+			continue
+		}
+		if cap(rs.Rows) > len(rs.Rows) {
+			rs.Rows = rs.Rows[:len(rs.Rows)+1]
+		} else {
+			rs.Rows = append(rs.Rows, Row{})
+		}
+		r := &rs.Rows[len(rs.Rows)-1]
+		if err := rs.unmarshalRow(r, line); err != nil {
+			return fmt.Errorf("cannot unmarshal %q: %s", line, err)
+		}
+		if len(r.Metric) == 0 {
+			rs.MissingMetricNameLines++
+			r.reset()
+			rs.Rows = rs.Rows[:len(rs.Rows)-1]
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalRow(r *Row, s string) error {
+	r.reset()
+	v, err := rs.p.Parse(s)
+	if err != nil {
+		return fmt.Errorf("cannot parse json line: %s", err)
+	}
+
+	// Strings returned by v are valid only until the next rs.p.Parse call, so they are copied.
+	metric := v.GetObject("metric")
+	if metric == nil {
+		return fmt.Errorf("missing `metric` object")
+	}
+	tagsStart := len(rs.tagsPool)
+	metric.Visit(func(key []byte, v *fastjson.Value) {
+		if err != nil {
+			return
+		}
+		value, errLocal := v.StringBytes()
+		if errLocal != nil {
+			err = fmt.Errorf("cannot parse value for label %q: %s", key, errLocal)
+			return
+		}
+		if string(key) == "__name__" {
+			r.Metric = string(value)
+			return
+		}
+		rs.tagsPool = append(rs.tagsPool, Tag{
+			Key:   string(key),
+			Value: string(value),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if tags := rs.tagsPool[tagsStart:]; len(tags) > 0 {
+		r.Tags = tags[:len(tags):len(tags)]
+	}
+
+	values := v.GetArray("values")
+	timestamps := v.GetArray("timestamps")
+	if len(values) != len(timestamps) {
+		return fmt.Errorf("the number of values must match the number of timestamps; got %d values vs %d timestamps", len(values), len(timestamps))
+	}
+	valuesStart := len(rs.valuesPool)
+	for i, v := range values {
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("cannot parse value #%d: %s", i, err)
+		}
+		rs.valuesPool = append(rs.valuesPool, f)
+	}
+	r.Values = rs.valuesPool[valuesStart:len(rs.valuesPool):len(rs.valuesPool)]
+	timestampsStart := len(rs.timestampsPool)
+	for i, v := range timestamps {
+		ts, err := v.Int64()
+		if err != nil {
+			return fmt.Errorf("cannot parse timestamp #%d: %s", i, err)
+		}
+		rs.timestampsPool = append(rs.timestampsPool, ts)
+	}
+	r.Timestamps = rs.timestampsPool[timestampsStart:len(rs.timestampsPool):len(rs.timestampsPool)]
+	return nil
+}
+
+// Row is a single row from `/api/v1/export` response.
+type Row struct {
+	Metric     string
+	Tags       []Tag
+	Values     []float64
+	Timestamps []int64
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Values = nil
+	r.Timestamps = nil
+}
+
+// Tag is a single label for the metric.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
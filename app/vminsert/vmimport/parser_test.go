@@ -0,0 +1,126 @@
+package vmimport
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+
+		// Try again
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+
+	// Invalid json
+	f("foo")
+	f(`{"metric":{"__name__":"foo"}`)
+
+	// Missing metric
+	f(`{"values":[1],"timestamps":[2]}`)
+	f(`{"metric":1,"values":[1],"timestamps":[2]}`)
+
+	// Invalid label value
+	f(`{"metric":{"__name__":1},"values":[1],"timestamps":[2]}`)
+	f(`{"metric":{"__name__":"foo","bar":null},"values":[1],"timestamps":[2]}`)
+
+	// Mismatched number of values and timestamps
+	f(`{"metric":{"__name__":"foo"},"values":[1,2],"timestamps":[2]}`)
+	f(`{"metric":{"__name__":"foo"},"values":[1]}`)
+
+	// Invalid values and timestamps
+	f(`{"metric":{"__name__":"foo"},"values":["x"],"timestamps":[2]}`)
+	f(`{"metric":{"__name__":"foo"},"values":[1],"timestamps":[1.5]}`)
+
+	// Invalid multiline
+	f(`{"metric":{"__name__":"foo"},"values":[1],"timestamps":[2]}` + "\nfoo")
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(s string, rowsExpected *Rows) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+		if rows.MissingMetricNameLines != rowsExpected.MissingMetricNameLines {
+			t.Fatalf("unexpected MissingMetricNameLines; got %d; want %d", rows.MissingMetricNameLines, rowsExpected.MissingMetricNameLines)
+		}
+
+		// Try unmarshaling again
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+
+		rows.Reset()
+		if len(rows.Rows) != 0 {
+			t.Fatalf("non-empty rows after reset: %+v", rows.Rows)
+		}
+	}
+
+	// Empty line
+	f("", &Rows{})
+	f("\n\n", &Rows{})
+
+	// Single line
+	f(`{"metric":{"__name__":"foo"},"values":[1.5],"timestamps":[2]}`, &Rows{
+		Rows: []Row{{
+			Metric:     "foo",
+			Values:     []float64{1.5},
+			Timestamps: []int64{2},
+		}},
+	})
+
+	// Multiple lines with labels
+	f(`{"metric":{"__name__":"foo","job":"bar","instance":"x\"y"},"values":[1,2],"timestamps":[1000,2000]}
+{"metric":{"__name__":"baz"},"values":[],"timestamps":[]}
+`, &Rows{
+		Rows: []Row{
+			{
+				Metric: "foo",
+				Tags: []Tag{
+					{
+						Key:   "job",
+						Value: "bar",
+					},
+					{
+						Key:   "instance",
+						Value: `x"y`,
+					},
+				},
+				Values:     []float64{1, 2},
+				Timestamps: []int64{1000, 2000},
+			},
+			{
+				Metric:     "baz",
+				Values:     []float64{},
+				Timestamps: []int64{},
+			},
+		},
+	})
+
+	// Lines without metric name are skipped
+	f(`{"metric":{"job":"bar"},"values":[1],"timestamps":[2]}
+{"metric":{"__name__":"foo"},"values":[3],"timestamps":[4]}
+{"metric":{"__name__":""},"values":[1],"timestamps":[2]}`, &Rows{
+		Rows: []Row{{
+			Metric:     "foo",
+			Values:     []float64{3},
+			Timestamps: []int64{4},
+		}},
+		MissingMetricNameLines: 2,
+	})
+}
@@ -0,0 +1,202 @@
+package vmimport
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/ratelimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxLineLen = flag.Int("import.maxLineLen", 100*1024*1024, "The maximum length in bytes of a single line accepted by /api/v1/import")
+
+var (
+	rowsInserted = metrics.NewCounter(`vm_rows_inserted_total{type="vmimport"}`)
+
+	missingMetricNameLines = metrics.NewCounter(`vm_rows_skipped_total{type="vmimport", reason="missing_metric_name"}`)
+)
+
+// InsertHandler processes JSON lines from req in the format returned by /api/v1/export.
+//
+// Lines without `__name__` label are skipped, while the rest of lines are processed.
+//
+// maxSize limits the size of the request body after decompression.
+func InsertHandler(req *http.Request, maxSize int64) error {
+	return concurrencylimiter.Do(func() error {
+		return insertHandlerInternal(req, maxSize)
+	})
+}
+
+func insertHandlerInternal(req *http.Request, maxSize int64) error {
+	vmimportReadCalls.Inc()
+
+	r := req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := getGzipReader(r)
+		if err != nil {
+			return fmt.Errorf("cannot read gzipped vmimport data: %s", err)
+		}
+		defer putGzipReader(zr)
+		r = zr
+	}
+	mr := common.NewMaxSizeReader(r, maxSize)
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetRateLimitClient(ratelimiter.GetClient(req))
+	ctx.Common.SetAccountID(tenant.GetAccountID(req.Context()))
+	for ctx.Read(mr) {
+		if err := ctx.InsertRows(); err != nil {
+			return err
+		}
+	}
+	if err := mr.Err(); err != nil {
+		return err
+	}
+	if ctx.missingMetricNameLines > 0 {
+		logger.Errorf("skipped %d lines without `__name__` label in %q from %s", ctx.missingMetricNameLines, req.URL.Path, req.RemoteAddr)
+	}
+	return ctx.Error()
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	rowsLen := 0
+	for i := range rows {
+		rowsLen += len(rows[i].Values)
+	}
+	ic := &ctx.Common
+	ic.Reset(rowsLen)
+	for i := range rows {
+		r := &rows[i]
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		var metricNameRaw []byte
+		values := r.Values
+		for j, ts := range r.Timestamps {
+			metricNameRaw = ic.WriteDataPointExt(metricNameRaw, ic.Labels, ts, values[j])
+		}
+	}
+	rowsInserted.Add(rowsLen)
+	return ic.FlushBufs()
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	v := gzipReaderPool.Get()
+	if v == nil {
+		return gzip.NewReader(r)
+	}
+	zr := v.(*gzip.Reader)
+	if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+func putGzipReader(zr *gzip.Reader) {
+	_ = zr.Close()
+	gzipReaderPool.Put(zr)
+}
+
+var gzipReaderPool sync.Pool
+
+func (ctx *pushCtx) Read(r io.Reader) bool {
+	if ctx.err != nil {
+		return false
+	}
+	ctx.reqBuf, ctx.tailBuf, ctx.err = common.ReadLinesBlockExt(r, ctx.reqBuf, ctx.tailBuf, *maxLineLen)
+	if ctx.err != nil {
+		if ctx.err != io.EOF {
+			vmimportReadErrors.Inc()
+			ctx.err = fmt.Errorf("cannot read vmimport data: %s", ctx.err)
+		}
+		return false
+	}
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf)); err != nil {
+		vmimportUnmarshalErrors.Inc()
+		ctx.err = fmt.Errorf("cannot unmarshal vmimport data with size %d: %s", len(ctx.reqBuf), err)
+		return false
+	}
+	if n := ctx.Rows.MissingMetricNameLines; n > 0 {
+		missingMetricNameLines.Add(n)
+		ctx.missingMetricNameLines += n
+	}
+	return true
+}
+
+var (
+	vmimportReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="vmimport"}`)
+	vmimportReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="vmimport"}`)
+	vmimportUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="vmimport"}`)
+)
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf  []byte
+	tailBuf []byte
+
+	missingMetricNameLines int
+
+	err error
+}
+
+func (ctx *pushCtx) Error() error {
+	if ctx.err == io.EOF {
+		return nil
+	}
+	return ctx.err
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetRateLimitClient(nil)
+	ctx.Common.SetAccountID("")
+
+	ctx.reqBuf = ctx.reqBuf[:0]
+	ctx.tailBuf = ctx.tailBuf[:0]
+
+	ctx.missingMetricNameLines = 0
+
+	ctx.err = nil
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
@@ -0,0 +1,162 @@
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+// evalConfig is the configuration for target expressions evaluation.
+type evalConfig struct {
+	// Start and End are the time range for the evaluation in milliseconds.
+	Start int64
+	End   int64
+
+	// Step is the interval in milliseconds between datapoints in the fetched series.
+	Step int64
+
+	Deadline netstorage.Deadline
+}
+
+// getTimestamps returns timestamps for datapoints in the fetched series.
+func (ec *evalConfig) getTimestamps() []int64 {
+	var timestamps []int64
+	for ts := ec.Start; ts < ec.End; ts += ec.Step {
+		timestamps = append(timestamps, ts)
+	}
+	return timestamps
+}
+
+// series is a single Graphite series.
+type series struct {
+	Name           string
+	Tags           map[string]string
+	PathExpression string
+
+	// Timestamps contains timestamps in milliseconds with Step interval.
+	// Each datapoint covers [timestamp ... timestamp+Step) time range.
+	Timestamps []int64
+	Values     []float64
+	Step       int64
+}
+
+// setName sets s name and path expression to name.
+func (s *series) setName(name string) {
+	s.Name = name
+	s.PathExpression = name
+}
+
+// sortedTagKeys returns sorted tag keys for s.
+func (s *series) sortedTagKeys() []string {
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// evalExpr returns series for the given Graphite target expression e.
+func evalExpr(ec *evalConfig, e expr) ([]*series, error) {
+	switch t := e.(type) {
+	case *pathExpr:
+		return fetchSeries(ec, t.Path)
+	case *funcExpr:
+		tf := transformFuncs[t.Name]
+		if tf == nil {
+			return nil, fmt.Errorf("unsupported function %q; supported functions: %s", t.Name, strings.Join(supportedFuncNames(), ", "))
+		}
+		ss, err := tf(ec, t)
+		if err != nil {
+			return nil, fmt.Errorf("cannot evaluate %s: %s", exprString(t), err)
+		}
+		return ss, nil
+	default:
+		return nil, fmt.Errorf("expecting series list; got %s", exprString(e))
+	}
+}
+
+func fetchSeries(ec *evalConfig, path string) ([]*series, error) {
+	tf, err := getTagFilterForPath(path)
+	if err != nil {
+		return nil, err
+	}
+	sq := &storage.SearchQuery{
+		MinTimestamp: ec.Start,
+		MaxTimestamp: ec.End - 1,
+		TagFilterss:  [][]storage.TagFilter{{*tf}},
+	}
+	rss, err := netstorage.ProcessSearchQuery(nil, sq, ec.Deadline)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch data for %q: %s", sq, err)
+	}
+	timestamps := ec.getTimestamps()
+	var ssLock sync.Mutex
+	var ss []*series
+	err = rss.RunParallel(func(rs *netstorage.Result) {
+		s := &series{
+			Name:           string(rs.MetricName.MetricGroup),
+			Tags:           getTags(&rs.MetricName),
+			PathExpression: path,
+			Timestamps:     timestamps,
+			Values:         alignValues(timestamps, ec.Step, rs.Timestamps, rs.Values),
+			Step:           ec.Step,
+		}
+		ssLock.Lock()
+		ss = append(ss, s)
+		ssLock.Unlock()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error when fetching data for %q: %s", sq, err)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Name < ss[j].Name
+	})
+	return ss, nil
+}
+
+func getTags(mn *storage.MetricName) map[string]string {
+	tags := make(map[string]string, len(mn.Tags)+1)
+	tags["name"] = string(mn.MetricGroup)
+	for i := range mn.Tags {
+		tag := &mn.Tags[i]
+		tags[string(tag.Key)] = string(tag.Value)
+	}
+	return tags
+}
+
+// alignValues returns values for the given timestamps with the given step.
+//
+// The value for each timestamp is the average of src values on [timestamp ... timestamp+step) time range.
+// NaN is returned for time ranges without src values.
+func alignValues(timestamps []int64, step int64, srcTimestamps []int64, srcValues []float64) []float64 {
+	values := make([]float64, len(timestamps))
+	j := 0
+	for i, ts := range timestamps {
+		for j < len(srcTimestamps) && srcTimestamps[j] < ts {
+			j++
+		}
+		sum := float64(0)
+		n := 0
+		for j < len(srcTimestamps) && srcTimestamps[j] < ts+step {
+			if v := srcValues[j]; !math.IsNaN(v) {
+				sum += v
+				n++
+			}
+			j++
+		}
+		if n == 0 {
+			values[i] = nan
+		} else {
+			values[i] = sum / float64(n)
+		}
+	}
+	return values
+}
+
+var nan = math.NaN()
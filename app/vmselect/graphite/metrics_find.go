@@ -0,0 +1,286 @@
+package graphite
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/prometheus"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// MetricsFindHandler implements /metrics/find handler.
+//
+// See https://graphite.readthedocs.io/en/latest/metrics_api.html#metrics-find
+func MetricsFindHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot parse request form values: %s", err)
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "treejson"
+	}
+	if format != "treejson" && format != "completer" {
+		return fmt.Errorf("unsupported format=%q; supported values: treejson, completer", format)
+	}
+	query := r.FormValue("query")
+	if len(query) == 0 {
+		return fmt.Errorf("missing `query` arg")
+	}
+	wildcards := getBool(r, "wildcards")
+	sep, err := getSeparator()
+	if err != nil {
+		return err
+	}
+	from, until, err := getFindTimeRange(r)
+	if err != nil {
+		return err
+	}
+	nodes, err := findNodes(query, sep, from, until, prometheus.GetDeadline(r))
+	if err != nil {
+		return err
+	}
+	if wildcards && len(nodes) > 1 {
+		// Add a node matching all the nodes at the current tree level.
+		n := strings.LastIndexByte(query, sep)
+		nodes = append(nodes, &node{
+			Path: query[:n+1] + "*",
+			Name: "*",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if format == "completer" {
+		WriteMetricsFindCompleterResponse(w, nodes, sep)
+	} else {
+		WriteMetricsFindTreeJSONResponse(w, nodes)
+	}
+	metricsFindDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var metricsFindDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/metrics/find"}`)
+
+// MetricsExpandHandler implements /metrics/expand handler.
+//
+// See https://graphite.readthedocs.io/en/latest/metrics_api.html#metrics-expand
+func MetricsExpandHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot parse request form values: %s", err)
+	}
+	queries := r.Form["query"]
+	if len(queries) == 0 {
+		return fmt.Errorf("missing `query` arg")
+	}
+	groupByExpr := getBool(r, "groupByExpr")
+	leavesOnly := getBool(r, "leavesOnly")
+	sep, err := getSeparator()
+	if err != nil {
+		return err
+	}
+	from, until, err := getFindTimeRange(r)
+	if err != nil {
+		return err
+	}
+	deadline := prometheus.GetDeadline(r)
+	m := make(map[string][]string, len(queries))
+	for _, query := range queries {
+		nodes, err := findNodes(query, sep, from, until, deadline)
+		if err != nil {
+			return err
+		}
+		paths := m[query]
+		for _, n := range nodes {
+			if leavesOnly && !n.IsLeaf {
+				continue
+			}
+			paths = append(paths, n.Path)
+		}
+		m[query] = paths
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if groupByExpr {
+		for query, paths := range m {
+			m[query] = uniqSorted(paths)
+		}
+		WriteMetricsExpandGroupedResponse(w, m)
+	} else {
+		var paths []string
+		for _, queryPaths := range m {
+			paths = append(paths, queryPaths...)
+		}
+		WriteMetricsExpandResponse(w, uniqSorted(paths))
+	}
+	metricsExpandDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var metricsExpandDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/metrics/expand"}`)
+
+// node is a node in Graphite metrics tree.
+type node struct {
+	// Path is the full path to the node.
+	Path string
+
+	// Name is the last part of Path.
+	Name string
+
+	// IsLeaf is set for nodes, which correspond to metric names.
+	// Other nodes have children.
+	IsLeaf bool
+}
+
+// findNodes returns nodes matching the given Graphite query with nodes delimited by sep
+// for metric names active on the given time range.
+//
+// The number of scanned metric names is limited by -search.maxTagValues and -search.maxUniqueTimeseries.
+func findNodes(query string, sep byte, from, until int64, deadline netstorage.Deadline) ([]*node, error) {
+	re, isRegexp, err := getRegexpForPath(query, sep)
+	if err != nil {
+		return nil, err
+	}
+	if !isRegexp {
+		re = regexp.QuoteMeta(query)
+	}
+	// Match metric names with the query prefix, so children for the matching nodes could be found.
+	re += "(?:" + regexp.QuoteMeta(string(sep)) + ".*)?"
+	if _, err := regexp.Compile("^(?:" + re + ")$"); err != nil {
+		return nil, fmt.Errorf("cannot compile regexp %q obtained from query %q: %s", re, query, err)
+	}
+	sq := &storage.SearchQuery{
+		MinTimestamp: from,
+		MaxTimestamp: until,
+		TagFilterss: [][]storage.TagFilter{{{
+			Value:    []byte(re),
+			IsRegexp: true,
+		}}},
+	}
+	names, err := netstorage.GetLabelValuesOnTimeRange("__name__", sq, deadline)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find metric names for query=%q: %s", query, err)
+	}
+	return getNodesFromNames(names, getNodesCount(query, sep), sep), nil
+}
+
+// getNodesFromNames returns nodes at the given tree depth for the given metric names.
+//
+// The returned nodes are sorted by path. Non-leaf nodes go before leaf nodes with the same path.
+func getNodesFromNames(names []string, depth int, sep byte) []*node {
+	type nodeKey struct {
+		path   string
+		isLeaf bool
+	}
+	m := make(map[nodeKey]struct{})
+	var nodes []*node
+	for _, name := range names {
+		n := 0
+		parts := 0
+		for parts < depth && n <= len(name) {
+			i := strings.IndexByte(name[n:], sep)
+			if i < 0 {
+				n = len(name) + 1
+			} else {
+				n += i + 1
+			}
+			parts++
+		}
+		if parts < depth {
+			continue
+		}
+		path := name
+		isLeaf := n > len(name)
+		if !isLeaf {
+			path = name[:n-1]
+		}
+		k := nodeKey{
+			path:   path,
+			isLeaf: isLeaf,
+		}
+		if _, ok := m[k]; ok {
+			continue
+		}
+		m[k] = struct{}{}
+		nodes = append(nodes, &node{
+			Path:   path,
+			Name:   path[strings.LastIndexByte(path, sep)+1:],
+			IsLeaf: isLeaf,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return !a.IsLeaf && b.IsLeaf
+	})
+	return nodes
+}
+
+// getNodesCount returns the number of nodes in Graphite query.
+//
+// Separators inside `{...}` and `[...]` aren't counted.
+func getNodesCount(query string, sep byte) int {
+	n := 1
+	braces := 0
+	brackets := false
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '{':
+			braces++
+		case c == '}' && braces > 0:
+			braces--
+		case c == '[':
+			brackets = true
+		case c == ']':
+			brackets = false
+		case c == sep && braces == 0 && !brackets:
+			n++
+		}
+	}
+	return n
+}
+
+func getFindTimeRange(r *http.Request) (int64, int64, error) {
+	now := time.Now().UnixNano() / 1e6
+	from, err := getTimeArg(r, "from", "0", now)
+	if err != nil {
+		return 0, 0, err
+	}
+	until, err := getTimeArg(r, "until", "now", now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > until {
+		return 0, 0, fmt.Errorf("from=%q cannot exceed until=%q", r.FormValue("from"), r.FormValue("until"))
+	}
+	return from, until, nil
+}
+
+func uniqSorted(a []string) []string {
+	sort.Strings(a)
+	dst := a[:0]
+	for i, s := range a {
+		if i > 0 && s == a[i-1] {
+			continue
+		}
+		dst = append(dst, s)
+	}
+	return dst
+}
+
+func getBool(r *http.Request, argKey string) bool {
+	switch strings.ToLower(r.FormValue(argKey)) {
+	case "", "0", "f", "false", "no":
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,51 @@
+package graphite
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestGetNodesCount(t *testing.T) {
+	f := func(query string, sep byte, nExpected int) {
+		t.Helper()
+		n := getNodesCount(query, sep)
+		if n != nExpected {
+			t.Fatalf("unexpected nodes count for query=%q; got %d; want %d", query, n, nExpected)
+		}
+	}
+	f("*", '.', 1)
+	f("foo", '.', 1)
+	f("foo.bar", '.', 2)
+	f("node.*.cpu", '.', 3)
+	f("foo.{bar.baz,x}.y", '.', 3)
+	f("foo.[.a].y", '.', 3)
+	f("foo_*_bar", '_', 3)
+	f("foo.bar", '_', 1)
+}
+
+func TestGetNodesFromNames(t *testing.T) {
+	f := func(names []string, depth int, sep byte, resultExpected []string) {
+		t.Helper()
+		nodes := getNodesFromNames(names, depth, sep)
+		var result []string
+		for _, n := range nodes {
+			result = append(result, fmt.Sprintf("%s,%s,%v", n.Path, n.Name, n.IsLeaf))
+		}
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected nodes for names=%q, depth=%d;\ngot\n%q\nwant\n%q", names, depth, result, resultExpected)
+		}
+	}
+	f(nil, 1, '.', nil)
+	f([]string{"foo"}, 2, '.', nil)
+	f([]string{"foo"}, 1, '.', []string{"foo,foo,true"})
+	f([]string{"node.a.cpu", "node.b.cpu", "node.a.mem"}, 1, '.', []string{"node,node,false"})
+	f([]string{"node.b.cpu", "node.a.cpu", "node.a.mem"}, 2, '.', []string{"node.a,a,false", "node.b,b,false"})
+	f([]string{"node.b.cpu", "node.a.cpu", "node.a.cpu.user", "node.a"}, 3, '.', []string{
+		"node.a.cpu,cpu,false",
+		"node.a.cpu,cpu,true",
+		"node.b.cpu,cpu,true",
+	})
+	f([]string{"node.a", "node.a.cpu"}, 2, '.', []string{"node.a,a,false", "node.a,a,true"})
+	f([]string{"node_a_cpu", "node_b"}, 2, '_', []string{"node_a,a,false", "node_b,b,true"})
+}
@@ -0,0 +1,263 @@
+package graphite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expr is a parsed Graphite target expression.
+//
+// See https://graphite.readthedocs.io/en/latest/render_api.html#target
+type expr interface {
+	// AppendString appends string representation of expr to dst.
+	AppendString(dst []byte) []byte
+}
+
+// pathExpr is a metric path such as `foo.*.bar.{baz,qux}`.
+type pathExpr struct {
+	Path string
+}
+
+// AppendString appends string representation of pe to dst.
+func (pe *pathExpr) AppendString(dst []byte) []byte {
+	return append(dst, pe.Path...)
+}
+
+// funcExpr is a function call such as `sumSeries(foo.*)`.
+type funcExpr struct {
+	Name string
+	Args []*argExpr
+}
+
+// AppendString appends string representation of fe to dst.
+func (fe *funcExpr) AppendString(dst []byte) []byte {
+	dst = append(dst, fe.Name...)
+	dst = append(dst, '(')
+	for i, arg := range fe.Args {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		if arg.Name != "" {
+			dst = append(dst, arg.Name...)
+			dst = append(dst, '=')
+		}
+		dst = arg.Expr.AppendString(dst)
+	}
+	dst = append(dst, ')')
+	return dst
+}
+
+// argExpr is a function arg. Name is set for keyword args such as `func="sum"`.
+type argExpr struct {
+	Name string
+	Expr expr
+}
+
+// stringExpr is a quoted string.
+type stringExpr struct {
+	S string
+}
+
+// AppendString appends string representation of se to dst.
+func (se *stringExpr) AppendString(dst []byte) []byte {
+	return strconv.AppendQuote(dst, se.S)
+}
+
+// numberExpr is a numeric literal.
+type numberExpr struct {
+	N float64
+}
+
+// AppendString appends string representation of ne to dst.
+func (ne *numberExpr) AppendString(dst []byte) []byte {
+	return strconv.AppendFloat(dst, ne.N, 'g', -1, 64)
+}
+
+// boolExpr is `true` or `false` literal.
+type boolExpr struct {
+	B bool
+}
+
+// AppendString appends string representation of be to dst.
+func (be *boolExpr) AppendString(dst []byte) []byte {
+	return strconv.AppendBool(dst, be.B)
+}
+
+func exprString(e expr) string {
+	return string(e.AppendString(nil))
+}
+
+// parseExpr parses Graphite target expression s.
+func parseExpr(s string) (expr, error) {
+	e, tail, err := parseExprInternal(s)
+	if err != nil {
+		return nil, err
+	}
+	tail = skipSpaces(tail)
+	if len(tail) > 0 {
+		return nil, fmt.Errorf("unparsed tail left after parsing %q: %q", s, tail)
+	}
+	return e, nil
+}
+
+func parseExprInternal(s string) (expr, string, error) {
+	s = skipSpaces(s)
+	if len(s) == 0 {
+		return nil, s, fmt.Errorf("missing expression")
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		str, tail, err := parseString(s)
+		if err != nil {
+			return nil, s, err
+		}
+		return &stringExpr{S: str}, tail, nil
+	}
+	token, tail := scanToken(s)
+	if len(token) == 0 {
+		return nil, s, fmt.Errorf("unexpected char %q at %q", s[0], s)
+	}
+	tail = skipSpaces(tail)
+	if len(tail) > 0 && tail[0] == '(' {
+		if !isFuncName(token) {
+			return nil, s, fmt.Errorf("invalid function name %q", token)
+		}
+		args, tail, err := parseArgs(tail[1:])
+		if err != nil {
+			return nil, s, fmt.Errorf("cannot parse args for %q: %s", token, err)
+		}
+		return &funcExpr{
+			Name: token,
+			Args: args,
+		}, tail, nil
+	}
+	switch token {
+	case "true", "True":
+		return &boolExpr{B: true}, tail, nil
+	case "false", "False":
+		return &boolExpr{B: false}, tail, nil
+	}
+	if n, err := strconv.ParseFloat(token, 64); err == nil {
+		return &numberExpr{N: n}, tail, nil
+	}
+	return &pathExpr{Path: token}, tail, nil
+}
+
+func parseArgs(s string) ([]*argExpr, string, error) {
+	var args []*argExpr
+	s = skipSpaces(s)
+	if len(s) > 0 && s[0] == ')' {
+		return args, s[1:], nil
+	}
+	for {
+		arg := &argExpr{}
+		s = skipSpaces(s)
+		if name, tail := scanToken(s); isFuncName(name) {
+			if tail = skipSpaces(tail); len(tail) > 0 && tail[0] == '=' {
+				arg.Name = name
+				s = tail[1:]
+			}
+		}
+		e, tail, err := parseExprInternal(s)
+		if err != nil {
+			return nil, s, err
+		}
+		arg.Expr = e
+		args = append(args, arg)
+		s = skipSpaces(tail)
+		if len(s) == 0 {
+			return nil, s, fmt.Errorf("missing closing ')'")
+		}
+		switch s[0] {
+		case ',':
+			s = s[1:]
+		case ')':
+			return args, s[1:], nil
+		default:
+			return nil, s, fmt.Errorf("unexpected char %q at %q; want ',' or ')'", s[0], s)
+		}
+	}
+}
+
+// scanToken returns the longest prefix of s, which may be a function name, a number or a metric path.
+//
+// Commas inside curly braces are part of the token, since they belong to `{a,b}` path wildcard.
+func scanToken(s string) (string, string) {
+	braces := 0
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		if c == '{' {
+			braces++
+		} else if c == '}' && braces > 0 {
+			braces--
+		} else if braces == 0 && !isTokenChar(c) {
+			break
+		}
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isTokenChar(c byte) bool {
+	switch c {
+	case '(', ')', ',', '=', '"', '\'', ' ', '\t', '\n', '\r':
+		return false
+	default:
+		return true
+	}
+}
+
+func isFuncName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func parseString(s string) (string, string, error) {
+	quote := s[0]
+	i := 1
+	for i < len(s) {
+		switch s[i] {
+		case '\\':
+			i += 2
+			continue
+		case quote:
+			str := s[1:i]
+			if strings.IndexByte(str, '\\') >= 0 {
+				str = unescapeString(str)
+			}
+			return str, s[i+1:], nil
+		}
+		i++
+	}
+	return "", s, fmt.Errorf("missing closing quote in %q", s)
+}
+
+func unescapeString(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			c = s[i]
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+func skipSpaces(s string) string {
+	for len(s) > 0 && (s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r') {
+		s = s[1:]
+	}
+	return s
+}
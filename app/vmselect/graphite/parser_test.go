@@ -0,0 +1,58 @@
+package graphite
+
+import (
+	"testing"
+)
+
+func TestParseExprSuccess(t *testing.T) {
+	f := func(s, resultExpected string) {
+		t.Helper()
+		e, err := parseExpr(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		result := exprString(e)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q;\ngot\n%s\nwant\n%s", s, result, resultExpected)
+		}
+	}
+
+	// Paths
+	f("foo", "foo")
+	f("foo.bar.baz", "foo.bar.baz")
+	f(" foo.*.b?r ", "foo.*.b?r")
+	f("foo.{bar,baz}.[a-z]x", "foo.{bar,baz}.[a-z]x")
+	f("foo-bar.1min:x", "foo-bar.1min:x")
+
+	// Functions
+	f("sumSeries(foo.*)", "sumSeries(foo.*)")
+	f("sumSeries( foo.* , bar.{a,b} )", "sumSeries(foo.*,bar.{a,b})")
+	f("scale(foo, 1.5)", "scale(foo,1.5)")
+	f("scale(foo, -2e3)", "scale(foo,-2000)")
+	f(`alias(foo, "bar baz")`, `alias(foo,"bar baz")`)
+	f(`alias(foo, 'bar\'s')`, `alias(foo,"bar's")`)
+	f(`summarize(foo.bar, "1h", func="max", alignToFrom=true)`, `summarize(foo.bar,"1h",func="max",alignToFrom=true)`)
+	f("aliasByNode(scale(foo.*.bar, 10), 1, -1)", "aliasByNode(scale(foo.*.bar,10),1,-1)")
+	f("group()", "group()")
+}
+
+func TestParseExprFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		e, err := parseExpr(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q; got %s", s, exprString(e))
+		}
+	}
+	f("")
+	f("   ")
+	f("foo bar")
+	f("(foo)")
+	f("sumSeries(foo")
+	f("sumSeries(foo,")
+	f("sumSeries(foo bar)")
+	f("sumSeries(foo))")
+	f(`alias(foo, "bar)`)
+	f("foo.bar(baz)")
+	f(`summarize(foo, func=)`)
+}
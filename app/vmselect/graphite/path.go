@@ -0,0 +1,106 @@
+package graphite
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+var separator = flag.String("search.graphiteSeparator", ".", "The separator between nodes in Graphite metric names. It is used by Graphite API handlers for matching `*` and `?` wildcards "+
+	"and for splitting metric names into tree levels at /metrics/find")
+
+func getSeparator() (byte, error) {
+	if len(*separator) != 1 {
+		return 0, fmt.Errorf("-search.graphiteSeparator must contain a single char; got %q", *separator)
+	}
+	return (*separator)[0], nil
+}
+
+// getTagFilterForPath returns tag filter on metric name for the given Graphite path.
+//
+// The path may contain the following wildcards:
+//
+//   - `*` matches any number of chars inside a single path node
+//   - `?` matches a single char inside a single path node
+//   - `[...]` matches a single char from the given set
+//   - `{a,b}` matches any of the given values
+//
+// See https://graphite.readthedocs.io/en/latest/render_api.html#paths-and-wildcards
+func getTagFilterForPath(path string) (*storage.TagFilter, error) {
+	sep, err := getSeparator()
+	if err != nil {
+		return nil, err
+	}
+	re, isRegexp, err := getRegexpForPath(path, sep)
+	if err != nil {
+		return nil, err
+	}
+	if !isRegexp {
+		return &storage.TagFilter{
+			Value: []byte(path),
+		}, nil
+	}
+	if _, err := regexp.Compile("^(?:" + re + ")$"); err != nil {
+		return nil, fmt.Errorf("cannot compile regexp %q obtained from path %q: %s", re, path, err)
+	}
+	return &storage.TagFilter{
+		Value:    []byte(re),
+		IsRegexp: true,
+	}, nil
+}
+
+// getRegexpForPath converts Graphite path with nodes delimited by sep to regexp.
+//
+// The returned bool is false if path has no wildcards.
+func getRegexpForPath(path string, sep byte) (string, bool, error) {
+	if len(path) == 0 {
+		return "", false, fmt.Errorf("path cannot be empty")
+	}
+	if strings.IndexAny(path, "*?[{") < 0 {
+		return "", false, nil
+	}
+	anyCharInNode := "[^" + regexp.QuoteMeta(string(sep)) + "]"
+	var b []byte
+	braces := 0
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '*':
+			b = append(b, anyCharInNode...)
+			b = append(b, '*')
+		case '?':
+			b = append(b, anyCharInNode...)
+		case '[':
+			n := strings.IndexByte(path[i:], ']')
+			if n < 0 {
+				return "", false, fmt.Errorf("missing closing ']' in path %q", path)
+			}
+			b = append(b, path[i:i+n+1]...)
+			i += n
+		case '{':
+			braces++
+			b = append(b, "(?:"...)
+		case '}':
+			if braces == 0 {
+				return "", false, fmt.Errorf("unexpected '}' in path %q", path)
+			}
+			braces--
+			b = append(b, ')')
+		case ',':
+			if braces > 0 {
+				b = append(b, '|')
+			} else {
+				b = append(b, ',')
+			}
+		default:
+			b = append(b, regexp.QuoteMeta(path[i:i+1])...)
+		}
+	}
+	if braces > 0 {
+		return "", false, fmt.Errorf("missing closing '}' in path %q", path)
+	}
+	return string(b), true, nil
+}
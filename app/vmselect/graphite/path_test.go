@@ -0,0 +1,76 @@
+package graphite
+
+import (
+	"testing"
+)
+
+func TestGetRegexpForPathSuccess(t *testing.T) {
+	f := func(path, reExpected string, isRegexpExpected bool) {
+		t.Helper()
+		re, isRegexp, err := getRegexpForPath(path, '.')
+		if err != nil {
+			t.Fatalf("unexpected error for path=%q: %s", path, err)
+		}
+		if isRegexp != isRegexpExpected {
+			t.Fatalf("unexpected isRegexp for path=%q; got %v; want %v", path, isRegexp, isRegexpExpected)
+		}
+		if re != reExpected {
+			t.Fatalf("unexpected regexp for path=%q; got %q; want %q", path, re, reExpected)
+		}
+	}
+	f("foo", "", false)
+	f("foo.bar-baz", "", false)
+	f("foo.*", `foo\.[^\.]*`, true)
+	f("foo.b?r", `foo\.b[^\.]r`, true)
+	f("foo.[a-c]x", `foo\.[a-c]x`, true)
+	f("foo.{bar,baz}.x+y", `foo\.(?:bar|baz)\.x\+y`, true)
+	f("{a,b{c,d}}", `(?:a|b(?:c|d))`, true)
+
+	// Non-default separator
+	re, _, err := getRegexpForPath("foo_*_b?r", '_')
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reExpected := `foo_[^_]*_b[^_]r`; re != reExpected {
+		t.Fatalf("unexpected regexp for non-default separator; got %q; want %q", re, reExpected)
+	}
+}
+
+func TestGetRegexpForPathFailure(t *testing.T) {
+	f := func(path string) {
+		t.Helper()
+		if _, _, err := getRegexpForPath(path, '.'); err == nil {
+			t.Fatalf("expecting non-nil error for path=%q", path)
+		}
+	}
+	f("")
+	f("foo.[ab")
+	f("foo.{a,b")
+	f("foo.{a}}")
+}
+
+func TestGetTagFilterForPath(t *testing.T) {
+	f := func(path, valueExpected string, isRegexpExpected bool) {
+		t.Helper()
+		tf, err := getTagFilterForPath(path)
+		if err != nil {
+			t.Fatalf("unexpected error for path=%q: %s", path, err)
+		}
+		if len(tf.Key) > 0 {
+			t.Fatalf("unexpected key for path=%q; got %q; want empty key", path, tf.Key)
+		}
+		if string(tf.Value) != valueExpected {
+			t.Fatalf("unexpected value for path=%q; got %q; want %q", path, tf.Value, valueExpected)
+		}
+		if tf.IsRegexp != isRegexpExpected {
+			t.Fatalf("unexpected IsRegexp for path=%q; got %v; want %v", path, tf.IsRegexp, isRegexpExpected)
+		}
+	}
+	f("foo.bar", "foo.bar", false)
+	f("foo.*", `foo\.[^\.]*`, true)
+
+	// Invalid regexp
+	if _, err := getTagFilterForPath("foo.[z-a]"); err == nil {
+		t.Fatalf("expecting non-nil error for invalid char range")
+	}
+}
@@ -0,0 +1,105 @@
+package graphite
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/prometheus"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	storageStep        = flag.Duration("search.graphiteStorageStep", 10*time.Second, "The interval between datapoints in Graphite series returned from /render API. It must match the interval between the ingested Graphite samples")
+	maxPointsPerSeries = flag.Int("search.graphiteMaxPointsPerSeries", 1e6, "The maximum number of points per series Graphite /render API can return")
+)
+
+// RenderHandler implements Graphite /render API.
+//
+// Only `format=json` is supported.
+//
+// See https://graphite.readthedocs.io/en/latest/render_api.html
+func RenderHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot parse request form values: %s", err)
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "json" {
+		return fmt.Errorf("unsupported format=%q; only format=json is supported", format)
+	}
+	now := time.Now().UnixNano() / 1e6
+	from, err := getTimeArg(r, "from", "-24h", now)
+	if err != nil {
+		return err
+	}
+	until, err := getTimeArg(r, "until", "now", now)
+	if err != nil {
+		return err
+	}
+	if from >= until {
+		return fmt.Errorf("from=%q must be smaller than until=%q", r.FormValue("from"), r.FormValue("until"))
+	}
+	step := int64(*storageStep / time.Millisecond)
+	if step <= 0 {
+		return fmt.Errorf("-search.graphiteStorageStep must be positive; got %s", *storageStep)
+	}
+	if s := r.FormValue("maxDataPoints"); len(s) > 0 {
+		maxDataPoints, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse maxDataPoints=%q: %s", s, err)
+		}
+		if maxDataPoints > 0 {
+			// Increase the step to a multiple of the storage step, so the number of points doesn't exceed maxDataPoints.
+			if n := int64(math.Ceil(float64(until-from) / maxDataPoints)); n > step {
+				step = (n + step - 1) / step * step
+			}
+		}
+	}
+	if points := (until - from) / step; points > int64(*maxPointsPerSeries) {
+		return fmt.Errorf("too many points per series must be returned for the given from=%q, until=%q and step=%dms: %d; the limit is %d; "+
+			"either increase -search.graphiteMaxPointsPerSeries or pass smaller maxDataPoints",
+			r.FormValue("from"), r.FormValue("until"), step, points, *maxPointsPerSeries)
+	}
+	ec := &evalConfig{
+		Start:    from - from%step,
+		End:      until,
+		Step:     step,
+		Deadline: prometheus.GetDeadline(r),
+	}
+	targets := r.Form["target"]
+	var ss []*series
+	for _, target := range targets {
+		e, err := parseExpr(target)
+		if err != nil {
+			return fmt.Errorf("cannot parse target=%q: %s", target, err)
+		}
+		ssTarget, err := evalExpr(ec, e)
+		if err != nil {
+			return fmt.Errorf("cannot evaluate target=%q: %s", target, err)
+		}
+		ss = append(ss, ssTarget...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	WriteRenderJSONResponse(w, ss)
+	renderDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var renderDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/render"}`)
+
+func getTimeArg(r *http.Request, argKey, defaultValue string, now int64) (int64, error) {
+	s := r.FormValue(argKey)
+	if len(s) == 0 {
+		s = defaultValue
+	}
+	t, err := parseTime(s, now)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s=%q: %s", argKey, s, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,89 @@
+package graphite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTime parses Graphite `from` or `until` value and returns it in milliseconds.
+//
+// The following formats are supported:
+//
+//   - `now`
+//   - relative time such as `-1h`, `-5min` or `-2d` from now
+//   - Unix timestamp in seconds
+//   - `HH:MM_YYYYMMDD` and `YYYYMMDD` absolute time in UTC
+//
+// See https://graphite.readthedocs.io/en/latest/render_api.html#from-until
+func parseTime(s string, now int64) (int64, error) {
+	switch s {
+	case "now":
+		return now, nil
+	case "today":
+		return now - now%(24*3600*1000), nil
+	case "yesterday":
+		return now - now%(24*3600*1000) - 24*3600*1000, nil
+	}
+	if strings.HasPrefix(s, "now") {
+		s = s[len("now"):]
+	}
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		d, err := parseInterval(s[1:])
+		if err != nil {
+			return 0, err
+		}
+		if s[0] == '-' {
+			d = -d
+		}
+		return now + d, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) != len("YYYYMMDD") {
+		return secs * 1000, nil
+	}
+	for _, layout := range []string{"15:04_20060102", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano() / 1e6, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot parse time %q; supported formats: now, -1h, Unix timestamp in seconds, HH:MM_YYYYMMDD, YYYYMMDD", s)
+}
+
+// parseInterval parses Graphite interval such as `5min` or `1d` and returns it in milliseconds.
+func parseInterval(s string) (int64, error) {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("missing number in interval %q", s)
+	}
+	v, err := strconv.ParseInt(s[:n], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse number in interval %q: %s", s, err)
+	}
+	unit := strings.TrimSpace(s[n:])
+	msecs, ok := intervalUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unsupported unit %q in interval %q; supported units: s, min, h, d, w, mon, y", unit, s)
+	}
+	return v * msecs, nil
+}
+
+var intervalUnits = func() map[string]int64 {
+	m := make(map[string]int64)
+	add := func(msecs int64, names ...string) {
+		for _, name := range names {
+			m[name] = msecs
+		}
+	}
+	add(1000, "s", "sec", "secs", "second", "seconds")
+	add(60*1000, "min", "mins", "minute", "minutes")
+	add(3600*1000, "h", "hour", "hours")
+	add(24*3600*1000, "d", "day", "days")
+	add(7*24*3600*1000, "w", "week", "weeks")
+	add(30*24*3600*1000, "mon", "month", "months")
+	add(365*24*3600*1000, "y", "year", "years")
+	return m
+}()
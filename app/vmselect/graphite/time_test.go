@@ -0,0 +1,66 @@
+package graphite
+
+import (
+	"testing"
+)
+
+func TestParseTimeSuccess(t *testing.T) {
+	now := int64(1600000000123)
+	f := func(s string, resultExpected int64) {
+		t.Helper()
+		result, err := parseTime(s, now)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %d; want %d", s, result, resultExpected)
+		}
+	}
+	f("now", now)
+	f("-1h", now-3600*1000)
+	f("now-5min", now-5*60*1000)
+	f("+10s", now+10*1000)
+	f("-2days", now-2*24*3600*1000)
+	f("-1w", now-7*24*3600*1000)
+	f("-1mon", now-30*24*3600*1000)
+	f("-1y", now-365*24*3600*1000)
+	f("1500000000", 1500000000*1000)
+	f("20200913", 1599955200*1000)
+	f("12:26_20200913", 1599999960*1000)
+	f("today", 1599955200*1000)
+	f("yesterday", 1599868800*1000)
+}
+
+func TestParseTimeFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseTime(s, 0); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f("")
+	f("foo")
+	f("-")
+	f("-1")
+	f("-1foo")
+	f("-h")
+	f("12:26_2020")
+}
+
+func TestParseInterval(t *testing.T) {
+	f := func(s string, resultExpected int64) {
+		t.Helper()
+		result, err := parseInterval(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %d; want %d", s, result, resultExpected)
+		}
+	}
+	f("1s", 1000)
+	f("30sec", 30*1000)
+	f("5min", 5*60*1000)
+	f("2hours", 2*3600*1000)
+	f("1d", 24*3600*1000)
+}
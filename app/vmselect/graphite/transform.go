@@ -0,0 +1,651 @@
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+type transformFunc func(ec *evalConfig, fe *funcExpr) ([]*series, error)
+
+// transformFuncs contains the supported Graphite functions.
+//
+// It is initialized in init, since transform funcs refer to transformFuncs via evalExpr.
+//
+// See https://graphite.readthedocs.io/en/latest/functions.html
+var transformFuncs map[string]transformFunc
+
+func init() {
+	transformFuncs = map[string]transformFunc{
+		"absolute":              transformAbsolute,
+		"alias":                 transformAlias,
+		"aliasByNode":           transformAliasByNode,
+		"averageSeries":         newAggrFunc("average", aggrAvg),
+		"avg":                   newAggrFunc("average", aggrAvg),
+		"derivative":            transformDerivative,
+		"group":                 transformGroup,
+		"keepLastValue":         transformKeepLastValue,
+		"limit":                 transformLimit,
+		"maxSeries":             newAggrFunc("max", aggrMax),
+		"minSeries":             newAggrFunc("min", aggrMin),
+		"nonNegativeDerivative": newNonNegativeDerivativeFunc(false),
+		"offset":                transformOffset,
+		"perSecond":             newNonNegativeDerivativeFunc(true),
+		"scale":                 transformScale,
+		"sortByName":            transformSortByName,
+		"sum":                   newAggrFunc("sum", aggrSum),
+		"sumSeries":             newAggrFunc("sum", aggrSum),
+		"summarize":             transformSummarize,
+		"transformNull":         transformTransformNull,
+	}
+}
+
+func supportedFuncNames() []string {
+	names := make([]string, 0, len(transformFuncs))
+	for name := range transformFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkArgs verifies that fe contains at least minArgs args
+// and that all its args may be matched against argNames.
+func checkArgs(fe *funcExpr, minArgs int, argNames ...string) error {
+	if len(fe.Args) < minArgs {
+		return fmt.Errorf("expecting at least %d args; got %d args", minArgs, len(fe.Args))
+	}
+	if len(fe.Args) > len(argNames) {
+		return fmt.Errorf("expecting at most %d args; got %d args", len(argNames), len(fe.Args))
+	}
+	for i, arg := range fe.Args {
+		if arg.Name == "" {
+			continue
+		}
+		n := indexOf(argNames, arg.Name)
+		if n < 0 {
+			return fmt.Errorf("unknown arg %q; supported args: %s", arg.Name, strings.Join(argNames, ", "))
+		}
+		if n < i {
+			return fmt.Errorf("arg %q is already passed as positional arg", arg.Name)
+		}
+	}
+	return nil
+}
+
+func indexOf(a []string, s string) int {
+	for i, v := range a {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// getArg returns the arg at position n or the keyword arg with the given name.
+//
+// nil is returned if the arg is missing.
+func getArg(fe *funcExpr, n int, name string) expr {
+	for _, arg := range fe.Args {
+		if arg.Name == name {
+			return arg.Expr
+		}
+	}
+	if n < len(fe.Args) && fe.Args[n].Name == "" {
+		return fe.Args[n].Expr
+	}
+	return nil
+}
+
+func getSeriesListArg(ec *evalConfig, fe *funcExpr, n int, name string) ([]*series, error) {
+	e := getArg(fe, n, name)
+	if e == nil {
+		return nil, fmt.Errorf("missing %q arg", name)
+	}
+	return evalExpr(ec, e)
+}
+
+func getNumberArg(fe *funcExpr, n int, name string, defaultValue float64) (float64, error) {
+	e := getArg(fe, n, name)
+	if e == nil {
+		return defaultValue, nil
+	}
+	ne, ok := e.(*numberExpr)
+	if !ok {
+		return 0, fmt.Errorf("%q arg must be a number; got %s", name, exprString(e))
+	}
+	return ne.N, nil
+}
+
+func getStringArg(fe *funcExpr, n int, name string, defaultValue string) (string, error) {
+	e := getArg(fe, n, name)
+	if e == nil {
+		return defaultValue, nil
+	}
+	se, ok := e.(*stringExpr)
+	if !ok {
+		return "", fmt.Errorf("%q arg must be a string; got %s", name, exprString(e))
+	}
+	return se.S, nil
+}
+
+func getBoolArg(fe *funcExpr, n int, name string, defaultValue bool) (bool, error) {
+	e := getArg(fe, n, name)
+	if e == nil {
+		return defaultValue, nil
+	}
+	be, ok := e.(*boolExpr)
+	if !ok {
+		return false, fmt.Errorf("%q arg must be a bool; got %s", name, exprString(e))
+	}
+	return be.B, nil
+}
+
+// transformSeries applies f to every series returned from the seriesList arg of fe.
+func transformSeries(ec *evalConfig, fe *funcExpr, f func(s *series)) ([]*series, error) {
+	ss, err := getSeriesListArg(ec, fe, 0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ss {
+		f(s)
+	}
+	return ss, nil
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.absolute
+func transformAbsolute(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 1, "seriesList"); err != nil {
+		return nil, err
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		for i, v := range s.Values {
+			s.Values[i] = math.Abs(v)
+		}
+		s.setName(fmt.Sprintf("absolute(%s)", s.Name))
+	})
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.alias
+func transformAlias(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 2, "seriesList", "newName"); err != nil {
+		return nil, err
+	}
+	newName, err := getStringArg(fe, 1, "newName", "")
+	if err != nil {
+		return nil, err
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		s.Name = newName
+	})
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.aliasByNode
+func transformAliasByNode(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if len(fe.Args) < 2 {
+		return nil, fmt.Errorf("expecting at least 2 args; got %d args", len(fe.Args))
+	}
+	nodes := fe.Args[1:]
+	for _, node := range nodes {
+		if node.Name != "" {
+			return nil, fmt.Errorf("unexpected keyword arg %q", node.Name)
+		}
+		switch node.Expr.(type) {
+		case *numberExpr, *stringExpr:
+		default:
+			return nil, fmt.Errorf("node must be either a number or a tag name; got %s", exprString(node.Expr))
+		}
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		parts := strings.Split(getPathFromName(s.Name), ".")
+		var dst []string
+		for _, node := range nodes {
+			switch t := node.Expr.(type) {
+			case *numberExpr:
+				n := int(t.N)
+				if n < 0 {
+					n += len(parts)
+				}
+				if n >= 0 && n < len(parts) {
+					dst = append(dst, parts[n])
+				}
+			case *stringExpr:
+				dst = append(dst, s.Tags[t.S])
+			}
+		}
+		s.Name = strings.Join(dst, ".")
+	})
+}
+
+// getPathFromName returns the first metric path from series name such as `scale(foo.bar,10)`.
+func getPathFromName(name string) string {
+	if n := strings.LastIndexByte(name, '('); n >= 0 {
+		name = name[n+1:]
+	}
+	if n := strings.IndexAny(name, ",)"); n >= 0 {
+		name = name[:n]
+	}
+	return name
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.derivative
+func transformDerivative(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 1, "seriesList"); err != nil {
+		return nil, err
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		prev := nan
+		for i, v := range s.Values {
+			s.Values[i] = v - prev
+			prev = v
+		}
+		s.setName(fmt.Sprintf("derivative(%s)", s.Name))
+	})
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.nonNegativeDerivative
+// and https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.perSecond
+func newNonNegativeDerivativeFunc(perSecond bool) transformFunc {
+	funcName := "nonNegativeDerivative"
+	if perSecond {
+		funcName = "perSecond"
+	}
+	return func(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+		if err := checkArgs(fe, 1, "seriesList", "maxValue"); err != nil {
+			return nil, err
+		}
+		maxValue, err := getNumberArg(fe, 1, "maxValue", nan)
+		if err != nil {
+			return nil, err
+		}
+		return transformSeries(ec, fe, func(s *series) {
+			prev := nan
+			for i, v := range s.Values {
+				d := getNonNegativeDelta(v, prev, maxValue)
+				if perSecond {
+					d /= float64(s.Step) / 1e3
+				}
+				s.Values[i] = d
+				prev = v
+			}
+			s.setName(fmt.Sprintf("%s(%s)", funcName, s.Name))
+		})
+	}
+}
+
+func getNonNegativeDelta(v, prev, maxValue float64) float64 {
+	if math.IsNaN(v) || math.IsNaN(prev) {
+		return nan
+	}
+	if v >= prev {
+		return v - prev
+	}
+	if !math.IsNaN(maxValue) && maxValue >= v {
+		// The counter wrapped at maxValue.
+		return maxValue - prev + v + 1
+	}
+	return nan
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.group
+func transformGroup(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	return getSeriesListsArgs(ec, fe)
+}
+
+func getSeriesListsArgs(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	for _, arg := range fe.Args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("unexpected keyword arg %q", arg.Name)
+		}
+	}
+	var ss []*series
+	for _, arg := range fe.Args {
+		ssArg, err := evalExpr(ec, arg.Expr)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, ssArg...)
+	}
+	return ss, nil
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.keepLastValue
+func transformKeepLastValue(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 1, "seriesList", "limit"); err != nil {
+		return nil, err
+	}
+	limit, err := getNumberArg(fe, 1, "limit", math.Inf(1))
+	if err != nil {
+		return nil, err
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		values := s.Values
+		lastValue := nan
+		gapStart := -1
+		fillGap := func(end int) {
+			if gapStart >= 0 && float64(end-gapStart) <= limit && !math.IsNaN(lastValue) {
+				for j := gapStart; j < end; j++ {
+					values[j] = lastValue
+				}
+			}
+			gapStart = -1
+		}
+		for i, v := range values {
+			if math.IsNaN(v) {
+				if gapStart < 0 {
+					gapStart = i
+				}
+				continue
+			}
+			fillGap(i)
+			lastValue = v
+		}
+		fillGap(len(values))
+		s.setName(fmt.Sprintf("keepLastValue(%s)", s.Name))
+	})
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.limit
+func transformLimit(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 2, "seriesList", "n"); err != nil {
+		return nil, err
+	}
+	n, err := getNumberArg(fe, 1, "n", 0)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := getSeriesListArg(ec, fe, 0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		n = 0
+	}
+	if int(n) < len(ss) {
+		ss = ss[:int(n)]
+	}
+	return ss, nil
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.offset
+func transformOffset(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 2, "seriesList", "factor"); err != nil {
+		return nil, err
+	}
+	factor, err := getNumberArg(fe, 1, "factor", 0)
+	if err != nil {
+		return nil, err
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		for i, v := range s.Values {
+			s.Values[i] = v + factor
+		}
+		s.setName(fmt.Sprintf("offset(%s,%g)", s.Name, factor))
+	})
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.scale
+func transformScale(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 2, "seriesList", "factor"); err != nil {
+		return nil, err
+	}
+	factor, err := getNumberArg(fe, 1, "factor", 1)
+	if err != nil {
+		return nil, err
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		for i, v := range s.Values {
+			s.Values[i] = v * factor
+		}
+		s.setName(fmt.Sprintf("scale(%s,%g)", s.Name, factor))
+	})
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.sortByName
+func transformSortByName(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 1, "seriesList"); err != nil {
+		return nil, err
+	}
+	ss, err := getSeriesListArg(ec, fe, 0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ss, func(i, j int) bool {
+		return ss[i].Name < ss[j].Name
+	})
+	return ss, nil
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.summarize
+func transformSummarize(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 2, "seriesList", "intervalString", "func", "alignToFrom"); err != nil {
+		return nil, err
+	}
+	intervalString, err := getStringArg(fe, 1, "intervalString", "")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := parseInterval(intervalString)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive; got %q", intervalString)
+	}
+	funcName, err := getStringArg(fe, 2, "func", "sum")
+	if err != nil {
+		return nil, err
+	}
+	af := summarizeFuncs[funcName]
+	if af == nil {
+		return nil, fmt.Errorf("unsupported func %q; supported funcs: sum, avg, average, min, max, last, count, median, range", funcName)
+	}
+	alignToFrom, err := getBoolArg(fe, 3, "alignToFrom", false)
+	if err != nil {
+		return nil, err
+	}
+	start := ec.Start
+	if !alignToFrom {
+		start -= start % interval
+	}
+	var timestamps []int64
+	for ts := start; ts < ec.End; ts += interval {
+		timestamps = append(timestamps, ts)
+	}
+	suffix := ""
+	if alignToFrom {
+		suffix = ", true"
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		values := make([]float64, len(timestamps))
+		var buf []float64
+		j := 0
+		for i, ts := range timestamps {
+			buf = buf[:0]
+			for j < len(s.Timestamps) && s.Timestamps[j] < ts {
+				j++
+			}
+			for j < len(s.Timestamps) && s.Timestamps[j] < ts+interval {
+				if v := s.Values[j]; !math.IsNaN(v) {
+					buf = append(buf, v)
+				}
+				j++
+			}
+			if len(buf) == 0 {
+				values[i] = nan
+			} else {
+				values[i] = af(buf)
+			}
+		}
+		s.Timestamps = timestamps
+		s.Values = values
+		s.Step = interval
+		s.setName(fmt.Sprintf("summarize(%s, %q, %q%s)", s.Name, intervalString, funcName, suffix))
+	})
+}
+
+var summarizeFuncs = map[string]func(values []float64) float64{
+	"sum":     aggrSum,
+	"avg":     aggrAvg,
+	"average": aggrAvg,
+	"min":     aggrMin,
+	"max":     aggrMax,
+	"last":    aggrLast,
+	"count":   aggrCount,
+	"median":  aggrMedian,
+	"range":   aggrRange,
+}
+
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.transformNull
+func transformTransformNull(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+	if err := checkArgs(fe, 1, "seriesList", "default"); err != nil {
+		return nil, err
+	}
+	defaultValue, err := getNumberArg(fe, 1, "default", 0)
+	if err != nil {
+		return nil, err
+	}
+	return transformSeries(ec, fe, func(s *series) {
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				s.Values[i] = defaultValue
+			}
+		}
+		s.setName(fmt.Sprintf("transformNull(%s,%g)", s.Name, defaultValue))
+	})
+}
+
+// newAggrFunc returns a function, which aggregates all the series from all the args into a single series.
+//
+// See https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.aggregate
+func newAggrFunc(aggrName string, af func(values []float64) float64) transformFunc {
+	return func(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+		ss, err := getSeriesListsArgs(ec, fe)
+		if err != nil {
+			return nil, err
+		}
+		if len(ss) == 0 {
+			return nil, nil
+		}
+		s0 := ss[0]
+		for _, s := range ss[1:] {
+			if s.Step != s0.Step || len(s.Values) != len(s0.Values) {
+				return nil, fmt.Errorf("cannot aggregate series with distinct steps: %q and %q", s0.Name, s.Name)
+			}
+		}
+		values := make([]float64, len(s0.Values))
+		var buf []float64
+		for i := range values {
+			buf = buf[:0]
+			for _, s := range ss {
+				if v := s.Values[i]; !math.IsNaN(v) {
+					buf = append(buf, v)
+				}
+			}
+			if len(buf) == 0 {
+				values[i] = nan
+			} else {
+				values[i] = af(buf)
+			}
+		}
+		name := fmt.Sprintf("%s(%s)", fe.Name, formatPathExpressions(ss))
+		tags := getCommonTags(ss)
+		if _, ok := tags["name"]; !ok {
+			tags["name"] = name
+		}
+		tags["aggregatedBy"] = aggrName
+		s := &series{
+			Name:           name,
+			Tags:           tags,
+			PathExpression: name,
+			Timestamps:     s0.Timestamps,
+			Values:         values,
+			Step:           s0.Step,
+		}
+		return []*series{s}, nil
+	}
+}
+
+func formatPathExpressions(ss []*series) string {
+	m := make(map[string]struct{})
+	var pes []string
+	for _, s := range ss {
+		if _, ok := m[s.PathExpression]; ok {
+			continue
+		}
+		m[s.PathExpression] = struct{}{}
+		pes = append(pes, s.PathExpression)
+	}
+	sort.Strings(pes)
+	return strings.Join(pes, ",")
+}
+
+func getCommonTags(ss []*series) map[string]string {
+	tags := make(map[string]string)
+	for k, v := range ss[0].Tags {
+		tags[k] = v
+	}
+	for _, s := range ss[1:] {
+		for k, v := range tags {
+			if s.Tags[k] != v {
+				delete(tags, k)
+			}
+		}
+	}
+	return tags
+}
+
+func aggrSum(values []float64) float64 {
+	sum := float64(0)
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func aggrAvg(values []float64) float64 {
+	return aggrSum(values) / float64(len(values))
+}
+
+func aggrMin(values []float64) float64 {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func aggrMax(values []float64) float64 {
+	max := values[0]
+	for _, v := range values[1:] {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+func aggrLast(values []float64) float64 {
+	return values[len(values)-1]
+}
+
+func aggrCount(values []float64) float64 {
+	return float64(len(values))
+}
+
+func aggrMedian(values []float64) float64 {
+	a := append([]float64{}, values...)
+	sort.Float64s(a)
+	n := len(a)
+	if n%2 == 1 {
+		return a[n/2]
+	}
+	return (a[n/2-1] + a[n/2]) / 2
+}
+
+func aggrRange(values []float64) float64 {
+	return aggrMax(values) - aggrMin(values)
+}
@@ -0,0 +1,201 @@
+package graphite
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTransformFuncs(t *testing.T) {
+	ec := &evalConfig{
+		Start: 0,
+		End:   40e3,
+		Step:  10e3,
+	}
+	timestamps := ec.getTimestamps()
+
+	// Register `testSeries(name)` function, which returns test series instead of fetching them from the storage.
+	testSeries := map[string][][]float64{
+		"foo": {
+			{1, -2, nan, 4},
+		},
+		"counter": {
+			{1, 5, 2, 10},
+		},
+		"bar.*": {
+			{1, 2, 3, nan},
+			{10, nan, 30, nan},
+		},
+	}
+	transformFuncs["testSeries"] = func(ec *evalConfig, fe *funcExpr) ([]*series, error) {
+		path, err := getStringArg(fe, 0, "path", "")
+		if err != nil {
+			return nil, err
+		}
+		var ss []*series
+		for i, values := range testSeries[path] {
+			name := path
+			if len(testSeries[path]) > 1 {
+				name = path[:len(path)-1] + string(rune('a'+i))
+			}
+			ss = append(ss, &series{
+				Name:           name,
+				Tags:           map[string]string{"name": name, "env": "prod"},
+				PathExpression: path,
+				Timestamps:     timestamps,
+				Values:         append([]float64{}, values...),
+				Step:           ec.Step,
+			})
+		}
+		return ss, nil
+	}
+	defer delete(transformFuncs, "testSeries")
+
+	type result struct {
+		Name       string
+		Timestamps []int64
+		Values     []float64
+	}
+	f := func(target string, resultsExpected []result) {
+		t.Helper()
+		e, err := parseExpr(target)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", target, err)
+		}
+		ss, err := evalExpr(ec, e)
+		if err != nil {
+			t.Fatalf("cannot evaluate %q: %s", target, err)
+		}
+		var results []result
+		for _, s := range ss {
+			values := append([]float64{}, s.Values...)
+			for i, v := range values {
+				if math.IsNaN(v) {
+					// Replace NaN with -1e9, since NaN cannot be compared with reflect.DeepEqual
+					values[i] = -1e9
+				}
+			}
+			results = append(results, result{
+				Name:       s.Name,
+				Timestamps: s.Timestamps,
+				Values:     values,
+			})
+		}
+		if !reflect.DeepEqual(results, resultsExpected) {
+			t.Fatalf("unexpected result for %q;\ngot\n%v\nwant\n%v", target, results, resultsExpected)
+		}
+	}
+	n := -1e9
+
+	f(`testSeries("foo")`, []result{{"foo", timestamps, []float64{1, -2, n, 4}}})
+	f(`absolute(testSeries("foo"))`, []result{{"absolute(foo)", timestamps, []float64{1, 2, n, 4}}})
+	f(`alias(testSeries("foo"), "x")`, []result{{"x", timestamps, []float64{1, -2, n, 4}}})
+	f(`aliasByNode(testSeries("bar.*"), 1)`, []result{
+		{"a", timestamps, []float64{1, 2, 3, n}},
+		{"b", timestamps, []float64{10, n, 30, n}},
+	})
+	f(`aliasByNode(scale(testSeries("bar.*"), 2), -1, 0, "env")`, []result{
+		{"a.bar.prod", timestamps, []float64{2, 4, 6, n}},
+		{"b.bar.prod", timestamps, []float64{20, n, 60, n}},
+	})
+	f(`scale(testSeries("foo"), 0.5)`, []result{{"scale(foo,0.5)", timestamps, []float64{0.5, -1, n, 2}}})
+	f(`offset(testSeries("foo"), 10)`, []result{{"offset(foo,10)", timestamps, []float64{11, 8, n, 14}}})
+	f(`transformNull(testSeries("foo"))`, []result{{"transformNull(foo,0)", timestamps, []float64{1, -2, 0, 4}}})
+	f(`transformNull(testSeries("foo"), default=-1)`, []result{{"transformNull(foo,-1)", timestamps, []float64{1, -2, -1, 4}}})
+	f(`keepLastValue(testSeries("foo"))`, []result{{"keepLastValue(foo)", timestamps, []float64{1, -2, -2, 4}}})
+	f(`keepLastValue(testSeries("bar.*"), 1)`, []result{
+		{"keepLastValue(bar.a)", timestamps, []float64{1, 2, 3, 3}},
+		{"keepLastValue(bar.b)", timestamps, []float64{10, 10, 30, 30}},
+	})
+	f(`derivative(testSeries("counter"))`, []result{{"derivative(counter)", timestamps, []float64{n, 4, -3, 8}}})
+	f(`nonNegativeDerivative(testSeries("counter"))`, []result{{"nonNegativeDerivative(counter)", timestamps, []float64{n, 4, n, 8}}})
+	f(`nonNegativeDerivative(testSeries("counter"), 9)`, []result{{"nonNegativeDerivative(counter)", timestamps, []float64{n, 4, 7, 8}}})
+	f(`perSecond(testSeries("counter"))`, []result{{"perSecond(counter)", timestamps, []float64{n, 0.4, n, 0.8}}})
+	f(`sumSeries(testSeries("bar.*"))`, []result{{"sumSeries(bar.*)", timestamps, []float64{11, 2, 33, n}}})
+	f(`sum(testSeries("bar.*"), testSeries("foo"))`, []result{{"sum(bar.*,foo)", timestamps, []float64{12, 0, 33, 4}}})
+	f(`averageSeries(testSeries("bar.*"))`, []result{{"averageSeries(bar.*)", timestamps, []float64{5.5, 2, 16.5, n}}})
+	f(`minSeries(testSeries("bar.*"))`, []result{{"minSeries(bar.*)", timestamps, []float64{1, 2, 3, n}}})
+	f(`maxSeries(testSeries("bar.*"))`, []result{{"maxSeries(bar.*)", timestamps, []float64{10, 2, 30, n}}})
+	f(`group(testSeries("foo"), testSeries("counter"))`, []result{
+		{"foo", timestamps, []float64{1, -2, n, 4}},
+		{"counter", timestamps, []float64{1, 5, 2, 10}},
+	})
+	f(`sortByName(group(testSeries("foo"), testSeries("counter")))`, []result{
+		{"counter", timestamps, []float64{1, 5, 2, 10}},
+		{"foo", timestamps, []float64{1, -2, n, 4}},
+	})
+	f(`limit(testSeries("bar.*"), 1)`, []result{{"bar.a", timestamps, []float64{1, 2, 3, n}}})
+	f(`summarize(testSeries("counter"), "20s")`, []result{{`summarize(counter, "20s", "sum")`, []int64{0, 20e3}, []float64{6, 12}}})
+	f(`summarize(testSeries("foo"), "20s", "max")`, []result{{`summarize(foo, "20s", "max")`, []int64{0, 20e3}, []float64{1, 4}}})
+	f(`summarize(testSeries("bar.*"), "30s", func="count")`, []result{
+		{`summarize(bar.a, "30s", "count")`, []int64{0, 30e3}, []float64{3, n}},
+		{`summarize(bar.b, "30s", "count")`, []int64{0, 30e3}, []float64{2, n}},
+	})
+}
+
+func TestTransformFuncsFailure(t *testing.T) {
+	ec := &evalConfig{
+		Start: 0,
+		End:   40e3,
+		Step:  10e3,
+	}
+	f := func(target string) {
+		t.Helper()
+		e, err := parseExpr(target)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", target, err)
+		}
+		if _, err := evalExpr(ec, e); err == nil {
+			t.Fatalf("expecting non-nil error for %q", target)
+		}
+	}
+
+	// Unsupported function
+	f(`unknownFunc(foo)`)
+
+	// Invalid args
+	f(`scale()`)
+	f(`scale(1, 2)`)
+	f(`scale(foo, "bar")`)
+	f(`scale(foo, 1, 2)`)
+	f(`scale(foo, bar=1)`)
+	f(`alias(foo, 1)`)
+	f(`aliasByNode(foo)`)
+	f(`aliasByNode(foo, bar)`)
+	f(`summarize(foo, "1foo")`)
+	f(`summarize(foo, "1h", "foo")`)
+	f(`summarize(foo, "1h", "sum", 1)`)
+	f(`sumSeries(foo, x=1)`)
+}
+
+func TestAlignValues(t *testing.T) {
+	f := func(timestamps []int64, step int64, srcTimestamps []int64, srcValues, valuesExpected []float64) {
+		t.Helper()
+		values := alignValues(timestamps, step, srcTimestamps, srcValues)
+		for i, v := range values {
+			if math.IsNaN(v) {
+				values[i] = -1e9
+			}
+		}
+		if !reflect.DeepEqual(values, valuesExpected) {
+			t.Fatalf("unexpected values;\ngot\n%v\nwant\n%v", values, valuesExpected)
+		}
+	}
+	f([]int64{0, 10, 20}, 10, nil, nil, []float64{-1e9, -1e9, -1e9})
+	f([]int64{0, 10, 20}, 10, []int64{-5, 0, 5, 10, 25, 30}, []float64{100, 1, 3, 4, 5, 200}, []float64{2, 4, 5})
+	f([]int64{0, 10, 20}, 10, []int64{1, 12}, []float64{1, math.NaN()}, []float64{1, -1e9, -1e9})
+}
+
+func TestGetPathFromName(t *testing.T) {
+	f := func(name, pathExpected string) {
+		t.Helper()
+		path := getPathFromName(name)
+		if path != pathExpected {
+			t.Fatalf("unexpected path for %q; got %q; want %q", name, path, pathExpected)
+		}
+	}
+	f("foo.bar", "foo.bar")
+	f("scale(foo.bar,10)", "foo.bar")
+	f("scale(sumSeries(foo.*.bar),10)", "foo.*.bar")
+	f(`summarize(foo.bar, "1h", "sum")`, "foo.bar")
+}
@@ -0,0 +1,445 @@
+package influx
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/influxutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxQueryDuration = flag.Duration("influx.maxQueryDuration", 30*time.Second, "The maximum duration for InfluxQL SHOW queries sent to /query")
+
+// QueryHandler processes InfluxQL queries sent to /query.
+//
+// Only SHOW DATABASES, SHOW MEASUREMENTS, SHOW TAG KEYS and SHOW FIELD KEYS are supported,
+// so clients such as Chronograf and Telegraf, which probe /query on startup, may work with VictoriaMetrics.
+// CREATE DATABASE statements are accepted and ignored, since databases are created on the first write.
+//
+// Measurements and fields are obtained from metric names in the form `{measurement}{separator}{field_name}`,
+// where separator is set via -influxMeasurementFieldSeparator.
+//
+// See https://docs.influxdata.com/influxdb/v1.7/tools/api/#query-http-endpoint
+func QueryHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	q := r.FormValue("q")
+	if len(q) == 0 {
+		return fmt.Errorf("missing required query arg `q`")
+	}
+	stmts, err := parseQuery(q)
+	if err != nil {
+		return err
+	}
+	deadline := netstorage.NewDeadlineWithContext(r.Context(), *maxQueryDuration)
+	db := r.FormValue("db")
+	results := make([]queryResult, 0, len(stmts))
+	for i, stmt := range stmts {
+		series, err := stmt.exec(db, deadline)
+		if err != nil {
+			return fmt.Errorf("cannot execute %q: %s", stmt.query, err)
+		}
+		results = append(results, queryResult{
+			StatementID: i,
+			Series:      series,
+		})
+	}
+	data, err := json.Marshal(&queryResponse{
+		Results: results,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal response: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+	influxQueryDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var influxQueryDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/query", protocol="influx"}`)
+
+// WriteQueryError writes err to w in the format expected by Influx clients.
+func WriteQueryError(w http.ResponseWriter, err error) {
+	data, _ := json.Marshal(map[string]string{
+		"error": err.Error(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write(data)
+}
+
+type queryResponse struct {
+	Results []queryResult `json:"results"`
+}
+
+type queryResult struct {
+	StatementID int           `json:"statement_id"`
+	Series      []querySeries `json:"series,omitempty"`
+}
+
+type querySeries struct {
+	Name    string     `json:"name"`
+	Columns []string   `json:"columns"`
+	Values  [][]string `json:"values"`
+}
+
+type statementType int
+
+const (
+	stmtCreateDatabase statementType = iota
+	stmtShowDatabases
+	stmtShowMeasurements
+	stmtShowTagKeys
+	stmtShowFieldKeys
+)
+
+// statement is a parsed InfluxQL statement.
+type statement struct {
+	query string
+	typ   statementType
+
+	// db is set via `ON <db>` clause. It overrides `db` query arg.
+	db string
+
+	// measurement is set via `FROM <measurement>` clause.
+	measurement string
+
+	limit  int
+	offset int
+}
+
+// parseQuery parses the given InfluxQL query consisting of semicolon-delimited statements.
+func parseQuery(q string) ([]*statement, error) {
+	var stmts []*statement
+	for _, s := range strings.Split(q, ";") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		stmt, err := parseStatement(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q: %s", s, err)
+		}
+		stmts = append(stmts, stmt)
+	}
+	if len(stmts) == 0 {
+		return nil, fmt.Errorf("query %q doesn't contain statements", q)
+	}
+	return stmts, nil
+}
+
+func parseStatement(s string) (*statement, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	stmt := &statement{
+		query: s,
+	}
+	switch {
+	case hasPrefixTokens(tokens, "create", "database"):
+		// The database name and the remaining clauses such as `WITH DURATION` are ignored.
+		stmt.typ = stmtCreateDatabase
+		return stmt, nil
+	case hasPrefixTokens(tokens, "show", "databases"):
+		stmt.typ = stmtShowDatabases
+		tokens = tokens[2:]
+	case hasPrefixTokens(tokens, "show", "measurements"):
+		stmt.typ = stmtShowMeasurements
+		tokens = tokens[2:]
+	case hasPrefixTokens(tokens, "show", "tag", "keys"):
+		stmt.typ = stmtShowTagKeys
+		tokens = tokens[3:]
+	case hasPrefixTokens(tokens, "show", "field", "keys"):
+		stmt.typ = stmtShowFieldKeys
+		tokens = tokens[3:]
+	default:
+		return nil, fmt.Errorf("unsupported statement; only SHOW DATABASES, SHOW MEASUREMENTS, SHOW TAG KEYS, SHOW FIELD KEYS and CREATE DATABASE are supported")
+	}
+	for len(tokens) > 0 {
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("missing value for %q clause", tokens[0])
+		}
+		clause, value := strings.ToLower(tokens[0]), tokens[1]
+		tokens = tokens[2:]
+		switch clause {
+		case "on":
+			if stmt.typ == stmtShowDatabases {
+				return nil, fmt.Errorf("unsupported clause %q", clause)
+			}
+			stmt.db = value
+		case "from":
+			if stmt.typ != stmtShowTagKeys && stmt.typ != stmtShowFieldKeys {
+				return nil, fmt.Errorf("unsupported clause %q", clause)
+			}
+			if strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("regexps aren't supported in FROM clause")
+			}
+			stmt.measurement = value
+		case "limit", "offset":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s value %q; it must be non-negative integer", clause, value)
+			}
+			if clause == "limit" {
+				stmt.limit = n
+			} else {
+				stmt.offset = n
+			}
+		default:
+			return nil, fmt.Errorf("unsupported clause %q", clause)
+		}
+	}
+	return stmt, nil
+}
+
+func hasPrefixTokens(tokens []string, prefix ...string) bool {
+	if len(tokens) < len(prefix) {
+		return false
+	}
+	for i, s := range prefix {
+		if !strings.EqualFold(tokens[i], s) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenize splits s into whitespace-delimited tokens.
+//
+// Double-quoted identifiers and single-quoted strings are unquoted.
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if len(s) == 0 {
+			return tokens, nil
+		}
+		var token []byte
+		for len(s) > 0 && !strings.ContainsAny(s[:1], " \t\r\n") {
+			quote := s[0]
+			if quote != '"' && quote != '\'' {
+				token = append(token, s[0])
+				s = s[1:]
+				continue
+			}
+			n := 1
+			for n < len(s) && s[n] != quote {
+				if s[n] == '\\' && n+1 < len(s) {
+					n++
+				}
+				token = append(token, s[n])
+				n++
+			}
+			if n >= len(s) {
+				return nil, fmt.Errorf("missing closing quote in %q", s)
+			}
+			s = s[n+1:]
+		}
+		tokens = append(tokens, string(token))
+	}
+}
+
+func (stmt *statement) exec(db string, deadline netstorage.Deadline) ([]querySeries, error) {
+	if len(stmt.db) > 0 {
+		db = stmt.db
+	}
+	var series []querySeries
+	switch stmt.typ {
+	case stmtCreateDatabase:
+		return nil, nil
+	case stmtShowDatabases:
+		var dbs []string
+		if len(influxutil.DatabaseLabel()) > 0 {
+			var err error
+			dbs, err = netstorage.GetLabelValues(influxutil.DatabaseLabel(), deadline)
+			if err != nil {
+				return nil, err
+			}
+		}
+		series = append(series, newQuerySeries("databases", "name", dbs))
+	case stmtShowMeasurements:
+		measurements, err := getMeasurements(db, deadline)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, newQuerySeries("measurements", "name", measurements))
+	case stmtShowTagKeys:
+		measurements := []string{stmt.measurement}
+		if len(stmt.measurement) == 0 {
+			var err error
+			measurements, err = getMeasurements(db, deadline)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, measurement := range measurements {
+			labels, err := netstorage.GetLabelsOnTimeRange(newSearchQuery(db, measurement), deadline)
+			if err != nil {
+				return nil, err
+			}
+			tagKeys := labels[:0]
+			for _, label := range labels {
+				if label != "__name__" && label != influxutil.DatabaseLabel() {
+					tagKeys = append(tagKeys, label)
+				}
+			}
+			if len(tagKeys) > 0 {
+				series = append(series, newQuerySeries(measurement, "tagKey", tagKeys))
+			}
+		}
+	case stmtShowFieldKeys:
+		names, err := getMetricNames(db, stmt.measurement, deadline)
+		if err != nil {
+			return nil, err
+		}
+		var measurements []string
+		m := make(map[string][]string)
+		for _, name := range names {
+			measurement, field := splitMetricName(name)
+			if len(stmt.measurement) > 0 && measurement != stmt.measurement {
+				continue
+			}
+			if _, ok := m[measurement]; !ok {
+				measurements = append(measurements, measurement)
+			}
+			m[measurement] = append(m[measurement], field)
+		}
+		sort.Strings(measurements)
+		for _, measurement := range measurements {
+			fields := m[measurement]
+			sort.Strings(fields)
+			qs := querySeries{
+				Name:    measurement,
+				Columns: []string{"fieldKey", "fieldType"},
+			}
+			for _, field := range fields {
+				// VictoriaMetrics stores all the field values as floats.
+				qs.Values = append(qs.Values, []string{field, "float"})
+			}
+			series = append(series, qs)
+		}
+	default:
+		logger.Panicf("BUG: unexpected statement type %d", stmt.typ)
+	}
+	return stmt.applyLimitOffset(series), nil
+}
+
+// getMeasurements returns sorted measurements for the given db.
+func getMeasurements(db string, deadline netstorage.Deadline) ([]string, error) {
+	names, err := getMetricNames(db, "", deadline)
+	if err != nil {
+		return nil, err
+	}
+	var measurements []string
+	m := make(map[string]bool)
+	for _, name := range names {
+		measurement, _ := splitMetricName(name)
+		if !m[measurement] {
+			m[measurement] = true
+			measurements = append(measurements, measurement)
+		}
+	}
+	sort.Strings(measurements)
+	return measurements, nil
+}
+
+// applyLimitOffset applies LIMIT and OFFSET clauses to values of every series.
+//
+// Series without values are dropped like InfluxDB does, except of SHOW DATABASES results.
+func (stmt *statement) applyLimitOffset(series []querySeries) []querySeries {
+	dst := series[:0]
+	for _, qs := range series {
+		values := qs.Values
+		if stmt.offset >= len(values) {
+			values = values[:0]
+		} else {
+			values = values[stmt.offset:]
+		}
+		if stmt.limit > 0 && stmt.limit < len(values) {
+			values = values[:stmt.limit]
+		}
+		if len(values) == 0 && stmt.typ != stmtShowDatabases {
+			continue
+		}
+		qs.Values = values
+		dst = append(dst, qs)
+	}
+	return dst
+}
+
+func newQuerySeries(name, column string, values []string) querySeries {
+	qs := querySeries{
+		Name:    name,
+		Columns: []string{column},
+		Values:  make([][]string, 0, len(values)),
+	}
+	for _, v := range values {
+		qs.Values = append(qs.Values, []string{v})
+	}
+	return qs
+}
+
+// getMetricNames returns metric names for the given db and measurement.
+//
+// All the metric names are returned if both db and measurement are empty.
+func getMetricNames(db, measurement string, deadline netstorage.Deadline) ([]string, error) {
+	if (len(influxutil.DatabaseLabel()) == 0 || len(db) == 0) && len(measurement) == 0 {
+		return netstorage.GetLabelValues("__name__", deadline)
+	}
+	return netstorage.GetLabelValuesOnTimeRange("__name__", newSearchQuery(db, measurement), deadline)
+}
+
+// newSearchQuery returns search query over all the time for series with the given db and measurement.
+func newSearchQuery(db, measurement string) *storage.SearchQuery {
+	var tfs []storage.TagFilter
+	if len(influxutil.DatabaseLabel()) > 0 && len(db) > 0 {
+		tfs = append(tfs, storage.TagFilter{
+			Key:   []byte(influxutil.DatabaseLabel()),
+			Value: []byte(db),
+		})
+	}
+	if len(measurement) > 0 {
+		tfs = append(tfs, storage.TagFilter{
+			// Metric names without the separator are measurements with `value` field. See splitMetricName.
+			Value:    []byte(regexp.QuoteMeta(measurement) + "(" + regexp.QuoteMeta(influxutil.MeasurementFieldSeparator()) + ".+)?"),
+			IsRegexp: true,
+		})
+	}
+	if len(tfs) == 0 {
+		tfs = append(tfs, storage.TagFilter{
+			Value:    []byte(".+"),
+			IsRegexp: true,
+		})
+	}
+	return &storage.SearchQuery{
+		MinTimestamp: 0,
+		MaxTimestamp: time.Now().Add(24*time.Hour).UnixNano() / 1e6,
+		TagFilterss:  [][]storage.TagFilter{tfs},
+	}
+}
+
+// splitMetricName splits the given metric name into measurement and field.
+//
+// Metric names without -influxMeasurementFieldSeparator, such as metrics
+// ingested via Prometheus protocol, are returned as measurements with `value` field.
+func splitMetricName(name string) (string, string) {
+	sep := influxutil.MeasurementFieldSeparator()
+	if len(sep) == 0 {
+		return name, "value"
+	}
+	n := strings.LastIndex(name, sep)
+	if n <= 0 || n+len(sep) == len(name) {
+		return name, "value"
+	}
+	return name[:n], name[n+len(sep):]
+}
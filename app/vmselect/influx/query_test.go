@@ -0,0 +1,145 @@
+package influx
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuerySuccess(t *testing.T) {
+	f := func(q string, stmtsExpected []statement) {
+		t.Helper()
+		stmts, err := parseQuery(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		var result []statement
+		for _, stmt := range stmts {
+			result = append(result, *stmt)
+		}
+		if !reflect.DeepEqual(result, stmtsExpected) {
+			t.Fatalf("unexpected statements for %q;\ngot\n%+v\nwant\n%+v", q, result, stmtsExpected)
+		}
+	}
+	f("SHOW DATABASES", []statement{{
+		query: "SHOW DATABASES",
+		typ:   stmtShowDatabases,
+	}})
+	f(`create database "telegraf"`, []statement{{
+		query: `create database "telegraf"`,
+		typ:   stmtCreateDatabase,
+	}})
+	f(`SHOW MEASUREMENTS ON "telegraf" LIMIT 100 OFFSET 10`, []statement{{
+		query:  `SHOW MEASUREMENTS ON "telegraf" LIMIT 100 OFFSET 10`,
+		typ:    stmtShowMeasurements,
+		db:     "telegraf",
+		limit:  100,
+		offset: 10,
+	}})
+	f(`show tag keys from "cpu load";  SHOW FIELD KEYS ON db1 FROM 'mem';`, []statement{
+		{
+			query:       `show tag keys from "cpu load"`,
+			typ:         stmtShowTagKeys,
+			measurement: "cpu load",
+		},
+		{
+			query:       `SHOW FIELD KEYS ON db1 FROM 'mem'`,
+			typ:         stmtShowFieldKeys,
+			db:          "db1",
+			measurement: "mem",
+		},
+	})
+	f(`SHOW TAG KEYS FROM "foo\"bar"`, []statement{{
+		query:       `SHOW TAG KEYS FROM "foo\"bar"`,
+		typ:         stmtShowTagKeys,
+		measurement: `foo"bar`,
+	}})
+}
+
+func TestParseQueryFailure(t *testing.T) {
+	f := func(q string) {
+		t.Helper()
+		stmts, err := parseQuery(q)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q; got %+v", q, stmts)
+		}
+	}
+	f("")
+	f(";")
+	f("SELECT * FROM cpu")
+	f("SHOW RETENTION POLICIES")
+	f("DROP DATABASE foo")
+	f("SHOW DATABASES ON foo")
+	f("SHOW MEASUREMENTS FROM cpu")
+	f("SHOW MEASUREMENTS WHERE host = 'foo'")
+	f("SHOW TAG KEYS FROM /cpu.*/")
+	f("SHOW TAG KEYS FROM")
+	f(`SHOW TAG KEYS FROM "cpu`)
+	f("SHOW MEASUREMENTS LIMIT foo")
+	f("SHOW MEASUREMENTS OFFSET -1")
+	f("SHOW DATABASES; SELECT 1")
+}
+
+func TestSplitMetricName(t *testing.T) {
+	f := func(name, measurementExpected, fieldExpected string) {
+		t.Helper()
+		measurement, field := splitMetricName(name)
+		if measurement != measurementExpected {
+			t.Fatalf("unexpected measurement for %q; got %q; want %q", name, measurement, measurementExpected)
+		}
+		if field != fieldExpected {
+			t.Fatalf("unexpected field for %q; got %q; want %q", name, field, fieldExpected)
+		}
+	}
+	f("cpu.usage_idle", "cpu", "usage_idle")
+	f("disk.io.read_bytes", "disk.io", "read_bytes")
+
+	// Metric names without separator
+	f("up", "up", "value")
+	f(".foo", ".foo", "value")
+	f("foo.", "foo.", "value")
+}
+
+func TestQueryHandler(t *testing.T) {
+	f := func(url string, statusCodeExpected int, respExpected string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		if err := QueryHandler(w, r); err != nil {
+			WriteQueryError(w, err)
+		}
+		if w.Code != statusCodeExpected {
+			t.Fatalf("unexpected status code for %q; got %d; want %d", url, w.Code, statusCodeExpected)
+		}
+		if resp := w.Body.String(); resp != respExpected {
+			t.Fatalf("unexpected response for %q;\ngot\n%s\nwant\n%s", url, resp, respExpected)
+		}
+	}
+	f("/query?q=CREATE+DATABASE+foo", 200, `{"results":[{"statement_id":0}]}`)
+	f("/query", 400, `{"error":"missing required query arg `+"`q`"+`"}`)
+	f("/query?q=SELECT+*+FROM+cpu", 400, `{"error":"cannot parse \"SELECT * FROM cpu\": unsupported statement; `+
+		`only SHOW DATABASES, SHOW MEASUREMENTS, SHOW TAG KEYS, SHOW FIELD KEYS and CREATE DATABASE are supported"}`)
+}
+
+func TestApplyLimitOffset(t *testing.T) {
+	f := func(stmt *statement, series, seriesExpected []querySeries) {
+		t.Helper()
+		result := stmt.applyLimitOffset(series)
+		if !reflect.DeepEqual(result, seriesExpected) {
+			t.Fatalf("unexpected series;\ngot\n%+v\nwant\n%+v", result, seriesExpected)
+		}
+	}
+	newSeries := func(name string, values ...string) []querySeries {
+		return []querySeries{newQuerySeries(name, "name", values)}
+	}
+	f(&statement{typ: stmtShowMeasurements}, newSeries("measurements", "a", "b"), newSeries("measurements", "a", "b"))
+	f(&statement{typ: stmtShowMeasurements, limit: 1}, newSeries("measurements", "a", "b"), newSeries("measurements", "a"))
+	f(&statement{typ: stmtShowMeasurements, offset: 1, limit: 5}, newSeries("measurements", "a", "b", "c"), newSeries("measurements", "b", "c"))
+
+	// Empty series are dropped
+	f(&statement{typ: stmtShowMeasurements, offset: 2}, newSeries("measurements", "a", "b"), []querySeries{})
+	f(&statement{typ: stmtShowMeasurements}, newSeries("measurements"), []querySeries{})
+
+	// Empty SHOW DATABASES results are preserved
+	f(&statement{typ: stmtShowDatabases}, newSeries("databases"), newSeries("databases"))
+}
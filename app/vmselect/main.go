@@ -1,27 +1,36 @@
 package vmselect
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/graphite"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/influx"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/prometheus"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/promql"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/influxutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/timerpool"
 	"github.com/VictoriaMetrics/metrics"
 )
 
 var (
-	deleteAuthKey         = flag.String("deleteAuthKey", "", "authKey for metrics' deletion via /api/v1/admin/tsdb/delete_series")
+	deleteAuthKey         = flag.String("deleteAuthKey", "", "authKey for metrics' deletion via /api/v1/admin/tsdb/delete_series and DELETE /api/v1/series")
+	resetCacheAuthKey     = flag.String("search.resetCacheAuthKey", "", "authKey for resetting the cache for query results via /internal/resetRollupResultCache")
 	maxConcurrentRequests = flag.Int("search.maxConcurrentRequests", runtime.GOMAXPROCS(-1)*2, "The maximum number of concurrent search requests. It shouldn't exceed 2*vCPUs for better performance. See also -search.maxQueueDuration")
 	maxQueueDuration      = flag.Duration("search.maxQueueDuration", 10*time.Second, "The maximum time the request waits for execution when -search.maxConcurrentRequests limit is reached")
+	maxQueuedRequests     = flag.Int("search.maxQueuedRequests", 1000, "The maximum number of search requests waiting for execution when -search.maxConcurrentRequests limit is reached. "+
+		"Requests exceeding the limit are rejected with 503 Service Unavailable")
 )
 
 // Init initializes vmselect
@@ -31,9 +40,31 @@ func Init() {
 	netstorage.InitTmpBlocksDir(tmpDirPath)
 	promql.InitRollupResultCache(*vmstorage.DataPath + "/cache/rollupResult")
 	concurrencyCh = make(chan struct{}, *maxConcurrentRequests)
+	promql.InitQueryMemoryLimiter(*maxConcurrentRequests)
 }
 
-var concurrencyCh chan struct{}
+var (
+	concurrencyCh chan struct{}
+
+	// queuedRequests is the number of requests waiting for a free slot in concurrencyCh.
+	queuedRequests int64
+)
+
+var (
+	concurrencyLimitReached = metrics.NewCounter(`vm_concurrent_select_limit_reached_total`)
+	concurrencyLimitTimeout = metrics.NewCounter(`vm_concurrent_select_limit_timeout_total`)
+	concurrencyLimitAborted = metrics.NewCounter(`vm_concurrent_select_limit_aborted_total`)
+
+	_ = metrics.NewGauge(`vm_concurrent_select_capacity`, func() float64 {
+		return float64(cap(concurrencyCh))
+	})
+	_ = metrics.NewGauge(`vm_concurrent_select_current`, func() float64 {
+		return float64(len(concurrencyCh))
+	})
+	_ = metrics.NewGauge(`vm_concurrent_select_queued`, func() float64 {
+		return float64(atomic.LoadInt64(&queuedRequests))
+	})
+)
 
 // Stop stops vmselect
 func Stop() {
@@ -42,20 +73,53 @@ func Stop() {
 
 // RequestHandler handles remote read API requests for Prometheus
 func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
+	path := strings.Replace(r.URL.Path, "//", "/", -1)
+	if path == "/api/v1/status/active_queries" {
+		// Active queries bypass the concurrency limit, so they may be inspected when vmselect is overloaded.
+		activeQueriesRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		prometheus.ActiveQueriesHandler(w, r)
+		return true
+	}
+
 	// Limit the number of concurrent queries.
-	// Sleep for a while until giving up. This should resolve short bursts in requests.
-	t := timerpool.Get(*maxQueueDuration)
+	// /health and /metrics requests bypass the limit, since they are served by httpserver before calling RequestHandler.
 	select {
 	case concurrencyCh <- struct{}{}:
-		timerpool.Put(t)
-		defer func() { <-concurrencyCh }()
-	case <-t.C:
-		timerpool.Put(t)
-		httpserver.Errorf(w, "cannot handle more than %d concurrent requests", cap(concurrencyCh))
-		return true
+	default:
+		// Sleep for a while until giving up. This should resolve short bursts in requests.
+		// Blocked channel senders are woken up in FIFO order, so the queued requests are served in arrival order.
+		concurrencyLimitReached.Inc()
+		if n := atomic.AddInt64(&queuedRequests, 1); n > int64(*maxQueuedRequests) {
+			atomic.AddInt64(&queuedRequests, -1)
+			http.Error(w, fmt.Sprintf("cannot handle more than %d concurrent requests; the queue with %d pending requests is full; "+
+				"either increase -search.maxConcurrentRequests and -search.maxQueuedRequests or reduce the load",
+				cap(concurrencyCh), *maxQueuedRequests), http.StatusServiceUnavailable)
+			return true
+		}
+		t := timerpool.Get(*maxQueueDuration)
+		select {
+		case concurrencyCh <- struct{}{}:
+			atomic.AddInt64(&queuedRequests, -1)
+			timerpool.Put(t)
+		case <-t.C:
+			atomic.AddInt64(&queuedRequests, -1)
+			timerpool.Put(t)
+			concurrencyLimitTimeout.Inc()
+			http.Error(w, fmt.Sprintf("cannot handle more than %d concurrent requests during -search.maxQueueDuration=%s; "+
+				"either increase -search.maxConcurrentRequests and -search.maxQueueDuration or reduce the load",
+				cap(concurrencyCh), *maxQueueDuration), http.StatusServiceUnavailable)
+			return true
+		case <-r.Context().Done():
+			// The client closed the connection, so there is no need in executing the request.
+			atomic.AddInt64(&queuedRequests, -1)
+			timerpool.Put(t)
+			concurrencyLimitAborted.Inc()
+			return true
+		}
 	}
+	defer func() { <-concurrencyCh }()
 
-	path := strings.Replace(r.URL.Path, "//", "/", -1)
 	if strings.HasPrefix(path, "/api/v1/label/") {
 		s := r.URL.Path[len("/api/v1/label/"):]
 		if strings.HasSuffix(s, "/values") {
@@ -91,6 +155,10 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 		}
 		return true
 	case "/api/v1/series":
+		if r.Method == "DELETE" {
+			// DELETE /api/v1/series is served by AdminRequestHandler.
+			return false
+		}
 		seriesRequests.Inc()
 		httpserver.EnableCORS(w, r)
 		if err := prometheus.SeriesHandler(w, r); err != nil {
@@ -108,6 +176,42 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 			return true
 		}
 		return true
+	case "/api/v1/status/tsdb":
+		tsdbStatusRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		if err := prometheus.TSDBStatusHandler(w, r); err != nil {
+			tsdbStatusErrors.Inc()
+			sendPrometheusError(w, r, err)
+			return true
+		}
+		return true
+	case "/api/v1/query_exemplars":
+		queryExemplarsRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		if err := prometheus.QueryExemplarsHandler(w, r); err != nil {
+			queryExemplarsErrors.Inc()
+			sendPrometheusError(w, r, err)
+			return true
+		}
+		return true
+	case "/api/v1/metadata":
+		metadataRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		if err := prometheus.MetadataHandler(w, r); err != nil {
+			metadataErrors.Inc()
+			sendPrometheusError(w, r, err)
+			return true
+		}
+		return true
+	case "/api/v1/targets/metadata":
+		targetsMetadataRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		if err := prometheus.TargetsMetadataHandler(w, r); err != nil {
+			targetsMetadataErrors.Inc()
+			sendPrometheusError(w, r, err)
+			return true
+		}
+		return true
 	case "/api/v1/labels":
 		labelsRequests.Inc()
 		httpserver.EnableCORS(w, r)
@@ -134,6 +238,30 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 			return true
 		}
 		return true
+	case "/api/v1/export/native":
+		exportNativeRequests.Inc()
+		if err := prometheus.ExportNativeHandler(w, r); err != nil {
+			exportNativeErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	case "/api/v1/export/csv":
+		exportCSVRequests.Inc()
+		if err := prometheus.ExportCSVHandler(w, r); err != nil {
+			exportCSVErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	case "/api/v1/read":
+		remoteReadRequests.Inc()
+		if err := prometheus.RemoteReadHandler(w, r); err != nil {
+			remoteReadErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
 	case "/federate":
 		federateRequests.Inc()
 		if err := prometheus.FederateHandler(w, r); err != nil {
@@ -142,7 +270,71 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 			return true
 		}
 		return true
-	case "/api/v1/admin/tsdb/delete_series":
+	case "/render":
+		graphiteRenderRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		if err := graphite.RenderHandler(w, r); err != nil {
+			graphiteRenderErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	case "/metrics/find":
+		graphiteMetricsFindRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		if err := graphite.MetricsFindHandler(w, r); err != nil {
+			graphiteMetricsFindErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	case "/metrics/expand":
+		graphiteMetricsExpandRequests.Inc()
+		httpserver.EnableCORS(w, r)
+		if err := graphite.MetricsExpandHandler(w, r); err != nil {
+			graphiteMetricsExpandErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	case "/query":
+		influxQueryRequests.Inc()
+		if !influxutil.CheckAuth(w, r) {
+			influxQueryErrors.Inc()
+			return true
+		}
+		if err := influx.QueryHandler(w, r); err != nil {
+			influxQueryErrors.Inc()
+			logger.Errorf("error in %q: %s", r.URL.Path, err)
+			influx.WriteQueryError(w, err)
+			return true
+		}
+		return true
+	case "/internal/resetRollupResultCache":
+		resetRollupResultCacheRequests.Inc()
+		authKey := r.FormValue("authKey")
+		if authKey != *resetCacheAuthKey {
+			httpserver.Errorf(w, "invalid authKey %q. It must match the value from -search.resetCacheAuthKey command line flag", authKey)
+			return true
+		}
+		if err := prometheus.ResetRollupResultCacheHandler(w, r); err != nil {
+			resetRollupResultCacheErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// AdminRequestHandler handles requests modifying the stored data such as time series deletion.
+//
+// It must be served only at the address for data ingestion, since the address for query endpoints may be exposed to untrusted clients.
+func AdminRequestHandler(w http.ResponseWriter, r *http.Request) bool {
+	path := strings.Replace(r.URL.Path, "//", "/", -1)
+	switch {
+	case path == "/api/v1/admin/tsdb/delete_series":
 		deleteRequests.Inc()
 		authKey := r.FormValue("authKey")
 		if authKey != *deleteAuthKey {
@@ -156,20 +348,49 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 		}
 		w.WriteHeader(http.StatusNoContent)
 		return true
+	case path == "/api/v1/series" && r.Method == "DELETE":
+		deleteSeriesRequests.Inc()
+		authKey := r.FormValue("authKey")
+		if authKey != *deleteAuthKey {
+			httpserver.Errorf(w, "invalid authKey %q. It must match the value from -deleteAuthKey command line flag", authKey)
+			return true
+		}
+		if err := prometheus.DeleteSeriesHandler(w, r); err != nil {
+			deleteSeriesErrors.Inc()
+			sendPrometheusError(w, r, err)
+			return true
+		}
+		return true
 	default:
 		return false
 	}
 }
 
 func sendPrometheusError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() == context.Canceled {
+		// The client has closed the request, so there is no need in logging the error.
+		// Return the non-standard 499 status code like nginx does, so canceled queries
+		// may be distinguished from failed queries in access logs.
+		canceledRequests.Inc()
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
 	logger.Errorf("error in %q: %s", r.URL.Path, err)
 
 	w.Header().Set("Content-Type", "application/json")
 	statusCode := 422
+	if esc, ok := err.(*httpserver.ErrorWithStatusCode); ok {
+		statusCode = esc.StatusCode
+	}
 	w.WriteHeader(statusCode)
 	prometheus.WriteErrorResponse(w, statusCode, err)
 }
 
+// statusClientClosedRequest is the status code returned for requests canceled by client.
+const statusClientClosedRequest = 499
+
+var canceledRequests = metrics.NewCounter(`vm_http_request_canceled_total`)
+
 var (
 	labelValuesRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/label/{}/values"}`)
 	labelValuesErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/label/{}/values"}`)
@@ -183,9 +404,26 @@ var (
 	seriesRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/series"}`)
 	seriesErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/series"}`)
 
+	deleteSeriesRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/series", method="DELETE"}`)
+	deleteSeriesErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/series", method="DELETE"}`)
+
 	seriesCountRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/series/count"}`)
 	seriesCountErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/series/count"}`)
 
+	tsdbStatusRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/status/tsdb"}`)
+	tsdbStatusErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/status/tsdb"}`)
+
+	activeQueriesRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/status/active_queries"}`)
+
+	queryExemplarsRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/query_exemplars"}`)
+	queryExemplarsErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/query_exemplars"}`)
+
+	metadataRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/metadata"}`)
+	metadataErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/metadata"}`)
+
+	targetsMetadataRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/targets/metadata"}`)
+	targetsMetadataErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/targets/metadata"}`)
+
 	labelsRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/labels"}`)
 	labelsErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/labels"}`)
 
@@ -195,9 +433,33 @@ var (
 	deleteRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/admin/tsdb/delete_series"}`)
 	deleteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/admin/tsdb/delete_series"}`)
 
+	resetRollupResultCacheRequests = metrics.NewCounter(`vm_http_requests_total{path="/internal/resetRollupResultCache"}`)
+	resetRollupResultCacheErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/internal/resetRollupResultCache"}`)
+
 	exportRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/export"}`)
 	exportErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/export"}`)
 
+	exportNativeRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/export/native"}`)
+	exportNativeErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/export/native"}`)
+
+	exportCSVRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/export/csv"}`)
+	exportCSVErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/export/csv"}`)
+
+	remoteReadRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/read"}`)
+	remoteReadErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/read"}`)
+
 	federateRequests = metrics.NewCounter(`vm_http_requests_total{path="/federate"}`)
 	federateErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/federate"}`)
+
+	graphiteRenderRequests = metrics.NewCounter(`vm_http_requests_total{path="/render"}`)
+	graphiteRenderErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/render"}`)
+
+	graphiteMetricsFindRequests = metrics.NewCounter(`vm_http_requests_total{path="/metrics/find"}`)
+	graphiteMetricsFindErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/metrics/find"}`)
+
+	graphiteMetricsExpandRequests = metrics.NewCounter(`vm_http_requests_total{path="/metrics/expand"}`)
+	graphiteMetricsExpandErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/metrics/expand"}`)
+
+	influxQueryRequests = metrics.NewCounter(`vm_http_requests_total{path="/query", protocol="influx"}`)
+	influxQueryErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/query", protocol="influx"}`)
 )
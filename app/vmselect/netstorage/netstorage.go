@@ -2,10 +2,13 @@ package netstorage
 
 import (
 	"container/heap"
+	"context"
 	"flag"
 	"fmt"
+	"math"
 	"runtime"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,14 +17,21 @@ import (
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/querytracer"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
 	"github.com/VictoriaMetrics/metrics"
 )
 
 var (
 	maxTagKeysPerSearch   = flag.Int("search.maxTagKeys", 10e3, "The maximum number of tag keys returned per search")
 	maxTagValuesPerSearch = flag.Int("search.maxTagValues", 10e3, "The maximum number of tag values returned per search")
-	maxMetricsPerSearch   = flag.Int("search.maxUniqueTimeseries", 100e3, "The maximum number of unique time series each search can scan")
+	maxMetricsPerSearch   = flag.Int("search.maxUniqueTimeseries", 100e3, "The maximum number of unique time series each search can scan. "+
+		"It can be lowered for a single query via `max_unique_timeseries` query arg")
+	removeExactDuplicates = flag.Bool("search.removeExactDuplicates", true, "Whether to remove samples with identical timestamps and bit-identical values for each time series at query time. "+
+		"Such duplicates may appear when the same data is written via multiple replicated paths. They inflate results of functions such as count_over_time. "+
+		"Samples with identical timestamps and distinct values are left untouched. See also -dedup.minScrapeInterval")
 )
 
 // Result is a single timeseries result.
@@ -74,6 +84,40 @@ func (rss *Results) Cancel() {
 //
 // rss becomes unusable after the call to RunParallel.
 func (rss *Results) RunParallel(f func(rs *Result)) error {
+	return rss.runParallel(func(pts *packedTimeseries, rs *Result, maxWorkersCount int) error {
+		if err := pts.Unpack(rss.tbf, rs, rss.tr, maxWorkersCount); err != nil {
+			return err
+		}
+		if len(rs.Timestamps) == 0 {
+			// Skip empty blocks.
+			return nil
+		}
+		f(rs)
+		return nil
+	})
+}
+
+// RunParallelChunked runs in parallel f for all the results from rss.
+//
+// Unlike RunParallel, every time series is passed to f in chunks containing
+// up to maxRowsPerChunk samples each, so the memory usage doesn't depend
+// on the number of samples per time series. Chunks for the same time series
+// are passed to f consecutively in the order of their timestamps.
+// Deduplication is applied to every chunk individually.
+//
+// f shouldn't hold references to rs after returning.
+//
+// rss becomes unusable after the call to RunParallelChunked.
+func (rss *Results) RunParallelChunked(maxRowsPerChunk int, f func(rs *Result)) error {
+	if maxRowsPerChunk <= 0 {
+		logger.Panicf("BUG: maxRowsPerChunk must be positive; got %d", maxRowsPerChunk)
+	}
+	return rss.runParallel(func(pts *packedTimeseries, rs *Result, maxWorkersCount int) error {
+		return pts.UnpackChunked(rss.tbf, rs, rss.tr, maxRowsPerChunk, f)
+	})
+}
+
+func (rss *Results) runParallel(f func(pts *packedTimeseries, rs *Result, maxWorkersCount int) error) error {
 	defer func() {
 		putTmpBlocksFile(rss.tbf)
 		rss.tbf = nil
@@ -98,18 +142,13 @@ func (rss *Results) RunParallel(f func(rs *Result)) error {
 
 			var err error
 			for pts := range workCh {
-				if time.Until(rss.deadline.Deadline) < 0 {
-					err = fmt.Errorf("timeout exceeded during query execution: %s", rss.deadline.Timeout)
+				if rss.deadline.Exceeded() {
+					err = rss.deadline.Error("during query execution")
 					break
 				}
-				if err = pts.Unpack(rss.tbf, rs, rss.tr, maxWorkersCount); err != nil {
+				if err = f(pts, rs, maxWorkersCount); err != nil {
 					break
 				}
-				if len(rs.Timestamps) == 0 {
-					// Skip empty blocks.
-					continue
-				}
-				f(rs)
 			}
 			// Drain the remaining work
 			for range workCh {
@@ -140,6 +179,42 @@ func (rss *Results) RunParallel(f func(rs *Result)) error {
 	return nil
 }
 
+// RunBlocks sequentially calls f for all the raw blocks from rss.
+//
+// The blocks are passed to f in the marshaled form, i.e. b.UnmarshalData
+// must be called before accessing b timestamps and values.
+// Blocks for the same metricName are passed to f consecutively.
+// Blocks may contain samples outside the rss time range.
+//
+// Storage isn't accessed during the call, so f may be slow.
+//
+// f shouldn't hold references to metricName and b after returning.
+//
+// rss becomes unusable after the call to RunBlocks.
+func (rss *Results) RunBlocks(f func(metricName []byte, b *storage.Block) error) error {
+	defer func() {
+		putTmpBlocksFile(rss.tbf)
+		rss.tbf = nil
+	}()
+
+	var b storage.Block
+	for i := range rss.packedTimeseries {
+		pts := &rss.packedTimeseries[i]
+		metricName := bytesutil.ToUnsafeBytes(pts.metricName)
+		for _, addr := range pts.addrs {
+			if rss.deadline.Exceeded() {
+				return rss.deadline.Error("during query execution")
+			}
+			rss.tbf.MustReadBlockAt(&b, addr)
+			if err := f(metricName, &b); err != nil {
+				return err
+			}
+		}
+	}
+	rss.packedTimeseries = rss.packedTimeseries[:0]
+	return nil
+}
+
 var gomaxprocs = runtime.GOMAXPROCS(-1)
 
 type packedTimeseries struct {
@@ -212,6 +287,102 @@ func (pts *packedTimeseries) Unpack(tbf *tmpBlocksFile, dst *Result, tr storage.
 
 	// Merge blocks
 	mergeSortBlocks(dst, sbs)
+
+	// Deduplicate samples from distinct blocks, which weren't merged yet.
+	dst.Timestamps, dst.Values = storage.DeduplicateSamples(dst.Timestamps, dst.Values)
+	if *removeExactDuplicates {
+		dst.Timestamps, dst.Values = removeExactDuplicateSamples(dst.Timestamps, dst.Values)
+	}
+	return nil
+}
+
+// UnpackChunked unpacks pts to dst in chunks containing up to maxRowsPerChunk samples and calls f for every chunk.
+//
+// Blocks are unpacked lazily in the order of their minimum timestamps,
+// so only the blocks overlapping the current chunk are held in memory.
+func (pts *packedTimeseries) UnpackChunked(tbf *tmpBlocksFile, dst *Result, tr storage.TimeRange, maxRowsPerChunk int, f func(rs *Result)) error {
+	dst.reset()
+
+	if err := dst.MetricName.Unmarshal(bytesutil.ToUnsafeBytes(pts.metricName)); err != nil {
+		return fmt.Errorf("cannot unmarshal metricName %q: %s", pts.metricName, err)
+	}
+
+	// Sort blocks by their minimum timestamps, so they could be unpacked on demand.
+	// Every block is read only once when it is unpacked.
+	pbs := pts.addrs
+	pts.addrs = nil
+	sort.Slice(pbs, func(i, j int) bool {
+		return pbs[i].minTimestamp < pbs[j].minTimestamp
+	})
+
+	flush := func() {
+		if len(dst.Timestamps) == 0 {
+			return
+		}
+		dst.Timestamps, dst.Values = storage.DeduplicateSamples(dst.Timestamps, dst.Values)
+		if *removeExactDuplicates {
+			dst.Timestamps, dst.Values = removeExactDuplicateSamples(dst.Timestamps, dst.Values)
+		}
+		f(dst)
+		dst.Timestamps = dst.Timestamps[:0]
+		dst.Values = dst.Values[:0]
+	}
+	var sbh sortBlocksHeap
+	for len(sbh) > 0 || len(pbs) > 0 {
+		// Unpack all the blocks, which may contain samples preceding the next sample in sbh.
+		for len(pbs) > 0 && (len(sbh) == 0 || pbs[0].minTimestamp <= sbh[0].Timestamps[sbh[0].NextIdx]) {
+			sb := getSortBlock()
+			if err := sb.unpackFrom(tbf, pbs[0], tr); err != nil {
+				putSortBlock(sb)
+				for _, sb := range sbh {
+					putSortBlock(sb)
+				}
+				return err
+			}
+			pbs = pbs[1:]
+			if len(sb.Timestamps) == 0 {
+				putSortBlock(sb)
+				continue
+			}
+			heap.Push(&sbh, sb)
+		}
+		if len(sbh) == 0 {
+			continue
+		}
+
+		// Copy samples from the top block until the next sample in other blocks.
+		top := sbh[0]
+		tsNext := int64(math.MaxInt64)
+		if len(sbh) > 1 {
+			sbNext := sbh[1]
+			if len(sbh) > 2 && sbh[2].Timestamps[sbh[2].NextIdx] < sbNext.Timestamps[sbNext.NextIdx] {
+				sbNext = sbh[2]
+			}
+			tsNext = sbNext.Timestamps[sbNext.NextIdx]
+		}
+		if len(pbs) > 0 && pbs[0].minTimestamp < tsNext {
+			tsNext = pbs[0].minTimestamp
+		}
+		idxNext := top.NextIdx
+		n := maxRowsPerChunk - len(dst.Timestamps)
+		for idxNext < len(top.Timestamps) && top.Timestamps[idxNext] <= tsNext && n > 0 {
+			idxNext++
+			n--
+		}
+		dst.Timestamps = append(dst.Timestamps, top.Timestamps[top.NextIdx:idxNext]...)
+		dst.Values = append(dst.Values, top.Values[top.NextIdx:idxNext]...)
+		if len(dst.Timestamps) >= maxRowsPerChunk {
+			flush()
+		}
+		if idxNext < len(top.Timestamps) {
+			top.NextIdx = idxNext
+			heap.Fix(&sbh, 0)
+		} else {
+			heap.Pop(&sbh)
+			putSortBlock(top)
+		}
+	}
+	flush()
 	return nil
 }
 
@@ -232,6 +403,42 @@ var sbPool sync.Pool
 
 var metricRowsSkipped = metrics.NewCounter(`vm_metric_rows_skipped_total{name="vmselect"}`)
 
+// removeExactDuplicateSamples removes samples with identical timestamps and bit-identical values.
+//
+// timestamps must be sorted. Samples with identical timestamps and distinct values are preserved.
+// The returned slices share memory with the passed slices.
+func removeExactDuplicateSamples(timestamps []int64, values []float64) ([]int64, []float64) {
+	// Fast path - search for the first pair of samples with identical timestamps.
+	i := 1
+	for i < len(timestamps) && timestamps[i] != timestamps[i-1] {
+		i++
+	}
+	if i >= len(timestamps) {
+		return timestamps, values
+	}
+
+	// Slow path - remove exact duplicates in place.
+	dstLen := i
+	for ; i < len(timestamps); i++ {
+		ts := timestamps[i]
+		vBits := math.Float64bits(values[i])
+		isDuplicate := false
+		for j := dstLen - 1; j >= 0 && timestamps[j] == ts; j-- {
+			if math.Float64bits(values[j]) == vBits {
+				isDuplicate = true
+				break
+			}
+		}
+		if isDuplicate {
+			continue
+		}
+		timestamps[dstLen] = ts
+		values[dstLen] = values[i]
+		dstLen++
+	}
+	return timestamps[:dstLen], values[:dstLen]
+}
+
 func mergeSortBlocks(dst *Result, sbh sortBlocksHeap) {
 	// Skip empty sort blocks, since they cannot be passed to heap.Init.
 	src := sbh
@@ -353,8 +560,10 @@ func (sbh *sortBlocksHeap) Pop() interface{} {
 }
 
 // DeleteSeries deletes time series matching the given tagFilterss.
-func DeleteSeries(sq *storage.SearchQuery) (int, error) {
-	tfss, err := setupTfss(sq.TagFilterss)
+//
+// Only time series for the tenant from the deadline are deleted.
+func DeleteSeries(sq *storage.SearchQuery, deadline Deadline) (int, error) {
+	tfss, err := setupTfss(sq.TagFilterss, deadline.AccountID())
 	if err != nil {
 		return 0, err
 	}
@@ -363,6 +572,9 @@ func DeleteSeries(sq *storage.SearchQuery) (int, error) {
 
 // GetLabels returns labels until the given deadline.
 func GetLabels(deadline Deadline) ([]string, error) {
+	if deadline.AccountID() != "" {
+		return GetLabelsOnTimeRange(getTenantSearchQuery(), deadline)
+	}
 	labels, err := vmstorage.SearchTagKeys(*maxTagKeysPerSearch)
 	if err != nil {
 		return nil, fmt.Errorf("error during labels search: %s", err)
@@ -384,6 +596,9 @@ func GetLabels(deadline Deadline) ([]string, error) {
 // GetLabelValues returns label values for the given labelName
 // until the given deadline.
 func GetLabelValues(labelName string, deadline Deadline) ([]string, error) {
+	if deadline.AccountID() != "" {
+		return GetLabelValuesOnTimeRange(labelName, getTenantSearchQuery(), deadline)
+	}
 	if labelName == "__name__" {
 		labelName = ""
 	}
@@ -400,8 +615,86 @@ func GetLabelValues(labelName string, deadline Deadline) ([]string, error) {
 	return labelValues, nil
 }
 
+// GetLabelsOnTimeRange returns labels for time series matching sq.TagFilterss
+// on the time range from sq until the given deadline.
+func GetLabelsOnTimeRange(sq *storage.SearchQuery, deadline Deadline) ([]string, error) {
+	tfss, err := setupTfss(sq.TagFilterss, deadline.AccountID())
+	if err != nil {
+		return nil, err
+	}
+	tr := storage.TimeRange{
+		MinTimestamp: sq.MinTimestamp,
+		MaxTimestamp: sq.MaxTimestamp,
+	}
+	labels, err := vmstorage.SearchTagKeysOnTimeRange(tfss, tr, *maxTagKeysPerSearch, *maxMetricsPerSearch)
+	if err != nil {
+		return nil, fmt.Errorf("error during labels search on time range: %s", err)
+	}
+
+	// Substitute "" with "__name__"
+	for i := range labels {
+		if labels[i] == "" {
+			labels[i] = "__name__"
+		}
+	}
+
+	// Sort labels like Prometheus does
+	sort.Strings(labels)
+
+	return labels, nil
+}
+
+// GetSeries returns up to limit metric names for time series matching sq.
+//
+// The returned bool is set to true if the result has been truncated to limit.
+func GetSeries(sq *storage.SearchQuery, limit int, deadline Deadline) ([]storage.MetricName, bool, error) {
+	tfss, err := setupTfss(sq.TagFilterss, deadline.AccountID())
+	if err != nil {
+		return nil, false, err
+	}
+	tr := storage.TimeRange{
+		MinTimestamp: sq.MinTimestamp,
+		MaxTimestamp: sq.MaxTimestamp,
+	}
+	mns, isLimited, err := vmstorage.SearchMetricNames(tfss, tr, limit, *maxMetricsPerSearch)
+	if err != nil {
+		return nil, false, fmt.Errorf("error during series search: %s", err)
+	}
+	return mns, isLimited, nil
+}
+
+// GetLabelValuesOnTimeRange returns label values for the given labelName
+// for time series matching sq.TagFilterss on the time range from sq until the given deadline.
+func GetLabelValuesOnTimeRange(labelName string, sq *storage.SearchQuery, deadline Deadline) ([]string, error) {
+	if labelName == "__name__" {
+		labelName = ""
+	}
+	tfss, err := setupTfss(sq.TagFilterss, deadline.AccountID())
+	if err != nil {
+		return nil, err
+	}
+	tr := storage.TimeRange{
+		MinTimestamp: sq.MinTimestamp,
+		MaxTimestamp: sq.MaxTimestamp,
+	}
+
+	// Search for tag values
+	labelValues, err := vmstorage.SearchTagValuesOnTimeRange([]byte(labelName), tfss, tr, *maxTagValuesPerSearch, *maxMetricsPerSearch)
+	if err != nil {
+		return nil, fmt.Errorf("error during label values search on time range for labelName=%q: %s", labelName, err)
+	}
+
+	// Sort labelValues like Prometheus does
+	sort.Strings(labelValues)
+
+	return labelValues, nil
+}
+
 // GetLabelEntries returns all the label entries until the given deadline.
 func GetLabelEntries(deadline Deadline) ([]storage.TagEntry, error) {
+	if deadline.AccountID() != "" {
+		return nil, errTenantUnsupported
+	}
 	labelEntries, err := vmstorage.SearchTagEntries(*maxTagKeysPerSearch, *maxTagValuesPerSearch)
 	if err != nil {
 		return nil, fmt.Errorf("error during label entries request: %s", err)
@@ -432,6 +725,9 @@ func GetLabelEntries(deadline Deadline) ([]storage.TagEntry, error) {
 
 // GetSeriesCount returns the number of unique series.
 func GetSeriesCount(deadline Deadline) (uint64, error) {
+	if deadline.AccountID() != "" {
+		return 0, errTenantUnsupported
+	}
 	n, err := vmstorage.GetSeriesCount()
 	if err != nil {
 		return 0, fmt.Errorf("error during series count request: %s", err)
@@ -439,6 +735,40 @@ func GetSeriesCount(deadline Deadline) (uint64, error) {
 	return n, nil
 }
 
+// GetTSDBStatusForDate returns tsdb status according to https://prometheus.io/docs/prometheus/latest/querying/api/#tsdb-stats
+func GetTSDBStatusForDate(deadline Deadline, date uint64, topN int) (*storage.TSDBStatus, error) {
+	if deadline.AccountID() != "" {
+		return nil, errTenantUnsupported
+	}
+	status, err := vmstorage.GetTSDBStatusForDate(date, topN)
+	if err != nil {
+		return nil, fmt.Errorf("error during tsdb status request: %s", err)
+	}
+	return status, nil
+}
+
+// GetMetricsMetadata returns metadata for up to limit metric families.
+//
+// Only metadata for metricFamilyName is returned if it isn't empty.
+// Metadata isn't tracked per tenant, so nothing is returned for requests scoped to a tenant.
+func GetMetricsMetadata(metricFamilyName string, limit int, deadline Deadline) map[string][]metricsmetadata.Row {
+	if deadline.AccountID() != "" {
+		return nil
+	}
+	return vmstorage.GetMetricsMetadata(metricFamilyName, limit)
+}
+
+// GetTargetsMetadata returns up to limit metadata rows for targets matching matchTarget.
+//
+// Only metadata for metricFamilyName is returned if it isn't empty.
+// Metadata isn't tracked per tenant, so nothing is returned for requests scoped to a tenant.
+func GetTargetsMetadata(matchTarget func(target []metricsmetadata.Label) bool, metricFamilyName string, limit int, deadline Deadline) []metricsmetadata.TargetRow {
+	if deadline.AccountID() != "" {
+		return nil
+	}
+	return vmstorage.GetTargetsMetadata(matchTarget, metricFamilyName, limit)
+}
+
 func getStorageSearch() *storage.Search {
 	v := ssPool.Get()
 	if v == nil {
@@ -458,10 +788,35 @@ var ssPool sync.Pool
 
 var missingMetricNamesForMetricID = metrics.NewCounter(`vm_missing_metric_names_for_metric_id_total`)
 
+// GetMaxUniqueTimeseries returns the limit on the number of unique time series per query for the requested limit n.
+//
+// The requested limit cannot exceed -search.maxUniqueTimeseries. The flag value is returned if n isn't positive.
+func GetMaxUniqueTimeseries(n int) int {
+	if n <= 0 || n > *maxMetricsPerSearch {
+		return *maxMetricsPerSearch
+	}
+	return n
+}
+
+// tooManyTimeseriesError returns err referring to `max_unique_timeseries` query arg if it is the limit exceeded by the search.
+//
+// Other errors are returned as is.
+func tooManyTimeseriesError(err error) error {
+	e, ok := err.(*storage.TooManyTimeseriesError)
+	if !ok || e.MaxTimeseries >= *maxMetricsPerSearch {
+		return err
+	}
+	return fmt.Errorf("the query matches at least %d unique time series, which exceeds the limit of %d unique time series set via `max_unique_timeseries` query arg; "+
+		"either narrow down the query with more specific label filters or increase `max_unique_timeseries` up to -search.maxUniqueTimeseries=%d",
+		e.Timeseries, e.MaxTimeseries, *maxMetricsPerSearch)
+}
+
 // ProcessSearchQuery performs sq on storage nodes until the given deadline.
-func ProcessSearchQuery(sq *storage.SearchQuery, deadline Deadline) (*Results, error) {
+//
+// Spans for the index lookup and data fetching are added to qt if it is enabled.
+func ProcessSearchQuery(qt *querytracer.Tracer, sq *storage.SearchQuery, deadline Deadline) (*Results, error) {
 	// Setup search.
-	tfss, err := setupTfss(sq.TagFilterss)
+	tfss, err := setupTfss(sq.TagFilterss, deadline.AccountID())
 	if err != nil {
 		return nil, err
 	}
@@ -473,33 +828,54 @@ func ProcessSearchQuery(sq *storage.SearchQuery, deadline Deadline) (*Results, e
 	vmstorage.WG.Add(1)
 	defer vmstorage.WG.Done()
 
+	var qtChild *querytracer.Tracer
+	if qt.Enabled() {
+		qtChild = qt.NewChild("index lookup: filters=%s, timeRange=%s", tagFilterssString(sq.TagFilterss), &tr)
+	}
+	// Stop index scans and data fetches as soon as the deadline is exceeded or the request is canceled by client.
+	ctx, cancel := context.WithDeadline(deadline.context(), deadline.Deadline)
+	defer cancel()
 	sr := getStorageSearch()
 	defer putStorageSearch(sr)
-	sr.Init(vmstorage.Storage, tfss, tr, *maxMetricsPerSearch)
+	sr.InitWithStopCh(vmstorage.Storage, tfss, tr, GetMaxUniqueTimeseries(sq.MaxMetrics), ctx.Done())
+	qtChild.Donef("done")
 
+	if qt.Enabled() {
+		qtChild = qt.NewChild("fetch data blocks")
+	}
+	blocksCount := 0
+	samplesCount := 0
 	tbf := getTmpBlocksFile()
 	m := make(map[string][]tmpBlockAddr)
 	for sr.NextMetricBlock() {
+		blocksCount++
+		samplesCount += sr.MetricBlock.Block.RowsCount()
 		addr, err := tbf.WriteBlock(sr.MetricBlock.Block)
 		if err != nil {
 			putTmpBlocksFile(tbf)
 			return nil, fmt.Errorf("cannot write data to temporary blocks file: %s", err)
 		}
-		if time.Until(deadline.Deadline) < 0 {
+		if deadline.Exceeded() {
 			putTmpBlocksFile(tbf)
-			return nil, fmt.Errorf("timeout exceeded while fetching data from storage: %s", deadline.Timeout)
+			return nil, deadline.Error("while fetching data from storage")
 		}
 		metricName := sr.MetricBlock.MetricName
 		m[string(metricName)] = append(m[string(metricName)], addr)
 	}
 	if err := sr.Error(); err != nil {
 		putTmpBlocksFile(tbf)
-		return nil, fmt.Errorf("search error: %s", err)
+		if deadline.Exceeded() {
+			return nil, deadline.Error("while fetching data from storage")
+		}
+		return nil, fmt.Errorf("search error: %s", tooManyTimeseriesError(err))
 	}
 	if err := tbf.Finalize(); err != nil {
 		putTmpBlocksFile(tbf)
 		return nil, fmt.Errorf("cannot finalize temporary blocks file: %s", err)
 	}
+	if qt.Enabled() {
+		qtChild.Donef("series=%d, blocks=%d, samples=%d", len(m), blocksCount, samplesCount)
+	}
 
 	var rss Results
 	rss.packedTimeseries = make([]packedTimeseries, len(m))
@@ -535,7 +911,13 @@ func putResult(rs *Result) {
 
 var rsPool sync.Pool
 
-func setupTfss(tagFilterss [][]storage.TagFilter) ([]*storage.TagFilters, error) {
+// setupTfss returns tag filters for the given tagFilterss.
+//
+// If accountID isn't empty, then the returned filters match only series for the given tenant.
+func setupTfss(tagFilterss [][]storage.TagFilter, accountID string) ([]*storage.TagFilters, error) {
+	if accountID != "" && len(tagFilterss) == 0 {
+		tagFilterss = [][]storage.TagFilter{nil}
+	}
 	tfss := make([]*storage.TagFilters, 0, len(tagFilterss))
 	for _, tagFilters := range tagFilterss {
 		tfs := storage.NewTagFilters()
@@ -545,21 +927,114 @@ func setupTfss(tagFilterss [][]storage.TagFilter) ([]*storage.TagFilters, error)
 				return nil, fmt.Errorf("cannot parse tag filter %s: %s", tf, err)
 			}
 		}
+		if accountID != "" {
+			if err := tfs.Add([]byte(tenant.Label), []byte(accountID), false, false); err != nil {
+				logger.Panicf("BUG: cannot add tenant filter: %s", err)
+			}
+		}
 		tfss = append(tfss, tfs)
 	}
 	return tfss, nil
 }
 
+// getTenantSearchQuery returns a search query for all the series for the tenant on the whole retention.
+func getTenantSearchQuery() *storage.SearchQuery {
+	return &storage.SearchQuery{
+		MinTimestamp: 0,
+		MaxTimestamp: time.Now().UnixNano() / 1e6,
+	}
+}
+
+var errTenantUnsupported = fmt.Errorf("the request isn't supported for tenants when -insert.extractTenantFromPath is set")
+
+// tagFilterssString returns human-readable representation of tagFilterss for query traces.
+func tagFilterssString(tagFilterss [][]storage.TagFilter) string {
+	var b []byte
+	for i, tagFilters := range tagFilterss {
+		if i > 0 {
+			b = append(b, " or "...)
+		}
+		b = append(b, '{')
+		for j := range tagFilters {
+			tf := &tagFilters[j]
+			if j > 0 {
+				b = append(b, ',')
+			}
+			if len(tf.Key) == 0 {
+				b = append(b, "__name__"...)
+			} else {
+				b = append(b, tf.Key...)
+			}
+			switch {
+			case tf.IsNegative && tf.IsRegexp:
+				b = append(b, "!~"...)
+			case tf.IsNegative:
+				b = append(b, "!="...)
+			case tf.IsRegexp:
+				b = append(b, "=~"...)
+			default:
+				b = append(b, '=')
+			}
+			b = strconv.AppendQuote(b, string(tf.Value))
+		}
+		b = append(b, '}')
+	}
+	return string(b)
+}
+
 // Deadline contains deadline with the corresponding timeout for pretty error messages.
+//
+// Deadline is also exceeded when the request is canceled by client.
 type Deadline struct {
 	Deadline time.Time
 	Timeout  time.Duration
+
+	// ctx is canceled when the request is canceled by client. It may be nil.
+	ctx context.Context
 }
 
 // NewDeadline returns deadline for the given timeout.
 func NewDeadline(timeout time.Duration) Deadline {
+	return NewDeadlineWithContext(context.Background(), timeout)
+}
+
+// NewDeadlineWithContext returns deadline for the given timeout, which is also exceeded when ctx is canceled.
+func NewDeadlineWithContext(ctx context.Context, timeout time.Duration) Deadline {
 	return Deadline{
 		Deadline: time.Now().Add(timeout),
 		Timeout:  timeout,
+		ctx:      ctx,
+	}
+}
+
+// Exceeded returns true if d is exceeded or the request is canceled by client.
+func (d *Deadline) Exceeded() bool {
+	return d.IsCanceled() || time.Until(d.Deadline) < 0
+}
+
+// IsCanceled returns true if the request is canceled by client.
+func (d *Deadline) IsCanceled() bool {
+	return d.context().Err() != nil
+}
+
+// Error returns an error explaining why d has been exceeded during the given action.
+func (d *Deadline) Error(action string) error {
+	if d.IsCanceled() {
+		return fmt.Errorf("the request has been canceled by client %s", action)
+	}
+	return fmt.Errorf("timeout exceeded %s: %s", action, d.Timeout)
+}
+
+// AccountID returns tenant's accountID for the request, which created d.
+//
+// Empty string is returned if the request isn't scoped to a tenant.
+func (d *Deadline) AccountID() string {
+	return tenant.GetAccountID(d.context())
+}
+
+func (d *Deadline) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
 	}
+	return d.ctx
 }
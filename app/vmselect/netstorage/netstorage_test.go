@@ -0,0 +1,299 @@
+package netstorage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestDeadline(t *testing.T) {
+	f := func(d Deadline, exceededExpected, canceledExpected bool, errExpected string) {
+		t.Helper()
+		if exceeded := d.Exceeded(); exceeded != exceededExpected {
+			t.Fatalf("unexpected Exceeded(); got %v; want %v", exceeded, exceededExpected)
+		}
+		if canceled := d.IsCanceled(); canceled != canceledExpected {
+			t.Fatalf("unexpected IsCanceled(); got %v; want %v", canceled, canceledExpected)
+		}
+		if !exceededExpected {
+			return
+		}
+		err := d.Error("during tests")
+		if !strings.Contains(err.Error(), errExpected) {
+			t.Fatalf("unexpected error; got %q; must contain %q", err, errExpected)
+		}
+	}
+
+	f(NewDeadline(time.Hour), false, false, "")
+	f(NewDeadline(-time.Second), true, false, "timeout exceeded during tests: -1s")
+	f(Deadline{}, true, false, "timeout exceeded during tests")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := NewDeadlineWithContext(ctx, time.Hour)
+	f(d, false, false, "")
+	cancel()
+	f(d, true, true, "the request has been canceled by client during tests")
+
+	// Cancellation takes precedence over timeout in error messages.
+	f(NewDeadlineWithContext(ctx, -time.Second), true, true, "canceled by client")
+}
+
+func TestGetMaxUniqueTimeseries(t *testing.T) {
+	f := func(n, resultExpected int) {
+		t.Helper()
+		if result := GetMaxUniqueTimeseries(n); result != resultExpected {
+			t.Fatalf("unexpected result for n=%d; got %d; want %d", n, result, resultExpected)
+		}
+	}
+	maxMetrics := *maxMetricsPerSearch
+	f(0, maxMetrics)
+	f(-1, maxMetrics)
+	f(1, 1)
+	f(maxMetrics-1, maxMetrics-1)
+	f(maxMetrics, maxMetrics)
+
+	// The requested limit cannot exceed -search.maxUniqueTimeseries.
+	f(maxMetrics+1, maxMetrics)
+}
+
+func TestTooManyTimeseriesError(t *testing.T) {
+	f := func(err error, errExpected string) {
+		t.Helper()
+		if errStr := tooManyTimeseriesError(err).Error(); errStr != errExpected {
+			t.Fatalf("unexpected error;\ngot\n%s\nwant\n%s", errStr, errExpected)
+		}
+	}
+	maxMetrics := *maxMetricsPerSearch
+
+	// Other errors are returned as is.
+	f(fmt.Errorf("foo"), "foo")
+
+	// The error for -search.maxUniqueTimeseries is returned as is.
+	err := &storage.TooManyTimeseriesError{
+		Timeseries:    maxMetrics + 1,
+		MaxTimeseries: maxMetrics,
+	}
+	f(err, err.Error())
+
+	// The error for max_unique_timeseries query arg must refer to the query arg.
+	err = &storage.TooManyTimeseriesError{
+		Timeseries:    11,
+		MaxTimeseries: 10,
+	}
+	f(err, fmt.Sprintf("the query matches at least 11 unique time series, which exceeds the limit of 10 unique time series set via `max_unique_timeseries` query arg; "+
+		"either narrow down the query with more specific label filters or increase `max_unique_timeseries` up to -search.maxUniqueTimeseries=%d", maxMetrics))
+}
+
+func TestPackedTimeseriesUnpackChunked(t *testing.T) {
+	// Write two interleaved sets of blocks for a series with millions of samples,
+	// so every block overlaps with a block from the other set.
+	const rowsCount = 2 * 1000 * 1000
+	const rowsPerBlock = 8 * 1024
+	tbf := getTmpBlocksFile()
+	defer putTmpBlocksFile(tbf)
+	var addrs []tmpBlockAddr
+	for start := 0; start < rowsCount; start += 2 * rowsPerBlock {
+		for _, offset := range []int{1, 0} {
+			var timestamps, values []int64
+			for i := start + offset; i < start+2*rowsPerBlock && i < rowsCount; i += 2 {
+				timestamps = append(timestamps, int64(i)*10)
+				values = append(values, int64(i))
+			}
+			var b storage.Block
+			b.Init(&storage.TSID{MetricID: 123}, timestamps, values, 0, 64)
+			_, _, _ = b.MarshalData(0, 0)
+			addr, err := tbf.WriteBlock(&b)
+			if err != nil {
+				t.Fatalf("cannot write block: %s", err)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	if err := tbf.Finalize(); err != nil {
+		t.Fatalf("cannot finalize tbf: %s", err)
+	}
+	// Blocks must be unpacked in the order of their timestamps regardless of their order in addrs.
+	rand.New(rand.NewSource(1)).Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+
+	var mn storage.MetricName
+	mn.MetricGroup = []byte("foo")
+	pts := &packedTimeseries{
+		metricName: string(mn.Marshal(nil)),
+		addrs:      addrs,
+	}
+	tr := storage.TimeRange{
+		MinTimestamp: 0,
+		MaxTimestamp: rowsCount * 10,
+	}
+
+	const maxRowsPerChunk = 10000
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	allocsStart := ms.TotalAlloc
+	var rs Result
+	rowsSeen := 0
+	chunks := 0
+	var errChunk error
+	err := pts.UnpackChunked(tbf, &rs, tr, maxRowsPerChunk, func(rs *Result) {
+		chunks++
+		if errChunk != nil {
+			return
+		}
+		if string(rs.MetricName.MetricGroup) != "foo" {
+			errChunk = fmt.Errorf("unexpected metric name in chunk #%d: %q", chunks, rs.MetricName.MetricGroup)
+			return
+		}
+		if len(rs.Timestamps) != len(rs.Values) {
+			errChunk = fmt.Errorf("the number of timestamps mismatches the number of values in chunk #%d: %d vs %d", chunks, len(rs.Timestamps), len(rs.Values))
+			return
+		}
+		if len(rs.Timestamps) > maxRowsPerChunk {
+			errChunk = fmt.Errorf("too many rows in chunk #%d; got %d; want up to %d", chunks, len(rs.Timestamps), maxRowsPerChunk)
+			return
+		}
+		if cap(rs.Timestamps) > 2*maxRowsPerChunk || cap(rs.Values) > 2*maxRowsPerChunk {
+			errChunk = fmt.Errorf("chunk buffers must be reused; got capacity %d for timestamps and %d for values in chunk #%d; want up to %d",
+				cap(rs.Timestamps), cap(rs.Values), chunks, 2*maxRowsPerChunk)
+			return
+		}
+		for i, ts := range rs.Timestamps {
+			if ts != int64(rowsSeen)*10 || rs.Values[i] != float64(rowsSeen) {
+				errChunk = fmt.Errorf("unexpected sample #%d; got (%d, %v); want (%d, %d)", rowsSeen, ts, rs.Values[i], rowsSeen*10, rowsSeen)
+				return
+			}
+			rowsSeen++
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	runtime.ReadMemStats(&ms)
+	allocs := ms.TotalAlloc - allocsStart
+	if errChunk != nil {
+		t.Fatalf("%s", errChunk)
+	}
+	if rowsSeen != rowsCount {
+		t.Fatalf("unexpected number of rows; got %d; want %d", rowsSeen, rowsCount)
+	}
+	if chunksExpected := (rowsCount + maxRowsPerChunk - 1) / maxRowsPerChunk; chunks != chunksExpected {
+		t.Fatalf("unexpected number of chunks; got %d; want %d", chunks, chunksExpected)
+	}
+
+	// Unpacking the whole series requires at least 16 bytes per sample.
+	// Chunked unpacking must use only a small fraction of this memory.
+	if maxAllocs := uint64(rowsCount * 16 / 4); allocs > maxAllocs {
+		t.Fatalf("too much memory allocated during chunked unpacking; got %d bytes; want up to %d bytes", allocs, maxAllocs)
+	}
+}
+
+func TestRemoveExactDuplicateSamples(t *testing.T) {
+	f := func(timestamps []int64, values []float64, timestampsExpected []int64, valuesExpected []float64) {
+		t.Helper()
+		timestampsResult, valuesResult := removeExactDuplicateSamples(timestamps, values)
+		if !reflect.DeepEqual(timestampsResult, timestampsExpected) {
+			t.Fatalf("unexpected timestamps; got %v; want %v", timestampsResult, timestampsExpected)
+		}
+		if len(valuesResult) != len(valuesExpected) {
+			t.Fatalf("unexpected number of values; got %d; want %d", len(valuesResult), len(valuesExpected))
+		}
+		for i, v := range valuesExpected {
+			if math.Float64bits(valuesResult[i]) != math.Float64bits(v) {
+				t.Fatalf("unexpected value #%d; got %v; want %v", i, valuesResult[i], v)
+			}
+		}
+	}
+	f(nil, nil, nil, nil)
+	f([]int64{1}, []float64{2}, []int64{1}, []float64{2})
+	f([]int64{1, 2, 3}, []float64{1, 1, 1}, []int64{1, 2, 3}, []float64{1, 1, 1})
+	f([]int64{1, 1, 2, 2, 2}, []float64{1, 1, 2, 2, 2}, []int64{1, 2}, []float64{1, 2})
+
+	// Samples with identical timestamps and distinct values must be preserved.
+	f([]int64{1, 1, 1, 1, 2}, []float64{1, 2, 1, 2, 3}, []int64{1, 1, 2}, []float64{1, 2, 3})
+
+	// Only bit-identical values are considered duplicates.
+	f([]int64{1, 1, 2, 2}, []float64{0, math.Copysign(0, -1), math.NaN(), math.NaN()}, []int64{1, 1, 2}, []float64{0, math.Copysign(0, -1), math.NaN()})
+}
+
+func TestPackedTimeseriesUnpackExactDuplicates(t *testing.T) {
+	defer func(v bool) {
+		*removeExactDuplicates = v
+	}(*removeExactDuplicates)
+
+	// The second block is an exact replica of the first block, while the third block
+	// contains a sample with the same timestamp and a distinct value.
+	blocks := [][2][]int64{
+		{{1000, 2000, 3000, 4000}, {1, 2, 3, 4}},
+		{{1000, 2000, 3000, 4000}, {1, 2, 3, 4}},
+		{{2000}, {5}},
+	}
+	f := func(countExpected int) {
+		t.Helper()
+		tbf := getTmpBlocksFile()
+		defer putTmpBlocksFile(tbf)
+		var addrs []tmpBlockAddr
+		for _, bd := range blocks {
+			var b storage.Block
+			b.Init(&storage.TSID{MetricID: 123}, bd[0], bd[1], 0, 64)
+			_, _, _ = b.MarshalData(0, 0)
+			addr, err := tbf.WriteBlock(&b)
+			if err != nil {
+				t.Fatalf("cannot write block: %s", err)
+			}
+			addrs = append(addrs, addr)
+		}
+		if err := tbf.Finalize(); err != nil {
+			t.Fatalf("cannot finalize tbf: %s", err)
+		}
+		var mn storage.MetricName
+		mn.MetricGroup = []byte("foo")
+		tr := storage.TimeRange{
+			MinTimestamp: 0,
+			MaxTimestamp: 10000,
+		}
+
+		// Verify the number of samples seen by count_over_time over the whole time range.
+		pts := &packedTimeseries{
+			metricName: string(mn.Marshal(nil)),
+			addrs:      append([]tmpBlockAddr{}, addrs...),
+		}
+		var rs Result
+		if err := pts.Unpack(tbf, &rs, tr, 4); err != nil {
+			t.Fatalf("unexpected error in Unpack: %s", err)
+		}
+		if len(rs.Timestamps) != countExpected {
+			t.Fatalf("unexpected number of samples from Unpack; got %d (%v); want %d", len(rs.Timestamps), rs.Timestamps, countExpected)
+		}
+
+		pts = &packedTimeseries{
+			metricName: string(mn.Marshal(nil)),
+			addrs:      append([]tmpBlockAddr{}, addrs...),
+		}
+		count := 0
+		err := pts.UnpackChunked(tbf, &rs, tr, 1000, func(rs *Result) {
+			count += len(rs.Timestamps)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error in UnpackChunked: %s", err)
+		}
+		if count != countExpected {
+			t.Fatalf("unexpected number of samples from UnpackChunked; got %d; want %d", count, countExpected)
+		}
+	}
+
+	*removeExactDuplicates = true
+	f(5)
+
+	*removeExactDuplicates = false
+	f(9)
+}
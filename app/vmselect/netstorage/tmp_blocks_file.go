@@ -63,6 +63,10 @@ var tmpBlocksFilePool sync.Pool
 type tmpBlockAddr struct {
 	offset uint64
 	size   int
+
+	// minTimestamp is the minimum timestamp in the block.
+	// It is used for unpacking blocks in the order of their timestamps without reading them.
+	minTimestamp int64
 }
 
 func (addr tmpBlockAddr) String() string {
@@ -94,6 +98,7 @@ var tmpBlocksFilesCreated = metrics.NewCounter(`vm_tmp_blocks_files_created_tota
 func (tbf *tmpBlocksFile) WriteBlock(b *storage.Block) (tmpBlockAddr, error) {
 	var addr tmpBlockAddr
 	addr.offset = tbf.offset
+	addr.minTimestamp = b.MinTimestamp()
 
 	tbfBufLen := len(tbf.buf)
 	tbf.buf = storage.MarshalBlock(tbf.buf, b)
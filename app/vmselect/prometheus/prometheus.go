@@ -1,33 +1,63 @@
 package prometheus
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"math"
 	"net/http"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/promql"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/querytracer"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/selector"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 	"github.com/VictoriaMetrics/metrics"
+	"github.com/golang/snappy"
 	"github.com/valyala/quicktemplate"
 )
 
 var (
 	maxQueryDuration = flag.Duration("search.maxQueryDuration", time.Second*30, "The maximum time for search query execution")
 	maxQueryLen      = flag.Int("search.maxQueryLen", 16*1024, "The maximum search query length in bytes")
+
+	maxRemoteReadRequestSize = flag.Int("search.maxRemoteReadRequestSize", 1024*1024, "The maximum size of a single remote_read request in bytes")
+
+	latencyOffset = flag.Duration("search.latencyOffset", time.Minute, "The time between data points are collected and the time they become complete in query results. "+
+		"Instant and range queries without explicit time are evaluated at the current time minus this offset, so incomplete recent data isn't shown. "+
+		"Queries with explicit time and exports aren't affected")
+	minDefaultStep = flag.Duration("search.minDefaultStep", time.Second, "The minimum step for /api/v1/query_range requests without step arg. "+
+		"The step for such requests is calculated as (end-start)/250 like Prometheus UI does, but it cannot be smaller than this value")
+
+	allowDeleteSeries = flag.Bool("search.allowDeleteSeries", false, "Whether to allow deleting time series via /api/v1/admin/tsdb/delete_series and DELETE /api/v1/series. "+
+		"Deletion requests are rejected with 409 Conflict if this flag isn't set")
+
+	maxSeries = flag.Int("search.maxSeries", 100e3, "The maximum number of time series, which may be returned from /api/v1/series. "+
+		"Requests with bigger `limit` query arg are limited to this value")
+	defaultSeriesLimit = flag.Int("search.defaultSeriesLimit", 0, "The maximum number of time series returned from /api/v1/series without `limit` query arg. "+
+		"-search.maxSeries is used if this flag isn't set")
 )
 
 // Default step used if not set.
 const defaultStep = 5 * 60 * 1000
 
-// Latency for data processing pipeline, i.e. the time between data is ignested
-// into the system and the time it becomes visible to search.
-const latencyOffset = 60 * 1000
+// Default step used for instant queries if not set.
+const defaultInstantStep = 60 * 1000
+
+func getLatencyOffsetMsecs() int64 {
+	return latencyOffset.Nanoseconds() / 1e6
+}
 
 // FederateHandler implements /federate . See https://prometheus.io/docs/prometheus/latest/federation/
 func FederateHandler(w http.ResponseWriter, r *http.Request) error {
@@ -62,7 +92,7 @@ func FederateHandler(w http.ResponseWriter, r *http.Request) error {
 		MaxTimestamp: end,
 		TagFilterss:  tagFilterss,
 	}
-	rss, err := netstorage.ProcessSearchQuery(sq, deadline)
+	rss, err := netstorage.ProcessSearchQuery(nil, sq, deadline)
 	if err != nil {
 		return fmt.Errorf("cannot fetch data for %q: %s", sq, err)
 	}
@@ -121,7 +151,19 @@ func ExportHandler(w http.ResponseWriter, r *http.Request) error {
 	if start >= end {
 		start = end - defaultStep
 	}
-	if err := exportHandler(w, matches, start, end, format, deadline); err != nil {
+	etfs, err := getExtraTagFilters(r)
+	if err != nil {
+		return err
+	}
+	maxMetrics, err := getMaxUniqueTimeseries(r)
+	if err != nil {
+		return err
+	}
+	maxRowsPerLine, err := getLimit(r, "max_rows_per_line")
+	if err != nil {
+		return err
+	}
+	if err := exportHandler(w, matches, etfs, start, end, format, maxMetrics, maxRowsPerLine, deadline); err != nil {
 		return err
 	}
 	exportDuration.UpdateDuration(startTime)
@@ -130,7 +172,12 @@ func ExportHandler(w http.ResponseWriter, r *http.Request) error {
 
 var exportDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/export"}`)
 
-func exportHandler(w http.ResponseWriter, matches []string, start, end int64, format string, deadline netstorage.Deadline) error {
+// exportHandler writes the data for the given matches to w in the given format.
+//
+// Every time series is split into lines containing up to maxRowsPerLine samples each if maxRowsPerLine > 0.
+// This limits memory usage when exporting time series with big number of samples.
+// maxRowsPerLine is ignored for `promapi` format, since it requires a single object per time series.
+func exportHandler(w http.ResponseWriter, matches []string, etfs []storage.TagFilter, start, end int64, format string, maxMetrics, maxRowsPerLine int, deadline netstorage.Deadline) error {
 	writeResponseFunc := WriteExportStdResponse
 	writeLineFunc := WriteExportJSONLine
 	contentType := "application/json"
@@ -140,6 +187,7 @@ func exportHandler(w http.ResponseWriter, matches []string, start, end int64, fo
 	} else if format == "promapi" {
 		writeResponseFunc = WriteExportPromAPIResponse
 		writeLineFunc = WriteExportPromAPILine
+		maxRowsPerLine = 0
 	}
 
 	tagFilterss, err := getTagFilterssFromMatches(matches)
@@ -149,9 +197,10 @@ func exportHandler(w http.ResponseWriter, matches []string, start, end int64, fo
 	sq := &storage.SearchQuery{
 		MinTimestamp: start,
 		MaxTimestamp: end,
-		TagFilterss:  tagFilterss,
+		TagFilterss:  joinTagFilterss(tagFilterss, etfs),
+		MaxMetrics:   maxMetrics,
 	}
-	rss, err := netstorage.ProcessSearchQuery(sq, deadline)
+	rss, err := netstorage.ProcessSearchQuery(nil, sq, deadline)
 	if err != nil {
 		return fmt.Errorf("cannot fetch data for %q: %s", sq, err)
 	}
@@ -159,11 +208,17 @@ func exportHandler(w http.ResponseWriter, matches []string, start, end int64, fo
 	resultsCh := make(chan *quicktemplate.ByteBuffer, runtime.GOMAXPROCS(-1))
 	doneCh := make(chan error)
 	go func() {
-		err := rss.RunParallel(func(rs *netstorage.Result) {
+		f := func(rs *netstorage.Result) {
 			bb := quicktemplate.AcquireByteBuffer()
 			writeLineFunc(bb, rs)
 			resultsCh <- bb
-		})
+		}
+		var err error
+		if maxRowsPerLine > 0 {
+			err = rss.RunParallelChunked(maxRowsPerLine, f)
+		} else {
+			err = rss.RunParallel(f)
+		}
 		close(resultsCh)
 		doneCh <- err
 	}()
@@ -183,45 +238,581 @@ func exportHandler(w http.ResponseWriter, matches []string, start, end int64, fo
 	return nil
 }
 
+// ExportNativeHandler exports data in native format from /api/v1/export/native.
+//
+// The exported data may be imported into other VictoriaMetrics instances via /api/v1/import/native.
+//
+// The response has the following format:
+//
+//   - start and end timestamps as 8-byte big-endian integers;
+//   - a sequence of (metricName, block) pairs, where metricName and block
+//     are prefixed by their 4-byte big-endian lengths. The block is marshaled
+//     with storage.Block.MarshalPortable.
+func ExportNativeHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	ct := currentTime()
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot parse request form values: %s", err)
+	}
+	matches := r.Form["match[]"]
+	if len(matches) == 0 {
+		return fmt.Errorf("missing `match[]` arg")
+	}
+	start, err := getTime(r, "start", 0)
+	if err != nil {
+		return err
+	}
+	end, err := getTime(r, "end", ct)
+	if err != nil {
+		return err
+	}
+	deadline := getDeadline(r)
+	if start >= end {
+		start = end - defaultStep
+	}
+	tagFilterss, err := getTagFilterssFromMatches(matches)
+	if err != nil {
+		return err
+	}
+	sq := &storage.SearchQuery{
+		MinTimestamp: start,
+		MaxTimestamp: end,
+		TagFilterss:  tagFilterss,
+	}
+	// ProcessSearchQuery copies the matching blocks to a temporary file,
+	// so slow clients don't block the storage.
+	rss, err := netstorage.ProcessSearchQuery(nil, sq, deadline)
+	if err != nil {
+		return fmt.Errorf("cannot fetch data for %q: %s", sq, err)
+	}
+
+	w.Header().Set("Content-Type", "VictoriaMetrics/native")
+	// Blocks in native format are already compressed.
+	httpserver.DisableResponseCompression(w)
+	bw := bufio.NewWriterSize(w, 64*1024)
+
+	// Write the time range, so the importer could drop samples outside it.
+	var dst []byte
+	dst = encoding.MarshalInt64(dst, start)
+	dst = encoding.MarshalInt64(dst, end)
+	if _, err := bw.Write(dst); err != nil {
+		rss.Cancel()
+		return fmt.Errorf("cannot write time range: %s", err)
+	}
+
+	var blockData []byte
+	err = rss.RunBlocks(func(metricName []byte, b *storage.Block) error {
+		blockData = b.MarshalPortable(blockData[:0])
+		dst = encoding.MarshalUint32(dst[:0], uint32(len(metricName)))
+		dst = append(dst, metricName...)
+		dst = encoding.MarshalUint32(dst, uint32(len(blockData)))
+		dst = append(dst, blockData...)
+		if _, err := bw.Write(dst); err != nil {
+			return fmt.Errorf("cannot write block: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error during data export: %s", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("cannot flush response: %s", err)
+	}
+	exportNativeDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var exportNativeDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/export/native"}`)
+
+// ExportCSVHandler exports data in CSV format from /api/v1/export/csv.
+//
+// The columns for the exported CSV lines are set via `format` arg.
+// See parseCSVExportFormat for details.
+func ExportCSVHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	ct := currentTime()
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot parse request form values: %s", err)
+	}
+	format := r.FormValue("format")
+	if len(format) == 0 {
+		return fmt.Errorf("missing `format` arg; it must contain comma-separated list of columns such as `__name__,label:host,value,timestamp:unix_ms`")
+	}
+	columns, err := parseCSVExportFormat(format)
+	if err != nil {
+		return err
+	}
+	matches := r.Form["match[]"]
+	if len(matches) == 0 {
+		return fmt.Errorf("missing `match[]` arg")
+	}
+	start, err := getTime(r, "start", 0)
+	if err != nil {
+		return err
+	}
+	end, err := getTime(r, "end", ct)
+	if err != nil {
+		return err
+	}
+	deadline := getDeadline(r)
+	if start >= end {
+		start = end - defaultStep
+	}
+	etfs, err := getExtraTagFilters(r)
+	if err != nil {
+		return err
+	}
+	maxMetrics, err := getMaxUniqueTimeseries(r)
+	if err != nil {
+		return err
+	}
+	tagFilterss, err := getTagFilterssFromMatches(matches)
+	if err != nil {
+		return err
+	}
+	sq := &storage.SearchQuery{
+		MinTimestamp: start,
+		MaxTimestamp: end,
+		TagFilterss:  joinTagFilterss(tagFilterss, etfs),
+		MaxMetrics:   maxMetrics,
+	}
+	rss, err := netstorage.ProcessSearchQuery(nil, sq, deadline)
+	if err != nil {
+		return fmt.Errorf("cannot fetch data for %q: %s", sq, err)
+	}
+
+	resultsCh := make(chan *quicktemplate.ByteBuffer, runtime.GOMAXPROCS(-1))
+	doneCh := make(chan error)
+	go func() {
+		err := rss.RunParallel(func(rs *netstorage.Result) {
+			bb := quicktemplate.AcquireByteBuffer()
+			bb.B = appendCSVLines(bb.B, rs, columns)
+			resultsCh <- bb
+		})
+		close(resultsCh)
+		doneCh <- err
+	}()
+
+	w.Header().Set("Content-Type", "text/csv")
+	bw := bufio.NewWriterSize(w, 64*1024)
+	var writeErr error
+	for bb := range resultsCh {
+		// Consume all the data from resultsCh even if the client is gone.
+		if writeErr == nil {
+			_, writeErr = bw.Write(bb.B)
+		}
+		quicktemplate.ReleaseByteBuffer(bb)
+	}
+	err = <-doneCh
+	if err != nil {
+		return fmt.Errorf("error during data fetching: %s", err)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("cannot write response: %s", writeErr)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("cannot flush response: %s", err)
+	}
+	exportCSVDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var exportCSVDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/export/csv"}`)
+
+// csvExportColumn describes a single column for /api/v1/export/csv.
+type csvExportColumn struct {
+	// labelName is non-empty for label columns. It equals to `__name__` for metric name column.
+	labelName string
+
+	// isValue is set for value column.
+	isValue bool
+
+	// timeFormat is non-empty for timestamp column.
+	timeFormat string
+}
+
+// parseCSVExportFormat parses column descriptors for /api/v1/export/csv from s.
+//
+// s must contain comma-separated list of the following entries:
+//
+//   - __name__ - metric name
+//   - value - sample value
+//   - timestamp:<format> - sample timestamp in the given format. The following formats are supported:
+//     unix_s, unix_ms, unix_ns and rfc3339. unix_ms is used if :<format> is missing.
+//   - label:<name> - the value for the label with the given name. Empty value is written
+//     for series without the given label.
+//
+// The format mirrors the format accepted by /api/v1/import/csv.
+func parseCSVExportFormat(s string) ([]csvExportColumn, error) {
+	var columns []csvExportColumn
+	for i, col := range strings.Split(s, ",") {
+		var c csvExportColumn
+		typ := col
+		ext := ""
+		hasExt := false
+		if n := strings.IndexByte(col, ':'); n >= 0 {
+			typ = col[:n]
+			ext = col[n+1:]
+			hasExt = true
+		}
+		switch typ {
+		case "__name__":
+			if hasExt {
+				return nil, fmt.Errorf("unexpected extension for the entry #%d %q; `__name__` column cannot have extensions", i+1, col)
+			}
+			c.labelName = "__name__"
+		case "value":
+			if hasExt {
+				return nil, fmt.Errorf("unexpected extension for the entry #%d %q; `value` column cannot have extensions", i+1, col)
+			}
+			c.isValue = true
+		case "timestamp":
+			if !hasExt {
+				ext = "unix_ms"
+			}
+			switch ext {
+			case "unix_s", "unix_ms", "unix_ns", "rfc3339":
+			default:
+				return nil, fmt.Errorf("unsupported time format %q in the entry #%d %q; supported formats: unix_s, unix_ms, unix_ns, rfc3339", ext, i+1, col)
+			}
+			c.timeFormat = ext
+		case "label":
+			if len(ext) == 0 {
+				return nil, fmt.Errorf("label name cannot be empty in the entry #%d %q", i+1, col)
+			}
+			c.labelName = ext
+		default:
+			return nil, fmt.Errorf("unknown column type %q in the entry #%d %q; allowed values: __name__, value, timestamp, label", typ, i+1, col)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// appendCSVLines appends CSV lines for all the samples in rs to dst and returns the result.
+func appendCSVLines(dst []byte, rs *netstorage.Result, columns []csvExportColumn) []byte {
+	for i, ts := range rs.Timestamps {
+		for j := range columns {
+			if j > 0 {
+				dst = append(dst, ',')
+			}
+			c := &columns[j]
+			switch {
+			case c.isValue:
+				dst = strconv.AppendFloat(dst, rs.Values[i], 'g', -1, 64)
+			case len(c.timeFormat) > 0:
+				dst = appendCSVTimestamp(dst, ts, c.timeFormat)
+			default:
+				dst = appendCSVField(dst, rs.MetricName.GetTagValue(c.labelName))
+			}
+		}
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+func appendCSVTimestamp(dst []byte, timestamp int64, format string) []byte {
+	switch format {
+	case "unix_s":
+		return strconv.AppendFloat(dst, float64(timestamp)/1e3, 'f', -1, 64)
+	case "unix_ns":
+		return strconv.AppendInt(dst, timestamp*1e6, 10)
+	case "rfc3339":
+		return time.Unix(0, timestamp*1e6).UTC().AppendFormat(dst, time.RFC3339Nano)
+	default:
+		return strconv.AppendInt(dst, timestamp, 10)
+	}
+}
+
+// appendCSVField appends s to dst and returns the result.
+//
+// s is quoted according to RFC 4180 if it contains commas, quotes or newlines.
+func appendCSVField(dst, s []byte) []byte {
+	if !bytes.ContainsAny(s, ",\"\r\n") {
+		return append(dst, s...)
+	}
+	dst = append(dst, '"')
+	for _, c := range s {
+		if c == '"' {
+			dst = append(dst, '"')
+		}
+		dst = append(dst, c)
+	}
+	return append(dst, '"')
+}
+
+// RemoteReadHandler processes Prometheus remote_read requests at /api/v1/read.
+//
+// See https://prometheus.io/docs/prometheus/latest/storage/#remote-storage-integrations
+func RemoteReadHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	reqBuf, err := prompb.ReadSnappy(nil, r.Body, int64(*maxRemoteReadRequestSize))
+	if err != nil {
+		return fmt.Errorf("cannot read remote_read request: %s", err)
+	}
+	var req prompb.ReadRequest
+	if err := req.Unmarshal(reqBuf); err != nil {
+		return fmt.Errorf("cannot unmarshal remote_read request: %s", err)
+	}
+	deadline := getDeadline(r)
+	resp := prompb.ReadResponse{
+		Results: make([]prompb.QueryResult, len(req.Queries)),
+	}
+	for i := range req.Queries {
+		if err := processRemoteReadQuery(&resp.Results[i], &req.Queries[i], deadline); err != nil {
+			return fmt.Errorf("cannot process query #%d: %s", i, err)
+		}
+	}
+
+	data := resp.Marshal(nil)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		return fmt.Errorf("cannot send remote_read response: %s", err)
+	}
+	remoteReadDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var remoteReadDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/read"}`)
+
+func processRemoteReadQuery(dst *prompb.QueryResult, q *prompb.Query, deadline netstorage.Deadline) error {
+	start := q.StartTimestampMs
+	end := q.EndTimestampMs
+	if start > end {
+		return fmt.Errorf("start=%d cannot exceed end=%d", start, end)
+	}
+	labelsOnly := false
+	if h := q.Hints; h != nil {
+		// Prometheus sets func="series" when it needs only series labels,
+		// i.e. for /api/v1/series requests.
+		labelsOnly = h.Func == "series"
+	}
+	tagFilters, err := getTagFiltersFromLabelMatchers(q.Matchers)
+	if err != nil {
+		return err
+	}
+	sq := &storage.SearchQuery{
+		MinTimestamp: start,
+		MaxTimestamp: end,
+		TagFilterss:  [][]storage.TagFilter{tagFilters},
+	}
+	rss, err := netstorage.ProcessSearchQuery(nil, sq, deadline)
+	if err != nil {
+		return fmt.Errorf("cannot fetch data for %q: %s", sq, err)
+	}
+
+	// -search.maxPointsPerTimeseries is applied to the number of points actually fetched per each time series,
+	// since the step hint is missing for instant queries and it doesn't reflect the real number of points.
+	var mu sync.Mutex
+	var tooManyPointsErr error
+	err = rss.RunParallel(func(rs *netstorage.Result) {
+		if !labelsOnly {
+			if err := promql.ValidateMaxPointsPerTimeseriesCount(len(rs.Timestamps)); err != nil {
+				mu.Lock()
+				if tooManyPointsErr == nil {
+					tooManyPointsErr = fmt.Errorf("cannot return %s: %s", &rs.MetricName, err)
+				}
+				mu.Unlock()
+				return
+			}
+		}
+
+		// rs is re-used after returning from the callback, so copy its contents.
+		mn := &rs.MetricName
+		labels := make([]prompb.Label, 0, len(mn.Tags)+1)
+		labels = append(labels, prompb.Label{
+			Name:  []byte("__name__"),
+			Value: append([]byte{}, mn.MetricGroup...),
+		})
+		for i := range mn.Tags {
+			tag := &mn.Tags[i]
+			labels = append(labels, prompb.Label{
+				Name:  append([]byte{}, tag.Key...),
+				Value: append([]byte{}, tag.Value...),
+			})
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return string(labels[i].Name) < string(labels[j].Name)
+		})
+		var samples []prompb.Sample
+		if !labelsOnly {
+			samples = make([]prompb.Sample, len(rs.Timestamps))
+			for i, ts := range rs.Timestamps {
+				samples[i] = prompb.Sample{
+					Value:     rs.Values[i],
+					Timestamp: ts,
+				}
+			}
+		}
+		mu.Lock()
+		dst.Timeseries = append(dst.Timeseries, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: samples,
+		})
+		mu.Unlock()
+	})
+	if err != nil {
+		return fmt.Errorf("error during data fetching: %s", err)
+	}
+	if tooManyPointsErr != nil {
+		return tooManyPointsErr
+	}
+
+	// Prometheus expects series sorted by labels.
+	tss := dst.Timeseries
+	sort.Slice(tss, func(i, j int) bool {
+		return lessLabels(tss[i].Labels, tss[j].Labels)
+	})
+	return nil
+}
+
+func lessLabels(a, b []prompb.Label) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if string(a[i].Name) != string(b[i].Name) {
+			return string(a[i].Name) < string(b[i].Name)
+		}
+		if string(a[i].Value) != string(b[i].Value) {
+			return string(a[i].Value) < string(b[i].Value)
+		}
+	}
+	return len(a) < len(b)
+}
+
+func getTagFiltersFromLabelMatchers(matchers []prompb.LabelMatcher) ([]storage.TagFilter, error) {
+	tagFilters := make([]storage.TagFilter, 0, len(matchers))
+	for i := range matchers {
+		lm := &matchers[i]
+		tf := storage.TagFilter{
+			Key:   lm.Name,
+			Value: lm.Value,
+		}
+		if string(tf.Key) == "__name__" {
+			tf.Key = nil
+		}
+		switch lm.Type {
+		case prompb.LabelMatcherEQ:
+		case prompb.LabelMatcherNEQ:
+			tf.IsNegative = true
+		case prompb.LabelMatcherRE:
+			tf.IsRegexp = true
+		case prompb.LabelMatcherNRE:
+			tf.IsNegative = true
+			tf.IsRegexp = true
+		default:
+			return nil, fmt.Errorf("unsupported label matcher type %d for %q", lm.Type, lm.Name)
+		}
+		tagFilters = append(tagFilters, tf)
+	}
+	if len(tagFilters) == 0 {
+		return nil, fmt.Errorf("remote_read query must contain at least a single label matcher")
+	}
+	return tagFilters, nil
+}
+
 // DeleteHandler processes /api/v1/admin/tsdb/delete_series prometheus API request.
 //
 // See https://prometheus.io/docs/prometheus/latest/querying/api/#delete-series
 func DeleteHandler(r *http.Request) error {
 	startTime := time.Now()
+	if _, err := deleteSeries(r); err != nil {
+		return err
+	}
+	deleteDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var deleteDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/admin/tsdb/delete_series"}`)
+
+// DeleteSeriesHandler processes DELETE /api/v1/series request.
+//
+// It deletes all the series matching match[] args and writes the number of deleted series to w.
+func DeleteSeriesHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	deletedCount, err := deleteSeries(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	WriteDeleteSeriesResponse(w, deletedCount)
+	deleteSeriesDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var deleteSeriesDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/series", method="DELETE"}`)
+
+// ResetRollupResultCacheHandler processes /internal/resetRollupResultCache request.
+//
+// It removes cached query results, which may depend on data for the time range from optional start and end args,
+// and writes the number of invalidated entries to w. The whole cache is reset if start and end args are missing.
+func ResetRollupResultCacheHandler(w http.ResponseWriter, r *http.Request) error {
+	start, err := getTime(r, "start", math.MinInt64)
+	if err != nil {
+		return err
+	}
+	end, err := getTime(r, "end", math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if start > end {
+		return fmt.Errorf("start=%d cannot exceed end=%d", start, end)
+	}
+	invalidatedEntries := promql.ResetRollupResultCacheForTimeRange(start, end)
+	w.Header().Set("Content-Type", "application/json")
+	WriteResetRollupResultCacheResponse(w, invalidatedEntries)
+	return nil
+}
+
+// deleteSeries deletes series matching match[] args from r and returns the number of deleted series.
+//
+// The deleted series are hidden from queries immediately, while their data is dropped during subsequent merges.
+func deleteSeries(r *http.Request) (int, error) {
+	if !*allowDeleteSeries {
+		return 0, &httpserver.ErrorWithStatusCode{
+			Err:        fmt.Errorf("time series deletion is disabled; set -search.allowDeleteSeries command-line flag for enabling it"),
+			StatusCode: http.StatusConflict,
+		}
+	}
 	if err := r.ParseForm(); err != nil {
-		return fmt.Errorf("cannot parse request form values: %s", err)
+		return 0, fmt.Errorf("cannot parse request form values: %s", err)
 	}
 	if r.FormValue("start") != "" || r.FormValue("end") != "" {
-		return fmt.Errorf("start and end aren't supported. Remove these args from the query in order to delete all the matching metrics")
+		return 0, fmt.Errorf("start and end aren't supported. Remove these args from the query in order to delete all the matching metrics")
 	}
 	matches := r.Form["match[]"]
 	tagFilterss, err := getTagFilterssFromMatches(matches)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	sq := &storage.SearchQuery{
 		TagFilterss: tagFilterss,
 	}
-	deletedCount, err := netstorage.DeleteSeries(sq)
+	deletedCount, err := netstorage.DeleteSeries(sq, getDeadline(r))
 	if err != nil {
-		return fmt.Errorf("cannot delete time series matching %q: %s", matches, err)
+		return 0, fmt.Errorf("cannot delete time series matching %q: %s", matches, err)
 	}
 	if deletedCount > 0 {
 		promql.ResetRollupResultCache()
 	}
-	deleteDuration.UpdateDuration(startTime)
-	return nil
+	return deletedCount, nil
 }
 
-var deleteDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/admin/tsdb/delete_series"}`)
-
 // LabelValuesHandler processes /api/v1/label/<labelName>/values request.
 //
 // See https://prometheus.io/docs/prometheus/latest/querying/api/#querying-label-values
 func LabelValuesHandler(labelName string, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 	deadline := getDeadline(r)
-	labelValues, err := netstorage.GetLabelValues(labelName, deadline)
+	sq, err := getLabelsSearchQuery(r)
+	if err != nil {
+		return err
+	}
+	var labelValues []string
+	if sq == nil {
+		labelValues, err = netstorage.GetLabelValues(labelName, deadline)
+	} else {
+		labelValues, err = netstorage.GetLabelValuesOnTimeRange(labelName, sq, deadline)
+	}
 	if err != nil {
 		return fmt.Errorf(`cannot obtain label values for %q: %s`, labelName, err)
 	}
@@ -257,19 +848,69 @@ var labelsCountDuration = metrics.NewSummary(`vm_request_duration_seconds{path="
 func LabelsHandler(w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 	deadline := getDeadline(r)
-	labels, err := netstorage.GetLabels(deadline)
+	sq, err := getLabelsSearchQuery(r)
+	if err != nil {
+		return err
+	}
+	var labels []string
+	if sq == nil {
+		labels, err = netstorage.GetLabels(deadline)
+	} else {
+		labels, err = netstorage.GetLabelsOnTimeRange(sq, deadline)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot obtain labels: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	WriteLabelsResponse(w, labels)
+	labelsDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var labelsDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/labels"}`)
+
+// getLabelsSearchQuery returns search query from `start`, `end` and `match[]` args
+// for /api/v1/labels and /api/v1/label/<name>/values requests.
+//
+// nil is returned if none of these args are set. In this case all the labels must be returned.
+func getLabelsSearchQuery(r *http.Request) (*storage.SearchQuery, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("cannot parse form values: %s", err)
+	}
+	matches := r.Form["match[]"]
+	etfs, err := getExtraTagFilters(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 && len(etfs) == 0 && len(r.FormValue("start")) == 0 && len(r.FormValue("end")) == 0 {
+		return nil, nil
+	}
+	ct := currentTime()
+	end, err := getTime(r, "end", ct)
+	if err != nil {
+		return nil, err
+	}
+	// Search over all the time by default if only `end` or `match[]` is set.
+	start, err := getTime(r, "start", 0)
+	if err != nil {
+		return nil, err
+	}
+	if start > end {
+		return nil, fmt.Errorf("start=%d cannot exceed end=%d", start, end)
+	}
+	tagFilterss, err := getTagFilterssFromMatches(matches)
 	if err != nil {
-		return fmt.Errorf("cannot obtain labels: %s", err)
+		return nil, err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	WriteLabelsResponse(w, labels)
-	labelsDuration.UpdateDuration(startTime)
-	return nil
+	sq := &storage.SearchQuery{
+		MinTimestamp: start,
+		MaxTimestamp: end,
+		TagFilterss:  joinTagFilterss(tagFilterss, etfs),
+	}
+	return sq, nil
 }
 
-var labelsDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/labels"}`)
-
 // SeriesCountHandler processes /api/v1/series/count request.
 func SeriesCountHandler(w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
@@ -286,6 +927,67 @@ func SeriesCountHandler(w http.ResponseWriter, r *http.Request) error {
 
 var seriesCountDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/series/count"}`)
 
+// TSDBStatusHandler processes /api/v1/status/tsdb request.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#tsdb-stats
+//
+// It accepts optional `date=YYYY-MM-DD` and `topN=N` query args.
+func TSDBStatusHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	deadline := getDeadline(r)
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot parse form values: %s", err)
+	}
+	date := uint64(currentTime()) / secsPerDay / 1e3
+	if dateStr := r.FormValue("date"); len(dateStr) > 0 {
+		t, err := time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			return fmt.Errorf("cannot parse `date` arg %q: %s", dateStr, err)
+		}
+		if t.Unix() < 0 {
+			return fmt.Errorf("`date` arg cannot be smaller than 1970-01-01; got %q", dateStr)
+		}
+		date = uint64(t.Unix()) / secsPerDay
+	}
+	topN := 10
+	if topNStr := r.FormValue("topN"); len(topNStr) > 0 {
+		n, err := strconv.Atoi(topNStr)
+		if err != nil {
+			return fmt.Errorf("cannot parse `topN` arg %q: %s", topNStr, err)
+		}
+		if n <= 0 || n > maxTSDBStatusTopN {
+			return fmt.Errorf("`topN` arg must be in the range [1 ... %d]; got %d", maxTSDBStatusTopN, n)
+		}
+		topN = n
+	}
+	status, err := netstorage.GetTSDBStatusForDate(deadline, date, topN)
+	if err != nil {
+		return fmt.Errorf("cannot obtain tsdb status for date=%d, topN=%d: %s", date, topN, err)
+	}
+	minTime := int64(date) * secsPerDay * 1e3
+	maxTime := minTime + secsPerDay*1e3 - 1
+	w.Header().Set("Content-Type", "application/json")
+	WriteTSDBStatusResponse(w, status, minTime, maxTime)
+	tsdbStatusDuration.UpdateDuration(startTime)
+	return nil
+}
+
+const (
+	secsPerDay        = 24 * 3600
+	maxTSDBStatusTopN = 1000
+)
+
+var tsdbStatusDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/status/tsdb"}`)
+
+// ActiveQueriesHandler processes /api/v1/status/active_queries request.
+//
+// It returns the currently executed queries sorted by execution duration in descending order.
+func ActiveQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	aqs := promql.GetActiveQueries()
+	w.Header().Set("Content-Type", "application/json")
+	WriteActiveQueriesResponse(w, aqs)
+}
+
 // SeriesHandler processes /api/v1/series request.
 //
 // See https://prometheus.io/docs/prometheus/latest/querying/api/#finding-series-by-label-matchers
@@ -296,63 +998,219 @@ func SeriesHandler(w http.ResponseWriter, r *http.Request) error {
 	if err := r.ParseForm(); err != nil {
 		return fmt.Errorf("cannot parse form values: %s", err)
 	}
-	matches := r.Form["match[]"]
-	start, err := getTime(r, "start", ct-defaultStep)
+	deadline := getDeadline(r)
+	tagFilterss, err := getTagFilterssFromMatches(r.Form["match[]"])
 	if err != nil {
 		return err
 	}
-	end, err := getTime(r, "end", ct)
+	sq, err := getSeriesSearchQuery(r, tagFilterss, ct)
 	if err != nil {
 		return err
 	}
-	deadline := getDeadline(r)
-
-	tagFilterss, err := getTagFilterssFromMatches(matches)
+	limit, err := getSeriesLimit(r)
 	if err != nil {
 		return err
 	}
+	mns, isLimited, err := netstorage.GetSeries(sq, limit, deadline)
+	if err != nil {
+		return fmt.Errorf("cannot fetch series for %q: %s", sq, err)
+	}
+	if isLimited {
+		seriesLimitedRequests.Inc()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	WriteSeriesResponse(w, mns, isLimited)
+	seriesDuration.UpdateDuration(startTime)
+	return nil
+}
+
+// getSeriesLimit returns the maximum number of time series to return from /api/v1/series for `limit` query arg from r.
+//
+// limit=0 means the maximum allowed number of time series, i.e. -search.maxSeries.
+func getSeriesLimit(r *http.Request) (int, error) {
+	limit := *maxSeries
+	argValue := r.FormValue("limit")
+	if len(argValue) == 0 {
+		if *defaultSeriesLimit > 0 && *defaultSeriesLimit < limit {
+			limit = *defaultSeriesLimit
+		}
+		return limit, nil
+	}
+	n, err := strconv.Atoi(argValue)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("cannot parse limit=%q; it must be a non-negative integer", argValue)
+	}
+	if n > 0 && n < limit {
+		limit = n
+	}
+	return limit, nil
+}
+
+var seriesLimitedRequests = metrics.NewCounter(`vm_series_limited_requests_total`)
+
+var seriesDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/series"}`)
+
+// getSeriesSearchQuery returns search query for the given tagFilterss on the [start ... end] time range from r.
+//
+// Extra label filters from r are applied to the returned query.
+func getSeriesSearchQuery(r *http.Request, tagFilterss [][]storage.TagFilter, ct int64) (*storage.SearchQuery, error) {
+	start, err := getTime(r, "start", ct-defaultStep)
+	if err != nil {
+		return nil, err
+	}
+	end, err := getTime(r, "end", ct)
+	if err != nil {
+		return nil, err
+	}
+	etfs, err := getExtraTagFilters(r)
+	if err != nil {
+		return nil, err
+	}
 	if start >= end {
 		start = end - defaultStep
 	}
 	sq := &storage.SearchQuery{
 		MinTimestamp: start,
 		MaxTimestamp: end,
-		TagFilterss:  tagFilterss,
+		TagFilterss:  joinTagFilterss(tagFilterss, etfs),
+	}
+	return sq, nil
+}
+
+// QueryExemplarsHandler processes /api/v1/query_exemplars request.
+//
+// Exemplars aren't stored, so an empty result is returned for valid requests.
+// This prevents from errors in Grafana when exemplars are enabled for Prometheus datasource.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#querying-exemplars
+func QueryExemplarsHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	ct := currentTime()
+
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot parse form values: %s", err)
 	}
-	rss, err := netstorage.ProcessSearchQuery(sq, deadline)
+	var tagFilterss [][]storage.TagFilter
+	if query := r.FormValue("query"); len(query) > 0 {
+		tfss, err := promql.ExtractMetricSelectors(query)
+		if err != nil {
+			return fmt.Errorf("cannot parse query %q: %s", query, err)
+		}
+		tagFilterss = append(tagFilterss, tfss...)
+	}
+	tfss, err := getTagFilterssFromMatches(r.Form["match[]"])
 	if err != nil {
-		return fmt.Errorf("cannot fetch data for %q: %s", sq, err)
+		return err
+	}
+	tagFilterss = append(tagFilterss, tfss...)
+	if len(tagFilterss) == 0 {
+		return fmt.Errorf("missing `query` or `match[]` arg")
+	}
+	if _, err := getSeriesSearchQuery(r, tagFilterss, ct); err != nil {
+		return err
 	}
-
-	resultsCh := make(chan *quicktemplate.ByteBuffer)
-	doneCh := make(chan error)
-	go func() {
-		err := rss.RunParallel(func(rs *netstorage.Result) {
-			bb := quicktemplate.AcquireByteBuffer()
-			writemetricNameObject(bb, &rs.MetricName)
-			resultsCh <- bb
-		})
-		close(resultsCh)
-		doneCh <- err
-	}()
 
 	w.Header().Set("Content-Type", "application/json")
-	WriteSeriesResponse(w, resultsCh)
+	WriteQueryExemplarsResponse(w)
+	queryExemplarsDuration.UpdateDuration(startTime)
+	return nil
+}
 
-	// Consume all the data from resultsCh in the event WriteSeriesResponse
-	// fails to consume all the data.
-	for bb := range resultsCh {
-		quicktemplate.ReleaseByteBuffer(bb)
+var queryExemplarsDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/query_exemplars"}`)
+
+// MetadataHandler processes /api/v1/metadata request.
+//
+// Metric families without known metadata are missing in the response.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metric-metadata
+func MetadataHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	limit, err := getLimit(r, "limit")
+	if err != nil {
+		return err
 	}
-	err = <-doneCh
+	limitPerMetric, err := getLimit(r, "limit_per_metric")
 	if err != nil {
-		return fmt.Errorf("error during data fetching: %s", err)
+		return err
 	}
-	seriesDuration.UpdateDuration(startTime)
+	m := netstorage.GetMetricsMetadata(r.FormValue("metric"), limit, getDeadline(r))
+	names := make([]string, 0, len(m))
+	for name, rows := range m {
+		if limitPerMetric > 0 && len(rows) > limitPerMetric {
+			m[name] = rows[:limitPerMetric]
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	WriteMetadataResponse(w, names, m)
+	metadataDuration.UpdateDuration(startTime)
 	return nil
 }
 
-var seriesDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/series"}`)
+var metadataDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/metadata"}`)
+
+// TargetsMetadataHandler processes /api/v1/targets/metadata request.
+//
+// Only metadata obtained from targets scraped via -promscrape.config is returned.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#querying-target-metadata
+func TargetsMetadataHandler(w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+	limit, err := getLimit(r, "limit")
+	if err != nil {
+		return err
+	}
+	matchTarget := func(target []metricsmetadata.Label) bool {
+		return true
+	}
+	if s := r.FormValue("match_target"); len(s) > 0 {
+		tfs, err := selector.Parse(s)
+		if err != nil {
+			return fmt.Errorf("cannot parse `match_target` arg %q: %s", s, err)
+		}
+		m, err := selector.NewMatcher(tfs)
+		if err != nil {
+			return fmt.Errorf("invalid `match_target` arg %q: %s", s, err)
+		}
+		var mn storage.MetricName
+		matchTarget = func(target []metricsmetadata.Label) bool {
+			mn.Reset()
+			for _, label := range target {
+				mn.AddTag(label.Name, label.Value)
+			}
+			return m.Match(&mn)
+		}
+	}
+	rows := netstorage.GetTargetsMetadata(matchTarget, r.FormValue("metric"), limit, getDeadline(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	WriteTargetsMetadataResponse(w, rows)
+	targetsMetadataDuration.UpdateDuration(startTime)
+	return nil
+}
+
+var targetsMetadataDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/targets/metadata"}`)
+
+// getLimit returns non-negative limit from argKey query arg at r.
+//
+// 0 is returned if the arg is missing.
+func getLimit(r *http.Request, argKey string) (int, error) {
+	s := r.FormValue(argKey)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q arg %q: %s", argKey, s, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%q arg cannot be negative; got %d", argKey, n)
+	}
+	return n, nil
+}
 
 // QueryHandler processes /api/v1/query request.
 //
@@ -362,23 +1220,43 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) error {
 	ct := currentTime()
 
 	query := r.FormValue("query")
-	start, err := getTime(r, "time", ct)
+	format := r.FormValue("format")
+	switch format {
+	case "", "json", "prometheus", "csv":
+	default:
+		return &httpserver.ErrorWithStatusCode{
+			Err:        fmt.Errorf(`unsupported format=%q; supported values: json, prometheus, csv`, format),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	start, err := getInstantQueryTime(r, ct)
 	if err != nil {
 		return err
 	}
-	step, err := getDuration(r, "step", latencyOffset)
+	step, err := getDuration(r, "step", defaultInstantStep)
 	if err != nil {
 		return err
 	}
 	deadline := getDeadline(r)
+	etfs, err := getExtraTagFilters(r)
+	if err != nil {
+		return err
+	}
+	maxMetrics, err := getMaxUniqueTimeseries(r)
+	if err != nil {
+		return err
+	}
 
 	if len(query) > *maxQueryLen {
 		return fmt.Errorf(`too long query; got %d bytes; mustn't exceed %d bytes`, len(query), *maxQueryLen)
 	}
-	if ct-start < latencyOffset {
-		start -= latencyOffset
+	var qt *querytracer.Tracer
+	if getBool(r, "trace") {
+		qt = querytracer.New(true, "/api/v1/query: query=%s, time=%d, step=%d", query, start, step)
 	}
-	if childQuery, windowStr, offsetStr := promql.IsMetricSelectorWithRollup(query); childQuery != "" {
+	// Do not use the fast path for traced queries, so the trace contains all the query execution stages.
+	// Do not use the fast path for non-JSON formats, since it writes the response in JSON.
+	if childQuery, windowStr, offsetStr := promql.IsMetricSelectorWithRollup(query); childQuery != "" && !qt.Enabled() && isJSONQueryFormat(format) {
 		var window int64
 		if len(windowStr) > 0 {
 			var err error
@@ -398,7 +1276,7 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) error {
 		start -= offset
 		end := start
 		start = end - window
-		if err := exportHandler(w, []string{childQuery}, start, end, "promapi", deadline); err != nil {
+		if err := exportHandler(w, []string{childQuery}, etfs, start, end, "promapi", maxMetrics, 0, deadline); err != nil {
 			return err
 		}
 		queryDuration.UpdateDuration(startTime)
@@ -406,22 +1284,93 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	ec := promql.EvalConfig{
-		Start:    start,
-		End:      start,
-		Step:     step,
-		Deadline: deadline,
+		Start:               start,
+		End:                 start,
+		Step:                step,
+		Deadline:            deadline,
+		EnforcedTagFilters:  etfs,
+		QueryTracer:         qt,
+		MaxUniqueTimeseries: maxMetrics,
+		RemoteAddr:          r.RemoteAddr,
 	}
 	result, err := promql.Exec(&ec, query)
 	if err != nil {
 		return fmt.Errorf("cannot execute %q: %s", query, err)
 	}
+	if qt.Enabled() {
+		qt.Donef("series=%d", len(result))
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	WriteQueryResponse(w, result)
+	switch format {
+	case "prometheus":
+		w.Header().Set("Content-Type", "text/plain")
+		for i := range result {
+			WriteFederate(w, &result[i])
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		bb := quicktemplate.AcquireByteBuffer()
+		bb.B = appendQueryResponseCSV(bb.B, result)
+		_, err := w.Write(bb.B)
+		quicktemplate.ReleaseByteBuffer(bb)
+		if err != nil {
+			return fmt.Errorf("cannot write response: %s", err)
+		}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		WriteQueryResponse(w, result, qt)
+	}
 	queryDuration.UpdateDuration(startTime)
 	return nil
 }
 
+func isJSONQueryFormat(format string) bool {
+	return format == "" || format == "json"
+}
+
+// appendQueryResponseCSV appends /api/v1/query response for rs in CSV format to dst and returns the result.
+//
+// The first line contains column names: label names sorted by name with `__name__` first, followed by `value`.
+// Every subsequent line contains label values for a single series followed by its instant value.
+// Missing labels result in empty columns.
+func appendQueryResponseCSV(dst []byte, rs []netstorage.Result) []byte {
+	hasMetricGroup := false
+	m := make(map[string]bool)
+	for i := range rs {
+		mn := &rs[i].MetricName
+		if len(mn.MetricGroup) > 0 {
+			hasMetricGroup = true
+		}
+		for _, tag := range mn.Tags {
+			m[string(tag.Key)] = true
+		}
+	}
+	labelNames := make([]string, 0, len(m)+1)
+	for labelName := range m {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+	if hasMetricGroup {
+		labelNames = append([]string{"__name__"}, labelNames...)
+	}
+
+	for _, labelName := range labelNames {
+		dst = appendCSVField(dst, []byte(labelName))
+		dst = append(dst, ',')
+	}
+	dst = append(dst, "value\n"...)
+	for i := range rs {
+		r := &rs[i]
+		for _, labelName := range labelNames {
+			dst = appendCSVField(dst, r.MetricName.GetTagValue(labelName))
+			dst = append(dst, ',')
+		}
+		dst = strconv.AppendFloat(dst, r.Values[len(r.Values)-1], 'g', -1, 64)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
 var queryDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/query"}`)
 
 // QueryRangeHandler processes /api/v1/query_range request.
@@ -432,56 +1381,129 @@ func QueryRangeHandler(w http.ResponseWriter, r *http.Request) error {
 	ct := currentTime()
 
 	query := r.FormValue("query")
-	start, err := getTime(r, "start", ct-defaultStep)
+	start, end, err := getRangeQueryStartEnd(r, ct)
 	if err != nil {
 		return err
 	}
-	end, err := getTime(r, "end", ct)
-	if err != nil {
-		return err
+	if start > end {
+		start = end
 	}
-	step, err := getDuration(r, "step", defaultStep)
+	step, err := getRangeQueryStep(r, start, end)
 	if err != nil {
 		return err
 	}
 	deadline := getDeadline(r)
 	mayCache := !getBool(r, "nocache")
+	etfs, err := getExtraTagFilters(r)
+	if err != nil {
+		return err
+	}
+	maxMetrics, err := getMaxUniqueTimeseries(r)
+	if err != nil {
+		return err
+	}
 
 	// Validate input args.
 	if len(query) > *maxQueryLen {
 		return fmt.Errorf(`too long query; got %d bytes; mustn't exceed %d bytes`, len(query), *maxQueryLen)
 	}
-	if start > end {
-		start = end
-	}
 	if err := promql.ValidateMaxPointsPerTimeseries(start, end, step); err != nil {
 		return err
 	}
 	start, end = promql.AdjustStartEnd(start, end, step)
 
+	var qt *querytracer.Tracer
+	if getBool(r, "trace") {
+		qt = querytracer.New(true, "/api/v1/query_range: query=%s, start=%d, end=%d, step=%d", query, start, end, step)
+	}
 	ec := promql.EvalConfig{
-		Start:    start,
-		End:      end,
-		Step:     step,
-		Deadline: deadline,
-		MayCache: mayCache,
+		Start:               start,
+		End:                 end,
+		Step:                step,
+		Deadline:            deadline,
+		MayCache:            mayCache,
+		EnforcedTagFilters:  etfs,
+		QueryTracer:         qt,
+		MaxUniqueTimeseries: maxMetrics,
+		RemoteAddr:          r.RemoteAddr,
 	}
 	result, err := promql.Exec(&ec, query)
 	if err != nil {
 		return fmt.Errorf("cannot execute %q: %s", query, err)
 	}
-	if ct-end < latencyOffset {
+	if ct-end < getLatencyOffsetMsecs() {
 		adjustLastPoints(result)
 	}
+	if qt.Enabled() {
+		qt.Donef("series=%d", len(result))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	WriteQueryRangeResponse(w, result)
+	WriteQueryRangeResponse(w, result, qt)
 	queryRangeDuration.UpdateDuration(startTime)
 	return nil
 }
 
 var queryRangeDuration = metrics.NewSummary(`vm_request_duration_seconds{path="/api/v1/query_range"}`)
 
+// getInstantQueryTime returns the evaluation time for the instant query from r.
+//
+// The current time ct minus -search.latencyOffset is used if the time isn't set explicitly,
+// so incomplete recent data isn't returned.
+func getInstantQueryTime(r *http.Request, ct int64) (int64, error) {
+	return getTime(r, "time", ct-getLatencyOffsetMsecs())
+}
+
+// getRangeQueryStartEnd returns the start and the end for the range query from r.
+//
+// The current time ct minus -search.latencyOffset is used as the end if it isn't set explicitly,
+// so incomplete recent data isn't returned.
+func getRangeQueryStartEnd(r *http.Request, ct int64) (int64, int64, error) {
+	defaultEnd := ct - getLatencyOffsetMsecs()
+	start, err := getTime(r, "start", defaultEnd-defaultStep)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := getTime(r, "end", defaultEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// defaultStepPoints is the number of points per series for range queries without step.
+const defaultStepPoints = 250
+
+// getRangeQueryStep returns the step for the range query from r.
+//
+// The step is calculated as (end-start)/250 if it is missing or zero, like Prometheus UI does.
+// The calculated step cannot be smaller than -search.minDefaultStep.
+func getRangeQueryStep(r *http.Request, start, end int64) (int64, error) {
+	if !isZeroDuration(r.FormValue("step")) {
+		return getDuration(r, "step", defaultStep)
+	}
+	step := (end - start) / defaultStepPoints
+	minStep := minDefaultStep.Nanoseconds() / 1e6
+	if minStep <= 0 {
+		minStep = 1
+	}
+	if step < minStep {
+		step = minStep
+	}
+	return step, nil
+}
+
+func isZeroDuration(s string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return secs == 0
+	}
+	d, err := time.ParseDuration(s)
+	return err == nil && d == 0
+}
+
 // adjustLastPoints substitutes the last point values with the previous
 // point values, since the last points may contain garbage.
 func adjustLastPoints(tss []netstorage.Result) {
@@ -570,6 +1592,14 @@ func getDuration(r *http.Request, argKey string, defaultValue int64) (int64, err
 
 const maxDurationMsecs = 100 * 365 * 24 * 3600 * 1000
 
+// GetDeadline returns deadline for the given request.
+//
+// The deadline is obtained from `timeout` query arg and is limited by -search.maxQueryDuration.
+// The deadline is also exceeded when the client closes the request.
+func GetDeadline(r *http.Request) netstorage.Deadline {
+	return getDeadline(r)
+}
+
 func getDeadline(r *http.Request) netstorage.Deadline {
 	d, err := getDuration(r, "timeout", 0)
 	if err != nil {
@@ -580,7 +1610,7 @@ func getDeadline(r *http.Request) netstorage.Deadline {
 		d = dMax
 	}
 	timeout := time.Duration(d) * time.Millisecond
-	return netstorage.NewDeadline(timeout)
+	return netstorage.NewDeadlineWithContext(r.Context(), timeout)
 }
 
 func getBool(r *http.Request, argKey string) bool {
@@ -593,10 +1623,97 @@ func getBool(r *http.Request, argKey string) bool {
 	}
 }
 
+// getMaxUniqueTimeseries returns the limit on the number of unique time series per query from `max_unique_timeseries` query arg.
+//
+// Zero is returned if the arg is missing, so -search.maxUniqueTimeseries is used.
+// The arg cannot raise the limit above -search.maxUniqueTimeseries.
+func getMaxUniqueTimeseries(r *http.Request) (int, error) {
+	argValue := r.FormValue("max_unique_timeseries")
+	if len(argValue) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(argValue)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("cannot parse max_unique_timeseries=%q; it must be a positive integer", argValue)
+	}
+	return n, nil
+}
+
 func currentTime() int64 {
 	return int64(time.Now().UTC().Unix()) * 1e3
 }
 
+// getExtraTagFilters returns tag filters from `extra_label=name=value` query args.
+//
+// These filters must be added to every metric selector in the request, so the request is limited
+// to time series with the given labels.
+func getExtraTagFilters(r *http.Request) ([]storage.TagFilter, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("cannot parse form values: %s", err)
+	}
+	extraLabels := r.Form["extra_label"]
+	if len(extraLabels) == 0 {
+		return nil, nil
+	}
+	tfs := make([]storage.TagFilter, 0, len(extraLabels))
+	for _, s := range extraLabels {
+		n := strings.IndexByte(s, '=')
+		if n < 0 {
+			return nil, fmt.Errorf("missing `=` in `extra_label=%s`; it must have `extra_label=name=value` format", s)
+		}
+		name := s[:n]
+		value := s[n+1:]
+		if !isValidLabelName(name) {
+			return nil, fmt.Errorf("invalid label name %q in `extra_label=%s`; it must match `[a-zA-Z_][a-zA-Z0-9_]*`", name, s)
+		}
+		if strings.ContainsAny(value, "\"\\\n\r") {
+			return nil, fmt.Errorf("label value %q in `extra_label=%s` cannot contain quotes, backslashes and newlines", value, s)
+		}
+		if name == "__name__" {
+			name = ""
+		}
+		tfs = append(tfs, storage.TagFilter{
+			Key:   []byte(name),
+			Value: []byte(value),
+		})
+	}
+	return tfs, nil
+}
+
+func isValidLabelName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// joinTagFilterss adds etfs to every item in tfss.
+//
+// etfs is returned as the only item if tfss is empty.
+func joinTagFilterss(tfss [][]storage.TagFilter, etfs []storage.TagFilter) [][]storage.TagFilter {
+	if len(etfs) == 0 {
+		return tfss
+	}
+	if len(tfss) == 0 {
+		return [][]storage.TagFilter{etfs}
+	}
+	dst := make([][]storage.TagFilter, 0, len(tfss))
+	for _, tfs := range tfss {
+		tfsNew := make([]storage.TagFilter, 0, len(tfs)+len(etfs))
+		tfsNew = append(tfsNew, tfs...)
+		tfsNew = append(tfsNew, etfs...)
+		dst = append(dst, tfsNew)
+	}
+	return dst
+}
+
 func getTagFilterssFromMatches(matches []string) ([][]storage.TagFilter, error) {
 	tagFilterss := make([][]storage.TagFilter, 0, len(matches))
 	for _, match := range matches {
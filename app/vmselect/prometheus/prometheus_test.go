@@ -0,0 +1,981 @@
+package prometheus
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	vminsertprometheus "github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/prometheus"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
+	"github.com/golang/snappy"
+)
+
+func TestRemoteWriteRead(t *testing.T) {
+	path := "TestRemoteWriteRead"
+	if err := flag.Set("storageDataPath", path); err != nil {
+		t.Fatalf("cannot set storageDataPath: %s", err)
+	}
+	vmstorage.Init(func(mrs []storage.MetricRow) {})
+	defer func() {
+		vmstorage.Stop()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+	netstorage.InitTmpBlocksDir(path + "/tmp")
+	concurrencylimiter.Init()
+
+	ts := time.Now().Add(-time.Hour).UnixNano() / 1e6
+	newLabels := func(kvs ...string) []prompb.Label {
+		var labels []prompb.Label
+		for i := 0; i < len(kvs); i += 2 {
+			labels = append(labels, prompb.Label{
+				Name:  []byte(kvs[i]),
+				Value: []byte(kvs[i+1]),
+			})
+		}
+		return labels
+	}
+	newSamples := func(values ...float64) []prompb.Sample {
+		var samples []prompb.Sample
+		for i, v := range values {
+			samples = append(samples, prompb.Sample{
+				Value:     v,
+				Timestamp: ts + int64(i)*1000,
+			})
+		}
+		return samples
+	}
+	fooA := prompb.TimeSeries{
+		Labels:  newLabels("__name__", "foo", "instance", "a", "job", "test"),
+		Samples: newSamples(1, 2.5, -3),
+	}
+	fooB := prompb.TimeSeries{
+		Labels:  newLabels("__name__", "foo", "instance", "b", "job", "test"),
+		Samples: newSamples(10, 0, 1e9),
+	}
+	bar := prompb.TimeSeries{
+		Labels:  newLabels("__name__", "bar", "job", "other"),
+		Samples: newSamples(42),
+	}
+
+	// Write the data via remote_write.
+	wr := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{fooB, bar, fooA},
+	}
+	body := snappy.Encode(nil, wr.Marshal(nil))
+	req := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if err := vminsertprometheus.InsertHandler(httptest.NewRecorder(), req, 1024*1024); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+
+	// Write the data via remote_write 2.0.
+	wrV2 := prompb.WriteRequestV2{
+		Symbols: [][]byte{
+			[]byte(""), []byte("__name__"), []byte("baz_count"), []byte("job"), []byte("v2"), []byte("instance"), []byte("c"),
+			[]byte("Requests count"), []byte("requests"),
+		},
+		Timeseries: []prompb.TimeSeriesV2{{
+			LabelsRefs: []uint32{1, 2, 5, 6, 3, 4},
+			Samples:    newSamples(7, 8),
+			Exemplars: []prompb.ExemplarV2{{
+				LabelsRefs: []uint32{3, 4},
+				Value:      1,
+				Timestamp:  ts,
+			}},
+			Metadata: prompb.MetadataV2{
+				Type:    prompb.MetricTypeV2Summary,
+				HelpRef: 7,
+				UnitRef: 8,
+			},
+		}},
+	}
+	bazV2 := prompb.TimeSeries{
+		Labels:  newLabels("__name__", "baz_count", "instance", "c", "job", "v2"),
+		Samples: newSamples(7, 8),
+	}
+	body = snappy.Encode(nil, wrV2.Marshal(nil))
+	req = httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+	w := httptest.NewRecorder()
+	if err := vminsertprometheus.InsertHandler(w, req, 1024*1024); err != nil {
+		t.Fatalf("cannot write data via remote_write 2.0: %s", err)
+	}
+	for header, valueExpected := range map[string]string{
+		"X-Prometheus-Remote-Write-Samples-Written":    "2",
+		"X-Prometheus-Remote-Write-Histograms-Written": "0",
+		"X-Prometheus-Remote-Write-Exemplars-Written":  "0",
+	} {
+		if value := w.Header().Get(header); value != valueExpected {
+			t.Fatalf("unexpected %s header; got %q; want %q", header, value, valueExpected)
+		}
+	}
+	mds := vmstorage.GetMetricsMetadata("baz", 0)
+	mdsExpected := map[string][]metricsmetadata.Row{
+		"baz": {{
+			MetricFamilyName: "baz",
+			Type:             "summary",
+			Help:             "Requests count",
+			Unit:             "requests",
+		}},
+	}
+	if !reflect.DeepEqual(mds, mdsExpected) {
+		t.Fatalf("unexpected metadata written via remote_write 2.0;\ngot\n%+v\nwant\n%+v", mds, mdsExpected)
+	}
+
+	// Unsupported protobuf messages must be rejected.
+	req = httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v3.Request")
+	err := vminsertprometheus.InsertHandler(httptest.NewRecorder(), req, 1024*1024)
+	if esc, ok := err.(*httpserver.ErrorWithStatusCode); !ok || esc.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("unexpected error for unsupported protobuf message; got %v; want error with status code %d", err, http.StatusUnsupportedMediaType)
+	}
+	vmstorage.Storage.DebugFlush()
+
+	fTenant := func(accountID string, q prompb.Query, tssExpected []prompb.TimeSeries) {
+		t.Helper()
+		rr := prompb.ReadRequest{
+			Queries: []prompb.Query{q},
+		}
+		body := snappy.Encode(nil, rr.Marshal(nil))
+		req := httptest.NewRequest("POST", "/api/v1/read", bytes.NewReader(body))
+		if accountID != "" {
+			req = newTenantRequest(t, "POST", "/select/"+accountID+"/api/v1/read", body)
+		}
+		w := httptest.NewRecorder()
+		if err := RemoteReadHandler(w, req); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusOK)
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "snappy" {
+			t.Fatalf("unexpected Content-Encoding; got %q; want %q", ce, "snappy")
+		}
+		data, err := snappy.Decode(nil, w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decode response: %s", err)
+		}
+		var resp prompb.ReadResponse
+		if err := resp.Unmarshal(data); err != nil {
+			t.Fatalf("cannot unmarshal response: %s", err)
+		}
+		if len(resp.Results) != 1 {
+			t.Fatalf("unexpected number of results; got %d; want 1", len(resp.Results))
+		}
+		tss := resp.Results[0].Timeseries
+		if len(tss) != len(tssExpected) {
+			t.Fatalf("unexpected number of series; got %d; want %d", len(tss), len(tssExpected))
+		}
+		for i := range tss {
+			if !reflect.DeepEqual(tss[i].Labels, tssExpected[i].Labels) {
+				t.Fatalf("unexpected labels for series #%d; got %s; want %s", i, tss[i].Labels, tssExpected[i].Labels)
+			}
+			if len(tss[i].Samples) != len(tssExpected[i].Samples) || (len(tss[i].Samples) > 0 && !reflect.DeepEqual(tss[i].Samples, tssExpected[i].Samples)) {
+				t.Fatalf("unexpected samples for series #%d; got %v; want %v", i, tss[i].Samples, tssExpected[i].Samples)
+			}
+		}
+	}
+	f := func(q prompb.Query, tssExpected []prompb.TimeSeries) {
+		t.Helper()
+		fTenant("", q, tssExpected)
+	}
+	newMatcher := func(typ prompb.LabelMatcherType, name, value string) prompb.LabelMatcher {
+		return prompb.LabelMatcher{
+			Type:  typ,
+			Name:  []byte(name),
+			Value: []byte(value),
+		}
+	}
+	start := ts - 1000
+	end := ts + 10000
+
+	// Exact match on metric name
+	f(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "__name__", "foo"),
+		},
+	}, []prompb.TimeSeries{fooA, fooB})
+
+	// Negative match
+	f(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "__name__", "foo"),
+			newMatcher(prompb.LabelMatcherNEQ, "instance", "a"),
+		},
+	}, []prompb.TimeSeries{fooB})
+
+	// Regexp match
+	f(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherRE, "job", "te.+|oth.+"),
+		},
+	}, []prompb.TimeSeries{bar, fooA, fooB})
+
+	// Data written via remote_write 2.0
+	f(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "job", "v2"),
+		},
+	}, []prompb.TimeSeries{bazV2})
+
+	// Negative regexp match
+	f(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherNRE, "__name__", "f.*"),
+			newMatcher(prompb.LabelMatcherRE, "job", ".+"),
+		},
+	}, []prompb.TimeSeries{bar, bazV2})
+
+	// Time range must be respected
+	f(prompb.Query{
+		StartTimestampMs: ts + 500,
+		EndTimestampMs:   ts + 1500,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "instance", "a"),
+		},
+	}, []prompb.TimeSeries{{
+		Labels: fooA.Labels,
+		Samples: []prompb.Sample{{
+			Value:     2.5,
+			Timestamp: ts + 1000,
+		}},
+	}})
+
+	// Labels only
+	f(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "job", "other"),
+		},
+		Hints: &prompb.ReadHints{
+			Func: "series",
+		},
+	}, []prompb.TimeSeries{{
+		Labels: bar.Labels,
+	}})
+
+	fError := func(q prompb.Query) {
+		t.Helper()
+		rr := prompb.ReadRequest{
+			Queries: []prompb.Query{q},
+		}
+		body := snappy.Encode(nil, rr.Marshal(nil))
+		req := httptest.NewRequest("POST", "/api/v1/read", bytes.NewReader(body))
+		if err := RemoteReadHandler(httptest.NewRecorder(), req); err == nil {
+			t.Fatalf("expecting non-nil error for too many points")
+		}
+	}
+
+	// The number of points is limited by the actual number of fetched points instead of the step hint.
+	hugeStart := end - 100*24*3600*1000
+	f(prompb.Query{
+		StartTimestampMs: hugeStart,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "job", "other"),
+		},
+		Hints: &prompb.ReadHints{
+			StepMs: 1,
+		},
+	}, []prompb.TimeSeries{bar})
+	f(prompb.Query{
+		StartTimestampMs: hugeStart,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "job", "other"),
+		},
+	}, []prompb.TimeSeries{bar})
+
+	// Too many points per time series
+	if err := flag.Set("search.maxPointsPerTimeseries", "2"); err != nil {
+		t.Fatalf("cannot set -search.maxPointsPerTimeseries: %s", err)
+	}
+	fError(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "job", "test"),
+		},
+	})
+	// Labels only requests don't return points, so they aren't limited.
+	f(prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherEQ, "instance", "a"),
+		},
+		Hints: &prompb.ReadHints{
+			Func: "series",
+		},
+	}, []prompb.TimeSeries{{
+		Labels: fooA.Labels,
+	}})
+	if err := flag.Set("search.maxPointsPerTimeseries", "10000"); err != nil {
+		t.Fatalf("cannot restore -search.maxPointsPerTimeseries: %s", err)
+	}
+
+	// Tenants must see only their own series.
+	tenantFoo := func(instance string, labels ...string) prompb.TimeSeries {
+		return prompb.TimeSeries{
+			Labels:  newLabels(append([]string{"__name__", "tenant_foo", "instance", instance}, labels...)...),
+			Samples: newSamples(1, 2),
+		}
+	}
+	writeTenant := func(accountID string, tss ...prompb.TimeSeries) {
+		t.Helper()
+		wr := prompb.WriteRequest{
+			Timeseries: tss,
+		}
+		req := newTenantRequest(t, "POST", "/insert/"+accountID+"/api/v1/write", snappy.Encode(nil, wr.Marshal(nil)))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if err := vminsertprometheus.InsertHandler(httptest.NewRecorder(), req, 1024*1024); err != nil {
+			t.Fatalf("cannot write data for tenant %s: %s", accountID, err)
+		}
+	}
+	// The tenant mustn't be able to write series for other tenants via vm_account_id label.
+	writeTenant("1", tenantFoo("a"), tenantFoo("forged", tenant.Label, "2"))
+	writeTenant("02", tenantFoo("b"))
+	vmstorage.Storage.DebugFlush()
+
+	tenantQuery := func(matchers ...prompb.LabelMatcher) prompb.Query {
+		return prompb.Query{
+			StartTimestampMs: start,
+			EndTimestampMs:   end,
+			Matchers:         append([]prompb.LabelMatcher{newMatcher(prompb.LabelMatcherEQ, "__name__", "tenant_foo")}, matchers...),
+		}
+	}
+	fTenant("1", tenantQuery(), []prompb.TimeSeries{
+		tenantFoo("a", tenant.Label, "1"),
+		tenantFoo("forged", tenant.Label, "1"),
+	})
+	fTenant("2", tenantQuery(), []prompb.TimeSeries{
+		tenantFoo("b", tenant.Label, "2"),
+	})
+	fTenant("2", tenantQuery(newMatcher(prompb.LabelMatcherEQ, tenant.Label, "1")), nil)
+	fTenant("2", prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers: []prompb.LabelMatcher{
+			newMatcher(prompb.LabelMatcherRE, "__name__", ".+"),
+		},
+	}, []prompb.TimeSeries{
+		tenantFoo("b", tenant.Label, "2"),
+	})
+	fTenant("3", tenantQuery(), nil)
+
+	// Requests without tenant see series from all the tenants.
+	f(tenantQuery(), []prompb.TimeSeries{
+		tenantFoo("a", tenant.Label, "1"),
+		tenantFoo("b", tenant.Label, "2"),
+		tenantFoo("forged", tenant.Label, "1"),
+	})
+
+	// Label values must be isolated too.
+	fLabelValues := func(accountID, labelName string, valuesExpected []string) {
+		t.Helper()
+		req := newTenantRequest(t, "GET", "/select/"+accountID+"/api/v1/label/"+labelName+"/values", nil)
+		w := httptest.NewRecorder()
+		if err := LabelValuesHandler(labelName, w, req); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var resp struct {
+			Data []string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("cannot unmarshal response %q: %s", w.Body.String(), err)
+		}
+		if !reflect.DeepEqual(resp.Data, valuesExpected) {
+			t.Fatalf("unexpected values for label %q for tenant %s; got %q; want %q", labelName, accountID, resp.Data, valuesExpected)
+		}
+	}
+	fLabelValues("1", "instance", []string{"a", "forged"})
+	fLabelValues("2", "instance", []string{"b"})
+	fLabelValues("2", "__name__", []string{"tenant_foo"})
+	fLabelValues("1", tenant.Label, []string{"1"})
+
+	// /api/v1/series must return up to limit series.
+	fSeries := func(match, limit string, seriesExpected int, isLimitedExpected bool) {
+		t.Helper()
+		args := url.Values{
+			"match[]": {match},
+			"start":   {strconv.FormatInt(start/1e3, 10)},
+			"end":     {strconv.FormatInt(end/1e3+1, 10)},
+		}
+		if limit != "" {
+			args.Set("limit", limit)
+		}
+		w := httptest.NewRecorder()
+		if err := SeriesHandler(w, httptest.NewRequest("GET", "/api/v1/series?"+args.Encode(), nil)); err != nil {
+			t.Fatalf("unexpected error for match[]=%s, limit=%s: %s", match, limit, err)
+		}
+		var resp struct {
+			Data     []map[string]string
+			Warnings []string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("cannot unmarshal response %q: %s", w.Body.String(), err)
+		}
+		if len(resp.Data) != seriesExpected {
+			t.Fatalf("unexpected number of series for match[]=%s, limit=%s; got %d; want %d", match, limit, len(resp.Data), seriesExpected)
+		}
+		if isLimited := len(resp.Warnings) > 0; isLimited != isLimitedExpected {
+			t.Fatalf("unexpected warnings for match[]=%s, limit=%s; got %q; want isLimited=%v", match, limit, resp.Warnings, isLimitedExpected)
+		}
+	}
+	fSeries("foo", "", 2, false)
+	fSeries("foo", "0", 2, false)
+	fSeries("foo", "2", 2, false)
+	fSeries("foo", "1", 1, true)
+	fSeries(`{__name__=~"foo|bar"}`, "", 3, false)
+	fSeries(`{__name__=~"foo|bar"}`, "2", 2, true)
+	fSeries(`{__name__=~".+"}`, "1", 1, true)
+	fSeries("missing", "1", 0, false)
+}
+
+func newTenantRequest(t *testing.T, method, path string, body []byte) *http.Request {
+	t.Helper()
+	req, err := tenant.NewRequest(httptest.NewRequest(method, path, bytes.NewReader(body)), "/"+strings.Split(path, "/")[1]+"/")
+	if err != nil {
+		t.Fatalf("cannot create request for %q: %s", path, err)
+	}
+	return req
+}
+
+func TestGetLabelsSearchQuery(t *testing.T) {
+	f := func(query string, sqExpected *storage.SearchQuery) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/labels?"+query, nil)
+		sq, err := getLabelsSearchQuery(r)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", query, err)
+		}
+		if !reflect.DeepEqual(sq, sqExpected) {
+			t.Fatalf("unexpected search query for %q; got %v; want %v", query, sq, sqExpected)
+		}
+	}
+	fError := func(query string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/labels?"+query, nil)
+		if _, err := getLabelsSearchQuery(r); err == nil {
+			t.Fatalf("expecting non-nil error for %q", query)
+		}
+	}
+
+	// No time range and no matches
+	f("", nil)
+	f("foo=bar", nil)
+
+	// Time range
+	f("start=10&end=20.5", &storage.SearchQuery{
+		MinTimestamp: 10e3,
+		MaxTimestamp: 20.5e3,
+		TagFilterss:  [][]storage.TagFilter{},
+	})
+	f("start=10&end=10", &storage.SearchQuery{
+		MinTimestamp: 10e3,
+		MaxTimestamp: 10e3,
+		TagFilterss:  [][]storage.TagFilter{},
+	})
+
+	// Matches
+	f("match[]=foo&start=10&end=20", &storage.SearchQuery{
+		MinTimestamp: 10e3,
+		MaxTimestamp: 20e3,
+		TagFilterss: [][]storage.TagFilter{{
+			{Key: []byte{}, Value: []byte("foo")},
+		}},
+	})
+
+	// Extra labels
+	f("extra_label=job=foo&start=10&end=20", &storage.SearchQuery{
+		MinTimestamp: 10e3,
+		MaxTimestamp: 20e3,
+		TagFilterss: [][]storage.TagFilter{{
+			{Key: []byte("job"), Value: []byte("foo")},
+		}},
+	})
+	f("match[]=foo&match[]={a=~\"b\"}&extra_label=job=bar&start=10&end=20", &storage.SearchQuery{
+		MinTimestamp: 10e3,
+		MaxTimestamp: 20e3,
+		TagFilterss: [][]storage.TagFilter{
+			{
+				{Key: []byte{}, Value: []byte("foo")},
+				{Key: []byte("job"), Value: []byte("bar")},
+			},
+			{
+				{Key: []byte("a"), Value: []byte("b"), IsRegexp: true},
+				{Key: []byte("job"), Value: []byte("bar")},
+			},
+		},
+	})
+
+	fError("start=foo")
+	fError("end=bar")
+	fError("start=20&end=10")
+	fError("match[]=foo{&start=10")
+	fError("extra_label=foo")
+}
+
+func TestGetExtraTagFilters(t *testing.T) {
+	f := func(query string, tfsExpected []storage.TagFilter) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/query?"+query, nil)
+		tfs, err := getExtraTagFilters(r)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", query, err)
+		}
+		if !reflect.DeepEqual(tfs, tfsExpected) {
+			t.Fatalf("unexpected tag filters for %q; got %v; want %v", query, tfs, tfsExpected)
+		}
+	}
+	fError := func(query string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/query?"+query, nil)
+		if _, err := getExtraTagFilters(r); err == nil {
+			t.Fatalf("expecting non-nil error for %q", query)
+		}
+	}
+
+	f("", nil)
+	f("query=foo", nil)
+	f("extra_label=job=foo", []storage.TagFilter{
+		{Key: []byte("job"), Value: []byte("foo")},
+	})
+	f("extra_label=job=foo&extra_label=tenant=a%3Db&extra_label=x_1=", []storage.TagFilter{
+		{Key: []byte("job"), Value: []byte("foo")},
+		{Key: []byte("tenant"), Value: []byte("a=b")},
+		{Key: []byte("x_1"), Value: []byte{}},
+	})
+	f("extra_label=__name__=foo", []storage.TagFilter{
+		{Key: []byte{}, Value: []byte("foo")},
+	})
+
+	// Missing `=`
+	fError("extra_label=foo")
+
+	// Invalid label name
+	fError("extra_label==foo")
+	fError("extra_label=1a=foo")
+	fError("extra_label=a-b=foo")
+	fError("extra_label=a%7Bb=foo")
+
+	// Invalid label value
+	fError("extra_label=job=foo%22")
+	fError("extra_label=job=foo%5C")
+	fError("extra_label=job=foo%0A")
+}
+
+func TestGetMaxUniqueTimeseries(t *testing.T) {
+	f := func(query string, nExpected int) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/query?"+query, nil)
+		n, err := getMaxUniqueTimeseries(r)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", query, err)
+		}
+		if n != nExpected {
+			t.Fatalf("unexpected limit for %q; got %d; want %d", query, n, nExpected)
+		}
+	}
+	fError := func(query string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/query?"+query, nil)
+		if _, err := getMaxUniqueTimeseries(r); err == nil {
+			t.Fatalf("expecting non-nil error for %q", query)
+		}
+	}
+
+	f("", 0)
+	f("query=foo", 0)
+	f("max_unique_timeseries=1", 1)
+	f("max_unique_timeseries=1000", 1000)
+
+	fError("max_unique_timeseries=foo")
+	fError("max_unique_timeseries=0")
+	fError("max_unique_timeseries=-1")
+	fError("max_unique_timeseries=1.5")
+}
+
+func TestGetSeriesLimit(t *testing.T) {
+	f := func(query string, maxSeriesValue, defaultLimit, limitExpected int) {
+		t.Helper()
+		maxSeriesOrig, defaultSeriesLimitOrig := *maxSeries, *defaultSeriesLimit
+		*maxSeries, *defaultSeriesLimit = maxSeriesValue, defaultLimit
+		defer func() {
+			*maxSeries, *defaultSeriesLimit = maxSeriesOrig, defaultSeriesLimitOrig
+		}()
+		r := httptest.NewRequest("GET", "/api/v1/series?"+query, nil)
+		limit, err := getSeriesLimit(r)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", query, err)
+		}
+		if limit != limitExpected {
+			t.Fatalf("unexpected limit for %q; got %d; want %d", query, limit, limitExpected)
+		}
+	}
+	fError := func(query string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/series?"+query, nil)
+		if _, err := getSeriesLimit(r); err == nil {
+			t.Fatalf("expecting non-nil error for %q", query)
+		}
+	}
+
+	f("", 1000, 0, 1000)
+	f("", 1000, 10, 10)
+	f("", 1000, 2000, 1000)
+	f("limit=0", 1000, 10, 1000)
+	f("limit=5", 1000, 10, 5)
+	f("limit=100", 1000, 10, 100)
+	f("limit=5000", 1000, 10, 1000)
+
+	fError("limit=foo")
+	fError("limit=-1")
+	fError("limit=1.5")
+}
+
+func TestJoinTagFilterss(t *testing.T) {
+	etfs := []storage.TagFilter{
+		{Key: []byte("job"), Value: []byte("foo")},
+	}
+	if tfss := joinTagFilterss(nil, nil); tfss != nil {
+		t.Fatalf("unexpected tag filters: %v", tfss)
+	}
+	tfss := joinTagFilterss(nil, etfs)
+	if !reflect.DeepEqual(tfss, [][]storage.TagFilter{etfs}) {
+		t.Fatalf("unexpected tag filters: %v", tfss)
+	}
+	src := [][]storage.TagFilter{
+		{{Key: []byte{}, Value: []byte("bar")}},
+		{{Key: []byte("job"), Value: []byte("baz")}},
+	}
+	tfss = joinTagFilterss(src, etfs)
+	tfssExpected := [][]storage.TagFilter{
+		{
+			{Key: []byte{}, Value: []byte("bar")},
+			{Key: []byte("job"), Value: []byte("foo")},
+		},
+		{
+			{Key: []byte("job"), Value: []byte("baz")},
+			{Key: []byte("job"), Value: []byte("foo")},
+		},
+	}
+	if !reflect.DeepEqual(tfss, tfssExpected) {
+		t.Fatalf("unexpected tag filters;\ngot\n%v\nwant\n%v", tfss, tfssExpected)
+	}
+	// src must remain unchanged
+	if len(src[0]) != 1 || len(src[1]) != 1 {
+		t.Fatalf("unexpected change of source tag filters: %v", src)
+	}
+}
+
+func TestParseCSVExportFormatFailure(t *testing.T) {
+	f := func(format string) {
+		t.Helper()
+		if _, err := parseCSVExportFormat(format); err == nil {
+			t.Fatalf("expecting non-nil error for format=%q", format)
+		}
+	}
+
+	// Empty column
+	f("")
+	f("__name__,,value")
+
+	// Unknown column type
+	f("foo")
+	f("metric:foo")
+
+	// Unexpected extension
+	f("__name__:foo")
+	f("value:foo")
+
+	// Invalid time format
+	f("timestamp:")
+	f("timestamp:unix_us")
+
+	// Missing label name
+	f("label")
+	f("label:")
+}
+
+func TestAppendCSVLines(t *testing.T) {
+	f := func(format string, rs *netstorage.Result, resultExpected string) {
+		t.Helper()
+		columns, err := parseCSVExportFormat(format)
+		if err != nil {
+			t.Fatalf("cannot parse format=%q: %s", format, err)
+		}
+		result := appendCSVLines(nil, rs, columns)
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result for format=%q;\ngot\n%s\nwant\n%s", format, result, resultExpected)
+		}
+	}
+
+	rs := &netstorage.Result{
+		Timestamps: []int64{1562529662678, 1562529663000},
+		Values:     []float64{1.5, -2},
+	}
+	rs.MetricName.MetricGroup = []byte("foo")
+	rs.MetricName.AddTag("host", "a,b")
+	rs.MetricName.AddTag("job", "x\"y\nz")
+
+	f("__name__,label:host,value,timestamp:unix_ms", rs, `foo,"a,b",1.5,1562529662678
+foo,"a,b",-2,1562529663000
+`)
+
+	// The default time format is unix_ms
+	f("timestamp,value", rs, "1562529662678,1.5\n1562529663000,-2\n")
+
+	// Time formats
+	f("timestamp:unix_s,timestamp:unix_ns,timestamp:rfc3339", rs, `1562529662.678,1562529662678000000,2019-07-07T20:01:02.678Z
+1562529663,1562529663000000000,2019-07-07T20:01:03Z
+`)
+
+	// Missing labels must result in empty columns; quotes must be escaped
+	f("label:missing,label:job,label:__name__,value", rs, `,"x""y
+z",foo,1.5
+,"x""y
+z",foo,-2
+`)
+
+	// Empty series
+	f("__name__,value", &netstorage.Result{}, "")
+}
+
+func TestAppendQueryResponseCSV(t *testing.T) {
+	f := func(rs []netstorage.Result, resultExpected string) {
+		t.Helper()
+		result := appendQueryResponseCSV(nil, rs)
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// Empty result
+	f(nil, "value\n")
+
+	// Series without labels
+	f([]netstorage.Result{{
+		Timestamps: []int64{1000},
+		Values:     []float64{1.5},
+	}}, "value\n1.5\n")
+
+	// Missing labels must result in empty columns; special chars must be quoted
+	var rs1, rs2 netstorage.Result
+	rs1.MetricName.MetricGroup = []byte("foo")
+	rs1.MetricName.AddTag("job", "x,y")
+	rs1.Timestamps = []int64{1000}
+	rs1.Values = []float64{-2}
+	rs2.MetricName.AddTag("instance", "host\"1")
+	rs2.MetricName.AddTag("job", "z")
+	rs2.Timestamps = []int64{1000}
+	rs2.Values = []float64{1e20}
+	f([]netstorage.Result{rs1, rs2}, `__name__,instance,job,value
+foo,,"x,y",-2
+,"host""1",z,1e+20
+`)
+}
+
+func TestQueryHandlerFormat(t *testing.T) {
+	f := func(format, contentTypeExpected, bodyExpected string) {
+		t.Helper()
+		url := `/api/v1/query?query=label_set(time(),"foo","bar")&time=100`
+		if format != "" {
+			url += "&format=" + format
+		}
+		r := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		if err := QueryHandler(w, r); err != nil {
+			t.Fatalf("unexpected error for format=%q: %s", format, err)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != contentTypeExpected {
+			t.Fatalf("unexpected Content-Type for format=%q; got %q; want %q", format, contentType, contentTypeExpected)
+		}
+		if body := w.Body.String(); body != bodyExpected {
+			t.Fatalf("unexpected response for format=%q;\ngot\n%s\nwant\n%s", format, body, bodyExpected)
+		}
+	}
+	jsonExpected := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"foo":"bar"},"value":[100,"100"]}]}}`
+	f("", "application/json", jsonExpected)
+	f("json", "application/json", jsonExpected)
+	f("prometheus", "text/plain", `{foo="bar"} 100 100000`+"\n")
+	f("csv", "text/csv", "foo,value\nbar,100\n")
+
+	// Invalid format
+	r := httptest.NewRequest("GET", `/api/v1/query?query=time()&format=foobar`, nil)
+	err := QueryHandler(httptest.NewRecorder(), r)
+	esc, ok := err.(*httpserver.ErrorWithStatusCode)
+	if !ok {
+		t.Fatalf("unexpected error for invalid format; got %v; want %T", err, esc)
+	}
+	if esc.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status code for invalid format; got %d; want %d", esc.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestResetRollupResultCacheHandler(t *testing.T) {
+	f := func(url string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		if err := ResetRollupResultCacheHandler(w, r); err != nil {
+			t.Fatalf("unexpected error for %q: %s", url, err)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Fatalf("unexpected Content-Type for %q; got %q; want %q", url, contentType, "application/json")
+		}
+		bodyExpected := `{"status":"success","data":{"invalidatedEntries":0}}`
+		if body := w.Body.String(); body != bodyExpected {
+			t.Fatalf("unexpected response for %q;\ngot\n%s\nwant\n%s", url, body, bodyExpected)
+		}
+	}
+	f("/internal/resetRollupResultCache")
+	f("/internal/resetRollupResultCache?start=100&end=200")
+	f("/internal/resetRollupResultCache?start=2020-01-01T00:00:00Z")
+
+	fError := func(url string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", url, nil)
+		if err := ResetRollupResultCacheHandler(httptest.NewRecorder(), r); err == nil {
+			t.Fatalf("expecting non-nil error for %q", url)
+		}
+	}
+	fError("/internal/resetRollupResultCache?start=foo")
+	fError("/internal/resetRollupResultCache?end=bar")
+	fError("/internal/resetRollupResultCache?start=200&end=100")
+}
+
+func TestGetQueryTimeLatencyOffset(t *testing.T) {
+	defer func() {
+		*latencyOffset = time.Minute
+	}()
+	const ct = 1600000000000
+	f := func(query string, offset time.Duration, timeExpected, startExpected, endExpected int64) {
+		t.Helper()
+		*latencyOffset = offset
+		r := httptest.NewRequest("GET", "/api/v1/query?"+query, nil)
+		tm, err := getInstantQueryTime(r, ct)
+		if err != nil {
+			t.Fatalf("unexpected error in getInstantQueryTime: %s", err)
+		}
+		if tm != timeExpected {
+			t.Fatalf("unexpected time for %q; got %d; want %d", query, tm, timeExpected)
+		}
+		start, end, err := getRangeQueryStartEnd(r, ct)
+		if err != nil {
+			t.Fatalf("unexpected error in getRangeQueryStartEnd: %s", err)
+		}
+		if start != startExpected {
+			t.Fatalf("unexpected start for %q; got %d; want %d", query, start, startExpected)
+		}
+		if end != endExpected {
+			t.Fatalf("unexpected end for %q; got %d; want %d", query, end, endExpected)
+		}
+	}
+
+	// Queries without explicit time are shifted back by the offset
+	f("", time.Minute, ct-60e3, ct-60e3-defaultStep, ct-60e3)
+	f("", 5*time.Second, ct-5e3, ct-5e3-defaultStep, ct-5e3)
+	f("", 0, ct, ct-defaultStep, ct)
+
+	// Queries with explicit time aren't affected
+	f("time=1600000000&start=1599999000&end=1600000000", time.Minute, ct, ct-1000e3, ct)
+	f("start=1599999000", time.Minute, ct-60e3, ct-1000e3, ct-60e3)
+}
+
+func TestGetRangeQueryStep(t *testing.T) {
+	defer func() {
+		*minDefaultStep = time.Second
+	}()
+	f := func(query string, minStep time.Duration, start, end, stepExpected int64) {
+		t.Helper()
+		*minDefaultStep = minStep
+		r := httptest.NewRequest("GET", "/api/v1/query_range?"+query, nil)
+		step, err := getRangeQueryStep(r, start, end)
+		if err != nil {
+			t.Fatalf("unexpected error in getRangeQueryStep(%q): %s", query, err)
+		}
+		if step != stepExpected {
+			t.Fatalf("unexpected step for %q; got %d; want %d", query, step, stepExpected)
+		}
+	}
+
+	// Missing or zero step is calculated from the time range.
+	f("", time.Second, 0, 3600e3, 14400)
+	f("step=0", time.Second, 0, 3600e3, 14400)
+	f("step=0s", time.Second, 0, 3600e3, 14400)
+	f("", time.Second, 1000e3, 1000e3, 1000)
+	f("", time.Minute, 0, 3600e3, 60e3)
+	f("", 0, 0, 100, 1)
+
+	// Explicitly set step isn't changed.
+	f("step=1", time.Minute, 0, 3600e3, 1000)
+	f("step=5m", time.Second, 0, 3600e3, 300e3)
+	f("step=0.5", time.Second, 0, 3600e3, 500)
+
+	// Invalid step
+	r := httptest.NewRequest("GET", "/api/v1/query_range?step=foo", nil)
+	if _, err := getRangeQueryStep(r, 0, 3600e3); err == nil {
+		t.Fatalf("expecting non-nil error for invalid step")
+	}
+	r = httptest.NewRequest("GET", "/api/v1/query_range?step=-1", nil)
+	if _, err := getRangeQueryStep(r, 0, 3600e3); err == nil {
+		t.Fatalf("expecting non-nil error for negative step")
+	}
+}
+
+func TestDeleteSeriesDisabled(t *testing.T) {
+	if *allowDeleteSeries {
+		t.Fatalf("-search.allowDeleteSeries must be disabled by default")
+	}
+	f := func(method, url string) {
+		t.Helper()
+		r := httptest.NewRequest(method, url, nil)
+		var err error
+		if method == "DELETE" {
+			err = DeleteSeriesHandler(httptest.NewRecorder(), r)
+		} else {
+			err = DeleteHandler(r)
+		}
+		esc, ok := err.(*httpserver.ErrorWithStatusCode)
+		if !ok {
+			t.Fatalf("expecting *httpserver.ErrorWithStatusCode error; got %v", err)
+		}
+		if esc.StatusCode != http.StatusConflict {
+			t.Fatalf("unexpected status code; got %d; want %d", esc.StatusCode, http.StatusConflict)
+		}
+	}
+	f("POST", `/api/v1/admin/tsdb/delete_series?match[]={job="foo"}`)
+	f("GET", `/api/v1/admin/tsdb/delete_series?match[]=up`)
+	f("DELETE", `/api/v1/series?match[]={job="foo"}`)
+}
@@ -7,112 +7,123 @@ package prometheus
 //line app/vmselect/prometheus/query_range_response.qtpl:1
 import (
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/querytracer"
 )
 
 // QueryRangeResponse generates response for /api/v1/query_range.See https://prometheus.io/docs/prometheus/latest/querying/api/#range-queries
 
-//line app/vmselect/prometheus/query_range_response.qtpl:8
+//line app/vmselect/prometheus/query_range_response.qtpl:9
 import (
 	qtio422016 "io"
 
 	qt422016 "github.com/valyala/quicktemplate"
 )
 
-//line app/vmselect/prometheus/query_range_response.qtpl:8
+//line app/vmselect/prometheus/query_range_response.qtpl:9
 var (
 	_ = qtio422016.Copy
 	_ = qt422016.AcquireByteBuffer
 )
 
-//line app/vmselect/prometheus/query_range_response.qtpl:8
-func StreamQueryRangeResponse(qw422016 *qt422016.Writer, rs []netstorage.Result) {
-//line app/vmselect/prometheus/query_range_response.qtpl:8
+//line app/vmselect/prometheus/query_range_response.qtpl:9
+func StreamQueryRangeResponse(qw422016 *qt422016.Writer, rs []netstorage.Result, qt *querytracer.Tracer) {
+//line app/vmselect/prometheus/query_range_response.qtpl:9
 	qw422016.N().S(`{"status":"success","data":{"resultType":"matrix","result":[`)
-//line app/vmselect/prometheus/query_range_response.qtpl:14
-	if len(rs) > 0 {
 //line app/vmselect/prometheus/query_range_response.qtpl:15
-		streamqueryRangeLine(qw422016, &rs[0])
+	if len(rs) > 0 {
 //line app/vmselect/prometheus/query_range_response.qtpl:16
+		streamqueryRangeLine(qw422016, &rs[0])
+//line app/vmselect/prometheus/query_range_response.qtpl:17
 		rs = rs[1:]
 
-//line app/vmselect/prometheus/query_range_response.qtpl:17
+//line app/vmselect/prometheus/query_range_response.qtpl:18
 		for i := range rs {
-//line app/vmselect/prometheus/query_range_response.qtpl:17
-			qw422016.N().S(`,`)
 //line app/vmselect/prometheus/query_range_response.qtpl:18
-			streamqueryRangeLine(qw422016, &rs[i])
+			qw422016.N().S(`,`)
 //line app/vmselect/prometheus/query_range_response.qtpl:19
-		}
+			streamqueryRangeLine(qw422016, &rs[i])
 //line app/vmselect/prometheus/query_range_response.qtpl:20
+		}
+//line app/vmselect/prometheus/query_range_response.qtpl:21
 	}
-//line app/vmselect/prometheus/query_range_response.qtpl:20
-	qw422016.N().S(`]}}`)
+//line app/vmselect/prometheus/query_range_response.qtpl:21
+	qw422016.N().S(`]}`)
+//line app/vmselect/prometheus/query_range_response.qtpl:24
+	if qt.Enabled() {
 //line app/vmselect/prometheus/query_range_response.qtpl:24
+		qw422016.N().S(`,"trace":`)
+//line app/vmselect/prometheus/query_range_response.qtpl:25
+		qw422016.N().S(qt.ToJSON())
+//line app/vmselect/prometheus/query_range_response.qtpl:26
+	}
+//line app/vmselect/prometheus/query_range_response.qtpl:26
+	qw422016.N().S(`}`)
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 }
 
-//line app/vmselect/prometheus/query_range_response.qtpl:24
-func WriteQueryRangeResponse(qq422016 qtio422016.Writer, rs []netstorage.Result) {
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
+func WriteQueryRangeResponse(qq422016 qtio422016.Writer, rs []netstorage.Result, qt *querytracer.Tracer) {
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 	qw422016 := qt422016.AcquireWriter(qq422016)
-//line app/vmselect/prometheus/query_range_response.qtpl:24
-	StreamQueryRangeResponse(qw422016, rs)
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
+	StreamQueryRangeResponse(qw422016, rs, qt)
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 	qt422016.ReleaseWriter(qw422016)
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 }
 
-//line app/vmselect/prometheus/query_range_response.qtpl:24
-func QueryRangeResponse(rs []netstorage.Result) string {
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
+func QueryRangeResponse(rs []netstorage.Result, qt *querytracer.Tracer) string {
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 	qb422016 := qt422016.AcquireByteBuffer()
-//line app/vmselect/prometheus/query_range_response.qtpl:24
-	WriteQueryRangeResponse(qb422016, rs)
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
+	WriteQueryRangeResponse(qb422016, rs, qt)
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 	qs422016 := string(qb422016.B)
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 	qt422016.ReleaseByteBuffer(qb422016)
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 	return qs422016
-//line app/vmselect/prometheus/query_range_response.qtpl:24
+//line app/vmselect/prometheus/query_range_response.qtpl:28
 }
 
-//line app/vmselect/prometheus/query_range_response.qtpl:26
+//line app/vmselect/prometheus/query_range_response.qtpl:30
 func streamqueryRangeLine(qw422016 *qt422016.Writer, r *netstorage.Result) {
-//line app/vmselect/prometheus/query_range_response.qtpl:26
+//line app/vmselect/prometheus/query_range_response.qtpl:30
 	qw422016.N().S(`{"metric":`)
-//line app/vmselect/prometheus/query_range_response.qtpl:28
+//line app/vmselect/prometheus/query_range_response.qtpl:32
 	streammetricNameObject(qw422016, &r.MetricName)
-//line app/vmselect/prometheus/query_range_response.qtpl:28
+//line app/vmselect/prometheus/query_range_response.qtpl:32
 	qw422016.N().S(`,"values":`)
-//line app/vmselect/prometheus/query_range_response.qtpl:29
+//line app/vmselect/prometheus/query_range_response.qtpl:33
 	streamvaluesWithTimestamps(qw422016, r.Values, r.Timestamps)
-//line app/vmselect/prometheus/query_range_response.qtpl:29
+//line app/vmselect/prometheus/query_range_response.qtpl:33
 	qw422016.N().S(`}`)
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 }
 
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 func writequeryRangeLine(qq422016 qtio422016.Writer, r *netstorage.Result) {
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	qw422016 := qt422016.AcquireWriter(qq422016)
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	streamqueryRangeLine(qw422016, r)
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	qt422016.ReleaseWriter(qw422016)
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 }
 
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 func queryRangeLine(r *netstorage.Result) string {
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	qb422016 := qt422016.AcquireByteBuffer()
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	writequeryRangeLine(qb422016, r)
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	qs422016 := string(qb422016.B)
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	qt422016.ReleaseByteBuffer(qb422016)
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 	return qs422016
-//line app/vmselect/prometheus/query_range_response.qtpl:31
+//line app/vmselect/prometheus/query_range_response.qtpl:35
 }
@@ -7,88 +7,99 @@ package prometheus
 //line app/vmselect/prometheus/query_response.qtpl:1
 import (
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/querytracer"
 )
 
 // QueryResponse generates response for /api/v1/query.See https://prometheus.io/docs/prometheus/latest/querying/api/#instant-queries
 
-//line app/vmselect/prometheus/query_response.qtpl:8
+//line app/vmselect/prometheus/query_response.qtpl:9
 import (
 	qtio422016 "io"
 
 	qt422016 "github.com/valyala/quicktemplate"
 )
 
-//line app/vmselect/prometheus/query_response.qtpl:8
+//line app/vmselect/prometheus/query_response.qtpl:9
 var (
 	_ = qtio422016.Copy
 	_ = qt422016.AcquireByteBuffer
 )
 
-//line app/vmselect/prometheus/query_response.qtpl:8
-func StreamQueryResponse(qw422016 *qt422016.Writer, rs []netstorage.Result) {
-//line app/vmselect/prometheus/query_response.qtpl:8
+//line app/vmselect/prometheus/query_response.qtpl:9
+func StreamQueryResponse(qw422016 *qt422016.Writer, rs []netstorage.Result, qt *querytracer.Tracer) {
+//line app/vmselect/prometheus/query_response.qtpl:9
 	qw422016.N().S(`{"status":"success","data":{"resultType":"vector","result":[`)
-//line app/vmselect/prometheus/query_response.qtpl:14
+//line app/vmselect/prometheus/query_response.qtpl:15
 	if len(rs) > 0 {
-//line app/vmselect/prometheus/query_response.qtpl:14
+//line app/vmselect/prometheus/query_response.qtpl:15
 		qw422016.N().S(`{"metric":`)
-//line app/vmselect/prometheus/query_response.qtpl:16
+//line app/vmselect/prometheus/query_response.qtpl:17
 		streammetricNameObject(qw422016, &rs[0].MetricName)
-//line app/vmselect/prometheus/query_response.qtpl:16
-		qw422016.N().S(`,"value":`)
 //line app/vmselect/prometheus/query_response.qtpl:17
+		qw422016.N().S(`,"value":`)
+//line app/vmselect/prometheus/query_response.qtpl:18
 		streammetricRow(qw422016, rs[0].Timestamps[0], rs[0].Values[0])
-//line app/vmselect/prometheus/query_response.qtpl:17
+//line app/vmselect/prometheus/query_response.qtpl:18
 		qw422016.N().S(`}`)
-//line app/vmselect/prometheus/query_response.qtpl:19
+//line app/vmselect/prometheus/query_response.qtpl:20
 		rs = rs[1:]
 
-//line app/vmselect/prometheus/query_response.qtpl:20
-		for i := range rs {
 //line app/vmselect/prometheus/query_response.qtpl:21
+		for i := range rs {
+//line app/vmselect/prometheus/query_response.qtpl:22
 			r := &rs[i]
 
-//line app/vmselect/prometheus/query_response.qtpl:21
+//line app/vmselect/prometheus/query_response.qtpl:22
 			qw422016.N().S(`,{"metric":`)
-//line app/vmselect/prometheus/query_response.qtpl:23
+//line app/vmselect/prometheus/query_response.qtpl:24
 			streammetricNameObject(qw422016, &r.MetricName)
-//line app/vmselect/prometheus/query_response.qtpl:23
-			qw422016.N().S(`,"value":`)
 //line app/vmselect/prometheus/query_response.qtpl:24
+			qw422016.N().S(`,"value":`)
+//line app/vmselect/prometheus/query_response.qtpl:25
 			streammetricRow(qw422016, r.Timestamps[0], r.Values[0])
-//line app/vmselect/prometheus/query_response.qtpl:24
+//line app/vmselect/prometheus/query_response.qtpl:25
 			qw422016.N().S(`}`)
-//line app/vmselect/prometheus/query_response.qtpl:26
-		}
 //line app/vmselect/prometheus/query_response.qtpl:27
+		}
+//line app/vmselect/prometheus/query_response.qtpl:28
 	}
-//line app/vmselect/prometheus/query_response.qtpl:27
-	qw422016.N().S(`]}}`)
+//line app/vmselect/prometheus/query_response.qtpl:28
+	qw422016.N().S(`]}`)
+//line app/vmselect/prometheus/query_response.qtpl:31
+	if qt.Enabled() {
 //line app/vmselect/prometheus/query_response.qtpl:31
+		qw422016.N().S(`,"trace":`)
+//line app/vmselect/prometheus/query_response.qtpl:32
+		qw422016.N().S(qt.ToJSON())
+//line app/vmselect/prometheus/query_response.qtpl:33
+	}
+//line app/vmselect/prometheus/query_response.qtpl:33
+	qw422016.N().S(`}`)
+//line app/vmselect/prometheus/query_response.qtpl:35
 }
 
-//line app/vmselect/prometheus/query_response.qtpl:31
-func WriteQueryResponse(qq422016 qtio422016.Writer, rs []netstorage.Result) {
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
+func WriteQueryResponse(qq422016 qtio422016.Writer, rs []netstorage.Result, qt *querytracer.Tracer) {
+//line app/vmselect/prometheus/query_response.qtpl:35
 	qw422016 := qt422016.AcquireWriter(qq422016)
-//line app/vmselect/prometheus/query_response.qtpl:31
-	StreamQueryResponse(qw422016, rs)
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
+	StreamQueryResponse(qw422016, rs, qt)
+//line app/vmselect/prometheus/query_response.qtpl:35
 	qt422016.ReleaseWriter(qw422016)
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
 }
 
-//line app/vmselect/prometheus/query_response.qtpl:31
-func QueryResponse(rs []netstorage.Result) string {
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
+func QueryResponse(rs []netstorage.Result, qt *querytracer.Tracer) string {
+//line app/vmselect/prometheus/query_response.qtpl:35
 	qb422016 := qt422016.AcquireByteBuffer()
-//line app/vmselect/prometheus/query_response.qtpl:31
-	WriteQueryResponse(qb422016, rs)
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
+	WriteQueryResponse(qb422016, rs, qt)
+//line app/vmselect/prometheus/query_response.qtpl:35
 	qs422016 := string(qb422016.B)
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
 	qt422016.ReleaseByteBuffer(qb422016)
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
 	return qs422016
-//line app/vmselect/prometheus/query_response.qtpl:31
+//line app/vmselect/prometheus/query_response.qtpl:35
 }
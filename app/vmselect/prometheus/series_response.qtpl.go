@@ -6,7 +6,7 @@ package prometheus
 
 //line app/vmselect/prometheus/series_response.qtpl:1
 import (
-	"github.com/valyala/quicktemplate"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 )
 
 // SeriesResponse generates response for /api/v1/series.See https://prometheus.io/docs/prometheus/latest/querying/api/#finding-series-by-label-matchers
@@ -25,59 +25,56 @@ var (
 )
 
 //line app/vmselect/prometheus/series_response.qtpl:8
-func StreamSeriesResponse(qw422016 *qt422016.Writer, resultsCh <-chan *quicktemplate.ByteBuffer) {
+func StreamSeriesResponse(qw422016 *qt422016.Writer, mns []storage.MetricName, isLimited bool) {
 //line app/vmselect/prometheus/series_response.qtpl:8
 	qw422016.N().S(`{"status":"success","data":[`)
 //line app/vmselect/prometheus/series_response.qtpl:12
-	bb, ok := <-resultsCh
-
+	for i := range mns {
 //line app/vmselect/prometheus/series_response.qtpl:13
-	if ok {
+		streammetricNameObject(qw422016, &mns[i])
+//line app/vmselect/prometheus/series_response.qtpl:14
+		if i+1 < len(mns) {
 //line app/vmselect/prometheus/series_response.qtpl:14
-		qw422016.N().Z(bb.B)
-//line app/vmselect/prometheus/series_response.qtpl:15
-		quicktemplate.ReleaseByteBuffer(bb)
-
-//line app/vmselect/prometheus/series_response.qtpl:16
-		for bb := range resultsCh {
-//line app/vmselect/prometheus/series_response.qtpl:16
 			qw422016.N().S(`,`)
+//line app/vmselect/prometheus/series_response.qtpl:14
+		}
+//line app/vmselect/prometheus/series_response.qtpl:15
+	}
+//line app/vmselect/prometheus/series_response.qtpl:15
+	qw422016.N().S(`]`)
 //line app/vmselect/prometheus/series_response.qtpl:17
-			qw422016.N().Z(bb.B)
-//line app/vmselect/prometheus/series_response.qtpl:18
-			quicktemplate.ReleaseByteBuffer(bb)
-
+	if isLimited {
+//line app/vmselect/prometheus/series_response.qtpl:17
+		qw422016.N().S(`,"warnings":["results truncated due to limit"]`)
 //line app/vmselect/prometheus/series_response.qtpl:19
-		}
-//line app/vmselect/prometheus/series_response.qtpl:20
 	}
-//line app/vmselect/prometheus/series_response.qtpl:20
-	qw422016.N().S(`]}`)
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:19
+	qw422016.N().S(`}`)
+//line app/vmselect/prometheus/series_response.qtpl:21
 }
 
-//line app/vmselect/prometheus/series_response.qtpl:23
-func WriteSeriesResponse(qq422016 qtio422016.Writer, resultsCh <-chan *quicktemplate.ByteBuffer) {
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
+func WriteSeriesResponse(qq422016 qtio422016.Writer, mns []storage.MetricName, isLimited bool) {
+//line app/vmselect/prometheus/series_response.qtpl:21
 	qw422016 := qt422016.AcquireWriter(qq422016)
-//line app/vmselect/prometheus/series_response.qtpl:23
-	StreamSeriesResponse(qw422016, resultsCh)
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
+	StreamSeriesResponse(qw422016, mns, isLimited)
+//line app/vmselect/prometheus/series_response.qtpl:21
 	qt422016.ReleaseWriter(qw422016)
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
 }
 
-//line app/vmselect/prometheus/series_response.qtpl:23
-func SeriesResponse(resultsCh <-chan *quicktemplate.ByteBuffer) string {
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
+func SeriesResponse(mns []storage.MetricName, isLimited bool) string {
+//line app/vmselect/prometheus/series_response.qtpl:21
 	qb422016 := qt422016.AcquireByteBuffer()
-//line app/vmselect/prometheus/series_response.qtpl:23
-	WriteSeriesResponse(qb422016, resultsCh)
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
+	WriteSeriesResponse(qb422016, mns, isLimited)
+//line app/vmselect/prometheus/series_response.qtpl:21
 	qs422016 := string(qb422016.B)
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
 	qt422016.ReleaseByteBuffer(qb422016)
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
 	return qs422016
-//line app/vmselect/prometheus/series_response.qtpl:23
+//line app/vmselect/prometheus/series_response.qtpl:21
 }
@@ -0,0 +1,110 @@
+package promql
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ActiveQuery is a query, which is currently executed.
+type ActiveQuery struct {
+	// Query is the executed query.
+	Query string
+
+	// Start, End and Step are query args in milliseconds.
+	Start int64
+	End   int64
+	Step  int64
+
+	// RemoteAddr is the address of the client, which sent the query.
+	RemoteAddr string
+
+	// StartTime is the time when the query execution has been started.
+	StartTime time.Time
+
+	// Duration is the query execution duration so far.
+	Duration time.Duration
+}
+
+// GetActiveQueries returns the currently executed queries sorted by Duration in descending order.
+func GetActiveQueries() []ActiveQuery {
+	return activeQueriesV.GetAll(time.Now())
+}
+
+var activeQueriesV = newActiveQueries()
+
+// activeQueriesShardsCount is the number of shards in activeQueries.
+//
+// Queries are spread among shards in order to reduce lock contention on concurrent queries.
+const activeQueriesShardsCount = 16
+
+// activeQueries tracks the currently executed queries.
+type activeQueries struct {
+	nextID uint64
+
+	shards [activeQueriesShardsCount]activeQueriesShard
+}
+
+type activeQueriesShard struct {
+	mu sync.Mutex
+	m  map[uint64]*ActiveQuery
+}
+
+func newActiveQueries() *activeQueries {
+	var aq activeQueries
+	for i := range aq.shards {
+		aq.shards[i].m = make(map[uint64]*ActiveQuery)
+	}
+	return &aq
+}
+
+// Add registers the query q for the given ec started at startTime.
+//
+// The returned id must be passed to Remove after the query is finished.
+func (aq *activeQueries) Add(ec *EvalConfig, q string, startTime time.Time) uint64 {
+	id := atomic.AddUint64(&aq.nextID, 1)
+	a := &ActiveQuery{
+		Query:      q,
+		Start:      ec.Start,
+		End:        ec.End,
+		Step:       ec.Step,
+		RemoteAddr: ec.RemoteAddr,
+		StartTime:  startTime,
+	}
+	shard := &aq.shards[id%activeQueriesShardsCount]
+	shard.mu.Lock()
+	shard.m[id] = a
+	shard.mu.Unlock()
+	return id
+}
+
+// Remove unregisters the query with the given id obtained from Add.
+func (aq *activeQueries) Remove(id uint64) {
+	shard := &aq.shards[id%activeQueriesShardsCount]
+	shard.mu.Lock()
+	delete(shard.m, id)
+	shard.mu.Unlock()
+}
+
+// GetAll returns all the registered queries with durations calculated at now.
+//
+// The returned queries are sorted by Duration in descending order.
+func (aq *activeQueries) GetAll(now time.Time) []ActiveQuery {
+	var result []ActiveQuery
+	for i := range aq.shards {
+		shard := &aq.shards[i]
+		shard.mu.Lock()
+		for _, a := range shard.m {
+			result = append(result, *a)
+		}
+		shard.mu.Unlock()
+	}
+	for i := range result {
+		result[i].Duration = now.Sub(result[i].StartTime)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Duration > result[j].Duration
+	})
+	return result
+}
@@ -0,0 +1,80 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+)
+
+func TestActiveQueries(t *testing.T) {
+	aq := newActiveQueries()
+	if result := aq.GetAll(time.Now()); len(result) != 0 {
+		t.Fatalf("unexpected active queries for empty list: %v", result)
+	}
+
+	startTime := time.Unix(1000, 0)
+	ec := &EvalConfig{
+		Start:      1000e3,
+		End:        2000e3,
+		Step:       10e3,
+		RemoteAddr: "1.2.3.4:5678",
+	}
+	id1 := aq.Add(ec, "foo", startTime.Add(2*time.Second))
+	id2 := aq.Add(ec, "bar", startTime)
+	id3 := aq.Add(ec, "baz", startTime.Add(time.Second))
+	if id1 == id2 || id2 == id3 || id1 == id3 {
+		t.Fatalf("ids must be unique; got %d, %d, %d", id1, id2, id3)
+	}
+
+	f := func(queriesExpected []string) {
+		t.Helper()
+		result := aq.GetAll(startTime.Add(10 * time.Second))
+		var queries []string
+		for _, a := range result {
+			queries = append(queries, a.Query)
+			if a.Duration != startTime.Add(10*time.Second).Sub(a.StartTime) {
+				t.Fatalf("unexpected duration for %q: %s", a.Query, a.Duration)
+			}
+			if a.Start != ec.Start || a.End != ec.End || a.Step != ec.Step || a.RemoteAddr != ec.RemoteAddr {
+				t.Fatalf("unexpected query args for %q: %+v", a.Query, a)
+			}
+		}
+		if len(queries) != len(queriesExpected) {
+			t.Fatalf("unexpected queries; got %q; want %q", queries, queriesExpected)
+		}
+		for i := range queries {
+			if queries[i] != queriesExpected[i] {
+				t.Fatalf("unexpected queries; got %q; want %q", queries, queriesExpected)
+			}
+		}
+	}
+
+	// Queries must be sorted by duration in descending order.
+	f([]string{"bar", "baz", "foo"})
+
+	aq.Remove(id3)
+	f([]string{"bar", "foo"})
+
+	aq.Remove(id2)
+	aq.Remove(id1)
+	f(nil)
+}
+
+func TestExecRemovesActiveQuery(t *testing.T) {
+	ec := &EvalConfig{
+		Start:    1000e3,
+		End:      2000e3,
+		Step:     200e3,
+		Deadline: netstorage.NewDeadline(time.Minute),
+	}
+	if _, err := Exec(ec, "time()"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := Exec(ec, "foo("); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if result := GetActiveQueries(); len(result) != 0 {
+		t.Fatalf("expecting no active queries after Exec; got %v", result)
+	}
+}
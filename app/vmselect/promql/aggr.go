@@ -6,6 +6,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 )
 
 var aggrFuncs = map[string]aggrFunc{
@@ -23,9 +25,15 @@ var aggrFuncs = map[string]aggrFunc{
 	"quantile":     aggrFuncQuantile,
 
 	// Extended PromQL funcs
-	"median":   aggrFuncMedian,
-	"limitk":   aggrFuncLimitK,
-	"distinct": newAggrFunc(aggrFuncDistinct),
+	"median":      aggrFuncMedian,
+	"limitk":      aggrFuncLimitK,
+	"distinct":    newAggrFunc(aggrFuncDistinct),
+	"topk_min":    newAggrFuncRangeTopK(minValue, false),
+	"topk_max":    newAggrFuncRangeTopK(maxValue, false),
+	"topk_avg":    newAggrFuncRangeTopK(avgValue, false),
+	"bottomk_min": newAggrFuncRangeTopK(minValue, true),
+	"bottomk_max": newAggrFuncRangeTopK(maxValue, true),
+	"bottomk_avg": newAggrFuncRangeTopK(avgValue, true),
 }
 
 type aggrFunc func(afa *aggrFuncArg) ([]*timeseries, error)
@@ -69,24 +77,15 @@ func aggrFuncExt(afe func(tss []*timeseries) []*timeseries, argOrig []*timeserie
 	arg := copyTimeseriesMetricNames(argOrig)
 
 	// Filter out superflouos tags.
-	var groupTags []string
-	groupOp := "by"
-	if modifier.Op != "" {
-		groupTags = modifier.Args
-		groupOp = strings.ToLower(modifier.Op)
-	}
+	groupOp := strings.ToLower(modifier.Op)
 	switch groupOp {
-	case "by":
-		for _, ts := range arg {
-			ts.MetricName.RemoveTagsOn(groupTags)
-		}
-	case "without":
-		for _, ts := range arg {
-			ts.MetricName.RemoveTagsIgnoring(groupTags)
-		}
+	case "", "by", "without":
 	default:
 		return nil, fmt.Errorf(`unknown modifier: %q`, groupOp)
 	}
+	for _, ts := range arg {
+		removeGroupTags(&ts.MetricName, modifier)
+	}
 
 	// Perform grouping.
 	m := make(map[string][]*timeseries)
@@ -116,6 +115,15 @@ func aggrFuncExt(afe func(tss []*timeseries) []*timeseries, argOrig []*timeserie
 	return rvs, nil
 }
 
+// removeGroupTags removes tags from mn, which aren't used for grouping according to modifier.
+func removeGroupTags(mn *storage.MetricName, modifier *modifierExpr) {
+	if strings.ToLower(modifier.Op) == "without" {
+		mn.RemoveTagsIgnoring(modifier.Args)
+		return
+	}
+	mn.RemoveTagsOn(modifier.Args)
+}
+
 func aggrFuncSum(tss []*timeseries) []*timeseries {
 	if len(tss) == 1 {
 		// Fast path - nothing to sum.
@@ -389,6 +397,160 @@ func newAggrFuncTopK(isReverse bool) aggrFunc {
 	}
 }
 
+// newAggrFuncRangeTopK returns aggrFunc, which selects k time series with the biggest
+// values of f calculated over all the points on the selected time range.
+//
+// k time series with the smallest values of f are selected if isReverse is set.
+// Unlike topk and bottomk, the whole time series are selected instead of individual points.
+//
+// The optional third arg in the form `label=value` adds a time series containing the sum
+// of the remaining time series with the given label. The label value defaults to `other`.
+func newAggrFuncRangeTopK(f func(values []float64) float64, isReverse bool) aggrFunc {
+	return func(afa *aggrFuncArg) ([]*timeseries, error) {
+		args := afa.args
+		if len(args) < 2 || len(args) > 3 {
+			return nil, fmt.Errorf(`unexpected number of args; got %d; want 2 or 3`, len(args))
+		}
+		ks, err := getScalar(args[0], 0)
+		if err != nil {
+			return nil, err
+		}
+		remainingSumTag := ""
+		if len(args) == 3 {
+			remainingSumTag, err = getString(args[2], 2)
+			if err != nil {
+				return nil, err
+			}
+		}
+		modifier := &afa.ae.Modifier
+		afe := func(tss []*timeseries) []*timeseries {
+			rvs := make([]timeseriesWithValue, len(tss))
+			for i, ts := range tss {
+				rvs[i] = timeseriesWithValue{
+					ts:    ts,
+					value: f(ts.Values),
+				}
+			}
+			// Sort time series, so the selected ones are at the end.
+			// Time series without values are always at the start.
+			sort.Slice(rvs, func(i, j int) bool {
+				a := rvs[i].value
+				b := rvs[j].value
+				if isReverse {
+					return greaterWithNaNs(a, b)
+				}
+				return lessWithNaNs(a, b)
+			})
+			for i := range rvs {
+				tss[i] = rvs[i].ts
+			}
+			remainingSumTs := getRemainingSumTimeseries(tss, modifier, ks, remainingSumTag)
+			for n := range ks {
+				k := getIntK(ks[n], len(tss))
+				for _, ts := range tss[:len(tss)-k] {
+					ts.Values[n] = nan
+				}
+			}
+			if remainingSumTs != nil {
+				tss = append(tss, remainingSumTs)
+			}
+			return tss
+		}
+		return aggrFuncExt(afe, args[1], modifier, true)
+	}
+}
+
+type timeseriesWithValue struct {
+	ts    *timeseries
+	value float64
+}
+
+// getRemainingSumTimeseries returns a time series with the sum of tss values, which aren't selected by topk-like funcs with ks.
+//
+// tss must be sorted, so the selected time series are at the end.
+// nil is returned if remainingSumTag is empty.
+func getRemainingSumTimeseries(tss []*timeseries, modifier *modifierExpr, ks []float64, remainingSumTag string) *timeseries {
+	if len(remainingSumTag) == 0 || len(tss) == 0 {
+		return nil
+	}
+	var dst timeseries
+	dst.CopyFromShallowTimestamps(tss[0])
+	removeGroupTags(&dst.MetricName, modifier)
+	tagName := remainingSumTag
+	tagValue := "other"
+	if n := strings.IndexByte(remainingSumTag, '='); n >= 0 {
+		tagName = remainingSumTag[:n]
+		tagValue = remainingSumTag[n+1:]
+	}
+	dst.MetricName.RemoveTag(tagName)
+	dst.MetricName.AddTag(tagName, tagValue)
+	for n := range dst.Values {
+		k := getIntK(ks[n], len(tss))
+		sum := float64(0)
+		count := 0
+		for _, ts := range tss[:len(tss)-k] {
+			v := ts.Values[n]
+			if math.IsNaN(v) {
+				continue
+			}
+			sum += v
+			count++
+		}
+		if count == 0 {
+			sum = nan
+		}
+		dst.Values[n] = sum
+	}
+	return &dst
+}
+
+// getIntK returns k limited to the range [0 ... kMax].
+func getIntK(k float64, kMax int) int {
+	if math.IsNaN(k) || k < 0 {
+		return 0
+	}
+	if k > float64(kMax) {
+		return kMax
+	}
+	return int(k)
+}
+
+func minValue(values []float64) float64 {
+	min := nan
+	for _, v := range values {
+		if math.IsNaN(min) || v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func maxValue(values []float64) float64 {
+	max := nan
+	for _, v := range values {
+		if math.IsNaN(max) || v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+func avgValue(values []float64) float64 {
+	sum := float64(0)
+	count := 0
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		sum += v
+		count++
+	}
+	if count == 0 {
+		return nan
+	}
+	return sum / float64(count)
+}
+
 func aggrFuncLimitK(afa *aggrFuncArg) ([]*timeseries, error) {
 	args := afa.args
 	if err := expectTransformArgsNum(args, 2); err != nil {
@@ -479,3 +641,10 @@ func lessWithNaNs(a, b float64) bool {
 	}
 	return a < b
 }
+
+func greaterWithNaNs(a, b float64) bool {
+	if math.IsNaN(a) {
+		return !math.IsNaN(b)
+	}
+	return a > b
+}
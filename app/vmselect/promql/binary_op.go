@@ -299,10 +299,24 @@ func adjustBinaryOpTags(be *binaryOpExpr, left, right []*timeseries) ([]*timeser
 		if mergeNonOverlappingTimeseries(tss) {
 			return nil
 		}
-		return fmt.Errorf(`duplicate timeseries on the %s side of %s %s: %s and %s`, side, be.Op, be.GroupModifier.AppendString(nil),
+		return fmt.Errorf(`duplicate timeseries on the %s side of %s %s: %s and %s; many-to-many matching isn't allowed`, side, be.Op, be.GroupModifier.AppendString(nil),
 			stringMetricTags(&tss[0].MetricName), stringMetricTags(&tss[1].MetricName))
 	}
 
+	// ensureUniqueMany verifies that labels copied from the "one" side don't produce duplicate series on the "many" side.
+	bb := bbPool.Get()
+	defer bbPool.Put(bb)
+	seenMany := make(map[string]*timeseries)
+	ensureUniqueMany := func(side string, ts *timeseries) error {
+		bb.B = marshalMetricNameSorted(bb.B[:0], &ts.MetricName)
+		if tsPrev := seenMany[string(bb.B)]; tsPrev != nil {
+			return fmt.Errorf(`duplicate timeseries on the %s side of %s %s %s: %s%s; multiple matches for labels; grouping labels must ensure unique matches`,
+				side, be.Op, be.GroupModifier.AppendString(nil), be.JoinModifier.AppendString(nil), ts.MetricName.MetricGroup, stringMetricTags(&ts.MetricName))
+		}
+		seenMany[string(bb.B)] = ts
+		return nil
+	}
+
 	var rvsLeft, rvsRight []*timeseries
 	mLeft, mRight := createTimeseriesMapByTagSet(be, left, right)
 	joinOp := strings.ToLower(be.JoinModifier.Op)
@@ -319,7 +333,13 @@ func adjustBinaryOpTags(be *binaryOpExpr, left, right []*timeseries) ([]*timeser
 			}
 			src := tssRight[0]
 			for _, ts := range tssLeft {
-				ts.MetricName.AddMissingTags(joinTags, &src.MetricName)
+				if !isScalar(tssRight) {
+					// Scalars have no labels to copy, so the labels on the "many" side must be left untouched.
+					ts.MetricName.SetTags(joinTags, &src.MetricName)
+				}
+				if err := ensureUniqueMany("left", ts); err != nil {
+					return nil, nil, nil, err
+				}
 				rvsLeft = append(rvsLeft, ts)
 				rvsRight = append(rvsRight, src)
 			}
@@ -329,7 +349,13 @@ func adjustBinaryOpTags(be *binaryOpExpr, left, right []*timeseries) ([]*timeser
 			}
 			src := tssLeft[0]
 			for _, ts := range tssRight {
-				ts.MetricName.AddMissingTags(joinTags, &src.MetricName)
+				if !isScalar(tssLeft) {
+					// Scalars have no labels to copy, so the labels on the "many" side must be left untouched.
+					ts.MetricName.SetTags(joinTags, &src.MetricName)
+				}
+				if err := ensureUniqueMany("right", ts); err != nil {
+					return nil, nil, nil, err
+				}
 				rvsLeft = append(rvsLeft, src)
 				rvsRight = append(rvsRight, ts)
 			}
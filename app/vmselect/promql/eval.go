@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"math"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/memory"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/querytracer"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 	"github.com/VictoriaMetrics/metrics"
 )
@@ -31,12 +35,35 @@ const minTimeseriesPointsForTimeRounding = 50
 func ValidateMaxPointsPerTimeseries(start, end, step int64) error {
 	points := (end-start)/step + 1
 	if uint64(points) > uint64(*maxPointsPerTimeseries) {
-		return fmt.Errorf(`too many points for the given step=%d, start=%d and end=%d: %d; cannot exceed %d points`,
-			step, start, end, uint64(points), *maxPointsPerTimeseries)
+		return fmt.Errorf(`too many points for the given step=%d, start=%d and end=%d: %d; cannot exceed %d points; `+
+			`either increase step to at least %gs or reduce the time range or increase -search.maxPointsPerTimeseries`,
+			step, start, end, uint64(points), *maxPointsPerTimeseries, float64(getMinStep(start, end))/1e3)
 	}
 	return nil
 }
 
+// ValidateMaxPointsPerTimeseriesCount checks whether the given number of points fetched for a single time series
+// doesn't exceed -search.maxPointsPerTimeseries.
+func ValidateMaxPointsPerTimeseriesCount(points int) error {
+	if points > *maxPointsPerTimeseries {
+		return fmt.Errorf("too many points for a single time series: %d; cannot exceed %d points; "+
+			"either reduce the time range or increase -search.maxPointsPerTimeseries", points, *maxPointsPerTimeseries)
+	}
+	return nil
+}
+
+// getMinStep returns the minimum step in milliseconds for the given time range, which doesn't exceed -search.maxPointsPerTimeseries.
+func getMinStep(start, end int64) int64 {
+	if *maxPointsPerTimeseries <= 1 || end <= start {
+		return end - start + 1
+	}
+	d := end - start
+	intervals := int64(*maxPointsPerTimeseries - 1)
+	// Round up to seconds, since step is usually passed in seconds.
+	step := (d + intervals - 1) / intervals
+	return (step + 999) / 1000 * 1000
+}
+
 // AdjustStartEnd adjusts start and end values, so response caching may be enabled.
 //
 // See EvalConfig.mayCache for details.
@@ -68,8 +95,29 @@ type EvalConfig struct {
 
 	Deadline netstorage.Deadline
 
+	// MayCache enables the rollup result cache for the query.
+	//
+	// The cache is bypassed if it is disabled via -search.disableCache.
 	MayCache bool
 
+	// EnforcedTagFilters are added to every metric selector in the query.
+	EnforcedTagFilters []storage.TagFilter
+
+	// QueryTracer collects query execution spans if it is enabled.
+	QueryTracer *querytracer.Tracer
+
+	// MaxUniqueTimeseries limits the number of unique time series each metric selector in the query may match.
+	// It cannot exceed -search.maxUniqueTimeseries. The flag value is used if it is zero.
+	MaxUniqueTimeseries int
+
+	// RemoteAddr is the address of the client, which sent the query.
+	// It is shown in the list of active queries.
+	RemoteAddr string
+
+	// memoryTracker tracks the memory allocated during the query evaluation.
+	// It is shared among all the EvalConfig copies for the query.
+	memoryTracker *queryMemoryTracker
+
 	timestamps     []int64
 	timestampsOnce sync.Once
 }
@@ -82,6 +130,11 @@ func newEvalConfig(src *EvalConfig) *EvalConfig {
 	ec.Step = src.Step
 	ec.Deadline = src.Deadline
 	ec.MayCache = src.MayCache
+	ec.EnforcedTagFilters = src.EnforcedTagFilters
+	ec.QueryTracer = src.QueryTracer
+	ec.MaxUniqueTimeseries = src.MaxUniqueTimeseries
+	ec.RemoteAddr = src.RemoteAddr
+	ec.memoryTracker = src.memoryTracker
 
 	// do not copy src.timestamps - they must be generated again.
 	return &ec
@@ -97,7 +150,7 @@ func (ec *EvalConfig) validate() {
 }
 
 func (ec *EvalConfig) mayCache() bool {
-	if !ec.MayCache {
+	if *disableCache || !ec.MayCache {
 		return false
 	}
 	if ec.Start%ec.Step != 0 {
@@ -141,6 +194,25 @@ func getTimestamps(start, end, step int64) []int64 {
 }
 
 func evalExpr(ec *EvalConfig, e expr) ([]*timeseries, error) {
+	if !ec.QueryTracer.Enabled() {
+		return evalExprInternal(ec, e)
+	}
+	ecNew := newEvalConfig(ec)
+	ecNew.QueryTracer = ec.QueryTracer.NewChild("eval: query=%s, timeRange=[%d..%d], step=%d", e.AppendString(nil), ec.Start, ec.End, ec.Step)
+	rv, err := evalExprInternal(ecNew, e)
+	if err != nil {
+		ecNew.QueryTracer.Donef("error: %s", err)
+		return nil, err
+	}
+	pointsCount := 0
+	for _, ts := range rv {
+		pointsCount += len(ts.Values)
+	}
+	ecNew.QueryTracer.Donef("series=%d, points=%d", len(rv), pointsCount)
+	return rv, nil
+}
+
+func evalExprInternal(ec *EvalConfig, e expr) ([]*timeseries, error) {
 	if me, ok := e.(*metricExpr); ok {
 		re := &rollupExpr{
 			Expr: me,
@@ -159,6 +231,13 @@ func evalExpr(ec *EvalConfig, e expr) ([]*timeseries, error) {
 		return rv, nil
 	}
 	if fe, ok := e.(*funcExpr); ok {
+		if re := getTimestampRollupExprArg(fe); re != nil {
+			rv, err := evalRollupFunc(ec, "timestamp", rollupTimestamp, re)
+			if err != nil {
+				return nil, fmt.Errorf(`cannot evaluate %q: %s`, fe.AppendString(nil), err)
+			}
+			return rv, nil
+		}
 		nrf := getRollupFunc(fe.Name)
 		if nrf == nil {
 			args, err := evalExprs(ec, fe.Args)
@@ -178,6 +257,9 @@ func evalExpr(ec *EvalConfig, e expr) ([]*timeseries, error) {
 			if err != nil {
 				return nil, fmt.Errorf(`cannot evaluate %q: %s`, fe.AppendString(nil), err)
 			}
+			if err := ec.memoryTracker.reserveTimeseries(rv); err != nil {
+				return nil, err
+			}
 			return rv, nil
 		}
 		args, re, err := evalRollupFuncArgs(ec, fe)
@@ -212,6 +294,9 @@ func evalExpr(ec *EvalConfig, e expr) ([]*timeseries, error) {
 		if err != nil {
 			return nil, fmt.Errorf(`cannot evaluate %q: %s`, ae.AppendString(nil), err)
 		}
+		if err := ec.memoryTracker.reserveTimeseries(rv); err != nil {
+			return nil, err
+		}
 		return rv, nil
 	}
 	if be, ok := e.(*binaryOpExpr); ok {
@@ -236,6 +321,9 @@ func evalExpr(ec *EvalConfig, e expr) ([]*timeseries, error) {
 		if err != nil {
 			return nil, fmt.Errorf(`cannot evaluate %q: %s`, be.AppendString(nil), err)
 		}
+		if err := ec.memoryTracker.reserveTimeseries(rv); err != nil {
+			return nil, err
+		}
 		return rv, nil
 	}
 	if ne, ok := e.(*numberExpr); ok {
@@ -261,6 +349,29 @@ func evalExprs(ec *EvalConfig, es []expr) ([][]*timeseries, error) {
 	return rvs, nil
 }
 
+// getTimestampRollupExprArg returns rollupExpr for timestamp(metricExpr).
+//
+// timestamp(metricExpr) returns timestamps for raw samples like Prometheus does,
+// while timestamp() for other args returns timestamps for the evaluation points.
+// nil is returned if fe isn't timestamp(metricExpr).
+func getTimestampRollupExprArg(fe *funcExpr) *rollupExpr {
+	if strings.ToLower(fe.Name) != "timestamp" || len(fe.Args) != 1 {
+		return nil
+	}
+	switch t := fe.Args[0].(type) {
+	case *metricExpr:
+		return &rollupExpr{
+			Expr: t,
+		}
+	case *rollupExpr:
+		// Allow `timestamp(m offset d)`.
+		if _, ok := t.Expr.(*metricExpr); ok && len(t.Window) == 0 && len(t.Step) == 0 && !t.InheritStep {
+			return t
+		}
+	}
+	return nil
+}
+
 func evalRollupFuncArgs(ec *EvalConfig, fe *funcExpr) ([]interface{}, *rollupExpr, error) {
 	var re *rollupExpr
 	rollupArgIdx := getRollupArgIdx(fe.Name)
@@ -309,6 +420,45 @@ func getRollupExprArg(arg expr) *rollupExpr {
 }
 
 func evalRollupFunc(ec *EvalConfig, name string, rf rollupFunc, re *rollupExpr) ([]*timeseries, error) {
+	if re.At == nil {
+		return evalRollupFuncWithoutAt(ec, name, rf, re)
+	}
+	tssAt, err := evalExpr(ec, re.At)
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate `@` modifier: %s", err)
+	}
+	if len(tssAt) != 1 {
+		return nil, fmt.Errorf("`@` modifier must return a single series; it returns %d series instead", len(tssAt))
+	}
+	atValue := tssAt[0].Values[0]
+	if math.IsNaN(atValue) || math.IsInf(atValue, 0) {
+		return nil, fmt.Errorf("`@` modifier must return finite timestamp; got %g", atValue)
+	}
+	atTimestamp := int64(atValue * 1000)
+	ecNew := newEvalConfig(ec)
+	ecNew.Start = atTimestamp
+	// Add an additional point to the end like Exec does, since it is needed for calculating rate, deriv, increase and delta funcs.
+	ecNew.End = atTimestamp + ec.Step
+	rvs, err := evalRollupFuncWithoutAt(ecNew, name, rf, re)
+	if err != nil {
+		return nil, err
+	}
+
+	// Expand the single point calculated at atTimestamp to all the points on the original time range.
+	timestamps := ec.getSharedTimestamps()
+	for _, ts := range rvs {
+		v := ts.Values[0]
+		values := make([]float64, len(timestamps))
+		for i := range timestamps {
+			values[i] = v
+		}
+		ts.Timestamps = timestamps
+		ts.Values = values
+	}
+	return rvs, nil
+}
+
+func evalRollupFuncWithoutAt(ec *EvalConfig, name string, rf rollupFunc, re *rollupExpr) ([]*timeseries, error) {
 	ecNew := ec
 	var offset int64
 	if len(re.Offset) > 0 {
@@ -343,6 +493,9 @@ func evalRollupFunc(ec *EvalConfig, name string, rf rollupFunc, re *rollupExpr)
 	if err != nil {
 		return nil, err
 	}
+	if strings.ToLower(name) == "absent_over_time" {
+		rvs = aggregateAbsentOverTime(ecNew, re.Expr, rvs)
+	}
 	if offset != 0 && len(rvs) > 0 {
 		// Make a copy of timestamps, since they may be used in other values.
 		srcTimestamps := rvs[0].Timestamps
@@ -357,6 +510,27 @@ func evalRollupFunc(ec *EvalConfig, name string, rf rollupFunc, re *rollupExpr)
 	return rvs, nil
 }
 
+// aggregateAbsentOverTime collapses absent_over_time results for all the tss into a single time series.
+//
+// The time series contains 1 only at points without samples in all the tss. It has tags
+// from non-regexp positive filters of e, like absent() does.
+func aggregateAbsentOverTime(ec *EvalConfig, e expr, tss []*timeseries) []*timeseries {
+	rvs := getAbsentTimeseries(ec, e)
+	if len(tss) == 0 {
+		return rvs
+	}
+	values := rvs[0].Values
+	for i := range values {
+		for _, ts := range tss {
+			if math.IsNaN(ts.Values[i]) {
+				values[i] = nan
+				break
+			}
+		}
+	}
+	return rvs
+}
+
 func evalRollupFuncWithSubquery(ec *EvalConfig, name string, rf rollupFunc, re *rollupExpr) ([]*timeseries, error) {
 	// Do not use rollupResultCacheV here, since it works only with metricExpr.
 	var step int64
@@ -386,16 +560,25 @@ func evalRollupFuncWithSubquery(ec *EvalConfig, name string, rf rollupFunc, re *
 		return nil, err
 	}
 	ecSQ.Start, ecSQ.End = AdjustStartEnd(ecSQ.Start, ecSQ.End, ecSQ.Step)
-	tssSQ, err := evalExpr(ecSQ, re.Expr)
-	if err != nil {
-		return nil, err
-	}
 
 	sharedTimestamps := getTimestamps(ec.Start, ec.End, ec.Step)
 	preFunc, rcs := getRollupConfigs(name, rf, ec.Start, ec.End, ec.Step, window, sharedTimestamps)
-	tss := make([]*timeseries, 0, len(tssSQ)*len(rcs))
+	var tss []*timeseries
 	var tssLock sync.Mutex
-	doParallel(tssSQ, func(tsSQ *timeseries, values []float64, timestamps []int64) ([]float64, []int64) {
+	var reserveErr error
+	rollupInnerSeries := func(tsSQ *timeseries, values []float64, timestamps []int64) ([]float64, []int64) {
+		if ec.Deadline.Exceeded() {
+			// Skip the remaining series, since the error is returned below.
+			return values, timestamps
+		}
+		if err := ec.memoryTracker.reserve(int64(len(rcs)), int64(len(sharedTimestamps))); err != nil {
+			tssLock.Lock()
+			if reserveErr == nil {
+				reserveErr = err
+			}
+			tssLock.Unlock()
+			return values, timestamps
+		}
 		values, timestamps = removeNanValues(values[:0], timestamps[:0], tsSQ.Values, tsSQ.Timestamps)
 		preFunc(values, timestamps)
 		for _, rc := range rcs {
@@ -412,7 +595,27 @@ func evalRollupFuncWithSubquery(ec *EvalConfig, name string, rf rollupFunc, re *
 			tssLock.Unlock()
 		}
 		return values, timestamps
-	})
+	}
+	ok, err := evalExprStream(ecSQ, re.Expr, rollupInnerSeries)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// The inner expression cannot be streamed, so its results are fully materialized
+		// before calculating the outer rollup.
+		tssSQ, err := evalExpr(ecSQ, re.Expr)
+		if err != nil {
+			return nil, err
+		}
+		doParallel(tssSQ, rollupInnerSeries)
+	}
+	if reserveErr != nil {
+		return nil, reserveErr
+	}
+	if ec.Deadline.Exceeded() {
+		// Do not return partial results.
+		return nil, ec.Deadline.Error("during subquery execution")
+	}
 	if !rollupFuncsKeepMetricGroup[name] {
 		tss = copyTimeseriesMetricNames(tss)
 		for _, ts := range tss {
@@ -422,6 +625,88 @@ func evalRollupFuncWithSubquery(ec *EvalConfig, name string, rf rollupFunc, re *
 	return tss, nil
 }
 
+// evalExprStream evaluates e and passes every resulting time series to f as soon as it is calculated,
+// so the results for all the time series aren't held in memory at once.
+//
+// Only rollup functions over a metric selector are evaluated this way, since every output series for them
+// depends on a single input series. false is returned if e cannot be evaluated in a streaming manner.
+//
+// f may be called concurrently from multiple goroutines. It mustn't hold references to ts after returning.
+func evalExprStream(ec *EvalConfig, e expr, f func(ts *timeseries, values []float64, timestamps []int64) ([]float64, []int64)) (bool, error) {
+	fe, ok := e.(*funcExpr)
+	if !ok {
+		return false, nil
+	}
+	if getTimestampRollupExprArg(fe) != nil {
+		return false, nil
+	}
+	name := fe.Name
+	nrf := getRollupFunc(name)
+	if nrf == nil || strings.ToLower(name) == "absent_over_time" {
+		return false, nil
+	}
+	rollupArgIdx := getRollupArgIdx(name)
+	if rollupArgIdx >= len(fe.Args) {
+		return false, nil
+	}
+	re := getRollupExprArg(fe.Args[rollupArgIdx])
+	me, ok := re.Expr.(*metricExpr)
+	if !ok || me.IsEmpty() || re.At != nil || len(re.Offset) > 0 {
+		return false, nil
+	}
+	args, re, err := evalRollupFuncArgs(ec, fe)
+	if err != nil {
+		return true, err
+	}
+	rf, err := nrf(args)
+	if err != nil {
+		return true, err
+	}
+	var window int64
+	if len(re.Window) > 0 {
+		window, err = DurationValue(re.Window, ec.Step)
+		if err != nil {
+			return true, err
+		}
+	}
+	me = getMetricExprWithEnforcedTagFilters(ec, me)
+	sq := &storage.SearchQuery{
+		MinTimestamp: ec.Start - window - maxSilenceInterval,
+		MaxTimestamp: ec.End + ec.Step,
+		TagFilterss:  [][]storage.TagFilter{me.TagFilters},
+		MaxMetrics:   ec.MaxUniqueTimeseries,
+	}
+	rss, err := netstorage.ProcessSearchQuery(ec.QueryTracer, sq, ec.Deadline)
+	if err != nil {
+		return true, fmt.Errorf(`cannot evaluate %q: %s`, fe.AppendString(nil), err)
+	}
+	var qtChild *querytracer.Tracer
+	if ec.QueryTracer.Enabled() {
+		qtChild = ec.QueryTracer.NewChild("stream %d series with %s", rss.Len(), name)
+	}
+	sharedTimestamps := getTimestamps(ec.Start, ec.End, ec.Step)
+	preFunc, rcs := getRollupConfigs(name, rf, ec.Start, ec.End, ec.Step, window, sharedTimestamps)
+	keepMetricGroup := rollupFuncsKeepMetricGroup[name]
+	var samplesScanned uint64
+	err = rss.RunParallel(func(rs *netstorage.Result) {
+		atomic.AddUint64(&samplesScanned, uint64(len(rs.Values)))
+		var tmpValues []float64
+		var tmpTimestamps []int64
+		doRollupForResult(name, rs, preFunc, rcs, sharedTimestamps, func(ts *timeseries) {
+			if !keepMetricGroup {
+				ts.MetricName.ResetMetricGroup()
+			}
+			tmpValues, tmpTimestamps = f(ts, tmpValues, tmpTimestamps)
+		})
+	})
+	if err != nil {
+		qtChild.Donef("error: %s", err)
+		return true, fmt.Errorf(`cannot evaluate %q: %s`, fe.AppendString(nil), err)
+	}
+	qtChild.Donef("samples=%d", samplesScanned)
+	return true, nil
+}
+
 func doParallel(tss []*timeseries, f func(ts *timeseries, values []float64, timestamps []int64) ([]float64, []int64)) {
 	concurrency := runtime.GOMAXPROCS(-1)
 	if concurrency > len(tss) {
@@ -479,15 +764,24 @@ var (
 )
 
 func evalRollupFuncWithMetricExpr(ec *EvalConfig, name string, rf rollupFunc, me *metricExpr, window int64) ([]*timeseries, error) {
+	// This also takes into account the enforced tag filters in rollupResultCacheV key.
+	me = getMetricExprWithEnforcedTagFilters(ec, me)
+
 	// Search for partial results in cache.
 	tssCached, start := rollupResultCacheV.Get(name, ec, me, window)
 	if start > ec.End {
 		// The result is fully cached.
 		rollupResultCacheFullHits.Inc()
+		if ec.QueryTracer.Enabled() {
+			ec.QueryTracer.Printf("the result is fully cached: series=%d", len(tssCached))
+		}
 		return tssCached, nil
 	}
 	if start > ec.Start {
 		rollupResultCachePartialHits.Inc()
+		if ec.QueryTracer.Enabled() {
+			ec.QueryTracer.Printf("the result is partially cached until %d: series=%d", start, len(tssCached))
+		}
 	} else {
 		rollupResultCacheMiss.Inc()
 	}
@@ -497,8 +791,9 @@ func evalRollupFuncWithMetricExpr(ec *EvalConfig, name string, rf rollupFunc, me
 		MinTimestamp: start - window - maxSilenceInterval,
 		MaxTimestamp: ec.End + ec.Step,
 		TagFilterss:  [][]storage.TagFilter{me.TagFilters},
+		MaxMetrics:   ec.MaxUniqueTimeseries,
 	}
-	rss, err := netstorage.ProcessSearchQuery(sq, ec.Deadline)
+	rss, err := netstorage.ProcessSearchQuery(ec.QueryTracer, sq, ec.Deadline)
 	if err != nil {
 		return nil, err
 	}
@@ -528,30 +823,34 @@ func evalRollupFuncWithMetricExpr(ec *EvalConfig, name string, rf rollupFunc, me
 			rollupPoints, rssLen*len(rcs), pointsPerTimeseries, float64(ec.Step)/1e3)
 	}
 	defer rml.Put(uint64(rollupMemorySize))
+	if err := ec.memoryTracker.reserve(int64(rssLen*len(rcs)), pointsPerTimeseries); err != nil {
+		rss.Cancel()
+		return nil, err
+	}
 
 	// Evaluate rollup
+	var qtChild *querytracer.Tracer
+	if ec.QueryTracer.Enabled() {
+		qtChild = ec.QueryTracer.NewChild("unpack and rollup %d series with %s", rssLen, name)
+	}
+	var samplesScanned uint64
 	tss := make([]*timeseries, 0, rssLen*len(rcs))
 	var tssLock sync.Mutex
 	err = rss.RunParallel(func(rs *netstorage.Result) {
-		preFunc(rs.Values, rs.Timestamps)
-		for _, rc := range rcs {
-			var ts timeseries
-			ts.MetricName.CopyFrom(&rs.MetricName)
-			if len(rc.TagValue) > 0 {
-				ts.MetricName.AddTag("rollup", rc.TagValue)
-			}
-			ts.Values = rc.Do(ts.Values[:0], rs.Values, rs.Timestamps)
-			ts.Timestamps = sharedTimestamps
-			ts.denyReuse = true
-
+		atomic.AddUint64(&samplesScanned, uint64(len(rs.Values)))
+		doRollupForResult(name, rs, preFunc, rcs, sharedTimestamps, func(ts *timeseries) {
 			tssLock.Lock()
-			tss = append(tss, &ts)
+			tss = append(tss, ts)
 			tssLock.Unlock()
-		}
+		})
 	})
 	if err != nil {
+		qtChild.Donef("error: %s", err)
 		return nil, err
 	}
+	if qtChild.Enabled() {
+		qtChild.Donef("samples=%d, series=%d", samplesScanned, len(tss))
+	}
 	if !rollupFuncsKeepMetricGroup[name] {
 		tss = copyTimeseriesMetricNames(tss)
 		for _, ts := range tss {
@@ -564,6 +863,72 @@ func evalRollupFuncWithMetricExpr(ec *EvalConfig, name string, rf rollupFunc, me
 	return tss, nil
 }
 
+// getMetricExprWithEnforcedTagFilters returns me with ec.EnforcedTagFilters added to it.
+//
+// The enforced tag filters are added to a copy of me, since me may be shared among cached queries.
+func getMetricExprWithEnforcedTagFilters(ec *EvalConfig, me *metricExpr) *metricExpr {
+	if len(ec.EnforcedTagFilters) == 0 {
+		return me
+	}
+	tfs := make([]storage.TagFilter, 0, len(me.TagFilters)+len(ec.EnforcedTagFilters))
+	tfs = append(tfs, me.TagFilters...)
+	tfs = append(tfs, ec.EnforcedTagFilters...)
+	return &metricExpr{
+		TagFilters: tfs,
+	}
+}
+
+// doRollupForResult applies rcs to rs and passes every resulting time series to f.
+func doRollupForResult(name string, rs *netstorage.Result, preFunc func(values []float64, timestamps []int64), rcs []*rollupConfig,
+	sharedTimestamps []int64, f func(ts *timeseries)) {
+	rs.Values, rs.Timestamps = dropStaleNaNs(name, rs.Values, rs.Timestamps)
+	preFunc(rs.Values, rs.Timestamps)
+	for _, rc := range rcs {
+		var ts timeseries
+		ts.MetricName.CopyFrom(&rs.MetricName)
+		if len(rc.TagValue) > 0 {
+			ts.MetricName.AddTag("rollup", rc.TagValue)
+		}
+		ts.Values = rc.Do(ts.Values[:0], rs.Values, rs.Timestamps)
+		ts.Timestamps = sharedTimestamps
+		ts.denyReuse = true
+		f(&ts)
+	}
+}
+
+// dropStaleNaNs removes Prometheus staleness marks from values and timestamps
+// for all the rollup funcs except of default_rollup and timestamp.
+//
+// default_rollup and timestamp use staleness marks for detecting the end of time series.
+func dropStaleNaNs(name string, values []float64, timestamps []int64) ([]float64, []int64) {
+	if name == "default_rollup" || name == "timestamp" {
+		return values, timestamps
+	}
+	hasStaleNaNs := false
+	for _, v := range values {
+		if decimal.IsStaleNaN(v) {
+			hasStaleNaNs = true
+			break
+		}
+	}
+	if !hasStaleNaNs {
+		// Fast path - no staleness marks.
+		return values, timestamps
+	}
+
+	// Slow path - remove staleness marks.
+	dstValues := values[:0]
+	dstTimestamps := timestamps[:0]
+	for i, v := range values {
+		if decimal.IsStaleNaN(v) {
+			continue
+		}
+		dstValues = append(dstValues, v)
+		dstTimestamps = append(dstTimestamps, timestamps[i])
+	}
+	return dstValues, dstTimestamps
+}
+
 var (
 	rollupMemoryLimiter     memoryLimiter
 	rollupMemoryLimiterOnce sync.Once
@@ -618,6 +983,11 @@ func getRollupConfigs(name string, rf rollupFunc, start, end, step, window int64
 			deltaValues(values)
 		}
 		rcs = appendRollupConfigs(rcs)
+	case "rollup_candlestick":
+		rcs = append(rcs, newRollupConfig(rollupOpen, "open"))
+		rcs = append(rcs, newRollupConfig(rollupLast, "close"))
+		rcs = append(rcs, newRollupConfig(rollupMin, "low"))
+		rcs = append(rcs, newRollupConfig(rollupMax, "high"))
 	default:
 		rcs = append(rcs, newRollupConfig(rf, ""))
 	}
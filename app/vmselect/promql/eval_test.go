@@ -0,0 +1,253 @@
+package promql
+
+import (
+	"flag"
+	"math"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestAggregateAbsentOverTime(t *testing.T) {
+	ec := &EvalConfig{
+		Start: 1000e3,
+		End:   1400e3,
+		Step:  200e3,
+	}
+	f := func(q string, tss []*timeseries, tagsExpected map[string]string, valuesExpected []float64) {
+		t.Helper()
+		e, err := parsePromQL(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		rvs := aggregateAbsentOverTime(ec, e, tss)
+		if len(rvs) != 1 {
+			t.Fatalf("unexpected number of time series for %q; got %d; want 1", q, len(rvs))
+		}
+		rv := rvs[0]
+		if len(rv.MetricName.MetricGroup) > 0 {
+			t.Fatalf("unexpected metric name for %q: %q", q, rv.MetricName.MetricGroup)
+		}
+		tags := make(map[string]string)
+		for _, tag := range rv.MetricName.Tags {
+			tags[string(tag.Key)] = string(tag.Value)
+		}
+		if !reflect.DeepEqual(tags, tagsExpected) {
+			t.Fatalf("unexpected tags for %q; got %v; want %v", q, tags, tagsExpected)
+		}
+		if len(rv.Values) != len(valuesExpected) {
+			t.Fatalf("unexpected number of values for %q; got %d; want %d", q, len(rv.Values), len(valuesExpected))
+		}
+		for i, v := range rv.Values {
+			vExpected := valuesExpected[i]
+			if math.IsNaN(vExpected) {
+				if !math.IsNaN(v) {
+					t.Fatalf("unexpected value at position %d for %q; got %v; want nan", i, q, v)
+				}
+				continue
+			}
+			if v != vExpected {
+				t.Fatalf("unexpected value at position %d for %q; got %v; want %v", i, q, v, vExpected)
+			}
+		}
+	}
+	newTimeseries := func(values ...float64) *timeseries {
+		return &timeseries{
+			Values: values,
+		}
+	}
+
+	// Only non-regexp positive filters are copied to the result.
+	q := `foo{job="bar",instance=~"host.+",env!="dev",zone!~"us-.+",dc="eu"}`
+	tagsExpected := map[string]string{
+		"job": "bar",
+		"dc":  "eu",
+	}
+
+	// No matching time series.
+	f(q, nil, tagsExpected, []float64{1, 1, 1})
+
+	// Matching time series without samples on the whole range.
+	f(q, []*timeseries{newTimeseries(1, 1, 1)}, tagsExpected, []float64{1, 1, 1})
+
+	// Samples are missing only at some points in all the matching time series.
+	f(q, []*timeseries{
+		newTimeseries(nan, 1, 1),
+		newTimeseries(1, nan, 1),
+	}, tagsExpected, []float64{nan, nan, 1})
+
+	// Regexp-only selector.
+	f(`{__name__=~"foo|bar",job=~"baz"}`, nil, map[string]string{}, []float64{1, 1, 1})
+}
+
+func TestGetTimestampRollupExprArg(t *testing.T) {
+	f := func(q string, resultExpected string) {
+		t.Helper()
+		e, err := parsePromQL(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		fe, ok := e.(*funcExpr)
+		if !ok {
+			t.Fatalf("expecting funcExpr for %q; got %T", q, e)
+		}
+		re := getTimestampRollupExprArg(fe)
+		result := ""
+		if re != nil {
+			result = string(re.AppendString(nil))
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected rollupExpr for %q; got %q; want %q", q, result, resultExpected)
+		}
+	}
+
+	// Metric selectors are evaluated with rollupTimestamp.
+	f(`timestamp(foo)`, `foo`)
+	f(`TIMESTAMP(foo{bar="baz"})`, `foo{bar="baz"}`)
+	f(`timestamp(foo offset 5m)`, `foo offset 5m`)
+
+	// Other args are evaluated with transformTimestamp.
+	f(`timestamp(time())`, ``)
+	f(`timestamp(foo + 1)`, ``)
+	f(`timestamp(foo[5m:1m])`, ``)
+	f(`time()`, ``)
+}
+
+func TestEvalRollupFuncWithSubqueryStreaming(t *testing.T) {
+	path := "TestEvalRollupFuncWithSubqueryStreaming"
+	if err := flag.Set("storageDataPath", path); err != nil {
+		t.Fatalf("cannot set storageDataPath: %s", err)
+	}
+	vmstorage.Init(func(mrs []storage.MetricRow) {})
+	defer func() {
+		vmstorage.Stop()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+	netstorage.InitTmpBlocksDir(path + "/tmp")
+
+	const seriesCount = 10
+	end := time.Now().Add(-time.Hour).Unix() / 60 * 60e3
+	start := end - 3600e3
+	var mrs []storage.MetricRow
+	for i := 0; i < seriesCount; i++ {
+		metricNameRaw := storage.MarshalMetricNameRaw(nil, []prompb.Label{
+			{Name: []byte("__name__"), Value: []byte("foo")},
+			{Name: []byte("instance"), Value: []byte{byte('a' + i)}},
+		})
+		for ts := start - 3600e3; ts <= end; ts += 10e3 {
+			mrs = append(mrs, storage.MetricRow{
+				MetricNameRaw: metricNameRaw,
+				Timestamp:     ts,
+				Value:         float64((ts / 1e3) * int64(i+1)),
+			})
+		}
+	}
+	if err := vmstorage.AddRows(mrs); err != nil {
+		t.Fatalf("cannot add rows: %s", err)
+	}
+	vmstorage.Storage.DebugFlush()
+
+	newEvalConfig := func() *EvalConfig {
+		return &EvalConfig{
+			Start:    start,
+			End:      end,
+			Step:     300e3,
+			Deadline: netstorage.NewDeadline(time.Minute),
+			memoryTracker: &queryMemoryTracker{
+				maxSize: math.MaxUint64,
+			},
+		}
+	}
+	eval := func(q string) ([]*timeseries, uint64) {
+		t.Helper()
+		e, err := parsePromQL(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		ec := newEvalConfig()
+		tss, err := evalExpr(ec, e)
+		if err != nil {
+			t.Fatalf("cannot evaluate %q: %s", q, err)
+		}
+		return tss, ec.memoryTracker.usage
+	}
+
+	// The streamed subquery must return the same results as the materialized one.
+	// The binary operation prevents streaming the inner results.
+	tss, usage := eval(`max_over_time(rate(foo[1m])[30m:1m])`)
+	tssMaterialized, usageMaterialized := eval(`max_over_time((rate(foo[1m]) + 0)[30m:1m])`)
+	if len(tss) != seriesCount {
+		t.Fatalf("unexpected number of series; got %d; want %d", len(tss), seriesCount)
+	}
+	timeseriesByName := func(tss []*timeseries) map[string]*timeseries {
+		m := make(map[string]*timeseries, len(tss))
+		for _, ts := range tss {
+			m[string(ts.MetricName.Marshal(nil))] = ts
+		}
+		return m
+	}
+	m := timeseriesByName(tss)
+	mMaterialized := timeseriesByName(tssMaterialized)
+	for k, ts := range mMaterialized {
+		tsStreamed := m[k]
+		if tsStreamed == nil {
+			t.Fatalf("missing streamed series %s", &ts.MetricName)
+		}
+		if !reflect.DeepEqual(tsStreamed.Values, ts.Values) || !reflect.DeepEqual(tsStreamed.Timestamps, ts.Timestamps) {
+			t.Fatalf("unexpected streamed series %s; got values=%v, timestamps=%v; want values=%v, timestamps=%v",
+				&ts.MetricName, tsStreamed.Values, tsStreamed.Timestamps, ts.Values, ts.Timestamps)
+		}
+	}
+
+	// Only the outer results must be accounted, since the inner results aren't materialized.
+	pointsPerSeries := int64(len(tss[0].Timestamps))
+	usageExpected := uint64(seriesCount * (timeseriesOverheadBytes + pointsPerSeries*16))
+	if usage != usageExpected {
+		t.Fatalf("unexpected memory usage for the streamed subquery; got %d; want %d", usage, usageExpected)
+	}
+	if usageMaterialized <= usage {
+		t.Fatalf("memory usage for the materialized subquery must exceed %d; got %d", usage, usageMaterialized)
+	}
+
+	// The inner series must be passed to the callback one by one.
+	e, err := parsePromQL(`rate(foo[1m])`)
+	if err != nil {
+		t.Fatalf("cannot parse query: %s", err)
+	}
+	var calls uint64
+	ok, err := evalExprStream(newEvalConfig(), e, func(ts *timeseries, values []float64, timestamps []int64) ([]float64, []int64) {
+		atomic.AddUint64(&calls, 1)
+		return values, timestamps
+	})
+	if err != nil {
+		t.Fatalf("cannot stream query: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expecting streaming evaluation for rate(foo[1m])")
+	}
+	if calls != seriesCount {
+		t.Fatalf("unexpected number of streamed series; got %d; want %d", calls, seriesCount)
+	}
+
+	// Aggregations cannot be streamed.
+	e, err = parsePromQL(`sum(rate(foo[1m]))`)
+	if err != nil {
+		t.Fatalf("cannot parse query: %s", err)
+	}
+	ok, err = evalExprStream(newEvalConfig(), e, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatalf("unexpected streaming evaluation for sum(rate(foo[1m]))")
+	}
+}
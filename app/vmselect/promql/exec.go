@@ -11,6 +11,7 @@ import (
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/querytracer"
 	"github.com/VictoriaMetrics/metrics"
 )
 
@@ -40,11 +41,24 @@ func Exec(ec *EvalConfig, q string) ([]netstorage.Result, error) {
 	}
 
 	ec.validate()
+	ec.memoryTracker = newQueryMemoryTracker()
+	defer ec.memoryTracker.release()
 
+	// The query is removed from active queries on both successful completion and error, including cancellation.
+	id := activeQueriesV.Add(ec, q, time.Now())
+	defer activeQueriesV.Remove(id)
+
+	qt := ec.QueryTracer
+	var qtChild *querytracer.Tracer
+	if qt.Enabled() {
+		qtChild = qt.NewChild("parse query %q", q)
+	}
 	e, err := parsePromQLWithCache(q)
 	if err != nil {
+		qtChild.Donef("error: %s", err)
 		return nil, err
 	}
+	qtChild.Donef("done")
 
 	// Add an additional point to the end. This point is used
 	// in calculating the last value for rate, deriv, increase
@@ -83,7 +97,9 @@ func maySortResults(e expr, tss []*timeseries) bool {
 		return true
 	}
 	switch fe.Name {
-	case "sort", "sort_desc":
+	case "sort", "sort_desc",
+		"sort_by_label", "sort_by_label_desc",
+		"sort_by_label_numeric", "sort_by_label_numeric_desc":
 		return false
 	default:
 		return true
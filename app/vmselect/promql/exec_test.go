@@ -1,10 +1,12 @@
 package promql
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/querytracer"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 )
 
@@ -303,6 +305,127 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
+	t.Run("time()[:100s] @ 1400", func(t *testing.T) {
+		t.Parallel()
+		q := `time()[:100s] @ 1400`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1400, 1400, 1400, 1400, 1400, 1400},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("time()[:10s] @ 1450", func(t *testing.T) {
+		t.Parallel()
+		q := `time()[:10s] @ 1450`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1450, 1450, 1450, 1450, 1450, 1450},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("time()[:100s] @ start()", func(t *testing.T) {
+		t.Parallel()
+		q := `time()[:100s] @ start()`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1000, 1000, 1000, 1000, 1000},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("time()[:100s] @ end()", func(t *testing.T) {
+		t.Parallel()
+		q := `time()[:100s] @ end()`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2000, 2000, 2000, 2000, 2000, 2000},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("time()[:100s] @ 1600 offset 200s", func(t *testing.T) {
+		t.Parallel()
+		q := `time()[:100s] @ 1600 offset 200s`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1400, 1400, 1400, 1400, 1400, 1400},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("time()[:100s] offset 100s @ (end() - 200)", func(t *testing.T) {
+		t.Parallel()
+		q := `time()[:100s] offset 100s @ (end() - 200)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1700, 1700, 1700, 1700, 1700, 1700},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("rate((time()^2)[100s:10s] offset 100s)", func(t *testing.T) {
+		t.Parallel()
+		q := `rate((time()^2)[100s:10s] offset 100s)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2100, 2500, 2900, 3300, 3700, 4100},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("rate((time()^2)[100s:10s] @ 1400)", func(t *testing.T) {
+		t.Parallel()
+		q := `rate((time()^2)[100s:10s] @ 1400)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3100, 3100, 3100, 3100, 3100, 3100},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("rate((time()^2)[100s:10s] @ start())", func(t *testing.T) {
+		t.Parallel()
+		q := `rate((time()^2)[100s:10s] @ start())`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2300, 2300, 2300, 2300, 2300, 2300},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("rate((time()^2)[100s:10s] @ 1400 offset 100s)", func(t *testing.T) {
+		t.Parallel()
+		q := `rate((time()^2)[100s:10s] @ 1400 offset 100s)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2900, 2900, 2900, 2900, 2900, 2900},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("rate((time()^2)[100s:10s] offset 100s @ end())", func(t *testing.T) {
+		t.Parallel()
+		q := `rate((time()^2)[100s:10s] offset 100s @ end())`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{4100, 4100, 4100, 4100, 4100, 4100},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
 	t.Run("time()[300s] offset 100s", func(t *testing.T) {
 		t.Parallel()
 		q := `time()[300s] offset 100s`
@@ -369,6 +492,28 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
+	t.Run("timestamp(time()) - time()", func(t *testing.T) {
+		t.Parallel()
+		q := `timestamp(time()) - time()`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0, 0, 0, 0, 0, 0},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("(time() - start()) / step()", func(t *testing.T) {
+		t.Parallel()
+		q := `(time() - start()) / step()`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0, 1, 2, 3, 4, 5},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
 	t.Run("time()/100", func(t *testing.T) {
 		t.Parallel()
 		q := `time()/100`
@@ -547,6 +692,34 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
+	t.Run("absent_over_time(time())", func(t *testing.T) {
+		t.Parallel()
+		q := `absent_over_time(time()[:100s])`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run("absent_over_time(NaN)", func(t *testing.T) {
+		t.Parallel()
+		q := `absent_over_time(NaN[:100s])`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run("absent_over_time(partial)", func(t *testing.T) {
+		t.Parallel()
+		q := `absent_over_time((time() < 1500)[100s:100s])`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
 	t.Run(`absent(scalar(multi-timeseries))`, func(t *testing.T) {
 		t.Parallel()
 		q := `
@@ -596,6 +769,78 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
+	t.Run(`clamp(time(), 1200, 1600)`, func(t *testing.T) {
+		t.Parallel()
+		q := `clamp(time(), 1200, 1600)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1200, 1200, 1400, 1600, 1600, 1600},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`clamp(-time(), -1600, -1200)`, func(t *testing.T) {
+		t.Parallel()
+		q := `clamp(-time(), -1600, -1200)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{-1200, -1200, -1400, -1600, -1600, -1600},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`clamp(time(), time()-100, 1500)`, func(t *testing.T) {
+		t.Parallel()
+		q := `clamp(time(), time()-100, 1500)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1500, nan, nan},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`clamp(time(), 1600, 1200)`, func(t *testing.T) {
+		t.Parallel()
+		q := `clamp(time(), 1600, 1200)`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`clamp(nan)`, func(t *testing.T) {
+		t.Parallel()
+		q := `clamp(time() > 1300, 1500, 1700)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, 1500, 1600, 1700, 1700},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`clamp_max(nan)`, func(t *testing.T) {
+		t.Parallel()
+		q := `clamp_max(time() > 1300, -time()+3000)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, 1400, 1400, 1200, 1000},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`clamp_min(nan)`, func(t *testing.T) {
+		t.Parallel()
+		q := `clamp_min(time() < 1500, -1)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, nan, nan, nan},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
 	t.Run("exp(time()/1e3)", func(t *testing.T) {
 		t.Parallel()
 		q := `exp(time()/1e3)`
@@ -623,7 +868,7 @@ func TestExecSuccess(t *testing.T) {
 		q := `round(rand(0), 0.01)`
 		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{0.95, 0.24, 0.66, 0.05, 0.37, 0.28},
+			Values:     []float64{0.95, 0.24, 0.66, 0.05, 0.37, 0.29},
 			Timestamps: timestampsExpected,
 		}
 		resultExpected := []netstorage.Result{r}
@@ -1176,20 +1421,9 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`label_del(nolabels)`, func(t *testing.T) {
-		t.Parallel()
-		q := `label_del(time(), "foo", "bar")`
-		r := netstorage.Result{
-			MetricName: metricNameExpected,
-			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
-			Timestamps: timestampsExpected,
-		}
-		resultExpected := []netstorage.Result{r}
-		f(q, resultExpected)
-	})
-	t.Run(`label_del(certain_labels)`, func(t *testing.T) {
+	t.Run(`drop_common_labels(single_series)`, func(t *testing.T) {
 		t.Parallel()
-		q := `label_del(label_set(time(), "foo", "bar", "__name__", "xxx", "q", "we"), "foo", "nonexisting-label")`
+		q := `drop_common_labels(label_set(time(), "foo", "bar", "__name__", "xxx"))`
 		r := netstorage.Result{
 			MetricName: metricNameExpected,
 			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
@@ -1197,80 +1431,215 @@ func TestExecSuccess(t *testing.T) {
 		}
 		r.MetricName.MetricGroup = []byte("xxx")
 		r.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("q"),
-			Value: []byte("we"),
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
 		}}
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`label_del(metricname)`, func(t *testing.T) {
+	t.Run(`drop_common_labels(multiple_series)`, func(t *testing.T) {
 		t.Parallel()
-		q := `label_del(label_set(time(), "foo", "bar", "__name__", "xxx", "q", "we"), "nonexisting-label", "__name__")`
-		r := netstorage.Result{
+		q := `drop_common_labels((
+			label_set(1, "foo", "bar", "__name__", "xxx", "job", "a", "env", "prod"),
+			label_set(2, "foo", "bar", "__name__", "xxx", "job", "b"),
+		))`
+		r1 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Values:     []float64{1, 1, 1, 1, 1, 1},
 			Timestamps: timestampsExpected,
 		}
-		r.MetricName.Tags = []storage.Tag{
+		r1.MetricName.Tags = []storage.Tag{
 			{
-				Key:   []byte("foo"),
-				Value: []byte("bar"),
+				Key:   []byte("env"),
+				Value: []byte("prod"),
 			},
 			{
-				Key:   []byte("q"),
-				Value: []byte("we"),
+				Key:   []byte("job"),
+				Value: []byte("a"),
 			},
 		}
-		resultExpected := []netstorage.Result{r}
-		f(q, resultExpected)
-	})
-	t.Run(`label_join(empty)`, func(t *testing.T) {
-		t.Parallel()
-		q := `label_join(vector(time()), "tt", "(sep)", "BAR")`
-		r := netstorage.Result{
+		r2 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Values:     []float64{2, 2, 2, 2, 2, 2},
 			Timestamps: timestampsExpected,
 		}
-		resultExpected := []netstorage.Result{r}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("job"),
+			Value: []byte("b"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
 		f(q, resultExpected)
 	})
-	t.Run(`label_join(tt)`, func(t *testing.T) {
+	t.Run(`drop_common_labels(distinct_metric_names)`, func(t *testing.T) {
 		t.Parallel()
-		q := `label_join(vector(time()), "tt", "(sep)", "foo", "BAR")`
-		r := netstorage.Result{
+		q := `drop_common_labels((
+			label_set(1, "foo", "bar", "__name__", "xxx"),
+			label_set(2, "foo", "bar", "__name__", "yyy"),
+		))`
+		r1 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Values:     []float64{1, 1, 1, 1, 1, 1},
 			Timestamps: timestampsExpected,
 		}
-		r.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("tt"),
-			Value: []byte("(sep)"),
-		}}
-		resultExpected := []netstorage.Result{r}
-		f(q, resultExpected)
-	})
-	t.Run(`label_join(__name__)`, func(t *testing.T) {
-		t.Parallel()
-		q := `label_join(time(), "__name__", "(sep)", "foo", "BAR", "")`
-		r := netstorage.Result{
+		r1.MetricName.MetricGroup = []byte("xxx")
+		r2 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Values:     []float64{2, 2, 2, 2, 2, 2},
 			Timestamps: timestampsExpected,
 		}
-		r.MetricName.MetricGroup = []byte("(sep)(sep)")
-		resultExpected := []netstorage.Result{r}
+		r2.MetricName.MetricGroup = []byte("yyy")
+		resultExpected := []netstorage.Result{r1, r2}
 		f(q, resultExpected)
 	})
-	t.Run(`label_join(label_join)`, func(t *testing.T) {
+	t.Run(`labels_equal()`, func(t *testing.T) {
 		t.Parallel()
-		q := `label_join(label_join(time(), "__name__", "(sep)", "foo", "BAR"), "xxx", ",", "foobar", "__name__")`
-		r := netstorage.Result{
+		q := `labels_equal((
+			label_set(1, "src", "a", "dst", "a"),
+			label_set(2, "src", "a", "dst", "b"),
+			label_set(3, "src", "b"),
+			label_set(4, "foo", "bar"),
+		), "src", "dst")`
+		r1 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("dst"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("src"),
+				Value: []byte("a"),
+			},
+		}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{4, 4, 4, 4, 4, 4},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`labels_equal(metricname)`, func(t *testing.T) {
+		t.Parallel()
+		q := `labels_equal((
+			label_set(1, "__name__", "foo", "job", "foo"),
+			label_set(2, "__name__", "foo", "job", "bar"),
+		), "__name__", "job")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.MetricGroup = []byte("foo")
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("job"),
+			Value: []byte("foo"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_del(nolabels)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_del(time(), "foo", "bar")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_del(certain_labels)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_del(label_set(time(), "foo", "bar", "__name__", "xxx", "q", "we"), "foo", "nonexisting-label")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.MetricGroup = []byte("xxx")
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("q"),
+			Value: []byte("we"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_del(metricname)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_del(label_set(time(), "foo", "bar", "__name__", "xxx", "q", "we"), "nonexisting-label", "__name__")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("q"),
+				Value: []byte("we"),
+			},
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_join(empty)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_join(vector(time()), "tt", "(sep)", "BAR")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_join(tt)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_join(vector(time()), "tt", "(sep)", "foo", "BAR")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
 			Timestamps: timestampsExpected,
 		}
-		r.MetricName.MetricGroup = []byte("(sep)")
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("tt"),
+			Value: []byte("(sep)"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_join(__name__)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_join(time(), "__name__", "(sep)", "foo", "BAR", "")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.MetricGroup = []byte("(sep)(sep)")
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_join(label_join)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_join(label_join(time(), "__name__", "(sep)", "foo", "BAR"), "xxx", ",", "foobar", "__name__")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.MetricGroup = []byte("(sep)")
 		r.MetricName.Tags = []storage.Tag{{
 			Key:   []byte("xxx"),
 			Value: []byte(",(sep)"),
@@ -1351,6 +1720,88 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
+	t.Run(`label_replace(capture_groups)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_replace(label_set(time(), "foo", "bar-baz"), "xxx", "$2:${1}", "foo", "(.+)-(.+)")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar-baz"),
+			},
+			{
+				Key:   []byte("xxx"),
+				Value: []byte("baz:bar"),
+			},
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_replace(mismatch_keep_dst)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_replace(label_set(time(), "foo", "bar", "xxx", "yyy"), "xxx", "$1", "foo", "b(z+)")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("xxx"),
+				Value: []byte("yyy"),
+			},
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_replace(empty_replacement)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_replace(label_set(time(), "foo", "bar", "xxx", "yyy"), "xxx", "", "foo", ".+")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`label_join(missing_src_labels)`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_join(label_set(time(), "foo", "a", "bar", "b"), "xxx", "-", "foo", "missing", "bar")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("bar"),
+				Value: []byte("b"),
+			},
+			{
+				Key:   []byte("foo"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("xxx"),
+				Value: []byte("a--b"),
+			},
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
 	t.Run(`two_timeseries`, func(t *testing.T) {
 		t.Parallel()
 		q := `sort_desc(time() or label_set(2, "xx", "foo"))`
@@ -1404,91 +1855,423 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`scalar(multi-timeseries)`, func(t *testing.T) {
+	t.Run(`round(negative)`, func(t *testing.T) {
 		t.Parallel()
-		q := `scalar(1 or label_set(2, "xx", "foo"))`
-		resultExpected := []netstorage.Result{}
+		q := `round(-time()/1e3*2.5)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{-2, -3, -3, -4, -4, -5},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`sort()`, func(t *testing.T) {
+	t.Run(`round(fractional, 0.25)`, func(t *testing.T) {
 		t.Parallel()
-		q := `sort(2 or label_set(1, "xx", "foo"))`
-		r1 := netstorage.Result{
+		q := `round(time()/1e3*1.234, 0.25)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Values:     []float64{1.25, 1.5, 1.75, 2, 2.25, 2.5},
 			Timestamps: timestampsExpected,
 		}
-		r1.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("xx"),
-			Value: []byte("foo"),
-		}}
-		r2 := netstorage.Result{
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`round(fractional, 0.1)`, func(t *testing.T) {
+		t.Parallel()
+		q := `round(-time()/1e3*1.234, 0.1)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Values:     []float64{-1.2, -1.5, -1.7, -2, -2.2, -2.5},
 			Timestamps: timestampsExpected,
 		}
-		resultExpected := []netstorage.Result{r1, r2}
+		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`sort_desc()`, func(t *testing.T) {
+	t.Run(`round(scalar, time())`, func(t *testing.T) {
 		t.Parallel()
-		q := `sort_desc(1 or label_set(2, "xx", "foo"))`
-		r1 := netstorage.Result{
+		q := `round(1111, time()/10)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Values:     []float64{1100, 1080, 1120, 1120, 1080, 1200},
 			Timestamps: timestampsExpected,
 		}
-		r1.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("xx"),
-			Value: []byte("foo"),
-		}}
-		r2 := netstorage.Result{
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`round(nan)`, func(t *testing.T) {
+		t.Parallel()
+		q := `round((time() > 1300)/1e3)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Values:     []float64{nan, nan, 1, 2, 2, 2},
 			Timestamps: timestampsExpected,
 		}
-		resultExpected := []netstorage.Result{r1, r2}
+		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`1 > 2`, func(t *testing.T) {
+	t.Run(`scalar(multi-timeseries)`, func(t *testing.T) {
 		t.Parallel()
-		q := `1 > 2`
+		q := `scalar(1 or label_set(2, "xx", "foo"))`
 		resultExpected := []netstorage.Result{}
 		f(q, resultExpected)
 	})
-	t.Run(`vector(1) == bool time()`, func(t *testing.T) {
+	t.Run(`scalar(zero-timeseries)`, func(t *testing.T) {
 		t.Parallel()
-		q := `vector(1) == bool time()`
+		q := `scalar(label_set(1, "foo", "bar") + on(foo) label_set(2, "foo", "baz"))`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`scalar(multi-timeseries-partial)`, func(t *testing.T) {
+		t.Parallel()
+		q := `scalar(label_set(time() > 1400, "foo", "bar") or label_set(time() < 1400, "foo", "baz"))`
 		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{0, 0, 0, 0, 0, 0},
+			Values:     []float64{1000, 1200, nan, 1600, 1800, 2000},
 			Timestamps: timestampsExpected,
 		}
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`vector(1) == time()`, func(t *testing.T) {
+	t.Run(`scalar(multi-timeseries) * vector`, func(t *testing.T) {
 		t.Parallel()
-		q := `vector(1) == time()`
+		q := `scalar(1 or label_set(2, "xx", "foo")) * label_set(3, "foo", "bar")`
 		resultExpected := []netstorage.Result{}
 		f(q, resultExpected)
 	})
-	t.Run(`-1 < 2`, func(t *testing.T) {
+	t.Run(`vector(scalar(zero-timeseries))`, func(t *testing.T) {
 		t.Parallel()
-		q := `-1 < 2`
+		q := `vector(scalar(label_set(1, "foo", "bar") + on(foo) label_set(2, "foo", "baz"))) default 7`
 		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{-1, -1, -1, -1, -1, -1},
+			Values:     []float64{7, 7, 7, 7, 7, 7},
 			Timestamps: timestampsExpected,
 		}
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`time() > 2`, func(t *testing.T) {
+	t.Run(`sort()`, func(t *testing.T) {
 		t.Parallel()
-		q := `time() > 2`
-		r := netstorage.Result{
-			MetricName: metricNameExpected,
+		q := `sort(2 or label_set(1, "xx", "foo"))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("xx"),
+			Value: []byte("foo"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_by_label()`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_by_label(label_set(1, "host", "b") or label_set(2, "host", "a") or label_set(3, "foo", "x"), "host")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("a"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("b"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("x"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_by_label_desc()`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_by_label_desc(label_set(1, "host", "b") or label_set(2, "host", "a") or label_set(3, "foo", "x"), "host")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("b"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("a"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("x"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_by_label(lexicographic)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_by_label(label_set(1, "host", "host10") or label_set(2, "host", "host2") or label_set(3, "host", "host1"), "host")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host1"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host10"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host2"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_by_label_numeric()`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_by_label_numeric(label_set(1, "host", "host10") or label_set(2, "host", "host2") or label_set(3, "host", "host1"), "host")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host1"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host2"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host10"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_by_label_numeric_desc()`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_by_label_numeric_desc(label_set(1, "host", "host10") or label_set(2, "host", "host2") or label_set(3, "host", "host1"), "host")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host10"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host2"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("host"),
+			Value: []byte("host1"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_by_label(multiple-labels)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_by_label(label_set(1, "x", "a", "y", "2") or label_set(2, "x", "b") or label_set(3, "x", "a", "y", "1"), "x", "y")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("a"),
+		}, {
+			Key:   []byte("y"),
+			Value: []byte("1"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("a"),
+		}, {
+			Key:   []byte("y"),
+			Value: []byte("2"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("b"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_by_label(stable)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_by_label(label_set(1, "x", "a", "y", "2") or label_set(2, "x", "b") or label_set(3, "x", "a", "y", "1"), "x")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("a"),
+		}, {
+			Key:   []byte("y"),
+			Value: []byte("2"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("a"),
+		}, {
+			Key:   []byte("y"),
+			Value: []byte("1"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("b"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3}
+		f(q, resultExpected)
+	})
+	t.Run(`sort_desc()`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_desc(1 or label_set(2, "xx", "foo"))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("xx"),
+			Value: []byte("foo"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`1 > 2`, func(t *testing.T) {
+		t.Parallel()
+		q := `1 > 2`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`vector(1) == bool time()`, func(t *testing.T) {
+		t.Parallel()
+		q := `vector(1) == bool time()`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0, 0, 0, 0, 0, 0},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`vector(1) == time()`, func(t *testing.T) {
+		t.Parallel()
+		q := `vector(1) == time()`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`-1 < 2`, func(t *testing.T) {
+		t.Parallel()
+		q := `-1 < 2`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{-1, -1, -1, -1, -1, -1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`time() > 2`, func(t *testing.T) {
+		t.Parallel()
+		q := `time() > 2`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
 			Values:     []float64{1000, 1200, 1400, 1600, 1800, 2000},
 			Timestamps: timestampsExpected,
 		}
@@ -1872,40 +2655,166 @@ func TestExecSuccess(t *testing.T) {
 		)`
 		r1 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{2000, 2400, 2800, 3200, 3600, 4000},
+			Values:     []float64{2000, 2400, 2800, 3200, 3600, 4000},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("noxxx"),
+				Value: []byte("aa"),
+			},
+			{
+				Key:   []byte("t2"),
+				Value: []byte("v3"),
+			},
+		}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1010, 1210, 1410, 1610, 1810, 2010},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("noxxx"),
+				Value: []byte("aa"),
+			},
+			{
+				Key:   []byte("t2"),
+				Value: []byte("v3"),
+			},
+			{
+				Key:   []byte("xxx"),
+				Value: []byte("yy"),
+			},
+		}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`rate(x) * on(instance) group_left(role) node_info`, func(t *testing.T) {
+		t.Parallel()
+		q := `with (
+			x = label_set(time()*2, "__name__", "x", "instance", "a", "job", "j") or label_set(time()*4, "__name__", "x", "instance", "b", "job", "j"),
+			node_info = label_set(1, "__name__", "node_info", "instance", "a", "role", "db") or label_set(1, "__name__", "node_info", "instance", "b", "role", "web"),
+		)
+		sort(rate(x[100s:10s]) * on(instance) group_left(role) node_info)`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("instance"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("job"),
+				Value: []byte("j"),
+			},
+			{
+				Key:   []byte("role"),
+				Value: []byte("db"),
+			},
+		}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{4, 4, 4, 4, 4, 4},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("instance"),
+				Value: []byte("b"),
+			},
+			{
+				Key:   []byte("job"),
+				Value: []byte("j"),
+			},
+			{
+				Key:   []byte("role"),
+				Value: []byte("web"),
+			},
+		}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`vector * on(instance) group_left(role) overwrites labels`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_set(time(), "instance", "a", "role", "old") * on(instance) group_left(role) label_set(2, "instance", "a", "role", "new")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2000, 2400, 2800, 3200, 3600, 4000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("instance"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("role"),
+				Value: []byte("new"),
+			},
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`vector * on(instance) group_left(role) removes missing labels`, func(t *testing.T) {
+		t.Parallel()
+		q := `label_set(time(), "instance", "a", "role", "old") * on(instance) group_left(role) label_set(2, "instance", "a")`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2000, 2400, 2800, 3200, 3600, 4000},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("instance"),
+			Value: []byte("a"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`node_info * on(instance) group_right(role) vector`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(label_set(2, "instance", "a", "role", "db") * on(instance) group_right(role) (
+			label_set(time(), "instance", "a", "cpu", "0") or label_set(10, "instance", "a", "cpu", "1")
+		))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{20, 20, 20, 20, 20, 20},
 			Timestamps: timestampsExpected,
 		}
 		r1.MetricName.Tags = []storage.Tag{
 			{
-				Key:   []byte("noxxx"),
-				Value: []byte("aa"),
+				Key:   []byte("cpu"),
+				Value: []byte("1"),
 			},
 			{
-				Key:   []byte("t1"),
-				Value: []byte("v123"),
+				Key:   []byte("instance"),
+				Value: []byte("a"),
 			},
 			{
-				Key:   []byte("t2"),
-				Value: []byte("v3"),
+				Key:   []byte("role"),
+				Value: []byte("db"),
 			},
 		}
 		r2 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1010, 1210, 1410, 1610, 1810, 2010},
+			Values:     []float64{2000, 2400, 2800, 3200, 3600, 4000},
 			Timestamps: timestampsExpected,
 		}
 		r2.MetricName.Tags = []storage.Tag{
 			{
-				Key:   []byte("noxxx"),
-				Value: []byte("aa"),
+				Key:   []byte("cpu"),
+				Value: []byte("0"),
 			},
 			{
-				Key:   []byte("t2"),
-				Value: []byte("v3"),
+				Key:   []byte("instance"),
+				Value: []byte("a"),
 			},
 			{
-				Key:   []byte("xxx"),
-				Value: []byte("yy"),
+				Key:   []byte("role"),
+				Value: []byte("db"),
 			},
 		}
 		resultExpected := []netstorage.Result{r1, r2}
@@ -2029,51 +2938,395 @@ func TestExecSuccess(t *testing.T) {
 		q := `histogram_quantile(0.6, label_set(100, "le", "200"))`
 		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{120, 120, 120, 120, 120, 120},
+			Values:     []float64{120, 120, 120, 120, 120, 120},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(scalar-phi)`, func(t *testing.T) {
+		t.Parallel()
+		q := `histogram_quantile(time() / 2 / 1e3, label_set(100, "le", "200"))`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{100, 120, 140, 160, 180, 200},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(valid)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(histogram_quantile(0.6,
+			label_set(90, "foo", "bar", "le", "10")
+			or label_set(100, "foo", "bar", "le", "30")
+			or label_set(300, "foo", "bar", "le", "+Inf")
+			or label_set(200, "tag", "xx", "le", "10")
+			or label_set(300, "tag", "xx", "le", "30")
+		))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{9, 9, 9, 9, 9, 9},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("tag"),
+			Value: []byte("xx"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{30, 30, 30, 30, 30, 30},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(vmrange-p10)`, func(t *testing.T) {
+		t.Parallel()
+		// Non-cumulative buckets in random order with gaps at [0...5] and [20...25].
+		q := `histogram_quantile(0.1, (
+			label_set(5, "foo", "bar", "vmrange", "30...40")
+			or label_set(20, "foo", "bar", "vmrange", "5...10")
+			or label_set(15, "foo", "bar", "vmrange", "25...30")
+			or label_set(60, "foo", "bar", "vmrange", "10...20")
+		))`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{7.5, 7.5, 7.5, 7.5, 7.5, 7.5},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(vmrange-p50)`, func(t *testing.T) {
+		t.Parallel()
+		// Non-cumulative buckets in random order with gaps at [0...5] and [20...25].
+		q := `histogram_quantile(0.5, (
+			label_set(5, "foo", "bar", "vmrange", "30...40")
+			or label_set(20, "foo", "bar", "vmrange", "5...10")
+			or label_set(15, "foo", "bar", "vmrange", "25...30")
+			or label_set(60, "foo", "bar", "vmrange", "10...20")
+		))`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{15, 15, 15, 15, 15, 15},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(vmrange-p90)`, func(t *testing.T) {
+		t.Parallel()
+		// Non-cumulative buckets in random order with gaps at [0...5] and [20...25].
+		q := `histogram_quantile(0.9, (
+			label_set(5, "foo", "bar", "vmrange", "30...40")
+			or label_set(20, "foo", "bar", "vmrange", "5...10")
+			or label_set(15, "foo", "bar", "vmrange", "25...30")
+			or label_set(60, "foo", "bar", "vmrange", "10...20")
+		))`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{28.333333333333332, 28.333333333333332, 28.333333333333332, 28.333333333333332, 28.333333333333332, 28.333333333333332},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(vmrange-p99)`, func(t *testing.T) {
+		t.Parallel()
+		// Non-cumulative buckets in random order with gaps at [0...5] and [20...25].
+		q := `histogram_quantile(0.99, (
+			label_set(5, "foo", "bar", "vmrange", "30...40")
+			or label_set(20, "foo", "bar", "vmrange", "5...10")
+			or label_set(15, "foo", "bar", "vmrange", "25...30")
+			or label_set(60, "foo", "bar", "vmrange", "10...20")
+		))`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{38, 38, 38, 38, 38, 38},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(vmrange-and-le)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(histogram_quantile(0.5,
+			label_set(10, "foo", "bar", "vmrange", "0...10")
+			or label_set(30, "foo", "bar", "vmrange", "10...20")
+			or label_set(90, "tag", "xx", "le", "10")
+			or label_set(100, "tag", "xx", "le", "+Inf")
+		))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{5.555555555555555, 5.555555555555555, 5.555555555555555, 5.555555555555555, 5.555555555555555, 5.555555555555555},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("tag"),
+			Value: []byte("xx"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{13.333333333333334, 13.333333333333334, 13.333333333333334, 13.333333333333334, 13.333333333333334, 13.333333333333334},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(vmrange-no-observations)`, func(t *testing.T) {
+		t.Parallel()
+		q := `histogram_quantile(0.5, label_set(0, "vmrange", "0...10") or label_set(0, "vmrange", "10...20"))`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(vmrange-invalid)`, func(t *testing.T) {
+		t.Parallel()
+		q := `histogram_quantile(0.5, label_set(10, "vmrange", "foobar") or label_set(10, "vmrange", "20...10"))`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`prometheus_buckets(vmrange)`, func(t *testing.T) {
+		t.Parallel()
+		// Non-cumulative buckets in random order with a gap at [20...25].
+		q := `sort_by_label(prometheus_buckets(
+			label_set(5, "foo", "bar", "vmrange", "30...40")
+			or label_set(20, "foo", "bar", "vmrange", "0...10")
+			or label_set(15, "foo", "bar", "vmrange", "25...30")
+			or label_set(60, "foo", "bar", "vmrange", "10...20")
+		), "le")`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{100, 100, 100, 100, 100, 100},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("+Inf"),
+			},
+		}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0, 0, 0, 0, 0, 0},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("0"),
+			},
+		}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{20, 20, 20, 20, 20, 20},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("10"),
+			},
+		}
+		r4 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{80, 80, 80, 80, 80, 80},
+			Timestamps: timestampsExpected,
+		}
+		r4.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("20"),
+			},
+		}
+		r5 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{80, 80, 80, 80, 80, 80},
+			Timestamps: timestampsExpected,
+		}
+		r5.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("25"),
+			},
+		}
+		r6 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{95, 95, 95, 95, 95, 95},
+			Timestamps: timestampsExpected,
+		}
+		r6.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("30"),
+			},
+		}
+		r7 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{100, 100, 100, 100, 100, 100},
+			Timestamps: timestampsExpected,
+		}
+		r7.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("40"),
+			},
+		}
+		resultExpected := []netstorage.Result{r1, r2, r3, r4, r5, r6, r7}
+		f(q, resultExpected)
+	})
+	t.Run(`prometheus_buckets(le)`, func(t *testing.T) {
+		t.Parallel()
+		q := `prometheus_buckets(label_set(90, "foo", "bar", "le", "10") or label_set(100, "foo", "baz"))`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{90, 90, 90, 90, 90, 90},
+			Timestamps: timestampsExpected,
+		}
+		r.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+			{
+				Key:   []byte("le"),
+				Value: []byte("10"),
+			},
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`histogram_quantile(prometheus_buckets)`, func(t *testing.T) {
+		t.Parallel()
+		// The quantile over converted buckets must match the quantile over the original vmrange buckets.
+		q := `histogram_quantile(0.9, prometheus_buckets(
+			label_set(5, "foo", "bar", "vmrange", "30...40")
+			or label_set(20, "foo", "bar", "vmrange", "5...10")
+			or label_set(15, "foo", "bar", "vmrange", "25...30")
+			or label_set(60, "foo", "bar", "vmrange", "10...20")
+		))`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{28.333333333333332, 28.333333333333332, 28.333333333333332, 28.333333333333332, 28.333333333333332, 28.333333333333332},
 			Timestamps: timestampsExpected,
 		}
+		r.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("foo"),
+				Value: []byte("bar"),
+			},
+		}
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`histogram_quantile(scalar-phi)`, func(t *testing.T) {
+	t.Run(`histogram_over_time(phi)`, func(t *testing.T) {
+		t.Parallel()
+		// Synthetic histogram from two instances. Per-second bucket increases are
+		// 10 for le=1, 50 for le=2, 90 for le=4 and 100 for le=+Inf.
+		const histogram = `(
+			label_set(time()*4, "le", "1", "instance", "a")
+			or label_set(time()*6, "le", "1", "instance", "b")
+			or label_set(time()*20, "le", "2", "instance", "a")
+			or label_set(time()*30, "le", "2", "instance", "b")
+			or label_set(time()*40, "le", "4", "instance", "a")
+			or label_set(time()*50, "le", "4", "instance", "b")
+			or label_set(time()*50, "le", "+Inf", "instance", "a")
+			or label_set(time()*50, "le", "+Inf", "instance", "b")
+		)[200s:10s]`
+		for _, tc := range []struct {
+			phi   string
+			value float64
+		}{
+			{"0.25", 1.375},
+			{"0.5", 2},
+			{"0.9", 4},
+			// The quantile falls into +Inf bucket, so the upper bound of the previous bucket is returned.
+			{"0.99", 4},
+		} {
+			q := `histogram_over_time(` + tc.phi + `, ` + histogram + `)`
+			r := netstorage.Result{
+				MetricName: metricNameExpected,
+				Values:     []float64{tc.value, tc.value, tc.value, tc.value, tc.value, tc.value},
+				Timestamps: timestampsExpected,
+			}
+			resultExpected := []netstorage.Result{r}
+			f(q, resultExpected)
+		}
+	})
+	t.Run(`histogram_over_time(non-monotonic)`, func(t *testing.T) {
 		t.Parallel()
-		q := `histogram_quantile(time() / 2 / 1e3, label_set(100, "le", "200"))`
+		// The le=2 bucket is smaller than the le=1 bucket, so it is clamped to the le=1 bucket.
+		// The +Inf bucket is smaller than the le=4 bucket, so the total is clamped to the le=4 bucket.
+		q := `histogram_over_time(0.5, (
+			label_set(time()*10, "le", "1")
+			or label_set(time()*5, "le", "2")
+			or label_set(time()*90, "le", "4")
+			or label_set(time()*80, "le", "+Inf")
+		)[200s:10s])`
 		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{100, 120, 140, 160, 180, 200},
+			Values:     []float64{2.875, 2.875, 2.875, 2.875, 2.875, 2.875},
 			Timestamps: timestampsExpected,
 		}
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`histogram_quantile(valid)`, func(t *testing.T) {
+	t.Run(`histogram_over_time(no-observations)`, func(t *testing.T) {
 		t.Parallel()
-		q := `sort(histogram_quantile(0.6,
-			label_set(90, "foo", "bar", "le", "10")
-			or label_set(100, "foo", "bar", "le", "30")
-			or label_set(300, "foo", "bar", "le", "+Inf")
-			or label_set(200, "tag", "xx", "le", "10")
-			or label_set(300, "tag", "xx", "le", "30")
-		))`
-		r1 := netstorage.Result{
-			MetricName: metricNameExpected,
-			Values:     []float64{9, 9, 9, 9, 9, 9},
-			Timestamps: timestampsExpected,
-		}
-		r1.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("tag"),
-			Value: []byte("xx"),
-		}}
-		r2 := netstorage.Result{
-			MetricName: metricNameExpected,
-			Values:     []float64{30, 30, 30, 30, 30, 30},
-			Timestamps: timestampsExpected,
-		}
-		r2.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("foo"),
-			Value: []byte("bar"),
-		}}
-		resultExpected := []netstorage.Result{r1, r2}
+		q := `histogram_over_time(0.5, (label_set(1, "le", "1") or label_set(1, "le", "+Inf"))[200s:10s])`
+		resultExpected := []netstorage.Result{}
 		f(q, resultExpected)
 	})
 	t.Run(`median_over_time()`, func(t *testing.T) {
@@ -2363,72 +3616,317 @@ func TestExecSuccess(t *testing.T) {
 	})
 	t.Run(`topk(NaN)`, func(t *testing.T) {
 		t.Parallel()
-		q := `sort(topk(NaN, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
+		q := `sort(topk(NaN, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`topk(100500)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(topk(100500, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{10, 10, 10, 10, 10, 10},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{6.666666666666667, 8, 9.333333333333334, 10.666666666666666, 12, 13.333333333333334},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("baz"),
+			Value: []byte("sss"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`bottomk(1)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(bottomk(1, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{6.666666666666667, 8, 9.333333333333334, nan, nan, nan},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("baz"),
+			Value: []byte("sss"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, nan, 10, 10, 10},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`topk_max(1)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(topk_max(1, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{6.666666666666667, 8, 9.333333333333334, 10.666666666666666, 12, 13.333333333333334},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("baz"),
+			Value: []byte("sss"),
+		}}
+		resultExpected := []netstorage.Result{r1}
+		f(q, resultExpected)
+	})
+	t.Run(`topk_min(1)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(topk_min(1, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{10, 10, 10, 10, 10, 10},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r1}
+		f(q, resultExpected)
+	})
+	t.Run(`topk_avg(1)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(topk_avg(1, label_set(10, "foo", "bar") or label_set(time()/100, "baz", "sss") or label_set(time()/500, "x", "y")))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{10, 12, 14, 16, 18, 20},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("baz"),
+			Value: []byte("sss"),
+		}}
+		resultExpected := []netstorage.Result{r1}
+		f(q, resultExpected)
+	})
+	t.Run(`topk_avg(2)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(topk_avg(2, label_set(10, "foo", "bar") or label_set(time()/100, "baz", "sss") or label_set(time()/500, "x", "y")))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{10, 10, 10, 10, 10, 10},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{10, 12, 14, 16, 18, 20},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("baz"),
+			Value: []byte("sss"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`topk_avg(NaN)`, func(t *testing.T) {
+		t.Parallel()
+		q := `topk_avg(NaN, label_set(10, "foo", "bar") or label_set(time()/100, "baz", "sss"))`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`topk_max(1, remaining_sum)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort_desc(topk_max(1, label_set(10, "foo", "bar") or label_set(time()/500, "x", "y") or label_set(time()/150, "baz", "sss"), "remaining_sum"))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{6.666666666666667, 8, 9.333333333333334, 10.666666666666666, 12, 13.333333333333334},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("baz"),
+			Value: []byte("sss"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{12, 12.4, 12.8, 13.2, 13.6, 14},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("remaining_sum"),
+			Value: []byte("other"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`bottomk_max(1, remaining_sum=foo)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(bottomk_max(1, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss"), "remaining_sum=foo"))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{6.666666666666667, 8, 9.333333333333334, 10.666666666666666, 12, 13.333333333333334},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("remaining_sum"),
+			Value: []byte("foo"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{10, 10, 10, 10, 10, 10},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r2, r1}
+		f(q, resultExpected)
+	})
+	t.Run(`bottomk_min(1)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(bottomk_min(1, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{6.666666666666667, 8, 9.333333333333334, 10.666666666666666, 12, 13.333333333333334},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("baz"),
+			Value: []byte("sss"),
+		}}
+		resultExpected := []netstorage.Result{r1}
+		f(q, resultExpected)
+	})
+	t.Run(`bottomk_avg(1) by (foo)`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(bottomk_avg(1, label_set(10, "foo", "bar") or label_set(time()/150, "foo", "bar", "x", "y") or label_set(time()/500, "foo", "baz")) by (foo))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2.4, 2.8, 3.2, 3.6, 4},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("baz"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{10, 10, 10, 10, 10, 10},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("foo"),
+			Value: []byte("bar"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+	t.Run(`keep_last_value()`, func(t *testing.T) {
+		t.Parallel()
+		q := `keep_last_value(label_set(time() < 1300 default time() > 1700, "__name__", "foobar", "x", "y"))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1000, 1200, 1200, 1200, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.MetricGroup = []byte("foobar")
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("y"),
+		}}
+		resultExpected := []netstorage.Result{r1}
+		f(q, resultExpected)
+	})
+	t.Run(`keep_last_value(leading_nans)`, func(t *testing.T) {
+		t.Parallel()
+		q := `keep_last_value(time() > 1500)`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, nan, 1600, 1800, 2000},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`keep_last_value(all_nans)`, func(t *testing.T) {
+		t.Parallel()
+		q := `keep_last_value(time() > 3000)`
 		resultExpected := []netstorage.Result{}
 		f(q, resultExpected)
 	})
-	t.Run(`topk(100500)`, func(t *testing.T) {
+	t.Run(`keep_last_value(q, maxGap)`, func(t *testing.T) {
 		t.Parallel()
-		q := `sort(topk(100500, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
-		r1 := netstorage.Result{
+		q := `keep_last_value(time() < 1300 default time() > 1700, 300)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{10, 10, 10, 10, 10, 10},
+			Values:     []float64{1000, 1200, 1200, nan, 1800, 2000},
 			Timestamps: timestampsExpected,
 		}
-		r1.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("foo"),
-			Value: []byte("bar"),
-		}}
-		r2 := netstorage.Result{
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`keep_next_value()`, func(t *testing.T) {
+		t.Parallel()
+		q := `keep_next_value(label_set(time() < 1300 default time() > 1700, "__name__", "foobar", "x", "y"))`
+		r1 := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{6.666666666666667, 8, 9.333333333333334, 10.666666666666666, 12, 13.333333333333334},
+			Values:     []float64{1000, 1200, 1800, 1800, 1800, 2000},
 			Timestamps: timestampsExpected,
 		}
-		r2.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("baz"),
-			Value: []byte("sss"),
+		r1.MetricName.MetricGroup = []byte("foobar")
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("x"),
+			Value: []byte("y"),
 		}}
-		resultExpected := []netstorage.Result{r1, r2}
+		resultExpected := []netstorage.Result{r1}
 		f(q, resultExpected)
 	})
-	t.Run(`bottomk(1)`, func(t *testing.T) {
+	t.Run(`keep_next_value(leading_nans)`, func(t *testing.T) {
 		t.Parallel()
-		q := `sort(bottomk(1, label_set(10, "foo", "bar") or label_set(time()/150, "baz", "sss")))`
-		r1 := netstorage.Result{
+		q := `keep_next_value(time() > 1500)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{6.666666666666667, 8, 9.333333333333334, nan, nan, nan},
+			Values:     []float64{1600, 1600, 1600, 1600, 1800, 2000},
 			Timestamps: timestampsExpected,
 		}
-		r1.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("baz"),
-			Value: []byte("sss"),
-		}}
-		r2 := netstorage.Result{
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`keep_next_value(trailing_nans)`, func(t *testing.T) {
+		t.Parallel()
+		q := `keep_next_value(time() < 1500)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{nan, nan, nan, 10, 10, 10},
+			Values:     []float64{1000, 1200, 1400, nan, nan, nan},
 			Timestamps: timestampsExpected,
 		}
-		r2.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("foo"),
-			Value: []byte("bar"),
-		}}
-		resultExpected := []netstorage.Result{r1, r2}
+		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
-	t.Run(`keep_last_value()`, func(t *testing.T) {
+	t.Run(`keep_next_value(all_nans)`, func(t *testing.T) {
 		t.Parallel()
-		q := `keep_last_value(label_set(time() < 1300 default time() > 1700, "__name__", "foobar", "x", "y"))`
-		r1 := netstorage.Result{
+		q := `keep_next_value(time() > 3000)`
+		resultExpected := []netstorage.Result{}
+		f(q, resultExpected)
+	})
+	t.Run(`keep_next_value(q, maxGap)`, func(t *testing.T) {
+		t.Parallel()
+		q := `keep_next_value(time() < 1300 default time() > 1700, 300)`
+		r := netstorage.Result{
 			MetricName: metricNameExpected,
-			Values:     []float64{1000, 1200, 1200, 1200, 1800, 2000},
+			Values:     []float64{1000, 1200, nan, 1800, 1800, 2000},
 			Timestamps: timestampsExpected,
 		}
-		r1.MetricName.MetricGroup = []byte("foobar")
-		r1.MetricName.Tags = []storage.Tag{{
-			Key:   []byte("x"),
-			Value: []byte("y"),
-		}}
-		resultExpected := []netstorage.Result{r1}
+		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
 	t.Run(`distinct_over_time([500s])`, func(t *testing.T) {
@@ -2786,6 +4284,61 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r}
 		f(q, resultExpected)
 	})
+	t.Run(`avg_over_time(rate(time()[100s:])[300s:])`, func(t *testing.T) {
+		t.Parallel()
+		q := `avg_over_time(rate(time()[100s:])[300s:])`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`max_over_time(rate(time()[100s:10s])[1000s:100s])`, func(t *testing.T) {
+		t.Parallel()
+		q := `max_over_time(rate(time()[100s:10s])[1000s:100s])`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`max_over_time(deriv(time()[200s:100s])[500s:])`, func(t *testing.T) {
+		t.Parallel()
+		q := `max_over_time(deriv(time()[200s:100s])[500s:])`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`rate(avg_over_time(time()[200s:100s])[300s:100s])`, func(t *testing.T) {
+		t.Parallel()
+		q := `rate(avg_over_time(time()[200s:100s])[300s:100s])`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
+	t.Run(`count_over_time(time()[300s:100s])`, func(t *testing.T) {
+		t.Parallel()
+		q := `count_over_time(time()[300s:100s])`
+		r := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{3, 3, 3, 3, 3, 3},
+			Timestamps: timestampsExpected,
+		}
+		resultExpected := []netstorage.Result{r}
+		f(q, resultExpected)
+	})
 	t.Run(`increase(time())`, func(t *testing.T) {
 		t.Parallel()
 		q := `increase(time())`
@@ -3133,6 +4686,48 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r1, r2, r3}
 		f(q, resultExpected)
 	})
+	t.Run(`rollup_candlestick()`, func(t *testing.T) {
+		t.Parallel()
+		q := `sort(rollup_candlestick(round(rand(0),0.01)[:10s]))`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0.32, 0.82, 0.13, 0.29, 0.86, 0.58},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("rollup"),
+			Value: []byte("open"),
+		}}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0.04, 0.49, 0.46, 0.58, 0.92, 0.52},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("rollup"),
+			Value: []byte("close"),
+		}}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0.02, 0.03, 0, 0.03, 0.02, 0.02},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("rollup"),
+			Value: []byte("low"),
+		}}
+		r4 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{0.94, 0.97, 0.93, 0.98, 0.92, 1},
+			Timestamps: timestampsExpected,
+		}
+		r4.MetricName.Tags = []storage.Tag{{
+			Key:   []byte("rollup"),
+			Value: []byte("high"),
+		}}
+		resultExpected := []netstorage.Result{r1, r2, r3, r4}
+		f(q, resultExpected)
+	})
 	t.Run(`rollup_deriv()`, func(t *testing.T) {
 		t.Parallel()
 		q := `sort(rollup_deriv(time()[100s:50s]))`
@@ -3475,6 +5070,178 @@ func TestExecSuccess(t *testing.T) {
 		resultExpected := []netstorage.Result{r1, r2, r3, r4, r5, r6}
 		f(q, resultExpected)
 	})
+	t.Run(`count_values by (job)`, func(t *testing.T) {
+		t.Parallel()
+		// The value 1 appears in both groups, so it must be counted per each group.
+		q := `count_values("version", (
+			label_set(1, "job", "a", "instance", "x"),
+			label_set(1, "job", "a", "instance", "y"),
+			label_set(time() > 1500, "job", "a", "instance", "z"),
+			label_set(1, "job", "b", "instance", "x"),
+			label_set(2, "job", "b", "instance", "y"),
+		)) by (job)`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("job"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("version"),
+				Value: []byte("1"),
+			},
+		}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, nan, 1, nan, nan},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("job"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("version"),
+				Value: []byte("1600"),
+			},
+		}
+		r3 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, nan, nan, 1, nan},
+			Timestamps: timestampsExpected,
+		}
+		r3.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("job"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("version"),
+				Value: []byte("1800"),
+			},
+		}
+		r4 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{nan, nan, nan, nan, nan, 1},
+			Timestamps: timestampsExpected,
+		}
+		r4.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("job"),
+				Value: []byte("a"),
+			},
+			{
+				Key:   []byte("version"),
+				Value: []byte("2000"),
+			},
+		}
+		r5 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r5.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("job"),
+				Value: []byte("b"),
+			},
+			{
+				Key:   []byte("version"),
+				Value: []byte("1"),
+			},
+		}
+		r6 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r6.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("job"),
+				Value: []byte("b"),
+			},
+			{
+				Key:   []byte("version"),
+				Value: []byte("2"),
+			},
+		}
+		resultExpected := []netstorage.Result{r1, r2, r3, r4, r5, r6}
+		f(q, resultExpected)
+	})
+	t.Run(`count_values without (instance)`, func(t *testing.T) {
+		t.Parallel()
+		// NaN values must be excluded.
+		q := `count_values("instance", (
+			label_set(1, "job", "a", "instance", "x"),
+			label_set(1, "job", "b", "instance", "y"),
+			label_set(1, "job", "b", "instance", "z"),
+			label_set(NaN, "job", "b", "instance", "w"),
+		)) without (instance)`
+		r1 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{1, 1, 1, 1, 1, 1},
+			Timestamps: timestampsExpected,
+		}
+		r1.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("instance"),
+				Value: []byte("1"),
+			},
+			{
+				Key:   []byte("job"),
+				Value: []byte("a"),
+			},
+		}
+		r2 := netstorage.Result{
+			MetricName: metricNameExpected,
+			Values:     []float64{2, 2, 2, 2, 2, 2},
+			Timestamps: timestampsExpected,
+		}
+		r2.MetricName.Tags = []storage.Tag{
+			{
+				Key:   []byte("instance"),
+				Value: []byte("1"),
+			},
+			{
+				Key:   []byte("job"),
+				Value: []byte("b"),
+			},
+		}
+		resultExpected := []netstorage.Result{r1, r2}
+		f(q, resultExpected)
+	})
+}
+
+func TestExecWithQueryTracer(t *testing.T) {
+	qt := querytracer.New(true, "test")
+	ec := &EvalConfig{
+		Start:       1000e3,
+		End:         2000e3,
+		Step:        200e3,
+		Deadline:    netstorage.NewDeadline(time.Minute),
+		QueryTracer: qt,
+	}
+	q := `sum(rate(time()[100s:]))`
+	if _, err := Exec(ec, q); err != nil {
+		t.Fatalf("unexpected error when executing %q: %s", q, err)
+	}
+	qt.Donef("done")
+	trace := qt.ToJSON()
+	for _, s := range []string{
+		`parse query \"sum(rate(time()[100s:]))\": done`,
+		`eval: query=sum(rate(time()[100s:])), timeRange=[1000000..2200000], step=200000: series=1, points=7`,
+		`eval: query=rate(time()[100s:]), timeRange=[1000000..2200000], step=200000: series=1, points=7`,
+		`eval: query=time(), timeRange=`,
+	} {
+		if !strings.Contains(trace, s) {
+			t.Fatalf("missing %q in the trace %s", s, trace)
+		}
+	}
 }
 
 func TestExecError(t *testing.T) {
@@ -3507,6 +5274,13 @@ func TestExecError(t *testing.T) {
 	// Non-existing func
 	f(`nonexisting()`)
 
+	// `@` modifier must return a single series
+	f(`time()[:100s] @ (label_set(1000, "foo", "bar"), label_set(1000, "foo", "baz"))`)
+
+	// `@` modifier must contain finite timestamp
+	f(`time()[:100s] @ NaN`)
+	f(`time()[:100s] @ (end() * Inf)`)
+
 	// Invalid number of args
 	f(`range_quantile()`)
 	f(`range_quantile(1, 2, 3)`)
@@ -3514,6 +5288,9 @@ func TestExecError(t *testing.T) {
 	f(`abs()`)
 	f(`abs(1,2)`)
 	f(`absent(1, 2)`)
+	f(`clamp()`)
+	f(`clamp(1, 2)`)
+	f(`clamp(1, 2, 3, 4)`)
 	f(`clamp_max()`)
 	f(`clamp_min(1,2,3)`)
 	f(`hour(1,2)`)
@@ -3524,6 +5301,10 @@ func TestExecError(t *testing.T) {
 	f(`label_set(1, "foo")`)
 	f(`label_del()`)
 	f(`label_keep()`)
+	f(`drop_common_labels()`)
+	f(`drop_common_labels(1, 2)`)
+	f(`labels_equal()`)
+	f(`labels_equal(1, "foo")`)
 	f(`round()`)
 	f(`round(1,2,3)`)
 	f(`scalar()`)
@@ -3532,12 +5313,24 @@ func TestExecError(t *testing.T) {
 	f(`timestamp()`)
 	f(`vector()`)
 	f(`histogram_quantile()`)
+	f(`histogram_over_time()`)
+	f(`prometheus_buckets()`)
+	f(`prometheus_buckets(1, 2)`)
+	f(`sort_by_label()`)
+	f(`sort_by_label(1)`)
+	f(`sort_by_label_desc(1, 2)`)
+	f(`sort_by_label_numeric(1, time())`)
+	f(`histogram_over_time(0.5)`)
 	f(`sum()`)
 	f(`count_values()`)
 	f(`quantile()`)
 	f(`topk()`)
 	f(`limitk()`)
 	f(`bottomk()`)
+	f(`topk_avg()`)
+	f(`topk_max(1)`)
+	f(`bottomk_min(1, 2, 3, 4)`)
+	f(`topk_min(1, time(), 3)`)
 	f(`time(123)`)
 	f(`start(1)`)
 	f(`end(1)`)
@@ -3563,6 +5356,9 @@ func TestExecError(t *testing.T) {
 	f(`median()`)
 	f(`median("foo", "bar")`)
 	f(`keep_last_value()`)
+	f(`keep_last_value(1, 2, 3)`)
+	f(`keep_next_value()`)
+	f(`keep_next_value(1, 2, 3)`)
 	f(`distinct_over_time()`)
 	f(`distinct()`)
 	f(`alias()`)
@@ -3575,6 +5371,8 @@ func TestExecError(t *testing.T) {
 	f(`count_values(1, 2)`)
 	f(`count_values(1 or label_set(2, "xx", "yy"), 2)`)
 	f(`quantile(1 or label_set(2, "xx", "foo"), 1)`)
+	f(`clamp(1, 1 or label_set(2, "xx", "foo"), 2)`)
+	f(`clamp(1, 1, 1 or label_set(2, "xx", "foo"))`)
 	f(`clamp_max(1, 1 or label_set(2, "xx", "foo"))`)
 	f(`clamp_min(1, 1 or label_set(2, "xx", "foo"))`)
 	f(`topk(label_set(2, "xx", "foo") or 1, 12)`)
@@ -3589,6 +5387,7 @@ func TestExecError(t *testing.T) {
 	f(`label_move(1, 2, 3)`)
 	f(`label_move(1, "foo", 3)`)
 	f(`label_keep(1, 2)`)
+	f(`labels_equal(1, "foo", 2)`)
 	f(`label_join(1, 2, 3)`)
 	f(`label_join(1, "foo", 2)`)
 	f(`label_join(1, "foo", "bar", 2)`)
@@ -3613,6 +5412,13 @@ func TestExecError(t *testing.T) {
 	f(`1 + on() group_left() (label_set(1, "foo", bar"), label_set(2, "foo", "baz"))`)
 	f(`1 + on(a) group_left(b) (label_set(1, "foo", bar"), label_set(2, "foo", "baz"))`)
 	f(`label_set(1, "foo", "bar") + on(foo) group_left() (label_set(1, "foo", "bar", "a", "b"), label_set(1, "foo", "bar", "a", "c"))`)
+
+	// Labels copied from the "one" side result in duplicate series on the "many" side.
+	f(`(label_set(1, "instance", "a", "role", "x"), label_set(2, "instance", "a", "role", "y")) * on(instance) group_left(role) label_set(1, "instance", "a", "role", "z")`)
+	f(`label_set(1, "instance", "a", "role", "z") * on(instance) group_right(role) (label_set(1, "instance", "a", "role", "x"), label_set(2, "instance", "a", "role", "y"))`)
+
+	// Duplicate series on the "one" side.
+	f(`label_set(time(), "instance", "a") * on(instance) group_left(role) (label_set(1, "instance", "a", "role", "x"), label_set(2, "instance", "a", "role", "y"))`)
 	f(`(label_set(1, "foo", bar"), label_set(2, "foo", "baz")) + group_right 1`)
 	f(`(label_set(1, "foo", bar"), label_set(2, "foo", "baz")) + on() group_right 1`)
 	f(`(label_set(1, "foo", bar"), label_set(2, "foo", "baz")) + on(a) group_right(b,c) 1`)
@@ -3660,3 +5466,32 @@ func testMetricNamesEqual(t *testing.T, mn, mnExpected *storage.MetricName) {
 		}
 	}
 }
+
+func TestValidateMaxPointsPerTimeseries(t *testing.T) {
+	f := func(start, end, step int64, isErrorExpected bool) {
+		t.Helper()
+		err := ValidateMaxPointsPerTimeseries(start, end, step)
+		if isErrorExpected != (err != nil) {
+			t.Fatalf("unexpected error for start=%d, end=%d, step=%d: %v", start, end, step, err)
+		}
+		if err == nil {
+			return
+		}
+		minStep := getMinStep(start, end)
+		if err := ValidateMaxPointsPerTimeseries(start, end, minStep); err != nil {
+			t.Fatalf("unexpected error for the suggested step=%d: %s", minStep, err)
+		}
+		if !strings.Contains(err.Error(), "increase step") {
+			t.Fatalf("missing suggestion for increasing step in the error: %s", err)
+		}
+	}
+
+	points := int64(*maxPointsPerTimeseries)
+	f(0, 0, 1e3, false)
+	f(0, (points-1)*1e3, 1e3, false)
+	f(0, points*1e3, 1e3, true)
+	f(0, 30*24*3600*1e3, 1, true)
+	f(0, 30*24*3600*1e3, 15e3, true)
+	f(0, 30*24*3600*1e3, 5*60e3, false)
+	f(123, 1e9+456, 1e3, true)
+}
@@ -82,7 +82,7 @@ again:
 		}
 		lex.sTail = s[n+1:]
 		goto again
-	case '{', '}', '[', ']', '(', ')', ',':
+	case '{', '}', '[', ']', '(', ')', ',', '@':
 		token = s[:1]
 		goto tokenFoundLabel
 	}
@@ -338,6 +338,10 @@ func isOffset(s string) bool {
 	return s == "offset"
 }
 
+func isAt(s string) bool {
+	return s == "@"
+}
+
 func isStringPrefix(s string) bool {
 	if len(s) == 0 {
 		return false
@@ -2,6 +2,7 @@ package promql
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,6 +24,7 @@ func getDefaultWithArgExprs() []*withArgExpr {
 			)`,
 
 			`median_over_time(m) = quantile_over_time(0.5, m)`,
+			`histogram_over_time(phi, buckets) = histogram_quantile(phi, sum(rate(buckets)) by (le, vmrange))`,
 			`range_median(q) = range_quantile(0.5, q)`,
 			`alias(q, name) = label_set(q, "__name__", name)`,
 		})
@@ -57,6 +59,19 @@ func checkDuplicateWithArgNames(was []*withArgExpr) error {
 	return nil
 }
 
+// checkForwardReferences verifies that the definitions from was
+// don't call the templates defined after them.
+func checkForwardReferences(was []*withArgExpr) error {
+	for i, wa := range was {
+		for _, waNext := range was[i+1:] {
+			if hasFuncCall(wa.Expr, waNext.Name) {
+				return fmt.Errorf("undefined WITH template %q in the definition of %q; templates may refer only to the previously defined templates", waNext.Name, wa.Name)
+			}
+		}
+	}
+	return nil
+}
+
 func mustParseWithArgExpr(s string) *withArgExpr {
 	var p parser
 	p.lex.Init(s)
@@ -89,13 +104,59 @@ func parsePromQL(s string) (expr, error) {
 	}
 	e = removeParensExpr(e)
 	e = simplifyConstants(e)
+	if err := checkAtModifiers(e); err != nil {
+		return nil, err
+	}
 	return e, nil
 }
 
+// checkAtModifiers verifies that constant `@` modifiers in e contain finite timestamps.
+//
+// It must be called after simplifyConstants, so constant expressions in `@` modifiers are already calculated.
+func checkAtModifiers(e expr) error {
+	switch t := e.(type) {
+	case *binaryOpExpr:
+		if err := checkAtModifiers(t.Left); err != nil {
+			return err
+		}
+		return checkAtModifiers(t.Right)
+	case *funcExpr:
+		return checkAtModifiersInArgs(t.Args)
+	case *aggrFuncExpr:
+		return checkAtModifiersInArgs(t.Args)
+	case *parensExpr:
+		return checkAtModifiersInArgs(*t)
+	case *rollupExpr:
+		if ne, ok := t.At.(*numberExpr); ok && (math.IsNaN(ne.N) || math.IsInf(ne.N, 0)) {
+			return fmt.Errorf("`@` modifier must contain finite timestamp; got %g in %q", ne.N, t.AppendString(nil))
+		}
+		if t.At != nil {
+			if err := checkAtModifiers(t.At); err != nil {
+				return err
+			}
+		}
+		return checkAtModifiers(t.Expr)
+	default:
+		return nil
+	}
+}
+
+func checkAtModifiersInArgs(args []expr) error {
+	for _, arg := range args {
+		if err := checkAtModifiers(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // removeParensExpr removes parensExpr for (expr) case.
 func removeParensExpr(e expr) expr {
 	if re, ok := e.(*rollupExpr); ok {
 		re.Expr = removeParensExpr(re.Expr)
+		if re.At != nil {
+			re.At = removeParensExpr(re.At)
+		}
 		return re
 	}
 	if be, ok := e.(*binaryOpExpr); ok {
@@ -132,6 +193,9 @@ func removeParensExpr(e expr) expr {
 func simplifyConstants(e expr) expr {
 	if re, ok := e.(*rollupExpr); ok {
 		re.Expr = simplifyConstants(re.Expr)
+		if re.At != nil {
+			re.At = simplifyConstants(re.At)
+		}
 		return re
 	}
 	if ae, ok := e.(*aggrFuncExpr); ok {
@@ -232,6 +296,9 @@ end:
 	if err := checkDuplicateWithArgNames(we.Was); err != nil {
 		return nil, err
 	}
+	if err := checkForwardReferences(we.Was); err != nil {
+		return nil, err
+	}
 	if err := p.lex.Next(); err != nil {
 		return nil, err
 	}
@@ -281,10 +348,51 @@ func (p *parser) parseWithArgExpr() (*withArgExpr, error) {
 	if err != nil {
 		return nil, fmt.Errorf(`withArgExpr: cannot parse %q: %s`, wa.Name, err)
 	}
+	if hasFuncCall(e, wa.Name) {
+		return nil, fmt.Errorf(`withArgExpr: recursive call of %q isn't allowed in its definition`, wa.Name)
+	}
 	wa.Expr = e
 	return &wa, nil
 }
 
+// hasFuncCall returns true if e contains a call of func with the given name.
+func hasFuncCall(e expr, name string) bool {
+	switch t := e.(type) {
+	case *binaryOpExpr:
+		return hasFuncCall(t.Left, name) || hasFuncCall(t.Right, name)
+	case *funcExpr:
+		return t.Name == name || hasFuncCallInArgs(t.Args, name)
+	case *aggrFuncExpr:
+		return hasFuncCallInArgs(t.Args, name)
+	case *parensExpr:
+		return hasFuncCallInArgs(*t, name)
+	case *rollupExpr:
+		return hasFuncCall(t.Expr, name) || t.At != nil && hasFuncCall(t.At, name)
+	case *withExpr:
+		for _, wa := range t.Was {
+			if wa.Name == name {
+				// The name is overridden by the nested WITH template.
+				return false
+			}
+			if hasFuncCall(wa.Expr, name) {
+				return true
+			}
+		}
+		return hasFuncCall(t.Expr, name)
+	default:
+		return false
+	}
+}
+
+func hasFuncCallInArgs(args []expr, name string) bool {
+	for _, arg := range args {
+		if hasFuncCall(arg, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // parseExpr parses promql expr
 func (p *parser) parseExpr() (expr, error) {
 	e, err := p.parseSingleExpr()
@@ -365,7 +473,7 @@ func (p *parser) parseSingleExpr() (expr, error) {
 	if err != nil {
 		return nil, err
 	}
-	if p.lex.Token != "[" && !isOffset(p.lex.Token) {
+	if p.lex.Token != "[" && !isOffset(p.lex.Token) && !isAt(p.lex.Token) {
 		// There is no rollup expression.
 		return e, nil
 	}
@@ -682,6 +790,13 @@ func expandWithExpr(was []*withArgExpr, e expr) (expr, error) {
 		}
 		re := *t
 		re.Expr = eNew
+		if t.At != nil {
+			atNew, err := expandWithExpr(was, t.At)
+			if err != nil {
+				return nil, err
+			}
+			re.At = atNew
+		}
 		return &re, nil
 	case *withExpr:
 		wasNew := make([]*withArgExpr, 0, len(was)+len(t.Was))
@@ -1203,6 +1318,20 @@ func (p *parser) parseOffset() (string, error) {
 	return d, nil
 }
 
+func (p *parser) parseAt() (expr, error) {
+	if !isAt(p.lex.Token) {
+		return nil, fmt.Errorf(`at: unexpected token %q; want "@"`, p.lex.Token)
+	}
+	if err := p.lex.Next(); err != nil {
+		return nil, err
+	}
+	e, err := p.parseSingleExprWithoutRollupSuffix()
+	if err != nil {
+		return nil, fmt.Errorf("at: %s", err)
+	}
+	return e, nil
+}
+
 func (p *parser) parseDuration() (string, error) {
 	if !isDuration(p.lex.Token) {
 		return "", fmt.Errorf(`duration: unexpected token %q; want "duration"`, p.lex.Token)
@@ -1221,7 +1350,7 @@ func (p *parser) parseIdentExpr() (expr, error) {
 	if err := p.lex.Next(); err != nil {
 		return nil, err
 	}
-	if isEOF(p.lex.Token) || isOffset(p.lex.Token) {
+	if isEOF(p.lex.Token) || isOffset(p.lex.Token) || isAt(p.lex.Token) {
 		p.lex.Prev()
 		return p.parseMetricExpr()
 	}
@@ -1261,7 +1390,7 @@ func IsMetricSelectorWithRollup(s string) (childQuery string, window, offset str
 		return
 	}
 	re, ok := expr.(*rollupExpr)
-	if !ok || len(re.Window) == 0 || len(re.Step) > 0 {
+	if !ok || len(re.Window) == 0 || len(re.Step) > 0 || re.At != nil {
 		return
 	}
 	me, ok := re.Expr.(*metricExpr)
@@ -1289,6 +1418,43 @@ func ParseMetricSelector(s string) ([]storage.TagFilter, error) {
 	return me.TagFilters, nil
 }
 
+// ExtractMetricSelectors returns TagFilters for all the metric selectors
+// found in PromQL query s.
+func ExtractMetricSelectors(s string) ([][]storage.TagFilter, error) {
+	e, err := parsePromQLWithCache(s)
+	if err != nil {
+		return nil, err
+	}
+	return appendMetricSelectors(nil, e), nil
+}
+
+func appendMetricSelectors(dst [][]storage.TagFilter, e expr) [][]storage.TagFilter {
+	switch t := e.(type) {
+	case *metricExpr:
+		if len(t.TagFilters) > 0 {
+			dst = append(dst, t.TagFilters)
+		}
+	case *rollupExpr:
+		dst = appendMetricSelectors(dst, t.Expr)
+	case *funcExpr:
+		for _, arg := range t.Args {
+			dst = appendMetricSelectors(dst, arg)
+		}
+	case *aggrFuncExpr:
+		for _, arg := range t.Args {
+			dst = appendMetricSelectors(dst, arg)
+		}
+	case *binaryOpExpr:
+		dst = appendMetricSelectors(dst, t.Left)
+		dst = appendMetricSelectors(dst, t.Right)
+	case parensExpr:
+		for _, arg := range t {
+			dst = appendMetricSelectors(dst, arg)
+		}
+	}
+	return dst
+}
+
 func (p *parser) parseMetricExpr() (*metricExpr, error) {
 	var me metricExpr
 	if isIdentPrefix(p.lex.Token) {
@@ -1323,16 +1489,26 @@ func (p *parser) parseRollupExpr(arg expr) (expr, error) {
 		re.Window = window
 		re.Step = step
 		re.InheritStep = inheritStep
-		if !isOffset(p.lex.Token) {
+	}
+	// `offset` and `@` modifiers may go in any order.
+	for {
+		switch {
+		case isOffset(p.lex.Token) && len(re.Offset) == 0:
+			offset, err := p.parseOffset()
+			if err != nil {
+				return nil, err
+			}
+			re.Offset = offset
+		case isAt(p.lex.Token) && re.At == nil:
+			at, err := p.parseAt()
+			if err != nil {
+				return nil, err
+			}
+			re.At = at
+		default:
 			return &re, nil
 		}
 	}
-	offset, err := p.parseOffset()
-	if err != nil {
-		return nil, err
-	}
-	re.Offset = offset
-	return &re, nil
 }
 
 type expr interface {
@@ -1526,6 +1702,12 @@ type rollupExpr struct {
 	// For example, `foobar{baz="aa"} offset 5m` will have Offset value `5m`.
 	Offset string
 
+	// At contains optional expression from `@` part.
+	//
+	// It pins the evaluation time for Expr to the given unix timestamp in seconds for all the points.
+	// For example, `foobar @ end()` will have At value `end()`.
+	At expr
+
 	// Step contains optional step value from square brackets.
 	//
 	// For example, `foobar[1h:3m]` will have Step value '3m'.
@@ -1573,6 +1755,17 @@ func (re *rollupExpr) AppendString(dst []byte) []byte {
 		dst = append(dst, " offset "...)
 		dst = append(dst, re.Offset...)
 	}
+	if re.At != nil {
+		dst = append(dst, " @ "...)
+		_, needParens := re.At.(*binaryOpExpr)
+		if needParens {
+			dst = append(dst, '(')
+		}
+		dst = re.At.AppendString(dst)
+		if needParens {
+			dst = append(dst, ')')
+		}
+	}
 	return dst
 }
 
@@ -1,6 +1,7 @@
 package promql
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -48,6 +49,37 @@ func TestParseMetricSelectorError(t *testing.T) {
 	f(`foo offset 5m`)
 }
 
+func TestExtractMetricSelectors(t *testing.T) {
+	f := func(s string, selectorsExpected []string) {
+		t.Helper()
+		tfss, err := ExtractMetricSelectors(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		var selectors []string
+		for _, tfs := range tfss {
+			me := &metricExpr{
+				TagFilters: tfs,
+			}
+			selectors = append(selectors, string(me.AppendString(nil)))
+		}
+		if !reflect.DeepEqual(selectors, selectorsExpected) {
+			t.Fatalf("unexpected selectors for %q; got %q; want %q", s, selectors, selectorsExpected)
+		}
+	}
+	f(`1+time()`, nil)
+	f(`foo`, []string{`foo`})
+	f(`rate(foo{bar="baz"}[5m]) offset 1h`, []string{`foo{bar="baz"}`})
+	f(`sum(rate(foo[5m])) by (x) / ignoring(y) (bar{a=~"b.+"} + 2)`, []string{`foo`, `bar{a=~"b.+"}`})
+	f(`max_over_time((foo or {x="y"})[1h:5m])`, []string{`foo`, `{x="y"}`})
+	f(`WITH (f(x) = x{a="b"}) f(foo)`, []string{`foo{a="b"}`})
+
+	// Invalid query
+	if _, err := ExtractMetricSelectors(`foo(`); err == nil {
+		t.Fatalf("expecting non-nil error for invalid query")
+	}
+}
+
 func TestParsePromQLSuccess(t *testing.T) {
 	another := func(s string, sExpected string) {
 		t.Helper()
@@ -105,6 +137,21 @@ func TestParsePromQLSuccess(t *testing.T) {
 	same(`metric{foo="bar"}[2d] offset 10h`)
 	same(`metric{foo="bar", b="sdfsdf"}[2d:3h] offset 10h`)
 	another(`  metric  {  foo  = "bar"  }  [  2d ]   offset   10h  `, `metric{foo="bar"}[2d] offset 10h`)
+	same(`metric @ 123`)
+	another(`metric @ 1609455600`, `metric @ 1.6094556e+09`)
+	same(`metric @ start()`)
+	same(`metric @ end()`)
+	same(`metric[5m] @ 123.5`)
+	same(`metric{foo="bar"}[5m:3s] @ end()`)
+	same(`metric offset 5m @ 123`)
+	another(`metric @ 123 offset 5m`, `metric offset 5m @ 123`)
+	another(`metric[5m]@end()offset 1h`, `metric[5m] offset 1h @ end()`)
+	same(`metric @ (end() - 3600)`)
+	another(`metric @ (4000 - 3600)`, `metric @ 400`)
+	same(`rate(metric[5m] @ end())`)
+	same(`rate(metric[5m] offset 1h @ start())`)
+	same(`(a + b)[5m:] @ 123`)
+	another(`with (t = end()) metric @ t`, `metric @ end()`)
 	// metric name matching keywords
 	same("rate")
 	same("RATE")
@@ -317,10 +364,9 @@ func TestParsePromQLSuccess(t *testing.T) {
 	// override ttf to ru
 	another(`with (ttf = ru(m, n)) ttf`, `(clamp_min(n - clamp_min(m, 0), 0) / clamp_min(n, 0)) * 100`)
 
-	// Verify withExpr recursion and forward reference
+	// Verify withExpr recursion and forward reference.
+	// Metric names, which match the template names, are left as is.
 	another(`with (x = x+y, y = x+x) y ^ 2`, `((x + y) + (x + y)) ^ 2`)
-	another(`with (f1(x)=f2(x), f2(x)=f1(x)^2) f1(foobar)`, `f2(foobar)`)
-	another(`with (f1(x)=f2(x), f2(x)=f1(x)^2) f2(foobar)`, `f2(foobar) ^ 2`)
 
 	// Verify withExpr funcs
 	another(`with (x() = y+1) x`, `y + 1`)
@@ -329,7 +375,6 @@ func TestParsePromQLSuccess(t *testing.T) {
 	another(`with (x(a, b) = a + b) x(foo, x(1, 2))`, `foo + 3`)
 	another(`with (x(a) = sum(a) by (b)) x(xx) / x(y)`, `sum(xx) by (b) / sum(y) by (b)`)
 	another(`with (f(a,f,x)=ff(x,f,a)) f(f(x,y,z),1,2)`, `ff(2, 1, ff(z, y, x))`)
-	another(`with (f(x)=1+f(x)) f(foo{bar="baz"})`, `1 + f(foo{bar="baz"})`)
 	another(`with (a=foo, y=bar, f(a)= a+a+y) f(x)`, `(x + x) + bar`)
 	another(`with (f(a, b) = m{a, b}) f({a="x", b="y"}, {c="d"})`, `m{a="x", b="y", c="d"}`)
 	another(`with (xx={a="x"}, f(a, b) = m{a, b}) f({xx, b="y"}, {c="d"})`, `m{a="x", b="y", c="d"}`)
@@ -355,6 +400,11 @@ func TestParsePromQLSuccess(t *testing.T) {
 	another(`with (f(x,y) = a + on (x,y) group_left (y,bar) b) f((foo),())`, `a + on (foo) group_left (bar) b`)
 	another(`with (f(x,y) = a + on (x,y) group_left (y,bar) b) f((foo,xx),())`, `a + on (foo, xx) group_left (bar) b`)
 
+	// Verify templates referring to the previously defined templates
+	another(`WITH (cpu = rate(node_cpu_seconds_total[5m])) sum(cpu) by (instance)`, `sum(rate(node_cpu_seconds_total[5m])) by (instance)`)
+	another(`WITH (f(x) = x / on() group_left() scalar(up)) f(foo)`, `foo / on () group_left () scalar(up)`)
+	another(`with (x = m, y = x + n, f(a) = a * y, g(b) = f(b) - 1) g(z)`, `(z * (m + n)) - 1`)
+
 	// Verify nested with exprs
 	another(`with (f(x) = (with(x=y) x) + x) f(z)`, `y + z`)
 	another(`with (x=foo) f(a, with (y=x) y)`, `f(a, foo)`)
@@ -367,9 +417,9 @@ func TestParsePromQLSuccess(t *testing.T) {
 			with (
 				z(y) = x + y * q
 			)
-			z(foo) / f(x)
+			z(foo) / abs(x)
 	)
-	f(a)`, `(a + (foo * m{foo="bar", y="1"})) / f(a)`)
+	f(a)`, `(a + (foo * m{foo="bar", y="1"})) / abs(a)`)
 
 	// complex withExpr
 	another(`WITH (
@@ -430,6 +480,19 @@ func TestParsePromQLError(t *testing.T) {
 	// invalid metricExpr
 	f(`{__name__="ff"} offset 55`)
 	f(`{__name__="ff"} offset -5m`)
+	f(`foo @`)
+	f(`foo @ @ 123`)
+	f(`foo @ 123 @ 456`)
+	f(`foo offset 5m offset 10m`)
+	f(`foo @ bar offset`)
+	f(`foo[5m] @`)
+	f(`foo @ NaN`)
+	f(`foo @ Inf`)
+	f(`foo @ -Inf`)
+	f(`foo[5m] @ (Inf - Inf)`)
+	f(`rate(foo[5m] @ NaN)`)
+	f(`sum(foo @ (1 unless 2))`)
+	f(`1 + (foo[5m:1m] @ NaN)`)
 	f(`foo[55]`)
 	f(`m[-5m]`)
 	f(`{`)
@@ -687,4 +750,13 @@ func TestParsePromQLError(t *testing.T) {
 	f(`with (f(x) = sum(m) by (x)) f((xx(), {foo="bar"}))`)
 	f(`with (f(x) = m + on (x) n) f(xx())`)
 	f(`with (f(x) = m + on (a) group_right (x) n) f(xx())`)
+
+	// recursive and undefined templates
+	f(`with (f(x) = f(x)) f(1)`)
+	f(`with (f(x)=1+f(x)) f(foo{bar="baz"})`)
+	f(`with (f(x) = rate(f(x)[5m])) f(m)`)
+	f(`with (f() = sum(f())) f()`)
+	f(`with (f(x) = g(x), g(x) = x) f(1)`)
+	f(`with (f1(x)=f2(x), f2(x)=f1(x)^2) f1(foobar)`)
+	f(`with (f1(x)=f2(x), f2(x)=f1(x)^2) f2(foobar)`)
 }
@@ -0,0 +1,111 @@
+package promql
+
+import (
+	"flag"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxMemoryPerQuery = flag.Int("search.maxMemoryPerQuery", 0, "The maximum approximate memory in bytes a single query may allocate for time series and data points during its evaluation. "+
+	"Queries exceeding the limit are rejected. Zero means no limit. The total memory used by concurrent queries doesn't exceed "+
+	"-search.maxMemoryPerQuery * -search.maxConcurrentRequests")
+
+// timeseriesOverheadBytes is the approximate number of bytes occupied by a single time series without data points.
+const timeseriesOverheadBytes = 256
+
+// queryMemoryLimiter limits the total memory reserved by concurrently executed queries.
+//
+// It is initialized by InitQueryMemoryLimiter.
+var queryMemoryLimiter memoryLimiter
+
+// InitQueryMemoryLimiter limits the total memory reserved by concurrent queries to -search.maxMemoryPerQuery * maxConcurrentQueries.
+//
+// It must be called before executing queries.
+func InitQueryMemoryLimiter(maxConcurrentQueries int) {
+	if *maxMemoryPerQuery <= 0 || maxConcurrentQueries <= 0 {
+		return
+	}
+	queryMemoryLimiter.MaxSize = uint64(*maxMemoryPerQuery) * uint64(maxConcurrentQueries)
+}
+
+// queryMemoryTracker tracks the approximate memory allocated during a single query evaluation.
+//
+// nil tracker doesn't limit memory usage.
+type queryMemoryTracker struct {
+	maxSize uint64
+	usage   uint64
+
+	// ml limits the total memory used by concurrent queries. It may be nil.
+	ml *memoryLimiter
+
+	// mlUsage is the memory reserved at ml. It is returned to ml by release.
+	mlUsage uint64
+}
+
+// newQueryMemoryTracker returns new tracker for -search.maxMemoryPerQuery.
+//
+// nil is returned if -search.maxMemoryPerQuery isn't set.
+func newQueryMemoryTracker() *queryMemoryTracker {
+	if *maxMemoryPerQuery <= 0 {
+		return nil
+	}
+	qmt := &queryMemoryTracker{
+		maxSize: uint64(*maxMemoryPerQuery),
+	}
+	if queryMemoryLimiter.MaxSize > 0 {
+		qmt.ml = &queryMemoryLimiter
+	}
+	return qmt
+}
+
+// reserve registers memory required for the given number of series with the given number of points per series.
+//
+// An error is returned if the query exceeds -search.maxMemoryPerQuery.
+func (qmt *queryMemoryTracker) reserve(series, pointsPerSeries int64) error {
+	if qmt == nil {
+		return nil
+	}
+	n := uint64(mulNoOverflow(series, timeseriesOverheadBytes+mulNoOverflow(pointsPerSeries, 16)))
+	usage := atomic.AddUint64(&qmt.usage, n)
+	if usage < n || usage > qmt.maxSize {
+		queryMemoryLimitExceeded.Inc()
+		return fmt.Errorf("the query requires more than -search.maxMemoryPerQuery=%d bytes for processing %d time series with %d points in each time series; "+
+			"possible solutions are: reducing the number of matching time series; increasing `step` query arg; reducing the time range for the query; "+
+			"increasing -search.maxMemoryPerQuery", qmt.maxSize, series, pointsPerSeries)
+	}
+	if qmt.ml == nil {
+		return nil
+	}
+	if !qmt.ml.Get(n) {
+		queryMemoryLimitExceeded.Inc()
+		return fmt.Errorf("not enough memory for processing %d time series with %d points in each time series; "+
+			"total available memory for concurrent queries: %d bytes; possible solutions are: reducing the number of concurrent queries; "+
+			"reducing the number of matching time series; increasing `step` query arg; reducing the time range for the query",
+			series, pointsPerSeries, qmt.ml.MaxSize)
+	}
+	atomic.AddUint64(&qmt.mlUsage, n)
+	return nil
+}
+
+// reserveTimeseries registers memory required for tss.
+func (qmt *queryMemoryTracker) reserveTimeseries(tss []*timeseries) error {
+	if qmt == nil || len(tss) == 0 {
+		return nil
+	}
+	return qmt.reserve(int64(len(tss)), int64(len(tss[0].Values)))
+}
+
+// release returns the memory reserved by qmt to the limiter for concurrent queries.
+//
+// It must be called when the query is finished.
+func (qmt *queryMemoryTracker) release() {
+	if qmt == nil || qmt.ml == nil {
+		return
+	}
+	n := atomic.SwapUint64(&qmt.mlUsage, 0)
+	qmt.ml.Put(n)
+}
+
+var queryMemoryLimitExceeded = metrics.NewCounter(`vm_memory_per_query_limit_exceeded_total`)
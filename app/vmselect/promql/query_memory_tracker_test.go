@@ -0,0 +1,174 @@
+package promql
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/netstorage"
+)
+
+func TestQueryMemoryTracker(t *testing.T) {
+	var qmtNil *queryMemoryTracker
+	if err := qmtNil.reserve(math.MaxInt64, math.MaxInt64); err != nil {
+		t.Fatalf("unexpected error for nil tracker: %s", err)
+	}
+
+	qmt := &queryMemoryTracker{
+		maxSize: 10000,
+	}
+	if err := qmt.reserve(2, 100); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if usageExpected := uint64(2 * (timeseriesOverheadBytes + 100*16)); qmt.usage != usageExpected {
+		t.Fatalf("unexpected usage; got %d; want %d", qmt.usage, usageExpected)
+	}
+	if err := qmt.reserve(10, 100); err == nil {
+		t.Fatalf("expecting non-nil error when exceeding the limit")
+	}
+
+	// Overflow must result in error instead of panic.
+	qmt = &queryMemoryTracker{
+		maxSize: math.MaxUint64,
+	}
+	if err := qmt.reserve(math.MaxInt64, math.MaxInt64); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := qmt.reserve(math.MaxInt64, math.MaxInt64); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := qmt.reserve(math.MaxInt64, math.MaxInt64); err == nil {
+		t.Fatalf("expecting non-nil error on usage overflow")
+	}
+}
+
+func TestQueryMemoryTrackerRelease(t *testing.T) {
+	ml := &memoryLimiter{
+		MaxSize: 10000,
+	}
+	newTracker := func() *queryMemoryTracker {
+		return &queryMemoryTracker{
+			maxSize: 8000,
+			ml:      ml,
+		}
+	}
+	qmt := newTracker()
+	if err := qmt.reserve(2, 100); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if usageExpected := uint64(2 * (timeseriesOverheadBytes + 100*16)); ml.usage != usageExpected {
+		t.Fatalf("unexpected limiter usage; got %d; want %d", ml.usage, usageExpected)
+	}
+
+	// The concurrent query must fail when the total limit is exceeded even if its own limit isn't reached.
+	qmtConcurrent := newTracker()
+	if err := qmtConcurrent.reserve(4, 100); err == nil {
+		t.Fatalf("expecting non-nil error when exceeding the total limit")
+	}
+	qmtConcurrent.release()
+
+	// The memory must be returned to the limiter after the query is finished.
+	qmt.release()
+	if ml.usage != 0 {
+		t.Fatalf("unexpected limiter usage after release; got %d; want 0", ml.usage)
+	}
+	qmt.release()
+	if ml.usage != 0 {
+		t.Fatalf("unexpected limiter usage after the second release; got %d; want 0", ml.usage)
+	}
+	qmt = newTracker()
+	if err := qmt.reserve(4, 100); err != nil {
+		t.Fatalf("unexpected error after releasing the memory: %s", err)
+	}
+	qmt.release()
+
+	var qmtNil *queryMemoryTracker
+	qmtNil.release()
+}
+
+func TestQueryMemoryTrackerReserveTimeseries(t *testing.T) {
+	f := func(q string, usageExpected uint64) {
+		t.Helper()
+		e, err := parsePromQL(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		ec := &EvalConfig{
+			Start:    1000e3,
+			End:      2000e3,
+			Step:     1e3,
+			Deadline: netstorage.NewDeadline(time.Minute),
+			memoryTracker: &queryMemoryTracker{
+				maxSize: math.MaxUint64,
+			},
+		}
+		if _, err := evalExpr(ec, e); err != nil {
+			t.Fatalf("cannot evaluate %q: %s", q, err)
+		}
+		if ec.memoryTracker.usage != usageExpected {
+			t.Fatalf("unexpected memory usage for %q; got %d; want %d", q, ec.memoryTracker.usage, usageExpected)
+		}
+	}
+	seriesSize := uint64(timeseriesOverheadBytes + 1001*16)
+
+	// Numbers aren't tracked, since they are cheap.
+	f(`1`, 0)
+
+	// Transform, aggregate and binary operation results are tracked.
+	f(`time()`, seriesSize)
+	f(`abs(time())`, 2*seriesSize)
+	f(`sum(time())`, 2*seriesSize)
+	f(`time() + time()`, 3*seriesSize)
+	f(`sum(time() * 2)`, 3*seriesSize)
+}
+
+func TestExecMaxMemoryPerQuery(t *testing.T) {
+	defer func(n int, maxSize uint64) {
+		*maxMemoryPerQuery = n
+		queryMemoryLimiter.MaxSize = maxSize
+	}(*maxMemoryPerQuery, queryMemoryLimiter.MaxSize)
+
+	f := func(maxMemory int, q string, isErrorExpected bool) {
+		t.Helper()
+		*maxMemoryPerQuery = maxMemory
+		ec := &EvalConfig{
+			Start:    1000e3,
+			End:      2000e3,
+			Step:     1e3,
+			Deadline: netstorage.NewDeadline(time.Minute),
+		}
+		// Execute the query multiple times in order to verify the memory usage isn't accumulated between queries.
+		queryMemoryLimiter.MaxSize = uint64(maxMemory)
+		for i := 0; i < 3; i++ {
+			result, err := Exec(ec, q)
+			if queryMemoryLimiter.usage != 0 {
+				t.Fatalf("the memory reserved by %q isn't released; usage=%d", q, queryMemoryLimiter.usage)
+			}
+			if !isErrorExpected {
+				if err != nil {
+					t.Fatalf("unexpected error when executing %q: %s", q, err)
+				}
+				continue
+			}
+			if err == nil {
+				t.Fatalf("expecting non-nil error when executing %q with -search.maxMemoryPerQuery=%d", q, maxMemory)
+			}
+			if !strings.Contains(err.Error(), "-search.maxMemoryPerQuery") {
+				t.Fatalf("unexpected error when executing %q: %s", q, err)
+			}
+			if result != nil {
+				t.Fatalf("expecting nil result on error; got %d series", len(result))
+			}
+		}
+	}
+
+	q := `count_over_time(time()[1h:1s])`
+	f(0, q, false)
+	f(1e6, q, false)
+	f(1e4, q, true)
+	f(1e5, `time()`, false)
+	f(1e5, `sum(time()) + sum(time())`, false)
+	f(1e5, `sum(time() + time()) + sum(time() + time())`, true)
+	f(3e4, `count_over_time(time()[1h:1s]) + max_over_time(time()[1h:1s])`, true)
+}
@@ -1,6 +1,7 @@
 package promql
 
 import (
+	"flag"
 	"fmt"
 	"math"
 	"sort"
@@ -9,9 +10,16 @@ import (
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
-	"github.com/valyala/histogram"
 )
 
+var maxStalenessInterval = flag.Duration("search.maxStalenessInterval", 0, "The maximum interval for staleness calculations. "+
+	"Series without samples during this interval are treated as absent. By default it is automatically calculated from the interval between samples. "+
+	"Prometheus staleness marks terminate series regardless of this flag")
+
+var setLookbackToStep = flag.Bool("search.setLookbackToStep", false, "Whether to limit the lookbehind window for series selectors without explicit range in square brackets to the query step. "+
+	"By default the lookbehind window is automatically calculated from the interval between samples and may reach 5 minutes for series with sparse samples. "+
+	"The step defaults to 1 minute for instant queries. Set step=5m query arg for Prometheus-like 5m lookbehind window. See also -search.maxStalenessInterval")
+
 var rollupFuncs = map[string]newRollupFunc{
 	"default_rollup": newRollupFuncOneArg(rollupDefault), // default rollup func
 
@@ -35,6 +43,8 @@ var rollupFuncs = map[string]newRollupFunc{
 	"quantile_over_time": newRollupQuantile,
 	"stddev_over_time":   newRollupFuncOneArg(rollupStddev),
 	"stdvar_over_time":   newRollupFuncOneArg(rollupStdvar),
+	"mad_over_time":      newRollupFuncOneArg(rollupMAD),
+	"absent_over_time":   newRollupFuncOneArg(rollupAbsent),
 
 	// Additional rollup funcs.
 	"first_over_time":    newRollupFuncOneArg(rollupFirst),
@@ -47,6 +57,7 @@ var rollupFuncs = map[string]newRollupFunc{
 	"rollup_deriv":       newRollupFuncOneArg(rollupFake),
 	"rollup_delta":       newRollupFuncOneArg(rollupFake),
 	"rollup_increase":    newRollupFuncOneArg(rollupFake), // + rollupFuncsRemoveCounterResets
+	"rollup_candlestick": newRollupFuncOneArg(rollupFake),
 }
 
 var rollupFuncsRemoveCounterResets = map[string]bool{
@@ -64,6 +75,7 @@ var rollupFuncsKeepMetricGroup = map[string]bool{
 	"max_over_time":      true,
 	"quantile_over_time": true,
 	"rollup":             true,
+	"rollup_candlestick": true,
 }
 
 func getRollupArgIdx(funcName string) int {
@@ -161,6 +173,11 @@ func (rc *rollupConfig) Do(dstValues []float64, values []float64, timestamps []i
 	window := rc.Window
 	if window <= 0 {
 		window = rc.Step
+		if *setLookbackToStep {
+			// Do not look for the previous sample beyond the step, so series
+			// without recent samples disappear from results like in Prometheus.
+			maxPrevInterval = rc.Step
+		}
 	}
 	if window < maxPrevInterval {
 		window = maxPrevInterval
@@ -205,6 +222,14 @@ func (rc *rollupConfig) Do(dstValues []float64, values []float64, timestamps []i
 }
 
 func getMaxPrevInterval(timestamps []int64) int64 {
+	d := getAutoMaxPrevInterval(timestamps)
+	if msi := maxStalenessInterval.Milliseconds(); msi > 0 && d > msi {
+		return msi
+	}
+	return d
+}
+
+func getAutoMaxPrevInterval(timestamps []int64) int64 {
 	if len(timestamps) < 2 {
 		return int64(maxSilenceInterval)
 	}
@@ -389,21 +414,75 @@ func newRollupQuantile(args []interface{}) (rollupFunc, error) {
 		// There is no need in handling NaNs here, since they must be cleanup up
 		// before calling rollup funcs.
 		values := rfa.values
-		if len(values) == 0 {
+		phi := phis[rfa.idx]
+		if len(values) == 0 || !(phi >= 0 && phi <= 1) {
 			return nan
 		}
-		hf := histogram.GetFast()
-		for _, v := range values {
-			hf.Update(v)
-		}
-		phi := phis[rfa.idx]
-		qv := hf.Quantile(phi)
-		histogram.PutFast(hf)
+		a := getFloat64s()
+		a.A = append(a.A[:0], values...)
+		sort.Float64s(a.A)
+		qv := quantileSorted(phi, a.A)
+		putFloat64s(a)
 		return qv
 	}
 	return rf, nil
 }
 
+func rollupMAD(rfa *rollupFuncArg) float64 {
+	// There is no need in handling NaNs here, since they must be cleanup up
+	// before calling rollup funcs.
+	values := rfa.values
+	if len(values) == 0 {
+		return nan
+	}
+	// Calculate the median of absolute deviations from the median in the same buffer.
+	a := getFloat64s()
+	a.A = append(a.A[:0], values...)
+	sort.Float64s(a.A)
+	median := quantileSorted(0.5, a.A)
+	for i, v := range a.A {
+		a.A[i] = math.Abs(v - median)
+	}
+	sort.Float64s(a.A)
+	mad := quantileSorted(0.5, a.A)
+	putFloat64s(a)
+	return mad
+}
+
+// quantileSorted returns phi-quantile for sorted values in a.
+//
+// The quantile is linearly interpolated between the closest values like Prometheus does.
+// phi must be in the range [0...1] and a mustn't be empty.
+func quantileSorted(phi float64, a []float64) float64 {
+	rank := phi * float64(len(a)-1)
+	lowerIdx := int(math.Floor(rank))
+	upperIdx := lowerIdx + 1
+	if upperIdx >= len(a) {
+		return a[len(a)-1]
+	}
+	weight := rank - float64(lowerIdx)
+	return a[lowerIdx]*(1-weight) + a[upperIdx]*weight
+}
+
+type float64s struct {
+	A []float64
+}
+
+func getFloat64s() *float64s {
+	v := float64sPool.Get()
+	if v == nil {
+		return &float64s{}
+	}
+	return v.(*float64s)
+}
+
+func putFloat64s(a *float64s) {
+	a.A = a.A[:0]
+	float64sPool.Put(a)
+}
+
+var float64sPool sync.Pool
+
 func rollupAvg(rfa *rollupFuncArg) float64 {
 	// Do not use `Rapid calculation methods` at https://en.wikipedia.org/wiki/Standard_deviation,
 	// since it is slower and has no significant benefits in precision.
@@ -477,6 +556,14 @@ func rollupCount(rfa *rollupFuncArg) float64 {
 	return float64(len(values))
 }
 
+func rollupAbsent(rfa *rollupFuncArg) float64 {
+	// The result is aggregated across all the matching time series by aggregateAbsentOverTime.
+	if len(rfa.values) == 0 {
+		return 1
+	}
+	return nan
+}
+
 func rollupStddev(rfa *rollupFuncArg) float64 {
 	stdvar := rollupStdvar(rfa)
 	return math.Sqrt(stdvar)
@@ -655,7 +742,32 @@ func rollupFirst(rfa *rollupFuncArg) float64 {
 	return values[0]
 }
 
-var rollupDefault = rollupFirst
+func rollupDefault(rfa *rollupFuncArg) float64 {
+	// Prometheus staleness marks aren't removed for default_rollup, so the series
+	// is treated as absent after the staleness mark.
+	// See https://prometheus.io/docs/prometheus/latest/querying/basics/#staleness
+	v := rollupFirst(rfa)
+	if decimal.IsStaleNaN(v) {
+		return nan
+	}
+	return v
+}
+
+func rollupTimestamp(rfa *rollupFuncArg) float64 {
+	// Return the timestamp for the sample selected by rollupDefault,
+	// so timestamp(q) returns the timestamp of the raw sample for q like Prometheus does.
+	if !math.IsNaN(rfa.prevValue) {
+		return float64(rfa.prevTimestamp) / 1e3
+	}
+
+	// Prometheus staleness marks aren't removed for timestamp, so the series
+	// is treated as absent after the staleness mark like in rollupDefault.
+	values := rfa.values
+	if len(values) == 0 || decimal.IsStaleNaN(values[0]) {
+		return nan
+	}
+	return float64(rfa.timestamps[0]) / 1e3
+}
 
 func rollupLast(rfa *rollupFuncArg) float64 {
 	// There is no need in handling NaNs here, since they must be cleanup up
@@ -667,6 +779,19 @@ func rollupLast(rfa *rollupFuncArg) float64 {
 	return values[len(values)-1]
 }
 
+func rollupOpen(rfa *rollupFuncArg) float64 {
+	// Do not take into account rfa.prevValue, since it belongs
+	// to the previous window.
+	//
+	// There is no need in handling NaNs here, since they must be cleanup up
+	// before calling rollup funcs.
+	values := rfa.values
+	if len(values) == 0 {
+		return nan
+	}
+	return values[0]
+}
+
 func rollupDistinct(rfa *rollupFuncArg) float64 {
 	// There is no need in handling NaNs here, since they must be cleanup up
 	// before calling rollup funcs.
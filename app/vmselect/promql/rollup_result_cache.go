@@ -4,22 +4,33 @@ import (
 	"crypto/rand"
 	"flag"
 	"fmt"
+	"math"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/memory"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/tenant"
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/VictoriaMetrics/metrics"
 )
 
-var disableCache = flag.Bool("search.disableCache", false, "Whether to disable response caching. This may be useful during data backfilling")
+var (
+	disableCache         = flag.Bool("search.disableCache", false, "Whether to disable response caching. This may be useful during data backfilling")
+	cacheTimestampOffset = flag.Duration("search.cacheTimestampOffset", 5*time.Minute, "The maximum duration since the current time for response data, "+
+		"which is always queried from the original raw data, without using the response cache. Increase this value if you see gaps in responses "+
+		"due to time synchronization issues between VictoriaMetrics and data sources")
+)
 
 var rollupResultCacheV = &rollupResultCache{
-	fastcache.New(1024 * 1024), // This is a cache for testing.
+	c:                    fastcache.New(1024 * 1024), // This is a cache for testing.
+	metainfoKeys:         make(map[string]struct{}),
+	metainfoKeysComplete: true,
 }
 var rollupResultCachePath string
 
@@ -40,19 +51,25 @@ var (
 )
 
 // InitRollupResultCache initializes the rollupResult cache
+//
+// The cache isn't allocated if -search.disableCache is set.
+// The previously saved cache is removed in this case, since it may contain stale results.
 func InitRollupResultCache(cachePath string) {
 	rollupResultCachePath = cachePath
 	startTime := time.Now()
 	var c *fastcache.Cache
-	if len(rollupResultCachePath) > 0 {
+	if *disableCache {
+		if len(rollupResultCachePath) > 0 && fs.IsPathExist(rollupResultCachePath) {
+			logger.Infof("removing rollupResult cache at %q, since -search.disableCache is set", rollupResultCachePath)
+			fs.MustRemoveAll(rollupResultCachePath)
+		}
+		rollupResultCachePath = ""
+	} else if len(rollupResultCachePath) > 0 {
 		logger.Infof("loading rollupResult cache from %q...", rollupResultCachePath)
 		c = fastcache.LoadFromFileOrNew(rollupResultCachePath, getRollupResultCacheSize())
 	} else {
 		c = fastcache.New(getRollupResultCacheSize())
 	}
-	if *disableCache {
-		c.Reset()
-	}
 
 	stats := &fastcache.Stats{}
 	var statsLock sync.Mutex
@@ -61,7 +78,7 @@ func InitRollupResultCache(cachePath string) {
 		statsLock.Lock()
 		defer statsLock.Unlock()
 
-		if time.Since(statsLastUpdate) < time.Second {
+		if c == nil || time.Since(statsLastUpdate) < time.Second {
 			return stats
 		}
 		var fcs fastcache.Stats
@@ -89,12 +106,30 @@ func InitRollupResultCache(cachePath string) {
 	})
 
 	rollupResultCacheV = &rollupResultCache{
-		c: c,
+		c:            c,
+		metainfoKeys: make(map[string]struct{}),
+
+		// Keys for the entries loaded from file are unknown.
+		metainfoKeysComplete: c == nil || fcs().EntriesCount == 0,
 	}
+
+	rollupResultCacheResetStopCh = make(chan struct{})
+	rollupResultCacheResetWG.Add(1)
+	go func() {
+		defer rollupResultCacheResetWG.Done()
+		checkRollupResultCacheReset(rollupResultCacheResetStopCh)
+	}()
 }
 
 // StopRollupResultCache closes the rollupResult cache.
 func StopRollupResultCache() {
+	close(rollupResultCacheResetStopCh)
+	rollupResultCacheResetWG.Wait()
+
+	if rollupResultCacheV.c == nil {
+		// The cache is disabled via -search.disableCache.
+		return
+	}
 	if len(rollupResultCachePath) == 0 {
 		rollupResultCacheV.c.Reset()
 		return
@@ -114,27 +149,190 @@ func StopRollupResultCache() {
 }
 
 type rollupResultCache struct {
+	// c is nil if the cache is disabled via -search.disableCache.
 	c *fastcache.Cache
+
+	// mu is held for reading during Get and Put calls and for writing during Reset calls,
+	// so Get and Put calls see either the whole cache state before the reset or the whole state after the reset.
+	mu sync.RWMutex
+
+	// metainfoKeysLock protects metainfoKeys and metainfoKeysComplete from concurrent Put calls.
+	metainfoKeysLock sync.Mutex
+
+	// metainfoKeys contains keys for metainfo entries stored in c.
+	//
+	// It is used for enumerating cached results when resetting the cache for the given time range.
+	metainfoKeys map[string]struct{}
+
+	// metainfoKeysComplete is set if metainfoKeys contains keys for all the metainfo entries stored in c.
+	//
+	// It is unset for the cache loaded from file and after metainfoKeys overflow.
+	metainfoKeysComplete bool
 }
 
+// maxRollupResultCacheMetainfoKeys limits the number of tracked metainfo keys in order to limit memory usage.
+const maxRollupResultCacheMetainfoKeys = 100e3
+
 var rollupResultCacheResets = metrics.NewCounter(`vm_cache_resets_total{type="promql/rollupResult"}`)
 
 // ResetRollupResultCache resets rollup result cache.
 func ResetRollupResultCache() {
+	ResetRollupResultCacheForTimeRange(math.MinInt64, math.MaxInt64)
+}
+
+// ResetRollupResultCacheForTimeRange removes cached results, which may depend on data
+// for the [start ... end] time range in milliseconds, and returns the number of removed results.
+//
+// The whole cache is reset if cached results cannot be enumerated, for example, after loading the cache from file.
+// The returned number is approximate in this case.
+func ResetRollupResultCacheForTimeRange(start, end int64) int {
+	if rollupResultCacheV.c == nil {
+		return 0
+	}
 	rollupResultCacheResets.Inc()
-	rollupResultCacheV.c.Reset()
+	return rollupResultCacheV.Reset(start, end)
+}
+
+// Reset removes cached results, which may depend on data for the [start ... end] time range, and returns the number of removed results.
+func (rrc *rollupResultCache) Reset(start, end int64) int {
+	rrc.mu.Lock()
+	defer rrc.mu.Unlock()
+
+	// There is no need in holding metainfoKeysLock, since Put calls are blocked by rrc.mu.
+	if !rrc.metainfoKeysComplete || (start == math.MinInt64 && end == math.MaxInt64) {
+		n := 0
+		if rrc.metainfoKeysComplete {
+			n = rrc.resetMetainfoEntries(start, end)
+		} else {
+			var fcs fastcache.Stats
+			rrc.c.UpdateStats(&fcs)
+			n = int(fcs.EntriesCount)
+		}
+		rrc.c.Reset()
+		rrc.metainfoKeys = make(map[string]struct{})
+		rrc.metainfoKeysComplete = true
+		return n
+	}
+	return rrc.resetMetainfoEntries(start, end)
+}
+
+// resetMetainfoEntries removes metainfo entries, which may depend on data for the [start ... end] time range,
+// and returns the number of removed entries.
+//
+// The cached results for the removed entries become unreachable, so they are evicted from the cache eventually.
+func (rrc *rollupResultCache) resetMetainfoEntries(start, end int64) int {
+	removed := 0
+	var mi rollupResultCacheMetainfo
+	var metainfoBuf []byte
+	for key := range rrc.metainfoKeys {
+		metainfoBuf = rrc.c.Get(metainfoBuf[:0], []byte(key))
+		if len(metainfoBuf) == 0 {
+			// The entry has been evicted from the cache.
+			delete(rrc.metainfoKeys, key)
+			continue
+		}
+		if err := mi.Unmarshal(metainfoBuf); err != nil {
+			logger.Panicf("BUG: cannot unmarshal rollupResultCacheMetainfo: %s; it looks like it was improperly saved", err)
+		}
+
+		// Results at the given timestamp depend on raw samples on the lookbehind window preceding the timestamp.
+		lookbehind := getRollupResultCacheKeyLookbehind([]byte(key))
+		n := mi.RemoveRange(start, end, lookbehind)
+		if n == 0 {
+			continue
+		}
+		removed += n
+		if len(mi.entries) == 0 {
+			rrc.c.Del([]byte(key))
+			delete(rrc.metainfoKeys, key)
+			continue
+		}
+		metainfoBuf = mi.Marshal(metainfoBuf[:0])
+		rrc.c.Set([]byte(key), metainfoBuf)
+	}
+	return removed
+}
+
+// registerMetainfoKey registers the key for metainfo entry stored in rrc.c.
+func (rrc *rollupResultCache) registerMetainfoKey(key []byte) {
+	rrc.metainfoKeysLock.Lock()
+	defer rrc.metainfoKeysLock.Unlock()
+
+	if !rrc.metainfoKeysComplete {
+		return
+	}
+	if _, ok := rrc.metainfoKeys[string(key)]; ok {
+		return
+	}
+	if len(rrc.metainfoKeys) >= maxRollupResultCacheMetainfoKeys {
+		// Stop tracking metainfo keys until the next full reset in order to limit memory usage.
+		rrc.metainfoKeys = make(map[string]struct{})
+		rrc.metainfoKeysComplete = false
+		return
+	}
+	rrc.metainfoKeys[string(key)] = struct{}{}
+}
+
+var (
+	rollupResultCacheResetStopCh chan struct{}
+	rollupResultCacheResetWG     sync.WaitGroup
+
+	needRollupResultCacheReset uint32
+)
+
+// ResetRollupResultCacheIfNeeded resets rollup result cache if mrs contain
+// timestamps older than `-search.cacheTimestampOffset`, since the cache may
+// contain stale results for the corresponding time range.
+//
+// The cache is reset asynchronously in order to reduce the overhead
+// during data backfilling.
+func ResetRollupResultCacheIfNeeded(mrs []storage.MetricRow) {
+	if atomic.LoadUint32(&needRollupResultCacheReset) != 0 {
+		// Fast path - the cache reset is already scheduled.
+		return
+	}
+	minTimestamp := time.Now().UnixNano()/1e6 - getCacheTimestampOffsetMsecs() - checkRollupResultCacheResetInterval.Nanoseconds()/1e6
+	for i := range mrs {
+		if mrs[i].Timestamp < minTimestamp {
+			atomic.StoreUint32(&needRollupResultCacheReset, 1)
+			return
+		}
+	}
+}
+
+const checkRollupResultCacheResetInterval = 5 * time.Second
+
+func checkRollupResultCacheReset(stopCh <-chan struct{}) {
+	t := time.NewTicker(checkRollupResultCacheResetInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+		}
+		if atomic.CompareAndSwapUint32(&needRollupResultCacheReset, 1, 0) {
+			ResetRollupResultCache()
+		}
+	}
+}
+
+func getCacheTimestampOffsetMsecs() int64 {
+	return cacheTimestampOffset.Nanoseconds() / 1e6
 }
 
 func (rrc *rollupResultCache) Get(funcName string, ec *EvalConfig, me *metricExpr, window int64) (tss []*timeseries, newStart int64) {
-	if *disableCache || !ec.mayCache() {
+	if !ec.mayCache() {
 		return nil, ec.Start
 	}
+	rrc.mu.RLock()
+	defer rrc.mu.RUnlock()
 
 	// Obtain tss from the cache.
 	bb := bbPool.Get()
 	defer bbPool.Put(bb)
 
-	bb.B = marshalRollupResultCacheKey(bb.B[:0], funcName, me, window, ec.Step)
+	bb.B = marshalRollupResultCacheKey(bb.B[:0], funcName, me, window, ec.Step, ec.Deadline.AccountID())
 	metainfoBuf := rrc.c.Get(nil, bb.B)
 	if len(metainfoBuf) == 0 {
 		return nil, ec.Start
@@ -152,7 +350,7 @@ func (rrc *rollupResultCache) Get(funcName string, ec *EvalConfig, me *metricExp
 	if len(resultBuf) == 0 {
 		mi.RemoveKey(key)
 		metainfoBuf = mi.Marshal(metainfoBuf[:0])
-		bb.B = marshalRollupResultCacheKey(bb.B[:0], funcName, me, window, ec.Step)
+		bb.B = marshalRollupResultCacheKey(bb.B[:0], funcName, me, window, ec.Step, ec.Deadline.AccountID())
 		rrc.c.Set(bb.B, metainfoBuf)
 		return nil, ec.Start
 	}
@@ -197,14 +395,14 @@ func (rrc *rollupResultCache) Get(funcName string, ec *EvalConfig, me *metricExp
 }
 
 func (rrc *rollupResultCache) Put(funcName string, ec *EvalConfig, me *metricExpr, window int64, tss []*timeseries) {
-	if *disableCache || len(tss) == 0 || !ec.mayCache() {
+	if len(tss) == 0 || !ec.mayCache() {
 		return
 	}
 
-	// Remove values up to currentTime - step - maxSilenceInterval,
+	// Remove values up to currentTime - step - cacheTimestampOffset,
 	// since these values may be added later.
 	timestamps := tss[0].Timestamps
-	deadline := (time.Now().UnixNano() / 1e6) - ec.Step - maxSilenceInterval
+	deadline := (time.Now().UnixNano() / 1e6) - ec.Step - getCacheTimestampOffsetMsecs()
 	i := len(timestamps) - 1
 	for i >= 0 && timestamps[i] > deadline {
 		i--
@@ -226,6 +424,9 @@ func (rrc *rollupResultCache) Put(funcName string, ec *EvalConfig, me *metricExp
 	}
 
 	// Store tss in the cache.
+	rrc.mu.RLock()
+	defer rrc.mu.RUnlock()
+
 	maxMarshaledSize := getRollupResultCacheSize() / 4
 	tssMarshaled := marshalTimeseriesFast(tss, maxMarshaledSize, ec.Step)
 	if tssMarshaled == nil {
@@ -242,7 +443,7 @@ func (rrc *rollupResultCache) Put(funcName string, ec *EvalConfig, me *metricExp
 	bb.B = key.Marshal(bb.B[:0])
 	rrc.c.SetBig(bb.B, tssMarshaled)
 
-	bb.B = marshalRollupResultCacheKey(bb.B[:0], funcName, me, window, ec.Step)
+	bb.B = marshalRollupResultCacheKey(bb.B[:0], funcName, me, window, ec.Step, ec.Deadline.AccountID())
 	metainfoBuf := rrc.c.Get(nil, bb.B)
 	var mi rollupResultCacheMetainfo
 	if len(metainfoBuf) > 0 {
@@ -253,6 +454,7 @@ func (rrc *rollupResultCache) Put(funcName string, ec *EvalConfig, me *metricExp
 	mi.AddKey(key, timestamps[0], timestamps[len(timestamps)-1])
 	metainfoBuf = mi.Marshal(metainfoBuf[:0])
 	rrc.c.Set(bb.B, metainfoBuf)
+	rrc.registerMetainfoKey(bb.B)
 }
 
 var (
@@ -272,7 +474,7 @@ var tooBigRollupResults = metrics.NewCounter("vm_too_big_rollup_results_total")
 // Increment this value every time the format of the cache changes.
 const rollupResultCacheVersion = 4
 
-func marshalRollupResultCacheKey(dst []byte, funcName string, me *metricExpr, window, step int64) []byte {
+func marshalRollupResultCacheKey(dst []byte, funcName string, me *metricExpr, window, step int64, accountID string) []byte {
 	dst = append(dst, rollupResultCacheVersion)
 	dst = encoding.MarshalUint64(dst, uint64(len(funcName)))
 	dst = append(dst, funcName...)
@@ -281,9 +483,38 @@ func marshalRollupResultCacheKey(dst []byte, funcName string, me *metricExpr, wi
 	for i := range me.TagFilters {
 		dst = me.TagFilters[i].Marshal(dst)
 	}
+	if accountID != "" {
+		// Results for the tenant are obtained with the additional tenant filter. See netstorage.setupTfss.
+		tf := storage.TagFilter{
+			Key:   []byte(tenant.Label),
+			Value: []byte(accountID),
+		}
+		dst = tf.Marshal(dst)
+	}
 	return dst
 }
 
+// getRollupResultCacheKeyLookbehind returns the maximum lookbehind window in milliseconds for results stored under the key
+// generated by marshalRollupResultCacheKey.
+func getRollupResultCacheKeyLookbehind(key []byte) int64 {
+	src := key
+	if len(src) < 9 {
+		logger.Panicf("BUG: too short rollupResultCache key: %d bytes", len(key))
+	}
+	funcNameLen := encoding.UnmarshalUint64(src[1:])
+	src = src[9:]
+	if uint64(len(src)) < funcNameLen+16 {
+		logger.Panicf("BUG: too short rollupResultCache key: %d bytes", len(key))
+	}
+	src = src[funcNameLen:]
+	window := encoding.UnmarshalInt64(src)
+	step := encoding.UnmarshalInt64(src[8:])
+	if window < step {
+		window = step
+	}
+	return window + maxSilenceInterval
+}
+
 // mergeTimeseries concatenates b with a and returns the result.
 //
 // Preconditions:
@@ -437,6 +668,26 @@ func (mi *rollupResultCacheMetainfo) AddKey(key rollupResultCacheKey, start, end
 	}
 }
 
+// RemoveRange removes entries with results, which may depend on data for the [start ... end] time range,
+// and returns the number of removed entries.
+//
+// lookbehind is the maximum duration of raw data preceding every result timestamp used for calculating the result.
+func (mi *rollupResultCacheMetainfo) RemoveRange(start, end, lookbehind int64) int {
+	if end < math.MaxInt64-lookbehind {
+		end += lookbehind
+	}
+	dst := mi.entries[:0]
+	for _, e := range mi.entries {
+		if e.start <= end && e.end >= start {
+			continue
+		}
+		dst = append(dst, e)
+	}
+	n := len(mi.entries) - len(dst)
+	mi.entries = dst
+	return n
+}
+
 func (mi *rollupResultCacheMetainfo) RemoveKey(key rollupResultCacheKey) {
 	for i := range mi.entries {
 		if mi.entries[i].key == key {
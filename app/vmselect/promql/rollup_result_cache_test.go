@@ -1,7 +1,12 @@
 package promql
 
 import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 )
@@ -236,6 +241,217 @@ func TestRollupResultCache(t *testing.T) {
 		testTimeseriesEqual(t, tss, tssExpected)
 	})
 
+	// Queries with disabled caching mustn't read or populate the cache.
+	t.Run("nocache", func(t *testing.T) {
+		ResetRollupResultCache()
+		ecNoCache := newEvalConfig(ec)
+		ecNoCache.MayCache = false
+		tss := []*timeseries{
+			{
+				Timestamps: []int64{1000, 1200},
+				Values:     []float64{1, 2},
+			},
+		}
+		rollupResultCacheV.Put(funcName, ecNoCache, me, window, tss)
+		tssResult, newStart := rollupResultCacheV.Get(funcName, ec, me, window)
+		if newStart != ec.Start {
+			t.Fatalf("unexpected newStart; got %d; want %d", newStart, ec.Start)
+		}
+		if len(tssResult) != 0 {
+			t.Fatalf("got %d timeseries, while expecting zero", len(tssResult))
+		}
+
+		// Other queries must still populate the cache.
+		rollupResultCacheV.Put(funcName, ec, me, window, tss)
+		tssResult, newStart = rollupResultCacheV.Get(funcName, ecNoCache, me, window)
+		if newStart != ec.Start {
+			t.Fatalf("unexpected newStart; got %d; want %d", newStart, ec.Start)
+		}
+		if len(tssResult) != 0 {
+			t.Fatalf("got %d timeseries, while expecting zero", len(tssResult))
+		}
+		tssResult, newStart = rollupResultCacheV.Get(funcName, ec, me, window)
+		if newStart != 1400 {
+			t.Fatalf("unexpected newStart; got %d; want %d", newStart, 1400)
+		}
+		testTimeseriesEqual(t, tssResult, tss)
+	})
+
+	// The cache must be bypassed if it is disabled globally.
+	t.Run("disable-cache", func(t *testing.T) {
+		ResetRollupResultCache()
+		*disableCache = true
+		defer func() {
+			*disableCache = false
+		}()
+		tss := []*timeseries{
+			{
+				Timestamps: []int64{1000, 1200},
+				Values:     []float64{1, 2},
+			},
+		}
+		rollupResultCacheV.Put(funcName, ec, me, window, tss)
+		*disableCache = false
+		tssResult, newStart := rollupResultCacheV.Get(funcName, ec, me, window)
+		if newStart != ec.Start {
+			t.Fatalf("unexpected newStart; got %d; want %d", newStart, ec.Start)
+		}
+		if len(tssResult) != 0 {
+			t.Fatalf("got %d timeseries, while expecting zero", len(tssResult))
+		}
+	})
+}
+
+func TestResetRollupResultCacheForTimeRange(t *testing.T) {
+	ResetRollupResultCache()
+	funcName := "foo"
+	window := int64(60e3)
+	newMetricExpr := func(value string) *metricExpr {
+		return &metricExpr{
+			TagFilters: []storage.TagFilter{{
+				Key:   []byte("aaa"),
+				Value: []byte(value),
+			}},
+		}
+	}
+	newEvalConfig := func(start, end int64) *EvalConfig {
+		return &EvalConfig{
+			Start: start,
+			End:   end,
+			Step:  100e3,
+
+			MayCache: true,
+		}
+	}
+	put := func(me *metricExpr, ec *EvalConfig) {
+		var tss []*timeseries
+		ts := &timeseries{}
+		for t := ec.Start; t <= ec.End; t += ec.Step {
+			ts.Timestamps = append(ts.Timestamps, t)
+			ts.Values = append(ts.Values, float64(t))
+		}
+		tss = append(tss, ts)
+		rollupResultCacheV.Put(funcName, ec, me, window, tss)
+	}
+	isCached := func(me *metricExpr, ec *EvalConfig) bool {
+		_, newStart := rollupResultCacheV.Get(funcName, ec, me, window)
+		return newStart != ec.Start
+	}
+
+	meA := newMetricExpr("a")
+	ecA := newEvalConfig(10e6, 11e6)
+	meB := newMetricExpr("b")
+	ecB := newEvalConfig(20e6, 21e6)
+	put(meA, ecA)
+	put(meB, ecB)
+
+	f := func(start, end int64, nExpected int, cachedAExpected, cachedBExpected bool) {
+		t.Helper()
+		n := ResetRollupResultCacheForTimeRange(start, end)
+		if n != nExpected {
+			t.Fatalf("unexpected number of removed entries for [%d ... %d]; got %d; want %d", start, end, n, nExpected)
+		}
+		if cachedA := isCached(meA, ecA); cachedA != cachedAExpected {
+			t.Fatalf("unexpected cache state for results a; got %v; want %v", cachedA, cachedAExpected)
+		}
+		if cachedB := isCached(meB, ecB); cachedB != cachedBExpected {
+			t.Fatalf("unexpected cache state for results b; got %v; want %v", cachedB, cachedBExpected)
+		}
+	}
+
+	// The time range doesn't overlap with cached results.
+	f(15e6, 16e6, 0, true, true)
+
+	// The time range is located in the lookbehind window for results b.
+	f(19.7e6, 19.8e6, 1, true, false)
+
+	// Reset the whole cache.
+	put(meB, ecB)
+	f(math.MinInt64, math.MaxInt64, 2, false, false)
+}
+
+func TestRollupResultCacheConcurrentReset(t *testing.T) {
+	ResetRollupResultCache()
+	funcName := "foo"
+	window := int64(60e3)
+	ec := &EvalConfig{
+		Start: 10e6,
+		End:   11e6,
+		Step:  100e3,
+
+		MayCache: true,
+	}
+	var wg sync.WaitGroup
+	errCh := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			me := &metricExpr{
+				TagFilters: []storage.TagFilter{{
+					Key:   []byte("aaa"),
+					Value: []byte(fmt.Sprintf("worker_%d", workerID)),
+				}},
+			}
+			ts := &timeseries{}
+			for t := ec.Start; t <= ec.End; t += ec.Step {
+				ts.Timestamps = append(ts.Timestamps, t)
+				ts.Values = append(ts.Values, float64(t+int64(workerID)))
+			}
+			for j := 0; j < 1000; j++ {
+				rollupResultCacheV.Put(funcName, ec, me, window, []*timeseries{ts})
+				tss, newStart := rollupResultCacheV.Get(funcName, ec, me, window)
+				if newStart == ec.Start {
+					// The cache has been reset.
+					continue
+				}
+				if len(tss) != 1 || newStart != ec.End+ec.Step {
+					errCh <- fmt.Errorf("unexpected cached results; got %d series; newStart=%d", len(tss), newStart)
+					return
+				}
+				for k, v := range tss[0].Values {
+					if v != float64(tss[0].Timestamps[k]+int64(workerID)) {
+						errCh <- fmt.Errorf("unexpected value at timestamp %d; got %v", tss[0].Timestamps[k], v)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		ResetRollupResultCacheForTimeRange(10.5e6, 10.6e6)
+		ResetRollupResultCache()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestResetRollupResultCacheIfNeeded(t *testing.T) {
+	f := func(timestamps []int64, needResetExpected bool) {
+		t.Helper()
+		atomic.StoreUint32(&needRollupResultCacheReset, 0)
+		mrs := make([]storage.MetricRow, len(timestamps))
+		for i, ts := range timestamps {
+			mrs[i].Timestamp = ts
+		}
+		ResetRollupResultCacheIfNeeded(mrs)
+		needReset := atomic.LoadUint32(&needRollupResultCacheReset) != 0
+		if needReset != needResetExpected {
+			t.Fatalf("unexpected needReset for timestamps %v; got %v; want %v", timestamps, needReset, needResetExpected)
+		}
+	}
+	currentTimestamp := time.Now().UnixNano() / 1e6
+	oldTimestamp := currentTimestamp - getCacheTimestampOffsetMsecs() - 3600*1000
+
+	f(nil, false)
+	f([]int64{currentTimestamp}, false)
+	f([]int64{currentTimestamp, currentTimestamp + 1000}, false)
+	f([]int64{oldTimestamp}, true)
+	f([]int64{currentTimestamp, oldTimestamp}, true)
+	atomic.StoreUint32(&needRollupResultCacheReset, 0)
 }
 
 func TestMergeTimeseries(t *testing.T) {
@@ -3,6 +3,9 @@ package promql
 import (
 	"math"
 	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 )
 
 var (
@@ -121,14 +124,70 @@ func TestRollupQuantileOverTime(t *testing.T) {
 		testRollupFunc(t, "quantile_over_time", args, &me, vExpected)
 	}
 
-	f(-123, 12)
-	f(-0.5, 12)
+	// phi outside [0...1]
+	f(-123, nan)
+	f(-0.5, nan)
+	f(1.01, nan)
+	f(234, nan)
+	f(nan, nan)
+
+	// Sorted testValues: 12, 21, 32, 34, 34, 34, 34, 44, 44, 54, 99, 123
 	f(0, 12)
-	f(0.1, 21)
-	f(0.5, 34)
-	f(0.9, 99)
+	f(0.1, 22.1)  // rank 1.1: 21 + 0.1*(32-21)
+	f(0.25, 33.5) // rank 2.75: 32 + 0.75*(34-32)
+	f(0.5, 34)    // rank 5.5: 34 + 0.5*(34-34)
+	f(0.75, 46.5) // rank 8.25: 44 + 0.25*(54-44)
 	f(1, 123)
-	f(234, 123)
+}
+
+func TestRollupMADOverTime(t *testing.T) {
+	f := func(values []float64, vExpected float64) {
+		t.Helper()
+		var rfa rollupFuncArg
+		rfa.values = values
+		v := rollupMAD(&rfa)
+		if math.IsNaN(vExpected) {
+			if !math.IsNaN(v) {
+				t.Fatalf("unexpected value for %v; got %v; want %v", values, v, vExpected)
+			}
+			return
+		}
+		if v != vExpected {
+			t.Fatalf("unexpected value for %v; got %v; want %v", values, v, vExpected)
+		}
+	}
+	f(nil, nan)
+	f([]float64{5}, 0)
+	f([]float64{1, 1, 1}, 0)
+	// median=2; deviations: 1, 0, 2, 5 -> median of 0, 1, 2, 5 is 1.5
+	f([]float64{1, 2, 4, 7}, 1.5)
+	// median=3; deviations: 2, 1, 0, 1, 97 -> median of 0, 1, 1, 2, 97 is 1
+	f([]float64{1, 2, 3, 4, 100}, 1)
+
+	// Input values mustn't be modified.
+	values := []float64{3, 1, 2}
+	f(values, 1)
+	if values[0] != 3 || values[1] != 1 || values[2] != 2 {
+		t.Fatalf("input values are modified: %v", values)
+	}
+}
+
+func TestQuantileSorted(t *testing.T) {
+	f := func(phi float64, a []float64, vExpected float64) {
+		t.Helper()
+		v := quantileSorted(phi, a)
+		if math.Abs(v-vExpected) > 1e-12 {
+			t.Fatalf("unexpected %v-quantile for %v; got %v; want %v", phi, a, v, vExpected)
+		}
+	}
+	f(0, []float64{7}, 7)
+	f(0.5, []float64{7}, 7)
+	f(1, []float64{7}, 7)
+	f(0.5, []float64{1, 2}, 1.5)
+	f(0.25, []float64{1, 2, 3, 4, 5}, 2)
+	f(0.1, []float64{1, 2, 3, 4, 5}, 1.4)
+	f(0.9, []float64{12, 21, 32, 34, 34, 34, 34, 44, 44, 54, 99, 123}, 94.5)
+	f(1, []float64{1, 2, 3, 4, 5}, 5)
 }
 
 func TestRollupPredictLinear(t *testing.T) {
@@ -205,6 +264,7 @@ func TestRollupNewRollupFuncSuccess(t *testing.T) {
 	f("count_over_time", 12)
 	f("stddev_over_time", 30.752935722554287)
 	f("stdvar_over_time", 945.7430555555555)
+	f("mad_over_time", 10) // the median of absolute deviations from 34: 0, 0, 0, 0, 2, 10, 10, 13, 20, 22, 65, 89
 	f("first_over_time", 123)
 	f("last_over_time", 34)
 	f("integrate", 61.0275)
@@ -279,6 +339,39 @@ func TestRollupNoWindowNoPoints(t *testing.T) {
 	})
 }
 
+func TestRollupSetLookbackToStep(t *testing.T) {
+	f := func(step, window int64, valueExpected float64) {
+		t.Helper()
+		// The series stopped reporting 4 minutes before the query time.
+		// Only the last sample falls into the time range fetched for instant query.
+		rc := rollupConfig{
+			Func:   rollupDefault,
+			Start:  600e3,
+			End:    600e3,
+			Step:   step,
+			Window: window,
+		}
+		rc.Timestamps = getTimestamps(rc.Start, rc.End, rc.Step)
+		values := rc.Do(nil, []float64{42}, []int64{360e3})
+		testRowsEqual(t, values, rc.Timestamps, []float64{valueExpected}, []int64{600e3})
+	}
+
+	// The lookbehind window defaults to 5 minutes for series with a single sample.
+	f(60e3, 0, 42)
+	f(300e3, 0, 42)
+
+	origValue := *setLookbackToStep
+	*setLookbackToStep = true
+	defer func() {
+		*setLookbackToStep = origValue
+	}()
+	f(60e3, 0, nan)
+	f(300e3, 0, 42)
+
+	// Explicit window in square brackets mustn't be affected.
+	f(60e3, 300e3, 42)
+}
+
 func TestRollupWindowNoPoints(t *testing.T) {
 	t.Run("beforeStart", func(t *testing.T) {
 		rc := rollupConfig{
@@ -415,6 +508,21 @@ func TestRollupFuncsNoWindow(t *testing.T) {
 		timestampsExpected := []int64{0, 40, 80, 120, 160}
 		testRowsEqual(t, values, rc.Timestamps, valuesExpected, timestampsExpected)
 	})
+	t.Run("timestamp", func(t *testing.T) {
+		rc := rollupConfig{
+			Func:   rollupTimestamp,
+			Start:  0,
+			End:    160,
+			Step:   40,
+			Window: 0,
+		}
+		rc.Timestamps = getTimestamps(rc.Start, rc.End, rc.Step)
+		values := rc.Do(nil, testValues, testTimestamps)
+		// Timestamps must match the samples selected by rollupFirst.
+		valuesExpected := []float64{0.005, 0.036, 0.08, 0.12, nan}
+		timestampsExpected := []int64{0, 40, 80, 120, 160}
+		testRowsEqual(t, values, rc.Timestamps, valuesExpected, timestampsExpected)
+	})
 	t.Run("count", func(t *testing.T) {
 		rc := rollupConfig{
 			Func:   rollupCount,
@@ -647,3 +755,78 @@ func testRowsEqual(t *testing.T, values []float64, timestamps []int64, valuesExp
 		}
 	}
 }
+
+func TestRollupDefaultStaleNaN(t *testing.T) {
+	rc := rollupConfig{
+		Func:   rollupDefault,
+		Start:  10,
+		End:    70,
+		Step:   10,
+		Window: 0,
+	}
+	rc.Timestamps = getTimestamps(rc.Start, rc.End, rc.Step)
+	values := rc.Do(nil, []float64{1, 2, decimal.StaleNaN, 4}, []int64{10, 20, 30, 60})
+	valuesExpected := []float64{1, 1, 2, nan, 4, 4, 4}
+	timestampsExpected := []int64{10, 20, 30, 40, 50, 60, 70}
+	testRowsEqual(t, values, rc.Timestamps, valuesExpected, timestampsExpected)
+	for i, v := range values {
+		if decimal.IsStaleNaN(v) {
+			t.Fatalf("unexpected staleness mark at position %d in rollup results", i)
+		}
+	}
+}
+
+func TestRollupTimestampStaleNaN(t *testing.T) {
+	rc := rollupConfig{
+		Func:   rollupTimestamp,
+		Start:  10,
+		End:    70,
+		Step:   10,
+		Window: 0,
+	}
+	rc.Timestamps = getTimestamps(rc.Start, rc.End, rc.Step)
+	values := rc.Do(nil, []float64{1, 2, decimal.StaleNaN, 4}, []int64{10, 20, 30, 60})
+	valuesExpected := []float64{0.01, 0.01, 0.02, nan, 0.06, 0.06, 0.06}
+	timestampsExpected := []int64{10, 20, 30, 40, 50, 60, 70}
+	testRowsEqual(t, values, rc.Timestamps, valuesExpected, timestampsExpected)
+}
+
+func TestDropStaleNaNs(t *testing.T) {
+	f := func(name string, values []float64, timestamps []int64, valuesExpected []float64, timestampsExpected []int64) {
+		t.Helper()
+		values, timestamps = dropStaleNaNs(name, values, timestamps)
+		testRowsEqual(t, values, timestamps, valuesExpected, timestampsExpected)
+	}
+	f("rate", nil, nil, nil, nil)
+	f("rate", []float64{1, 2}, []int64{10, 20}, []float64{1, 2}, []int64{10, 20})
+	f("rate", []float64{1, decimal.StaleNaN, 3, decimal.StaleNaN}, []int64{10, 20, 30, 40}, []float64{1, 3}, []int64{10, 30})
+
+	// default_rollup and timestamp must keep staleness marks
+	for _, name := range []string{"default_rollup", "timestamp"} {
+		values, timestamps := dropStaleNaNs(name, []float64{1, decimal.StaleNaN}, []int64{10, 20})
+		if len(values) != 2 || !decimal.IsStaleNaN(values[1]) || len(timestamps) != 2 {
+			t.Fatalf("unexpected result for %s; got values=%v, timestamps=%v", name, values, timestamps)
+		}
+	}
+}
+
+func TestGetMaxPrevIntervalMaxStalenessInterval(t *testing.T) {
+	f := func(timestamps []int64, dExpected int64) {
+		t.Helper()
+		d := getMaxPrevInterval(timestamps)
+		if d != dExpected {
+			t.Fatalf("unexpected maxPrevInterval for timestamps=%v; got %d; want %d", timestamps, d, dExpected)
+		}
+	}
+	f(nil, maxSilenceInterval)
+	f([]int64{0, 16000, 32000}, 17000)
+
+	origValue := *maxStalenessInterval
+	*maxStalenessInterval = 10 * time.Second
+	defer func() {
+		*maxStalenessInterval = origValue
+	}()
+	f(nil, 10000)
+	f([]int64{0, 16000, 32000}, 10000)
+	f([]int64{0, 1600, 3200}, 1700)
+}
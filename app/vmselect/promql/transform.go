@@ -11,13 +11,13 @@ import (
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
-	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
 	"github.com/valyala/histogram"
 )
 
 var transformFuncsKeepMetricGroup = map[string]bool{
 	"ceil":      true,
+	"clamp":     true,
 	"clamp_max": true,
 	"clamp_min": true,
 	"floor":     true,
@@ -30,6 +30,7 @@ var transformFuncs = map[string]transformFunc{
 	"abs":                newTransformFuncOneArg(transformAbs),
 	"absent":             transformAbsent,
 	"ceil":               newTransformFuncOneArg(transformCeil),
+	"clamp":              transformClamp,
 	"clamp_max":          transformClampMax,
 	"clamp_min":          transformClampMin,
 	"day_of_month":       newTransformFuncDateTime(transformDayOfMonth),
@@ -63,9 +64,13 @@ var transformFuncs = map[string]transformFunc{
 	"label_copy":         transformLabelCopy,
 	"label_move":         transformLabelMove,
 	"label_transform":    transformLabelTransform,
+	"labels_equal":       transformLabelsEqual,
+	"drop_common_labels": transformDropCommonLabels,
+	"prometheus_buckets": transformPrometheusBuckets,
 	"union":              transformUnion,
 	"":                   transformUnion, // empty func is a synonim to union
 	"keep_last_value":    transformKeepLastValue,
+	"keep_next_value":    transformKeepNextValue,
 	"start":              newTransformFuncZeroArgs(transformStart),
 	"end":                newTransformFuncZeroArgs(transformEnd),
 	"step":               newTransformFuncZeroArgs(transformStep),
@@ -90,6 +95,11 @@ var transformFuncs = map[string]transformFunc{
 	"cos":                newTransformFuncOneArg(transformCos),
 	"asin":               newTransformFuncOneArg(transformAsin),
 	"acos":               newTransformFuncOneArg(transformAcos),
+
+	"sort_by_label":              newTransformFuncSortByLabel(false, false),
+	"sort_by_label_desc":         newTransformFuncSortByLabel(true, false),
+	"sort_by_label_numeric":      newTransformFuncSortByLabel(false, true),
+	"sort_by_label_numeric_desc": newTransformFuncSortByLabel(true, true),
 }
 
 func getTransformFunc(s string) transformFunc {
@@ -148,23 +158,7 @@ func transformAbsent(tfa *transformFuncArg) ([]*timeseries, error) {
 	arg := args[0]
 
 	if len(arg) == 0 {
-		// Copy tags from arg
-		rvs := evalNumber(tfa.ec, 1)
-		rv := rvs[0]
-		me, ok := tfa.fe.Args[0].(*metricExpr)
-		if !ok {
-			return rvs, nil
-		}
-		for i := range me.TagFilters {
-			tf := &me.TagFilters[i]
-			if len(tf.Key) == 0 {
-				continue
-			}
-			if tf.IsRegexp || tf.IsNegative {
-				continue
-			}
-			rv.MetricName.AddTagBytes(tf.Key, tf.Value)
-		}
+		rvs := getAbsentTimeseries(tfa.ec, tfa.fe.Args[0])
 		return rvs, nil
 	}
 
@@ -182,10 +176,62 @@ func transformAbsent(tfa *transformFuncArg) ([]*timeseries, error) {
 	return arg, nil
 }
 
+// getAbsentTimeseries returns a single time series with 1 values for absent() and absent_over_time().
+//
+// The returned time series contains tags from non-regexp positive filters of arg if it is a metric selector.
+func getAbsentTimeseries(ec *EvalConfig, arg expr) []*timeseries {
+	// Copy tags from arg
+	rvs := evalNumber(ec, 1)
+	rv := rvs[0]
+	me, ok := arg.(*metricExpr)
+	if !ok {
+		return rvs
+	}
+	for i := range me.TagFilters {
+		tf := &me.TagFilters[i]
+		if len(tf.Key) == 0 {
+			continue
+		}
+		if tf.IsRegexp || tf.IsNegative {
+			continue
+		}
+		rv.MetricName.AddTagBytes(tf.Key, tf.Value)
+	}
+	return rvs
+}
+
 func transformCeil(v float64) float64 {
 	return math.Ceil(v)
 }
 
+// transformClamp implements clamp(q, min, max) like Prometheus does.
+//
+// Points with min > max are dropped.
+func transformClamp(tfa *transformFuncArg) ([]*timeseries, error) {
+	args := tfa.args
+	if err := expectTransformArgsNum(args, 3); err != nil {
+		return nil, err
+	}
+	mins, err := getScalar(args[1], 1)
+	if err != nil {
+		return nil, err
+	}
+	maxs, err := getScalar(args[2], 2)
+	if err != nil {
+		return nil, err
+	}
+	tf := func(values []float64) {
+		for i, v := range values {
+			if mins[i] > maxs[i] {
+				values[i] = nan
+				continue
+			}
+			values[i] = math.Max(mins[i], math.Min(maxs[i], v))
+		}
+	}
+	return doTransformValues(args[0], tf, tfa.fe)
+}
+
 func transformClampMax(tfa *transformFuncArg) ([]*timeseries, error) {
 	args := tfa.args
 	if err := expectTransformArgsNum(args, 2); err != nil {
@@ -197,9 +243,7 @@ func transformClampMax(tfa *transformFuncArg) ([]*timeseries, error) {
 	}
 	tf := func(values []float64) {
 		for i, v := range values {
-			if v > maxs[i] {
-				values[i] = maxs[i]
-			}
+			values[i] = math.Min(maxs[i], v)
 		}
 	}
 	return doTransformValues(args[0], tf, tfa.fe)
@@ -216,9 +260,7 @@ func transformClampMin(tfa *transformFuncArg) ([]*timeseries, error) {
 	}
 	tf := func(values []float64) {
 		for i, v := range values {
-			if v < mins[i] {
-				values[i] = mins[i]
-			}
+			values[i] = math.Max(mins[i], v)
 		}
 	}
 	return doTransformValues(args[0], tf, tfa.fe)
@@ -280,6 +322,9 @@ func transformHistogramQuantile(tfa *transformFuncArg) ([]*timeseries, error) {
 		return nil, err
 	}
 
+	// Convert buckets with `vmrange` labels to buckets with `le` labels.
+	tss := vmrangeBucketsToLE(args[1])
+
 	// Group metrics by all tags excluding "le"
 	type x struct {
 		le float64
@@ -287,7 +332,7 @@ func transformHistogramQuantile(tfa *transformFuncArg) ([]*timeseries, error) {
 	}
 	m := make(map[string][]x)
 	bb := bbPool.Get()
-	for _, ts := range args[1] {
+	for _, ts := range tss {
 		tagValue := ts.MetricName.GetTagValue("le")
 		if len(tagValue) == 0 {
 			continue
@@ -329,13 +374,32 @@ func transformHistogramQuantile(tfa *transformFuncArg) ([]*timeseries, error) {
 		if phi > 1 {
 			return inf
 		}
-		vReq := xss[len(xss)-1].ts.Values[i] * phi
+		// The last bucket must contain the total number of observations. Cumulative buckets
+		// may be non-monotonic due to float rounding errors or due to counter resets in rate(),
+		// so the total is clamped to the maximum bucket value.
+		vLast := nan
+		for _, xs := range xss {
+			v := xs.ts.Values[i]
+			if !math.IsNaN(v) && (math.IsNaN(vLast) || v > vLast) {
+				vLast = v
+			}
+		}
+		if math.IsNaN(vLast) || vLast <= 0 {
+			// There are no observations, so the quantile cannot be estimated.
+			return nan
+		}
+		vReq := vLast * phi
 		for _, xs := range xss {
 			v := xs.ts.Values[i]
 			le := xs.le
-			if v <= vPrev {
+			if math.IsNaN(v) {
+				// Missing bucket. Substitute it with the previous bucket.
 				v = vPrev
 				le = lePrev
+			} else if v < vPrev {
+				// Non-monotonic bucket. Clamp it to the previous bucket value,
+				// i.e. assume there are no observations between lePrev and le.
+				v = vPrev
 			}
 			if v < vReq {
 				vPrev = v
@@ -367,6 +431,130 @@ func transformHistogramQuantile(tfa *transformFuncArg) ([]*timeseries, error) {
 	return rvs, nil
 }
 
+func transformPrometheusBuckets(tfa *transformFuncArg) ([]*timeseries, error) {
+	args := tfa.args
+	if err := expectTransformArgsNum(args, 1); err != nil {
+		return nil, err
+	}
+	rvs := vmrangeBucketsToLE(args[0])
+	return rvs, nil
+}
+
+// vmrangeBucketsToLE converts VictoriaMetrics histogram buckets with `vmrange="start...end"` labels
+// to Prometheus-compatible cumulative buckets with `le` labels.
+//
+// vmrange buckets contain non-cumulative counts. They may be passed in any order and may have gaps
+// between them. Time series with `le` label are returned as is. Other time series are dropped.
+func vmrangeBucketsToLE(tss []*timeseries) []*timeseries {
+	rvs := make([]*timeseries, 0, len(tss))
+
+	// Group time series by MetricGroup+tags excluding `vmrange` tag.
+	type x struct {
+		start  float64
+		end    float64
+		endStr string
+		ts     *timeseries
+	}
+	m := make(map[string][]x)
+	bb := bbPool.Get()
+	for _, ts := range tss {
+		vmrange := ts.MetricName.GetTagValue("vmrange")
+		if len(vmrange) == 0 {
+			if len(ts.MetricName.GetTagValue("le")) > 0 {
+				// Keep Prometheus-compatible buckets.
+				rvs = append(rvs, ts)
+			}
+			continue
+		}
+		n := strings.Index(bytesutil.ToUnsafeString(vmrange), "...")
+		if n < 0 {
+			continue
+		}
+		start, err := strconv.ParseFloat(bytesutil.ToUnsafeString(vmrange[:n]), 64)
+		if err != nil {
+			continue
+		}
+		endStr := string(vmrange[n+len("..."):])
+		end, err := strconv.ParseFloat(endStr, 64)
+		if err != nil || start > end {
+			continue
+		}
+		ts.MetricName.RemoveTag("vmrange")
+		bb.B = marshalMetricNameSorted(bb.B[:0], &ts.MetricName)
+		m[string(bb.B)] = append(m[string(bb.B)], x{
+			start:  start,
+			end:    end,
+			endStr: endStr,
+			ts:     ts,
+		})
+	}
+	bbPool.Put(bb)
+
+	newBucket := func(src *timeseries, leStr string) *timeseries {
+		var ts timeseries
+		ts.CopyFromShallowTimestamps(src)
+		for i := range ts.Values {
+			ts.Values[i] = 0
+		}
+		// src may already contain `le` tag.
+		ts.MetricName.RemoveTag("le")
+		ts.MetricName.AddTag("le", leStr)
+		return &ts
+	}
+	for _, xss := range m {
+		sort.Slice(xss, func(i, j int) bool {
+			return xss[i].end < xss[j].end
+		})
+
+		// Convert every vmrange bucket to `le` bucket. Add an empty bucket
+		// with `le=start` for gaps between buckets, so the quantile isn't
+		// interpolated over ranges without observations.
+		buckets := make([]*timeseries, 0, len(xss)+2)
+		prevEnd := math.Inf(-1)
+		var prevTS *timeseries
+		for _, xs := range xss {
+			if xs.end == prevEnd {
+				// Merge buckets with identical ends.
+				for i, v := range xs.ts.Values {
+					if math.IsNaN(v) {
+						continue
+					}
+					if math.IsNaN(prevTS.Values[i]) {
+						prevTS.Values[i] = v
+					} else {
+						prevTS.Values[i] += v
+					}
+				}
+				continue
+			}
+			if xs.start > prevEnd {
+				buckets = append(buckets, newBucket(xs.ts, strconv.FormatFloat(xs.start, 'g', -1, 64)))
+			}
+			xs.ts.MetricName.AddTag("le", xs.endStr)
+			buckets = append(buckets, xs.ts)
+			prevEnd = xs.end
+			prevTS = xs.ts
+		}
+		if !math.IsInf(prevEnd, 1) {
+			buckets = append(buckets, newBucket(prevTS, "+Inf"))
+		}
+
+		// Make bucket counts cumulative.
+		for i := range buckets[0].Values {
+			count := float64(0)
+			for _, ts := range buckets {
+				v := ts.Values[i]
+				if !math.IsNaN(v) && v > 0 {
+					count += v
+				}
+				ts.Values[i] = count
+			}
+		}
+		rvs = append(rvs, buckets...)
+	}
+	return rvs
+}
+
 func transformHour(t time.Time) int {
 	return t.Hour()
 }
@@ -418,28 +606,84 @@ func skipTrailingNaNs(values []float64) []float64 {
 }
 
 func transformKeepLastValue(tfa *transformFuncArg) ([]*timeseries, error) {
-	args := tfa.args
-	if err := expectTransformArgsNum(args, 1); err != nil {
+	rvs, maxGaps, err := getKeepValueArgs(tfa)
+	if err != nil {
 		return nil, err
 	}
-	rvs := args[0]
 	for _, ts := range rvs {
+		// Fill NaN gaps with the previous non-NaN value.
 		values := ts.Values
-		if len(values) == 0 {
-			continue
-		}
-		prevValue := values[0]
+		timestamps := ts.Timestamps
+		prevValue := nan
+		prevTimestamp := int64(0)
 		for i, v := range values {
-			if math.IsNaN(v) {
-				v = prevValue
+			if !math.IsNaN(v) {
+				prevValue = v
+				prevTimestamp = timestamps[i]
+				continue
 			}
-			values[i] = v
-			prevValue = v
+			if math.IsNaN(prevValue) || isTooLongGap(timestamps[i]-prevTimestamp, maxGaps[i]) {
+				continue
+			}
+			values[i] = prevValue
 		}
 	}
 	return rvs, nil
 }
 
+func transformKeepNextValue(tfa *transformFuncArg) ([]*timeseries, error) {
+	rvs, maxGaps, err := getKeepValueArgs(tfa)
+	if err != nil {
+		return nil, err
+	}
+	for _, ts := range rvs {
+		// Fill NaN gaps with the next non-NaN value.
+		values := ts.Values
+		timestamps := ts.Timestamps
+		nextValue := nan
+		nextTimestamp := int64(0)
+		for i := len(values) - 1; i >= 0; i-- {
+			v := values[i]
+			if !math.IsNaN(v) {
+				nextValue = v
+				nextTimestamp = timestamps[i]
+				continue
+			}
+			if math.IsNaN(nextValue) || isTooLongGap(nextTimestamp-timestamps[i], maxGaps[i]) {
+				continue
+			}
+			values[i] = nextValue
+		}
+	}
+	return rvs, nil
+}
+
+// getKeepValueArgs returns args for keep_last_value(q, maxGap) and keep_next_value(q, maxGap).
+//
+// maxGap is the maximum gap in seconds, which may be filled. Gaps are filled regardless
+// of their duration if maxGap is missing or isn't positive.
+func getKeepValueArgs(tfa *transformFuncArg) ([]*timeseries, []float64, error) {
+	args := tfa.args
+	if len(args) != 1 && len(args) != 2 {
+		return nil, nil, fmt.Errorf(`unexpected number of args: %d; want 1 or 2`, len(args))
+	}
+	var maxGapArg []*timeseries
+	if len(args) == 1 {
+		maxGapArg = evalNumber(tfa.ec, 0)
+	} else {
+		maxGapArg = args[1]
+	}
+	maxGaps, err := getScalar(maxGapArg, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return args[0], maxGaps, nil
+}
+
+func isTooLongGap(gapMsecs int64, maxGap float64) bool {
+	return maxGap > 0 && float64(gapMsecs) > maxGap*1e3
+}
+
 func newTransformFuncRunning(rf func(a, b float64, idx int) float64) transformFunc {
 	return func(tfa *transformFuncArg) ([]*timeseries, error) {
 		args := tfa.args
@@ -690,6 +934,76 @@ func transformLabelDel(tfa *transformFuncArg) ([]*timeseries, error) {
 	return rvs, nil
 }
 
+// transformDropCommonLabels removes labels with identical values across all the series returned by q.
+//
+// The metric name is treated as a regular label, so it is removed if all the series have the same metric name.
+// Nothing is removed from a single series, since all its labels, including the metric name, are trivially common.
+func transformDropCommonLabels(tfa *transformFuncArg) ([]*timeseries, error) {
+	args := tfa.args
+	if err := expectTransformArgsNum(args, 1); err != nil {
+		return nil, err
+	}
+	rvs := args[0]
+	if len(rvs) < 2 {
+		return rvs, nil
+	}
+	mnFirst := &rvs[0].MetricName
+	var commonLabels []string
+	if len(mnFirst.MetricGroup) > 0 {
+		commonLabels = append(commonLabels, "__name__")
+	}
+	for _, tag := range mnFirst.Tags {
+		commonLabels = append(commonLabels, string(tag.Key))
+	}
+	dstLabels := commonLabels[:0]
+	for _, label := range commonLabels {
+		value := mnFirst.GetTagValue(label)
+		isCommon := true
+		for _, ts := range rvs[1:] {
+			if string(ts.MetricName.GetTagValue(label)) != string(value) {
+				isCommon = false
+				break
+			}
+		}
+		if isCommon {
+			dstLabels = append(dstLabels, label)
+		}
+	}
+	for _, ts := range rvs {
+		for _, label := range dstLabels {
+			ts.MetricName.RemoveTag(label)
+		}
+	}
+	return rvs, nil
+}
+
+// transformLabelsEqual returns series from q with equal values for label1 and label2.
+//
+// Missing labels are treated as labels with empty values, so series without both labels are returned.
+func transformLabelsEqual(tfa *transformFuncArg) ([]*timeseries, error) {
+	args := tfa.args
+	if err := expectTransformArgsNum(args, 3); err != nil {
+		return nil, err
+	}
+	label1, err := getString(args[1], 1)
+	if err != nil {
+		return nil, err
+	}
+	label2, err := getString(args[2], 2)
+	if err != nil {
+		return nil, err
+	}
+	tss := args[0]
+	rvs := tss[:0]
+	for _, ts := range tss {
+		mn := &ts.MetricName
+		if string(mn.GetTagValue(label1)) == string(mn.GetTagValue(label2)) {
+			rvs = append(rvs, ts)
+		}
+	}
+	return rvs, nil
+}
+
 func transformLabelSet(tfa *transformFuncArg) ([]*timeseries, error) {
 	args := tfa.args
 	if len(args) < 1 {
@@ -872,9 +1186,13 @@ func labelReplace(tss []*timeseries, srcLabel string, r *regexp.Regexp, dstLabel
 	replacementBytes := []byte(replacement)
 	for _, ts := range tss {
 		mn := &ts.MetricName
-		dstValue := getDstValue(mn, dstLabel)
 		srcValue := mn.GetTagValue(srcLabel)
+		if !r.Match(srcValue) {
+			// Leave the time series unchanged if the regexp doesn't match src label value like Prometheus does.
+			continue
+		}
 		b := r.ReplaceAll(srcValue, replacementBytes)
+		dstValue := getDstValue(mn, dstLabel)
 		*dstValue = append((*dstValue)[:0], b...)
 		if len(b) == 0 {
 			mn.RemoveTag(dstLabel)
@@ -919,19 +1237,10 @@ func transformRound(tfa *transformFuncArg) ([]*timeseries, error) {
 		return nil, err
 	}
 	tf := func(values []float64) {
-		var nPrev float64
-		var p10 float64
+		// Round half up like Prometheus does, so round(-2.5) = -2.
 		for i, v := range values {
-			n := nearest[i]
-			if n != nPrev {
-				nPrev = n
-				_, e := decimal.FromFloat(n)
-				p10 = math.Pow10(int(-e))
-			}
-			v += 0.5 * math.Copysign(n, v)
-			v -= math.Mod(v, n)
-			v, _ = math.Modf(v * p10)
-			values[i] = v / p10
+			nearestInverse := 1 / nearest[i]
+			values[i] = math.Floor(v*nearestInverse+0.5) / nearestInverse
 		}
 	}
 	return doTransformValues(args[0], tf, tfa.fe)
@@ -955,11 +1264,30 @@ func transformScalar(tfa *transformFuncArg) ([]*timeseries, error) {
 
 	// The arg isn't a string. Extract scalar from it.
 	arg := args[0]
-	if len(arg) != 1 {
-		return evalNumber(tfa.ec, nan), nil
+	if len(arg) == 1 {
+		arg[0].MetricName.Reset()
+		return arg, nil
+	}
+
+	// Calculate the scalar individually per each point like Prometheus does.
+	// It equals to the only non-NaN value at the point. It is NaN if the point
+	// has zero or multiple non-NaN values.
+	rvs := evalNumber(tfa.ec, nan)
+	values := rvs[0].Values
+	for i := range values {
+		n := 0
+		v := nan
+		for _, ts := range arg {
+			if !math.IsNaN(ts.Values[i]) {
+				n++
+				v = ts.Values[i]
+			}
+		}
+		if n == 1 {
+			values[i] = v
+		}
 	}
-	arg[0].MetricName.Reset()
-	return arg, nil
+	return rvs, nil
 }
 
 func newTransformFuncSort(isDesc bool) transformFunc {
@@ -992,6 +1320,96 @@ func newTransformFuncSort(isDesc bool) transformFunc {
 	}
 }
 
+// newTransformFuncSortByLabel returns a func for sorting series by the given labels.
+//
+// Numbers inside label values are compared by value if isNumeric is set, so `host2` goes before `host10`.
+// Series without the label go last regardless of isDesc. The sort is stable.
+func newTransformFuncSortByLabel(isDesc, isNumeric bool) transformFunc {
+	return func(tfa *transformFuncArg) ([]*timeseries, error) {
+		args := tfa.args
+		if len(args) < 2 {
+			return nil, fmt.Errorf(`not enough args; got %d; want at least %d`, len(args), 2)
+		}
+		var labels []string
+		for i := 1; i < len(args); i++ {
+			label, err := getString(args[i], i)
+			if err != nil {
+				return nil, err
+			}
+			labels = append(labels, label)
+		}
+		rvs := args[0]
+		sort.SliceStable(rvs, func(i, j int) bool {
+			for _, label := range labels {
+				a := rvs[i].MetricName.GetTagValue(label)
+				b := rvs[j].MetricName.GetTagValue(label)
+				if string(a) == string(b) {
+					continue
+				}
+				if len(a) == 0 {
+					return false
+				}
+				if len(b) == 0 {
+					return true
+				}
+				n := 0
+				if isNumeric {
+					n = compareNumericAware(string(a), string(b))
+				}
+				if n == 0 {
+					n = strings.Compare(string(a), string(b))
+				}
+				if isDesc {
+					return n > 0
+				}
+				return n < 0
+			}
+			return false
+		})
+		return rvs, nil
+	}
+}
+
+// compareNumericAware compares a with b, while comparing digit sequences by their numeric values.
+//
+// It returns 0 if a and b are equal when ignoring leading zeros in numbers.
+func compareNumericAware(a, b string) int {
+	for len(a) > 0 && len(b) > 0 {
+		if !isDigit(a[0]) || !isDigit(b[0]) {
+			if a[0] != b[0] {
+				return int(a[0]) - int(b[0])
+			}
+			a = a[1:]
+			b = b[1:]
+			continue
+		}
+		na, nb := digitsPrefixLen(a), digitsPrefixLen(b)
+		da := strings.TrimLeft(a[:na], "0")
+		db := strings.TrimLeft(b[:nb], "0")
+		if len(da) != len(db) {
+			return len(da) - len(db)
+		}
+		if n := strings.Compare(da, db); n != 0 {
+			return n
+		}
+		a = a[na:]
+		b = b[nb:]
+	}
+	return len(a) - len(b)
+}
+
+func digitsPrefixLen(s string) int {
+	n := 0
+	for n < len(s) && isDigit(s[n]) {
+		n++
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
 func transformSqrt(v float64) float64 {
 	return math.Sqrt(v)
 }
@@ -0,0 +1,33 @@
+package promql
+
+import (
+	"testing"
+)
+
+func TestCompareNumericAware(t *testing.T) {
+	f := func(a, b string, resultExpected int) {
+		t.Helper()
+		result := compareNumericAware(a, b)
+		if result < 0 {
+			result = -1
+		} else if result > 0 {
+			result = 1
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for compareNumericAware(%q, %q); got %d; want %d", a, b, result, resultExpected)
+		}
+	}
+	f("", "", 0)
+	f("", "a", -1)
+	f("a", "b", -1)
+	f("2", "10", -1)
+	f("10", "2", 1)
+	f("host2", "host10", -1)
+	f("host10", "host10", 0)
+	f("host010", "host10", 0)
+	f("host10a", "host10b", -1)
+	f("host10.5", "host10.20", -1)
+	f("a1b2", "a1b10", -1)
+	f("abc", "ab1", 1)
+	f("1.2.3.4:9100", "1.2.3.10:9100", -1)
+}
@@ -0,0 +1,168 @@
+package vmstorage
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/backup"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+var (
+	backupS3Endpoint = flag.String("backup.s3Endpoint", "", "S3-compatible object storage url for uploading snapshots via /snapshot/backup and for -restore.backupName. "+
+		"For example, https://s3.amazonaws.com or http://minio:9000 . Backups are disabled if empty")
+	backupS3Region    = flag.String("backup.s3Region", "us-east-1", "Region for the -backup.s3Endpoint")
+	backupS3AccessKey = flag.String("backup.s3AccessKey", "", "Access key for the -backup.s3Endpoint. AWS_ACCESS_KEY_ID env var is used if empty. "+
+		"Requests aren't signed if both are empty")
+	backupS3SecretKey = flag.String("backup.s3SecretKey", "", "Secret key for the -backup.s3Endpoint. AWS_SECRET_ACCESS_KEY env var is used if empty")
+	backupBucket      = flag.String("backup.bucket", "", "Bucket for backups at -backup.s3Endpoint")
+	backupPrefix      = flag.String("backup.prefix", "", "Optional prefix for backups in -backup.bucket. Backups are stored at <prefix>/<backupName>/")
+	backupConcurrency = flag.Int("backup.concurrency", 10, "The number of files to upload or download concurrently during backup and restore")
+	backupChecksum    = flag.Bool("backup.checksum", false, "Whether to calculate checksums for the uploaded files. Unchanged files are detected only by their size if disabled. "+
+		"Downloaded files are verified against their checksums during restore if enabled")
+
+	restoreBackupName = flag.String("restore.backupName", "", "The name of the backup to download from -backup.s3Endpoint into -storageDataPath at startup. "+
+		"-storageDataPath must be empty or missing, so the existing data isn't overwritten")
+)
+
+func getBackupConfig() (*backup.Config, error) {
+	if len(*backupS3Endpoint) == 0 {
+		return nil, fmt.Errorf("backups are disabled; set -backup.s3Endpoint and -backup.bucket command-line flags for enabling them")
+	}
+	if len(*backupBucket) == 0 {
+		return nil, fmt.Errorf("-backup.bucket must be set")
+	}
+	accessKey := *backupS3AccessKey
+	if len(accessKey) == 0 {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	secretKey := *backupS3SecretKey
+	if len(secretKey) == 0 {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	cfg := &backup.Config{
+		Client: &backup.S3Client{
+			Endpoint:  *backupS3Endpoint,
+			Bucket:    *backupBucket,
+			Region:    *backupS3Region,
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+		},
+		Prefix:      *backupPrefix,
+		Concurrency: *backupConcurrency,
+		Checksum:    *backupChecksum,
+	}
+	return cfg, nil
+}
+
+// backupSnapshot uploads the snapshot with the given snapshotName to the backup with the given backupName.
+//
+// The snapshot contains hardlinks to immutable parts, so the upload doesn't interfere with background merges.
+func backupSnapshot(snapshotName, backupName string) (*backup.Stats, error) {
+	cfg, err := getBackupConfig()
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := Storage.ListSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list snapshots: %s", err)
+	}
+	if !containsString(snapshots, snapshotName) {
+		return nil, fmt.Errorf("cannot find snapshot %q", snapshotName)
+	}
+	snapshotPath := filepath.Join(*DataPath, "snapshots", snapshotName)
+	logger.Infof("uploading snapshot %q to backup %q...", snapshotPath, backupName)
+	startTime := time.Now()
+	stats, err := backup.Backup(cfg, snapshotPath, backupName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot upload snapshot %q to backup %q: %s", snapshotName, backupName, err)
+	}
+	logger.Infof("uploaded snapshot %q to backup %q in %s; uploaded %d files (%d bytes); skipped %d unchanged files (%d bytes); deleted %d stale files",
+		snapshotPath, backupName, time.Since(startTime), stats.FilesCopied, stats.BytesCopied, stats.FilesSkipped, stats.BytesSkipped, stats.FilesDeleted)
+	return stats, nil
+}
+
+// restoreBackupIfNeeded downloads -restore.backupName into -storageDataPath.
+//
+// It must be called before opening the storage.
+func restoreBackupIfNeeded() {
+	if len(*restoreBackupName) == 0 {
+		return
+	}
+	cfg, err := getBackupConfig()
+	if err != nil {
+		logger.Fatalf("cannot restore backup %q: %s", *restoreBackupName, err)
+	}
+	if !isEmptyDir(*DataPath) {
+		logger.Fatalf("cannot restore backup %q into non-empty -storageDataPath=%q; remove its contents or drop -restore.backupName command-line flag",
+			*restoreBackupName, *DataPath)
+	}
+	coldPath := ""
+	if len(*coldDataPath) > 0 {
+		coldPath = filepath.Join(*coldDataPath, "data")
+		if !isEmptyDir(coldPath) {
+			logger.Fatalf("cannot restore backup %q into non-empty %q at -coldStorageDataPath", *restoreBackupName, coldPath)
+		}
+	}
+	logger.Infof("restoring backup %q into %q...", *restoreBackupName, *DataPath)
+	startTime := time.Now()
+	stats, err := backup.Restore(cfg, *restoreBackupName, func(path string) string {
+		return getRestorePath(*DataPath, coldPath, path)
+	})
+	if err != nil {
+		logger.Fatalf("cannot restore backup %q into %q: %s", *restoreBackupName, *DataPath, err)
+	}
+	logger.Infof("restored backup %q into %q in %s; downloaded %d files (%d bytes)",
+		*restoreBackupName, *DataPath, time.Since(startTime), stats.FilesCopied, stats.BytesCopied)
+}
+
+// getRestorePath returns local path for the given path inside the backup.
+//
+// Backups have the layout of storage snapshots, i.e. data/small, data/big, data/cold and indexdb dirs.
+// Cold parts are restored to coldPath if it isn't empty. Otherwise they are restored to data/big.
+func getRestorePath(dataPath, coldPath, path string) string {
+	const coldPrefix = "data/cold"
+	if path == coldPrefix || strings.HasPrefix(path, coldPrefix+"/") {
+		suffix := path[len(coldPrefix):]
+		if len(coldPath) > 0 {
+			return filepath.Join(coldPath, "big"+suffix)
+		}
+		return filepath.Join(dataPath, "data/big"+suffix)
+	}
+	return filepath.Join(dataPath, path)
+}
+
+func isEmptyDir(path string) bool {
+	d, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true
+		}
+		logger.Fatalf("cannot open %q: %s", path, err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	_, err = d.Readdirnames(1)
+	if err == io.EOF {
+		return true
+	}
+	if err != nil {
+		logger.Fatalf("cannot read %q: %s", path, err)
+	}
+	return false
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package vmstorage
+
+import (
+	"testing"
+)
+
+func TestGetRestorePath(t *testing.T) {
+	f := func(coldPath, path, resultExpected string) {
+		t.Helper()
+		result := getRestorePath("/data", coldPath, path)
+		if result != resultExpected {
+			t.Fatalf("unexpected restore path for %q; got %q; want %q", path, result, resultExpected)
+		}
+	}
+	f("", "indexdb/15A2B3C4D5E6F708/part", "/data/indexdb/15A2B3C4D5E6F708/part")
+	f("", "data/small/2019_01/part/values.bin", "/data/data/small/2019_01/part/values.bin")
+	f("", "data/cold", "/data/data/big")
+	f("", "data/cold/2019_01/part/values.bin", "/data/data/big/2019_01/part/values.bin")
+	f("", "data/colder/foo", "/data/data/colder/foo")
+	f("/cold/data", "data/cold", "/cold/data/big")
+	f("/cold/data", "data/cold/2019_01/part/values.bin", "/cold/data/big/2019_01/part/values.bin")
+	f("/cold/data", "data/big/2019_01/part/values.bin", "/data/data/big/2019_01/part/values.bin")
+}
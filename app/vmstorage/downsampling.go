@@ -0,0 +1,76 @@
+package vmstorage
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/flagutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/selector"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+var (
+	downsamplingPeriods flagutil.Array
+	downsamplingAggr    = flag.String("downsampling.aggregate", "last", "Aggregate for samples falling into a single -downsampling.period interval. "+
+		"Supported values: last, min, max, sum")
+)
+
+func init() {
+	flag.Var(&downsamplingPeriods, "downsampling.period", "Comma-separated downsampling periods in the form `[series_selector:]offset:interval`, e.g. `30d:5m,180d:1h`. "+
+		"Samples older than the offset are collapsed to a single sample per interval. "+
+		"Periods with series selector such as `{job=\"node\"}:30d:1m` are applied only to the matching time series. "+
+		"Time series are downsampled according to the first matching series selector; time series without matching selectors are downsampled according to periods without selector. "+
+		"The flag may be passed multiple times. Downsampling is disabled if the flag isn't set")
+}
+
+func initDownsampling() {
+	periods, err := parseDownsamplingPeriods(downsamplingPeriods)
+	if err != nil {
+		logger.Fatalf("invalid -downsampling.period: %s", err)
+	}
+	if err := storage.SetDownsamplingPeriods(periods, *downsamplingAggr); err != nil {
+		logger.Fatalf("cannot set downsampling periods: %s", err)
+	}
+}
+
+// parseDownsamplingPeriods parses downsampling periods in the form `[series_selector:]offset:interval` such as `30d:5m` or `{job="foo"}:30d:5m`.
+func parseDownsamplingPeriods(ss []string) ([]storage.DownsamplingPeriod, error) {
+	var periods []storage.DownsamplingPeriod
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		// Series selector may contain `:` chars, so parse the period from the end.
+		n := strings.LastIndexByte(s, ':')
+		if n < 0 {
+			return nil, fmt.Errorf("missing `:` in %q; expecting `[series_selector:]offset:interval`", s)
+		}
+		interval, err := parseRetention(s[n+1:])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse interval in %q: %s", s, err)
+		}
+		prefix := s[:n]
+		var tfs []storage.TagFilter
+		n = strings.LastIndexByte(prefix, ':')
+		if n >= 0 {
+			tfs, err = selector.Parse(strings.TrimSpace(prefix[:n]))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse series selector in %q: %s", s, err)
+			}
+			prefix = prefix[n+1:]
+		}
+		offset, err := parseRetention(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse offset in %q: %s", s, err)
+		}
+		periods = append(periods, storage.DownsamplingPeriod{
+			TagFilters: tfs,
+			Offset:     offset,
+			Interval:   interval,
+		})
+	}
+	return periods, nil
+}
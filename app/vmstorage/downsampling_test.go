@@ -0,0 +1,92 @@
+package vmstorage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestParseDownsamplingPeriodsSuccess(t *testing.T) {
+	f := func(ss []string, periodsExpected []storage.DownsamplingPeriod) {
+		t.Helper()
+		periods, err := parseDownsamplingPeriods(ss)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(periods, periodsExpected) {
+			t.Fatalf("unexpected downsampling periods\ngot\n%v\nwant\n%v", periods, periodsExpected)
+		}
+	}
+	f(nil, nil)
+	f([]string{""}, nil)
+	f([]string{"30d:5m"}, []storage.DownsamplingPeriod{{
+		Offset:   30 * 24 * time.Hour,
+		Interval: 5 * time.Minute,
+	}})
+	f([]string{"30d:5m", " 180d:1h"}, []storage.DownsamplingPeriod{
+		{
+			Offset:   30 * 24 * time.Hour,
+			Interval: 5 * time.Minute,
+		},
+		{
+			Offset:   180 * 24 * time.Hour,
+			Interval: time.Hour,
+		},
+	})
+
+	// Series selectors
+	f([]string{`{job="foo",instance=~"bar:.+"}:30d:5m`, `node_cpu:180d:1h`}, []storage.DownsamplingPeriod{
+		{
+			TagFilters: []storage.TagFilter{
+				{
+					Key:   []byte("job"),
+					Value: []byte("foo"),
+				},
+				{
+					Key:      []byte("instance"),
+					Value:    []byte("bar:.+"),
+					IsRegexp: true,
+				},
+			},
+			Offset:   30 * 24 * time.Hour,
+			Interval: 5 * time.Minute,
+		},
+		{
+			TagFilters: []storage.TagFilter{{
+				Value: []byte("node_cpu"),
+			}},
+			Offset:   180 * 24 * time.Hour,
+			Interval: time.Hour,
+		},
+	})
+}
+
+func TestParseDownsamplingPeriodsError(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseDownsamplingPeriods([]string{s}); err == nil {
+			t.Fatalf("expecting non-nil error for %q", s)
+		}
+	}
+
+	// Missing interval
+	f("30d")
+	f("30d:")
+
+	// Missing offset
+	f(":5m")
+
+	// Invalid durations
+	f("30x:5m")
+	f("30d:5x")
+	f("-30d:5m")
+	f("30d:0m")
+
+	// Invalid series selectors
+	f(":30d:5m")
+	f("{job=foo}:30d:5m")
+	f(`{job="foo"}30d:5m`)
+	f(`{job="foo"}:30d`)
+}
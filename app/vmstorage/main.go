@@ -17,20 +17,169 @@ import (
 )
 
 var (
-	retentionPeriod = flag.Int("retentionPeriod", 1, "Retention period in months")
+	retentionPeriod  = flag.Int("retentionPeriod", 1, "Retention period in months")
+	indexDBRetention = flag.Duration("storage.indexDBRetention", 0, "The interval for indexdb rotation. Inactive time series are removed from the index searched by default "+
+		"after up to two such intervals, while their data remains searchable until -retentionPeriod via slower lookups in the rotated-out indexdb tables. "+
+		"This may speed up searches under high churn rate for time series. indexdb is rotated every -retentionPeriod if set to 0 or if it exceeds -retentionPeriod")
 	snapshotAuthKey = flag.String("snapshotAuthKey", "", "authKey, which must be passed in query string to /snapshot* pages")
 
+	minScrapeInterval = flag.Duration("dedup.minScrapeInterval", 0, "Leave only the last sample in every time series per each interval with this duration. "+
+		"This may be useful for reducing overhead when multiple identically configured Prometheus instances write data to the same VictoriaMetrics. "+
+		"Deduplication is disabled if the -dedup.minScrapeInterval is 0")
+
 	precisionBits = flag.Int("precisionBits", 64, "The number of precision bits to store per each value. Lower precision bits improves data compression at the cost of precision loss")
 
+	exactValuesMetricNameRegexp = flag.String("storage.exactValuesMetricNameRegexp", "", "Regexp for metric names, which values must be stored as raw float64 values without precision loss. "+
+		"This may be useful for metrics with monetary values, which cannot tolerate rounding errors. Such values occupy more disk space. "+
+		"The regexp is anchored to the whole metric name. -precisionBits isn't applied to the matching metrics")
+
+	compressLevel = flag.Int("storage.compressLevel", 0, "The zstd compression level for data blocks in the range [-22...22]. "+
+		"The compression level is automatically selected depending on the block size if -storage.compressLevel is 0. "+
+		"Negative values reduce CPU usage during merges at the cost of bigger disk space usage, while higher values improve compression ratio at the cost of higher CPU usage")
+
+	tsidCacheSize = flag.Int("storage.cacheSizeTSID", 0, "Overrides the max size in bytes for storage/tsid cache. "+
+		"The size is automatically calculated from the allowed memory (see -memory.allowedPercent) if set to 0")
+	metricIDCacheSize = flag.Int("storage.cacheSizeMetricID", 0, "Overrides the max size in bytes for storage/metricIDs cache. "+
+		"The size is automatically calculated from the allowed memory (see -memory.allowedPercent) if set to 0")
+	metricNameCacheSize = flag.Int("storage.cacheSizeMetricName", 0, "Overrides the max size in bytes for storage/metricName cache. "+
+		"The size is automatically calculated from the allowed memory (see -memory.allowedPercent) if set to 0")
+	dateMetricIDCacheSize = flag.Int("storage.cacheSizeDateMetricID", 0, "Overrides the max size in bytes for storage/date_metricID cache. "+
+		"The size is automatically calculated from the allowed memory (see -memory.allowedPercent) if set to 0")
+
+	maxOutOfOrderWindow = flag.Duration("storage.maxOutOfOrderWindow", 0, "The maximum duration samples may lag behind the latest ingested sample for the same series. "+
+		"Samples lagging behind by more than this duration are dropped. Samples are accepted regardless of their order if set to 0")
+
+	maxFutureSampleTimestamp = flag.Duration("storage.maxFutureSampleTimestamp", 10*time.Minute, "The maximum duration sample timestamps may be ahead of the current time. "+
+		"Samples with bigger timestamps are dropped or clamped depending on -storage.futureSampleTimestampAction. "+
+		"Samples are accepted regardless of their timestamps if set to 0")
+	futureSampleTimestampAction = flag.String("storage.futureSampleTimestampAction", "drop", "Action for samples with timestamps exceeding -storage.maxFutureSampleTimestamp. "+
+		"Possible values: drop, clamp. Timestamps are set to the current time plus -storage.maxFutureSampleTimestamp if set to clamp")
+
+	maxHourlySeries = flag.Int("storage.maxHourlySeries", 0, "The maximum number of new series, which may be created during an hour. Samples for new series exceeding the limit are dropped, "+
+		"while samples for already existing series are accepted. The limit is disabled if set to 0. See also -storage.maxDailySeries")
+	maxDailySeries = flag.Int("storage.maxDailySeries", 0, "The maximum number of new series, which may be created during a day. Samples for new series exceeding the limit are dropped, "+
+		"while samples for already existing series are accepted. The limit is disabled if set to 0. See also -storage.maxHourlySeries")
+
+	maxMetricNameLen = flag.Int("maxMetricNameLen", 16*1024, "The maximum length of metric name. Samples with longer metric names are dropped. "+
+		"See also -maxLabelNameLen, -maxLabelValueLen and -maxLabelsPerTimeseries")
+	maxLabelNameLen        = flag.Int("maxLabelNameLen", 256, "The maximum length of label name. Samples with longer label names are dropped")
+	maxLabelValueLen       = flag.Int("maxLabelValueLen", 16*1024, "The maximum length of label value. Samples with longer label values are dropped")
+	maxLabelsPerTimeseries = flag.Int("maxLabelsPerTimeseries", 30, "The maximum number of labels per time series including metric name. "+
+		"Samples with more labels are dropped")
+
+	maxCandidateSeries = flag.Int("search.maxCandidateSeries", 0, "The maximum number of candidate time series, which may be scanned on the selected time range "+
+		"when all the tag filters in the query match too many time series. By default it equals to 20*-search.maxUniqueTimeseries")
+
+	mergeConcurrency = flag.Int("storage.mergeConcurrency", 0, "The number of concurrent background merge workers per each monthly partition for small parts, "+
+		"for big parts and per each indexdb table. Lower values reduce disk and CPU usage by merges, so queries may become faster during heavy ingestion, "+
+		"while higher values speed up merges on systems with fast disks. By default it is automatically calculated from the number of available CPU cores")
+
+	inmemoryDataFlushInterval = flag.Duration("storage.inmemoryDataFlushInterval", 5*time.Second, "The interval for flushing recently ingested in-memory data to disk. "+
+		"Lower values reduce the amount of data lost on unclean shutdown such as OOM crash or hardware reset at the cost of higher disk IO. "+
+		"Higher values reduce write amplification. The minimum supported interval is 1s")
+
+	walEnabled = flag.Bool("storage.wal", false, "Whether to write ingested rows to write-ahead log before acknowledging them, so they are recovered on startup after unclean shutdown. "+
+		"The log is truncated after the rows are flushed to disk every -storage.inmemoryDataFlushInterval. See also -storage.walSyncInterval")
+	walSyncInterval = flag.Duration("storage.walSyncInterval", 0, "The interval for syncing write-ahead log to disk when -storage.wal is set. "+
+		"Inserts are acknowledged only after the log is synced if it is set to 0, while concurrent inserts share a single sync. "+
+		"Higher values reduce disk IO at the cost of losing the rows ingested during the last interval on hardware reset")
+
+	minFreeDiskSpaceBytes = flag.Int64("storage.minFreeDiskSpaceBytes", 0, "The minimum free disk space at -storageDataPath. The storage switches to read-only mode "+
+		"when the free disk space drops below this value, so inserts are rejected with 503 Service Unavailable, while queries and background merges continue working. "+
+		"Writes are resumed automatically when the free disk space becomes bigger than this value. The limit is disabled if set to 0")
+
 	// DataPath is a path to storage data.
 	DataPath = flag.String("storageDataPath", "victoria-metrics-data", "Path to storage data")
+
+	coldDataPath = flag.String("coldStorageDataPath", "", "Optional path to cold storage data. Monthly partitions with all the data older than -coldStorageAge "+
+		"are moved in background from -storageDataPath to this path. Queries transparently search data at both paths. "+
+		"The path cannot be removed after the data has been moved to it")
+	coldAge = flag.Duration("coldStorageAge", 24*time.Hour, "Monthly partitions are moved to -coldStorageDataPath when their end is older than this duration")
 )
 
+func checkLabelLimitFlag(flagName string, n int) {
+	if n <= 0 || n > storage.MaxLabelLenLimit {
+		logger.Fatalf("invalid `-%s`: %d; it must be in the range [1 ... %d]", flagName, n, storage.MaxLabelLenLimit)
+	}
+}
+
 // Init initializes vmstorage.
-func Init() {
+//
+// resetCacheIfNeeded is called on every AddRows call, so it may reset
+// response caches if the added rows may affect already cached responses.
+//
+// The progress of opening the storage is reported via httpserver.SetStartupPhase,
+// so the caller must call httpserver.SetReady after the initialization is complete.
+func Init(resetCacheIfNeeded func(mrs []storage.MetricRow)) {
+	resetResponseCacheIfNeeded = resetCacheIfNeeded
 	if err := encoding.CheckPrecisionBits(uint8(*precisionBits)); err != nil {
 		logger.Fatalf("invalid `-precisionBits`: %s", err)
 	}
+	if err := encoding.CheckCompressLevel(*compressLevel); err != nil {
+		logger.Fatalf("invalid `-storage.compressLevel`: %s", err)
+	}
+	encoding.SetCompressLevel(*compressLevel)
+	if err := storage.SetExactValuesMetricNameRegexp(*exactValuesMetricNameRegexp); err != nil {
+		logger.Fatalf("invalid `-storage.exactValuesMetricNameRegexp`: %s", err)
+	}
+	storage.SetMinScrapeIntervalForDeduplication(*minScrapeInterval)
+	if *maxOutOfOrderWindow < 0 {
+		logger.Fatalf("invalid `-storage.maxOutOfOrderWindow`: %s; it cannot be negative", *maxOutOfOrderWindow)
+	}
+	storage.SetMaxOutOfOrderWindow(*maxOutOfOrderWindow)
+	if *maxFutureSampleTimestamp < 0 {
+		logger.Fatalf("invalid `-storage.maxFutureSampleTimestamp`: %s; it cannot be negative", *maxFutureSampleTimestamp)
+	}
+	switch *futureSampleTimestampAction {
+	case "drop", "clamp":
+	default:
+		logger.Fatalf("invalid `-storage.futureSampleTimestampAction`: %q; supported values are: drop, clamp", *futureSampleTimestampAction)
+	}
+	storage.SetMaxFutureSampleTimestamp(*maxFutureSampleTimestamp, *futureSampleTimestampAction == "clamp")
+	if *maxHourlySeries < 0 || *maxDailySeries < 0 {
+		logger.Fatalf("invalid `-storage.maxHourlySeries`=%d or `-storage.maxDailySeries`=%d; they cannot be negative", *maxHourlySeries, *maxDailySeries)
+	}
+	storage.SetSeriesLimits(*maxHourlySeries, *maxDailySeries)
+	checkLabelLimitFlag("maxMetricNameLen", *maxMetricNameLen)
+	checkLabelLimitFlag("maxLabelNameLen", *maxLabelNameLen)
+	checkLabelLimitFlag("maxLabelValueLen", *maxLabelValueLen)
+	checkLabelLimitFlag("maxLabelsPerTimeseries", *maxLabelsPerTimeseries)
+	storage.SetLabelLimits(*maxMetricNameLen, *maxLabelNameLen, *maxLabelValueLen, *maxLabelsPerTimeseries)
+	if len(*coldDataPath) > 0 {
+		if *coldAge < 0 {
+			logger.Fatalf("invalid `-coldStorageAge`: %s; it cannot be negative", *coldAge)
+		}
+		logger.Infof("moving partitions older than %s to cold storage at %q", *coldAge, *coldDataPath)
+	}
+	storage.SetColdStorage(*coldDataPath, *coldAge)
+	storage.SetCacheSizes(*tsidCacheSize, *metricIDCacheSize, *metricNameCacheSize, *dateMetricIDCacheSize)
+	storage.SetMaxCandidateMetrics(*maxCandidateSeries)
+	if *mergeConcurrency < 0 {
+		logger.Fatalf("invalid `-storage.mergeConcurrency`: %d; it cannot be negative", *mergeConcurrency)
+	}
+	storage.SetMergeConcurrency(*mergeConcurrency)
+	if *inmemoryDataFlushInterval < time.Second {
+		logger.Fatalf("invalid `-storage.inmemoryDataFlushInterval`: %s; it cannot be smaller than 1s", *inmemoryDataFlushInterval)
+	}
+	storage.SetInmemoryDataFlushInterval(*inmemoryDataFlushInterval)
+	if *walSyncInterval < 0 {
+		logger.Fatalf("invalid `-storage.walSyncInterval`: %s; it cannot be negative", *walSyncInterval)
+	}
+	storage.SetWAL(*walEnabled, *walSyncInterval)
+	if *minFreeDiskSpaceBytes < 0 {
+		logger.Fatalf("invalid `-storage.minFreeDiskSpaceBytes`: %d; it cannot be negative", *minFreeDiskSpaceBytes)
+	}
+	storage.SetMinFreeDiskSpaceBytes(*minFreeDiskSpaceBytes)
+	if *indexDBRetention < 0 {
+		logger.Fatalf("invalid `-storage.indexDBRetention`: %s; it cannot be negative", *indexDBRetention)
+	}
+	storage.SetIndexDBRetention(*indexDBRetention)
+	storage.SetOpenPhaseCallback(func(phase string) {
+		httpserver.SetStartupPhase("opening storage: " + phase)
+	})
+	initDownsampling()
+	httpserver.SetStartupPhase("restoring backup")
+	restoreBackupIfNeeded()
 	logger.Infof("opening storage at %q with retention period %d months", *DataPath, *retentionPeriod)
 	startTime := time.Now()
 	strg, err := storage.OpenStorage(*DataPath, *retentionPeriod)
@@ -38,6 +187,8 @@ func Init() {
 		logger.Fatalf("cannot open a storage at %s with retention period %d months: %s", *DataPath, *retentionPeriod, err)
 	}
 	Storage = strg
+	initRetentionFilters()
+	initMetricsMetadata()
 
 	var m storage.Metrics
 	Storage.UpdateMetrics(&m)
@@ -49,6 +200,12 @@ func Init() {
 		*DataPath, time.Since(startTime), partsCount, blocksCount, rowsCount)
 
 	registerStorageMetrics(Storage)
+	httpserver.RegisterHealthDetailsFunc(func() string {
+		if IsReadOnly() {
+			return fmt.Sprintf("storage: read-only mode, since free disk space at %q is below -storage.minFreeDiskSpaceBytes=%d", *DataPath, *minFreeDiskSpaceBytes)
+		}
+		return ""
+	})
 }
 
 // Storage is a storage.
@@ -62,8 +219,18 @@ var Storage *storage.Storage
 // Use syncwg instead of sync, since Add is called from concurrent goroutines.
 var WG syncwg.WaitGroup
 
+var resetResponseCacheIfNeeded func(mrs []storage.MetricRow)
+
+// IsReadOnly returns true if the storage is in read-only mode because of low free disk space.
+//
+// See -storage.minFreeDiskSpaceBytes.
+func IsReadOnly() bool {
+	return Storage.IsReadOnly()
+}
+
 // AddRows adds mrs to the storage.
 func AddRows(mrs []storage.MetricRow) error {
+	resetResponseCacheIfNeeded(mrs)
 	WG.Add(1)
 	err := Storage.AddRows(mrs, uint8(*precisionBits))
 	WG.Done()
@@ -96,6 +263,30 @@ func SearchTagValues(tagKey []byte, maxTagValues int) ([]string, error) {
 	return values, err
 }
 
+// SearchTagKeysOnTimeRange searches for tag keys for time series matching tfss on the given tr.
+func SearchTagKeysOnTimeRange(tfss []*storage.TagFilters, tr storage.TimeRange, maxTagKeys, maxMetrics int) ([]string, error) {
+	WG.Add(1)
+	keys, err := Storage.SearchTagKeysOnTimeRange(tfss, tr, maxTagKeys, maxMetrics)
+	WG.Done()
+	return keys, err
+}
+
+// SearchTagValuesOnTimeRange searches for tag values for the given tagKey for time series matching tfss on the given tr.
+func SearchTagValuesOnTimeRange(tagKey []byte, tfss []*storage.TagFilters, tr storage.TimeRange, maxTagValues, maxMetrics int) ([]string, error) {
+	WG.Add(1)
+	values, err := Storage.SearchTagValuesOnTimeRange(tagKey, tfss, tr, maxTagValues, maxMetrics)
+	WG.Done()
+	return values, err
+}
+
+// SearchMetricNames returns up to limit metric names for time series matching tfss on the given tr.
+func SearchMetricNames(tfss []*storage.TagFilters, tr storage.TimeRange, limit, maxMetrics int) ([]storage.MetricName, bool, error) {
+	WG.Add(1)
+	mns, isLimited, err := Storage.SearchMetricNames(tfss, tr, limit, maxMetrics)
+	WG.Done()
+	return mns, isLimited, err
+}
+
 // SearchTagEntries searches for tag entries.
 func SearchTagEntries(maxTagKeys, maxTagValues int) ([]storage.TagEntry, error) {
 	WG.Add(1)
@@ -112,11 +303,20 @@ func GetSeriesCount() (uint64, error) {
 	return n, err
 }
 
+// GetTSDBStatusForDate returns TSDB status for the given date.
+func GetTSDBStatusForDate(date uint64, topN int) (*storage.TSDBStatus, error) {
+	WG.Add(1)
+	status, err := Storage.GetTSDBStatusForDate(date, topN)
+	WG.Done()
+	return status, err
+}
+
 // Stop stops the vmstorage
 func Stop() {
 	logger.Infof("gracefully closing the storage at %s", *DataPath)
 	startTime := time.Now()
 	WG.WaitAndBlock()
+	stopRetentionFilters()
 	Storage.MustClose()
 	logger.Infof("successfully closed the storage in %s", time.Since(startTime))
 
@@ -187,6 +387,20 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 		}
 		fmt.Fprintf(w, `{"status":"ok"}`)
 		return true
+	case "/backup":
+		w.Header().Set("Content-Type", "application/json")
+		snapshotName := r.FormValue("snapshot")
+		backupName := r.FormValue("backup")
+		stats, err := backupSnapshot(snapshotName, backupName)
+		if err != nil {
+			msg := fmt.Sprintf("cannot backup snapshot %q: %s", snapshotName, err)
+			logger.Errorf("%s", msg)
+			fmt.Fprintf(w, `{"status":"error","msg":%q}`, msg)
+			return true
+		}
+		fmt.Fprintf(w, `{"status":"ok","filesUploaded":%d,"bytesUploaded":%d,"filesSkipped":%d,"bytesSkipped":%d,"filesDeleted":%d}`,
+			stats.FilesCopied, stats.BytesCopied, stats.FilesSkipped, stats.BytesSkipped, stats.FilesDeleted)
+		return true
 	case "/delete_all":
 		w.Header().Set("Content-Type", "application/json")
 		snapshots, err := Storage.ListSnapshots()
@@ -305,6 +519,78 @@ func registerStorageMetrics(strg *storage.Storage) {
 	metrics.NewGauge(`vm_date_metric_ids_search_hits_total`, func() float64 {
 		return float64(idbm().DateMetricIDsSearchHits)
 	})
+	metrics.NewGauge(`vm_out_of_order_rows_total{type="reordered"}`, func() float64 {
+		return float64(m().OutOfOrderRowsReordered)
+	})
+	metrics.NewGauge(`vm_out_of_order_rows_total{type="dropped"}`, func() float64 {
+		return float64(m().OutOfOrderRowsDropped)
+	})
+	metrics.NewGauge(`vm_future_timestamp_rows_total{type="dropped"}`, func() float64 {
+		return float64(m().FutureTimestampRowsDropped)
+	})
+	metrics.NewGauge(`vm_future_timestamp_rows_total{type="clamped"}`, func() float64 {
+		return float64(m().FutureTimestampRowsClamped)
+	})
+	metrics.NewGauge(`vm_storage_is_read_only`, func() float64 {
+		return float64(m().IsReadOnly)
+	})
+	metrics.NewGauge(`vm_wal_bytes_written_total`, func() float64 {
+		return float64(m().WALBytesWritten)
+	})
+	metrics.NewGauge(`vm_wal_syncs_total`, func() float64 {
+		return float64(m().WALSyncs)
+	})
+	metrics.NewGauge(`vm_wal_rows_replayed_total`, func() float64 {
+		return float64(m().WALRowsReplayed)
+	})
+	metrics.NewGauge(`vm_indexdb_rotations_total`, func() float64 {
+		return float64(m().IndexDBRotations)
+	})
+	metrics.NewGauge(`vm_indexdb_archived_tables`, func() float64 {
+		return float64(m().ArchivedIndexDBs)
+	})
+	metrics.NewGauge(`vm_indexdb_archived_tables_dropped_total`, func() float64 {
+		return float64(m().ArchivedIndexDBsDropped)
+	})
+	metrics.NewGauge(`vm_indexdb_archived_searches_total`, func() float64 {
+		return float64(m().ArchivedIndexDBSearches)
+	})
+	metrics.NewGauge(`vm_hourly_series_limit_rows_dropped_total`, func() float64 {
+		return float64(m().HourlySeriesLimitRowsDropped)
+	})
+	metrics.NewGauge(`vm_hourly_series_limit_max_series`, func() float64 {
+		return float64(m().HourlySeriesLimitMaxSeries)
+	})
+	metrics.NewGauge(`vm_hourly_series_limit_current_series`, func() float64 {
+		return float64(m().HourlySeriesLimitCurrentSeries)
+	})
+	metrics.NewGauge(`vm_daily_series_limit_rows_dropped_total`, func() float64 {
+		return float64(m().DailySeriesLimitRowsDropped)
+	})
+	metrics.NewGauge(`vm_daily_series_limit_max_series`, func() float64 {
+		return float64(m().DailySeriesLimitMaxSeries)
+	})
+	metrics.NewGauge(`vm_daily_series_limit_current_series`, func() float64 {
+		return float64(m().DailySeriesLimitCurrentSeries)
+	})
+	metrics.NewGauge(`vm_label_limit_rows_dropped_total{reason="too_long_metric_name"}`, func() float64 {
+		return float64(m().TooLongMetricNameRowsDropped)
+	})
+	metrics.NewGauge(`vm_label_limit_rows_dropped_total{reason="too_long_label_name"}`, func() float64 {
+		return float64(m().TooLongLabelNameRowsDropped)
+	})
+	metrics.NewGauge(`vm_label_limit_rows_dropped_total{reason="too_long_label_value"}`, func() float64 {
+		return float64(m().TooLongLabelValueRowsDropped)
+	})
+	metrics.NewGauge(`vm_label_limit_rows_dropped_total{reason="too_many_labels"}`, func() float64 {
+		return float64(m().TooManyLabelsRowsDropped)
+	})
+	metrics.NewGauge(`vm_negative_only_searches_total`, func() float64 {
+		return float64(idbm().NegativeOnlySearches)
+	})
+	metrics.NewGauge(`vm_limited_series_search_candidates_total`, func() float64 {
+		return float64(idbm().LimitedSeriesSearchCandidates)
+	})
 
 	metrics.NewGauge(`vm_assisted_merges_total{type="storage/small"}`, func() float64 {
 		return float64(tm().SmallAssistedMerges)
@@ -329,6 +615,24 @@ func registerStorageMetrics(strg *storage.Storage) {
 	metrics.NewGauge(`vm_parts{type="indexdb"}`, func() float64 {
 		return float64(idbm().PartsCount)
 	})
+	metrics.NewGauge(`vm_parts_not_in_merge{type="storage/big"}`, func() float64 {
+		return float64(tm().BigPartsNotInMerge)
+	})
+	metrics.NewGauge(`vm_parts_not_in_merge{type="storage/small"}`, func() float64 {
+		return float64(tm().SmallPartsNotInMerge)
+	})
+	metrics.NewGauge(`vm_parts_not_in_merge{type="indexdb"}`, func() float64 {
+		return float64(idbm().PartsNotInMerge)
+	})
+	metrics.NewGauge(`vm_inmemory_parts{type="storage"}`, func() float64 {
+		return float64(tm().InmemoryPartsCount)
+	})
+	metrics.NewGauge(`vm_cold_parts{type="storage"}`, func() float64 {
+		return float64(tm().ColdPartsCount)
+	})
+	metrics.NewGauge(`vm_cold_parts_moved_total{type="storage"}`, func() float64 {
+		return float64(tm().ColdPartsMoved)
+	})
 
 	metrics.NewGauge(`vm_blocks{type="storage/big"}`, func() float64 {
 		return float64(tm().BigBlocksCount)
@@ -339,6 +643,9 @@ func registerStorageMetrics(strg *storage.Storage) {
 	metrics.NewGauge(`vm_blocks{type="indexdb"}`, func() float64 {
 		return float64(idbm().BlocksCount)
 	})
+	metrics.NewGauge(`vm_cold_blocks{type="storage"}`, func() float64 {
+		return float64(tm().ColdBlocksCount)
+	})
 
 	metrics.NewGauge(`vm_rows{type="storage/big"}`, func() float64 {
 		return float64(tm().BigRowsCount)
@@ -346,9 +653,24 @@ func registerStorageMetrics(strg *storage.Storage) {
 	metrics.NewGauge(`vm_rows{type="storage/small"}`, func() float64 {
 		return float64(tm().SmallRowsCount)
 	})
+	metrics.NewGauge(`vm_inmemory_rows{type="storage"}`, func() float64 {
+		return float64(tm().InmemoryRowsCount)
+	})
 	metrics.NewGauge(`vm_rows{type="indexdb"}`, func() float64 {
 		return float64(idbm().ItemsCount)
 	})
+	metrics.NewGauge(`vm_rows{type="indexdb/archived"}`, func() float64 {
+		return float64(m().ArchivedIndexDBTableMetrics.ItemsCount)
+	})
+	metrics.NewGauge(`vm_data_size_bytes{type="indexdb"}`, func() float64 {
+		return float64(idbm().SizeBytes)
+	})
+	metrics.NewGauge(`vm_data_size_bytes{type="indexdb/archived"}`, func() float64 {
+		return float64(m().ArchivedIndexDBTableMetrics.SizeBytes)
+	})
+	metrics.NewGauge(`vm_cold_rows{type="storage"}`, func() float64 {
+		return float64(tm().ColdRowsCount)
+	})
 
 	metrics.NewGauge(`vm_cache_entries{type="storage/tsid"}`, func() float64 {
 		return float64(m().TSIDCacheSize)
@@ -362,6 +684,9 @@ func registerStorageMetrics(strg *storage.Storage) {
 	metrics.NewGauge(`vm_cache_entries{type="storage/date_metricID"}`, func() float64 {
 		return float64(m().DateMetricIDCacheSize)
 	})
+	metrics.NewGauge(`vm_cache_entries{type="storage/latestTimestamp"}`, func() float64 {
+		return float64(m().LatestTimestampCacheSize)
+	})
 	metrics.NewGauge(`vm_cache_entries{type="storage/bigIndexBlocks"}`, func() float64 {
 		return float64(tm().BigIndexBlocksCacheSize)
 	})
@@ -396,6 +721,9 @@ func registerStorageMetrics(strg *storage.Storage) {
 	metrics.NewGauge(`vm_cache_size_bytes{type="storage/date_metricID"}`, func() float64 {
 		return float64(m().DateMetricIDCacheBytesSize)
 	})
+	metrics.NewGauge(`vm_cache_size_bytes{type="storage/latestTimestamp"}`, func() float64 {
+		return float64(m().LatestTimestampCacheBytesSize)
+	})
 	metrics.NewGauge(`vm_cache_size_bytes{type="indexdb/tagFilters"}`, func() float64 {
 		return float64(idbm().TagCacheBytesSize)
 	})
@@ -403,6 +731,19 @@ func registerStorageMetrics(strg *storage.Storage) {
 		return float64(idbm().UselessTagFiltersCacheBytesSize)
 	})
 
+	metrics.NewGauge(`vm_cache_size_max_bytes{type="storage/tsid"}`, func() float64 {
+		return float64(m().TSIDCacheMaxBytesSize)
+	})
+	metrics.NewGauge(`vm_cache_size_max_bytes{type="storage/metricIDs"}`, func() float64 {
+		return float64(m().MetricIDCacheMaxBytesSize)
+	})
+	metrics.NewGauge(`vm_cache_size_max_bytes{type="storage/metricName"}`, func() float64 {
+		return float64(m().MetricNameCacheMaxBytesSize)
+	})
+	metrics.NewGauge(`vm_cache_size_max_bytes{type="storage/date_metricID"}`, func() float64 {
+		return float64(m().DateMetricIDCacheMaxBytesSize)
+	})
+
 	metrics.NewGauge(`vm_cache_requests_total{type="storage/tsid"}`, func() float64 {
 		return float64(m().TSIDCacheRequests)
 	})
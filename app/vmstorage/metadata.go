@@ -0,0 +1,52 @@
+package vmstorage
+
+import (
+	"flag"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/metricsmetadata"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxMetadataEntries = flag.Int("storage.maxMetadataEntries", 100000, "The maximum number of metric metadata entries (type, help and unit per metric family and target) "+
+	"to keep in memory for /api/v1/metadata and /api/v1/targets/metadata. The least recently updated entries are evicted when the limit is reached. "+
+	"Metadata isn't stored if set to 0")
+
+// metricsMetadata contains metadata obtained from scraped targets and from imported data.
+var metricsMetadata *metricsmetadata.Storage
+
+func initMetricsMetadata() {
+	metricsMetadata = metricsmetadata.NewStorage(*maxMetadataEntries)
+
+	m := func() *metricsmetadata.Metrics {
+		var m metricsmetadata.Metrics
+		metricsMetadata.UpdateMetrics(&m)
+		return &m
+	}
+	metrics.NewGauge(`vm_metrics_metadata_entries`, func() float64 {
+		return float64(m().Entries)
+	})
+	metrics.NewGauge(`vm_metrics_metadata_evictions_total`, func() float64 {
+		return float64(m().Evictions)
+	})
+}
+
+// AddMetricsMetadata adds metadata rows obtained from the given target.
+//
+// target must be empty for metadata obtained via import APIs.
+func AddMetricsMetadata(target []metricsmetadata.Label, rows []metricsmetadata.Row) {
+	metricsMetadata.Add(target, rows)
+}
+
+// GetMetricsMetadata returns metadata for up to limit metric families.
+//
+// Only metadata for metricFamilyName is returned if it isn't empty.
+func GetMetricsMetadata(metricFamilyName string, limit int) map[string][]metricsmetadata.Row {
+	return metricsMetadata.Get(metricFamilyName, limit)
+}
+
+// GetTargetsMetadata returns up to limit metadata rows for targets matching matchTarget.
+//
+// Only metadata for metricFamilyName is returned if it isn't empty.
+func GetTargetsMetadata(matchTarget func(target []metricsmetadata.Label) bool, metricFamilyName string, limit int) []metricsmetadata.TargetRow {
+	return metricsMetadata.GetTargetMetadata(matchTarget, metricFamilyName, limit)
+}
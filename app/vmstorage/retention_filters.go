@@ -0,0 +1,143 @@
+package vmstorage
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/selector"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+var retentionFiltersFile = flag.String("retentionFiltersFile", "", "Optional path to file with per-series retention filters. "+
+	"Each line must contain a series selector followed by retention, e.g. `{job=\"debug\"} 7d`. "+
+	"The first matching filter is applied to each time series. Time series without matching filters are kept for -retentionPeriod. "+
+	"The file is re-read on SIGHUP")
+
+func initRetentionFilters() {
+	if len(*retentionFiltersFile) == 0 {
+		return
+	}
+	if err := loadRetentionFilters(*retentionFiltersFile); err != nil {
+		logger.Fatalf("cannot load -retentionFiltersFile=%q: %s", *retentionFiltersFile, err)
+	}
+	sighupCh := procutil.NewSighupChan()
+	retentionFiltersReloaderWG.Add(1)
+	go func() {
+		defer retentionFiltersReloaderWG.Done()
+		for {
+			select {
+			case <-retentionFiltersReloaderStopCh:
+				return
+			case <-sighupCh:
+			}
+			logger.Infof("SIGHUP received; reloading -retentionFiltersFile=%q", *retentionFiltersFile)
+			if err := loadRetentionFilters(*retentionFiltersFile); err != nil {
+				logger.Errorf("cannot reload -retentionFiltersFile=%q; continuing using the previous filters: %s", *retentionFiltersFile, err)
+			}
+		}
+	}()
+}
+
+func stopRetentionFilters() {
+	close(retentionFiltersReloaderStopCh)
+	retentionFiltersReloaderWG.Wait()
+}
+
+var (
+	retentionFiltersReloaderStopCh = make(chan struct{})
+	retentionFiltersReloaderWG     sync.WaitGroup
+)
+
+func loadRetentionFilters(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rfs, err := parseRetentionFilters(data)
+	if err != nil {
+		return err
+	}
+	if err := Storage.SetRetentionFilters(rfs); err != nil {
+		return err
+	}
+	logger.Infof("loaded %d retention filters from %q", len(rfs), path)
+	return nil
+}
+
+// parseRetentionFilters parses retention filters from data.
+//
+// Each non-empty line must contain `<series_selector> <retention>`.
+// Lines starting with `#` are ignored.
+func parseRetentionFilters(data []byte) ([]storage.RetentionFilter, error) {
+	var rfs []storage.RetentionFilter
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		n := strings.LastIndexAny(line, " \t")
+		if n < 0 {
+			return nil, fmt.Errorf("line %d: missing retention in %q; expecting `<series_selector> <retention>`", lineNum, line)
+		}
+		tfs, err := selector.Parse(strings.TrimSpace(line[:n]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: cannot parse series selector: %s", lineNum, err)
+		}
+		retention, err := parseRetention(line[n+1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: cannot parse retention: %s", lineNum, err)
+		}
+		rfs = append(rfs, storage.RetentionFilter{
+			TagFilters: tfs,
+			Retention:  retention,
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rfs, nil
+}
+
+// parseRetention parses retention such as `30s`, `12h`, `7d`, `4w` or `1y`.
+func parseRetention(s string) (time.Duration, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid retention %q", s)
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	case 'y':
+		unit = 365 * 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("unknown unit in retention %q; supported units: s, m, h, d, w, y", s)
+	}
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse retention %q: %s", s, err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("retention must be positive; got %q", s)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
@@ -0,0 +1,121 @@
+package vmstorage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestParseRetentionFiltersSuccess(t *testing.T) {
+	f := func(s string, rfsExpected []storage.RetentionFilter) {
+		t.Helper()
+		rfs, err := parseRetentionFilters([]byte(s))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(rfs, rfsExpected) {
+			t.Fatalf("unexpected retention filters\ngot\n%v\nwant\n%v", rfs, rfsExpected)
+		}
+	}
+	f("", nil)
+	f("# comment\n\n  ", nil)
+	f(`foo 1d`, []storage.RetentionFilter{{
+		TagFilters: []storage.TagFilter{{
+			Value: []byte("foo"),
+		}},
+		Retention: 24 * time.Hour,
+	}})
+	f(`{__name__="foo:bar", job!="x"}  2w`, []storage.RetentionFilter{{
+		TagFilters: []storage.TagFilter{
+			{
+				Value: []byte("foo:bar"),
+			},
+			{
+				Key:        []byte("job"),
+				Value:      []byte("x"),
+				IsNegative: true,
+			},
+		},
+		Retention: 14 * 24 * time.Hour,
+	}})
+
+	// The order of filters must be preserved, since the first matching filter is applied.
+	f(`
+# Debug metrics
+{job="debug"} 3d
+metric{env=~"prod|staging", instance!~"test.+"} 1.5h
+{job=~".+"} 1y
+`, []storage.RetentionFilter{
+		{
+			TagFilters: []storage.TagFilter{{
+				Key:   []byte("job"),
+				Value: []byte("debug"),
+			}},
+			Retention: 3 * 24 * time.Hour,
+		},
+		{
+			TagFilters: []storage.TagFilter{
+				{
+					Value: []byte("metric"),
+				},
+				{
+					Key:      []byte("env"),
+					Value:    []byte("prod|staging"),
+					IsRegexp: true,
+				},
+				{
+					Key:        []byte("instance"),
+					Value:      []byte("test.+"),
+					IsRegexp:   true,
+					IsNegative: true,
+				},
+			},
+			Retention: 90 * time.Minute,
+		},
+		{
+			TagFilters: []storage.TagFilter{{
+				Key:      []byte("job"),
+				Value:    []byte(".+"),
+				IsRegexp: true,
+			}},
+			Retention: 365 * 24 * time.Hour,
+		},
+	})
+}
+
+func TestParseRetentionFiltersError(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		rfs, err := parseRetentionFilters([]byte(s))
+		if err == nil {
+			t.Fatalf("expecting non-nil error for %q", s)
+		}
+		if rfs != nil {
+			t.Fatalf("expecting nil rfs; got %v", rfs)
+		}
+	}
+
+	// Missing retention
+	f(`foo`)
+	f(`{job="foo"}`)
+
+	// Invalid retention
+	f(`foo 1`)
+	f(`foo 1x`)
+	f(`foo -1d`)
+	f(`foo 0s`)
+	f(`foo xd`)
+
+	// Invalid selector
+	f(`{} 1d`)
+	f(`{job="foo" 1d`)
+	f(`{job=foo} 1d`)
+	f(`{job~"foo"} 1d`)
+	f(`{job="foo" env="bar"} 1d`)
+	f(`{1job="foo"} 1d`)
+	f(`{job=~"foo("} 1d`)
+	f(`foo-bar 1d`)
+	f(`{job="foo"}x 1d`)
+}
@@ -11,6 +11,7 @@ require (
 	github.com/valyala/histogram v1.0.1
 	github.com/valyala/quicktemplate v1.1.1
 	golang.org/x/sys v0.0.0-20190531175056-4c3a928424d2
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 go 1.12
@@ -0,0 +1,395 @@
+// Package backup implements uploading storage snapshots to S3-compatible object storage and restoring them back.
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// Config is the configuration for Backup and Restore.
+type Config struct {
+	// Client is the client for the object storage.
+	Client *S3Client
+
+	// Prefix is an optional prefix for object keys. Backups are stored at Prefix/backupName/ .
+	Prefix string
+
+	// Concurrency is the number of files to upload or download concurrently.
+	Concurrency int
+
+	// Checksum enables calculating checksums for the uploaded files.
+	//
+	// Files with size matching the already uploaded files are skipped
+	// only if their checksums match. Downloaded files are verified against
+	// their checksums during restore.
+	Checksum bool
+}
+
+// Stats contains stats for Backup and Restore calls.
+type Stats struct {
+	// FilesCopied is the number of uploaded or downloaded files.
+	FilesCopied uint64
+
+	// BytesCopied is the number of uploaded or downloaded bytes.
+	BytesCopied uint64
+
+	// FilesSkipped is the number of files skipped during incremental upload,
+	// since they already exist in the object storage.
+	FilesSkipped uint64
+
+	// BytesSkipped is the size of skipped files.
+	BytesSkipped uint64
+
+	// FilesDeleted is the number of stale files deleted from the object storage.
+	FilesDeleted uint64
+}
+
+// manifestName is the name of the file with the list of backup contents.
+//
+// The manifest is uploaded after all the other files, so backups without
+// the manifest are incomplete.
+const manifestName = "manifest.json"
+
+type manifest struct {
+	Dirs  []string   `json:"dirs"`
+	Files []fileInfo `json:"files"`
+}
+
+type fileInfo struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Backup uploads the contents of snapshotPath to the backup with the given backupName.
+//
+// Symlinks in snapshotPath are followed, so snapshot dirs pointing to the hardlinked parts are uploaded.
+// Files already uploaded to the backup by the previous calls are skipped, so repeated uploads
+// to the same backupName are incremental. Files missing in snapshotPath are deleted from the backup.
+//
+// snapshotPath mustn't be modified during the upload.
+func Backup(cfg *Config, snapshotPath, backupName string) (*Stats, error) {
+	if err := checkBackupName(backupName); err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := walkDir(&m, snapshotPath, ""); err != nil {
+		return nil, fmt.Errorf("cannot read snapshot at %q: %s", snapshotPath, err)
+	}
+	backupPrefix := cfg.backupPrefix(backupName)
+	prevManifest, err := cfg.readManifest(backupName)
+	if err != nil {
+		return nil, err
+	}
+	prevChecksums := make(map[string]string)
+	if prevManifest != nil {
+		for _, fi := range prevManifest.Files {
+			prevChecksums[fi.Path] = fi.Checksum
+		}
+	}
+	ois, err := cfg.Client.ListObjects(backupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	remoteSizes := make(map[string]int64, len(ois))
+	for _, oi := range ois {
+		remoteSizes[strings.TrimPrefix(oi.Key, backupPrefix)] = oi.Size
+	}
+
+	// Delete the manifest, so the backup is marked as incomplete until all the files are uploaded.
+	if err := cfg.Client.DeleteObject(backupPrefix + manifestName); err != nil {
+		return nil, err
+	}
+
+	var stats Stats
+	err = cfg.runConcurrent(len(m.Files), func(i int) error {
+		fi := &m.Files[i]
+		path := filepath.Join(snapshotPath, fi.Path)
+		if cfg.Checksum {
+			checksum, err := getFileChecksum(path)
+			if err != nil {
+				return err
+			}
+			fi.Checksum = checksum
+		}
+		if size, ok := remoteSizes[fi.Path]; ok && size == fi.Size {
+			if checksum, ok := prevChecksums[fi.Path]; !cfg.Checksum || ok && checksum == fi.Checksum {
+				atomic.AddUint64(&stats.FilesSkipped, 1)
+				atomic.AddUint64(&stats.BytesSkipped, uint64(fi.Size))
+				return nil
+			}
+		}
+		if err := cfg.uploadFile(path, backupPrefix+fi.Path, fi.Size); err != nil {
+			return err
+		}
+		atomic.AddUint64(&stats.FilesCopied, 1)
+		atomic.AddUint64(&stats.BytesCopied, uint64(fi.Size))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	localFiles := make(map[string]bool, len(m.Files))
+	for _, fi := range m.Files {
+		localFiles[fi.Path] = true
+	}
+	for _, oi := range ois {
+		path := strings.TrimPrefix(oi.Key, backupPrefix)
+		if localFiles[path] || path == manifestName {
+			continue
+		}
+		if err := cfg.Client.DeleteObject(oi.Key); err != nil {
+			return nil, err
+		}
+		stats.FilesDeleted++
+	}
+
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal manifest: %s", err)
+	}
+	if err := cfg.Client.PutObject(backupPrefix+manifestName, strings.NewReader(string(data)), int64(len(data))); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Restore downloads the backup with the given backupName.
+//
+// getDstPath must return local path for the given relative path inside the backup.
+// It is called for both dirs and files. Dirs are created before downloading the files.
+func Restore(cfg *Config, backupName string, getDstPath func(path string) string) (*Stats, error) {
+	if err := checkBackupName(backupName); err != nil {
+		return nil, err
+	}
+	m, err := cfg.readManifest(backupName)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("backup %q doesn't exist at %q or it is incomplete", backupName, cfg.backupPrefix(backupName))
+	}
+	for _, dir := range m.Dirs {
+		dstPath := getDstPath(dir)
+		if err := os.MkdirAll(dstPath, 0755); err != nil {
+			return nil, fmt.Errorf("cannot create dir %q: %s", dstPath, err)
+		}
+	}
+	backupPrefix := cfg.backupPrefix(backupName)
+	var stats Stats
+	err = cfg.runConcurrent(len(m.Files), func(i int) error {
+		fi := &m.Files[i]
+		if err := cfg.downloadFile(backupPrefix+fi.Path, getDstPath(fi.Path), fi); err != nil {
+			return err
+		}
+		atomic.AddUint64(&stats.FilesCopied, 1)
+		atomic.AddUint64(&stats.BytesCopied, uint64(fi.Size))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func checkBackupName(backupName string) error {
+	if len(backupName) == 0 {
+		return fmt.Errorf("backup name cannot be empty")
+	}
+	if strings.ContainsAny(backupName, "/\\") || backupName == "." || backupName == ".." {
+		return fmt.Errorf("invalid backup name %q; it cannot contain slashes", backupName)
+	}
+	return nil
+}
+
+func (cfg *Config) backupPrefix(backupName string) string {
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if len(prefix) == 0 {
+		return backupName + "/"
+	}
+	return prefix + "/" + backupName + "/"
+}
+
+// readManifest returns manifest for the given backupName.
+//
+// nil is returned if the backup doesn't exist or it is incomplete.
+func (cfg *Config) readManifest(backupName string) (*manifest, error) {
+	key := cfg.backupPrefix(backupName) + manifestName
+	r, err := cfg.Client.GetObject(key)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", key, err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %s", key, err)
+	}
+	return &m, nil
+}
+
+// runConcurrent calls f for indexes in the range [0..n) from up to cfg.Concurrency goroutines.
+//
+// It returns the first error returned by f.
+func (cfg *Config) runConcurrent(n int, f func(i int) error) error {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	workCh := make(chan int, n)
+	for i := 0; i < n; i++ {
+		workCh <- i
+	}
+	close(workCh)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	var failed uint32
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range workCh {
+				if atomic.LoadUint32(&failed) != 0 {
+					// Drain the remaining work after the first error.
+					continue
+				}
+				if err := f(i); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						atomic.StoreUint32(&failed, 1)
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (cfg *Config) uploadFile(path, key string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %s", path, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return cfg.Client.PutObject(key, f, size)
+}
+
+func (cfg *Config) downloadFile(key, dstPath string, fi *fileInfo) error {
+	r, err := cfg.Client.GetObject(key)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %s", dstPath, err)
+	}
+	h := xxhash.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot download %q to %q: %s", key, dstPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot sync %q: %s", dstPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %s", dstPath, err)
+	}
+	if n != fi.Size {
+		return fmt.Errorf("unexpected size for %q; got %d bytes; want %d bytes", key, n, fi.Size)
+	}
+	if cfg.Checksum && len(fi.Checksum) > 0 {
+		if checksum := formatChecksum(h.Sum64()); checksum != fi.Checksum {
+			return fmt.Errorf("checksum mismatch for %q; got %s; want %s", key, checksum, fi.Checksum)
+		}
+	}
+	return nil
+}
+
+func getFileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot open %q: %s", path, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := xxhash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("cannot read %q: %s", path, err)
+	}
+	return formatChecksum(h.Sum64()), nil
+}
+
+func formatChecksum(h uint64) string {
+	return strconv.FormatUint(h, 16)
+}
+
+// walkDir adds dirs and files from rootPath/path to m.
+//
+// Symlinks are followed.
+func walkDir(m *manifest, rootPath, path string) error {
+	dirPath := filepath.Join(rootPath, path)
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		return fmt.Errorf("cannot read dir %q: %s", dirPath, err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		subPath := name
+		if len(path) > 0 {
+			subPath = path + "/" + name
+		}
+		fi, err := os.Stat(filepath.Join(rootPath, subPath))
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			m.Dirs = append(m.Dirs, subPath)
+			if err := walkDir(m, rootPath, subPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		m.Files = append(m.Files, fileInfo{
+			Path: subPath,
+			Size: fi.Size(),
+		})
+	}
+	return nil
+}
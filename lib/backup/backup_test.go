@@ -0,0 +1,295 @@
+package backup
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	fs := newFakeS3()
+	defer fs.Close()
+
+	tmpDir, err := ioutil.TempDir("", "TestBackupRestore")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	// Create snapshot with symlinks pointing to the hardlinked parts.
+	partsPath := filepath.Join(tmpDir, "parts")
+	snapshotPath := filepath.Join(tmpDir, "snapshot")
+	mustWriteFile(t, filepath.Join(partsPath, "2019_01", "part1", "values.bin"), "values1")
+	mustWriteFile(t, filepath.Join(partsPath, "2019_01", "part1", "metadata.json"), "{}")
+	mustWriteFile(t, filepath.Join(partsPath, "2019_01", "part2", "values.bin"), "")
+	mustMkdir(t, filepath.Join(partsPath, "2019_02"))
+	mustMkdir(t, filepath.Join(snapshotPath, "data"))
+	if err := os.Symlink(partsPath, filepath.Join(snapshotPath, "data", "big")); err != nil {
+		t.Fatalf("cannot create symlink: %s", err)
+	}
+
+	cfg := &Config{
+		Client: &S3Client{
+			Endpoint: fs.URL,
+			Bucket:   "bucket",
+		},
+		Prefix:      "/prefix/",
+		Concurrency: 2,
+		Checksum:    true,
+	}
+	f := func(statsExpected *Stats) {
+		t.Helper()
+		stats, err := Backup(cfg, snapshotPath, "foo")
+		if err != nil {
+			t.Fatalf("unexpected error in Backup: %s", err)
+		}
+		if !reflect.DeepEqual(stats, statsExpected) {
+			t.Fatalf("unexpected stats;\ngot\n%+v\nwant\n%+v", stats, statsExpected)
+		}
+	}
+
+	// The initial backup uploads all the files.
+	f(&Stats{
+		FilesCopied: 3,
+		BytesCopied: 9,
+	})
+	keysExpected := []string{
+		"prefix/foo/data/big/2019_01/part1/metadata.json",
+		"prefix/foo/data/big/2019_01/part1/values.bin",
+		"prefix/foo/data/big/2019_01/part2/values.bin",
+		"prefix/foo/manifest.json",
+	}
+	if keys := fs.Keys(); !reflect.DeepEqual(keys, keysExpected) {
+		t.Fatalf("unexpected keys;\ngot\n%q\nwant\n%q", keys, keysExpected)
+	}
+
+	// The subsequent backup skips unchanged files.
+	f(&Stats{
+		FilesSkipped: 3,
+		BytesSkipped: 9,
+	})
+
+	// Changed files are uploaded, while missing files are deleted.
+	mustWriteFile(t, filepath.Join(partsPath, "2019_01", "part1", "values.bin"), "values2")
+	if err := os.RemoveAll(filepath.Join(partsPath, "2019_01", "part2")); err != nil {
+		t.Fatalf("cannot remove part: %s", err)
+	}
+	mustWriteFile(t, filepath.Join(partsPath, "2019_02", "part3", "values.bin"), "values3")
+	f(&Stats{
+		FilesCopied:  2,
+		BytesCopied:  14,
+		FilesSkipped: 1,
+		BytesSkipped: 2,
+		FilesDeleted: 1,
+	})
+
+	// Restore the backup.
+	dstPath := filepath.Join(tmpDir, "restored")
+	getDstPath := func(path string) string {
+		return filepath.Join(dstPath, path)
+	}
+	stats, err := Restore(cfg, "foo", getDstPath)
+	if err != nil {
+		t.Fatalf("unexpected error in Restore: %s", err)
+	}
+	if stats.FilesCopied != 3 || stats.BytesCopied != 16 {
+		t.Fatalf("unexpected stats for Restore: %+v", stats)
+	}
+	mustHaveFile(t, filepath.Join(dstPath, "data", "big", "2019_01", "part1", "values.bin"), "values2")
+	mustHaveFile(t, filepath.Join(dstPath, "data", "big", "2019_01", "part1", "metadata.json"), "{}")
+	mustHaveFile(t, filepath.Join(dstPath, "data", "big", "2019_02", "part3", "values.bin"), "values3")
+	if _, err := os.Stat(filepath.Join(dstPath, "data", "big", "2019_01", "part2")); !os.IsNotExist(err) {
+		t.Fatalf("deleted part mustn't be restored")
+	}
+
+	// Corrupted files must be detected during restore.
+	fs.Set("prefix/foo/data/big/2019_02/part3/values.bin", "values4")
+	if err := os.RemoveAll(dstPath); err != nil {
+		t.Fatalf("cannot remove %q: %s", dstPath, err)
+	}
+	if _, err := Restore(cfg, "foo", getDstPath); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expecting checksum mismatch error; got %v", err)
+	}
+
+	// Missing backup cannot be restored.
+	if _, err := Restore(cfg, "bar", getDstPath); err == nil {
+		t.Fatalf("expecting non-nil error when restoring missing backup")
+	}
+
+	// Invalid backup names must be rejected.
+	if _, err := Backup(cfg, snapshotPath, "foo/bar"); err == nil {
+		t.Fatalf("expecting non-nil error for invalid backup name")
+	}
+}
+
+func TestRunConcurrent(t *testing.T) {
+	f := func(concurrency, n int) {
+		t.Helper()
+		cfg := &Config{
+			Concurrency: concurrency,
+		}
+		var mu sync.Mutex
+		var calls []int
+		err := cfg.runConcurrent(n, func(i int) error {
+			mu.Lock()
+			calls = append(calls, i)
+			mu.Unlock()
+			if i == 3 {
+				return fmt.Errorf("error for %d", i)
+			}
+			return nil
+		})
+		if n > 3 {
+			if err == nil || err.Error() != "error for 3" {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(calls) != n {
+			t.Fatalf("unexpected number of calls; got %d; want %d", len(calls), n)
+		}
+	}
+	f(0, 0)
+	f(1, 3)
+	f(10, 2)
+	f(1, 10)
+	f(4, 100)
+}
+
+func mustWriteFile(t *testing.T, path, data string) {
+	t.Helper()
+	mustMkdir(t, filepath.Dir(path))
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+}
+
+func mustMkdir(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("cannot create %q: %s", path, err)
+	}
+}
+
+func mustHaveFile(t *testing.T, path, dataExpected string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", path, err)
+	}
+	if string(data) != dataExpected {
+		t.Fatalf("unexpected contents of %q; got %q; want %q", path, data, dataExpected)
+	}
+}
+
+// fakeS3 is an in-memory S3 server supporting requests issued by S3Client.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func newFakeS3() *fakeS3 {
+	fs := &fakeS3{
+		objects: make(map[string]string),
+	}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.handler))
+	return fs
+}
+
+func (fs *fakeS3) Keys() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var keys []string
+	for k := range fs.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (fs *fakeS3) Set(key, data string) {
+	fs.mu.Lock()
+	fs.objects[key] = data
+	fs.mu.Unlock()
+}
+
+func (fs *fakeS3) handler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/bucket/") {
+		http.Error(w, "missing bucket", http.StatusNotFound)
+		return
+	}
+	key := r.URL.Path[len("/bucket/"):]
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fs.objects[key] = string(data)
+	case "DELETE":
+		delete(fs.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		if len(key) == 0 {
+			fs.list(w, r)
+			return
+		}
+		data, ok := fs.objects[key]
+		if !ok {
+			http.Error(w, "missing object", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns up to 2 objects per response in order to verify pagination.
+func (fs *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("prefix")
+	var keys []string
+	for k := range fs.objects {
+		if strings.HasPrefix(k, prefix) && k > r.FormValue("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var lr listBucketResult
+	if len(keys) > 2 {
+		keys = keys[:2]
+		lr.IsTruncated = true
+		lr.NextContinuationToken = keys[1]
+	}
+	for _, k := range keys {
+		lr.Contents = append(lr.Contents, ObjectInfo{
+			Key:  k,
+			Size: int64(len(fs.objects[k])),
+		})
+	}
+	data, err := xml.Marshal(&lr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(data)
+}
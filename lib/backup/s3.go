@@ -0,0 +1,300 @@
+package backup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Client is a minimal client for S3-compatible object storage.
+//
+// It uses path-style requests, so it works with AWS S3 and with
+// self-hosted S3-compatible storage such as MinIO.
+type S3Client struct {
+	// Endpoint is the object storage url such as https://s3.amazonaws.com or http://minio:9000 .
+	Endpoint string
+
+	// Bucket is the bucket name.
+	Bucket string
+
+	// Region is the region used for request signing.
+	Region string
+
+	// AccessKey and SecretKey are credentials for request signing.
+	//
+	// Requests aren't signed if AccessKey is empty.
+	AccessKey string
+	SecretKey string
+
+	// Client is the http client to use. http.DefaultClient is used if Client is nil.
+	Client *http.Client
+}
+
+// ObjectInfo describes an object stored in S3.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// PutObject uploads size bytes from r to the object with the given key.
+func (c *S3Client) PutObject(key string, r io.Reader, size int64) error {
+	req, err := c.newRequest("PUT", key, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		// Prevent from sending chunked request for empty objects.
+		req.Body = http.NoBody
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("cannot upload %q: %s", key, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// GetObject returns the contents of the object with the given key.
+//
+// The caller must close the returned reader.
+func (c *S3Client) GetObject(key string) (io.ReadCloser, error) {
+	req, err := c.newRequest("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, &statusCodeError{
+				statusCode: http.StatusNotFound,
+				body:       []byte(fmt.Sprintf("missing object %q", key)),
+			}
+		}
+		return nil, fmt.Errorf("cannot download %q: %s", key, err)
+	}
+	return resp.Body, nil
+}
+
+// DeleteObject deletes the object with the given key.
+//
+// It doesn't return error if the object is missing.
+func (c *S3Client) DeleteObject(key string) error {
+	req, err := c.newRequest("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot delete %q: %s", key, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// ListObjects returns all the objects with keys starting from the given prefix.
+func (c *S3Client) ListObjects(prefix string) ([]ObjectInfo, error) {
+	var ois []ObjectInfo
+	continuationToken := ""
+	for {
+		args := url.Values{}
+		args.Set("list-type", "2")
+		args.Set("prefix", prefix)
+		if len(continuationToken) > 0 {
+			args.Set("continuation-token", continuationToken)
+		}
+		req, err := c.newRequest("GET", "", args, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list objects with prefix %q: %s", prefix, err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read list of objects with prefix %q: %s", prefix, err)
+		}
+		var lr listBucketResult
+		if err := xml.Unmarshal(data, &lr); err != nil {
+			return nil, fmt.Errorf("cannot parse list of objects with prefix %q: %s", prefix, err)
+		}
+		ois = append(ois, lr.Contents...)
+		if !lr.IsTruncated || len(lr.NextContinuationToken) == 0 {
+			return ois, nil
+		}
+		continuationToken = lr.NextContinuationToken
+	}
+}
+
+type listBucketResult struct {
+	Contents              []ObjectInfo
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (c *S3Client) newRequest(method, key string, args url.Values, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse endpoint %q: %s", c.Endpoint, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket
+	if len(key) > 0 {
+		u.Path += "/" + key
+	} else {
+		u.Path += "/"
+	}
+	u.RawQuery = args.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request for %q: %s", u, err)
+	}
+	return req, nil
+}
+
+func (c *S3Client) do(req *http.Request) (*http.Response, error) {
+	if len(c.AccessKey) > 0 {
+		signRequest(req, c.AccessKey, c.SecretKey, c.Region, time.Now())
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		return nil, &statusCodeError{
+			statusCode: resp.StatusCode,
+			body:       data,
+		}
+	}
+	return resp, nil
+}
+
+type statusCodeError struct {
+	statusCode int
+	body       []byte
+}
+
+func (e *statusCodeError) Error() string {
+	return fmt.Sprintf("unexpected status code %d; response body: %q", e.statusCode, e.body)
+}
+
+func isNotFoundError(err error) bool {
+	sce, ok := err.(*statusCodeError)
+	return ok && sce.statusCode == http.StatusNotFound
+}
+
+// unsignedPayload is used instead of payload hash, so big files may be uploaded without reading them twice.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signRequest signs req with AWS Signature Version 4.
+//
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signRequest(req *http.Request, accessKey, secretKey, region string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	headers := map[string]string{
+		"host": host,
+	}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for k := range headers {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, k := range headerNames {
+		canonicalHeaders.WriteString(k)
+		canonicalHeaders.WriteByte(':')
+		canonicalHeaders.WriteString(headers[k])
+		canonicalHeaders.WriteByte('\n')
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQueryString(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQueryString(args url.Values) string {
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var a []string
+	for _, k := range keys {
+		vs := append([]string{}, args[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			a = append(a, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(a, "&")
+}
+
+// uriEncode encodes s according to the rules for AWS Signature Version 4.
+func uriEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
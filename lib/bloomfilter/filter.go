@@ -0,0 +1,83 @@
+// Package bloomfilter provides memory-bounded approximate sets.
+package bloomfilter
+
+import (
+	"sync/atomic"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// hashesCount is the number of bits set per item.
+const hashesCount = 4
+
+// bitsPerItem is the number of bits per each item the filter is sized for.
+//
+// This gives false positive rate of around 0.2% when the filter contains
+// the maximum number of items.
+const bitsPerItem = 16
+
+// filter is a Bloom filter, which may be used from concurrent goroutines.
+type filter struct {
+	bits []uint64
+}
+
+func newFilter(maxItems int) *filter {
+	bitsCount := maxItems * bitsPerItem
+	wordsCount := (bitsCount + 63) / 64
+	if wordsCount == 0 {
+		wordsCount = 1
+	}
+	return &filter{
+		bits: make([]uint64, wordsCount),
+	}
+}
+
+// Has returns true if h may be in f.
+func (f *filter) Has(h uint64) bool {
+	bits := f.bits
+	maxBits := uint64(len(bits)) * 64
+	for i := 0; i < hashesCount; i++ {
+		n := nextHash(h, i) % maxBits
+		if atomic.LoadUint64(&bits[n/64])&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds h to f.
+//
+// It returns true if h didn't exist in f.
+func (f *filter) Add(h uint64) bool {
+	bits := f.bits
+	maxBits := uint64(len(bits)) * 64
+	isNew := false
+	for i := 0; i < hashesCount; i++ {
+		n := nextHash(h, i) % maxBits
+		p := &bits[n/64]
+		mask := uint64(1) << (n % 64)
+		for {
+			w := atomic.LoadUint64(p)
+			if w&mask != 0 {
+				break
+			}
+			if atomic.CompareAndSwapUint64(p, w, w|mask) {
+				isNew = true
+				break
+			}
+		}
+	}
+	return isNew
+}
+
+func nextHash(h uint64, i int) uint64 {
+	if i == 0 {
+		return h
+	}
+	var b [9]byte
+	for j := 0; j < 8; j++ {
+		b[j] = byte(h >> (8 * uint(j)))
+	}
+	b[8] = byte(i)
+	return xxhash.Sum64(b[:])
+}
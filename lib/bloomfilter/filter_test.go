@@ -0,0 +1,33 @@
+package bloomfilter
+
+import (
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	const maxItems = 10000
+	f := newFilter(maxItems)
+	for i := 0; i < maxItems; i++ {
+		h := uint64(i) * 0x9E3779B97F4A7C15
+		f.Add(h)
+		if !f.Has(h) {
+			t.Fatalf("missing item %d after adding it", i)
+		}
+	}
+	for i := 0; i < maxItems; i++ {
+		if !f.Has(uint64(i) * 0x9E3779B97F4A7C15) {
+			t.Fatalf("missing item %d", i)
+		}
+	}
+
+	// Verify false positive rate.
+	falsePositives := 0
+	for i := maxItems; i < 2*maxItems; i++ {
+		if f.Has(uint64(i) * 0x9E3779B97F4A7C15) {
+			falsePositives++
+		}
+	}
+	if p := float64(falsePositives) / maxItems; p > 0.01 {
+		t.Fatalf("too high false positive rate; got %.4f; want up to 0.01", p)
+	}
+}
@@ -0,0 +1,155 @@
+package bloomfilter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter limits the number of distinct items, which may be added during the given interval.
+//
+// The number of items is limited over a sliding window: the items added during the previous interval
+// are taken into account proportionally to the part of the sliding window they occupy. This prevents
+// from adding up to 2*maxItems items around interval boundaries. Memory usage doesn't depend on the number
+// of added items, since the items are tracked with a Bloom filter.
+// This means a small share of new items may be mistakenly treated as already added.
+type Limiter struct {
+	maxItems int
+	v        atomic.Value
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewLimiter returns new Limiter, which allows adding up to maxItems distinct items during every refreshInterval.
+//
+// MustStop must be called when the Limiter is no longer needed.
+func NewLimiter(maxItems int, refreshInterval time.Duration) *Limiter {
+	l := &Limiter{
+		maxItems: maxItems,
+		stopCh:   make(chan struct{}),
+	}
+	l.v.Store(newLimiter(maxItems, refreshInterval, 0))
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		t := time.NewTicker(refreshInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				lm := l.v.Load().(*limiter)
+				prevItems := atomic.LoadUint64(&lm.currentItems)
+				l.v.Store(newLimiter(maxItems, refreshInterval, prevItems))
+			case <-l.stopCh:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// MustStop stops the given Limiter.
+func (l *Limiter) MustStop() {
+	close(l.stopCh)
+	l.wg.Wait()
+}
+
+// MaxItems returns the maxItems passed to NewLimiter.
+func (l *Limiter) MaxItems() int {
+	return l.maxItems
+}
+
+// CurrentItems returns the approximate number of distinct items added to l during the sliding window.
+func (l *Limiter) CurrentItems() int {
+	lm := l.v.Load().(*limiter)
+	return int(float64(atomic.LoadUint64(&lm.currentItems)) + lm.prevItemsInWindow())
+}
+
+// CanAdd returns true if the item with the given hash h may be added to l.
+//
+// It doesn't add h to l, so it may be used for checking multiple limiters before adding h to them.
+func (l *Limiter) CanAdd(h uint64) bool {
+	lm := l.v.Load().(*limiter)
+	return lm.CanAdd(h)
+}
+
+// Add adds the item with the given hash h to l.
+//
+// It returns false if h is a new item and the limit on the number of items has been reached.
+// Already added items are always accepted.
+func (l *Limiter) Add(h uint64) bool {
+	lm := l.v.Load().(*limiter)
+	return lm.Add(h)
+}
+
+type limiter struct {
+	currentItems uint64
+	maxItems     uint64
+	f            *filter
+
+	// prevItems is the number of items added during the previous interval.
+	prevItems uint64
+
+	startTime time.Time
+	interval  time.Duration
+}
+
+func newLimiter(maxItems int, interval time.Duration, prevItems uint64) *limiter {
+	return &limiter{
+		maxItems:  uint64(maxItems),
+		f:         newFilter(maxItems),
+		prevItems: prevItems,
+		startTime: time.Now(),
+		interval:  interval,
+	}
+}
+
+// prevItemsInWindow returns the estimated number of items from the previous interval, which belong to the sliding window.
+func (l *limiter) prevItemsInWindow() float64 {
+	if l.prevItems == 0 {
+		return 0
+	}
+	remaining := l.interval - time.Since(l.startTime)
+	if remaining <= 0 {
+		return 0
+	}
+	return float64(l.prevItems) * remaining.Seconds() / l.interval.Seconds()
+}
+
+// maxCurrentItems returns the maximum number of items, which may be added during the current interval.
+func (l *limiter) maxCurrentItems() uint64 {
+	n := float64(l.maxItems) - l.prevItemsInWindow()
+	if n <= 0 {
+		return 0
+	}
+	return uint64(n)
+}
+
+func (l *limiter) CanAdd(h uint64) bool {
+	if l.f.Has(h) {
+		return true
+	}
+	return atomic.LoadUint64(&l.currentItems) < l.maxCurrentItems()
+}
+
+func (l *limiter) Add(h uint64) bool {
+	if l.f.Has(h) {
+		return true
+	}
+	maxItems := l.maxCurrentItems()
+	for {
+		n := atomic.LoadUint64(&l.currentItems)
+		if n >= maxItems {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&l.currentItems, n, n+1) {
+			break
+		}
+	}
+	if !l.f.Add(h) {
+		// h has been added by a concurrent goroutine.
+		atomic.AddUint64(&l.currentItems, ^uint64(0))
+	}
+	return true
+}
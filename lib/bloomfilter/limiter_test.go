@@ -0,0 +1,125 @@
+package bloomfilter
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	const maxItems = 1000
+	l := NewLimiter(maxItems, time.Hour)
+	defer l.MustStop()
+	if n := l.MaxItems(); n != maxItems {
+		t.Fatalf("unexpected MaxItems; got %d; want %d", n, maxItems)
+	}
+	accepted := 0
+	for i := 0; i < 2*maxItems; i++ {
+		if l.Add(uint64(i)) {
+			accepted++
+		}
+	}
+	// Some items may be mistakenly treated as already added because of Bloom filter false positives.
+	if accepted < maxItems || accepted > maxItems+maxItems/50 {
+		t.Fatalf("unexpected number of accepted items; got %d; want %d", accepted, maxItems)
+	}
+	if n := l.CurrentItems(); n != maxItems {
+		t.Fatalf("unexpected CurrentItems; got %d; want %d", n, maxItems)
+	}
+	// Already added items must be accepted after reaching the limit.
+	for i := 0; i < maxItems/2; i++ {
+		if !l.Add(uint64(i)) {
+			t.Fatalf("already added item %d must be accepted", i)
+		}
+	}
+}
+
+func TestLimiterRefresh(t *testing.T) {
+	l := NewLimiter(1, 10*time.Millisecond)
+	defer l.MustStop()
+	if !l.Add(1) {
+		t.Fatalf("the first item must be accepted")
+	}
+	if l.Add(2) {
+		t.Fatalf("the second item must be rejected")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.Add(2) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the limiter hasn't been refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	const maxItems = 1000
+	l := NewLimiter(maxItems, time.Hour)
+	defer l.MustStop()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2*maxItems; i++ {
+				l.Add(uint64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := l.CurrentItems(); n > maxItems {
+		t.Fatalf("too many items; got %d; want up to %d", n, maxItems)
+	}
+}
+
+func TestLimiterCanAdd(t *testing.T) {
+	l := NewLimiter(1, time.Hour)
+	defer l.MustStop()
+	if !l.CanAdd(1) {
+		t.Fatalf("the first item must be allowed")
+	}
+	// CanAdd mustn't add items.
+	if n := l.CurrentItems(); n != 0 {
+		t.Fatalf("unexpected CurrentItems after CanAdd; got %d; want 0", n)
+	}
+	if !l.Add(1) {
+		t.Fatalf("the first item must be accepted")
+	}
+	if !l.CanAdd(1) {
+		t.Fatalf("already added item must be allowed")
+	}
+	if l.CanAdd(2) {
+		t.Fatalf("the second item must be rejected")
+	}
+}
+
+func TestLimiterSlidingWindow(t *testing.T) {
+	const maxItems = 100
+	f := func(prevItems uint64, elapsed time.Duration, acceptedExpected int) {
+		t.Helper()
+		lm := newLimiter(maxItems, time.Hour, prevItems)
+		lm.startTime = lm.startTime.Add(-elapsed)
+		accepted := 0
+		for i := 0; i < 2*maxItems; i++ {
+			if lm.Add(uint64(i)) {
+				accepted++
+			}
+		}
+		// Some items may be mistakenly treated as already added because of Bloom filter false positives.
+		if accepted < acceptedExpected || accepted > acceptedExpected+maxItems/20 {
+			t.Fatalf("unexpected number of accepted items for prevItems=%d, elapsed=%s; got %d; want %d", prevItems, elapsed, accepted, acceptedExpected)
+		}
+	}
+
+	// The previous interval had no items.
+	f(0, 0, maxItems)
+
+	// The previous interval exhausted the limit, so items are allowed proportionally to the elapsed part of the current interval.
+	f(maxItems, time.Minute, 1)
+	f(maxItems, 15*time.Minute, 25)
+	f(maxItems, 30*time.Minute, 50)
+	f(maxItems/2, 30*time.Minute, 75)
+
+	// The previous interval is out of the sliding window.
+	f(maxItems, time.Hour, maxItems)
+}
@@ -0,0 +1,88 @@
+package bytesutil
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	internStringDisableCache = flag.Bool("internStringDisableCache", false, "Whether to disable the cache for interned strings such as label names and values. "+
+		"This may reduce CPU usage if the cache becomes contended at the cost of higher memory usage for duplicate strings. "+
+		"See also -internStringCacheExpireDuration")
+	internStringCacheExpireDuration = flag.Duration("internStringCacheExpireDuration", 6*time.Minute, "The expiry duration for the cache of interned strings such as label names and values. "+
+		"Strings, which weren't accessed during this duration, are removed from the cache. See also -internStringDisableCache")
+)
+
+// InternBytes returns interned string for b.
+//
+// See InternString for details.
+func InternBytes(b []byte) string {
+	return InternString(ToUnsafeString(b))
+}
+
+// InternString returns interned copy of s.
+//
+// Identical strings passed to InternString share the same backing memory,
+// so this reduces memory usage when the returned strings are retained for long time.
+// The returned string doesn't refer to the memory s refers to.
+//
+// Strings, which weren't accessed during -internStringCacheExpireDuration, are periodically removed from the cache,
+// so it doesn't grow indefinitely.
+func InternString(s string) string {
+	if *internStringDisableCache {
+		return string(append([]byte{}, s...))
+	}
+	ct := uint64(time.Now().Unix())
+	if v, ok := internStringsMap.Load(s); ok {
+		e := v.(*internStringEntry)
+		if atomic.LoadUint64(&e.lastAccessTime) != ct {
+			// Update the last access time only once per second in order to reduce contention on e.
+			atomic.StoreUint64(&e.lastAccessTime, ct)
+		}
+		return e.s
+	}
+	sCopy := string(append([]byte{}, s...))
+	e := &internStringEntry{
+		s:              sCopy,
+		lastAccessTime: ct,
+	}
+	if v, loaded := internStringsMap.LoadOrStore(sCopy, e); loaded {
+		sCopy = v.(*internStringEntry).s
+	}
+	cleanupInternStringsMapIfNeeded(ct)
+	return sCopy
+}
+
+type internStringEntry struct {
+	s              string
+	lastAccessTime uint64
+}
+
+// cleanupInternStringsMapIfNeeded removes expired strings from internStringsMap.
+//
+// The cleanup runs at most once per half of -internStringCacheExpireDuration.
+func cleanupInternStringsMapIfNeeded(ct uint64) {
+	expireSecs := uint64(internStringCacheExpireDuration.Seconds())
+	lastCleanupTime := atomic.LoadUint64(&internStringsMapLastCleanupTime)
+	if ct < lastCleanupTime+expireSecs/2 || !atomic.CompareAndSwapUint64(&internStringsMapLastCleanupTime, lastCleanupTime, ct) {
+		return
+	}
+	cleanupInternStringsMap(ct, expireSecs)
+}
+
+func cleanupInternStringsMap(ct, expireSecs uint64) {
+	internStringsMap.Range(func(k, v interface{}) bool {
+		e := v.(*internStringEntry)
+		if atomic.LoadUint64(&e.lastAccessTime)+expireSecs < ct {
+			internStringsMap.Delete(k)
+		}
+		return true
+	})
+}
+
+var (
+	internStringsMap                sync.Map
+	internStringsMapLastCleanupTime uint64
+)
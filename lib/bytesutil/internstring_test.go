@@ -0,0 +1,82 @@
+package bytesutil
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestInternString(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		b := []byte(s)
+		result := InternBytes(b)
+		if result != s {
+			t.Fatalf("unexpected interned string; got %q; want %q", result, s)
+		}
+		// The interned string mustn't refer to b.
+		for i := range b {
+			b[i] = 'x'
+		}
+		if result != s {
+			t.Fatalf("the interned string refers to the original buffer; got %q; want %q", result, s)
+		}
+		result2 := InternString(s)
+		if result2 != s {
+			t.Fatalf("unexpected interned string on the second call; got %q; want %q", result2, s)
+		}
+		if len(s) > 0 && stringData(result) != stringData(result2) {
+			t.Fatalf("identical interned strings must share the same memory")
+		}
+	}
+	f("")
+	f("foo")
+	f("kube-system")
+	f("pod-5f7b9c6d8-x2x9z")
+}
+
+func TestInternStringDisableCache(t *testing.T) {
+	*internStringDisableCache = true
+	defer func() {
+		*internStringDisableCache = false
+	}()
+	s := "foo-disabled"
+	result1 := InternString(s)
+	result2 := InternString(s)
+	if result1 != s || result2 != s {
+		t.Fatalf("unexpected interned strings; got %q and %q; want %q", result1, result2, s)
+	}
+	if stringData(result1) == stringData(result2) {
+		t.Fatalf("strings mustn't be interned when the cache is disabled")
+	}
+	if _, ok := internStringsMap.Load(s); ok {
+		t.Fatalf("the string mustn't be added to the cache when it is disabled")
+	}
+}
+
+func TestCleanupInternStringsMap(t *testing.T) {
+	s := "foo-expired"
+	InternString(s)
+	if _, ok := internStringsMap.Load(s); !ok {
+		t.Fatalf("missing interned string in the cache")
+	}
+	expireSecs := uint64(internStringCacheExpireDuration.Seconds())
+	ct := uint64(time.Now().Unix())
+
+	// Recently accessed strings must remain in the cache.
+	cleanupInternStringsMap(ct, expireSecs)
+	if _, ok := internStringsMap.Load(s); !ok {
+		t.Fatalf("recently accessed string mustn't be removed from the cache")
+	}
+
+	// Expired strings must be removed from the cache.
+	cleanupInternStringsMap(ct+expireSecs+1, expireSecs)
+	if _, ok := internStringsMap.Load(s); ok {
+		t.Fatalf("expired string must be removed from the cache")
+	}
+}
+
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
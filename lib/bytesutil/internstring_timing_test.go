@@ -0,0 +1,28 @@
+package bytesutil
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func BenchmarkInternBytes(b *testing.B) {
+	var labels [][]byte
+	for i := 0; i < 10000; i++ {
+		labels = append(labels, []byte(fmt.Sprintf("pod-%08d", i)))
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(labels)))
+	b.RunParallel(func(pb *testing.PB) {
+		n := 0
+		for pb.Next() {
+			for _, label := range labels {
+				s := InternBytes(label)
+				n += len(s)
+			}
+		}
+		atomic.AddUint64(&Sink, uint64(n))
+	})
+}
+
+var Sink uint64
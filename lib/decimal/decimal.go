@@ -5,13 +5,42 @@ import (
 	"sync"
 )
 
+// ExactScale is the exponent for values stored as raw float64 bits via AppendFloatToExact.
+//
+// Such values are restored bit-for-bit, while conversion to decimal values via AppendFloatToDecimal
+// may lose precision. ExactScale is never returned by AppendFloatToDecimal.
+const ExactScale = math.MinInt16
+
+// AppendFloatToExact appends raw bits for each item in src to dst and returns the result.
+//
+// The returned values must be used with ExactScale exponent.
+func AppendFloatToExact(dst []int64, src []float64) []int64 {
+	dst = ExtendInt64sCapacity(dst, len(src))
+	for _, f := range src {
+		dst = append(dst, int64(math.Float64bits(f)))
+	}
+	return dst
+}
+
 // CalibrateScale calibrates a and b with the corresponding exponents ae, be
 // and returns the resulting exponent e.
+//
+// If either ae or be equals to ExactScale, then the other values are converted
+// to raw float64 bits and ExactScale is returned.
 func CalibrateScale(a []int64, ae int16, b []int64, be int16) (e int16) {
 	if ae == be {
 		// Fast path - exponents are equal.
 		return ae
 	}
+	if ae == ExactScale || be == ExactScale {
+		if ae != ExactScale {
+			convertDecimalToExact(a, ae)
+		}
+		if be != ExactScale {
+			convertDecimalToExact(b, be)
+		}
+		return ExactScale
+	}
 	if len(a) == 0 {
 		return be
 	}
@@ -43,7 +72,7 @@ func CalibrateScale(a []int64, ae int16, b []int64, be int16) (e int16) {
 	}
 	if downExp > 0 {
 		for i, v := range b {
-			if v == vInfPos || v == vInfNeg {
+			if isSpecialValue(v) {
 				// Special case for these values - do not touch them.
 				continue
 			}
@@ -78,12 +107,27 @@ func ExtendInt64sCapacity(dst []int64, additionalItems int) []int64 {
 	return dst[:dstLen]
 }
 
+func convertDecimalToExact(va []int64, e int16) {
+	for i, v := range va {
+		va[i] = int64(math.Float64bits(ToFloat(v, e)))
+	}
+}
+
 // AppendDecimalToFloat converts each item in va to f=v*10^e, appends it
 // to dst and returns the resulting dst.
+//
+// Items are treated as raw float64 bits if e equals to ExactScale.
 func AppendDecimalToFloat(dst []float64, va []int64, e int16) []float64 {
 	// Extend dst capacity in order to eliminate memory allocations below.
 	dst = ExtendFloat64sCapacity(dst, len(va))
 
+	if e == ExactScale {
+		for _, v := range va {
+			dst = append(dst, math.Float64frombits(uint64(v)))
+		}
+		return dst
+	}
+
 	e10 := math.Pow10(int(e))
 	for _, v := range va {
 		// Manually inline ToFloat here for better performance
@@ -92,6 +136,8 @@ func AppendDecimalToFloat(dst []float64, va []int64, e int16) []float64 {
 			f = infPos
 		} else if v == vInfNeg {
 			f = infNeg
+		} else if v == vStaleNaN {
+			f = StaleNaN
 		} else {
 			f = float64(v) * e10
 		}
@@ -124,16 +170,19 @@ func AppendFloatToDecimal(dst []int64, src []float64) (va []int64, e int16) {
 	vae.ea = vae.ea[:0]
 
 	// Determine the minimum exponent across all src items.
-	v, exp := FromFloat(src[0])
-	vae.va = append(vae.va, v)
-	vae.ea = append(vae.ea, exp)
-	minExp := exp
-	for _, f := range src[1:] {
+	// Staleness marks and Inf values are skipped, since they don't depend on the exponent.
+	minExp := int16(0)
+	hasRegularValues := false
+	for _, f := range src {
 		v, exp := FromFloat(f)
 		vae.va = append(vae.va, v)
 		vae.ea = append(vae.ea, exp)
-		if exp < minExp {
+		if isSpecialValue(v) {
+			continue
+		}
+		if !hasRegularValues || exp < minExp {
 			minExp = exp
+			hasRegularValues = true
 		}
 	}
 
@@ -141,6 +190,9 @@ func AppendFloatToDecimal(dst []int64, src []float64) (va []int64, e int16) {
 	// If not, adjust minExp accordingly.
 	downExp := int16(0)
 	for i, v := range vae.va {
+		if isSpecialValue(v) {
+			continue
+		}
 		exp := vae.ea[i]
 		upExp := exp - minExp
 		maxUpExp := maxUpExponent(v)
@@ -152,6 +204,10 @@ func AppendFloatToDecimal(dst []int64, src []float64) (va []int64, e int16) {
 
 	// Scale each item in src to minExp and append it to dst.
 	for i, v := range vae.va {
+		if isSpecialValue(v) {
+			dst = append(dst, v)
+			continue
+		}
 		exp := vae.ea[i]
 		adjExp := exp - minExp
 		for adjExp > 0 {
@@ -177,6 +233,13 @@ type vaeBuf struct {
 
 var vaeBufPool sync.Pool
 
+// isSpecialValue returns true if v represents Inf or Prometheus staleness mark.
+//
+// Such values must be kept as is when scaling decimal values.
+func isSpecialValue(v int64) bool {
+	return v == vInfPos || v == vInfNeg || v == vStaleNaN
+}
+
 func maxUpExponent(v int64) int16 {
 	if v == 0 {
 		// Any exponent allowed.
@@ -236,19 +299,28 @@ func maxUpExponent(v int64) int16 {
 }
 
 // ToFloat returns f=v*10^e.
+//
+// v is treated as raw float64 bits if e equals to ExactScale.
 func ToFloat(v int64, e int16) float64 {
+	if e == ExactScale {
+		return math.Float64frombits(uint64(v))
+	}
 	if v == vInfPos {
 		return infPos
 	}
 	if v == vInfNeg {
 		return infNeg
 	}
+	if v == vStaleNaN {
+		return StaleNaN
+	}
 	return float64(v) * math.Pow10(int(e))
 }
 
 const (
-	vInfPos = 1<<63 - 1
-	vInfNeg = -1 << 63
+	vInfPos   = 1<<63 - 1
+	vInfNeg   = -1 << 63
+	vStaleNaN = 1<<63 - 2
 
 	vMax = 1<<63 - 3
 	vMin = -1<<63 + 1
@@ -259,13 +331,35 @@ var (
 	infNeg = math.Inf(-1)
 )
 
+// StaleNaN is a special NaN value, which is used as Prometheus staleness mark.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/basics/#staleness
+var StaleNaN = math.Float64frombits(staleNaNBits)
+
+// staleNaNBits is the bit representation of Prometheus staleness mark.
+const staleNaNBits = 0x7ff0000000000002
+
+// IsStaleNaN returns true if f represents Prometheus staleness mark.
+func IsStaleNaN(f float64) bool {
+	return math.Float64bits(f) == staleNaNBits
+}
+
+// IsStaleNaNInt64 returns true if v represents Prometheus staleness mark in decimal form returned from FromFloat.
+func IsStaleNaNInt64(v int64) bool {
+	return v == vStaleNaN
+}
+
 // FromFloat converts f to v*10^e.
 //
 // It tries minimizing v.
 // For instance, for f = -1.234 it returns v = -1234, e = -3.
 //
-// FromFloat doesn't work properly with NaN values, so don't pass them here.
+// FromFloat doesn't work properly with NaN values other than StaleNaN, so don't pass them here.
 func FromFloat(f float64) (v int64, e int16) {
+	if IsStaleNaN(f) {
+		// Special case for Prometheus staleness mark
+		return vStaleNaN, 0
+	}
 	if math.IsInf(f, 0) {
 		// Special case for Inf
 		if math.IsInf(f, 1) {
@@ -237,6 +237,7 @@ func TestFloatToDecimal(t *testing.T) {
 
 	testFloatToDecimal(t, math.Inf(1), vInfPos, 0)
 	testFloatToDecimal(t, math.Inf(-1), vInfNeg, 0)
+	testFloatToDecimal(t, StaleNaN, vStaleNaN, 0)
 	testFloatToDecimal(t, 1<<63-1, 922337203685, 7)
 	testFloatToDecimal(t, -1<<63, -922337203685, 7)
 }
@@ -253,6 +254,62 @@ func testFloatToDecimal(t *testing.T, f float64, vExpected int64, eExpected int1
 	}
 }
 
+func TestStaleNaN(t *testing.T) {
+	if !IsStaleNaN(StaleNaN) {
+		t.Fatalf("StaleNaN must be detected as staleness mark")
+	}
+	if IsStaleNaN(math.NaN()) {
+		t.Fatalf("regular NaN mustn't be detected as staleness mark")
+	}
+	if IsStaleNaN(0) || IsStaleNaN(math.Inf(1)) {
+		t.Fatalf("non-NaN values mustn't be detected as staleness mark")
+	}
+
+	v, e := FromFloat(StaleNaN)
+	if !IsStaleNaNInt64(v) {
+		t.Fatalf("FromFloat result for staleness mark must be detected as staleness mark; got %d", v)
+	}
+	if f := ToFloat(v, e); !IsStaleNaN(f) {
+		t.Fatalf("unexpected ToFloat result for staleness mark; got %v; want StaleNaN", f)
+	}
+	if v, _ := FromFloat(123); IsStaleNaNInt64(v) {
+		t.Fatalf("regular values mustn't be detected as staleness mark")
+	}
+	va, e := AppendFloatToDecimal(nil, []float64{1, StaleNaN, 3})
+	fa := AppendDecimalToFloat(nil, va, e)
+	if len(fa) != 3 || fa[0] != 1 || !IsStaleNaN(fa[1]) || fa[2] != 3 {
+		t.Fatalf("unexpected roundtrip result for values with staleness mark; got %v", fa)
+	}
+}
+
+func TestAppendFloatToDecimalSpecialValuesRoundtrip(t *testing.T) {
+	f := func(values []float64) {
+		t.Helper()
+		va, e := AppendFloatToDecimal(nil, values)
+		result := AppendDecimalToFloat(nil, va, e)
+		if len(result) != len(values) {
+			t.Fatalf("unexpected number of values; got %d; want %d", len(result), len(values))
+		}
+		for i, v := range values {
+			if IsStaleNaN(v) {
+				if !IsStaleNaN(result[i]) {
+					t.Fatalf("unexpected value at position %d; got %v; want StaleNaN; result=%v", i, result[i], result)
+				}
+				continue
+			}
+			if result[i] != v {
+				t.Fatalf("unexpected value at position %d; got %v; want %v; result=%v", i, result[i], v, result)
+			}
+		}
+	}
+	// Special values mustn't affect the exponent for the rest of values.
+	f([]float64{0.5, 1.25, 3.75, StaleNaN})
+	f([]float64{StaleNaN, 0.5, 1.25, 3.75})
+	f([]float64{0.001, StaleNaN, 12.5, math.Inf(1), -0.25, math.Inf(-1)})
+	f([]float64{StaleNaN, StaleNaN})
+	f([]float64{math.Inf(1), StaleNaN, math.Inf(-1)})
+}
+
 func TestFloatToDecimalRoundtrip(t *testing.T) {
 	testFloatToDecimalRoundtrip(t, 0)
 	testFloatToDecimalRoundtrip(t, 1)
@@ -287,6 +344,55 @@ func TestFloatToDecimalRoundtrip(t *testing.T) {
 	}
 }
 
+func TestFloatToExactRoundtrip(t *testing.T) {
+	f := func(values []float64) {
+		t.Helper()
+		va := AppendFloatToExact(nil, values)
+		result := AppendDecimalToFloat(nil, va, ExactScale)
+		if len(result) != len(values) {
+			t.Fatalf("unexpected number of values; got %d; want %d", len(result), len(values))
+		}
+		for i, v := range values {
+			if math.Float64bits(result[i]) != math.Float64bits(v) {
+				t.Fatalf("unexpected value #%d; got %v; want %v", i, result[i], v)
+			}
+			if fNew := ToFloat(va[i], ExactScale); math.Float64bits(fNew) != math.Float64bits(v) {
+				t.Fatalf("unexpected ToFloat result for value #%d; got %v; want %v", i, fNew, v)
+			}
+		}
+	}
+	f(nil)
+	f([]float64{0, 0.1, 0.1 + 0.2, 12345.67, -98765.4321, 1e-300, 5e-324, math.MaxFloat64, math.Pi})
+	f([]float64{math.Inf(1), math.Inf(-1), StaleNaN, math.NaN(), math.Copysign(0, -1)})
+}
+
+func TestCalibrateScaleExact(t *testing.T) {
+	a := AppendFloatToExact(nil, []float64{12345.67, 0.1})
+	b := []int64{123, -5}
+	e := CalibrateScale(a, ExactScale, b, -1)
+	if e != ExactScale {
+		t.Fatalf("unexpected scale; got %d; want %d", e, ExactScale)
+	}
+	result := AppendDecimalToFloat(nil, append(a, b...), e)
+	resultExpected := []float64{12345.67, 0.1, 12.3, -0.5}
+	if !reflect.DeepEqual(result, resultExpected) {
+		t.Fatalf("unexpected values; got %v; want %v", result, resultExpected)
+	}
+
+	// The order of exact and decimal values mustn't matter.
+	a = []int64{vInfPos, 7}
+	b = AppendFloatToExact(nil, []float64{1.5})
+	e = CalibrateScale(a, 2, b, ExactScale)
+	if e != ExactScale {
+		t.Fatalf("unexpected scale; got %d; want %d", e, ExactScale)
+	}
+	result = AppendDecimalToFloat(nil, append(a, b...), e)
+	resultExpected = []float64{math.Inf(1), 700, 1.5}
+	if !reflect.DeepEqual(result, resultExpected) {
+		t.Fatalf("unexpected values; got %v; want %v", result, resultExpected)
+	}
+}
+
 func roundFloat(f float64, exp int) float64 {
 	f *= math.Pow10(-exp)
 	return math.Trunc(f) * math.Pow10(exp)
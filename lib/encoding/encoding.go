@@ -57,6 +57,44 @@ func CheckPrecisionBits(precisionBits uint8) error {
 	return nil
 }
 
+// Bounds for the compress level passed to SetCompressLevel.
+const (
+	minCompressLevel = -22
+	maxCompressLevel = 22
+)
+
+// CheckCompressLevel verifies whether the given compressLevel is valid.
+func CheckCompressLevel(compressLevel int) error {
+	if compressLevel < minCompressLevel || compressLevel > maxCompressLevel {
+		return fmt.Errorf("compressLevel must be in the range [%d...%d]; got %d", minCompressLevel, maxCompressLevel, compressLevel)
+	}
+	return nil
+}
+
+// SetCompressLevel sets the zstd compress level for MarshalTimestamps and MarshalValues.
+//
+// The compress level is automatically selected depending on the number of items
+// if compressLevel is 0. Negative values result in faster compression at the cost
+// of lower compression ratio, while higher values result in better compression ratio
+// at the cost of higher CPU usage.
+//
+// The data marshaled at any compress level may be unmarshaled regardless of the current
+// compress level, since zstd frames don't depend on the compress level used for their creation.
+//
+// This function must be called before marshaling the data.
+func SetCompressLevel(compressLevel int) {
+	compressLevelOverride = compressLevel
+}
+
+// GetCompressLevel returns the compress level set via SetCompressLevel.
+//
+// 0 means the compress level must be automatically selected.
+func GetCompressLevel() int {
+	return compressLevelOverride
+}
+
+var compressLevelOverride = 0
+
 // MarshalTimestamps marshals timestamps, appends the marshaled result
 // to dst and returns the dst.
 //
@@ -334,6 +372,9 @@ func isGauge(a []int64) bool {
 }
 
 func getCompressLevel(itemsCount int) int {
+	if compressLevelOverride != 0 {
+		return compressLevelOverride
+	}
 	if itemsCount <= 1<<6 {
 		return 1
 	}
@@ -257,6 +257,63 @@ func TestMarshalUnmarshalValues(t *testing.T) {
 	}
 }
 
+func TestMarshalUnmarshalValuesCompressLevel(t *testing.T) {
+	defer SetCompressLevel(0)
+
+	const precisionBits = 64
+
+	var values []int64
+	v := int64(0)
+	for i := 0; i < 8*1024; i++ {
+		v += int64(rand.NormFloat64() * 1e2)
+		values = append(values, v)
+	}
+	f := func(compressLevel int) {
+		t.Helper()
+		SetCompressLevel(compressLevel)
+		result, mt, firstValue := MarshalValues(nil, values, precisionBits)
+
+		// The data must be readable regardless of the current compress level.
+		for _, level := range []int{0, -5, 1, 10} {
+			SetCompressLevel(level)
+			values2, err := UnmarshalValues(nil, result, mt, firstValue, len(values))
+			if err != nil {
+				t.Fatalf("cannot unmarshal values marshaled with compressLevel=%d at compressLevel=%d: %s", compressLevel, level, err)
+			}
+			if !reflect.DeepEqual(values, values2) {
+				t.Fatalf("unexpected values unmarshaled with compressLevel=%d at compressLevel=%d", compressLevel, level)
+			}
+		}
+	}
+	f(0)
+	f(-22)
+	f(-5)
+	f(-1)
+	f(1)
+	f(5)
+	f(19)
+}
+
+func TestCheckCompressLevel(t *testing.T) {
+	f := func(compressLevel int, isValid bool) {
+		t.Helper()
+		err := CheckCompressLevel(compressLevel)
+		if isValid && err != nil {
+			t.Fatalf("unexpected error for compressLevel=%d: %s", compressLevel, err)
+		}
+		if !isValid && err == nil {
+			t.Fatalf("expecting non-nil error for compressLevel=%d", compressLevel)
+		}
+	}
+	f(0, true)
+	f(-22, true)
+	f(-1, true)
+	f(1, true)
+	f(22, true)
+	f(-23, false)
+	f(23, false)
+}
+
 func TestMarshalInt64ArraySize(t *testing.T) {
 	var va []int64
 	v := int64(rand.Float64() * 1e9)
@@ -25,6 +25,28 @@ func BenchmarkMarshalGaugeArray(b *testing.B) {
 
 var Sink uint64
 
+func BenchmarkMarshalGaugeArrayCompressLevel(b *testing.B) {
+	defer SetCompressLevel(0)
+	for _, compressLevel := range []int{-22, -5, -1, 0, 1, 3, 5, 10, 19} {
+		SetCompressLevel(compressLevel)
+		dst, _, _ := marshalInt64Array(nil, benchGaugeArray, 64)
+		b.Logf("compressLevel=%d: %d items compressed to %d bytes; %.2f bytes per item",
+			compressLevel, len(benchGaugeArray), len(dst), float64(len(dst))/float64(len(benchGaugeArray)))
+		b.Run(fmt.Sprintf("level_%d", compressLevel), func(b *testing.B) {
+			SetCompressLevel(compressLevel)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchGaugeArray)))
+			b.RunParallel(func(pb *testing.PB) {
+				var dst []byte
+				for pb.Next() {
+					dst, _, _ = marshalInt64Array(dst[:0], benchGaugeArray, 64)
+					atomic.AddUint64(&Sink, uint64(len(dst)))
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkUnmarshalGaugeArray(b *testing.B) {
 	b.ReportAllocs()
 	b.SetBytes(int64(len(benchGaugeArray)))
@@ -11,8 +11,47 @@ func (a *Array) String() string {
 }
 
 // Set implements flag.Value interface
+//
+// Commas inside `{...}` and inside quoted strings don't split the value,
+// so series selectors such as `{job="foo",instance="bar"}` may be passed in flag values.
 func (a *Array) Set(value string) error {
-	values := strings.Split(value, ",")
+	values := splitArrayValues(value)
 	*a = append(*a, values...)
 	return nil
 }
+
+func splitArrayValues(s string) []string {
+	var values []string
+	depth := 0
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			switch c {
+			case '\\':
+				// Skip the escaped char.
+				i++
+			case quote:
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				values = append(values, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(values, s[start:])
+}
@@ -3,6 +3,7 @@ package flagutil
 import (
 	"flag"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -32,3 +33,25 @@ func TestArray(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitArrayValues(t *testing.T) {
+	f := func(s string, valuesExpected []string) {
+		t.Helper()
+		values := splitArrayValues(s)
+		if !reflect.DeepEqual(values, valuesExpected) {
+			t.Fatalf("unexpected values for %q;\ngot\n%q\nwant\n%q", s, values, valuesExpected)
+		}
+	}
+	f("", []string{""})
+	f("foo", []string{"foo"})
+	f("foo,bar", []string{"foo", "bar"})
+	f("foo,,bar,", []string{"foo", "", "bar", ""})
+
+	// Commas inside series selectors
+	f(`{job="foo",instance="bar"}:30d:5m,180d:1h`, []string{`{job="foo",instance="bar"}:30d:5m`, `180d:1h`})
+	f(`foo{job=~"a,b"},bar`, []string{`foo{job=~"a,b"}`, `bar`})
+
+	// Commas inside quoted strings
+	f(`"foo,bar",baz`, []string{`"foo,bar"`, `baz`})
+	f(`"foo\",bar",baz`, []string{`"foo\",bar"`, `baz`})
+}
@@ -0,0 +1,13 @@
+package flagutil
+
+import (
+	"strings"
+)
+
+// IsSecretFlag returns true if the flag with the given name may contain secret value such as password, token or key.
+//
+// Values for such flags mustn't be exposed in logs, metrics and http responses.
+func IsSecretFlag(name string) bool {
+	lname := strings.ToLower(name)
+	return strings.Contains(lname, "pass") || strings.Contains(lname, "key") || strings.Contains(lname, "secret") || strings.Contains(lname, "token")
+}
@@ -0,0 +1,24 @@
+package flagutil
+
+import (
+	"testing"
+)
+
+func TestIsSecretFlag(t *testing.T) {
+	f := func(name string, resultExpected bool) {
+		t.Helper()
+		result := IsSecretFlag(name)
+		if result != resultExpected {
+			t.Fatalf("unexpected IsSecretFlag(%q); got %v; want %v", name, result, resultExpected)
+		}
+	}
+
+	f("httpAuth.password", true)
+	f("httpAuth.bearerToken", true)
+	f("snapshotAuthKey", true)
+	f("tls.keyFile", true)
+	f("influx.SECRET", true)
+	f("httpListenAddr", false)
+	f("storageDataPath", false)
+	f("httpAuth.username", false)
+}
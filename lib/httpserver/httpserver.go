@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -15,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
@@ -27,12 +30,27 @@ var (
 	tlsCertFile = flag.String("tlsCertFile", "", "Path to file with TLS certificate. Used only if tls=true. Prefer ECDSA certs instead of RSA certs, since RSA certs are slow")
 	tlsKeyFile  = flag.String("tlsKeyFile", "", "Path to file with TLS key. Used only if tls=true")
 
-	httpAuthUsername = flag.String("httpAuth.username", "", "Username for HTTP Basic Auth. The authentication is disabled if empty. See also -httpAuth.password")
-	httpAuthPassword = flag.String("httpAuth.password", "", "Password for HTTP Basic Auth. The authentication is disabled -httpAuth.username is empty")
-	metricsAuthKey   = flag.String("metricsAuthKey", "", "Auth key for /metrics. It overrides httpAuth settings")
-	pprofAuthKey     = flag.String("pprofAuthKey", "", "Auth key for /debug/pprof. It overrides httpAuth settings")
+	httpAuthUsername         = flag.String("httpAuth.username", "", "Username for HTTP Basic Auth. The authentication is disabled if empty. See also -httpAuth.password")
+	httpAuthPassword         = flag.String("httpAuth.password", "", "Password for HTTP Basic Auth. The authentication is disabled -httpAuth.username is empty")
+	httpAuthBearerToken      = flag.String("httpAuth.bearerToken", "", "Bearer token for HTTP authentication via `Authorization: Bearer <token>` request header. The authentication is disabled if empty")
+	httpAuthUnprotectedPaths = flag.String("httpAuth.unprotectedPaths", "/health,/ready,/metrics,/flags", "Comma-separated list of paths, which aren't protected by -httpAuth.* flags. "+
+		"/metrics and /flags may be protected separately with -metricsAuthKey")
+	metricsAuthKey = flag.String("metricsAuthKey", "", "Auth key for /metrics and /flags. It overrides httpAuth settings")
+	pprofAuthKey   = flag.String("pprofAuthKey", "", "Auth key for /debug/pprof/* endpoints. It overrides httpAuth settings. "+
+		"The endpoints are disabled if empty")
 
 	disableResponseCompression = flag.Bool("http.disableResponseCompression", false, "Disable compression of HTTP responses for saving CPU resources. By default compression is enabled to save network bandwidth")
+	compressionLevel           = flag.Int("http.compressionLevel", gzip.BestSpeed, "The gzip compression level for HTTP responses in the range 1...9. Higher levels reduce network bandwidth at the cost of higher CPU usage")
+
+	readTimeout = flag.Duration("http.readTimeout", time.Minute, "The maximum duration without receiving data from the client while reading the request. "+
+		"It doesn't limit the total request duration, so big but slow uploads aren't cut off while the client keeps sending data")
+	writeTimeout = flag.Duration("http.writeTimeout", time.Minute, "The maximum duration without sending data to the client while writing the response. "+
+		"It doesn't limit the total response duration")
+	idleConnTimeout = flag.Duration("http.idleConnTimeout", time.Minute, "Timeout for idle keep-alive connections between requests. "+
+		"Increase it in order to reduce connection churn when many clients send requests at low rate")
+	maxHeaderBytes = flag.Int("http.maxHeaderBytes", http.DefaultMaxHeaderBytes, "The maximum size in bytes of request headers including the request line")
+	disableHTTP2   = flag.Bool("http.disableHTTP2", false, "Whether to disable HTTP/2 for incoming requests. HTTP/2 is available only if -tls is set. "+
+		"Unencrypted HTTP/2 (h2c) isn't supported, so clients must use HTTP/1.1 when -tls isn't set")
 )
 
 var (
@@ -50,18 +68,43 @@ type RequestHandler func(w http.ResponseWriter, r *http.Request) bool
 
 // Serve starts an http server on the given addr with the given rh.
 //
+// addr may contain comma-separated list of addresses such as `[::]:8428,127.0.0.1:8429`.
+// In this case all the addresses are served by rh. Serve returns after all the addresses
+// are stopped via Stop.
+//
 // By default all the responses are transparently compressed, since Google
 // charges a lot for the egress traffic. The compression may be disabled
 // by calling DisableResponseCompression before writing the first byte to w.
 //
 // The compression is also disabled if -http.disableResponseCompression flag is set.
 func Serve(addr string, rh RequestHandler) {
+	addrs := netutil.ParseListenAddrs(addr)
+	if len(addrs) == 0 {
+		logger.Fatalf("missing address to listen for http connections in %q", addr)
+	}
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			serve(addr, rh)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+func serve(addr string, rh RequestHandler) {
 	scheme := "http"
 	if *tlsEnable {
 		scheme = "https"
 	}
+	if *compressionLevel < gzip.BestSpeed || *compressionLevel > gzip.BestCompression {
+		logger.Fatalf("-http.compressionLevel must be in the range %d...%d; got %d", gzip.BestSpeed, gzip.BestCompression, *compressionLevel)
+	}
 	logger.Infof("starting http server at %s://%s/", scheme, addr)
-	logger.Infof("pprof handlers are exposed at %s://%s/debug/pprof/", scheme, addr)
+	if len(*pprofAuthKey) > 0 {
+		logger.Infof("pprof handlers are exposed at %s://%s/debug/pprof/", scheme, addr)
+	}
 	lnTmp, err := netutil.NewTCPListener(scheme, addr)
 	if err != nil {
 		logger.Fatalf("cannot start http server at %s: %s", addr, err)
@@ -69,17 +112,21 @@ func Serve(addr string, rh RequestHandler) {
 	setNetworkTimeouts(lnTmp)
 	ln := net.Listener(lnTmp)
 
+	var cl *certLoader
 	if *tlsEnable {
-		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		cl, err = newCertLoader(*tlsCertFile, *tlsKeyFile)
 		if err != nil {
 			logger.Fatalf("cannot load TLS cert from tlsCertFile=%q, tlsKeyFile=%q: %s", *tlsCertFile, *tlsKeyFile, err)
 		}
 		cfg := &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: cl.GetCertificate,
+		}
+		if !*disableHTTP2 {
+			cfg.NextProtos = []string{"h2", "http/1.1"}
 		}
 		ln = tls.NewListener(ln, cfg)
 	}
-	serveWithListener(addr, ln, rh)
+	serveWithListener(addr, ln, rh, cl)
 }
 
 func setNetworkTimeouts(ln *netutil.TCPListener) {
@@ -87,27 +134,35 @@ func setNetworkTimeouts(ln *netutil.TCPListener) {
 	// in order to protect from DoS or broken networks.
 	// Application-level timeouts must be set by the authors of request handlers.
 	//
-	// The read timeout limits the life of idle connection
-	ln.ReadTimeout = time.Minute
-	ln.WriteTimeout = time.Minute
+	// The timeouts apply to every read and write call, so they limit
+	// the duration of inactivity instead of the total request duration.
+	ln.ReadTimeout = *readTimeout
+	ln.WriteTimeout = *writeTimeout
 }
 
-func serveWithListener(addr string, ln net.Listener, rh RequestHandler) {
+func serveWithListener(addr string, ln net.Listener, rh RequestHandler, cl *certLoader) {
 	s := &http.Server{
 		Handler: gzipHandler(rh),
 
-		// Disable http/2
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-
 		// Do not set ReadTimeout and WriteTimeout here.
 		// Network-level timeouts are set in setNetworkTimeouts.
 		// Application-level timeouts must be set in the app.
 
-		// Do not set IdleTimeout, since it is equivalent to read timeout
-		// set in setNetworkTimeouts.
+		// IdleTimeout overrides the network-level read timeout
+		// while waiting for the next request on keep-alive connections.
+		IdleTimeout: *idleConnTimeout,
+
+		MaxHeaderBytes: *maxHeaderBytes,
 
 		ErrorLog: logger.StdErrorLogger(),
 	}
+	if *disableHTTP2 || !*tlsEnable {
+		// Disable http/2. Unencrypted http/2 (h2c) isn't supported, so plain-text connections are served over http/1.1.
+		s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	if cl != nil {
+		s.RegisterOnShutdown(cl.MustStop)
+	}
 	serversLock.Lock()
 	servers[addr] = s
 	serversLock.Unlock()
@@ -122,7 +177,26 @@ func serveWithListener(addr string, ln net.Listener, rh RequestHandler) {
 
 // Stop stops the http server on the given addr, which has been started
 // via Serve func.
+//
+// All the addresses are stopped if addr contains comma-separated list of addresses.
 func Stop(addr string) error {
+	addrs := netutil.ParseListenAddrs(addr)
+	errCh := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			errCh <- stop(addr)
+		}(addr)
+	}
+	var firstErr error
+	for range addrs {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func stop(addr string) error {
 	serversLock.Lock()
 	s := servers[addr]
 	delete(servers, addr)
@@ -162,6 +236,18 @@ func handlerWrapper(w http.ResponseWriter, r *http.Request, rh RequestHandler) {
 	case "/health":
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte("OK"))
+		for _, details := range getHealthDetails() {
+			fmt.Fprintf(w, "\n%s", details)
+		}
+		return
+	case "/ready":
+		w.Header().Set("Content-Type", "text/plain")
+		if phase, ok := getStartupPhase(); !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready; phase: %s", phase)
+			return
+		}
+		w.Write([]byte("OK"))
 		return
 	case "/metrics":
 		startTime := time.Now()
@@ -170,18 +256,35 @@ func handlerWrapper(w http.ResponseWriter, r *http.Request, rh RequestHandler) {
 		writePrometheusMetrics(w)
 		metricsHandlerDuration.UpdateDuration(startTime)
 		return
+	case "/flags":
+		flagsRequests.Inc()
+		w.Header().Set("Content-Type", "text/plain")
+		writeFlags(w, flag.CommandLine)
+		return
 	case "/favicon.ico":
 		faviconRequests.Inc()
 		w.WriteHeader(http.StatusNoContent)
 		return
 	default:
 		if strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+			if len(*pprofAuthKey) == 0 {
+				// Do not log the error in order to prevent from log flooding by scanners probing for pprof handlers.
+				unsupportedRequestErrors.Inc()
+				http.Error(w, fmt.Sprintf("unsupported path requested: %q; pprof handlers are disabled; set -pprofAuthKey command-line flag for enabling them",
+					r.URL.Path), http.StatusNotFound)
+				return
+			}
 			pprofRequests.Inc()
 			DisableResponseCompression(w)
 			pprofHandler(r.URL.Path[len("/debug/pprof/"):], w, r)
 			return
 		}
 
+		if phase, ok := getStartupPhase(); !ok {
+			notReadyRequests.Inc()
+			http.Error(w, fmt.Sprintf("the service isn't ready yet; phase: %s", phase), http.StatusServiceUnavailable)
+			return
+		}
 		if rh(w, r) {
 			return
 		}
@@ -192,11 +295,75 @@ func handlerWrapper(w http.ResponseWriter, r *http.Request, rh RequestHandler) {
 	}
 }
 
+// RegisterHealthDetailsFunc registers f, which returns additional details for /health page.
+//
+// f must return an empty string if there are no details to report, such as degraded operation modes.
+// /health page returns 200 OK regardless of the details.
+func RegisterHealthDetailsFunc(f func() string) {
+	healthDetailsFuncsLock.Lock()
+	healthDetailsFuncs = append(healthDetailsFuncs, f)
+	healthDetailsFuncsLock.Unlock()
+}
+
+func getHealthDetails() []string {
+	healthDetailsFuncsLock.Lock()
+	defer healthDetailsFuncsLock.Unlock()
+	var a []string
+	for _, f := range healthDetailsFuncs {
+		if details := f(); len(details) > 0 {
+			a = append(a, details)
+		}
+	}
+	return a
+}
+
+var (
+	healthDetailsFuncs     []func() string
+	healthDetailsFuncsLock sync.Mutex
+)
+
+// SetStartupPhase marks the process as not ready for serving requests and sets the current startup phase.
+//
+// /ready page returns 503 Service Unavailable with the phase until SetReady is called,
+// while /health page returns 200 OK as long as the process is alive.
+// Requests to other paths except of /metrics, /flags and /debug/pprof/* are rejected with 503 Service Unavailable
+// until SetReady is called, so they don't access partially initialized state.
+func SetStartupPhase(phase string) {
+	startupPhaseLock.Lock()
+	startupPhase = phase
+	startupPhaseLock.Unlock()
+	atomic.StoreUint32(&isReady, 0)
+}
+
+// SetReady marks the process as ready for serving requests after SetStartupPhase calls.
+func SetReady() {
+	atomic.StoreUint32(&isReady, 1)
+}
+
+// getStartupPhase returns the current startup phase and false if the process isn't ready for serving requests.
+func getStartupPhase() (string, bool) {
+	if atomic.LoadUint32(&isReady) != 0 {
+		return "", true
+	}
+	startupPhaseLock.Lock()
+	phase := startupPhase
+	startupPhaseLock.Unlock()
+	return phase, false
+}
+
+var (
+	// isReady is set to 1 by default, so the processes, which don't call SetStartupPhase, are always ready.
+	isReady = uint32(1)
+
+	startupPhase     string
+	startupPhaseLock sync.Mutex
+)
+
 func checkAuth(w http.ResponseWriter, r *http.Request) bool {
 	path := r.URL.Path
-	if path == "/metrics" && len(*metricsAuthKey) > 0 {
+	if (path == "/metrics" || path == "/flags") && len(*metricsAuthKey) > 0 {
 		authKey := r.FormValue("authKey")
-		if *metricsAuthKey == authKey {
+		if constantTimeEqual(*metricsAuthKey, authKey) {
 			return true
 		}
 		http.Error(w, "The provided authKey doesn't match -metricsAuthKey", http.StatusUnauthorized)
@@ -204,29 +371,63 @@ func checkAuth(w http.ResponseWriter, r *http.Request) bool {
 	}
 	if strings.HasPrefix(path, "/debug/pprof/") && len(*pprofAuthKey) > 0 {
 		authKey := r.FormValue("authKey")
-		if *pprofAuthKey == authKey {
+		if constantTimeEqual(*pprofAuthKey, authKey) {
 			return true
 		}
 		http.Error(w, "The provided authKey doesn't match -pprofAuthKey", http.StatusUnauthorized)
 		return false
 	}
-	return checkBasicAuth(w, r)
+	return checkHTTPAuth(w, r)
 }
 
-func checkBasicAuth(w http.ResponseWriter, r *http.Request) bool {
-	if len(*httpAuthUsername) == 0 {
-		// HTTP Basic Auth is disabled.
+func checkHTTPAuth(w http.ResponseWriter, r *http.Request) bool {
+	basicAuthEnabled := len(*httpAuthUsername) > 0
+	bearerAuthEnabled := len(*httpAuthBearerToken) > 0
+	if !basicAuthEnabled && !bearerAuthEnabled {
+		// HTTP auth is disabled.
 		return true
 	}
-	username, password, ok := r.BasicAuth()
-	if ok && username == *httpAuthUsername && password == *httpAuthPassword {
+	if isUnprotectedPath(r.URL.Path) {
 		return true
 	}
-	w.Header().Set("WWW-Authenticate", `Basic realm="VictoriaMetrics"`)
+	if basicAuthEnabled {
+		username, password, ok := r.BasicAuth()
+		if ok && constantTimeEqual(username, *httpAuthUsername) && constantTimeEqual(password, *httpAuthPassword) {
+			return true
+		}
+	}
+	if bearerAuthEnabled {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, prefix) && constantTimeEqual(auth[len(prefix):], *httpAuthBearerToken) {
+			return true
+		}
+	}
+	h := w.Header()
+	if basicAuthEnabled {
+		h.Add("WWW-Authenticate", `Basic realm="VictoriaMetrics"`)
+	}
+	if bearerAuthEnabled {
+		h.Add("WWW-Authenticate", `Bearer realm="VictoriaMetrics"`)
+	}
 	http.Error(w, "", http.StatusUnauthorized)
 	return false
 }
 
+func isUnprotectedPath(path string) bool {
+	for _, p := range strings.Split(*httpAuthUnprotectedPaths, ",") {
+		if strings.TrimSpace(p) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// constantTimeEqual compares a to b in constant time in order to protect from timing attacks.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
 func maybeGzipResponseWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
 	if *disableResponseCompression {
 		return w
@@ -242,12 +443,8 @@ func maybeGzipResponseWriter(w http.ResponseWriter, r *http.Request) http.Respon
 	}
 	h := w.Header()
 	h.Set("Content-Encoding", "gzip")
-	zw := getGzipWriter(w)
-	bw := getBufioWriter(zw)
 	zrw := &gzipResponseWriter{
 		ResponseWriter: w,
-		zw:             zw,
-		bw:             bw,
 	}
 	return zrw
 }
@@ -268,7 +465,7 @@ func EnableCORS(w http.ResponseWriter, _ *http.Request) {
 func getGzipWriter(w io.Writer) *gzip.Writer {
 	v := gzipWriterPool.Get()
 	if v == nil {
-		zw, err := gzip.NewWriterLevel(w, 1)
+		zw, err := gzip.NewWriterLevel(w, *compressionLevel)
 		if err != nil {
 			logger.Panicf("BUG: cannot create gzip writer: %s", err)
 		}
@@ -285,57 +482,147 @@ func putGzipWriter(zw *gzip.Writer) {
 
 var gzipWriterPool sync.Pool
 
+// minCompressSize is the minimum response size to compress.
+//
+// Smaller responses are sent uncompressed, since the compression
+// wastes CPU time without noticeable bandwidth savings for them.
+const minCompressSize = 1024
+
+// gzipFlushInterval is the maximum duration compressed data may be buffered
+// before sending it to the client.
+//
+// This prevents from stalls for clients of streaming handlers, which do not call Flush.
+const gzipFlushInterval = time.Second
+
 type gzipResponseWriter struct {
 	http.ResponseWriter
 	zw         *gzip.Writer
 	bw         *bufio.Writer
 	statusCode int
 
+	// buf holds the response body until the decision whether to compress it is made.
+	buf []byte
+
 	firstWriteDone     bool
 	disableCompression bool
+	lastFlushTime      time.Time
 }
 
 func (zrw *gzipResponseWriter) Write(p []byte) (int, error) {
-	if !zrw.firstWriteDone {
-		h := zrw.Header()
-		if h.Get("Content-Encoding") != "gzip" {
-			// The request handler disabled gzip encoding.
-			// Send uncompressed response body.
-			zrw.disableCompression = true
-		} else if h.Get("Content-Type") == "" {
-			// Disable auto-detection of content-type, since it
-			// is incorrectly detected after the compression.
-			h.Set("Content-Type", "text/html")
-		}
-		zrw.firstWriteDone = true
-	}
 	if zrw.statusCode == 0 {
 		zrw.WriteHeader(http.StatusOK)
 	}
+	if !zrw.firstWriteDone {
+		zrw.buf = append(zrw.buf, p...)
+		if len(zrw.buf) < minCompressSize {
+			return len(p), nil
+		}
+		if err := zrw.writeHeaderAndBuf(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
 	if zrw.disableCompression {
 		return zrw.ResponseWriter.Write(p)
 	}
-	return zrw.bw.Write(p)
+	n, err := zrw.bw.Write(p)
+	if err == nil && time.Since(zrw.lastFlushTime) > gzipFlushInterval {
+		zrw.Flush()
+	}
+	return n, err
+}
+
+// writeHeaderAndBuf decides whether to compress the response, writes the response header
+// and the buffered response body.
+func (zrw *gzipResponseWriter) writeHeaderAndBuf(canCompress bool) error {
+	zrw.firstWriteDone = true
+	h := zrw.Header()
+	if h.Get("Content-Type") == "" {
+		// Detect content-type on the uncompressed data, since it
+		// is incorrectly detected after the compression.
+		h.Set("Content-Type", http.DetectContentType(zrw.buf))
+	}
+	if !canCompress || h.Get("Content-Encoding") != "gzip" || isCompressedContentType(h.Get("Content-Type")) {
+		// The request handler disabled gzip encoding or the response is already compressed.
+		// Send uncompressed response body.
+		zrw.disableCompression = true
+		DisableResponseCompression(zrw.ResponseWriter)
+	} else {
+		h.Del("Content-Length")
+		zrw.zw = getGzipWriter(zrw.ResponseWriter)
+		zrw.bw = getBufioWriter(zrw.zw)
+		zrw.lastFlushTime = time.Now()
+	}
+	zrw.ResponseWriter.WriteHeader(zrw.statusCode)
+	buf := zrw.buf
+	zrw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if zrw.disableCompression {
+		_, err = zrw.ResponseWriter.Write(buf)
+	} else {
+		_, err = zrw.bw.Write(buf)
+	}
+	return err
+}
+
+// isCompressedContentType returns true if the response with the given contentType
+// is usually already compressed, so it shouldn't be compressed again.
+func isCompressedContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range compressedContentTypePrefixes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var compressedContentTypePrefixes = []string{
+	"image/",
+	"audio/",
+	"video/",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-snappy",
 }
 
 func (zrw *gzipResponseWriter) WriteHeader(statusCode int) {
 	if zrw.statusCode != 0 {
 		return
 	}
-	if statusCode == http.StatusNoContent {
-		DisableResponseCompression(zrw.ResponseWriter)
-	}
-	zrw.ResponseWriter.WriteHeader(statusCode)
 	zrw.statusCode = statusCode
+	if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		// Responses without body cannot be compressed.
+		if err := zrw.writeHeaderAndBuf(false); err != nil && !isTrivialNetworkError(err) {
+			logger.Errorf("gzipResponseWriter.WriteHeader: %s", err)
+		}
+	}
 }
 
 // Implements http.Flusher
 func (zrw *gzipResponseWriter) Flush() {
-	if err := zrw.bw.Flush(); err != nil && !isTrivialNetworkError(err) {
-		logger.Errorf("gzipResponseWriter.Flush (buffer): %s", err)
+	if !zrw.firstWriteDone {
+		if zrw.statusCode == 0 {
+			zrw.statusCode = http.StatusOK
+		}
+		// The handler streams the response, so compress it regardless of the size of the data written so far.
+		if err := zrw.writeHeaderAndBuf(true); err != nil && !isTrivialNetworkError(err) {
+			logger.Errorf("gzipResponseWriter.Flush (header): %s", err)
+		}
 	}
-	if err := zrw.zw.Flush(); err != nil && !isTrivialNetworkError(err) {
-		logger.Errorf("gzipResponseWriter.Flush (gzip): %s", err)
+	if !zrw.disableCompression {
+		if err := zrw.bw.Flush(); err != nil && !isTrivialNetworkError(err) {
+			logger.Errorf("gzipResponseWriter.Flush (buffer): %s", err)
+		}
+		if err := zrw.zw.Flush(); err != nil && !isTrivialNetworkError(err) {
+			logger.Errorf("gzipResponseWriter.Flush (gzip): %s", err)
+		}
+		zrw.lastFlushTime = time.Now()
 	}
 	if fw, ok := zrw.ResponseWriter.(http.Flusher); ok {
 		fw.Flush()
@@ -344,7 +631,15 @@ func (zrw *gzipResponseWriter) Flush() {
 
 func (zrw *gzipResponseWriter) Close() error {
 	if !zrw.firstWriteDone {
-		zrw.Header().Del("Content-Encoding")
+		if zrw.statusCode == 0 {
+			// Nothing has been written.
+			zrw.Header().Del("Content-Encoding")
+			return nil
+		}
+		// Send small responses uncompressed.
+		return zrw.writeHeaderAndBuf(false)
+	}
+	if zrw.disableCompression {
 		return nil
 	}
 	zrw.Flush()
@@ -388,42 +683,108 @@ func pprofHandler(profileName string, w http.ResponseWriter, r *http.Request) {
 		pprofTraceRequests.Inc()
 		pprof.Trace(w, r)
 	case "mutex":
+		// Mutex profiling is enabled only for the duration of the request, since it has non-zero overhead.
+		// The sampling fraction may be set via `fraction` query arg.
+		// Concurrent requests are serialized, so they don't reset the fraction set by each other.
 		pprofMutexRequests.Inc()
-		seconds, _ := strconv.Atoi(r.FormValue("seconds"))
-		if seconds <= 0 {
-			seconds = 10
-		}
-		prev := runtime.SetMutexProfileFraction(10)
-		time.Sleep(time.Duration(seconds) * time.Second)
+		fraction := getPprofIntArg(r, "fraction", 10)
+		pprofMutexProfileLock.Lock()
+		prev := runtime.SetMutexProfileFraction(fraction)
+		sleepPprofSeconds(r)
 		pprof.Index(w, r)
 		runtime.SetMutexProfileFraction(prev)
+		pprofMutexProfileLock.Unlock()
+	case "block":
+		// Block profiling is enabled only for the duration of the request, since it has non-zero overhead.
+		// The sampling rate in nanoseconds may be set via `rate` query arg.
+		// Concurrent requests are serialized, so they don't disable block profiling in the middle of each other.
+		pprofBlockRequests.Inc()
+		rate := getPprofIntArg(r, "rate", 1)
+		pprofBlockProfileLock.Lock()
+		runtime.SetBlockProfileRate(rate)
+		sleepPprofSeconds(r)
+		pprof.Index(w, r)
+		runtime.SetBlockProfileRate(0)
+		pprofBlockProfileLock.Unlock()
 	default:
 		pprofDefaultRequests.Inc()
 		pprof.Index(w, r)
 	}
 }
 
+var (
+	pprofMutexProfileLock sync.Mutex
+	pprofBlockProfileLock sync.Mutex
+)
+
+func sleepPprofSeconds(r *http.Request) {
+	seconds := getPprofIntArg(r, "seconds", 10)
+	time.Sleep(time.Duration(seconds) * time.Second)
+}
+
+func getPprofIntArg(r *http.Request, argName string, defaultValue int) int {
+	n, err := strconv.Atoi(r.FormValue(argName))
+	if err != nil || n <= 0 {
+		return defaultValue
+	}
+	return n
+}
+
 var (
 	metricsRequests      = metrics.NewCounter(`vm_http_requests_total{path="/metrics"}`)
+	flagsRequests        = metrics.NewCounter(`vm_http_requests_total{path="/flags"}`)
 	pprofRequests        = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/"}`)
 	pprofCmdlineRequests = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/cmdline"}`)
 	pprofProfileRequests = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/profile"}`)
 	pprofSymbolRequests  = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/symbol"}`)
 	pprofTraceRequests   = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/trace"}`)
 	pprofMutexRequests   = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/mutex"}`)
+	pprofBlockRequests   = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/block"}`)
 	pprofDefaultRequests = metrics.NewCounter(`vm_http_requests_total{path="/debug/pprof/default"}`)
 	faviconRequests      = metrics.NewCounter(`vm_http_requests_total{path="/favicon.ico"}`)
 
 	unsupportedRequestErrors = metrics.NewCounter(`vm_http_request_errors_total{path="*", reason="unsupported"}`)
+	notReadyRequests         = metrics.NewCounter(`vm_http_request_errors_total{path="*", reason="not_ready"}`)
 
 	requestsTotal = metrics.NewCounter(`vm_http_requests_all_total`)
 )
 
 // Errorf writes formatted error message to w and to logger.
+//
+// The response status code is 400 Bad Request unless args contain *ErrorWithStatusCode.
+// Errors with 429 Too Many Requests status code aren't logged in order to prevent from log flooding by throttled clients.
 func Errorf(w http.ResponseWriter, format string, args ...interface{}) {
 	errStr := fmt.Sprintf(format, args...)
-	logger.Errorf("%s", errStr)
-	http.Error(w, errStr, http.StatusBadRequest)
+	statusCode := http.StatusBadRequest
+	for _, arg := range args {
+		if esc, ok := arg.(*ErrorWithStatusCode); ok {
+			statusCode = esc.StatusCode
+			if esc.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(esc.RetryAfter.Seconds()))))
+			}
+			break
+		}
+	}
+	if statusCode != http.StatusTooManyRequests {
+		logger.Errorf("%s", errStr)
+	}
+	http.Error(w, errStr, statusCode)
+}
+
+// ErrorWithStatusCode is an error, which must be returned to the client with the given StatusCode.
+//
+// It must be passed to Errorf without wrapping in order to be taken into account.
+type ErrorWithStatusCode struct {
+	Err        error
+	StatusCode int
+
+	// RetryAfter is an optional duration for Retry-After response header.
+	RetryAfter time.Duration
+}
+
+// Error implements error interface.
+func (e *ErrorWithStatusCode) Error() string {
+	return e.Err.Error()
 }
 
 func isTrivialNetworkError(err error) bool {
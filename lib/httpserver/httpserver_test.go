@@ -0,0 +1,440 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerWrapperAuth(t *testing.T) {
+	defer func() {
+		*httpAuthUsername = ""
+		*httpAuthPassword = ""
+		*httpAuthBearerToken = ""
+		*httpAuthUnprotectedPaths = "/health,/metrics,/flags"
+		*metricsAuthKey = ""
+	}()
+	rh := func(w http.ResponseWriter, r *http.Request) bool {
+		w.Write([]byte("ok"))
+		return true
+	}
+	f := func(path string, setAuth func(r *http.Request), statusCodeExpected int, wwwAuthenticateExpected []string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", path, nil)
+		if setAuth != nil {
+			setAuth(r)
+		}
+		w := httptest.NewRecorder()
+		handlerWrapper(w, r, rh)
+		if w.Code != statusCodeExpected {
+			t.Fatalf("unexpected status code for %q; got %d; want %d", path, w.Code, statusCodeExpected)
+		}
+		wwwAuthenticate := w.Header()["Www-Authenticate"]
+		if !reflect.DeepEqual(wwwAuthenticate, wwwAuthenticateExpected) {
+			t.Fatalf("unexpected WWW-Authenticate header for %q; got %q; want %q", path, wwwAuthenticate, wwwAuthenticateExpected)
+		}
+	}
+	basicAuth := func(username, password string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.SetBasicAuth(username, password)
+		}
+	}
+	bearerAuth := func(token string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	basicChallenge := []string{`Basic realm="VictoriaMetrics"`}
+	bearerChallenge := []string{`Bearer realm="VictoriaMetrics"`}
+
+	// Auth is disabled
+	f("/api/v1/query", nil, http.StatusOK, nil)
+
+	// Basic auth
+	*httpAuthUsername = "foo"
+	*httpAuthPassword = "bar"
+	f("/api/v1/query", basicAuth("foo", "bar"), http.StatusOK, nil)
+	f("/api/v1/query", nil, http.StatusUnauthorized, basicChallenge)
+	f("/api/v1/query", basicAuth("foo", "baz"), http.StatusUnauthorized, basicChallenge)
+	f("/api/v1/query", basicAuth("fo", "bar"), http.StatusUnauthorized, basicChallenge)
+	f("/api/v1/query", bearerAuth("bar"), http.StatusUnauthorized, basicChallenge)
+	f("/health", nil, http.StatusOK, nil)
+	f("/metrics", nil, http.StatusOK, nil)
+	f("/flags", nil, http.StatusOK, nil)
+
+	// Basic auth and bearer token
+	*httpAuthBearerToken = "secret"
+	f("/api/v1/query", basicAuth("foo", "bar"), http.StatusOK, nil)
+	f("/api/v1/query", bearerAuth("secret"), http.StatusOK, nil)
+	f("/api/v1/query", bearerAuth("secret1"), http.StatusUnauthorized, append(basicChallenge, bearerChallenge...))
+	f("/api/v1/query", nil, http.StatusUnauthorized, append(basicChallenge, bearerChallenge...))
+
+	// Bearer token only
+	*httpAuthUsername = ""
+	*httpAuthPassword = ""
+	f("/api/v1/query", bearerAuth("secret"), http.StatusOK, nil)
+	f("/api/v1/query", bearerAuth(""), http.StatusUnauthorized, bearerChallenge)
+	f("/api/v1/query", basicAuth("foo", "bar"), http.StatusUnauthorized, bearerChallenge)
+	f("/health", nil, http.StatusOK, nil)
+
+	// Custom unprotected paths
+	*httpAuthUnprotectedPaths = "/health"
+	f("/health", nil, http.StatusOK, nil)
+	f("/metrics", nil, http.StatusUnauthorized, bearerChallenge)
+	f("/metrics", bearerAuth("secret"), http.StatusOK, nil)
+	f("/flags", nil, http.StatusUnauthorized, bearerChallenge)
+	f("/flags", bearerAuth("secret"), http.StatusOK, nil)
+
+	// /metrics and /flags protected separately with -metricsAuthKey
+	*httpAuthUnprotectedPaths = "/health,/metrics,/flags"
+	*metricsAuthKey = "qwerty"
+	f("/metrics?authKey=qwerty", nil, http.StatusOK, nil)
+	f("/metrics?authKey=qwert", nil, http.StatusUnauthorized, nil)
+	f("/metrics", bearerAuth("secret"), http.StatusUnauthorized, nil)
+	f("/flags?authKey=qwerty", nil, http.StatusOK, nil)
+	f("/flags", nil, http.StatusUnauthorized, nil)
+	f("/api/v1/query?authKey=qwerty", nil, http.StatusUnauthorized, bearerChallenge)
+}
+
+func TestHandlerWrapperPprof(t *testing.T) {
+	defer func() {
+		*httpAuthBearerToken = ""
+		*pprofAuthKey = ""
+	}()
+	rh := func(w http.ResponseWriter, r *http.Request) bool {
+		t.Fatalf("unexpected call to request handler for %q", r.URL.Path)
+		return true
+	}
+	f := func(path string, statusCodeExpected int) {
+		t.Helper()
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handlerWrapper(w, r, rh)
+		if w.Code != statusCodeExpected {
+			t.Fatalf("unexpected status code for %q; got %d; want %d", path, w.Code, statusCodeExpected)
+		}
+	}
+
+	// pprof handlers are disabled without -pprofAuthKey
+	f("/debug/pprof/", http.StatusNotFound)
+	f("/debug/pprof/cmdline", http.StatusNotFound)
+	f("/debug/pprof/cmdline?authKey=", http.StatusNotFound)
+
+	// pprof handlers are protected with -pprofAuthKey, which overrides httpAuth settings
+	*pprofAuthKey = "qwerty"
+	*httpAuthBearerToken = "secret"
+	f("/debug/pprof/cmdline?authKey=qwerty", http.StatusOK)
+	f("/debug/pprof/goroutine?authKey=qwerty", http.StatusOK)
+	f("/debug/pprof/cmdline?authKey=qwert", http.StatusUnauthorized)
+	f("/debug/pprof/cmdline", http.StatusUnauthorized)
+}
+
+func TestWriteFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("storageDataPath", "victoria-metrics-data", "")
+	fs.Int("retentionPeriod", 1, "")
+	fs.String("httpAuth.password", "", "")
+	fs.String("httpAuth.bearerToken", "", "")
+	fs.Bool("dryRun", false, "")
+	if err := fs.Parse([]string{"-retentionPeriod=12", "-httpAuth.bearerToken=foobar", "-dryRun"}); err != nil {
+		t.Fatalf("cannot parse flags: %s", err)
+	}
+
+	var bb bytes.Buffer
+	writeFlags(&bb, fs)
+	result := bb.String()
+	resultExpected := `-dryRun="true" (set)
+-httpAuth.bearerToken="secret" (set)
+-httpAuth.password="secret" (default)
+-retentionPeriod="12" (set)
+-storageDataPath="victoria-metrics-data" (default)
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestErrorfStatusCode(t *testing.T) {
+	f := func(args []interface{}, statusCodeExpected int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		Errorf(w, "error: %s", args...)
+		if w.Code != statusCodeExpected {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, statusCodeExpected)
+		}
+	}
+
+	f([]interface{}{fmt.Errorf("foobar")}, http.StatusBadRequest)
+	f([]interface{}{&ErrorWithStatusCode{
+		Err:        fmt.Errorf("too big request"),
+		StatusCode: http.StatusRequestEntityTooLarge,
+	}}, http.StatusRequestEntityTooLarge)
+
+	// Wrapped ErrorWithStatusCode isn't taken into account
+	f([]interface{}{fmt.Errorf("cannot read request: %s", &ErrorWithStatusCode{
+		Err:        fmt.Errorf("too big request"),
+		StatusCode: http.StatusRequestEntityTooLarge,
+	})}, http.StatusBadRequest)
+}
+
+func TestGzipHandler(t *testing.T) {
+	f := func(acceptEncoding string, rh RequestHandler, contentEncodingExpected, bodyExpected string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/foo", nil)
+		if len(acceptEncoding) > 0 {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		gzipHandler(rh).ServeHTTP(w, r)
+		contentEncoding := w.Header().Get("Content-Encoding")
+		if contentEncoding != contentEncodingExpected {
+			t.Fatalf("unexpected Content-Encoding; got %q; want %q", contentEncoding, contentEncodingExpected)
+		}
+		body := w.Body.Bytes()
+		if contentEncoding == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("cannot create gzip reader: %s", err)
+			}
+			body, err = ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("cannot decompress response body: %s", err)
+			}
+		}
+		if string(body) != bodyExpected {
+			t.Fatalf("unexpected response body; got %q; want %q", body, bodyExpected)
+		}
+	}
+	newHandler := func(contentType, body string) RequestHandler {
+		return func(w http.ResponseWriter, r *http.Request) bool {
+			if len(contentType) > 0 {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Write([]byte(body))
+			return true
+		}
+	}
+	smallBody := "small response"
+	bigBody := strings.Repeat("big response ", 1000)
+
+	// Compression isn't requested
+	f("", newHandler("text/plain", bigBody), "", bigBody)
+	f("deflate", newHandler("text/plain", bigBody), "", bigBody)
+
+	// Small responses aren't compressed
+	f("gzip", newHandler("text/plain", smallBody), "", smallBody)
+
+	// Big responses are compressed
+	f("gzip, deflate", newHandler("application/json", bigBody), "gzip", bigBody)
+	f("gzip", newHandler("", bigBody), "gzip", bigBody)
+
+	// Already compressed responses aren't compressed
+	f("gzip", newHandler("image/png", bigBody), "", bigBody)
+	f("gzip", newHandler("application/x-gzip", bigBody), "", bigBody)
+
+	// The handler disables the compression
+	f("gzip", func(w http.ResponseWriter, r *http.Request) bool {
+		DisableResponseCompression(w)
+		w.Write([]byte(bigBody))
+		return true
+	}, "", bigBody)
+
+	// Responses without body
+	f("gzip", func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}, "", "")
+
+	// Streaming responses are compressed on Flush regardless of their size
+	f("gzip", func(w http.ResponseWriter, r *http.Request) bool {
+		w.Write([]byte(smallBody))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(smallBody))
+		return true
+	}, "gzip", smallBody+smallBody)
+}
+
+func TestGzipResponseWriterFlush(t *testing.T) {
+	r := httptest.NewRequest("GET", "/foo", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	zrw := maybeGzipResponseWriter(w, r).(*gzipResponseWriter)
+	if _, err := zrw.Write([]byte("foo")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w.Body.Len() > 0 {
+		t.Fatalf("small response mustn't be sent before Flush")
+	}
+	zrw.Flush()
+	if !w.Flushed {
+		t.Fatalf("the response must be flushed")
+	}
+	n := w.Body.Len()
+	if n == 0 {
+		t.Fatalf("the response must be sent after Flush")
+	}
+
+	// Buffered data must be flushed if gzipFlushInterval passed since the last flush.
+	zrw.lastFlushTime = time.Now().Add(-2 * gzipFlushInterval)
+	if _, err := zrw.Write([]byte("bar")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w.Body.Len() == n {
+		t.Fatalf("the response must be flushed after gzipFlushInterval")
+	}
+	if err := zrw.Close(); err != nil {
+		t.Fatalf("unexpected error on close: %s", err)
+	}
+}
+
+func TestHealthDetails(t *testing.T) {
+	defer func() {
+		healthDetailsFuncs = nil
+	}()
+	rh := func(w http.ResponseWriter, r *http.Request) bool {
+		return false
+	}
+	f := func(bodyExpected string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/health", nil)
+		w := httptest.NewRecorder()
+		handlerWrapper(w, r, rh)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusOK)
+		}
+		if body := w.Body.String(); body != bodyExpected {
+			t.Fatalf("unexpected body; got %q; want %q", body, bodyExpected)
+		}
+	}
+
+	f("OK")
+
+	details := ""
+	RegisterHealthDetailsFunc(func() string {
+		return details
+	})
+	RegisterHealthDetailsFunc(func() string {
+		return ""
+	})
+	f("OK")
+
+	details = "storage: read-only mode"
+	f("OK\nstorage: read-only mode")
+}
+
+func TestReadiness(t *testing.T) {
+	defer SetReady()
+	rh := func(w http.ResponseWriter, r *http.Request) bool {
+		w.Write([]byte("served"))
+		return true
+	}
+	f := func(path string, statusCodeExpected int, bodyExpected string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handlerWrapper(w, r, rh)
+		if w.Code != statusCodeExpected {
+			t.Fatalf("unexpected status code for %q; got %d; want %d", path, w.Code, statusCodeExpected)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != bodyExpected {
+			t.Fatalf("unexpected body for %q; got %q; want %q", path, body, bodyExpected)
+		}
+	}
+
+	// The process is ready by default.
+	f("/ready", http.StatusOK, "OK")
+	f("/api/v1/query", http.StatusOK, "served")
+
+	// The process isn't ready during startup, while it is alive.
+	SetStartupPhase("opening storage: opening partitions")
+	f("/ready", http.StatusServiceUnavailable, "not ready; phase: opening storage: opening partitions")
+	f("/health", http.StatusOK, "OK")
+	f("/api/v1/query", http.StatusServiceUnavailable, "the service isn't ready yet; phase: opening storage: opening partitions")
+
+	SetStartupPhase("loading query caches")
+	f("/ready", http.StatusServiceUnavailable, "not ready; phase: loading query caches")
+
+	SetReady()
+	f("/ready", http.StatusOK, "OK")
+	f("/health", http.StatusOK, "OK")
+	f("/api/v1/query", http.StatusOK, "served")
+}
+
+func TestServeMultipleAddrs(t *testing.T) {
+	getFreeAddr := func(network, host string) string {
+		t.Helper()
+		ln, err := net.Listen(network, net.JoinHostPort(host, "0"))
+		if err != nil {
+			return ""
+		}
+		addr := ln.Addr().String()
+		_ = ln.Close()
+		return addr
+	}
+	addrs := []string{
+		getFreeAddr("tcp4", "127.0.0.1"),
+		getFreeAddr("tcp4", "127.0.0.1"),
+	}
+	if addr := getFreeAddr("tcp6", "::1"); addr != "" {
+		// IPv6 may be unavailable in the test environment.
+		addrs = append(addrs, addr)
+	}
+	addr := strings.Join(addrs, ",")
+	rh := func(w http.ResponseWriter, r *http.Request) bool {
+		return false
+	}
+	serveDoneCh := make(chan struct{})
+	go func() {
+		Serve(addr, rh)
+		close(serveDoneCh)
+	}()
+
+	// All the addresses must serve /health.
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/health", addr)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := http.Get(url)
+			if err == nil {
+				body, err := ioutil.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if err != nil {
+					t.Fatalf("cannot read response body from %q: %s", url, err)
+				}
+				if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+					t.Fatalf("unexpected response from %q; status code: %d; body: %q", url, resp.StatusCode, body)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("cannot obtain response from %q: %s", url, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// All the addresses must be stopped by a single Stop call.
+	if err := Stop(addr); err != nil {
+		t.Fatalf("cannot stop http server at %q: %s", addr, err)
+	}
+	select {
+	case <-serveDoneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout when waiting for Serve to return")
+	}
+	for _, addr := range addrs {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			_ = c.Close()
+			t.Fatalf("expecting %q to be closed after Stop", addr)
+		}
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"strings"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/buildinfo"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/flagutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/memory"
 	"github.com/VictoriaMetrics/metrics"
 )
@@ -26,9 +26,8 @@ func writePrometheusMetrics(w io.Writer) {
 
 	// Export flags as metrics.
 	flag.VisitAll(func(f *flag.Flag) {
-		lname := strings.ToLower(f.Name)
 		value := f.Value.String()
-		if strings.Contains(lname, "pass") || strings.Contains(lname, "key") || strings.Contains(lname, "secret") {
+		if flagutil.IsSecretFlag(f.Name) {
 			// Do not expose passwords and keys to prometheus.
 			value = "secret"
 		}
@@ -37,3 +36,26 @@ func writePrometheusMetrics(w io.Writer) {
 }
 
 var startTime = time.Now()
+
+// writeFlags writes all the flags registered in fs with their current values to w.
+//
+// Flags are sorted by name, so the output may be compared across hosts with diff.
+// Each flag is marked either as set on the command line or as having its default value.
+// Values for secret flags are masked.
+func writeFlags(w io.Writer, fs *flag.FlagSet) {
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if flagutil.IsSecretFlag(f.Name) {
+			value = "secret"
+		}
+		state := "default"
+		if setFlags[f.Name] {
+			state = "set"
+		}
+		fmt.Fprintf(w, "-%s=%q (%s)\n", f.Name, value, state)
+	})
+}
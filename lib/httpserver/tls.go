@@ -0,0 +1,72 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+)
+
+// certLoader holds TLS certificate loaded from certFile and keyFile.
+//
+// The certificate is re-read from files on SIGHUP, so it may be rotated without restart.
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	cert atomic.Value
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	cl := &certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stopCh:   make(chan struct{}),
+	}
+	if err := cl.reload(); err != nil {
+		return nil, err
+	}
+	sighupCh := procutil.NewSighupChan()
+	cl.wg.Add(1)
+	go func() {
+		defer cl.wg.Done()
+		for {
+			select {
+			case <-cl.stopCh:
+				return
+			case <-sighupCh:
+			}
+			if err := cl.reload(); err != nil {
+				logger.Errorf("cannot reload TLS cert from tlsCertFile=%q, tlsKeyFile=%q; continuing using the previous cert: %s", cl.certFile, cl.keyFile, err)
+				continue
+			}
+			logger.Infof("reloaded TLS cert from tlsCertFile=%q, tlsKeyFile=%q", cl.certFile, cl.keyFile)
+		}
+	}()
+	return cl, nil
+}
+
+func (cl *certLoader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return err
+	}
+	cl.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate callback.
+func (cl *certLoader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cl.cert.Load().(*tls.Certificate), nil
+}
+
+// MustStop stops reloading the certificate on SIGHUP.
+func (cl *certLoader) MustStop() {
+	close(cl.stopCh)
+	cl.wg.Wait()
+}
@@ -0,0 +1,183 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestServeTLS")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := dir + "/cert.pem"
+	keyFile := dir + "/key.pem"
+	writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	*tlsEnable = true
+	*tlsCertFile = certFile
+	*tlsKeyFile = keyFile
+	defer func() {
+		*tlsEnable = false
+		*tlsCertFile = ""
+		*tlsKeyFile = ""
+	}()
+
+	addr := getFreeAddr(t)
+	rh := func(w http.ResponseWriter, r *http.Request) bool {
+		w.Write([]byte("ok"))
+		return true
+	}
+	go Serve(addr, rh)
+	defer func() {
+		if err := Stop(addr); err != nil {
+			t.Fatalf("cannot stop the server: %s", err)
+		}
+	}()
+	waitForServer(t, addr)
+
+	// Plain HTTP requests must be rejected.
+	resp, err := http.Get("http://" + addr + "/health")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatalf("expecting plain HTTP request to fail when TLS is enabled")
+		}
+	}
+
+	// TLS handshake must succeed.
+	if serial := getPeerCertSerial(t, addr); serial != 1 {
+		t.Fatalf("unexpected cert serial number; got %d; want 1", serial)
+	}
+
+	// The cert must be reloaded on SIGHUP.
+	writeSelfSignedCert(t, certFile, keyFile, 2)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("cannot send SIGHUP: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for getPeerCertSerial(t, addr) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the cert hasn't been reloaded on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The previous cert must be used if the new cert is invalid.
+	if err := ioutil.WriteFile(keyFile, []byte("invalid key"), 0600); err != nil {
+		t.Fatalf("cannot write invalid key: %s", err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("cannot send SIGHUP: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if serial := getPeerCertSerial(t, addr); serial != 2 {
+		t.Fatalf("unexpected cert serial number after invalid reload; got %d; want 2", serial)
+	}
+}
+
+func TestNewCertLoaderError(t *testing.T) {
+	if _, err := newCertLoader("non-existing-cert.pem", "non-existing-key.pem"); err == nil {
+		t.Fatalf("expecting non-nil error for missing cert files")
+	}
+}
+
+func getPeerCertSerial(t *testing.T, addr string) int64 {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot establish TLS connection: %s", err)
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		t.Fatalf("missing peer certificates")
+	}
+	return certs[0].SerialNumber.Int64()
+}
+
+func getFreeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func waitForServer(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the server at %q didn't start: %s", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{
+			Organization: []string{"VictoriaMetrics test"},
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create cert: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+	writePEM := func(path, typ string, data []byte) {
+		pemData := pem.EncodeToMemory(&pem.Block{
+			Type:  typ,
+			Bytes: data,
+		})
+		if err := ioutil.WriteFile(path, pemData, 0600); err != nil {
+			t.Fatalf("cannot write %q: %s", path, err)
+		}
+	}
+	writePEM(certFile, "CERTIFICATE", certDER)
+	writePEM(keyFile, "EC PRIVATE KEY", keyDER)
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		panic(fmt.Errorf("BUG: cannot load the generated cert: %s", err))
+	}
+}
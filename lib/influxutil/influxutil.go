@@ -0,0 +1,44 @@
+// Package influxutil contains settings shared between Influx write API at vminsert and InfluxQL query API at vmselect.
+package influxutil
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var (
+	measurementFieldSeparator = flag.String("influxMeasurementFieldSeparator", ".", "Separator for `{measurement}{separator}{field_name}` metric name when inserted via Influx line protocol")
+	databaseLabel             = flag.String("influx.databaseLabel", "db", "Label name for storing `db` query arg from Influx v1 write API and `bucket` query arg from Influx v2 write API. "+
+		"The database isn't stored if empty")
+	token = flag.String("influx.token", "", "Token for Influx write API authentication via `Authorization: Token <token>` request header. "+
+		"The authentication is disabled if empty")
+)
+
+// MeasurementFieldSeparator returns -influxMeasurementFieldSeparator value.
+func MeasurementFieldSeparator() string {
+	return *measurementFieldSeparator
+}
+
+// DatabaseLabel returns -influx.databaseLabel value.
+func DatabaseLabel() string {
+	return *databaseLabel
+}
+
+// CheckAuth verifies that req contains `Authorization: Token <token>` header matching -influx.token.
+//
+// It writes 401 Unauthorized response to w and returns false if the token is missing or invalid.
+// It always returns true if -influx.token isn't set.
+func CheckAuth(w http.ResponseWriter, req *http.Request) bool {
+	if len(*token) == 0 {
+		return true
+	}
+	const prefix = "Token "
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, prefix) && subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(*token)) == 1 {
+		return true
+	}
+	http.Error(w, "missing or invalid `Authorization: Token <token>` request header", http.StatusUnauthorized)
+	return false
+}
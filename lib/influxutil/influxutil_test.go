@@ -0,0 +1,41 @@
+package influxutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckAuth(t *testing.T) {
+	defer func() {
+		*token = ""
+	}()
+	f := func(authHeader string, okExpected bool) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/v2/write", nil)
+		if authHeader != "" {
+			r.Header.Set("Authorization", authHeader)
+		}
+		w := httptest.NewRecorder()
+		ok := CheckAuth(w, r)
+		if ok != okExpected {
+			t.Fatalf("unexpected CheckAuth result for %q; got %v; want %v", authHeader, ok, okExpected)
+		}
+		if !ok && w.Code != http.StatusUnauthorized {
+			t.Fatalf("unexpected status code for %q; got %d; want %d", authHeader, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Auth is disabled
+	f("", true)
+	f("Token foobar", true)
+
+	// Auth is enabled
+	*token = "secret"
+	f("Token secret", true)
+	f("", false)
+	f("Token secret1", false)
+	f("Token ", false)
+	f("Bearer secret", false)
+	f("secret", false)
+}
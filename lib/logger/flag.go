@@ -2,18 +2,17 @@ package logger
 
 import (
 	"flag"
-	"strings"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/buildinfo"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/flagutil"
 )
 
 func logAllFlags() {
 	Infof("build version: %s", buildinfo.Version)
 	Infof("command line flags")
 	flag.VisitAll(func(f *flag.Flag) {
-		lname := strings.ToLower(f.Name)
 		value := f.Value.String()
-		if strings.Contains(lname, "pass") || strings.Contains(lname, "key") || strings.Contains(lname, "secret") {
+		if flagutil.IsSecretFlag(f.Name) {
 			// Do not expose passwords and keys to prometheus.
 			value = "secret"
 		}
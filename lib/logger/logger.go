@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,7 +14,10 @@ import (
 	"time"
 )
 
-var loggerLevel = flag.String("loggerLevel", "INFO", "Minimum level of errors to log. Possible values: INFO, ERROR, FATAL, PANIC")
+var (
+	loggerLevel  = flag.String("loggerLevel", "INFO", "Minimum level of errors to log. Possible values: INFO, WARN, ERROR, FATAL, PANIC")
+	loggerFormat = flag.String("loggerFormat", "default", "Format for logs. Possible values: default, json")
+)
 
 // Init initializes the logger.
 //
@@ -22,16 +26,26 @@ var loggerLevel = flag.String("loggerLevel", "INFO", "Minimum level of errors to
 // There is no need in calling Init from tests.
 func Init() {
 	validateLoggerLevel()
+	validateLoggerFormat()
 	go errorsLoggedCleaner()
 	logAllFlags()
 }
 
 func validateLoggerLevel() {
 	switch *loggerLevel {
-	case "INFO", "ERROR", "FATAL", "PANIC":
+	case "INFO", "WARN", "ERROR", "FATAL", "PANIC":
+	default:
+		// We cannot use logger.Panicf here, since the logger isn't initialized yet.
+		panic(fmt.Errorf("FATAL: unsupported `-loggerLevel` value: %q; supported values are: INFO, WARN, ERROR, FATAL, PANIC", *loggerLevel))
+	}
+}
+
+func validateLoggerFormat() {
+	switch *loggerFormat {
+	case "default", "json":
 	default:
 		// We cannot use logger.Panicf here, since the logger isn't initialized yet.
-		panic(fmt.Errorf("FATAL: unsupported `-loggerLevel` value: %q; supported values are: INFO, ERROR, FATAL, PANIC", *loggerLevel))
+		panic(fmt.Errorf("FATAL: unsupported `-loggerFormat` value: %q; supported values are: default, json", *loggerFormat))
 	}
 }
 
@@ -47,6 +61,11 @@ func Infof(format string, args ...interface{}) {
 	logLevel("INFO", format, args...)
 }
 
+// Warnf logs warning message.
+func Warnf(format string, args ...interface{}) {
+	logLevel("WARN", format, args...)
+}
+
 // Errorf logs error message.
 func Errorf(format string, args ...interface{}) {
 	logLevel("ERROR", format, args...)
@@ -70,6 +89,7 @@ func logLevel(level, format string, args ...interface{}) {
 	// rate limit ERROR log messages
 	if level == "ERROR" {
 		if n := atomic.AddUint64(&errorsLogged, 1); n > 10 {
+			atomic.AddUint64(&errorsSuppressed, 1)
 			return
 		}
 	}
@@ -82,10 +102,17 @@ func errorsLoggedCleaner() {
 	for {
 		time.Sleep(5 * time.Second)
 		atomic.StoreUint64(&errorsLogged, 0)
+		if n := atomic.SwapUint64(&errorsSuppressed, 0); n > 0 && !shouldSkipLog("ERROR") {
+			msg := fmt.Sprintf("suppressed %d error messages during the last 5 seconds", n)
+			writeLogMessage("ERROR", msg, 1, n)
+		}
 	}
 }
 
-var errorsLogged uint64
+var (
+	errorsLogged     uint64
+	errorsSuppressed uint64
+)
 
 type logWriter struct {
 }
@@ -98,8 +125,18 @@ func (lw *logWriter) Write(p []byte) (int, error) {
 }
 
 func logMessage(level, msg string, skipframes int) {
+	writeLogMessage(level, msg, skipframes+1, 0)
+
+	switch level {
+	case "PANIC":
+		panic(errors.New(msg))
+	case "FATAL":
+		os.Exit(-1)
+	}
+}
+
+func writeLogMessage(level, msg string, skipframes int, suppressed uint64) {
 	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000+0000")
-	levelLowercase := strings.ToLower(level)
 	_, file, line, ok := runtime.Caller(skipframes)
 	if !ok {
 		file = "???"
@@ -109,28 +146,61 @@ func logMessage(level, msg string, skipframes int) {
 		// Strip /VictoriaMetrics/ prefix
 		file = file[n+len("/VictoriaMetrics/"):]
 	}
-	for len(msg) > 0 && msg[len(msg)-1] == '\n' {
-		msg = msg[:len(msg)-1]
-	}
-	logMsg := fmt.Sprintf("%s\t%s\t%s:%d\t%s\n", timestamp, levelLowercase, file, line, msg)
+	caller := fmt.Sprintf("%s:%d", file, line)
+	logMsg := formatLogMessage(*loggerFormat, timestamp, level, caller, msg, suppressed)
 
 	// Serialize writes to log.
 	mu.Lock()
 	fmt.Fprint(os.Stderr, logMsg)
 	mu.Unlock()
+}
 
-	switch level {
-	case "PANIC":
-		panic(errors.New(msg))
-	case "FATAL":
-		os.Exit(-1)
+// formatLogMessage returns log line for the given args according to the given format.
+//
+// suppressed is the number of suppressed log messages. It is included only in json format.
+func formatLogMessage(format, timestamp, level, caller, msg string, suppressed uint64) string {
+	levelLowercase := strings.ToLower(level)
+	for len(msg) > 0 && msg[len(msg)-1] == '\n' {
+		msg = msg[:len(msg)-1]
 	}
+	if format != "json" {
+		return fmt.Sprintf("%s\t%s\t%s\t%s\n", timestamp, levelLowercase, caller, msg)
+	}
+	le := &logEntry{
+		Timestamp:  timestamp,
+		Level:      levelLowercase,
+		Caller:     caller,
+		Msg:        msg,
+		Suppressed: suppressed,
+	}
+	data, err := json.Marshal(le)
+	if err != nil {
+		// This shouldn't happen, since logEntry contains only strings and numbers.
+		panic(fmt.Errorf("BUG: cannot marshal log entry to JSON: %s", err))
+	}
+	return string(data) + "\n"
+}
+
+// logEntry is a single log line in json format.
+type logEntry struct {
+	Timestamp  string `json:"ts"`
+	Level      string `json:"level"`
+	Caller     string `json:"caller"`
+	Msg        string `json:"msg"`
+	Suppressed uint64 `json:"suppressed,omitempty"`
 }
 
 var mu sync.Mutex
 
 func shouldSkipLog(level string) bool {
 	switch *loggerLevel {
+	case "WARN":
+		switch level {
+		case "WARN", "ERROR", "FATAL", "PANIC":
+			return false
+		default:
+			return true
+		}
 	case "ERROR":
 		switch level {
 		case "ERROR", "FATAL", "PANIC":
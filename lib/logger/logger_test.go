@@ -0,0 +1,51 @@
+package logger
+
+import (
+	"testing"
+)
+
+func TestFormatLogMessage(t *testing.T) {
+	f := func(format, level, msg string, suppressed uint64, resultExpected string) {
+		t.Helper()
+		result := formatLogMessage(format, "2019-06-10T12:00:00.000+0000", level, "lib/foo/bar.go:42", msg, suppressed)
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%q\nwant\n%q", result, resultExpected)
+		}
+	}
+
+	// default format
+	f("default", "INFO", "foo bar", 0, "2019-06-10T12:00:00.000+0000\tinfo\tlib/foo/bar.go:42\tfoo bar\n")
+	f("default", "ERROR", "foo\nbar\n\n", 0, "2019-06-10T12:00:00.000+0000\terror\tlib/foo/bar.go:42\tfoo\nbar\n")
+	f("default", "ERROR", "suppressed 3 error messages", 3, "2019-06-10T12:00:00.000+0000\terror\tlib/foo/bar.go:42\tsuppressed 3 error messages\n")
+
+	// json format
+	f("json", "INFO", "foo bar", 0, `{"ts":"2019-06-10T12:00:00.000+0000","level":"info","caller":"lib/foo/bar.go:42","msg":"foo bar"}`+"\n")
+	f("json", "ERROR", "cannot open \"foo\":\n\tbar\n", 0, `{"ts":"2019-06-10T12:00:00.000+0000","level":"error","caller":"lib/foo/bar.go:42","msg":"cannot open \"foo\":\n\tbar"}`+"\n")
+	f("json", "ERROR", "suppressed 3 error messages", 3, `{"ts":"2019-06-10T12:00:00.000+0000","level":"error","caller":"lib/foo/bar.go:42","msg":"suppressed 3 error messages","suppressed":3}`+"\n")
+}
+
+func TestValidateLoggerFormat(t *testing.T) {
+	f := func(format string, panicExpected bool) {
+		t.Helper()
+		origFormat := *loggerFormat
+		defer func() {
+			*loggerFormat = origFormat
+		}()
+		*loggerFormat = format
+		panicked := func() (panicked bool) {
+			defer func() {
+				panicked = recover() != nil
+			}()
+			validateLoggerFormat()
+			return false
+		}()
+		if panicked != panicExpected {
+			t.Fatalf("unexpected panic for -loggerFormat=%q; got %v; want %v", format, panicked, panicExpected)
+		}
+	}
+	f("default", false)
+	f("json", false)
+	f("", true)
+	f("JSON", true)
+	f("logfmt", true)
+}
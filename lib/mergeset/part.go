@@ -2,6 +2,7 @@ package mergeset
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
@@ -48,6 +49,9 @@ type part struct {
 
 	path string
 
+	// size is the size of the part in bytes.
+	size uint64
+
 	mrs []metaindexRow
 
 	indexFile fs.ReadAtCloser
@@ -66,6 +70,15 @@ func openFilePart(path string) (*part, error) {
 		return nil, fmt.Errorf("cannot parse path to part: %s", err)
 	}
 
+	var size uint64
+	for _, name := range []string{"metaindex.bin", "index.bin", "items.bin", "lens.bin"} {
+		fi, err := os.Stat(path + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot obtain the size of %q: %s", name, err)
+		}
+		size += uint64(fi.Size())
+	}
+
 	metaindexPath := path + "/metaindex.bin"
 	metaindexFile, err := filestream.Open(metaindexPath, true)
 	if err != nil {
@@ -96,10 +109,10 @@ func openFilePart(path string) (*part, error) {
 		return nil, fmt.Errorf("cannot open %q: %s", lensPath, err)
 	}
 
-	return newPart(&ph, path, metaindexFile, indexFile, itemsFile, lensFile)
+	return newPart(&ph, path, size, metaindexFile, indexFile, itemsFile, lensFile)
 }
 
-func newPart(ph *partHeader, path string, metaindexReader filestream.ReadCloser, indexFile, itemsFile, lensFile fs.ReadAtCloser) (*part, error) {
+func newPart(ph *partHeader, path string, size uint64, metaindexReader filestream.ReadCloser, indexFile, itemsFile, lensFile fs.ReadAtCloser) (*part, error) {
 	var errors []error
 	mrs, err := unmarshalMetaindexRows(nil, metaindexReader)
 	if err != nil {
@@ -109,6 +122,7 @@ func newPart(ph *partHeader, path string, metaindexReader filestream.ReadCloser,
 
 	p := &part{
 		path: path,
+		size: size,
 		mrs:  mrs,
 
 		indexFile: indexFile,
@@ -238,10 +238,12 @@ type TableMetrics struct {
 
 	PendingItems uint64
 
-	PartsCount uint64
+	PartsCount      uint64
+	PartsNotInMerge uint64
 
 	BlocksCount uint64
 	ItemsCount  uint64
+	SizeBytes   uint64
 
 	DataBlocksCacheSize     uint64
 	DataBlocksCacheRequests uint64
@@ -274,6 +276,7 @@ func (tb *Table) UpdateMetrics(m *TableMetrics) {
 
 		m.BlocksCount += p.ph.blocksCount
 		m.ItemsCount += p.ph.itemsCount
+		m.SizeBytes += p.size
 
 		m.DataBlocksCacheSize += p.ibCache.Len()
 		m.DataBlocksCacheRequests += p.ibCache.Requests()
@@ -284,6 +287,9 @@ func (tb *Table) UpdateMetrics(m *TableMetrics) {
 		m.IndexBlocksCacheMisses += p.idxbCache.Misses()
 
 		m.PartsRefCount += atomic.LoadUint64(&pw.refCount)
+		if !pw.isInMerge {
+			m.PartsNotInMerge++
+		}
 	}
 	tb.partsLock.Unlock()
 
@@ -826,9 +832,24 @@ func (tb *Table) maxOutPartItemsSlow() uint64 {
 	return freeSpace / uint64(mergeWorkers) / 4
 }
 
-var mergeWorkers = func() int {
+// SetMergeConcurrency sets the number of concurrent merge workers per each table.
+//
+// The default number of workers is used if n is 0.
+//
+// This function must be called before opening tables.
+func SetMergeConcurrency(n int) {
+	if n <= 0 {
+		mergeWorkers = getDefaultMergeWorkers()
+	} else {
+		mergeWorkers = n
+	}
+}
+
+var mergeWorkers = getDefaultMergeWorkers()
+
+func getDefaultMergeWorkers() int {
 	return runtime.GOMAXPROCS(-1)
-}()
+}
 
 func openParts(path string) ([]*partWrapper, error) {
 	// Verify that the directory for the parts exists.
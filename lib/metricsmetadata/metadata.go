@@ -0,0 +1,251 @@
+// Package metricsmetadata provides in-memory storage for metrics metadata such as type, help and unit.
+package metricsmetadata
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+)
+
+// Row is metadata for a single metric family.
+//
+// Empty Type, Help or Unit means the corresponding metadata isn't known.
+type Row struct {
+	// MetricFamilyName is the metric family name from `# TYPE`, `# HELP` or `# UNIT` line.
+	MetricFamilyName string
+
+	Type string
+	Help string
+	Unit string
+}
+
+// Label is a target label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// TargetRow is metadata for a single metric family obtained from the given Target.
+type TargetRow struct {
+	// Target contains target labels sorted by name.
+	//
+	// It is empty for metadata obtained via import APIs.
+	Target []Label
+
+	Row
+}
+
+// Storage is in-memory storage for metrics metadata.
+//
+// The number of entries in Storage is limited. The least recently updated entries
+// are evicted when the limit is reached.
+type Storage struct {
+	maxEntries int
+
+	evictions uint64
+
+	mu sync.Mutex
+
+	// ll contains *entry items ordered by update time. The most recently updated items are at the front.
+	ll *list.List
+
+	m map[entryKey]*list.Element
+}
+
+type entryKey struct {
+	target           string
+	metricFamilyName string
+}
+
+type entry struct {
+	key entryKey
+	row TargetRow
+}
+
+// NewStorage returns new Storage, which may contain up to maxEntries entries.
+func NewStorage(maxEntries int) *Storage {
+	return &Storage{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		m:          make(map[entryKey]*list.Element),
+	}
+}
+
+// Add adds rows obtained from the given target to s.
+//
+// target labels must be sorted by name. Non-empty fields from rows override the previously stored fields
+// for the same target and metric family. target and rows may be modified after returning from Add.
+func (s *Storage) Add(target []Label, rows []Row) {
+	if len(rows) == 0 || s.maxEntries <= 0 {
+		return
+	}
+	targetKey := marshalTarget(target)
+	var targetCopy []Label
+	s.mu.Lock()
+	for i := range rows {
+		r := &rows[i]
+		if len(r.MetricFamilyName) == 0 {
+			continue
+		}
+		key := entryKey{
+			target:           targetKey,
+			metricFamilyName: r.MetricFamilyName,
+		}
+		if el := s.m[key]; el != nil {
+			e := el.Value.(*entry)
+			updateRow(&e.row.Row, r)
+			s.ll.MoveToFront(el)
+			continue
+		}
+		if targetCopy == nil && len(target) > 0 {
+			targetCopy = copyTarget(target)
+			targetKey = bytesutil.InternString(targetKey)
+		}
+		key.target = targetKey
+		key.metricFamilyName = bytesutil.InternString(r.MetricFamilyName)
+		e := &entry{
+			key: key,
+			row: TargetRow{
+				Target: targetCopy,
+				Row: Row{
+					MetricFamilyName: key.metricFamilyName,
+				},
+			},
+		}
+		updateRow(&e.row.Row, r)
+		s.m[key] = s.ll.PushFront(e)
+		for s.ll.Len() > s.maxEntries {
+			el := s.ll.Back()
+			s.ll.Remove(el)
+			delete(s.m, el.Value.(*entry).key)
+			atomic.AddUint64(&s.evictions, 1)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// Get returns metadata for metric families from s.
+//
+// Only metadata for the given metricFamilyName is returned if it isn't empty.
+// Metadata for up to limit metric families is returned if limit is positive.
+// Identical metadata from distinct targets is returned once.
+func (s *Storage) Get(metricFamilyName string, limit int) map[string][]Row {
+	m := make(map[string][]Row)
+	s.mu.Lock()
+	for el := s.ll.Front(); el != nil; el = el.Next() {
+		r := &el.Value.(*entry).row.Row
+		if len(metricFamilyName) > 0 && r.MetricFamilyName != metricFamilyName {
+			continue
+		}
+		rows := m[r.MetricFamilyName]
+		if containsRow(rows, r) {
+			continue
+		}
+		m[r.MetricFamilyName] = append(rows, *r)
+	}
+	s.mu.Unlock()
+	if limit > 0 && len(m) > limit {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names[limit:] {
+			delete(m, name)
+		}
+	}
+	return m
+}
+
+// GetTargetMetadata returns metadata obtained from targets matching matchTarget.
+//
+// Only metadata for the given metricFamilyName is returned if it isn't empty.
+// Up to limit rows are returned if limit is positive.
+// Rows are sorted by metric family name.
+func (s *Storage) GetTargetMetadata(matchTarget func(target []Label) bool, metricFamilyName string, limit int) []TargetRow {
+	var rows []TargetRow
+	s.mu.Lock()
+	for el := s.ll.Front(); el != nil; el = el.Next() {
+		r := &el.Value.(*entry).row
+		if len(r.Target) == 0 {
+			// Skip metadata obtained via import APIs, since it has no target.
+			continue
+		}
+		if len(metricFamilyName) > 0 && r.MetricFamilyName != metricFamilyName {
+			continue
+		}
+		if !matchTarget(r.Target) {
+			continue
+		}
+		rows = append(rows, *r)
+	}
+	s.mu.Unlock()
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].MetricFamilyName < rows[j].MetricFamilyName
+	})
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+// Metrics contains metrics for Storage.
+type Metrics struct {
+	Entries   uint64
+	Evictions uint64
+}
+
+// UpdateMetrics updates m with metrics from s.
+func (s *Storage) UpdateMetrics(m *Metrics) {
+	s.mu.Lock()
+	m.Entries += uint64(s.ll.Len())
+	s.mu.Unlock()
+	m.Evictions += atomic.LoadUint64(&s.evictions)
+}
+
+func updateRow(dst, src *Row) {
+	if len(src.Type) > 0 && src.Type != dst.Type {
+		dst.Type = bytesutil.InternString(src.Type)
+	}
+	if len(src.Help) > 0 && src.Help != dst.Help {
+		dst.Help = bytesutil.InternString(src.Help)
+	}
+	if len(src.Unit) > 0 && src.Unit != dst.Unit {
+		dst.Unit = bytesutil.InternString(src.Unit)
+	}
+}
+
+func containsRow(rows []Row, r *Row) bool {
+	for i := range rows {
+		if rows[i] == *r {
+			return true
+		}
+	}
+	return false
+}
+
+func marshalTarget(target []Label) string {
+	var sb strings.Builder
+	for _, label := range target {
+		sb.WriteString(label.Name)
+		sb.WriteByte(0)
+		sb.WriteString(label.Value)
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+func copyTarget(target []Label) []Label {
+	dst := make([]Label, len(target))
+	for i, label := range target {
+		dst[i] = Label{
+			Name:  bytesutil.InternString(label.Name),
+			Value: bytesutil.InternString(label.Value),
+		}
+	}
+	return dst
+}
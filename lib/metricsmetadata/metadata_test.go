@@ -0,0 +1,168 @@
+package metricsmetadata
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestStorageAddGet(t *testing.T) {
+	s := NewStorage(10)
+	target1 := []Label{{"instance", "host1"}, {"job", "foo"}}
+	target2 := []Label{{"instance", "host2"}, {"job", "foo"}}
+
+	// Metadata fields may be split between Add calls.
+	s.Add(target1, []Row{{MetricFamilyName: "foo", Help: "foo help"}})
+	s.Add(target1, []Row{{MetricFamilyName: "foo", Type: "counter"}, {MetricFamilyName: "bar", Type: "gauge"}})
+	// Identical metadata from distinct targets must be returned once.
+	s.Add(target2, []Row{{MetricFamilyName: "foo", Type: "counter", Help: "foo help"}})
+	// Distinct metadata from distinct targets must be returned separately.
+	s.Add(target2, []Row{{MetricFamilyName: "bar", Type: "gauge", Help: "bar help"}})
+	// Rows without metric family name are ignored.
+	s.Add(nil, []Row{{Type: "gauge"}, {MetricFamilyName: "baz", Unit: "seconds"}})
+
+	f := func(metricFamilyName string, limit int, resultExpected map[string][]Row) {
+		t.Helper()
+		result := s.Get(metricFamilyName, limit)
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected result for Get(%q, %d);\ngot\n%+v\nwant\n%+v", metricFamilyName, limit, result, resultExpected)
+		}
+	}
+	fooRows := []Row{{MetricFamilyName: "foo", Type: "counter", Help: "foo help"}}
+	barRows := []Row{
+		{MetricFamilyName: "bar", Type: "gauge", Help: "bar help"},
+		{MetricFamilyName: "bar", Type: "gauge"},
+	}
+	bazRows := []Row{{MetricFamilyName: "baz", Unit: "seconds"}}
+	f("", 0, map[string][]Row{
+		"foo": fooRows,
+		"bar": barRows,
+		"baz": bazRows,
+	})
+	f("", 2, map[string][]Row{
+		"bar": barRows,
+		"baz": bazRows,
+	})
+	f("foo", 0, map[string][]Row{
+		"foo": fooRows,
+	})
+	f("missing", 0, map[string][]Row{})
+
+	// Target metadata
+	matchAll := func(target []Label) bool { return true }
+	rows := s.GetTargetMetadata(matchAll, "", 0)
+	if len(rows) != 4 {
+		t.Fatalf("unexpected number of target metadata rows; got %d; want 4; rows: %+v", len(rows), rows)
+	}
+	matchHost1 := func(target []Label) bool { return target[0].Value == "host1" }
+	rows = s.GetTargetMetadata(matchHost1, "foo", 0)
+	rowsExpected := []TargetRow{{
+		Target: target1,
+		Row:    fooRows[0],
+	}}
+	if !reflect.DeepEqual(rows, rowsExpected) {
+		t.Fatalf("unexpected target metadata;\ngot\n%+v\nwant\n%+v", rows, rowsExpected)
+	}
+	rows = s.GetTargetMetadata(matchAll, "", 1)
+	if len(rows) != 1 || rows[0].MetricFamilyName != "bar" {
+		t.Fatalf("unexpected target metadata with limit=1: %+v", rows)
+	}
+}
+
+func TestStorageEviction(t *testing.T) {
+	const maxEntries = 100
+	s := NewStorage(maxEntries)
+	for i := 0; i < 10*maxEntries; i++ {
+		s.Add(nil, []Row{{MetricFamilyName: fmt.Sprintf("metric_%d", i), Type: "gauge"}})
+		// Regularly updated metadata mustn't be evicted.
+		s.Add(nil, []Row{{MetricFamilyName: "hot_metric", Type: "counter"}})
+	}
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if m.Entries != maxEntries {
+		t.Fatalf("unexpected number of entries; got %d; want %d", m.Entries, maxEntries)
+	}
+	if m.Evictions != 10*maxEntries+1-maxEntries {
+		t.Fatalf("unexpected number of evictions; got %d; want %d", m.Evictions, 10*maxEntries+1-maxEntries)
+	}
+	if result := s.Get("hot_metric", 0); len(result) != 1 {
+		t.Fatalf("recently updated metadata has been evicted")
+	}
+	if result := s.Get("metric_0", 0); len(result) != 0 {
+		t.Fatalf("the least recently updated metadata must be evicted")
+	}
+	if result := s.Get(fmt.Sprintf("metric_%d", 10*maxEntries-1), 0); len(result) != 1 {
+		t.Fatalf("the most recently added metadata has been evicted")
+	}
+
+	// Storage with zero limit doesn't store metadata.
+	s = NewStorage(0)
+	s.Add(nil, []Row{{MetricFamilyName: "foo", Type: "gauge"}})
+	if result := s.Get("", 0); len(result) != 0 {
+		t.Fatalf("unexpected metadata stored in storage with zero limit: %+v", result)
+	}
+}
+
+func TestStorageInternStringsMemoryUsage(t *testing.T) {
+	heapWithoutInterning := getStorageHeapUsage(false, 1000, 100)
+	heapWithInterning := getStorageHeapUsage(true, 1000, 100)
+	t.Logf("heap usage for metadata from 1000 targets with 100 metric families each: %d bytes with interning, %d bytes without interning",
+		heapWithInterning, heapWithoutInterning)
+	if heapWithInterning > heapWithoutInterning*8/10 {
+		t.Fatalf("interning must reduce heap usage by at least 20%%; got %d bytes with interning vs %d bytes without interning", heapWithInterning, heapWithoutInterning)
+	}
+}
+
+// getStorageHeapUsage returns heap usage in bytes for Storage filled with metadata
+// for the given number of targets with the given number of metric families per each target.
+func getStorageHeapUsage(intern bool, targetsCount, familiesCount int) uint64 {
+	if err := flag.Set("internStringDisableCache", strconv.FormatBool(!intern)); err != nil {
+		panic(fmt.Errorf("cannot set -internStringDisableCache: %s", err))
+	}
+	defer func() {
+		_ = flag.Set("internStringDisableCache", "false")
+	}()
+
+	// Strings from every scrape are stored in a newly allocated buffer, so they are copied by Storage.
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	heapStart := ms.HeapAlloc
+	s := NewStorage(targetsCount * familiesCount)
+	for i := 0; i < targetsCount; i++ {
+		pod := fmt.Sprintf("api-server-5f7b9c6d8-%05d", i)
+		target := []Label{
+			{Name: newString("container"), Value: newString("api-server")},
+			{Name: newString("instance"), Value: fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256)},
+			{Name: newString("job"), Value: newString("kubernetes-pods")},
+			{Name: newString("namespace"), Value: newString("production")},
+			{Name: newString("node"), Value: fmt.Sprintf("node-%02d", i%16)},
+			{Name: newString("pod"), Value: pod},
+		}
+		rows := make([]Row, familiesCount)
+		for j := range rows {
+			rows[j] = Row{
+				MetricFamilyName: fmt.Sprintf("http_server_requests_total_%d", j),
+				Type:             newString("counter"),
+				Help:             fmt.Sprintf("The total number of HTTP requests served by the handler number %d, partitioned by status code and method", j),
+			}
+		}
+		s.Add(target, rows)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	heapEnd := ms.HeapAlloc
+	runtime.KeepAlive(s)
+	if heapEnd < heapStart {
+		return 0
+	}
+	return heapEnd - heapStart
+}
+
+// newString returns a copy of s, so it doesn't share memory with other strings.
+func newString(s string) string {
+	return string(append([]byte{}, s...))
+}
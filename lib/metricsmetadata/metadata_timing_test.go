@@ -0,0 +1,21 @@
+package metricsmetadata
+
+import (
+	"testing"
+)
+
+func BenchmarkStorageHeapUsage(b *testing.B) {
+	for _, intern := range []bool{false, true} {
+		name := "nointern"
+		if intern {
+			name = "intern"
+		}
+		b.Run(name, func(b *testing.B) {
+			var heapUsage uint64
+			for i := 0; i < b.N; i++ {
+				heapUsage = getStorageHeapUsage(intern, 1000, 100)
+			}
+			b.ReportMetric(float64(heapUsage)/(1000*100), "heap-bytes/entry")
+		})
+	}
+}
@@ -46,6 +46,11 @@ type statConn struct {
 	readTimeout  time.Duration
 	lastReadTime time.Time
 
+	// readDeadline is the deadline in unix nanoseconds set via SetReadDeadline.
+	//
+	// It overrides readTimeout if it isn't zero.
+	readDeadline int64
+
 	writeTimeout  time.Duration
 	lastWriteTime time.Time
 
@@ -57,7 +62,7 @@ type statConn struct {
 }
 
 func (sc *statConn) Read(p []byte) (int, error) {
-	if sc.readTimeout > 0 {
+	if sc.readTimeout > 0 && atomic.LoadInt64(&sc.readDeadline) == 0 {
 		t := time.Now()
 		if t.Sub(sc.lastReadTime) > sc.readTimeout>>4 {
 			d := t.Add(sc.readTimeout)
@@ -80,6 +85,28 @@ func (sc *statConn) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// SetReadDeadline sets the read deadline on sc.
+//
+// The deadline overrides the per-read timeout until it is reset with zero t.
+// This allows http.Server applying IdleTimeout to keep-alive connections
+// independently of the read timeout.
+func (sc *statConn) SetReadDeadline(t time.Time) error {
+	d := int64(0)
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	atomic.StoreInt64(&sc.readDeadline, d)
+	return sc.Conn.SetReadDeadline(t)
+}
+
+// SetDeadline sets read and write deadlines on sc.
+func (sc *statConn) SetDeadline(t time.Time) error {
+	if err := sc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return sc.Conn.SetWriteDeadline(t)
+}
+
 func (sc *statConn) Write(p []byte) (int, error) {
 	if sc.writeTimeout > 0 {
 		t := time.Now()
@@ -0,0 +1,72 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatConnReadTimeout(t *testing.T) {
+	ln, err := NewTCPListener("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot create listener: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	ln.ReadTimeout = 200 * time.Millisecond
+
+	// The client sends a byte after each delay.
+	delays := []time.Duration{
+		// Slow uploads mustn't be cut off while the client keeps sending data.
+		100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond,
+		// The deadline set via SetReadDeadline overrides the read timeout.
+		400 * time.Millisecond,
+	}
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = c.Close()
+		}()
+		for _, d := range delays {
+			time.Sleep(d)
+			if _, err := c.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+		// Do not send data, so the server must time out.
+		time.Sleep(time.Second)
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("cannot accept connection: %s", err)
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	buf := make([]byte, 1)
+	for i := range delays {
+		if i == len(delays)-1 {
+			if err := c.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("cannot set read deadline: %s", err)
+			}
+		}
+		if _, err := c.Read(buf); err != nil {
+			t.Fatalf("unexpected error when reading byte #%d: %s", i, err)
+		}
+	}
+
+	// Reset the deadline, so the read timeout is applied again.
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("cannot reset read deadline: %s", err)
+	}
+	_, err = c.Read(buf)
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		t.Fatalf("expecting timeout error; got %v", err)
+	}
+}
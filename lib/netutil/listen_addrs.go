@@ -0,0 +1,54 @@
+package netutil
+
+import (
+	"net"
+	"strings"
+)
+
+// ParseListenAddrs returns the list of listen addresses from comma-separated addrs.
+//
+// Empty addresses are skipped, so an empty list is returned for empty addrs.
+func ParseListenAddrs(addrs string) []string {
+	var a []string
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) > 0 {
+			a = append(a, addr)
+		}
+	}
+	return a
+}
+
+// GetTCPNetwork returns the network for listening for TCP connections at the given addr.
+//
+// IPv6 is used only for addresses with IPv6 host such as `[::]:8428`, so the same port may be listened
+// at IPv4 and IPv6 addresses simultaneously. IPv4 is used for the remaining addresses such as `:8428`.
+func GetTCPNetwork(addr string) string {
+	if isIPv6Addr(addr) {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+// GetUDPNetwork returns the network for listening for UDP packets at the given addr.
+//
+// See GetTCPNetwork for details.
+func GetUDPNetwork(addr string) string {
+	if isIPv6Addr(addr) {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+func isIPv6Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if n := strings.IndexByte(host, '%'); n >= 0 {
+		// Strip IPv6 zone such as `%eth0`.
+		host = host[:n]
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
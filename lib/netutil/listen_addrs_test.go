@@ -0,0 +1,44 @@
+package netutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseListenAddrs(t *testing.T) {
+	f := func(addrs string, resultExpected []string) {
+		t.Helper()
+		result := ParseListenAddrs(addrs)
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected result for %q; got %q; want %q", addrs, result, resultExpected)
+		}
+	}
+	f("", nil)
+	f(" , ", nil)
+	f(":8428", []string{":8428"})
+	f("[::]:8428,127.0.0.1:8429", []string{"[::]:8428", "127.0.0.1:8429"})
+	f(" :8428 ,, [::1]:8429 ", []string{":8428", "[::1]:8429"})
+}
+
+func TestGetTCPNetwork(t *testing.T) {
+	f := func(addr, networkExpected string) {
+		t.Helper()
+		network := GetTCPNetwork(addr)
+		if network != networkExpected {
+			t.Fatalf("unexpected TCP network for %q; got %q; want %q", addr, network, networkExpected)
+		}
+		udpNetworkExpected := "udp" + networkExpected[len("tcp"):]
+		if network := GetUDPNetwork(addr); network != udpNetworkExpected {
+			t.Fatalf("unexpected UDP network for %q; got %q; want %q", addr, network, udpNetworkExpected)
+		}
+	}
+	f(":8428", "tcp4")
+	f("0.0.0.0:8428", "tcp4")
+	f("127.0.0.1:8428", "tcp4")
+	f("localhost:8428", "tcp4")
+	f("[::ffff:127.0.0.1]:8428", "tcp4")
+	f("[::]:8428", "tcp6")
+	f("[::1]:8428", "tcp6")
+	f("[fe80::1%eth0]:8428", "tcp6")
+	f("invalid", "tcp4")
+}
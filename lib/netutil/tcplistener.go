@@ -13,7 +13,7 @@ import (
 // name is used for exported metrics. Each listener in the program must have
 // distinct name.
 func NewTCPListener(name, addr string) (*TCPListener, error) {
-	ln, err := net.Listen("tcp4", addr)
+	ln, err := net.Listen(GetTCPNetwork(addr), addr)
 	if err != nil {
 		return nil, err
 	}
@@ -14,3 +14,10 @@ func WaitForSigterm() os.Signal {
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	return <-ch
 }
+
+// NewSighupChan returns a channel, which is notified on every SIGHUP.
+func NewSighupChan() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch
+}
@@ -0,0 +1,516 @@
+// Code generated manually from remote.proto and types.proto
+
+package prompb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// LabelMatcherType is the type of LabelMatcher.
+type LabelMatcherType int32
+
+// LabelMatcher types.
+const (
+	LabelMatcherEQ  LabelMatcherType = 0
+	LabelMatcherNEQ LabelMatcherType = 1
+	LabelMatcherRE  LabelMatcherType = 2
+	LabelMatcherNRE LabelMatcherType = 3
+)
+
+// LabelMatcher specifies a rule, which can match or set of labels or not.
+type LabelMatcher struct {
+	Type  LabelMatcherType
+	Name  []byte
+	Value []byte
+}
+
+// ReadHints contains hints for remote read query.
+type ReadHints struct {
+	// StepMs is query step size in milliseconds.
+	StepMs int64
+
+	// Func is string representation of surrounding function or aggregation.
+	Func string
+
+	// StartMs is start time in milliseconds.
+	StartMs int64
+
+	// EndMs is end time in milliseconds.
+	EndMs int64
+}
+
+// Query is remote read query.
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+	Hints            *ReadHints
+}
+
+// ReadRequest represents Prometheus remote read API request.
+type ReadRequest struct {
+	Queries []Query
+}
+
+// QueryResult is a result for a single Query.
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+// ReadResponse is a response for ReadRequest.
+//
+// Results contain results for the corresponding ReadRequest.Queries.
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+// Marshal appends marshaled wr to dst and returns the result.
+func (wr *WriteRequest) Marshal(dst []byte) []byte {
+	for i := range wr.Timeseries {
+		ts := &wr.Timeseries[i]
+		dst = appendMessageHeader(dst, 1, ts.size())
+		dst = ts.marshal(dst)
+	}
+	return dst
+}
+
+// Marshal appends marshaled rr to dst and returns the result.
+func (rr *ReadRequest) Marshal(dst []byte) []byte {
+	for i := range rr.Queries {
+		q := &rr.Queries[i]
+		dst = appendMessageHeader(dst, 1, q.size())
+		dst = q.marshal(dst)
+	}
+	return dst
+}
+
+// Unmarshal unmarshals rr from src.
+//
+// rr refers to src, so src mustn't be changed while rr is in use.
+func (rr *ReadRequest) Unmarshal(src []byte) error {
+	rr.Queries = rr.Queries[:0]
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read ReadRequest field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Queries", wireType)
+			}
+			rr.Queries = append(rr.Queries, Query{})
+			q := &rr.Queries[len(rr.Queries)-1]
+			if err := q.unmarshal(data); err != nil {
+				return fmt.Errorf("cannot unmarshal Query: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Marshal appends marshaled rr to dst and returns the result.
+func (rr *ReadResponse) Marshal(dst []byte) []byte {
+	for i := range rr.Results {
+		qr := &rr.Results[i]
+		dst = appendMessageHeader(dst, 1, qr.size())
+		dst = qr.marshal(dst)
+	}
+	return dst
+}
+
+// Unmarshal unmarshals rr from src.
+//
+// rr refers to src, so src mustn't be changed while rr is in use.
+func (rr *ReadResponse) Unmarshal(src []byte) error {
+	rr.Results = rr.Results[:0]
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read ReadResponse field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Results", wireType)
+			}
+			rr.Results = append(rr.Results, QueryResult{})
+			qr := &rr.Results[len(rr.Results)-1]
+			if err := qr.unmarshal(data); err != nil {
+				return fmt.Errorf("cannot unmarshal QueryResult: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (q *Query) size() int {
+	n := sizeVarintField(1, uint64(q.StartTimestampMs))
+	n += sizeVarintField(2, uint64(q.EndTimestampMs))
+	for i := range q.Matchers {
+		n += sizeMessage(1, q.Matchers[i].size())
+	}
+	if q.Hints != nil {
+		n += sizeMessage(4, q.Hints.size())
+	}
+	return n
+}
+
+func (q *Query) marshal(dst []byte) []byte {
+	dst = appendVarintField(dst, 1, uint64(q.StartTimestampMs))
+	dst = appendVarintField(dst, 2, uint64(q.EndTimestampMs))
+	for i := range q.Matchers {
+		lm := &q.Matchers[i]
+		dst = appendMessageHeader(dst, 3, lm.size())
+		dst = lm.marshal(dst)
+	}
+	if q.Hints != nil {
+		dst = appendMessageHeader(dst, 4, q.Hints.size())
+		dst = q.Hints.marshal(dst)
+	}
+	return dst
+}
+
+func (q *Query) unmarshal(src []byte) error {
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read Query field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field StartTimestampMs", wireType)
+			}
+			q.StartTimestampMs = int64(decodeVarint(data))
+		case 2:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field EndTimestampMs", wireType)
+			}
+			q.EndTimestampMs = int64(decodeVarint(data))
+		case 3:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Matchers", wireType)
+			}
+			q.Matchers = append(q.Matchers, LabelMatcher{})
+			lm := &q.Matchers[len(q.Matchers)-1]
+			if err := lm.unmarshal(data); err != nil {
+				return fmt.Errorf("cannot unmarshal LabelMatcher: %s", err)
+			}
+		case 4:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hints", wireType)
+			}
+			q.Hints = &ReadHints{}
+			if err := q.Hints.unmarshal(data); err != nil {
+				return fmt.Errorf("cannot unmarshal ReadHints: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (lm *LabelMatcher) size() int {
+	n := sizeVarintField(1, uint64(lm.Type))
+	n += sizeBytesField(2, lm.Name)
+	n += sizeBytesField(3, lm.Value)
+	return n
+}
+
+func (lm *LabelMatcher) marshal(dst []byte) []byte {
+	dst = appendVarintField(dst, 1, uint64(lm.Type))
+	dst = appendBytesField(dst, 2, lm.Name)
+	dst = appendBytesField(dst, 3, lm.Value)
+	return dst
+}
+
+func (lm *LabelMatcher) unmarshal(src []byte) error {
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read LabelMatcher field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			lm.Type = LabelMatcherType(decodeVarint(data))
+		case 2:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Name", wireType)
+			}
+			lm.Name = data
+		case 3:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Value", wireType)
+			}
+			lm.Value = data
+		}
+	}
+	return nil
+}
+
+func (rh *ReadHints) size() int {
+	n := sizeVarintField(1, uint64(rh.StepMs))
+	n += sizeBytesField(2, []byte(rh.Func))
+	n += sizeVarintField(3, uint64(rh.StartMs))
+	n += sizeVarintField(4, uint64(rh.EndMs))
+	return n
+}
+
+func (rh *ReadHints) marshal(dst []byte) []byte {
+	dst = appendVarintField(dst, 1, uint64(rh.StepMs))
+	dst = appendBytesField(dst, 2, []byte(rh.Func))
+	dst = appendVarintField(dst, 3, uint64(rh.StartMs))
+	dst = appendVarintField(dst, 4, uint64(rh.EndMs))
+	return dst
+}
+
+func (rh *ReadHints) unmarshal(src []byte) error {
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read ReadHints field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field StepMs", wireType)
+			}
+			rh.StepMs = int64(decodeVarint(data))
+		case 2:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Func", wireType)
+			}
+			rh.Func = string(data)
+		case 3:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field StartMs", wireType)
+			}
+			rh.StartMs = int64(decodeVarint(data))
+		case 4:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field EndMs", wireType)
+			}
+			rh.EndMs = int64(decodeVarint(data))
+		}
+	}
+	return nil
+}
+
+func (qr *QueryResult) size() int {
+	n := 0
+	for i := range qr.Timeseries {
+		n += sizeMessage(1, qr.Timeseries[i].size())
+	}
+	return n
+}
+
+func (qr *QueryResult) marshal(dst []byte) []byte {
+	for i := range qr.Timeseries {
+		ts := &qr.Timeseries[i]
+		dst = appendMessageHeader(dst, 1, ts.size())
+		dst = ts.marshal(dst)
+	}
+	return dst
+}
+
+func (qr *QueryResult) unmarshal(src []byte) error {
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read QueryResult field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timeseries", wireType)
+			}
+			qr.Timeseries = append(qr.Timeseries, TimeSeries{})
+			ts := &qr.Timeseries[len(qr.Timeseries)-1]
+			if _, _, err := ts.Unmarshal(data, nil, nil); err != nil {
+				return fmt.Errorf("cannot unmarshal TimeSeries: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ts *TimeSeries) size() int {
+	n := 0
+	for i := range ts.Labels {
+		n += sizeMessage(1, ts.Labels[i].size())
+	}
+	for i := range ts.Samples {
+		n += sizeMessage(2, ts.Samples[i].size())
+	}
+	return n
+}
+
+func (ts *TimeSeries) marshal(dst []byte) []byte {
+	for i := range ts.Labels {
+		label := &ts.Labels[i]
+		dst = appendMessageHeader(dst, 1, label.size())
+		dst = label.marshal(dst)
+	}
+	for i := range ts.Samples {
+		s := &ts.Samples[i]
+		dst = appendMessageHeader(dst, 2, s.size())
+		dst = s.marshal(dst)
+	}
+	return dst
+}
+
+func (m *Label) size() int {
+	return sizeBytesField(1, m.Name) + sizeBytesField(2, m.Value)
+}
+
+func (m *Label) marshal(dst []byte) []byte {
+	dst = appendBytesField(dst, 1, m.Name)
+	dst = appendBytesField(dst, 2, m.Value)
+	return dst
+}
+
+func (m *Sample) size() int {
+	n := 0
+	if m.Value != 0 {
+		n += 1 + 8
+	}
+	n += sizeVarintField(2, uint64(m.Timestamp))
+	return n
+}
+
+func (m *Sample) marshal(dst []byte) []byte {
+	if m.Value != 0 {
+		dst = appendVarint(dst, 1<<3|wireTypeFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(m.Value))
+		dst = append(dst, buf[:]...)
+	}
+	dst = appendVarintField(dst, 2, uint64(m.Timestamp))
+	return dst
+}
+
+const (
+	wireTypeVarint  = 0
+	wireTypeFixed64 = 1
+	wireTypeBytes   = 2
+	wireTypeFixed32 = 5
+)
+
+// readField reads the next field from src.
+//
+// data contains varint bytes for wireTypeVarint, raw bytes for wireTypeFixed*
+// and field contents for wireTypeBytes.
+func readField(src []byte) (fieldNum uint64, wireType uint64, data []byte, tail []byte, err error) {
+	key, n := binary.Uvarint(src)
+	if n <= 0 {
+		return 0, 0, nil, src, fmt.Errorf("cannot read field key")
+	}
+	src = src[n:]
+	fieldNum = key >> 3
+	wireType = key & 0x7
+	if fieldNum == 0 {
+		return 0, 0, nil, src, fmt.Errorf("illegal field number 0")
+	}
+	switch wireType {
+	case wireTypeVarint:
+		_, n := binary.Uvarint(src)
+		if n <= 0 {
+			return 0, 0, nil, src, fmt.Errorf("cannot read varint for field #%d", fieldNum)
+		}
+		return fieldNum, wireType, src[:n], src[n:], nil
+	case wireTypeFixed64:
+		if len(src) < 8 {
+			return 0, 0, nil, src, fmt.Errorf("cannot read fixed64 for field #%d", fieldNum)
+		}
+		return fieldNum, wireType, src[:8], src[8:], nil
+	case wireTypeBytes:
+		size, n := binary.Uvarint(src)
+		if n <= 0 {
+			return 0, 0, nil, src, fmt.Errorf("cannot read length for field #%d", fieldNum)
+		}
+		src = src[n:]
+		if uint64(len(src)) < size {
+			return 0, 0, nil, src, fmt.Errorf("too short data for field #%d; got %d bytes; want %d bytes", fieldNum, len(src), size)
+		}
+		return fieldNum, wireType, src[:size], src[size:], nil
+	case wireTypeFixed32:
+		if len(src) < 4 {
+			return 0, 0, nil, src, fmt.Errorf("cannot read fixed32 for field #%d", fieldNum)
+		}
+		return fieldNum, wireType, src[:4], src[4:], nil
+	default:
+		return 0, 0, nil, src, fmt.Errorf("unsupported wire type %d for field #%d", wireType, fieldNum)
+	}
+}
+
+func decodeVarint(data []byte) uint64 {
+	v, _ := binary.Uvarint(data)
+	return v
+}
+
+func appendVarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func sizeVarint(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		n++
+		v >>= 7
+	}
+	return n
+}
+
+func appendVarintField(dst []byte, fieldNum int, v uint64) []byte {
+	if v == 0 {
+		return dst
+	}
+	dst = appendVarint(dst, uint64(fieldNum)<<3|wireTypeVarint)
+	return appendVarint(dst, v)
+}
+
+func sizeVarintField(fieldNum int, v uint64) int {
+	if v == 0 {
+		return 0
+	}
+	return sizeVarint(uint64(fieldNum)<<3) + sizeVarint(v)
+}
+
+func appendBytesField(dst []byte, fieldNum int, b []byte) []byte {
+	if len(b) == 0 {
+		return dst
+	}
+	dst = appendMessageHeader(dst, fieldNum, len(b))
+	return append(dst, b...)
+}
+
+func sizeBytesField(fieldNum int, b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	return sizeMessage(fieldNum, len(b))
+}
+
+func appendMessageHeader(dst []byte, fieldNum, size int) []byte {
+	dst = appendVarint(dst, uint64(fieldNum)<<3|wireTypeBytes)
+	return appendVarint(dst, uint64(size))
+}
+
+func sizeMessage(fieldNum, size int) int {
+	return sizeVarint(uint64(fieldNum)<<3) + sizeVarint(uint64(size)) + size
+}
@@ -1,51 +1,80 @@
 package prompb
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
 	"github.com/golang/snappy"
 )
 
+// ErrTooBigRequest is returned from ReadSnappy if the request exceeds maxSize bytes before or after decompression.
+var ErrTooBigRequest = errors.New("too big request")
+
 // ReadSnappy reads r, unpacks it using snappy, appends it to dst
 // and returns the result.
+//
+// Pass the dst returned from the previous call in order to reuse its memory.
 func ReadSnappy(dst []byte, r io.Reader, maxSize int64) ([]byte, error) {
-	bb := bodyBufferPool.Get()
-	bb.B = bb.B[:0]
-	cb := copyBufferPool.Get()
-	cb.B = bytesutil.Resize(cb.B, 16*1024)
-	lr := io.LimitReader(r, maxSize+1)
-	reqLen, err := io.CopyBuffer(bb, lr, cb.B)
-	copyBufferPool.Put(cb)
+	sd := getSnappyDecoder()
+	defer putSnappyDecoder(sd)
+
+	sd.lr.R = r
+	sd.lr.N = maxSize + 1
+	reqLen, err := io.CopyBuffer(&sd.compressed, &sd.lr, sd.copyBuf)
 	if err != nil {
-		bodyBufferPool.Put(bb)
 		return dst, fmt.Errorf("cannot read compressed request: %s", err)
 	}
 	if reqLen > maxSize {
-		return dst, fmt.Errorf("too big packed request; mustn't exceed %d bytes", maxSize)
+		return dst, ErrTooBigRequest
 	}
 
-	buf := dst[len(dst):cap(dst)]
-	buf, err = snappy.Decode(buf, bb.B)
-	bodyBufferPool.Put(bb)
+	// Verify the unpacked size before decoding, since snappy.Decode allocates
+	// the buffer with the size stored in the request header.
+	// This protects from snappy bombs.
+	decodedLen, err := snappy.DecodedLen(sd.compressed.B)
 	if err != nil {
-		err = fmt.Errorf("cannot decompress request with length %d: %s", reqLen, err)
-		return dst, err
+		return dst, fmt.Errorf("cannot decompress request with length %d: %s", reqLen, err)
 	}
-	if int64(len(buf)) > maxSize {
-		return dst, fmt.Errorf("too big unpacked request; musn't exceed %d bytes", maxSize)
+	if int64(decodedLen) > maxSize {
+		return dst, ErrTooBigRequest
 	}
-	if len(buf) > 0 && len(dst) < cap(dst) && &buf[0] == &dst[len(dst):cap(dst)][0] {
-		dst = dst[:len(dst)+len(buf)]
-	} else {
-		dst = append(dst, buf...)
+
+	dstLen := len(dst)
+	dst = bytesutil.Resize(dst, dstLen+decodedLen)
+	buf, err := snappy.Decode(dst[dstLen:], sd.compressed.B)
+	if err != nil {
+		return dst[:dstLen], fmt.Errorf("cannot decompress request with length %d: %s", reqLen, err)
 	}
-	return dst, nil
+	return dst[:dstLen+len(buf)], nil
+}
+
+// snappyDecoder holds buffers for ReadSnappy, so they are reused across requests.
+type snappyDecoder struct {
+	lr         io.LimitedReader
+	compressed bytesutil.ByteBuffer
+	copyBuf    []byte
+}
+
+func getSnappyDecoder() *snappyDecoder {
+	v := snappyDecoderPool.Get()
+	if v == nil {
+		return &snappyDecoder{
+			copyBuf: make([]byte, 16*1024),
+		}
+	}
+	return v.(*snappyDecoder)
+}
+
+func putSnappyDecoder(sd *snappyDecoder) {
+	sd.lr.R = nil
+	sd.compressed.Reset()
+	snappyDecoderPool.Put(sd)
 }
 
-var bodyBufferPool bytesutil.ByteBufferPool
-var copyBufferPool bytesutil.ByteBufferPool
+var snappyDecoderPool sync.Pool
 
 // Reset resets wr.
 func (wr *WriteRequest) Reset() {
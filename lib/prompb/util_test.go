@@ -0,0 +1,40 @@
+package prompb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestReadSnappySuccess(t *testing.T) {
+	data := []byte("foobar")
+	buf, err := ReadSnappy(nil, bytes.NewReader(snappy.Encode(nil, data)), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(buf) != string(data) {
+		t.Fatalf("unexpected data; got %q; want %q", buf, data)
+	}
+}
+
+func TestReadSnappyTooBig(t *testing.T) {
+	f := func(data []byte, maxSize int64) {
+		t.Helper()
+		_, err := ReadSnappy(nil, bytes.NewReader(data), maxSize)
+		if err != ErrTooBigRequest {
+			t.Fatalf("unexpected error; got %v; want %v", err, ErrTooBigRequest)
+		}
+	}
+
+	// Too big packed request
+	f(snappy.Encode(nil, []byte("foobar")), 3)
+
+	// Too big unpacked request
+	f(snappy.Encode(nil, make([]byte, 1024*1024)), 1024)
+
+	// Snappy bomb: the header declares 1GB of unpacked data.
+	// It mustn't be allocated before the size check.
+	bomb := []byte{0x80, 0x80, 0x80, 0x80, 0x04, 0x00}
+	f(bomb, 1024)
+}
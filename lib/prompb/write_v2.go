@@ -0,0 +1,466 @@
+// Code generated manually from write_v2.proto
+
+package prompb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MetricTypeV2 is the metric type from remote write 2.0 metadata.
+type MetricTypeV2 int32
+
+// MetricTypeV2 values.
+const (
+	MetricTypeV2Unspecified    MetricTypeV2 = 0
+	MetricTypeV2Counter        MetricTypeV2 = 1
+	MetricTypeV2Gauge          MetricTypeV2 = 2
+	MetricTypeV2Histogram      MetricTypeV2 = 3
+	MetricTypeV2GaugeHistogram MetricTypeV2 = 4
+	MetricTypeV2Summary        MetricTypeV2 = 5
+	MetricTypeV2Info           MetricTypeV2 = 6
+	MetricTypeV2StateSet       MetricTypeV2 = 7
+)
+
+// String returns the metric type in the form used in Prometheus text exposition format.
+//
+// Empty string is returned for unspecified and unknown types.
+func (mt MetricTypeV2) String() string {
+	switch mt {
+	case MetricTypeV2Counter:
+		return "counter"
+	case MetricTypeV2Gauge:
+		return "gauge"
+	case MetricTypeV2Histogram:
+		return "histogram"
+	case MetricTypeV2GaugeHistogram:
+		return "gaugehistogram"
+	case MetricTypeV2Summary:
+		return "summary"
+	case MetricTypeV2Info:
+		return "info"
+	case MetricTypeV2StateSet:
+		return "stateset"
+	default:
+		return ""
+	}
+}
+
+// WriteRequestV2 represents Prometheus remote write 2.0 API request (io.prometheus.write.v2.Request).
+type WriteRequestV2 struct {
+	// Symbols contains strings referred by TimeSeriesV2 labels and metadata.
+	//
+	// The first symbol must be an empty string.
+	Symbols [][]byte
+
+	Timeseries []TimeSeriesV2
+
+	refsPool         []uint32
+	samplesPool      []Sample
+	exemplarsPool    []ExemplarV2
+	exemplarRefsPool []uint32
+}
+
+// TimeSeriesV2 is a time series from remote write 2.0 request.
+type TimeSeriesV2 struct {
+	// LabelsRefs contains pairs of references to WriteRequestV2.Symbols for label names and values.
+	LabelsRefs []uint32
+
+	Samples   []Sample
+	Exemplars []ExemplarV2
+
+	// HistogramsCount is the number of native histogram samples in the time series.
+	//
+	// Native histograms aren't decoded, since they aren't supported.
+	HistogramsCount int
+
+	Metadata MetadataV2
+
+	CreatedTimestamp int64
+}
+
+// ExemplarV2 is an exemplar from remote write 2.0 request.
+type ExemplarV2 struct {
+	LabelsRefs []uint32
+	Value      float64
+	Timestamp  int64
+
+	// refsStart and refsEnd is the LabelsRefs range in WriteRequestV2.exemplarRefsPool.
+	refsStart int
+	refsEnd   int
+}
+
+// MetadataV2 is metric metadata from remote write 2.0 request.
+type MetadataV2 struct {
+	Type MetricTypeV2
+
+	// HelpRef and UnitRef are references to WriteRequestV2.Symbols.
+	HelpRef uint32
+	UnitRef uint32
+}
+
+// Reset resets wr.
+func (wr *WriteRequestV2) Reset() {
+	for i := range wr.Symbols {
+		wr.Symbols[i] = nil
+	}
+	wr.Symbols = wr.Symbols[:0]
+
+	for i := range wr.Timeseries {
+		wr.Timeseries[i] = TimeSeriesV2{}
+	}
+	wr.Timeseries = wr.Timeseries[:0]
+
+	wr.refsPool = wr.refsPool[:0]
+	wr.samplesPool = wr.samplesPool[:0]
+	for i := range wr.exemplarsPool {
+		wr.exemplarsPool[i] = ExemplarV2{}
+	}
+	wr.exemplarsPool = wr.exemplarsPool[:0]
+	wr.exemplarRefsPool = wr.exemplarRefsPool[:0]
+}
+
+// Symbol returns the symbol for the given ref.
+func (wr *WriteRequestV2) Symbol(ref uint32) ([]byte, error) {
+	if uint64(ref) >= uint64(len(wr.Symbols)) {
+		return nil, fmt.Errorf("symbol reference %d exceeds the number of symbols %d", ref, len(wr.Symbols))
+	}
+	return wr.Symbols[ref], nil
+}
+
+// AppendLabels appends labels for the given labelsRefs to dst and returns the result.
+//
+// The returned labels refer to wr.Symbols.
+func (wr *WriteRequestV2) AppendLabels(dst []Label, labelsRefs []uint32) ([]Label, error) {
+	if len(labelsRefs)%2 != 0 {
+		return dst, fmt.Errorf("odd number of label references: %d", len(labelsRefs))
+	}
+	for i := 0; i < len(labelsRefs); i += 2 {
+		name, err := wr.Symbol(labelsRefs[i])
+		if err != nil {
+			return dst, fmt.Errorf("cannot obtain label name: %s", err)
+		}
+		value, err := wr.Symbol(labelsRefs[i+1])
+		if err != nil {
+			return dst, fmt.Errorf("cannot obtain value for label %q: %s", name, err)
+		}
+		dst = append(dst, Label{
+			Name:  name,
+			Value: value,
+		})
+	}
+	return dst, nil
+}
+
+// Unmarshal unmarshals wr from src.
+//
+// wr refers to src, so src mustn't be changed while wr is in use.
+func (wr *WriteRequestV2) Unmarshal(src []byte) error {
+	wr.Reset()
+
+	// Unmarshal time series to wr.Timeseries at first and then split pools to per-series slices,
+	// since the pools may be re-allocated during the unmarshaling.
+	type poolOffsets struct {
+		refs      int
+		samples   int
+		exemplars int
+	}
+	var offsets []poolOffsets
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read WriteRequestV2 field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 4:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Symbols", wireType)
+			}
+			wr.Symbols = append(wr.Symbols, data)
+		case 5:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timeseries", wireType)
+			}
+			if cap(wr.Timeseries) > len(wr.Timeseries) {
+				wr.Timeseries = wr.Timeseries[:len(wr.Timeseries)+1]
+			} else {
+				wr.Timeseries = append(wr.Timeseries, TimeSeriesV2{})
+			}
+			ts := &wr.Timeseries[len(wr.Timeseries)-1]
+			offsets = append(offsets, poolOffsets{
+				refs:      len(wr.refsPool),
+				samples:   len(wr.samplesPool),
+				exemplars: len(wr.exemplarsPool),
+			})
+			if err := wr.unmarshalTimeSeries(ts, data); err != nil {
+				return fmt.Errorf("cannot unmarshal TimeSeries: %s", err)
+			}
+		}
+	}
+	if len(wr.Symbols) > 0 && len(wr.Symbols[0]) > 0 {
+		return fmt.Errorf("the first symbol must be empty; got %q", wr.Symbols[0])
+	}
+
+	for i := range wr.Timeseries {
+		ts := &wr.Timeseries[i]
+		start := offsets[i]
+		end := poolOffsets{
+			refs:      len(wr.refsPool),
+			samples:   len(wr.samplesPool),
+			exemplars: len(wr.exemplarsPool),
+		}
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		ts.LabelsRefs = wr.refsPool[start.refs:end.refs]
+		ts.Samples = wr.samplesPool[start.samples:end.samples]
+		ts.Exemplars = wr.exemplarsPool[start.exemplars:end.exemplars]
+	}
+	for i := range wr.exemplarsPool {
+		e := &wr.exemplarsPool[i]
+		e.LabelsRefs = wr.exemplarRefsPool[e.refsStart:e.refsEnd]
+	}
+	return nil
+}
+
+func (wr *WriteRequestV2) unmarshalTimeSeries(ts *TimeSeriesV2, src []byte) error {
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read TimeSeries field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			wr.refsPool, err = appendUint32s(wr.refsPool, wireType, data)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal LabelsRefs: %s", err)
+			}
+		case 2:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Samples", wireType)
+			}
+			wr.samplesPool = append(wr.samplesPool, Sample{})
+			s := &wr.samplesPool[len(wr.samplesPool)-1]
+			if err := s.Unmarshal(data); err != nil {
+				return fmt.Errorf("cannot unmarshal Sample: %s", err)
+			}
+		case 3:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Histograms", wireType)
+			}
+			ts.HistogramsCount++
+		case 4:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Exemplars", wireType)
+			}
+			wr.exemplarsPool = append(wr.exemplarsPool, ExemplarV2{})
+			e := &wr.exemplarsPool[len(wr.exemplarsPool)-1]
+			e.refsStart = len(wr.exemplarRefsPool)
+			wr.exemplarRefsPool, err = e.unmarshal(wr.exemplarRefsPool, data)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal Exemplar: %s", err)
+			}
+			e.refsEnd = len(wr.exemplarRefsPool)
+		case 5:
+			if wireType != wireTypeBytes {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			if err := ts.Metadata.unmarshal(data); err != nil {
+				return fmt.Errorf("cannot unmarshal Metadata: %s", err)
+			}
+		case 6:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field CreatedTimestamp", wireType)
+			}
+			ts.CreatedTimestamp = int64(decodeVarint(data))
+		}
+	}
+	return nil
+}
+
+func (e *ExemplarV2) unmarshal(dstRefs []uint32, src []byte) ([]uint32, error) {
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return dstRefs, fmt.Errorf("cannot read Exemplar field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1:
+			dstRefs, err = appendUint32s(dstRefs, wireType, data)
+			if err != nil {
+				return dstRefs, fmt.Errorf("cannot unmarshal LabelsRefs: %s", err)
+			}
+		case 2:
+			if wireType != wireTypeFixed64 {
+				return dstRefs, fmt.Errorf("proto: wrong wireType = %d for field Value", wireType)
+			}
+			e.Value = math.Float64frombits(binary.LittleEndian.Uint64(data))
+		case 3:
+			if wireType != wireTypeVarint {
+				return dstRefs, fmt.Errorf("proto: wrong wireType = %d for field Timestamp", wireType)
+			}
+			e.Timestamp = int64(decodeVarint(data))
+		}
+	}
+	return dstRefs, nil
+}
+
+func (m *MetadataV2) unmarshal(src []byte) error {
+	for len(src) > 0 {
+		fieldNum, wireType, data, tail, err := readField(src)
+		if err != nil {
+			return fmt.Errorf("cannot read Metadata field: %s", err)
+		}
+		src = tail
+		switch fieldNum {
+		case 1, 3, 4:
+			if wireType != wireTypeVarint {
+				return fmt.Errorf("proto: wrong wireType = %d for field #%d", wireType, fieldNum)
+			}
+			v := decodeVarint(data)
+			switch fieldNum {
+			case 1:
+				m.Type = MetricTypeV2(v)
+			case 3:
+				m.HelpRef = uint32(v)
+			case 4:
+				m.UnitRef = uint32(v)
+			}
+		}
+	}
+	return nil
+}
+
+// appendUint32s appends uint32 values from packed or unpacked repeated field data to dst.
+func appendUint32s(dst []uint32, wireType uint64, data []byte) ([]uint32, error) {
+	switch wireType {
+	case wireTypeVarint:
+		return append(dst, uint32(decodeVarint(data))), nil
+	case wireTypeBytes:
+		for len(data) > 0 {
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return dst, fmt.Errorf("cannot read packed varint")
+			}
+			dst = append(dst, uint32(v))
+			data = data[n:]
+		}
+		return dst, nil
+	default:
+		return dst, fmt.Errorf("proto: wrong wireType = %d for repeated uint32 field", wireType)
+	}
+}
+
+// Marshal appends marshaled wr to dst and returns the result.
+//
+// Native histograms aren't marshaled.
+func (wr *WriteRequestV2) Marshal(dst []byte) []byte {
+	for _, symbol := range wr.Symbols {
+		// Empty symbols must be marshaled too, since they are referred by index.
+		dst = appendMessageHeader(dst, 4, len(symbol))
+		dst = append(dst, symbol...)
+	}
+	for i := range wr.Timeseries {
+		ts := &wr.Timeseries[i]
+		dst = appendMessageHeader(dst, 5, ts.size())
+		dst = ts.marshal(dst)
+	}
+	return dst
+}
+
+func (ts *TimeSeriesV2) size() int {
+	n := sizePackedUint32sField(1, ts.LabelsRefs)
+	for i := range ts.Samples {
+		n += sizeMessage(2, ts.Samples[i].size())
+	}
+	for i := range ts.Exemplars {
+		n += sizeMessage(4, ts.Exemplars[i].size())
+	}
+	if size := ts.Metadata.size(); size > 0 {
+		n += sizeMessage(5, size)
+	}
+	n += sizeVarintField(6, uint64(ts.CreatedTimestamp))
+	return n
+}
+
+func (ts *TimeSeriesV2) marshal(dst []byte) []byte {
+	dst = appendPackedUint32sField(dst, 1, ts.LabelsRefs)
+	for i := range ts.Samples {
+		s := &ts.Samples[i]
+		dst = appendMessageHeader(dst, 2, s.size())
+		dst = s.marshal(dst)
+	}
+	for i := range ts.Exemplars {
+		e := &ts.Exemplars[i]
+		dst = appendMessageHeader(dst, 4, e.size())
+		dst = e.marshal(dst)
+	}
+	if size := ts.Metadata.size(); size > 0 {
+		dst = appendMessageHeader(dst, 5, size)
+		dst = ts.Metadata.marshal(dst)
+	}
+	dst = appendVarintField(dst, 6, uint64(ts.CreatedTimestamp))
+	return dst
+}
+
+func (e *ExemplarV2) size() int {
+	n := sizePackedUint32sField(1, e.LabelsRefs)
+	if e.Value != 0 {
+		n += 1 + 8
+	}
+	n += sizeVarintField(3, uint64(e.Timestamp))
+	return n
+}
+
+func (e *ExemplarV2) marshal(dst []byte) []byte {
+	dst = appendPackedUint32sField(dst, 1, e.LabelsRefs)
+	if e.Value != 0 {
+		dst = appendVarint(dst, 2<<3|wireTypeFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(e.Value))
+		dst = append(dst, buf[:]...)
+	}
+	dst = appendVarintField(dst, 3, uint64(e.Timestamp))
+	return dst
+}
+
+func (m *MetadataV2) size() int {
+	return sizeVarintField(1, uint64(m.Type)) + sizeVarintField(3, uint64(m.HelpRef)) + sizeVarintField(4, uint64(m.UnitRef))
+}
+
+func (m *MetadataV2) marshal(dst []byte) []byte {
+	dst = appendVarintField(dst, 1, uint64(m.Type))
+	dst = appendVarintField(dst, 3, uint64(m.HelpRef))
+	dst = appendVarintField(dst, 4, uint64(m.UnitRef))
+	return dst
+}
+
+func sizePackedUint32sField(fieldNum int, a []uint32) int {
+	if len(a) == 0 {
+		return 0
+	}
+	n := 0
+	for _, v := range a {
+		n += sizeVarint(uint64(v))
+	}
+	return sizeMessage(fieldNum, n)
+}
+
+func appendPackedUint32sField(dst []byte, fieldNum int, a []uint32) []byte {
+	if len(a) == 0 {
+		return dst
+	}
+	n := 0
+	for _, v := range a {
+		n += sizeVarint(uint64(v))
+	}
+	dst = appendMessageHeader(dst, fieldNum, n)
+	for _, v := range a {
+		dst = appendVarint(dst, uint64(v))
+	}
+	return dst
+}
@@ -0,0 +1,201 @@
+package prompb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWriteRequestV2MarshalUnmarshal(t *testing.T) {
+	f := func(wr *WriteRequestV2) {
+		t.Helper()
+		data := wr.Marshal(nil)
+		var wr2 WriteRequestV2
+		if err := wr2.Unmarshal(data); err != nil {
+			t.Fatalf("cannot unmarshal WriteRequestV2: %s", err)
+		}
+		if len(wr2.Symbols) != len(wr.Symbols) {
+			t.Fatalf("unexpected number of symbols; got %d; want %d", len(wr2.Symbols), len(wr.Symbols))
+		}
+		for i := range wr.Symbols {
+			if string(wr2.Symbols[i]) != string(wr.Symbols[i]) {
+				t.Fatalf("unexpected symbol #%d; got %q; want %q", i, wr2.Symbols[i], wr.Symbols[i])
+			}
+		}
+		if len(wr2.Timeseries) != len(wr.Timeseries) {
+			t.Fatalf("unexpected number of time series; got %d; want %d", len(wr2.Timeseries), len(wr.Timeseries))
+		}
+		for i := range wr.Timeseries {
+			ts, ts2 := &wr.Timeseries[i], &wr2.Timeseries[i]
+			if len(ts.LabelsRefs) > 0 && !reflect.DeepEqual(ts2.LabelsRefs, ts.LabelsRefs) {
+				t.Fatalf("unexpected labels refs for time series #%d; got %v; want %v", i, ts2.LabelsRefs, ts.LabelsRefs)
+			}
+			if len(ts.Samples) > 0 && !reflect.DeepEqual(ts2.Samples, ts.Samples) {
+				t.Fatalf("unexpected samples for time series #%d; got %v; want %v", i, ts2.Samples, ts.Samples)
+			}
+			if len(ts2.Exemplars) != len(ts.Exemplars) {
+				t.Fatalf("unexpected number of exemplars for time series #%d; got %d; want %d", i, len(ts2.Exemplars), len(ts.Exemplars))
+			}
+			for j := range ts.Exemplars {
+				e, e2 := &ts.Exemplars[j], &ts2.Exemplars[j]
+				if len(e2.LabelsRefs) != len(e.LabelsRefs) || (len(e.LabelsRefs) > 0 && !reflect.DeepEqual(e2.LabelsRefs, e.LabelsRefs)) || e2.Value != e.Value || e2.Timestamp != e.Timestamp {
+					t.Fatalf("unexpected exemplar #%d for time series #%d; got %+v; want %+v", j, i, e2, e)
+				}
+			}
+			if ts2.Metadata != ts.Metadata {
+				t.Fatalf("unexpected metadata for time series #%d; got %+v; want %+v", i, ts2.Metadata, ts.Metadata)
+			}
+			if ts2.CreatedTimestamp != ts.CreatedTimestamp {
+				t.Fatalf("unexpected created timestamp for time series #%d; got %d; want %d", i, ts2.CreatedTimestamp, ts.CreatedTimestamp)
+			}
+		}
+
+		// Unmarshal must reset the previous state.
+		if err := wr2.Unmarshal(data); err != nil {
+			t.Fatalf("cannot unmarshal WriteRequestV2 for the second time: %s", err)
+		}
+		if len(wr2.Timeseries) != len(wr.Timeseries) {
+			t.Fatalf("unexpected number of time series after the second unmarshal; got %d; want %d", len(wr2.Timeseries), len(wr.Timeseries))
+		}
+	}
+
+	f(&WriteRequestV2{})
+	f(&WriteRequestV2{
+		Symbols: [][]byte{[]byte(""), []byte("__name__"), []byte("foo")},
+		Timeseries: []TimeSeriesV2{{
+			LabelsRefs: []uint32{1, 2},
+			Samples: []Sample{
+				{Value: 1, Timestamp: 1000},
+				{Value: 0, Timestamp: 2000},
+				{Value: -1.5, Timestamp: -3000},
+			},
+		}},
+	})
+	f(&WriteRequestV2{
+		Symbols: [][]byte{
+			[]byte(""), []byte("__name__"), []byte("foo_total"), []byte("job"), []byte("bar"),
+			[]byte("trace_id"), []byte("abc"), []byte("Help message"), []byte("seconds"),
+		},
+		Timeseries: []TimeSeriesV2{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []Sample{{Value: 10, Timestamp: 123}},
+				Exemplars: []ExemplarV2{
+					{LabelsRefs: []uint32{5, 6}, Value: 0.5, Timestamp: 100},
+					{Value: 2, Timestamp: 110},
+				},
+				Metadata: MetadataV2{
+					Type:    MetricTypeV2Counter,
+					HelpRef: 7,
+					UnitRef: 8,
+				},
+				CreatedTimestamp: 50,
+			},
+			{
+				LabelsRefs: []uint32{1, 2},
+				Exemplars: []ExemplarV2{
+					{LabelsRefs: []uint32{5, 6, 3, 4}, Value: 3, Timestamp: 200},
+				},
+				Metadata: MetadataV2{
+					Type: MetricTypeV2Gauge,
+				},
+			},
+		},
+	})
+}
+
+func TestWriteRequestV2UnmarshalHistograms(t *testing.T) {
+	wr := &WriteRequestV2{
+		Symbols: [][]byte{[]byte(""), []byte("__name__"), []byte("foo")},
+		Timeseries: []TimeSeriesV2{{
+			LabelsRefs: []uint32{1, 2},
+		}},
+	}
+	data := wr.Marshal(nil)
+
+	// Append time series with two native histograms. The histograms must be skipped.
+	var ts []byte
+	ts = appendPackedUint32sField(ts, 1, []uint32{1, 2})
+	ts = appendBytesField(ts, 3, []byte{0x08, 0x01})
+	ts = appendBytesField(ts, 3, []byte{0x08, 0x02})
+	data = appendBytesField(data, 5, ts)
+
+	var wr2 WriteRequestV2
+	if err := wr2.Unmarshal(data); err != nil {
+		t.Fatalf("cannot unmarshal WriteRequestV2: %s", err)
+	}
+	if len(wr2.Timeseries) != 2 {
+		t.Fatalf("unexpected number of time series; got %d; want 2", len(wr2.Timeseries))
+	}
+	if n := wr2.Timeseries[0].HistogramsCount; n != 0 {
+		t.Fatalf("unexpected number of histograms for the first time series; got %d; want 0", n)
+	}
+	if n := wr2.Timeseries[1].HistogramsCount; n != 2 {
+		t.Fatalf("unexpected number of histograms for the second time series; got %d; want 2", n)
+	}
+	if !reflect.DeepEqual(wr2.Timeseries[1].LabelsRefs, []uint32{1, 2}) {
+		t.Fatalf("unexpected labels refs for the second time series; got %v; want %v", wr2.Timeseries[1].LabelsRefs, []uint32{1, 2})
+	}
+}
+
+func TestWriteRequestV2UnmarshalFailure(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		var wr WriteRequestV2
+		if err := wr.Unmarshal(data); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Truncated data
+	wr := &WriteRequestV2{
+		Symbols: [][]byte{[]byte(""), []byte("foo")},
+		Timeseries: []TimeSeriesV2{{
+			LabelsRefs: []uint32{1, 1},
+			Samples:    []Sample{{Value: 1, Timestamp: 2}},
+		}},
+	}
+	data := wr.Marshal(nil)
+	f(data[:len(data)-1])
+
+	// Non-empty first symbol
+	wr = &WriteRequestV2{
+		Symbols: [][]byte{[]byte("foo")},
+	}
+	f(wr.Marshal(nil))
+}
+
+func TestWriteRequestV2AppendLabels(t *testing.T) {
+	wr := &WriteRequestV2{
+		Symbols: [][]byte{[]byte(""), []byte("__name__"), []byte("foo"), []byte("job")},
+	}
+	f := func(labelsRefs []uint32, labelsExpected []Label) {
+		t.Helper()
+		labels, err := wr.AppendLabels(nil, labelsRefs)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(labels, labelsExpected) {
+			t.Fatalf("unexpected labels; got %s; want %s", labels, labelsExpected)
+		}
+	}
+	f(nil, nil)
+	f([]uint32{1, 2, 3, 0}, []Label{
+		{Name: []byte("__name__"), Value: []byte("foo")},
+		{Name: []byte("job"), Value: []byte("")},
+	})
+
+	fFailure := func(labelsRefs []uint32) {
+		t.Helper()
+		if _, err := wr.AppendLabels(nil, labelsRefs); err == nil {
+			t.Fatalf("expecting non-nil error for labelsRefs=%v", labelsRefs)
+		}
+	}
+
+	// Odd number of refs
+	fFailure([]uint32{1})
+	fFailure([]uint32{1, 2, 3})
+
+	// Refs out of range
+	fFailure([]uint32{4, 1})
+	fFailure([]uint32{1, 100})
+}
@@ -0,0 +1,259 @@
+// Package promrelabel implements Prometheus-compatible relabeling for time series labels.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+package promrelabel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+// RelabelConfig is a single relabeling rule in Prometheus relabel_config format.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    *string  `yaml:"separator,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Regex        *string  `yaml:"regex,omitempty"`
+	Replacement  *string  `yaml:"replacement,omitempty"`
+
+	// Action may be replace, keep, drop, labeldrop, labelkeep or labelmap.
+	//
+	// replace is used by default.
+	Action string `yaml:"action,omitempty"`
+}
+
+// ParsedRelabelConfig is a parsed RelabelConfig.
+type ParsedRelabelConfig struct {
+	SourceLabels []string
+	Separator    string
+	TargetLabel  string
+	Regex        *regexp.Regexp
+	Replacement  string
+	Action       string
+}
+
+// String returns human-readable representation of prc.
+func (prc *ParsedRelabelConfig) String() string {
+	return fmt.Sprintf("SourceLabels=%s, Separator=%q, TargetLabel=%q, Regex=%q, Replacement=%q, Action=%q",
+		prc.SourceLabels, prc.Separator, prc.TargetLabel, prc.Regex.String(), prc.Replacement, prc.Action)
+}
+
+// LoadRelabelConfigs loads relabel configs from the YAML file at the given path.
+func LoadRelabelConfigs(path string) ([]ParsedRelabelConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", path, err)
+	}
+	prcs, err := ParseRelabelConfigsData(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse relabel configs from %q: %s", path, err)
+	}
+	return prcs, nil
+}
+
+// ParseRelabelConfigsData parses relabel configs from YAML data.
+//
+// The data must contain a list of relabel configs in Prometheus relabel_config format.
+func ParseRelabelConfigsData(data []byte) ([]ParsedRelabelConfig, error) {
+	var rcs []RelabelConfig
+	if err := yaml.UnmarshalStrict(data, &rcs); err != nil {
+		return nil, err
+	}
+	return ParseRelabelConfigs(rcs)
+}
+
+// ParseRelabelConfigs parses rcs.
+func ParseRelabelConfigs(rcs []RelabelConfig) ([]ParsedRelabelConfig, error) {
+	if len(rcs) == 0 {
+		return nil, nil
+	}
+	prcs := make([]ParsedRelabelConfig, 0, len(rcs))
+	for i := range rcs {
+		prc, err := parseRelabelConfig(&rcs[i])
+		if err != nil {
+			return nil, fmt.Errorf("error when parsing `relabel_config` #%d: %s", i+1, err)
+		}
+		prcs = append(prcs, *prc)
+	}
+	return prcs, nil
+}
+
+var defaultRegexForRelabelConfig = regexp.MustCompile("^(.*)$")
+
+func parseRelabelConfig(rc *RelabelConfig) (*ParsedRelabelConfig, error) {
+	separator := ";"
+	if rc.Separator != nil {
+		separator = *rc.Separator
+	}
+	regexCompiled := defaultRegexForRelabelConfig
+	if rc.Regex != nil {
+		// The regex must match the whole string like in Prometheus.
+		re, err := regexp.Compile("^(?:" + *rc.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `regex` %q: %s", *rc.Regex, err)
+		}
+		regexCompiled = re
+	}
+	replacement := "$1"
+	if rc.Replacement != nil {
+		replacement = *rc.Replacement
+	}
+	action := rc.Action
+	if action == "" {
+		action = "replace"
+	}
+	switch action {
+	case "replace":
+		if rc.TargetLabel == "" {
+			return nil, fmt.Errorf("missing `target_label` for `action=replace`")
+		}
+	case "keep", "drop":
+		if len(rc.SourceLabels) == 0 {
+			return nil, fmt.Errorf("missing `source_labels` for `action=%s`", action)
+		}
+	case "labeldrop", "labelkeep", "labelmap":
+	default:
+		return nil, fmt.Errorf("unknown `action` %q; supported actions: replace, keep, drop, labeldrop, labelkeep, labelmap", action)
+	}
+	return &ParsedRelabelConfig{
+		SourceLabels: rc.SourceLabels,
+		Separator:    separator,
+		TargetLabel:  rc.TargetLabel,
+		Regex:        regexCompiled,
+		Replacement:  replacement,
+		Action:       action,
+	}, nil
+}
+
+// ApplyRelabelConfigs applies prcs to labels and returns the result.
+//
+// The metric name must be stored in `__name__` label.
+// nil is returned if the labels are dropped by `keep` or `drop` actions.
+// Labels with empty values are removed from the result.
+//
+// The returned labels may share memory with labels.
+func ApplyRelabelConfigs(labels []prompb.Label, prcs []ParsedRelabelConfig) []prompb.Label {
+	for i := range prcs {
+		labels = applyRelabelConfig(labels, &prcs[i])
+		if labels == nil {
+			return nil
+		}
+	}
+	return removeEmptyLabels(labels)
+}
+
+func applyRelabelConfig(labels []prompb.Label, prc *ParsedRelabelConfig) []prompb.Label {
+	switch prc.Action {
+	case "replace":
+		value := concatLabelValues(labels, prc.SourceLabels, prc.Separator)
+		match := prc.Regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			// Labels remain unchanged if the regex doesn't match the source labels.
+			return labels
+		}
+		targetLabel := string(prc.Regex.ExpandString(nil, prc.TargetLabel, value, match))
+		replacement := prc.Regex.ExpandString(nil, prc.Replacement, value, match)
+		return setLabelValue(labels, targetLabel, replacement)
+	case "keep":
+		value := concatLabelValues(labels, prc.SourceLabels, prc.Separator)
+		if !prc.Regex.MatchString(value) {
+			return nil
+		}
+		return labels
+	case "drop":
+		value := concatLabelValues(labels, prc.SourceLabels, prc.Separator)
+		if prc.Regex.MatchString(value) {
+			return nil
+		}
+		return labels
+	case "labeldrop":
+		dst := labels[:0]
+		for _, label := range labels {
+			if !prc.Regex.Match(label.Name) {
+				dst = append(dst, label)
+			}
+		}
+		return dst
+	case "labelkeep":
+		dst := labels[:0]
+		for _, label := range labels {
+			if prc.Regex.Match(label.Name) {
+				dst = append(dst, label)
+			}
+		}
+		return dst
+	case "labelmap":
+		// Iterate over the labels present before the mapping, since new labels may be added during the mapping.
+		n := len(labels)
+		for i := 0; i < n; i++ {
+			name := bytesutil.ToUnsafeString(labels[i].Name)
+			match := prc.Regex.FindStringSubmatchIndex(name)
+			if match == nil {
+				continue
+			}
+			targetLabel := string(prc.Regex.ExpandString(nil, prc.Replacement, name, match))
+			labels = setLabelValue(labels, targetLabel, labels[i].Value)
+		}
+		return labels
+	default:
+		panic(fmt.Errorf("BUG: unknown `action`: %q", prc.Action))
+	}
+}
+
+func concatLabelValues(labels []prompb.Label, labelNames []string, separator string) string {
+	if len(labelNames) == 0 {
+		return ""
+	}
+	var b []byte
+	for i, labelName := range labelNames {
+		if i > 0 {
+			b = append(b, separator...)
+		}
+		if label := getLabelByName(labels, labelName); label != nil {
+			b = append(b, label.Value...)
+		}
+	}
+	return string(b)
+}
+
+func getLabelByName(labels []prompb.Label, name string) *prompb.Label {
+	for i := range labels {
+		label := &labels[i]
+		if string(label.Name) == name {
+			return label
+		}
+	}
+	return nil
+}
+
+func setLabelValue(labels []prompb.Label, name string, value []byte) []prompb.Label {
+	if label := getLabelByName(labels, name); label != nil {
+		label.Value = value
+		return labels
+	}
+	return append(labels, prompb.Label{
+		Name:  []byte(name),
+		Value: value,
+	})
+}
+
+func removeEmptyLabels(labels []prompb.Label) []prompb.Label {
+	dst := labels[:0]
+	for _, label := range labels {
+		if len(label.Name) > 0 && len(label.Value) > 0 {
+			dst = append(dst, label)
+		}
+	}
+	return dst
+}
+
+// HasMetricName returns true if labels contain non-empty `__name__` label.
+func HasMetricName(labels []prompb.Label) bool {
+	label := getLabelByName(labels, "__name__")
+	return label != nil && len(label.Value) > 0
+}
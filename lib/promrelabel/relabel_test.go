@@ -0,0 +1,190 @@
+package promrelabel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestParseRelabelConfigsDataFailure(t *testing.T) {
+	f := func(data string) {
+		t.Helper()
+		if _, err := ParseRelabelConfigsData([]byte(data)); err == nil {
+			t.Fatalf("expecting non-nil error for data=%q", data)
+		}
+	}
+
+	// Invalid YAML
+	f(`foobar`)
+
+	// Unknown field
+	f(`- foo: bar`)
+
+	// Unknown action
+	f(`- action: foobar`)
+
+	// Missing target_label for replace action
+	f(`- source_labels: [foo]`)
+
+	// Missing source_labels for keep and drop actions
+	f(`- action: keep`)
+	f(`- action: drop`)
+
+	// Invalid regex
+	f(`
+- action: labeldrop
+  regex: "a("
+`)
+}
+
+func TestApplyRelabelConfigs(t *testing.T) {
+	f := func(config, labels, resultExpected string) {
+		t.Helper()
+		prcs, err := ParseRelabelConfigsData([]byte(config))
+		if err != nil {
+			t.Fatalf("cannot parse relabel configs: %s", err)
+		}
+		result := ApplyRelabelConfigs(parseLabels(labels), prcs)
+		if s := labelsToString(result); s != resultExpected {
+			t.Fatalf("unexpected result for labels=%q;\ngot\n%s\nwant\n%s", labels, s, resultExpected)
+		}
+	}
+
+	// Empty config
+	f(``, `__name__=foo,bar=baz`, `__name__=foo,bar=baz`)
+
+	// replace with default regex and replacement
+	f(`
+- source_labels: [bar]
+  target_label: qwe
+`, `__name__=foo,bar=baz`, `__name__=foo,bar=baz,qwe=baz`)
+
+	// replace with multiple source labels and capture groups
+	f(`
+- source_labels: [__name__, bar]
+  separator: "-"
+  regex: "(.+)-b(.+)"
+  target_label: __name__
+  replacement: "${1}_${2}"
+`, `__name__=foo,bar=baz`, `__name__=foo_az,bar=baz`)
+
+	// replace with non-matching regex leaves labels unchanged
+	f(`
+- source_labels: [bar]
+  regex: "x.*"
+  target_label: bar
+  replacement: aaa
+`, `__name__=foo,bar=baz`, `__name__=foo,bar=baz`)
+
+	// replace with empty replacement removes the label
+	f(`
+- target_label: bar
+  replacement: ""
+`, `__name__=foo,bar=baz`, `__name__=foo`)
+
+	// keep
+	f(`
+- action: keep
+  source_labels: [bar]
+  regex: "ba.+"
+`, `__name__=foo,bar=baz`, `__name__=foo,bar=baz`)
+	f(`
+- action: keep
+  source_labels: [bar]
+  regex: "ba"
+`, `__name__=foo,bar=baz`, ``)
+
+	// drop
+	f(`
+- action: drop
+  source_labels: [__name__]
+  regex: "foo|bar"
+`, `__name__=foo,bar=baz`, ``)
+	f(`
+- action: drop
+  source_labels: [missing]
+  regex: ".+"
+`, `__name__=foo,bar=baz`, `__name__=foo,bar=baz`)
+
+	// labeldrop
+	f(`
+- action: labeldrop
+  regex: "b.*"
+`, `__name__=foo,bar=baz,qwe=rty,bo=x`, `__name__=foo,qwe=rty`)
+
+	// labelkeep
+	f(`
+- action: labelkeep
+  regex: "__name__|qwe"
+`, `__name__=foo,bar=baz,qwe=rty`, `__name__=foo,qwe=rty`)
+
+	// labelmap
+	f(`
+- action: labelmap
+  regex: "meta_(.+)"
+`, `__name__=foo,meta_bar=baz,meta_foo=x`, `__name__=foo,meta_bar=baz,meta_foo=x,bar=baz,foo=x`)
+	f(`
+- action: labelmap
+  regex: "meta_(.+)"
+  replacement: "__name__"
+`, `__name__=foo,meta_x=bar`, `__name__=bar,meta_x=bar`)
+
+	// Multiple rules are applied in order
+	f(`
+- action: labelmap
+  regex: "meta_(.+)"
+- action: labeldrop
+  regex: "meta_.+"
+- action: keep
+  source_labels: [foo]
+  regex: "x"
+`, `__name__=foo,meta_foo=x`, `__name__=foo,foo=x`)
+}
+
+func TestHasMetricName(t *testing.T) {
+	f := func(labels string, resultExpected bool) {
+		t.Helper()
+		result := HasMetricName(parseLabels(labels))
+		if result != resultExpected {
+			t.Fatalf("unexpected result for labels=%q; got %v; want %v", labels, result, resultExpected)
+		}
+	}
+	f(``, false)
+	f(`foo=bar`, false)
+	f(`__name__=,foo=bar`, false)
+	f(`__name__=foo`, true)
+	f(`foo=bar,__name__=foo`, true)
+}
+
+func parseLabels(s string) []prompb.Label {
+	var labels []prompb.Label
+	for len(s) > 0 {
+		var pair string
+		n := strings.IndexByte(s, ',')
+		if n < 0 {
+			pair, s = s, ""
+		} else {
+			pair, s = s[:n], s[n+1:]
+		}
+		n = strings.IndexByte(pair, '=')
+		labels = append(labels, prompb.Label{
+			Name:  []byte(pair[:n]),
+			Value: []byte(pair[n+1:]),
+		})
+	}
+	return labels
+}
+
+func labelsToString(labels []prompb.Label) string {
+	var b []byte
+	for i, label := range labels {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, label.Name...)
+		b = append(b, '=')
+		b = append(b, label.Value...)
+	}
+	return string(b)
+}
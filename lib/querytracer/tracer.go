@@ -0,0 +1,122 @@
+package querytracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Tracer collects timestamped spans for a query.
+//
+// Tracer must be created via New or via Tracer.NewChild for nested spans.
+// Every created Tracer must be finished with Donef.
+//
+// nil Tracer is valid - it is returned by New when tracing is disabled.
+// All the methods on nil Tracer are no-op, so they don't allocate memory.
+// Callers must check Enabled before preparing expensive args for tracer methods.
+type Tracer struct {
+	startTime time.Time
+	doneTime  time.Time
+	message   string
+
+	// mu protects children, since child spans may be added from concurrent goroutines.
+	mu       sync.Mutex
+	children []*Tracer
+}
+
+// New returns new Tracer with the message obtained from format and args.
+//
+// nil is returned if enabled is false.
+func New(enabled bool, format string, args ...interface{}) *Tracer {
+	if !enabled {
+		return nil
+	}
+	return &Tracer{
+		startTime: time.Now(),
+		message:   fmt.Sprintf(format, args...),
+	}
+}
+
+// Enabled returns true if t collects spans.
+func (t *Tracer) Enabled() bool {
+	return t != nil
+}
+
+// NewChild adds new child span to t with the message obtained from format and args.
+//
+// The returned child must be finished with Donef.
+func (t *Tracer) NewChild(format string, args ...interface{}) *Tracer {
+	if t == nil {
+		return nil
+	}
+	child := New(true, format, args...)
+	t.mu.Lock()
+	t.children = append(t.children, child)
+	t.mu.Unlock()
+	return child
+}
+
+// Printf adds a finished child span with the message obtained from format and args to t.
+func (t *Tracer) Printf(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	child := New(true, format, args...)
+	child.doneTime = child.startTime
+	t.mu.Lock()
+	t.children = append(t.children, child)
+	t.mu.Unlock()
+}
+
+// Donef finishes t and appends the message obtained from format and args to t message.
+//
+// t mustn't be used after Donef call.
+func (t *Tracer) Donef(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	if !t.doneTime.IsZero() {
+		panic(fmt.Errorf("BUG: Donef cannot be called multiple times for %q", t.message))
+	}
+	t.message += ": " + fmt.Sprintf(format, args...)
+	t.doneTime = time.Now()
+}
+
+// ToJSON returns JSON representation of t.
+//
+// An empty string is returned for nil t.
+func (t *Tracer) ToJSON() string {
+	if t == nil {
+		return ""
+	}
+	data, err := json.Marshal(t.toSpan())
+	if err != nil {
+		panic(fmt.Errorf("BUG: unexpected error when marshaling trace to JSON: %s", err))
+	}
+	return string(data)
+}
+
+type span struct {
+	DurationMsec float64 `json:"duration_msec"`
+	Message      string  `json:"message"`
+	Children     []*span `json:"children,omitempty"`
+}
+
+func (t *Tracer) toSpan() *span {
+	doneTime := t.doneTime
+	if doneTime.IsZero() {
+		// The span didn't finish yet.
+		doneTime = time.Now()
+	}
+	s := &span{
+		DurationMsec: float64(doneTime.Sub(t.startTime)) / 1e6,
+		Message:      t.message,
+	}
+	t.mu.Lock()
+	for _, child := range t.children {
+		s.Children = append(s.Children, child.toSpan())
+	}
+	t.mu.Unlock()
+	return s
+}
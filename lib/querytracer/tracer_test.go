@@ -0,0 +1,76 @@
+package querytracer
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTracerDisabled(t *testing.T) {
+	qt := New(false, "test")
+	if qt.Enabled() {
+		t.Fatalf("tracer must be disabled")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		qtChild := qt.NewChild("child")
+		qtChild.Printf("foo")
+		qtChild.Donef("done")
+		qt.Printf("bar")
+		qt.Donef("done")
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected number of allocations for disabled tracer; got %v; want 0", allocs)
+	}
+	if s := qt.ToJSON(); s != "" {
+		t.Fatalf("unexpected JSON for disabled tracer; got %q; want empty string", s)
+	}
+}
+
+func TestTracerEnabled(t *testing.T) {
+	qt := New(true, "query %q", "foo")
+	if !qt.Enabled() {
+		t.Fatalf("tracer must be enabled")
+	}
+	qtChild := qt.NewChild("child %d", 1)
+	qtChild.Printf("message %d", 2)
+	qtChild.Donef("series=%d", 3)
+	qt.Printf("message %d", 4)
+	qt.Donef("done")
+
+	var s span
+	if err := json.Unmarshal([]byte(qt.ToJSON()), &s); err != nil {
+		t.Fatalf("cannot unmarshal trace: %s", err)
+	}
+	resetDurations(&s)
+	sExpected := span{
+		Message: `query "foo": done`,
+		Children: []*span{
+			{
+				Message: "child 1: series=3",
+				Children: []*span{
+					{
+						Message: "message 2",
+					},
+				},
+			},
+			{
+				Message: "message 4",
+			},
+		},
+	}
+	if !reflect.DeepEqual(&s, &sExpected) {
+		got, _ := json.Marshal(&s)
+		want, _ := json.Marshal(&sExpected)
+		t.Fatalf("unexpected trace;\ngot\n%s\nwant\n%s", got, want)
+	}
+}
+
+func resetDurations(s *span) {
+	if s.DurationMsec < 0 {
+		panic("duration cannot be negative")
+	}
+	s.DurationMsec = 0
+	for _, child := range s.Children {
+		resetDurations(child)
+	}
+}
@@ -0,0 +1,68 @@
+package selector
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+// Matcher matches metric names against tag filters.
+type Matcher struct {
+	tfs []tagFilter
+}
+
+type tagFilter struct {
+	key        string
+	value      string
+	isNegative bool
+	re         *regexp.Regexp
+}
+
+// NewMatcher returns Matcher for the given tfs.
+//
+// Tag filters match the whole tag value in the same way as in the storage.
+// Missing tags are matched as tags with empty values.
+func NewMatcher(tfs []storage.TagFilter) (*Matcher, error) {
+	var m Matcher
+	for i := range tfs {
+		tf := &tfs[i]
+		x := tagFilter{
+			key:        string(tf.Key),
+			value:      string(tf.Value),
+			isNegative: tf.IsNegative,
+		}
+		if tf.IsRegexp {
+			re, err := regexp.Compile("^(?:" + x.value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("cannot compile regexp for %s: %s", tf, err)
+			}
+			x.re = re
+		}
+		m.tfs = append(m.tfs, x)
+	}
+	return &m, nil
+}
+
+// Match returns true if mn matches all the tag filters in m.
+func (m *Matcher) Match(mn *storage.MetricName) bool {
+	for i := range m.tfs {
+		tf := &m.tfs[i]
+		var value []byte
+		if len(tf.key) == 0 {
+			value = mn.MetricGroup
+		} else {
+			value = mn.GetTagValue(tf.key)
+		}
+		var ok bool
+		if tf.re != nil {
+			ok = tf.re.Match(value)
+		} else {
+			ok = string(value) == tf.value
+		}
+		if ok == tf.isNegative {
+			return false
+		}
+	}
+	return true
+}
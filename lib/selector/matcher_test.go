@@ -0,0 +1,49 @@
+package selector
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestMatcher(t *testing.T) {
+	var mn storage.MetricName
+	mn.MetricGroup = []byte("http_requests_total")
+	mn.AddTag("job", "api")
+	mn.AddTag("instance", "host-1")
+
+	f := func(s string, resultExpected bool) {
+		t.Helper()
+		tfs, err := Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", s, err)
+		}
+		m, err := NewMatcher(tfs)
+		if err != nil {
+			t.Fatalf("cannot create matcher for %q: %s", s, err)
+		}
+		result := m.Match(&mn)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %v; want %v", s, result, resultExpected)
+		}
+	}
+	f(`http_requests_total`, true)
+	f(`http_requests`, false)
+	f(`{__name__=~"http_.+"}`, true)
+	f(`{__name__=~"http_"}`, false)
+	f(`http_requests_total{job="api"}`, true)
+	f(`http_requests_total{job="api",instance="host-2"}`, false)
+	f(`{job!="api"}`, false)
+	f(`{job!="web"}`, true)
+	f(`{instance=~"host-.+"}`, true)
+	f(`{instance=~"host"}`, false)
+	f(`{instance!~"host-1|host-2"}`, false)
+	f(`{instance!~"host-2"}`, true)
+
+	// Missing labels are matched as empty labels.
+	f(`{env=""}`, true)
+	f(`{env!=""}`, false)
+	f(`{env=~".*"}`, true)
+	f(`{env=~".+"}`, false)
+	f(`{job=""}`, false)
+}
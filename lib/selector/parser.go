@@ -0,0 +1,126 @@
+// Package selector provides parsing and matching for Prometheus series selectors
+// such as `metric{label="value",label=~"regexp"}`.
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+// Parse parses series selector such as `metric{label="value",label=~"regexp"}`
+// and returns the corresponding tag filters.
+//
+// The metric name is returned in the tag filter with nil Key.
+func Parse(s string) ([]storage.TagFilter, error) {
+	var tfs []storage.TagFilter
+	n := strings.IndexByte(s, '{')
+	metricName := s
+	if n >= 0 {
+		metricName = s[:n]
+		s = s[n:]
+	} else {
+		s = ""
+	}
+	metricName = strings.TrimSpace(metricName)
+	if len(metricName) > 0 {
+		if !isIdent(metricName) {
+			return nil, fmt.Errorf("invalid metric name %q", metricName)
+		}
+		tfs = append(tfs, storage.TagFilter{
+			Value: []byte(metricName),
+		})
+	}
+	if len(s) > 0 {
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("missing closing `}` in %q", s)
+		}
+		s = strings.TrimSpace(s[1 : len(s)-1])
+		for len(s) > 0 {
+			tf, tail, err := parseLabelFilter(s)
+			if err != nil {
+				return nil, err
+			}
+			tfs = append(tfs, *tf)
+			s = strings.TrimSpace(tail)
+			if len(s) == 0 {
+				break
+			}
+			if s[0] != ',' {
+				return nil, fmt.Errorf("missing `,` in front of %q", s)
+			}
+			s = strings.TrimSpace(s[1:])
+		}
+	}
+	if len(tfs) == 0 {
+		return nil, fmt.Errorf("series selector cannot be empty")
+	}
+	return tfs, nil
+}
+
+func parseLabelFilter(s string) (*storage.TagFilter, string, error) {
+	n := 0
+	for n < len(s) && isIdentChar(s[n]) {
+		n++
+	}
+	label := s[:n]
+	if !isIdent(label) {
+		return nil, "", fmt.Errorf("invalid label name at %q", s)
+	}
+	s = strings.TrimSpace(s[n:])
+	var tf storage.TagFilter
+	switch {
+	case strings.HasPrefix(s, "=~"):
+		tf.IsRegexp = true
+		s = s[2:]
+	case strings.HasPrefix(s, "!~"):
+		tf.IsRegexp = true
+		tf.IsNegative = true
+		s = s[2:]
+	case strings.HasPrefix(s, "!="):
+		tf.IsNegative = true
+		s = s[2:]
+	case strings.HasPrefix(s, "="):
+		s = s[1:]
+	default:
+		return nil, "", fmt.Errorf("missing operator after label %q", label)
+	}
+	s = strings.TrimSpace(s)
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot find quoted value for label %q at %q", label, s)
+	}
+	value, err := strconv.Unquote(quoted)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot unquote value for label %q: %s", label, err)
+	}
+	if tf.IsRegexp {
+		if _, err := regexp.Compile(value); err != nil {
+			return nil, "", fmt.Errorf("invalid regexp for label %q: %s", label, err)
+		}
+	}
+	if label != "__name__" {
+		tf.Key = []byte(label)
+	}
+	tf.Value = []byte(value)
+	return &tf, s[len(quoted):], nil
+}
+
+func isIdent(s string) bool {
+	if len(s) == 0 || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isIdentChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':'
+}
@@ -0,0 +1,80 @@
+package selector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestParseSuccess(t *testing.T) {
+	f := func(s string, tfsExpected []storage.TagFilter) {
+		t.Helper()
+		tfs, err := Parse(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(tfs, tfsExpected) {
+			t.Fatalf("unexpected tag filters for %q\ngot\n%v\nwant\n%v", s, tfs, tfsExpected)
+		}
+	}
+	f(`foo`, []storage.TagFilter{{
+		Value: []byte("foo"),
+	}})
+	f(`foo:bar_baz { }`, []storage.TagFilter{{
+		Value: []byte("foo:bar_baz"),
+	}})
+	f(`{__name__=~"foo|bar"}`, []storage.TagFilter{{
+		Value:    []byte("foo|bar"),
+		IsRegexp: true,
+	}})
+	f(`foo{a="b", c!="d",e=~"x.+" , f!~"y\"z"}`, []storage.TagFilter{
+		{
+			Value: []byte("foo"),
+		},
+		{
+			Key:   []byte("a"),
+			Value: []byte("b"),
+		},
+		{
+			Key:        []byte("c"),
+			Value:      []byte("d"),
+			IsNegative: true,
+		},
+		{
+			Key:      []byte("e"),
+			Value:    []byte("x.+"),
+			IsRegexp: true,
+		},
+		{
+			Key:        []byte("f"),
+			Value:      []byte(`y"z`),
+			IsNegative: true,
+			IsRegexp:   true,
+		},
+	})
+}
+
+func TestParseError(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		tfs, err := Parse(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+		if tfs != nil {
+			t.Fatalf("expecting nil tfs; got %v", tfs)
+		}
+	}
+	f(``)
+	f(`{}`)
+	f(`foo-bar`)
+	f(`1foo`)
+	f(`{foo="bar"`)
+	f(`{foo="bar"}x`)
+	f(`{foo=bar}`)
+	f(`{foo~"bar"}`)
+	f(`{foo="bar" baz="x"}`)
+	f(`{foo="bar",}x`)
+	f(`{foo=~"bar("}`)
+}
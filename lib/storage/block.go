@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"fmt"
+	"math"
 	"sync"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 )
@@ -79,6 +82,49 @@ func (b *Block) fixupTimestamps() {
 	b.bh.MaxTimestamp = b.timestamps[len(b.timestamps)-1]
 }
 
+// deduplicateSamplesDuringMerge removes samples closer to each other than
+// minScrapeInterval from unmarshaled b. It is a no-op for marshaled b.
+func (b *Block) deduplicateSamplesDuringMerge() {
+	if len(b.values) == 0 {
+		// Nothing to dedup or the data is already marshaled.
+		return
+	}
+	srcTimestamps := b.timestamps[b.nextIdx:]
+	srcValues := b.values[b.nextIdx:]
+	timestamps, values := deduplicateSamplesDuringMerge(srcTimestamps, srcValues)
+	b.timestamps = b.timestamps[:b.nextIdx+len(timestamps)]
+	b.values = b.values[:b.nextIdx+len(values)]
+}
+
+// downsampleSamplesDuringMerge downsamples b samples according to dps at the given time now.
+//
+// Marshaled b is unmarshaled only if it contains samples, which may need downsampling.
+func (b *Block) downsampleSamplesDuringMerge(dps []downsamplingPeriod, now int64) {
+	if len(dps) == 0 {
+		// Fast path - the block mustn't be downsampled.
+		return
+	}
+	if len(b.values) == 0 {
+		// The block is marshaled.
+		if b.bh.RowsCount < 2 || !needsDownsampling(dps, b.bh.MinTimestamp, now) {
+			// Fast path - nothing to downsample.
+			return
+		}
+		if err := b.UnmarshalData(); err != nil {
+			logger.Panicf("FATAL: cannot unmarshal block for downsampling: %s", err)
+		}
+	}
+	srcTimestamps := b.timestamps[b.nextIdx:]
+	srcValues := b.values[b.nextIdx:]
+	aggr := downsamplingAggr
+	if b.bh.Scale == decimal.ExactScale {
+		aggr = downsamplingAggrExact
+	}
+	timestamps, values := downsampleSamples(dps, srcTimestamps, srcValues, now, aggr)
+	b.timestamps = b.timestamps[:b.nextIdx+len(timestamps)]
+	b.values = b.values[:b.nextIdx+len(values)]
+}
+
 // RowsCount returns the number of rows in the block.
 func (b *Block) RowsCount() int {
 	return int(b.bh.RowsCount)
@@ -99,6 +145,13 @@ func (b *Block) Scale() int16 {
 	return b.bh.Scale
 }
 
+// MinTimestamp returns the minimum timestamp in the block.
+//
+// It is available without calling UnmarshalData.
+func (b *Block) MinTimestamp() int64 {
+	return b.bh.MinTimestamp
+}
+
 // Init initializes b with the given tsid, timestamps, values and scale.
 func (b *Block) Init(tsid *TSID, timestamps, values []int64, scale int16, precisionBits uint8) {
 	b.Reset()
@@ -274,3 +327,121 @@ func (b *Block) UnmarshalData() error {
 
 	return nil
 }
+
+// portableBlockVersion is the version of the block format produced by MarshalPortable.
+//
+// Increment this value every time the format changes.
+const portableBlockVersion = 1
+
+// MarshalPortable marshals b to dst, so it could be unmarshaled with UnmarshalPortable
+// on other VictoriaMetrics instances.
+//
+// The marshaled block doesn't contain TSID, since it is specific to the local storage.
+func (b *Block) MarshalPortable(dst []byte) []byte {
+	b.MarshalData(0, 0)
+
+	dst = append(dst, portableBlockVersion)
+	dst = encoding.MarshalVarInt64(dst, b.bh.MinTimestamp)
+	dst = encoding.MarshalVarInt64(dst, b.bh.MaxTimestamp)
+	dst = encoding.MarshalVarInt64(dst, b.bh.FirstValue)
+	dst = encoding.MarshalVarUint64(dst, uint64(b.bh.RowsCount))
+	dst = encoding.MarshalVarInt64(dst, int64(b.bh.Scale))
+	dst = append(dst, byte(b.bh.TimestampsMarshalType), byte(b.bh.ValuesMarshalType), b.bh.PrecisionBits)
+	dst = encoding.MarshalBytes(dst, b.timestampsData)
+	dst = encoding.MarshalBytes(dst, b.valuesData)
+	return dst
+}
+
+// UnmarshalPortable unmarshals block from src to b and returns the remaining tail.
+//
+// b.UnmarshalData must be called on b before accessing its timestamps and values.
+func (b *Block) UnmarshalPortable(src []byte) ([]byte, error) {
+	b.Reset()
+
+	if len(src) < 1 {
+		return src, fmt.Errorf("cannot unmarshal block version from empty data")
+	}
+	if src[0] != portableBlockVersion {
+		return src, fmt.Errorf("unsupported block version: %d; want %d", src[0], portableBlockVersion)
+	}
+	src = src[1:]
+
+	tail, minTimestamp, err := encoding.UnmarshalVarInt64(src)
+	if err != nil {
+		return tail, fmt.Errorf("cannot unmarshal MinTimestamp: %s", err)
+	}
+	src = tail
+	tail, maxTimestamp, err := encoding.UnmarshalVarInt64(src)
+	if err != nil {
+		return tail, fmt.Errorf("cannot unmarshal MaxTimestamp: %s", err)
+	}
+	src = tail
+	if minTimestamp > maxTimestamp {
+		return src, fmt.Errorf("MinTimestamp cannot exceed MaxTimestamp; got %d vs %d", minTimestamp, maxTimestamp)
+	}
+	tail, firstValue, err := encoding.UnmarshalVarInt64(src)
+	if err != nil {
+		return tail, fmt.Errorf("cannot unmarshal FirstValue: %s", err)
+	}
+	src = tail
+	tail, rowsCount, err := encoding.UnmarshalVarUint64(src)
+	if err != nil {
+		return tail, fmt.Errorf("cannot unmarshal RowsCount: %s", err)
+	}
+	src = tail
+	if rowsCount == 0 {
+		return src, fmt.Errorf("RowsCount must be greater than 0")
+	}
+	if rowsCount > maxRowsPerBlock {
+		return src, fmt.Errorf("too big RowsCount: %d; cannot exceed %d", rowsCount, maxRowsPerBlock)
+	}
+	tail, scale, err := encoding.UnmarshalVarInt64(src)
+	if err != nil {
+		return tail, fmt.Errorf("cannot unmarshal Scale: %s", err)
+	}
+	src = tail
+	if scale < math.MinInt16 || scale > math.MaxInt16 {
+		return src, fmt.Errorf("Scale must be in the range [%d..%d]; got %d", math.MinInt16, math.MaxInt16, scale)
+	}
+	if len(src) < 3 {
+		return src, fmt.Errorf("cannot unmarshal marshal types and precision bits from %d bytes; need at least 3 bytes", len(src))
+	}
+	timestampsMarshalType := encoding.MarshalType(src[0])
+	if err := encoding.CheckMarshalType(timestampsMarshalType); err != nil {
+		return src, fmt.Errorf("unsupported TimestampsMarshalType: %s", err)
+	}
+	valuesMarshalType := encoding.MarshalType(src[1])
+	if err := encoding.CheckMarshalType(valuesMarshalType); err != nil {
+		return src, fmt.Errorf("unsupported ValuesMarshalType: %s", err)
+	}
+	precisionBits := src[2]
+	if err := encoding.CheckPrecisionBits(precisionBits); err != nil {
+		return src, err
+	}
+	src = src[3:]
+
+	tail, tds, err := encoding.UnmarshalBytes(src)
+	if err != nil {
+		return tail, fmt.Errorf("cannot unmarshal timestampsData: %s", err)
+	}
+	src = tail
+	tail, vd, err := encoding.UnmarshalBytes(src)
+	if err != nil {
+		return tail, fmt.Errorf("cannot unmarshal valuesData: %s", err)
+	}
+	src = tail
+
+	b.bh.MinTimestamp = minTimestamp
+	b.bh.MaxTimestamp = maxTimestamp
+	b.bh.FirstValue = firstValue
+	b.bh.RowsCount = uint32(rowsCount)
+	b.bh.Scale = int16(scale)
+	b.bh.TimestampsMarshalType = timestampsMarshalType
+	b.bh.ValuesMarshalType = valuesMarshalType
+	b.bh.PrecisionBits = precisionBits
+	b.timestampsData = append(b.timestampsData[:0], tds...)
+	b.valuesData = append(b.valuesData[:0], vd...)
+	b.bh.TimestampsBlockSize = uint32(len(b.timestampsData))
+	b.bh.ValuesBlockSize = uint32(len(b.valuesData))
+	return src, nil
+}
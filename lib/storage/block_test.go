@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+)
+
+func TestBlockMarshalUnmarshalPortable(t *testing.T) {
+	var b Block
+	for i := 0; i < 1000; i++ {
+		b.Reset()
+		rowsCount := rand.Intn(maxRowsPerBlock) + 1
+		b.timestamps = getRandTimestamps(rowsCount)
+		b.values = getRandValues(rowsCount)
+		b.bh.Scale = int16(rand.Intn(30) - 15)
+		b.bh.PrecisionBits = 64
+		testBlockMarshalUnmarshalPortable(t, &b)
+	}
+}
+
+func testBlockMarshalUnmarshalPortable(t *testing.T, b *Block) {
+	var b1, b2 Block
+	b1.CopyFrom(b)
+	rowsCount := len(b.values)
+	data := b1.MarshalPortable(nil)
+	if b1.bh.RowsCount != uint32(rowsCount) {
+		t.Fatalf("unexpected number of rows marshaled; got %d; want %d", b1.bh.RowsCount, rowsCount)
+	}
+	tail, err := b2.UnmarshalPortable(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(tail) > 0 {
+		t.Fatalf("unexpected non-empty tail: %X", tail)
+	}
+	compareBlocksPortable(t, &b2, b, &b1.bh)
+
+	// Verify non-empty prefix and suffix
+	prefix := "prefix"
+	suffix := "suffix"
+	data = append(data[:0], prefix...)
+	data = b1.MarshalPortable(data)
+	if b1.bh.RowsCount != uint32(rowsCount) {
+		t.Fatalf("unexpected number of rows marshaled; got %d; want %d", b1.bh.RowsCount, rowsCount)
+	}
+	if string(data[:len(prefix)]) != prefix {
+		t.Fatalf("unexpected prefix; got %q; want %q", data[:len(prefix)], prefix)
+	}
+	data = append(data, suffix...)
+	tail, err = b2.UnmarshalPortable(data[len(prefix):])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(tail) != suffix {
+		t.Fatalf("unexpected tail; got %q; want %q", tail, suffix)
+	}
+	compareBlocksPortable(t, &b2, b, &b1.bh)
+}
+
+func compareBlocksPortable(t *testing.T, b1, bExpected *Block, bhExpected *blockHeader) {
+	t.Helper()
+	if b1.bh.MinTimestamp != bhExpected.MinTimestamp {
+		t.Fatalf("unexpected MinTimestamp; got %d; want %d", b1.bh.MinTimestamp, bhExpected.MinTimestamp)
+	}
+	if b1.bh.MaxTimestamp != bhExpected.MaxTimestamp {
+		t.Fatalf("unexpected MaxTimestamp; got %d; want %d", b1.bh.MaxTimestamp, bhExpected.MaxTimestamp)
+	}
+	if b1.bh.FirstValue != bhExpected.FirstValue {
+		t.Fatalf("unexpected FirstValue; got %d; want %d", b1.bh.FirstValue, bhExpected.FirstValue)
+	}
+	if b1.bh.RowsCount != bhExpected.RowsCount {
+		t.Fatalf("unexpected RowsCount; got %d; want %d", b1.bh.RowsCount, bhExpected.RowsCount)
+	}
+	if b1.bh.Scale != bhExpected.Scale {
+		t.Fatalf("unexpected Scale; got %d; want %d", b1.bh.Scale, bhExpected.Scale)
+	}
+	if b1.bh.TimestampsMarshalType != bhExpected.TimestampsMarshalType {
+		t.Fatalf("unexpected TimestampsMarshalType; got %d; want %d", b1.bh.TimestampsMarshalType, bhExpected.TimestampsMarshalType)
+	}
+	if b1.bh.ValuesMarshalType != bhExpected.ValuesMarshalType {
+		t.Fatalf("unexpected ValuesMarshalType; got %d; want %d", b1.bh.ValuesMarshalType, bhExpected.ValuesMarshalType)
+	}
+	if b1.bh.PrecisionBits != bhExpected.PrecisionBits {
+		t.Fatalf("unexpected PrecisionBits; got %d; want %d", b1.bh.PrecisionBits, bhExpected.PrecisionBits)
+	}
+	if err := b1.UnmarshalData(); err != nil {
+		t.Fatalf("cannot unmarshal block data: %s", err)
+	}
+	if !reflect.DeepEqual(b1.values, bExpected.values) {
+		t.Fatalf("unexpected values; got\n%d\nwant\n%d", b1.values, bExpected.values)
+	}
+	if b1.bh.ValuesMarshalType != encoding.MarshalTypeConst && b1.bh.ValuesMarshalType != encoding.MarshalTypeDeltaConst && !reflect.DeepEqual(b1.timestamps, bExpected.timestamps) {
+		t.Fatalf("unexpected timestamps; got\n%d\nwant\n%d", b1.timestamps, bExpected.timestamps)
+	}
+}
+
+func TestBlockUnmarshalPortableFailure(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		var b Block
+		if _, err := b.UnmarshalPortable(data); err == nil {
+			t.Fatalf("expecting non-nil error when unmarshaling %X", data)
+		}
+	}
+
+	var b Block
+	b.timestamps = []int64{1, 2, 3}
+	b.values = []int64{4, 5, 6}
+	b.bh.PrecisionBits = 64
+	data := b.MarshalPortable(nil)
+
+	// Empty data
+	f(nil)
+
+	// Unsupported version
+	dataInvalidVersion := append([]byte{}, data...)
+	dataInvalidVersion[0] = portableBlockVersion + 1
+	f(dataInvalidVersion)
+
+	// Truncated data
+	for i := 1; i < len(data); i++ {
+		f(data[:i])
+	}
+}
+
+func getRandTimestamps(n int) []int64 {
+	timestamps := make([]int64, n)
+	ts := rand.Int63n(1e12)
+	for i := range timestamps {
+		ts += int64(rand.NormFloat64() * 1e3)
+		if ts < 0 {
+			ts = 0
+		}
+		timestamps[i] = ts
+	}
+	// Timestamps must be sorted in the block.
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] < timestamps[i-1] {
+			timestamps[i] = timestamps[i-1]
+		}
+	}
+	return timestamps
+}
+
+func getRandValues(n int) []int64 {
+	values := make([]int64, n)
+	for i := range values {
+		values[i] = int64(rand.NormFloat64() * 1e6)
+	}
+	return values
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"time"
+)
+
+// SetColdStorage enables moving partitions with data older than coldAge to coldPath.
+//
+// The data is moved in background. Queries transparently search the data
+// at both the storage path and coldPath.
+//
+// Cold storage is disabled if coldPath is empty.
+//
+// This function must be called before initializing the storage.
+func SetColdStorage(coldPath string, coldAge time.Duration) {
+	coldStoragePath = coldPath
+	coldStorageAge = coldAge.Nanoseconds() / 1e6
+}
+
+var (
+	coldStoragePath = ""
+	coldStorageAge  = int64(0)
+)
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"time"
+)
+
+// SetMinScrapeIntervalForDeduplication sets the minimum interval for data points during de-duplication.
+//
+// De-duplication is disabled if interval is 0.
+//
+// This function must be called before initializing the storage.
+func SetMinScrapeIntervalForDeduplication(interval time.Duration) {
+	minScrapeInterval = interval.Nanoseconds() / 1e6
+}
+
+var minScrapeInterval = int64(0)
+
+// DeduplicateSamples removes samples from srcTimestamps and srcValues if they fall
+// into the same interval set via SetMinScrapeIntervalForDeduplication.
+//
+// Intervals are aligned to minScrapeInterval, so the result doesn't depend on how samples
+// are split into blocks and parts. The last sample is kept for each interval.
+// srcTimestamps must be sorted.
+//
+// src* slice contents may be modified, while the returned slices share the same underlying arrays.
+func DeduplicateSamples(srcTimestamps []int64, srcValues []float64) ([]int64, []float64) {
+	if !needsDedup(srcTimestamps, minScrapeInterval) {
+		// Fast path - nothing to deduplicate.
+		return srcTimestamps, srcValues
+	}
+	dstTimestamps := deduplicateTimestamps(srcTimestamps, func(dst, src int) {
+		srcValues[dst] = srcValues[src]
+	})
+	return dstTimestamps, srcValues[:len(dstTimestamps)]
+}
+
+// deduplicateSamplesDuringMerge works the same as DeduplicateSamples, but for int64 values stored in blocks.
+func deduplicateSamplesDuringMerge(srcTimestamps []int64, srcValues []int64) ([]int64, []int64) {
+	if !needsDedup(srcTimestamps, minScrapeInterval) {
+		// Fast path - nothing to deduplicate.
+		return srcTimestamps, srcValues
+	}
+	dstTimestamps := deduplicateTimestamps(srcTimestamps, func(dst, src int) {
+		srcValues[dst] = srcValues[src]
+	})
+	return dstTimestamps, srcValues[:len(dstTimestamps)]
+}
+
+// deduplicateTimestamps leaves the last timestamp per each minScrapeInterval in timestamps and returns the result.
+//
+// moveValue is called for moving the value for the kept timestamp from src to dst position,
+// so the caller could deduplicate values of arbitrary type.
+func deduplicateTimestamps(timestamps []int64, moveValue func(dst, src int)) []int64 {
+	dstTimestamps := timestamps[:0]
+	for i, ts := range timestamps {
+		if i+1 < len(timestamps) && getDedupInterval(timestamps[i+1], minScrapeInterval) == getDedupInterval(ts, minScrapeInterval) {
+			// The next sample belongs to the same interval, so it takes precedence.
+			continue
+		}
+		moveValue(len(dstTimestamps), i)
+		dstTimestamps = append(dstTimestamps, ts)
+	}
+	return dstTimestamps
+}
+
+// getDedupInterval returns the number of the interval with the given duration containing the given timestamp.
+func getDedupInterval(timestamp, interval int64) int64 {
+	n := timestamp / interval
+	if timestamp < 0 && timestamp%interval != 0 {
+		n--
+	}
+	return n
+}
+
+func needsDedup(timestamps []int64, interval int64) bool {
+	if interval <= 0 || len(timestamps) < 2 {
+		return false
+	}
+	prevInterval := getDedupInterval(timestamps[0], interval)
+	for _, ts := range timestamps[1:] {
+		n := getDedupInterval(ts, interval)
+		if n == prevInterval {
+			return true
+		}
+		prevInterval = n
+	}
+	return false
+}
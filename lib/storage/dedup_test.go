@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNeedsDedup(t *testing.T) {
+	f := func(interval int64, timestamps []int64, expected bool) {
+		t.Helper()
+		result := needsDedup(timestamps, interval)
+		if result != expected {
+			t.Fatalf("unexpected result for needsDedup(%d, %d); got %v; want %v", timestamps, interval, result, expected)
+		}
+	}
+	f(-1, nil, false)
+	f(-1, []int64{1}, false)
+	f(0, []int64{1, 2}, false)
+	f(10, []int64{1}, false)
+	f(10, []int64{1, 2}, true)
+	f(10, []int64{1, 11}, false)
+	f(10, []int64{1, 11, 12}, true)
+	f(10, []int64{1, 11, 21, 35}, false)
+}
+
+func TestDeduplicateSamples(t *testing.T) {
+	f := func(scrapeInterval time.Duration, timestamps, timestampsExpected []int64) {
+		t.Helper()
+		SetMinScrapeIntervalForDeduplication(scrapeInterval)
+		defer SetMinScrapeIntervalForDeduplication(0)
+
+		timestampsCopy := append([]int64{}, timestamps...)
+		values := make([]float64, len(timestamps))
+		for i, ts := range timestamps {
+			values[i] = float64(ts)
+		}
+		dedupTimestamps, dedupValues := DeduplicateSamples(timestampsCopy, values)
+		if !reflect.DeepEqual(dedupTimestamps, timestampsExpected) {
+			t.Fatalf("invalid DeduplicateSamples(%v) result;\ngot\n%v\nwant\n%v", timestamps, dedupTimestamps, timestampsExpected)
+		}
+		// The last sample must be preserved for every group of duplicate samples.
+		for i, ts := range dedupTimestamps {
+			if dedupValues[i] != float64(ts) {
+				t.Fatalf("unexpected value at position %d for timestamp %d; got %v; want %v", i, ts, dedupValues[i], float64(ts))
+			}
+		}
+
+		timestampsCopy = append(timestampsCopy[:0], timestamps...)
+		int64Values := append([]int64{}, timestamps...)
+		dedupTimestamps, dedupInt64Values := deduplicateSamplesDuringMerge(timestampsCopy, int64Values)
+		if !reflect.DeepEqual(dedupTimestamps, timestampsExpected) {
+			t.Fatalf("invalid deduplicateSamplesDuringMerge(%v) result;\ngot\n%v\nwant\n%v", timestamps, dedupTimestamps, timestampsExpected)
+		}
+		if !reflect.DeepEqual(dedupInt64Values, timestampsExpected) {
+			t.Fatalf("invalid values for deduplicateSamplesDuringMerge(%v);\ngot\n%v\nwant\n%v", timestamps, dedupInt64Values, timestampsExpected)
+		}
+	}
+
+	// Disabled dedup
+	f(0, []int64{1, 2, 3, 4}, []int64{1, 2, 3, 4})
+
+	// Nothing to dedup
+	f(time.Millisecond, []int64{1, 2, 3, 4}, []int64{1, 2, 3, 4})
+	f(10*time.Millisecond, []int64{0, 10, 25, 40}, []int64{0, 10, 25, 40})
+	f(10*time.Millisecond, []int64{123}, []int64{123})
+
+	// HA pair with a few milliseconds between samples
+	f(10*time.Millisecond, []int64{0, 3, 10, 13, 20, 23}, []int64{3, 13, 23})
+
+	// Identical timestamps
+	f(time.Millisecond, []int64{1, 1, 2, 2, 2, 3}, []int64{1, 2, 3})
+
+	// Intervals are aligned to the dedup interval
+	f(10*time.Millisecond, []int64{0, 5, 9, 10, 30, 45, 50}, []int64{9, 10, 30, 45, 50})
+	f(10*time.Millisecond, []int64{5, 12, 19, 21}, []int64{5, 19, 21})
+	f(10*time.Millisecond, []int64{-15, -11, -10, -1, 0}, []int64{-11, -1, 0})
+}
+
+func TestDeduplicateSamplesSplitIndependent(t *testing.T) {
+	SetMinScrapeIntervalForDeduplication(15 * time.Millisecond)
+	defer SetMinScrapeIntervalForDeduplication(0)
+
+	r := rand.New(rand.NewSource(1))
+	var timestamps []int64
+	ts := int64(0)
+	for i := 0; i < 1000; i++ {
+		ts += int64(r.Intn(20))
+		timestamps = append(timestamps, ts)
+	}
+	dedup := func(timestamps []int64) []int64 {
+		values := make([]int64, len(timestamps))
+		copy(values, timestamps)
+		timestamps = append([]int64{}, timestamps...)
+		timestamps, _ = deduplicateSamplesDuringMerge(timestamps, values)
+		return timestamps
+	}
+	timestampsExpected := dedup(timestamps)
+
+	// Deduplicate samples split into parts at arbitrary positions, then merge the parts
+	// and deduplicate the merged samples again like background merge does.
+	// The result mustn't depend on the split.
+	for i := 0; i < 100; i++ {
+		var merged []int64
+		tail := timestamps
+		for len(tail) > 0 {
+			n := 1 + r.Intn(len(tail))
+			merged = append(merged, dedup(tail[:n])...)
+			tail = tail[n:]
+		}
+		merged = dedup(merged)
+		if !reflect.DeepEqual(merged, timestampsExpected) {
+			t.Fatalf("unexpected result after merging parts;\ngot\n%v\nwant\n%v", merged, timestampsExpected)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+// DownsamplingPeriod instructs leaving a single sample per Interval for samples older than Offset.
+//
+// The period is applied only to time series matching TagFilters if TagFilters are set.
+type DownsamplingPeriod struct {
+	TagFilters []TagFilter
+	Offset     time.Duration
+	Interval   time.Duration
+}
+
+// String returns string representation of dp.
+func (dp *DownsamplingPeriod) String() string {
+	var bb bytesutil.ByteBuffer
+	bb.B = appendTagFiltersString(bb.B, dp.TagFilters)
+	if len(bb.B) > 0 {
+		bb.B = append(bb.B, ':')
+	}
+	fmt.Fprintf(&bb, "%s:%s", dp.Offset, dp.Interval)
+	return string(bb.B)
+}
+
+func appendTagFiltersString(dst []byte, tfs []TagFilter) []byte {
+	for i := range tfs {
+		dst = append(dst, tfs[i].String()...)
+	}
+	return dst
+}
+
+type downsamplingPeriod struct {
+	offsetMsecs   int64
+	intervalMsecs int64
+}
+
+// downsamplingFilter contains downsampling periods for time series matching tfs.
+type downsamplingFilter struct {
+	tfs     *TagFilters
+	periods []downsamplingPeriod
+}
+
+// downsamplingAggrFunc aggregates values falling into a single downsampling interval.
+type downsamplingAggrFunc func(values []int64) int64
+
+var downsamplingAggrFuncs = map[string]downsamplingAggrFunc{
+	"last": func(values []int64) int64 {
+		return values[len(values)-1]
+	},
+	"min": skipStaleNaNs(decimal.IsStaleNaNInt64, func(values []int64) int64 {
+		n := values[0]
+		for _, v := range values[1:] {
+			if v < n {
+				n = v
+			}
+		}
+		return n
+	}),
+	"max": skipStaleNaNs(decimal.IsStaleNaNInt64, func(values []int64) int64 {
+		n := values[0]
+		for _, v := range values[1:] {
+			if v > n {
+				n = v
+			}
+		}
+		return n
+	}),
+	"sum": skipStaleNaNs(decimal.IsStaleNaNInt64, func(values []int64) int64 {
+		n := int64(0)
+		for _, v := range values {
+			n += v
+		}
+		return n
+	}),
+}
+
+// downsamplingExactAggrFuncs contains aggregate functions for values stored as raw float64 bits
+// in blocks with decimal.ExactScale.
+var downsamplingExactAggrFuncs = map[string]downsamplingAggrFunc{
+	"last": downsamplingAggrFuncs["last"],
+	"min": skipStaleNaNs(isStaleNaNExact, func(values []int64) int64 {
+		n := values[0]
+		for _, v := range values[1:] {
+			if math.Float64frombits(uint64(v)) < math.Float64frombits(uint64(n)) {
+				n = v
+			}
+		}
+		return n
+	}),
+	"max": skipStaleNaNs(isStaleNaNExact, func(values []int64) int64 {
+		n := values[0]
+		for _, v := range values[1:] {
+			if math.Float64frombits(uint64(v)) > math.Float64frombits(uint64(n)) {
+				n = v
+			}
+		}
+		return n
+	}),
+	"sum": skipStaleNaNs(isStaleNaNExact, func(values []int64) int64 {
+		n := float64(0)
+		for _, v := range values {
+			n += math.Float64frombits(uint64(v))
+		}
+		return int64(math.Float64bits(n))
+	}),
+}
+
+func isStaleNaNExact(v int64) bool {
+	return decimal.IsStaleNaN(math.Float64frombits(uint64(v)))
+}
+
+// skipStaleNaNs returns aggregate function, which applies af to values without Prometheus staleness marks.
+//
+// The staleness mark is returned if all the values are staleness marks, so the interval without real samples keeps the mark.
+// values may be modified, since downsampleSamples doesn't use them after the aggregation.
+func skipStaleNaNs(isStaleNaN func(v int64) bool, af downsamplingAggrFunc) downsamplingAggrFunc {
+	return func(values []int64) int64 {
+		dst := values[:0]
+		for _, v := range values {
+			if !isStaleNaN(v) {
+				dst = append(dst, v)
+			}
+		}
+		if len(dst) == 0 {
+			return values[len(values)-1]
+		}
+		return af(dst)
+	}
+}
+
+// SetDownsamplingPeriods sets downsampling periods applied to samples during background merges.
+//
+// Samples older than the period offset are collapsed to a single sample per the period interval.
+// The sample gets the timestamp of the last sample in the interval and the value
+// obtained by applying aggr to the samples in the interval. aggr may be `last`, `min`, `max` or `sum`.
+//
+// Periods with the same TagFilters form a single downsampling filter. Time series are downsampled
+// according to the first filter they match. Time series not matching any filter are downsampled
+// according to periods without TagFilters. Periods with bigger offsets within a filter must have bigger intervals,
+// which are multiple of the intervals for smaller offsets.
+//
+// Downsampling is disabled if periods are empty.
+//
+// This function must be called before initializing the storage.
+func SetDownsamplingPeriods(periods []DownsamplingPeriod, aggr string) error {
+	af := downsamplingAggrFuncs[aggr]
+	if af == nil {
+		return fmt.Errorf("unsupported downsampling aggregate %q; supported values: last, min, max, sum", aggr)
+	}
+	var defaultPeriods []DownsamplingPeriod
+	var filterKeys []string
+	filterPeriods := make(map[string][]DownsamplingPeriod)
+	for i := range periods {
+		p := &periods[i]
+		if len(p.TagFilters) == 0 {
+			defaultPeriods = append(defaultPeriods, *p)
+			continue
+		}
+		key := string(appendTagFiltersString(nil, p.TagFilters))
+		if _, ok := filterPeriods[key]; !ok {
+			filterKeys = append(filterKeys, key)
+		}
+		filterPeriods[key] = append(filterPeriods[key], *p)
+	}
+	dps, err := newDownsamplingPeriods(defaultPeriods)
+	if err != nil {
+		return err
+	}
+	filters := make([]downsamplingFilter, 0, len(filterKeys))
+	for _, key := range filterKeys {
+		ps := filterPeriods[key]
+		tfs := NewTagFilters()
+		for j := range ps[0].TagFilters {
+			tf := &ps[0].TagFilters[j]
+			if err := tfs.Add(tf.Key, tf.Value, tf.IsNegative, tf.IsRegexp); err != nil {
+				return fmt.Errorf("cannot parse tag filter %s for the downsampling period %s: %s", tf, &ps[0], err)
+			}
+		}
+		if len(tfs.tfs) == 0 {
+			return fmt.Errorf("the downsampling period %s must contain at least a single non-empty tag filter", &ps[0])
+		}
+		filterDPs, err := newDownsamplingPeriods(ps)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, downsamplingFilter{
+			tfs:     tfs,
+			periods: filterDPs,
+		})
+	}
+	downsamplingPeriods = dps
+	downsamplingFilters = filters
+	downsamplingAggr = af
+	downsamplingAggrExact = downsamplingExactAggrFuncs[aggr]
+	return nil
+}
+
+// newDownsamplingPeriods validates periods and returns them sorted by offsets.
+func newDownsamplingPeriods(periods []DownsamplingPeriod) ([]downsamplingPeriod, error) {
+	dps := make([]downsamplingPeriod, 0, len(periods))
+	for i := range periods {
+		p := &periods[i]
+		offsetMsecs := int64(p.Offset / time.Millisecond)
+		intervalMsecs := int64(p.Interval / time.Millisecond)
+		if offsetMsecs <= 0 {
+			return nil, fmt.Errorf("offset must be positive for the downsampling period %s", p)
+		}
+		if intervalMsecs <= 0 {
+			return nil, fmt.Errorf("interval must be positive for the downsampling period %s", p)
+		}
+		dps = append(dps, downsamplingPeriod{
+			offsetMsecs:   offsetMsecs,
+			intervalMsecs: intervalMsecs,
+		})
+	}
+	sort.Slice(dps, func(i, j int) bool {
+		return dps[i].offsetMsecs < dps[j].offsetMsecs
+	})
+	for i := 1; i < len(dps); i++ {
+		prev := &dps[i-1]
+		dp := &dps[i]
+		if dp.offsetMsecs == prev.offsetMsecs {
+			return nil, fmt.Errorf("duplicate downsampling offset %s", time.Duration(dp.offsetMsecs)*time.Millisecond)
+		}
+		if dp.intervalMsecs <= prev.intervalMsecs || dp.intervalMsecs%prev.intervalMsecs != 0 {
+			return nil, fmt.Errorf("downsampling interval %s for offset %s must be bigger than and multiple of the interval %s for the smaller offset %s",
+				time.Duration(dp.intervalMsecs)*time.Millisecond, time.Duration(dp.offsetMsecs)*time.Millisecond,
+				time.Duration(prev.intervalMsecs)*time.Millisecond, time.Duration(prev.offsetMsecs)*time.Millisecond)
+		}
+	}
+	return dps, nil
+}
+
+var (
+	// downsamplingPeriods contains periods for time series not matching downsamplingFilters.
+	downsamplingPeriods []downsamplingPeriod
+
+	// downsamplingFilters contains periods for time series matching series selectors.
+	downsamplingFilters []downsamplingFilter
+
+	downsamplingAggr      = downsamplingAggrFuncs["last"]
+	downsamplingAggrExact = downsamplingExactAggrFuncs["last"]
+)
+
+// isDownsamplingEnabled returns true if at least a single downsampling period is set.
+func isDownsamplingEnabled() bool {
+	return len(downsamplingPeriods) > 0 || len(downsamplingFilters) > 0
+}
+
+// needsDownsampling returns true if samples older than minTimestamp may be downsampled according to dps at the given time now.
+func needsDownsampling(dps []downsamplingPeriod, minTimestamp, now int64) bool {
+	if len(dps) == 0 {
+		return false
+	}
+	return minTimestamp <= now-dps[0].offsetMsecs
+}
+
+// getDownsamplingInterval returns downsampling interval according to dps for the sample with the given timestamp at the given time now.
+//
+// 0 is returned if the sample mustn't be downsampled.
+func getDownsamplingInterval(dps []downsamplingPeriod, timestamp, now int64) int64 {
+	for i := len(dps) - 1; i >= 0; i-- {
+		dp := &dps[i]
+		if timestamp <= now-dp.offsetMsecs {
+			return dp.intervalMsecs
+		}
+	}
+	return 0
+}
+
+// maxDownsampledRows returns the maximum number of rows, which may remain in the block
+// with samples on the time range [minTimestamp ... maxTimestamp] after downsampling according to dps at the given time now.
+//
+// -1 is returned if the time range contains samples, which mustn't be downsampled.
+func maxDownsampledRows(dps []downsamplingPeriod, minTimestamp, maxTimestamp, now int64) int64 {
+	if len(dps) == 0 || maxTimestamp > now-dps[0].offsetMsecs {
+		return -1
+	}
+	n := int64(0)
+	for i := len(dps) - 1; i >= 0 && minTimestamp <= maxTimestamp; i-- {
+		dp := &dps[i]
+		tierMaxTimestamp := now - dp.offsetMsecs
+		if minTimestamp > tierMaxTimestamp {
+			continue
+		}
+		end := maxTimestamp
+		if end > tierMaxTimestamp {
+			end = tierMaxTimestamp
+		}
+		n += floorDiv(end, dp.intervalMsecs) - floorDiv(minTimestamp, dp.intervalMsecs) + 1
+		minTimestamp = end + 1
+	}
+	return n
+}
+
+// downsampleSamples leaves a single sample per downsampling interval for samples
+// older than the offsets for dps at the given time now.
+//
+// Values falling into a single interval are aggregated with aggr.
+//
+// Intervals are aligned to Unix epoch, so repeated downsampling of the same samples
+// leaves them unchanged. srcTimestamps must be sorted.
+//
+// src* slice contents may be modified, while the returned slices share the same underlying arrays.
+func downsampleSamples(dps []downsamplingPeriod, srcTimestamps, srcValues []int64, now int64, aggr downsamplingAggrFunc) ([]int64, []int64) {
+	if len(srcTimestamps) < 2 || !needsDownsampling(dps, srcTimestamps[0], now) {
+		// Fast path - nothing to downsample.
+		return srcTimestamps, srcValues
+	}
+
+	// Slow path - downsample samples.
+	dstTimestamps := srcTimestamps[:0]
+	dstValues := srcValues[:0]
+	i := 0
+	for i < len(srcTimestamps) {
+		ts := srcTimestamps[i]
+		interval := getDownsamplingInterval(dps, ts, now)
+		if interval == 0 {
+			// The remaining samples are too fresh for downsampling, since timestamps are sorted.
+			dstTimestamps = append(dstTimestamps, srcTimestamps[i:]...)
+			dstValues = append(dstValues, srcValues[i:]...)
+			break
+		}
+		bucket := floorDiv(ts, interval)
+		j := i + 1
+		for j < len(srcTimestamps) && floorDiv(srcTimestamps[j], interval) == bucket && getDownsamplingInterval(dps, srcTimestamps[j], now) == interval {
+			j++
+		}
+		// The value must be calculated before overwriting srcValues, since dstValues shares the same underlying array.
+		v := srcValues[i]
+		if j-i > 1 {
+			v = aggr(srcValues[i:j])
+		}
+		dstTimestamps = append(dstTimestamps, srcTimestamps[j-1])
+		dstValues = append(dstValues, v)
+		i = j
+	}
+	return dstTimestamps, dstValues
+}
+
+func floorDiv(a, b int64) int64 {
+	n := a / b
+	if a%b < 0 {
+		n--
+	}
+	return n
+}
+
+// metricIDDownsampling contains per-metricID downsampling filters obtained from downsamplingFilters.
+type metricIDDownsampling struct {
+	// m maps metricID to the index of the first matching downsampling filter.
+	m map[uint64]int
+
+	// maxMetricID is the maximum metricID, which has been matched against downsampling filters.
+	//
+	// Time series with bigger metricIDs mustn't be downsampled until the next matching,
+	// since they may need downsampling periods from filters.
+	maxMetricID uint64
+}
+
+// getPeriods returns downsampling periods for the given metricID.
+func (md *metricIDDownsampling) getPeriods(metricID uint64) []downsamplingPeriod {
+	if len(downsamplingFilters) == 0 {
+		// Fast path - all the time series are downsampled with the same periods.
+		return downsamplingPeriods
+	}
+	if md == nil || metricID > md.maxMetricID {
+		return nil
+	}
+	if idx, ok := md.m[metricID]; ok {
+		return downsamplingFilters[idx].periods
+	}
+	return downsamplingPeriods
+}
+
+func (s *Storage) getMetricIDDownsampling() *metricIDDownsampling {
+	return s.metricIDDownsampling.Load().(*metricIDDownsampling)
+}
+
+func (s *Storage) startDownsamplingUpdater() {
+	if !isDownsamplingEnabled() {
+		return
+	}
+	// All the time series created before this call are visible to search,
+	// so they are matched before background merges start downsampling them.
+	if err := s.updateMetricIDDownsampling(atomic.LoadUint64(&uniqueUint64)); err != nil {
+		logger.Errorf("cannot apply downsampling filters: %s", err)
+	}
+	s.downsamplingUpdaterWG.Add(1)
+	go func() {
+		s.downsamplingUpdater()
+		s.downsamplingUpdaterWG.Done()
+	}()
+}
+
+// downsamplingUpdateInterval is the interval for matching new time series
+// against downsampling filters and downsampling parts not touched by background merges.
+var downsamplingUpdateInterval = time.Hour
+
+func (s *Storage) downsamplingUpdater() {
+	t := time.NewTimer(downsamplingUpdateInterval)
+	defer t.Stop()
+	for {
+		if err := s.tb.mergeDownsampledParts(s.stop); err != nil {
+			logger.Errorf("cannot downsample old parts: %s", err)
+		}
+
+		// Time series created after the maxMetricID may be invisible to search right now,
+		// so only the time series created before the update interval are matched.
+		maxMetricID := atomic.LoadUint64(&uniqueUint64)
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			t.Reset(downsamplingUpdateInterval)
+		}
+		if err := s.updateMetricIDDownsampling(maxMetricID); err != nil {
+			logger.Errorf("cannot apply downsampling filters: %s", err)
+		}
+	}
+}
+
+// updateMetricIDDownsampling matches time series with metricIDs up to maxMetricID against downsamplingFilters.
+func (s *Storage) updateMetricIDDownsampling(maxMetricID uint64) error {
+	if len(downsamplingFilters) == 0 {
+		return nil
+	}
+	md := &metricIDDownsampling{
+		m:           make(map[uint64]int),
+		maxMetricID: maxMetricID,
+	}
+	idb := s.idb()
+	archivedIDBs := s.getArchivedIndexDBs(0)
+	defer putArchivedIndexDBs(archivedIDBs)
+	for i := range downsamplingFilters {
+		df := &downsamplingFilters[i]
+		metricIDs, err := idb.searchAllMetricIDs(df.tfs)
+		if err != nil {
+			return fmt.Errorf("cannot search time series for downsampling filter %s: %s", df.tfs, err)
+		}
+		for _, db := range archivedIDBs {
+			archivedMetricIDs, err := db.searchAllMetricIDs(df.tfs)
+			if err != nil {
+				return fmt.Errorf("cannot search time series for downsampling filter %s in archived indexdb %q: %s", df.tfs, db.name, err)
+			}
+			metricIDs = append(metricIDs, archivedMetricIDs...)
+		}
+		for _, metricID := range metricIDs {
+			if _, ok := md.m[metricID]; ok {
+				// The time series already matches the previous filter.
+				continue
+			}
+			md.m[metricID] = i
+		}
+	}
+	s.metricIDDownsampling.Store(md)
+	return nil
+}
+
+// needsDownsampling returns true if p contains blocks, which must be downsampled according to md at the given time now.
+//
+// Blocks containing samples, which are too fresh for downsampling, are ignored,
+// since they are downsampled by background merges or by the next call when all their samples become old enough.
+func (p *part) needsDownsampling(md *metricIDDownsampling, now int64) (bool, error) {
+	minOffsetMsecs := getMinDownsamplingOffsetMsecs()
+	if p.ph.MinTimestamp > now-minOffsetMsecs {
+		// Fast path - the part contains only fresh rows.
+		return false, nil
+	}
+	var compressedIndexBuf, indexBuf []byte
+	var bhs []blockHeader
+	for i := range p.metaindex {
+		mr := &p.metaindex[i]
+		if mr.MinTimestamp > now-minOffsetMsecs {
+			continue
+		}
+		compressedIndexBuf = bytesutil.Resize(compressedIndexBuf[:0], int(mr.IndexBlockSize))
+		p.indexFile.ReadAt(compressedIndexBuf, int64(mr.IndexBlockOffset))
+		var err error
+		indexBuf, err = encoding.DecompressZSTD(indexBuf[:0], compressedIndexBuf)
+		if err != nil {
+			return false, fmt.Errorf("cannot decompress index block in the part %q: %s", p, err)
+		}
+		bhs, err = unmarshalBlockHeaders(bhs[:0], indexBuf, int(mr.BlockHeadersCount))
+		if err != nil {
+			return false, fmt.Errorf("cannot unmarshal index block in the part %q: %s", p, err)
+		}
+		for j := range bhs {
+			bh := &bhs[j]
+			if bh.RowsCount < 2 {
+				continue
+			}
+			dps := md.getPeriods(bh.TSID.MetricID)
+			if n := maxDownsampledRows(dps, bh.MinTimestamp, bh.MaxTimestamp, now); n >= 0 && int64(bh.RowsCount) > n {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// getMinDownsamplingOffsetMsecs returns the minimum offset among all the downsampling periods.
+func getMinDownsamplingOffsetMsecs() int64 {
+	n := int64(math.MaxInt64)
+	if len(downsamplingPeriods) > 0 {
+		n = downsamplingPeriods[0].offsetMsecs
+	}
+	for i := range downsamplingFilters {
+		dps := downsamplingFilters[i].periods
+		if dps[0].offsetMsecs < n {
+			n = dps[0].offsetMsecs
+		}
+	}
+	return n
+}
+
+// mergeDownsampledParts merges parts with samples, which must be downsampled,
+// so old partitions without background merges are downsampled too.
+//
+// Parts without samples for downsampling aren't rewritten.
+func (tb *table) mergeDownsampledParts(stopCh <-chan struct{}) error {
+	md := tb.getMetricIDDownsampling()
+	now := timestampFromTime(time.Now())
+	ptws := tb.GetPartitions(nil)
+	defer tb.PutPartitions(ptws)
+	for _, ptw := range ptws {
+		if err := ptw.pt.mergeDownsampledParts(md, now, stopCh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pt *partition) mergeDownsampledParts(md *metricIDDownsampling, now int64, stopCh <-chan struct{}) error {
+	pws := pt.GetParts(nil)
+	defer pt.PutParts(pws)
+	for _, pw := range pws {
+		ok, err := pw.p.needsDownsampling(md, now)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		// Rewrite the part if it isn't merged right now.
+		pt.partsLock.Lock()
+		canMerge := !pw.isInMerge && pt.hasPartNolock(pw)
+		if canMerge {
+			pw.isInMerge = true
+		}
+		pt.partsLock.Unlock()
+		if !canMerge {
+			// The part is already merged, so it is downsampled by the merge.
+			continue
+		}
+		if err := pt.mergeParts([]*partWrapper{pw}, stopCh); err != nil {
+			if err == errForciblyStopped {
+				return nil
+			}
+			return fmt.Errorf("cannot downsample the part %q: %s", pw.p, err)
+		}
+	}
+	return nil
+}
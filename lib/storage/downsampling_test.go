@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+)
+
+func TestSetDownsamplingPeriodsFailure(t *testing.T) {
+	f := func(periods []DownsamplingPeriod, aggr string) {
+		t.Helper()
+		if err := SetDownsamplingPeriods(periods, aggr); err == nil {
+			t.Fatalf("expecting non-nil error for periods=%v, aggr=%q", periods, aggr)
+		}
+	}
+	day := 24 * time.Hour
+
+	// Unsupported aggregate
+	f(nil, "")
+	f(nil, "foobar")
+
+	// Non-positive offset or interval
+	f([]DownsamplingPeriod{{Offset: 0, Interval: time.Minute}}, "last")
+	f([]DownsamplingPeriod{{Offset: day, Interval: 0}}, "last")
+	f([]DownsamplingPeriod{{Offset: -day, Interval: time.Minute}}, "last")
+
+	// Duplicate offsets
+	f([]DownsamplingPeriod{{Offset: day, Interval: time.Minute}, {Offset: day, Interval: time.Hour}}, "last")
+
+	// The interval for bigger offset must be bigger than and multiple of the interval for smaller offset
+	f([]DownsamplingPeriod{{Offset: day, Interval: time.Hour}, {Offset: 30 * day, Interval: time.Minute}}, "last")
+	f([]DownsamplingPeriod{{Offset: day, Interval: time.Hour}, {Offset: 30 * day, Interval: time.Hour}}, "last")
+	f([]DownsamplingPeriod{{Offset: day, Interval: 2 * time.Minute}, {Offset: 30 * day, Interval: 3 * time.Minute}}, "last")
+
+	// Invalid periods for series selectors
+	jobFilters := []TagFilter{{Key: []byte("job"), Value: []byte("foo")}}
+	f([]DownsamplingPeriod{{TagFilters: jobFilters, Offset: day, Interval: time.Hour}, {TagFilters: jobFilters, Offset: 30 * day, Interval: time.Minute}}, "last")
+	f([]DownsamplingPeriod{{TagFilters: jobFilters, Offset: day, Interval: time.Minute}, {TagFilters: jobFilters, Offset: day, Interval: time.Hour}}, "last")
+}
+
+func TestSetDownsamplingPeriodsFilters(t *testing.T) {
+	defer func() {
+		if err := SetDownsamplingPeriods(nil, "last"); err != nil {
+			t.Fatalf("cannot reset downsampling periods: %s", err)
+		}
+	}()
+	day := 24 * time.Hour
+	fooFilters := []TagFilter{{Key: []byte("job"), Value: []byte("foo")}}
+	barFilters := []TagFilter{{Key: []byte("job"), Value: []byte("bar")}}
+	periods := []DownsamplingPeriod{
+		{TagFilters: fooFilters, Offset: 30 * day, Interval: time.Hour},
+		{Offset: day, Interval: time.Hour},
+		{TagFilters: barFilters, Offset: day, Interval: time.Minute},
+		{TagFilters: fooFilters, Offset: day, Interval: time.Minute},
+	}
+	if err := SetDownsamplingPeriods(periods, "last"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dpsExpected := []downsamplingPeriod{{offsetMsecs: 24 * 3600 * 1e3, intervalMsecs: 3600 * 1e3}}
+	if !reflect.DeepEqual(downsamplingPeriods, dpsExpected) {
+		t.Fatalf("unexpected periods for time series without filters;\ngot\n%v\nwant\n%v", downsamplingPeriods, dpsExpected)
+	}
+	if len(downsamplingFilters) != 2 {
+		t.Fatalf("unexpected number of downsampling filters; got %d; want 2", len(downsamplingFilters))
+	}
+	fooExpected := []downsamplingPeriod{
+		{offsetMsecs: 24 * 3600 * 1e3, intervalMsecs: 60 * 1e3},
+		{offsetMsecs: 30 * 24 * 3600 * 1e3, intervalMsecs: 3600 * 1e3},
+	}
+	if !reflect.DeepEqual(downsamplingFilters[0].periods, fooExpected) {
+		t.Fatalf("unexpected periods for the first filter;\ngot\n%v\nwant\n%v", downsamplingFilters[0].periods, fooExpected)
+	}
+	barExpected := []downsamplingPeriod{{offsetMsecs: 24 * 3600 * 1e3, intervalMsecs: 60 * 1e3}}
+	if !reflect.DeepEqual(downsamplingFilters[1].periods, barExpected) {
+		t.Fatalf("unexpected periods for the second filter;\ngot\n%v\nwant\n%v", downsamplingFilters[1].periods, barExpected)
+	}
+
+	// Time series are downsampled according to the first matching filter.
+	md := &metricIDDownsampling{
+		m: map[uint64]int{
+			1: 0,
+			2: 1,
+		},
+		maxMetricID: 3,
+	}
+	if dps := md.getPeriods(1); !reflect.DeepEqual(dps, fooExpected) {
+		t.Fatalf("unexpected periods for metricID=1; got %v; want %v", dps, fooExpected)
+	}
+	if dps := md.getPeriods(2); !reflect.DeepEqual(dps, barExpected) {
+		t.Fatalf("unexpected periods for metricID=2; got %v; want %v", dps, barExpected)
+	}
+	if dps := md.getPeriods(3); !reflect.DeepEqual(dps, dpsExpected) {
+		t.Fatalf("unexpected periods for metricID=3; got %v; want %v", dps, dpsExpected)
+	}
+
+	// Time series, which weren't matched against filters yet, aren't downsampled.
+	if dps := md.getPeriods(4); len(dps) != 0 {
+		t.Fatalf("unexpected periods for metricID=4; got %v; want no periods", dps)
+	}
+	var mdNil *metricIDDownsampling
+	if dps := mdNil.getPeriods(3); len(dps) != 0 {
+		t.Fatalf("unexpected periods for metricID=3 before matching; got %v; want no periods", dps)
+	}
+}
+
+func TestMaxDownsampledRows(t *testing.T) {
+	now := int64(1000e3)
+	dps := []downsamplingPeriod{
+		{offsetMsecs: 100e3, intervalMsecs: 10},
+		{offsetMsecs: 500e3, intervalMsecs: 100},
+	}
+	f := func(minTimestamp, maxTimestamp, nExpected int64) {
+		t.Helper()
+		n := maxDownsampledRows(dps, minTimestamp, maxTimestamp, now)
+		if n != nExpected {
+			t.Fatalf("unexpected maxDownsampledRows(%d, %d); got %d; want %d", minTimestamp, maxTimestamp, n, nExpected)
+		}
+	}
+
+	// Samples, which are too fresh for downsampling
+	f(900e3, 950e3, -1)
+	f(0, 950e3, -1)
+
+	// A single tier
+	f(600e3, 600e3+99, 10)
+	f(0, 99, 1)
+	f(0, 100, 2)
+
+	// Stacked tiers
+	f(500e3-100, 500e3+99, 2+10)
+}
+
+func TestDownsampleSamples(t *testing.T) {
+	// Intervals and offsets are in milliseconds.
+	now := int64(1000e3)
+	f := func(periods []DownsamplingPeriod, aggr string, timestamps, values, timestampsExpected, valuesExpected []int64) {
+		t.Helper()
+		if err := SetDownsamplingPeriods(periods, aggr); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer func() {
+			if err := SetDownsamplingPeriods(nil, "last"); err != nil {
+				t.Fatalf("cannot reset downsampling periods: %s", err)
+			}
+		}()
+
+		timestampsCopy := append([]int64{}, timestamps...)
+		valuesCopy := append([]int64{}, values...)
+		resultTimestamps, resultValues := downsampleSamples(downsamplingPeriods, timestampsCopy, valuesCopy, now, downsamplingAggr)
+		if !reflect.DeepEqual(resultTimestamps, timestampsExpected) {
+			t.Fatalf("unexpected timestamps for downsampleSamples(%v);\ngot\n%v\nwant\n%v", timestamps, resultTimestamps, timestampsExpected)
+		}
+		if !reflect.DeepEqual(resultValues, valuesExpected) {
+			t.Fatalf("unexpected values for downsampleSamples(%v);\ngot\n%v\nwant\n%v", values, resultValues, valuesExpected)
+		}
+
+		// Repeated downsampling must leave the samples unchanged.
+		resultTimestamps, resultValues = downsampleSamples(downsamplingPeriods, resultTimestamps, resultValues, now, downsamplingAggr)
+		if !reflect.DeepEqual(resultTimestamps, timestampsExpected) {
+			t.Fatalf("unexpected timestamps for repeated downsampleSamples(%v);\ngot\n%v\nwant\n%v", timestamps, resultTimestamps, timestampsExpected)
+		}
+		if !reflect.DeepEqual(resultValues, valuesExpected) {
+			t.Fatalf("unexpected values for repeated downsampleSamples(%v);\ngot\n%v\nwant\n%v", values, resultValues, valuesExpected)
+		}
+	}
+	ms := time.Millisecond
+
+	// Disabled downsampling
+	f(nil, "last", []int64{1, 2, 3}, []int64{4, 5, 6}, []int64{1, 2, 3}, []int64{4, 5, 6})
+
+	// All the samples are too fresh
+	periods := []DownsamplingPeriod{{Offset: 100e3 * ms, Interval: 10 * ms}}
+	f(periods, "last", []int64{950e3, 950e3 + 1, 950e3 + 2}, []int64{1, 2, 3}, []int64{950e3, 950e3 + 1, 950e3 + 2}, []int64{1, 2, 3})
+
+	// A single tier
+	timestamps := []int64{1, 5, 9, 10, 15, 31, 950e3, 950e3 + 1}
+	values := []int64{1, 7, 3, 4, 5, 6, 7, 8}
+	f(periods, "last", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{3, 5, 6, 7, 8})
+	f(periods, "min", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{1, 4, 6, 7, 8})
+	f(periods, "max", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{7, 5, 6, 7, 8})
+	f(periods, "sum", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{11, 9, 6, 7, 8})
+
+	// Staleness marks are ignored by min, max and sum, unless the interval contains only staleness marks
+	staleNaN, _ := decimal.FromFloat(decimal.StaleNaN)
+	values = []int64{1, staleNaN, 3, staleNaN, 5, staleNaN, 7, 8}
+	f(periods, "last", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{3, 5, staleNaN, 7, 8})
+	f(periods, "min", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{1, 5, staleNaN, 7, 8})
+	f(periods, "max", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{3, 5, staleNaN, 7, 8})
+	f(periods, "sum", timestamps, values, []int64{9, 15, 31, 950e3, 950e3 + 1}, []int64{4, 5, staleNaN, 7, 8})
+
+	// Stacked tiers
+	periods = []DownsamplingPeriod{
+		{Offset: 100e3 * ms, Interval: 10 * ms},
+		{Offset: 500e3 * ms, Interval: 100 * ms},
+	}
+	timestamps = []int64{10, 20, 150, 199, 500e3 + 1, 500e3 + 5, 500e3 + 11, 950e3, 950e3 + 1}
+	values = []int64{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	f(periods, "last", timestamps, values, []int64{20, 199, 500e3 + 5, 500e3 + 11, 950e3, 950e3 + 1}, []int64{2, 4, 6, 7, 8, 9})
+
+	// The interval mustn't be shared by samples from distinct tiers
+	timestamps = []int64{500e3 - 2, 500e3 - 1, 500e3, 500e3 + 1}
+	values = []int64{1, 2, 3, 4}
+	f(periods, "last", timestamps, values, []int64{500e3 - 1, 500e3, 500e3 + 1}, []int64{2, 3, 4})
+}
+
+func TestDownsamplingExactAggrFuncsStaleNaN(t *testing.T) {
+	f := func(aggr string, values []float64, resultExpected float64) {
+		t.Helper()
+		exactValues := decimal.AppendFloatToExact(nil, values)
+		v := downsamplingExactAggrFuncs[aggr](exactValues)
+		result := math.Float64frombits(uint64(v))
+		if decimal.IsStaleNaN(resultExpected) {
+			if !decimal.IsStaleNaN(result) {
+				t.Fatalf("unexpected result for %s(%v); got %v; want staleness mark", aggr, values, result)
+			}
+			return
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %s(%v); got %v; want %v", aggr, values, result, resultExpected)
+		}
+	}
+	stale := decimal.StaleNaN
+
+	f("min", []float64{1.5, stale, 0.5}, 0.5)
+	f("max", []float64{stale, 1.5, 0.5}, 1.5)
+	f("sum", []float64{1.5, stale, 0.5, stale}, 2)
+	f("last", []float64{1.5, 0.5, stale}, stale)
+
+	// Intervals with only staleness marks keep the mark
+	f("min", []float64{stale, stale}, stale)
+	f("max", []float64{stale}, stale)
+	f("sum", []float64{stale, stale}, stale)
+}
+
+func TestBlockDownsampleSamplesDuringMerge(t *testing.T) {
+	if err := SetDownsamplingPeriods([]DownsamplingPeriod{{Offset: time.Hour, Interval: time.Minute}}, "last"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() {
+		if err := SetDownsamplingPeriods(nil, "last"); err != nil {
+			t.Fatalf("cannot reset downsampling periods: %s", err)
+		}
+	}()
+
+	now := timestampFromTime(time.Now())
+	startTimestamp := now - 2*3600*1e3
+	startTimestamp -= startTimestamp % (60 * 1e3)
+	var timestamps, values []int64
+	for i := 0; i < 10; i++ {
+		// Old samples with 10 seconds interval.
+		timestamps = append(timestamps, startTimestamp+int64(i)*10*1e3)
+		values = append(values, int64(i))
+	}
+	for i := 0; i < 3; i++ {
+		// Fresh samples with 10 seconds interval.
+		timestamps = append(timestamps, now-10*60*1e3+int64(i)*10*1e3)
+		values = append(values, int64(100+i))
+	}
+	timestampsExpected := []int64{startTimestamp + 50*1e3, startTimestamp + 90*1e3}
+	timestampsExpected = append(timestampsExpected, timestamps[10:]...)
+	valuesExpected := []int64{5, 9, 100, 101, 102}
+
+	var b Block
+	b.Init(&TSID{MetricID: 1}, timestamps, values, 0, 64)
+
+	// Marshal the block in order to verify that marshaled blocks are downsampled too.
+	b.MarshalData(0, 0)
+	b.downsampleSamplesDuringMerge(downsamplingPeriods, now)
+	if err := b.UnmarshalData(); err != nil {
+		t.Fatalf("cannot unmarshal block: %s", err)
+	}
+	if !reflect.DeepEqual(b.Timestamps(), timestampsExpected) {
+		t.Fatalf("unexpected timestamps;\ngot\n%v\nwant\n%v", b.Timestamps(), timestampsExpected)
+	}
+	if !reflect.DeepEqual(b.Values(), valuesExpected) {
+		t.Fatalf("unexpected values;\ngot\n%v\nwant\n%v", b.Values(), valuesExpected)
+	}
+
+	// Downsample the block again.
+	b.MarshalData(0, 0)
+	b.downsampleSamplesDuringMerge(downsamplingPeriods, now)
+	b.MarshalData(0, 0)
+	if err := b.UnmarshalData(); err != nil {
+		t.Fatalf("cannot unmarshal block: %s", err)
+	}
+	if !reflect.DeepEqual(b.Timestamps(), timestampsExpected) {
+		t.Fatalf("unexpected timestamps after repeated downsampling;\ngot\n%v\nwant\n%v", b.Timestamps(), timestampsExpected)
+	}
+	if !reflect.DeepEqual(b.Values(), valuesExpected) {
+		t.Fatalf("unexpected values after repeated downsampling;\ngot\n%v\nwant\n%v", b.Values(), valuesExpected)
+	}
+}
+
+func TestStorageDownsamplingFilters(t *testing.T) {
+	periods := []DownsamplingPeriod{
+		{
+			TagFilters: []TagFilter{{Key: []byte("job"), Value: []byte("fine")}},
+			Offset:     time.Hour,
+			Interval:   time.Minute,
+		},
+		{
+			Offset:   time.Hour,
+			Interval: 10 * time.Minute,
+		},
+	}
+	if err := SetDownsamplingPeriods(periods, "last"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() {
+		if err := SetDownsamplingPeriods(nil, "last"); err != nil {
+			t.Fatalf("cannot reset downsampling periods: %s", err)
+		}
+	}()
+
+	path := "TestStorageDownsamplingFilters"
+	s, err := OpenStorage(path, 1)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	defer func() {
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	// Add 20 minutes of samples with 10 seconds interval two hours ago.
+	startTimestamp := timestampFromTime(time.Now()) - 2*3600*1e3
+	startTimestamp -= startTimestamp % (10 * 60 * 1e3)
+	addRows := func(job string) {
+		t.Helper()
+		mn := MetricName{
+			MetricGroup: []byte("metric"),
+			Tags: []Tag{
+				{[]byte("job"), []byte(job)},
+			},
+		}
+		metricNameRaw := mn.marshalRaw(nil)
+		var mrs []MetricRow
+		for i := 0; i < 120; i++ {
+			mrs = append(mrs, MetricRow{
+				MetricNameRaw: metricNameRaw,
+				Timestamp:     startTimestamp + int64(i)*10*1e3,
+				Value:         float64(i),
+			})
+		}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding rows: %s", err)
+		}
+		s.DebugFlush()
+	}
+	searchRows := func(job string) int {
+		t.Helper()
+		tfs := NewTagFilters()
+		if err := tfs.Add([]byte("job"), []byte(job), false, false); err != nil {
+			t.Fatalf("cannot add job tag filter: %s", err)
+		}
+		tr := TimeRange{
+			MinTimestamp: startTimestamp,
+			MaxTimestamp: startTimestamp + 3600*1e3,
+		}
+		rows := 0
+		var sr Search
+		sr.Init(s, []*TagFilters{tfs}, tr, 1e5)
+		for sr.NextMetricBlock() {
+			rows += sr.MetricBlock.Block.RowsCount()
+		}
+		if err := sr.Error(); err != nil {
+			t.Fatalf("unexpected error in search: %s", err)
+		}
+		sr.MustClose()
+		return rows
+	}
+	countPartsForDownsampling := func() int {
+		t.Helper()
+		md := s.getMetricIDDownsampling()
+		now := timestampFromTime(time.Now())
+		n := 0
+		ptws := s.tb.GetPartitions(nil)
+		for _, ptw := range ptws {
+			pws := ptw.pt.GetParts(nil)
+			for _, pw := range pws {
+				ok, err := pw.p.needsDownsampling(md, now)
+				if err != nil {
+					t.Fatalf("cannot check whether the part %q needs downsampling: %s", pw.p, err)
+				}
+				if ok {
+					n++
+				}
+			}
+			ptw.pt.PutParts(pws)
+		}
+		s.tb.PutPartitions(ptws)
+		return n
+	}
+	downsampleParts := func() {
+		t.Helper()
+		// Parts, which are merged by background merges started before the matching, are skipped
+		// and are downsampled on the next call.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if err := s.tb.mergeDownsampledParts(s.stop); err != nil {
+				t.Fatalf("cannot downsample parts: %s", err)
+			}
+			n := countPartsForDownsampling()
+			if n == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected number of parts for downsampling after the downsampling; got %d; want 0", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	addRows("fine")
+	addRows("coarse")
+	if err := s.updateMetricIDDownsampling(atomic.LoadUint64(&uniqueUint64)); err != nil {
+		t.Fatalf("cannot match time series against downsampling filters: %s", err)
+	}
+
+	// Time series created after the matching aren't downsampled until the next matching.
+	addRows("new")
+
+	// Parts without background merges are downsampled.
+	downsampleParts()
+	if n := searchRows("fine"); n != 20 {
+		t.Fatalf("unexpected number of rows for the time series matching the filter; got %d; want 20", n)
+	}
+	if n := searchRows("coarse"); n != 2 {
+		t.Fatalf("unexpected number of rows for the time series without matching filters; got %d; want 2", n)
+	}
+	if n := searchRows("new"); n != 120 {
+		t.Fatalf("unexpected number of rows for the time series created after the matching; got %d; want 120", n)
+	}
+
+	// The new time series is downsampled after the next matching.
+	if err := s.updateMetricIDDownsampling(atomic.LoadUint64(&uniqueUint64)); err != nil {
+		t.Fatalf("cannot match time series against downsampling filters: %s", err)
+	}
+	downsampleParts()
+	if n := searchRows("new"); n != 2 {
+		t.Fatalf("unexpected number of rows for the new time series after the matching; got %d; want 2", n)
+	}
+	if n := searchRows("fine"); n != 20 {
+		t.Fatalf("unexpected number of rows for the time series matching the filter after repeated downsampling; got %d; want 20", n)
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+)
+
+// SetExactValuesMetricNameRegexp sets the regexp for metric names, which values must be stored without precision loss.
+//
+// Values for the matching metrics are stored as raw float64 bits instead of decimal values,
+// so they are read back bit-for-bit at the cost of higher disk space usage.
+// The regexp is anchored to the whole metric name. Empty expr disables exact values.
+//
+// This function must be called before initializing the storage.
+func SetExactValuesMetricNameRegexp(expr string) error {
+	if expr == "" {
+		exactValuesMetricNameRe = nil
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fmt.Errorf("cannot compile regexp %q: %s", expr, err)
+	}
+	exactValuesMetricNameRe = re
+	resetExactValuesCache()
+	return nil
+}
+
+var exactValuesMetricNameRe *regexp.Regexp
+
+// isExactValuesMetric returns true if values for metricNameRaw must be stored as raw float64 bits.
+func isExactValuesMetric(metricNameRaw []byte) bool {
+	re := exactValuesMetricNameRe
+	if re == nil {
+		// Fast path - exact values are disabled.
+		return false
+	}
+	metricGroup := getMetricGroupFromRaw(metricNameRaw)
+	if v, ok := exactValuesCache.Load(bytesutil.ToUnsafeString(metricGroup)); ok {
+		return v.(bool)
+	}
+	ok := re.Match(metricGroup)
+	if atomic.AddUint64(&exactValuesCacheSize, 1) > maxExactValuesCacheSize {
+		resetExactValuesCache()
+	}
+	exactValuesCache.Store(string(metricGroup), ok)
+	return ok
+}
+
+// getMetricGroupFromRaw returns metric name from metricNameRaw without memory allocations.
+//
+// nil is returned for malformed metricNameRaw.
+func getMetricGroupFromRaw(metricNameRaw []byte) []byte {
+	src := metricNameRaw
+	for len(src) > 0 {
+		tail, key, err := unmarshalBytesFast(src)
+		if err != nil {
+			return nil
+		}
+		tail, value, err := unmarshalBytesFast(tail)
+		if err != nil {
+			return nil
+		}
+		if len(key) == 0 {
+			return value
+		}
+		src = tail
+	}
+	return nil
+}
+
+func resetExactValuesCache() {
+	exactValuesCache.Range(func(k, v interface{}) bool {
+		exactValuesCache.Delete(k)
+		return true
+	})
+	atomic.StoreUint64(&exactValuesCacheSize, 0)
+}
+
+// maxExactValuesCacheSize limits the number of cached metric names in order to limit memory usage.
+const maxExactValuesCacheSize = 100e3
+
+var (
+	exactValuesCache     sync.Map
+	exactValuesCacheSize uint64
+)
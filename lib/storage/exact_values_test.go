@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+var exactTestValues = []float64{12345.67, 0.1 + 0.2, 1e-300, math.Pi, -9007199254740993.25, 0.07, 1.1e15, -0.01}
+
+func TestIsExactValuesMetric(t *testing.T) {
+	if err := SetExactValuesMetricNameRegexp("billing_.+|cost"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() {
+		_ = SetExactValuesMetricNameRegexp("")
+	}()
+
+	f := func(metricGroup string, resultExpected bool) {
+		t.Helper()
+		labels := []prompb.Label{
+			{Name: []byte("job"), Value: []byte("foo")},
+			{Name: []byte("__name__"), Value: []byte(metricGroup)},
+		}
+		metricNameRaw := MarshalMetricNameRaw(nil, labels)
+		for i := 0; i < 2; i++ {
+			// The second call must return the cached result.
+			result := isExactValuesMetric(metricNameRaw)
+			if result != resultExpected {
+				t.Fatalf("unexpected isExactValuesMetric(%q); got %v; want %v", metricGroup, result, resultExpected)
+			}
+		}
+	}
+	f("billing_total", true)
+	f("cost", true)
+	f("billing_", false)
+	f("costs", false)
+	f("node_billing_total", false)
+	f("", false)
+}
+
+func TestSetExactValuesMetricNameRegexpInvalid(t *testing.T) {
+	if err := SetExactValuesMetricNameRegexp("foo("); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if exactValuesMetricNameRe != nil {
+		t.Fatalf("exact values must remain disabled after invalid regexp")
+	}
+}
+
+func TestMergeBlockStreamsExactValues(t *testing.T) {
+	var tsid TSID
+	initTestTSID(&tsid)
+	valuesExpected := make(map[int64]float64)
+	var exactRows, decimalRows []rawRow
+	for i, v := range exactTestValues {
+		ts := int64(i * 2)
+		exactRows = append(exactRows, rawRow{
+			TSID:          tsid,
+			Timestamp:     ts,
+			Value:         v,
+			PrecisionBits: 4,
+			ExactValue:    true,
+		})
+		valuesExpected[ts] = v
+		ts++
+		decimalRows = append(decimalRows, rawRow{
+			TSID:          tsid,
+			Timestamp:     ts,
+			Value:         float64(i),
+			PrecisionBits: 4,
+		})
+		valuesExpected[ts] = float64(i)
+	}
+	bsrs := []*blockStreamReader{
+		newTestBlockStreamReader(t, exactRows),
+		newTestBlockStreamReader(t, decimalRows),
+	}
+
+	var mp inmemoryPart
+	var bsw blockStreamWriter
+	bsw.InitFromInmemoryPart(&mp)
+	var rowsMerged, rowsDeleted uint64
+	if err := mergeBlockStreams(&mp.ph, &bsw, bsrs, nil, &rowsMerged, nil, nil, nil, &rowsDeleted); err != nil {
+		t.Fatalf("unexpected error in mergeBlockStreams: %s", err)
+	}
+
+	var bsr blockStreamReader
+	bsr.InitFromInmemoryPart(&mp)
+	rowsCount := 0
+	for bsr.NextBlock() {
+		b := &bsr.Block
+		if b.bh.Scale != decimal.ExactScale {
+			t.Fatalf("unexpected scale for the merged block; got %d; want %d", b.bh.Scale, decimal.ExactScale)
+		}
+		if err := b.UnmarshalData(); err != nil {
+			t.Fatalf("cannot unmarshal block: %s", err)
+		}
+		values := decimal.AppendDecimalToFloat(nil, b.values, b.bh.Scale)
+		for i, ts := range b.timestamps {
+			if math.Float64bits(values[i]) != math.Float64bits(valuesExpected[ts]) {
+				t.Fatalf("unexpected value at timestamp %d; got %v; want %v", ts, values[i], valuesExpected[ts])
+			}
+		}
+		rowsCount += len(b.timestamps)
+	}
+	if err := bsr.Error(); err != nil {
+		t.Fatalf("unexpected error when reading merged blocks: %s", err)
+	}
+	if rowsCount != len(valuesExpected) {
+		t.Fatalf("unexpected number of merged rows; got %d; want %d", rowsCount, len(valuesExpected))
+	}
+}
+
+func TestStorageExactValues(t *testing.T) {
+	if err := SetExactValuesMetricNameRegexp("billing_total"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() {
+		_ = SetExactValuesMetricNameRegexp("")
+	}()
+
+	path := "TestStorageExactValues"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	now := timestampFromTime(time.Now())
+	for i, v := range exactTestValues {
+		// Flush every sample into a separate part, so the values are read back from multiple parts.
+		var mrs []MetricRow
+		for _, metricGroup := range []string{"billing_total", "metric"} {
+			labels := []prompb.Label{
+				{Name: []byte("__name__"), Value: []byte(metricGroup)},
+			}
+			mrs = append(mrs, MetricRow{
+				MetricNameRaw: MarshalMetricNameRaw(nil, labels),
+				Timestamp:     now - int64(len(exactTestValues)-i)*1000,
+				Value:         v,
+			})
+		}
+		if err := s.AddRows(mrs, 4); err != nil {
+			t.Fatalf("unexpected error when adding mrs: %s", err)
+		}
+		s.DebugFlush()
+	}
+
+	values, err := getValuesByMetricGroup(s, "billing_total")
+	if err != nil {
+		t.Fatalf("cannot obtain values: %s", err)
+	}
+	if len(values) != len(exactTestValues) {
+		t.Fatalf("unexpected number of values; got %d; want %d", len(values), len(exactTestValues))
+	}
+	for i, v := range exactTestValues {
+		ts := now - int64(len(exactTestValues)-i)*1000
+		if math.Float64bits(values[ts]) != math.Float64bits(v) {
+			t.Fatalf("unexpected value at timestamp %d; got %v; want %v", ts, values[ts], v)
+		}
+	}
+
+	// Values for metrics not matching the regexp are stored with the given precisionBits.
+	values, err = getValuesByMetricGroup(s, "metric")
+	if err != nil {
+		t.Fatalf("cannot obtain values: %s", err)
+	}
+	if len(values) != len(exactTestValues) {
+		t.Fatalf("unexpected number of values; got %d; want %d", len(values), len(exactTestValues))
+	}
+	lossy := false
+	for i, v := range exactTestValues {
+		ts := now - int64(len(exactTestValues)-i)*1000
+		if values[ts] != v {
+			lossy = true
+		}
+	}
+	if !lossy {
+		t.Fatalf("expecting precision loss for values stored with 4 precision bits; got %v", values)
+	}
+
+	s.MustClose()
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
+
+func getValuesByMetricGroup(s *Storage, metricGroup string) (map[int64]float64, error) {
+	tfs := NewTagFilters()
+	if err := tfs.Add(nil, []byte(metricGroup), false, false); err != nil {
+		return nil, fmt.Errorf("cannot add tag filter: %s", err)
+	}
+	tr := TimeRange{
+		MinTimestamp: 0,
+		MaxTimestamp: timestampFromTime(time.Now()),
+	}
+	var sr Search
+	sr.Init(s, []*TagFilters{tfs}, tr, 1e5)
+	defer sr.MustClose()
+	m := make(map[int64]float64)
+	var values []float64
+	for sr.NextMetricBlock() {
+		b := sr.MetricBlock.Block
+		if err := b.UnmarshalData(); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal block: %s", err)
+		}
+		values = decimal.AppendDecimalToFloat(values[:0], b.Values(), b.Scale())
+		for i, ts := range b.Timestamps() {
+			m[ts] = values[i]
+		}
+	}
+	if err := sr.Error(); err != nil {
+		return nil, fmt.Errorf("search error: %s", err)
+	}
+	return m, nil
+}
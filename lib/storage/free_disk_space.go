@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+// SetMinFreeDiskSpaceBytes sets the minimum free disk space at the storage path.
+//
+// The storage switches to read-only mode when the free disk space drops below n bytes,
+// so AddRows returns ErrReadOnly. Writes are resumed automatically when the free disk space
+// becomes bigger than n. Searches and background merges continue working in read-only mode.
+//
+// Read-only mode is disabled if n is 0.
+//
+// This function must be called before initializing the storage.
+func SetMinFreeDiskSpaceBytes(n int64) {
+	minFreeDiskSpaceBytes = n
+}
+
+var minFreeDiskSpaceBytes = int64(0)
+
+// ErrReadOnly is returned from Storage.AddRows when the storage is in read-only mode.
+var ErrReadOnly = errors.New("the storage is in read-only mode, since free disk space is below -storage.minFreeDiskSpaceBytes; " +
+	"free up disk space or add more disk space in order to resume writes")
+
+// freeDiskSpaceCheckInterval is the interval between free disk space checks.
+//
+// Free disk space is checked periodically instead of per each AddRows call, since the check requires a syscall.
+var freeDiskSpaceCheckInterval = time.Second
+
+// IsReadOnly returns true if s is in read-only mode because of low free disk space.
+func (s *Storage) IsReadOnly() bool {
+	return atomic.LoadUint32(&s.isReadOnly) == 1
+}
+
+func (s *Storage) startFreeDiskSpaceWatcher() {
+	if minFreeDiskSpaceBytes <= 0 {
+		return
+	}
+	s.checkFreeDiskSpace()
+	s.freeDiskSpaceWatcherWG.Add(1)
+	go func() {
+		s.freeDiskSpaceWatcher()
+		s.freeDiskSpaceWatcherWG.Done()
+	}()
+}
+
+func (s *Storage) freeDiskSpaceWatcher() {
+	t := time.NewTicker(freeDiskSpaceCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.checkFreeDiskSpace()
+		}
+	}
+}
+
+// checkFreeDiskSpace switches s to read-only mode if the free disk space at s.path is below minFreeDiskSpaceBytes
+// and switches it back to read-write mode when the free disk space is recovered.
+func (s *Storage) checkFreeDiskSpace() {
+	freeSpace := mustGetFreeDiskSpace(s.path)
+	if freeSpace < uint64(minFreeDiskSpaceBytes) {
+		if atomic.CompareAndSwapUint32(&s.isReadOnly, 0, 1) {
+			logger.Errorf("switching the storage at %q to read-only mode, since free disk space is %d bytes, which is below -storage.minFreeDiskSpaceBytes=%d",
+				s.path, freeSpace, minFreeDiskSpaceBytes)
+		}
+		return
+	}
+	if atomic.CompareAndSwapUint32(&s.isReadOnly, 1, 0) {
+		logger.Infof("resuming writes to the storage at %q, since free disk space is %d bytes, which exceeds -storage.minFreeDiskSpaceBytes=%d",
+			s.path, freeSpace, minFreeDiskSpaceBytes)
+	}
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorageMinFreeDiskSpace(t *testing.T) {
+	// Free disk space can never reach math.MaxInt64 bytes, so the storage must start in read-only mode.
+	SetMinFreeDiskSpaceBytes(math.MaxInt64)
+	defer SetMinFreeDiskSpaceBytes(0)
+
+	path := "TestStorageMinFreeDiskSpace"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	defer func() {
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	var mn MetricName
+	mn.MetricGroup = []byte("metric")
+	mrs := []MetricRow{{
+		MetricNameRaw: mn.marshalRaw(nil),
+		Timestamp:     timestampFromTime(time.Now()),
+		Value:         123,
+	}}
+	if !s.IsReadOnly() {
+		t.Fatalf("expecting read-only storage when free disk space is below the limit")
+	}
+	if err := s.AddRows(mrs, defaultPrecisionBits); err != ErrReadOnly {
+		t.Fatalf("unexpected error when adding rows to read-only storage; got %v; want %v", err, ErrReadOnly)
+	}
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if m.IsReadOnly != 1 {
+		t.Fatalf("unexpected IsReadOnly metric; got %d; want 1", m.IsReadOnly)
+	}
+
+	// Writes must be resumed when free disk space is recovered.
+	SetMinFreeDiskSpaceBytes(1)
+	s.checkFreeDiskSpace()
+	if s.IsReadOnly() {
+		t.Fatalf("expecting writable storage when free disk space exceeds the limit")
+	}
+	if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+		t.Fatalf("unexpected error when adding rows to writable storage: %s", err)
+	}
+	m.Reset()
+	s.UpdateMetrics(&m)
+	if m.IsReadOnly != 0 {
+		t.Fatalf("unexpected IsReadOnly metric; got %d; want 0", m.IsReadOnly)
+	}
+}
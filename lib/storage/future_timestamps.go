@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetMaxFutureSampleTimestamp sets the maximum duration sample timestamps may be ahead of the current time.
+//
+// Samples with timestamps exceeding the current time plus d are dropped if clamp is false.
+// Otherwise their timestamps are set to the current time plus d.
+// Samples are accepted regardless of their timestamps if d is 0.
+//
+// This function must be called before initializing the storage.
+func SetMaxFutureSampleTimestamp(d time.Duration, clamp bool) {
+	maxFutureSampleTimestamp = d.Nanoseconds() / 1e6
+	clampFutureSampleTimestamps = clamp
+}
+
+var (
+	maxFutureSampleTimestamp    = int64(0)
+	clampFutureSampleTimestamps = false
+)
+
+// getMaxSampleTimestamp returns the maximum allowed sample timestamp in milliseconds for the current time.
+//
+// It returns 0 if sample timestamps aren't limited.
+func getMaxSampleTimestamp() int64 {
+	if maxFutureSampleTimestamp <= 0 {
+		return 0
+	}
+	return timestampFromTime(time.Now()) + maxFutureSampleTimestamp
+}
+
+// adjustFutureTimestamp applies the limit set via SetMaxFutureSampleTimestamp to the timestamp
+// of the sample given maxTimestamp obtained from getMaxSampleTimestamp.
+//
+// false is returned if the sample must be dropped.
+func (s *Storage) adjustFutureTimestamp(timestamp *int64, maxTimestamp int64) bool {
+	if maxTimestamp <= 0 || *timestamp <= maxTimestamp {
+		return true
+	}
+	if clampFutureSampleTimestamps {
+		atomic.AddUint64(&s.futureTimestampRowsClamped, 1)
+		*timestamp = maxTimestamp
+		return true
+	}
+	atomic.AddUint64(&s.futureTimestampRowsDropped, 1)
+	return false
+}
+
+func (s *Storage) updateFutureTimestampMetrics(m *Metrics) {
+	m.FutureTimestampRowsDropped += atomic.LoadUint64(&s.futureTimestampRowsDropped)
+	m.FutureTimestampRowsClamped += atomic.LoadUint64(&s.futureTimestampRowsClamped)
+}
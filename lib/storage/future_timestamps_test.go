@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorageMaxFutureSampleTimestamp(t *testing.T) {
+	f := func(d time.Duration, clamp bool, timestampsExpected map[string][]int64, droppedExpected, clampedExpected uint64) {
+		t.Helper()
+		SetMaxFutureSampleTimestamp(d, clamp)
+		defer SetMaxFutureSampleTimestamp(0, false)
+
+		path := "TestStorageMaxFutureSampleTimestamp"
+		s, err := OpenStorage(path, 0)
+		if err != nil {
+			t.Fatalf("cannot open storage: %s", err)
+		}
+		var mrs []MetricRow
+		var mn MetricName
+		mn.MetricGroup = []byte("metric")
+		for job, timestamp := range testFutureTimestamps {
+			mn.Tags = []Tag{{[]byte("job"), []byte(job)}}
+			mrs = append(mrs, MetricRow{
+				MetricNameRaw: mn.marshalRaw(nil),
+				Timestamp:     timestamp,
+				Value:         1,
+			})
+		}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding mrs: %s", err)
+		}
+		s.DebugFlush()
+
+		tr := TimeRange{
+			MinTimestamp: 0,
+			MaxTimestamp: testFutureNow + 24*3600*1000,
+		}
+		timestamps, err := getTimestampsByJobOnTimeRange(s, tr)
+		if err != nil {
+			t.Fatalf("cannot obtain timestamps: %s", err)
+		}
+		if len(timestamps) != len(timestampsExpected) {
+			t.Fatalf("unexpected number of series; got %d; want %d; series: %v", len(timestamps), len(timestampsExpected), timestamps)
+		}
+		for job, tssExpected := range timestampsExpected {
+			tss := timestamps[job]
+			if len(tss) != len(tssExpected) {
+				t.Fatalf("unexpected number of samples for %q; got %d; want %d", job, len(tss), len(tssExpected))
+			}
+			for i, tsExpected := range tssExpected {
+				if tsExpected < 0 {
+					// The timestamp must be clamped to the current time plus d.
+					if tss[i] < testFutureNow+d.Milliseconds() || tss[i] > timestampFromTime(time.Now())+d.Milliseconds() {
+						t.Fatalf("unexpected clamped timestamp for %q; got %d", job, tss[i])
+					}
+					continue
+				}
+				if tss[i] != tsExpected {
+					t.Fatalf("unexpected timestamp for %q; got %d; want %d", job, tss[i], tsExpected)
+				}
+			}
+		}
+
+		var m Metrics
+		s.UpdateMetrics(&m)
+		if m.FutureTimestampRowsDropped != droppedExpected {
+			t.Fatalf("unexpected number of dropped rows; got %d; want %d", m.FutureTimestampRowsDropped, droppedExpected)
+		}
+		if m.FutureTimestampRowsClamped != clampedExpected {
+			t.Fatalf("unexpected number of clamped rows; got %d; want %d", m.FutureTimestampRowsClamped, clampedExpected)
+		}
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}
+
+	// The check is disabled
+	f(0, false, map[string][]int64{
+		"past":        {testFutureTimestamps["past"]},
+		"near_future": {testFutureTimestamps["near_future"]},
+		"far_future":  {testFutureTimestamps["far_future"]},
+	}, 0, 0)
+
+	// Drop samples too far in the future
+	f(10*time.Minute, false, map[string][]int64{
+		"past":        {testFutureTimestamps["past"]},
+		"near_future": {testFutureTimestamps["near_future"]},
+	}, 1, 0)
+
+	// Clamp samples too far in the future
+	f(10*time.Minute, true, map[string][]int64{
+		"past":        {testFutureTimestamps["past"]},
+		"near_future": {testFutureTimestamps["near_future"]},
+		"far_future":  {-1},
+	}, 0, 1)
+}
+
+var testFutureNow = timestampFromTime(time.Now())
+
+var testFutureTimestamps = map[string]int64{
+	"past":        testFutureNow - 3600*1000,
+	"near_future": testFutureNow + 5*60*1000,
+	"far_future":  testFutureNow + 3*3600*1000,
+}
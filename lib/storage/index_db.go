@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"container/heap"
 	"errors"
 	"fmt"
 	"io"
@@ -97,6 +98,13 @@ type indexDB struct {
 	// The number of successful searches for metric ids by days.
 	dateMetricIDsSearchHits uint64
 
+	// The number of searches containing only negative tag filters.
+	// Such searches cannot use tag filters for seeding the candidate metricIDs.
+	negativeOnlySearches uint64
+
+	// The number of candidate time series checked by searches with limit on the number of results.
+	limitedSeriesSearchCandidates uint64
+
 	mustDrop uint64
 }
 
@@ -162,6 +170,10 @@ type IndexDBMetrics struct {
 	DateMetricIDsSearchCalls       uint64
 	DateMetricIDsSearchHits        uint64
 
+	NegativeOnlySearches uint64
+
+	LimitedSeriesSearchCandidates uint64
+
 	mergeset.TableMetrics
 }
 
@@ -195,6 +207,8 @@ func (db *indexDB) UpdateMetrics(m *IndexDBMetrics) {
 	m.RecentHourMetricIDsSearchHits += atomic.LoadUint64(&db.recentHourMetricIDsSearchHits)
 	m.DateMetricIDsSearchCalls += atomic.LoadUint64(&db.dateMetricIDsSearchCalls)
 	m.DateMetricIDsSearchHits += atomic.LoadUint64(&db.dateMetricIDsSearchHits)
+	m.NegativeOnlySearches += atomic.LoadUint64(&db.negativeOnlySearches)
+	m.LimitedSeriesSearchCandidates += atomic.LoadUint64(&db.limitedSeriesSearchCandidates)
 
 	db.tb.UpdateMetrics(&m.TableMetrics)
 	db.doExtDB(func(extDB *indexDB) {
@@ -399,6 +413,9 @@ type indexSearch struct {
 	ts mergeset.TableSearch
 	kb bytesutil.ByteBuffer
 
+	// stopCh is closed when the search must be stopped. It may be nil.
+	stopCh <-chan struct{}
+
 	// tsidByNameMisses and tsidByNameSkips is used for a performance
 	// hack in GetOrCreateTSIDByName. See the comment there.
 	tsidByNameMisses int
@@ -452,6 +469,7 @@ func (db *indexDB) getIndexSearch() *indexSearch {
 func (db *indexDB) putIndexSearch(is *indexSearch) {
 	is.ts.MustClose()
 	is.kb.Reset()
+	is.stopCh = nil
 
 	// Do not reset tsidByNameMisses and tsidByNameSkips,
 	// since they are used in GetOrCreateTSIDByName across call boundaries.
@@ -760,6 +778,410 @@ func (is *indexSearch) searchTagValues(tvs map[string]struct{}, prefix []byte, m
 	return nil
 }
 
+// SearchTagKeysOnTimeRange returns tag keys for time series matching tfss on the given tr.
+//
+// Time series are selected via the per-day (date -> metricID) index.
+// Falls back to SearchTagKeys if neither tfss nor tr are set.
+func (db *indexDB) SearchTagKeysOnTimeRange(tfss []*TagFilters, tr TimeRange, maxTagKeys, maxMetrics int) ([]string, error) {
+	if len(tfss) == 0 && !isDateRangeSearchable(tr) {
+		return db.SearchTagKeys(maxTagKeys)
+	}
+	tks := make(map[string]struct{})
+	err := db.searchMetricNamesOnTimeRange(tfss, tr, maxMetrics, func(mn *MetricName) bool {
+		tks[""] = struct{}{}
+		for i := range mn.Tags {
+			tks[string(mn.Tags[i].Key)] = struct{}{}
+		}
+		return len(tks) < maxTagKeys
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(tks))
+	for key := range tks {
+		keys = append(keys, key)
+	}
+
+	// Do not sort keys, since they must be sorted by vmselect.
+	return keys, nil
+}
+
+// SearchTagValuesOnTimeRange returns tag values for the given tagKey for time series matching tfss on the given tr.
+//
+// Time series are selected via the per-day (date -> metricID) index.
+// Falls back to SearchTagValues if neither tfss nor tr are set.
+func (db *indexDB) SearchTagValuesOnTimeRange(tagKey []byte, tfss []*TagFilters, tr TimeRange, maxTagValues, maxMetrics int) ([]string, error) {
+	if len(tfss) == 0 && !isDateRangeSearchable(tr) {
+		return db.SearchTagValues(tagKey, maxTagValues)
+	}
+	tvs := make(map[string]struct{})
+	err := db.searchMetricNamesOnTimeRange(tfss, tr, maxMetrics, func(mn *MetricName) bool {
+		if len(tagKey) == 0 {
+			tvs[string(mn.MetricGroup)] = struct{}{}
+		} else if v := mn.GetTagValue(string(tagKey)); v != nil {
+			tvs[string(v)] = struct{}{}
+		}
+		return len(tvs) < maxTagValues
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tagValues := make([]string, 0, len(tvs))
+	for tv := range tvs {
+		tagValues = append(tagValues, tv)
+	}
+
+	// Do not sort tagValues, since they must be sorted by vmselect.
+	return tagValues, nil
+}
+
+// searchMetricNamesOnTimeRange calls f for each metric name matching tfss on the given tr
+// until f returns false.
+func (db *indexDB) searchMetricNamesOnTimeRange(tfss []*TagFilters, tr TimeRange, maxMetrics int, f func(mn *MetricName) bool) error {
+	mn := GetMetricName()
+	defer PutMetricName(mn)
+
+	stop := false
+	search := func(db *indexDB) error {
+		is := db.getIndexSearch()
+		defer db.putIndexSearch(is)
+		metricIDs, err := is.getMetricIDsOnTimeRange(tfss, tr, maxMetrics)
+		if err != nil {
+			return err
+		}
+		var metricName []byte
+		for _, metricID := range metricIDs {
+			metricName, err = is.searchMetricName(metricName[:0], metricID)
+			if err != nil {
+				if err == io.EOF {
+					// The metricID -> metricName entry may be missing due to unflushed entries.
+					continue
+				}
+				return err
+			}
+			if err := mn.Unmarshal(metricName); err != nil {
+				return fmt.Errorf("cannot unmarshal metricName %q for metricID=%d: %s", metricName, metricID, err)
+			}
+			if !f(mn) {
+				stop = true
+				return nil
+			}
+		}
+		return nil
+	}
+
+	if err := search(db); err != nil {
+		return err
+	}
+	if stop {
+		return nil
+	}
+	var err error
+	ok := db.doExtDB(func(extDB *indexDB) {
+		err = search(extDB)
+	})
+	if ok && err != nil {
+		return err
+	}
+	return nil
+}
+
+// SearchMetricNames returns up to limit metric names for time series matching tfss on the given tr.
+//
+// Unlike searchMetricNamesOnTimeRange it doesn't collect all the matching metricIDs before loading metric names,
+// so the index scan stops soon after limit matching time series are found.
+// The returned bool is set to true if the result has been truncated.
+func (db *indexDB) SearchMetricNames(tfss []*TagFilters, tr TimeRange, limit, maxMetrics int) ([]MetricName, bool, error) {
+	var mns []MetricName
+	seen := make(map[string]struct{})
+	isLimited := false
+	var buf []byte
+	search := func(db *indexDB) error {
+		is := db.getIndexSearch()
+		defer db.putIndexSearch(is)
+		isComplete, err := is.searchMetricNamesWithLimit(tfss, tr, limit, maxMetrics, func(mn *MetricName) bool {
+			buf = mn.Marshal(buf[:0])
+			if _, ok := seen[string(buf)]; ok {
+				// The time series has been already found in db, while searching in extDB.
+				return true
+			}
+			if len(mns) >= limit {
+				return false
+			}
+			seen[string(buf)] = struct{}{}
+			mns = append(mns, MetricName{})
+			mns[len(mns)-1].CopyFrom(mn)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if !isComplete {
+			isLimited = true
+		}
+		return nil
+	}
+
+	if err := search(db); err != nil {
+		return nil, false, err
+	}
+	if isLimited {
+		return mns, true, nil
+	}
+	var err error
+	ok := db.doExtDB(func(extDB *indexDB) {
+		err = search(extDB)
+	})
+	if ok && err != nil {
+		return nil, false, err
+	}
+	return mns, isLimited, nil
+}
+
+// searchMetricNamesWithLimit calls f for metric names of non-deleted time series matching tfss on the given tr
+// until f returns false.
+//
+// Candidate metricIDs are read from the index in geometrically growing batches starting from limit+1,
+// so only a small part of the index is scanned for tfss matching much more than limit time series.
+// Metric names are loaded only for candidates, which weren't checked in the previous batches.
+// Up to getMaxCandidateMetrics(maxMetrics) candidates are checked per each tfs.
+//
+// false is returned if the search has been stopped by f or due to too many candidates.
+func (is *indexSearch) searchMetricNamesWithLimit(tfss []*TagFilters, tr TimeRange, limit, maxMetrics int, f func(mn *MetricName) bool) (bool, error) {
+	checkDate := isDateRangeSearchable(tr)
+	var minDate, maxDate uint64
+	var recentMetricIDs map[uint64]struct{}
+	if checkDate {
+		minDate = uint64(tr.MinTimestamp / msecPerDay)
+		maxDate = uint64(tr.MaxTimestamp / msecPerDay)
+		if m, ok := is.getMetricIDsForRecentHours(tr, maxMetrics); ok {
+			recentMetricIDs = m
+		}
+	}
+	dmis := is.db.getDeletedMetricIDs()
+	maxCandidates := getMaxCandidateMetrics(maxMetrics)
+	mn := GetMetricName()
+	defer PutMetricName(mn)
+	var metricName []byte
+	var tfsPtrs []*tagFilter
+
+	for _, tfs := range tfss {
+		tfsPtrs = tfsPtrs[:0]
+		for i := range tfs.tfs {
+			tfsPtrs = append(tfsPtrs, &tfs.tfs[i])
+		}
+		checked := make(map[uint64]struct{})
+		checkCandidates := func(metricIDs map[uint64]struct{}) (bool, error) {
+			for _, metricID := range getSortedMetricIDs(metricIDs) {
+				if _, ok := checked[metricID]; ok {
+					continue
+				}
+				checked[metricID] = struct{}{}
+				atomic.AddUint64(&is.db.limitedSeriesSearchCandidates, 1)
+				if _, deleted := dmis[metricID]; deleted {
+					continue
+				}
+				if recentMetricIDs != nil {
+					if _, ok := recentMetricIDs[metricID]; !ok {
+						continue
+					}
+				} else if checkDate {
+					ok, err := is.hasDateMetricIDInRange(minDate, maxDate, metricID)
+					if err != nil {
+						return false, err
+					}
+					if !ok {
+						continue
+					}
+				}
+				var err error
+				metricName, err = is.searchMetricName(metricName[:0], metricID)
+				if err != nil {
+					if err == io.EOF {
+						// The metricID -> metricName entry may be missing due to unflushed entries.
+						continue
+					}
+					return false, err
+				}
+				if err := mn.Unmarshal(metricName); err != nil {
+					return false, fmt.Errorf("cannot unmarshal metricName %q for metricID=%d: %s", metricName, metricID, err)
+				}
+				ok, err := matchTagFilters(mn, tfsPtrs, &is.kb)
+				if err != nil {
+					return false, fmt.Errorf("cannot match MetricName %s against tagFilters: %s", mn, err)
+				}
+				if ok && !f(mn) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+
+		// Read candidates in growing batches until f stops the search.
+		batchSize := limit + 1
+		for {
+			if batchSize > maxCandidates {
+				batchSize = maxCandidates
+			}
+			metricIDs, isComplete, err := is.getCandidateMetricIDs(tfs, batchSize)
+			if err != nil {
+				return false, err
+			}
+			ok, err := checkCandidates(metricIDs)
+			if err != nil || !ok {
+				return false, err
+			}
+			if isComplete {
+				break
+			}
+			if batchSize >= maxCandidates {
+				// Too many candidates.
+				return false, nil
+			}
+			batchSize *= 4
+		}
+	}
+	return true, nil
+}
+
+// getCandidateMetricIDs returns candidate metricIDs for tfs, which are read from up to maxMetrics rows per each positive tag filter.
+//
+// The returned bool is set to true if the returned metricIDs contain all the time series matching tfs.
+// Otherwise the returned metricIDs contain the intersection of partial results for positive tag filters.
+func (is *indexSearch) getCandidateMetricIDs(tfs *TagFilters, maxMetrics int) (map[uint64]struct{}, bool, error) {
+	var candidates map[uint64]struct{}
+	for i := range tfs.tfs {
+		tf := &tfs.tfs[i]
+		if tf.isNegative {
+			continue
+		}
+		metricIDs, err := is.getMetricIDsForTagFilter(tf, maxMetrics)
+		if err != nil {
+			if err == errFallbackToMetricNameMatch {
+				// The tag filter is checked by metric name match.
+				continue
+			}
+			return nil, false, fmt.Errorf("cannot find MetricIDs for tagFilter %s: %s", tf, err)
+		}
+		if len(metricIDs) < maxMetrics {
+			// The tf matches less than maxMetrics time series, so it contains all the candidates.
+			return metricIDs, true, nil
+		}
+		if candidates == nil {
+			candidates = metricIDs
+			continue
+		}
+		for metricID := range candidates {
+			if _, ok := metricIDs[metricID]; !ok {
+				delete(candidates, metricID)
+			}
+		}
+	}
+	if candidates != nil {
+		return candidates, false, nil
+	}
+
+	// There are no positive filters usable for selecting candidates.
+	metricIDs := make(map[uint64]struct{})
+	if err := is.updateMetricIDsForCommonPrefix(metricIDs, tfs.commonPrefix, maxMetrics); err != nil {
+		return nil, false, err
+	}
+	return metricIDs, len(metricIDs) < maxMetrics, nil
+}
+
+// hasDateMetricIDInRange returns true if the given metricID has (date -> metricID) entry for any date in the range [minDate ... maxDate].
+func (is *indexSearch) hasDateMetricIDInRange(minDate, maxDate, metricID uint64) (bool, error) {
+	for date := minDate; date <= maxDate; date++ {
+		ok, err := is.hasDateMetricID(date, metricID)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// getMetricIDsOnTimeRange returns sorted metricIDs for non-deleted time series matching tfss on the given tr.
+//
+// tr is ignored if it covers too many days for the per-day index.
+func (is *indexSearch) getMetricIDsOnTimeRange(tfss []*TagFilters, tr TimeRange, maxMetrics int) ([]uint64, error) {
+	var dateMetricIDs map[uint64]struct{}
+	if isDateRangeSearchable(tr) {
+		m, err := is.getMetricIDsForDateRange(tr, maxMetrics)
+		if err != nil {
+			return nil, err
+		}
+		dateMetricIDs = m
+	}
+	if len(tfss) == 0 {
+		if len(dateMetricIDs) == 0 {
+			return nil, nil
+		}
+		sortedMetricIDs := getSortedMetricIDs(dateMetricIDs)
+		dmis := is.db.getDeletedMetricIDs()
+		if len(dmis) == 0 {
+			return sortedMetricIDs, nil
+		}
+		metricIDsFiltered := sortedMetricIDs[:0]
+		for _, metricID := range sortedMetricIDs {
+			if _, deleted := dmis[metricID]; !deleted {
+				metricIDsFiltered = append(metricIDsFiltered, metricID)
+			}
+		}
+		return metricIDsFiltered, nil
+	}
+
+	metricIDs, err := is.searchMetricIDs(tfss, tr, maxMetrics)
+	if err != nil {
+		return nil, err
+	}
+	if dateMetricIDs == nil {
+		return metricIDs, nil
+	}
+	metricIDsFiltered := metricIDs[:0]
+	for _, metricID := range metricIDs {
+		if _, ok := dateMetricIDs[metricID]; ok {
+			metricIDsFiltered = append(metricIDsFiltered, metricID)
+		}
+	}
+	return metricIDsFiltered, nil
+}
+
+// getMetricIDsForDateRange returns metricIDs for all the days covering the given tr.
+//
+// Unlike getMetricIDsForTimeRange it doesn't fail on days without (date -> metricID) entries.
+func (is *indexSearch) getMetricIDsForDateRange(tr TimeRange, maxMetrics int) (map[uint64]struct{}, error) {
+	if metricIDs, ok := is.getMetricIDsForRecentHours(tr, maxMetrics); ok {
+		return metricIDs, nil
+	}
+	minDate := tr.MinTimestamp / msecPerDay
+	maxDate := tr.MaxTimestamp / msecPerDay
+	metricIDs := make(map[uint64]struct{})
+	for date := minDate; date <= maxDate; date++ {
+		err := is.getMetricIDsForDate(uint64(date), metricIDs, maxMetrics+1)
+		if err != nil && err != errMissingMetricIDsForDate {
+			return nil, err
+		}
+		if len(metricIDs) > maxMetrics {
+			return nil, errTooManyTimeseries(len(metricIDs), maxMetrics)
+		}
+	}
+	return metricIDs, nil
+}
+
+// maxDaysForDateRangeSearch is the maximum number of days, which may be searched via the per-day index.
+//
+// Bigger time ranges are searched without time range filtering.
+const maxDaysForDateRangeSearch = 40
+
+func isDateRangeSearchable(tr TimeRange) bool {
+	if tr.isZero() || tr.MinTimestamp > tr.MaxTimestamp {
+		return false
+	}
+	return tr.MaxTimestamp/msecPerDay-tr.MinTimestamp/msecPerDay <= maxDaysForDateRangeSearch
+}
+
 // GetSeriesCount returns the approximate number of unique timeseries in the db.
 //
 // It includes the deleted series too and may count the same series
@@ -784,6 +1206,398 @@ func (db *indexDB) GetSeriesCount() (uint64, error) {
 	return n + nExt, nil
 }
 
+// TSDBStatus contains TSDB status data for /api/v1/status/tsdb.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#tsdb-stats
+type TSDBStatus struct {
+	TotalSeries          uint64
+	TotalLabelValuePairs uint64
+
+	SeriesCountByMetricName     []TopHeapEntry
+	LabelValueCountByLabelName  []TopHeapEntry
+	MemoryInBytesByLabelName    []TopHeapEntry
+	SeriesCountByLabelValuePair []TopHeapEntry
+}
+
+// TopHeapEntry represents an entry from `top heap` used in stats.
+type TopHeapEntry struct {
+	Name  string
+	Count uint64
+}
+
+// GetTSDBStatusForDate returns topN entries for TSDB status for the given date.
+//
+// Only time series with (date -> metricID) entries for the given date are taken into account.
+func (db *indexDB) GetTSDBStatusForDate(date uint64, topN int) (*TSDBStatus, error) {
+	is := db.getIndexSearch()
+	defer db.putIndexSearch(is)
+
+	var status *TSDBStatus
+	var err error
+	ok := db.doExtDB(func(extDB *indexDB) {
+		// Tag entries for time series created before the last indexDB rotation
+		// are located in extDB, while (date -> metricID) entries may be located in db.
+		// So both dbs must be scanned simultaneously.
+		isExt := extDB.getIndexSearch()
+		status, err = is.getTSDBStatusForDate(isExt, date, topN)
+		extDB.putIndexSearch(isExt)
+	})
+	if !ok {
+		status, err = is.getTSDBStatusForDate(nil, date, topN)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// getTSDBStatusForDate calculates TSDB status for the given date over is and the optional isExt.
+//
+// Memory usage is bounded by the number of time series for the given date, since tag entries
+// are streamed through topN heaps.
+func (is *indexSearch) getTSDBStatusForDate(isExt *indexSearch, date uint64, topN int) (*TSDBStatus, error) {
+	metricIDs, err := is.getSortedMetricIDsForDate(date)
+	if err != nil {
+		return nil, err
+	}
+	if isExt != nil {
+		metricIDsExt, err := isExt.getSortedMetricIDsForDate(date)
+		if err != nil {
+			return nil, err
+		}
+		metricIDs = unionSortedMetricIDs(metricIDs, metricIDsExt)
+	}
+	if dmis := is.db.getDeletedMetricIDs(); len(dmis) > 0 {
+		metricIDsFiltered := metricIDs[:0]
+		for _, metricID := range metricIDs {
+			if _, deleted := dmis[metricID]; !deleted {
+				metricIDsFiltered = append(metricIDsFiltered, metricID)
+			}
+		}
+		metricIDs = metricIDsFiltered
+	}
+	status := &TSDBStatus{
+		TotalSeries: uint64(len(metricIDs)),
+	}
+	if len(metricIDs) == 0 {
+		return status, nil
+	}
+
+	thSeriesCountByMetricName := newTopHeap(topN)
+	thLabelValueCountByLabelName := newTopHeap(topN)
+	thMemoryInBytesByLabelName := newTopHeap(topN)
+	thSeriesCountByLabelValuePair := newTopHeap(topN)
+	var labelName, labelValue, labelPair, tagPrefix []byte
+	var seriesCount, labelValueCount, memoryInBytes uint64
+	flushLabelValue := func() {
+		if seriesCount == 0 {
+			return
+		}
+		if len(labelName) == 0 {
+			thSeriesCountByMetricName.pushIfNonEmpty(labelValue, seriesCount)
+		}
+		labelPair = appendLabelName(labelPair[:0], labelName)
+		labelPair = append(labelPair, '=')
+		labelPair = append(labelPair, labelValue...)
+		thSeriesCountByLabelValuePair.pushIfNonEmpty(labelPair, seriesCount)
+		status.TotalLabelValuePairs += seriesCount
+		labelValueCount++
+		memoryInBytes += uint64(len(labelValue))
+		seriesCount = 0
+	}
+	flushLabelName := func() {
+		flushLabelValue()
+		if labelValueCount == 0 {
+			return
+		}
+		labelPair = appendLabelName(labelPair[:0], labelName)
+		thLabelValueCountByLabelName.pushIfNonEmpty(labelPair, labelValueCount)
+		thMemoryInBytesByLabelName.pushIfNonEmpty(labelPair, memoryInBytes)
+		labelValueCount = 0
+		memoryInBytes = 0
+	}
+
+	prefix := marshalCommonPrefix(nil, nsPrefixTagToMetricID)
+	tss := []*mergeset.TableSearch{&is.ts}
+	if isExt != nil {
+		tss = append(tss, &isExt.ts)
+	}
+	var tim tableItemsMerger
+	tim.Init(tss, prefix)
+	for tim.NextItem() {
+		tail := tim.Item[len(prefix):]
+		if len(tail) < 8 {
+			return nil, fmt.Errorf("cannot extract metricID from tag entry; want at least %d bytes; got %d bytes", 8, len(tail))
+		}
+		metricID := encoding.UnmarshalUint64(tail[len(tail)-8:])
+		if !containsSortedMetricID(metricIDs, metricID) {
+			continue
+		}
+		tail = tail[:len(tail)-8]
+		if string(tail) != string(tagPrefix) {
+			// Tag entries are sorted by (tag key, tag value), so the next tag starts here.
+			var name, value []byte
+			name, value, err = unmarshalTagKeyValue(name, value, tail)
+			if err != nil {
+				return nil, fmt.Errorf("cannot unmarshal tag entry: %s", err)
+			}
+			if string(name) != string(labelName) {
+				flushLabelName()
+			} else {
+				flushLabelValue()
+			}
+			labelName = append(labelName[:0], name...)
+			labelValue = append(labelValue[:0], value...)
+			tagPrefix = append(tagPrefix[:0], tail...)
+		}
+		seriesCount++
+	}
+	if err := tim.Error(); err != nil {
+		return nil, fmt.Errorf("error when scanning tag entries for date %d: %s", date, err)
+	}
+	flushLabelName()
+
+	status.SeriesCountByMetricName = thSeriesCountByMetricName.getSortedResult()
+	status.LabelValueCountByLabelName = thLabelValueCountByLabelName.getSortedResult()
+	status.MemoryInBytesByLabelName = thMemoryInBytesByLabelName.getSortedResult()
+	status.SeriesCountByLabelValuePair = thSeriesCountByLabelValuePair.getSortedResult()
+	return status, nil
+}
+
+func appendLabelName(dst, name []byte) []byte {
+	if len(name) == 0 {
+		return append(dst, "__name__"...)
+	}
+	return append(dst, name...)
+}
+
+func unmarshalTagKeyValue(dstKey, dstValue, src []byte) ([]byte, []byte, error) {
+	tail, dstKey, err := unmarshalTagValue(dstKey[:0], src)
+	if err != nil {
+		return dstKey, dstValue, fmt.Errorf("cannot unmarshal tag key: %s", err)
+	}
+	tail, dstValue, err = unmarshalTagValue(dstValue[:0], tail)
+	if err != nil {
+		return dstKey, dstValue, fmt.Errorf("cannot unmarshal tag value: %s", err)
+	}
+	if len(tail) > 0 {
+		return dstKey, dstValue, fmt.Errorf("unexpected non-empty tail left after unmarshaling tag: %X", tail)
+	}
+	return dstKey, dstValue, nil
+}
+
+// getSortedMetricIDsForDate returns sorted metricIDs from (date -> metricID) entries for the given date.
+func (is *indexSearch) getSortedMetricIDsForDate(date uint64) ([]uint64, error) {
+	ts := &is.ts
+	kb := &is.kb
+	kb.B = marshalCommonPrefix(kb.B[:0], nsPrefixDateToMetricID)
+	kb.B = encoding.MarshalUint64(kb.B, date)
+	ts.Seek(kb.B)
+	var metricIDs []uint64
+	for ts.NextItem() {
+		if !bytes.HasPrefix(ts.Item, kb.B) {
+			break
+		}
+		v := ts.Item[len(kb.B):]
+		if len(v) != 8 {
+			return nil, fmt.Errorf("cannot extract metricID from k; want %d bytes; got %d bytes", 8, len(v))
+		}
+		// Items are sorted, so metricIDs are sorted too.
+		metricIDs = append(metricIDs, encoding.UnmarshalUint64(v))
+	}
+	if err := ts.Error(); err != nil {
+		return nil, fmt.Errorf("error when searching for metricIDs for date %d: %s", date, err)
+	}
+	return metricIDs, nil
+}
+
+func unionSortedMetricIDs(a, b []uint64) []uint64 {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	dst := make([]uint64, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			dst = append(dst, a[0])
+			a = a[1:]
+		case a[0] > b[0]:
+			dst = append(dst, b[0])
+			b = b[1:]
+		default:
+			dst = append(dst, a[0])
+			a = a[1:]
+			b = b[1:]
+		}
+	}
+	dst = append(dst, a...)
+	dst = append(dst, b...)
+	return dst
+}
+
+func containsSortedMetricID(sortedMetricIDs []uint64, metricID uint64) bool {
+	n := sort.Search(len(sortedMetricIDs), func(i int) bool {
+		return sortedMetricIDs[i] >= metricID
+	})
+	return n < len(sortedMetricIDs) && sortedMetricIDs[n] == metricID
+}
+
+// tableItemsMerger returns sorted items with the given prefix from multiple table searches.
+//
+// Duplicate items are returned only once.
+type tableItemsMerger struct {
+	// Item contains the current item. It is valid until the next call to NextItem.
+	Item []byte
+
+	tss      []*mergeset.TableSearch
+	ok       []bool
+	prefix   []byte
+	prevItem []byte
+	err      error
+}
+
+// Init initializes tim for returning items with the given prefix from tss.
+func (tim *tableItemsMerger) Init(tss []*mergeset.TableSearch, prefix []byte) {
+	tim.Item = nil
+	tim.tss = tss
+	tim.ok = make([]bool, len(tss))
+	tim.prefix = prefix
+	tim.err = nil
+	for i, ts := range tss {
+		ts.Seek(prefix)
+		tim.ok[i] = tim.next(i)
+	}
+}
+
+func (tim *tableItemsMerger) next(i int) bool {
+	ts := tim.tss[i]
+	if !ts.NextItem() {
+		if err := ts.Error(); err != nil && tim.err == nil {
+			tim.err = err
+		}
+		return false
+	}
+	return bytes.HasPrefix(ts.Item, tim.prefix)
+}
+
+// NextItem advances tim to the next item.
+//
+// It returns false if there are no more items or on error. Call Error for obtaining the error.
+func (tim *tableItemsMerger) NextItem() bool {
+	if tim.err != nil {
+		return false
+	}
+	if tim.Item != nil {
+		// Advance all the searches pointing to the previous item.
+		// The previous item must be copied, since it may change after advancing the first search.
+		tim.prevItem = append(tim.prevItem[:0], tim.Item...)
+		for i, ts := range tim.tss {
+			if tim.ok[i] && string(ts.Item) == string(tim.prevItem) {
+				tim.ok[i] = tim.next(i)
+			}
+		}
+		tim.Item = nil
+		if tim.err != nil {
+			return false
+		}
+	}
+	minIdx := -1
+	for i, ts := range tim.tss {
+		if !tim.ok[i] {
+			continue
+		}
+		if minIdx < 0 || string(ts.Item) < string(tim.tss[minIdx].Item) {
+			minIdx = i
+		}
+	}
+	if minIdx < 0 {
+		return false
+	}
+	tim.Item = tim.tss[minIdx].Item
+	return true
+}
+
+// Error returns the last error occurred in tim.
+func (tim *tableItemsMerger) Error() error {
+	return tim.err
+}
+
+// topHeap maintains topN entries with the biggest counts.
+type topHeap struct {
+	topN int
+	a    []TopHeapEntry
+}
+
+func newTopHeap(topN int) *topHeap {
+	return &topHeap{
+		topN: topN,
+	}
+}
+
+// pushIfNonEmpty pushes (name, count) to th if count is among topN biggest counts.
+func (th *topHeap) pushIfNonEmpty(name []byte, count uint64) {
+	if count == 0 || th.topN <= 0 {
+		return
+	}
+	if len(th.a) < th.topN {
+		th.a = append(th.a, TopHeapEntry{
+			Name:  string(name),
+			Count: count,
+		})
+		heap.Push(th, nil)
+		return
+	}
+	if count <= th.a[0].Count {
+		return
+	}
+	th.a[0] = TopHeapEntry{
+		Name:  string(name),
+		Count: count,
+	}
+	heap.Fix(th, 0)
+}
+
+// getSortedResult returns entries from th sorted by count in descending order.
+func (th *topHeap) getSortedResult() []TopHeapEntry {
+	result := append([]TopHeapEntry{}, th.a...)
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Name < b.Name
+	})
+	return result
+}
+
+// heap.Interface implementation for topHeap.
+
+func (th *topHeap) Len() int {
+	return len(th.a)
+}
+
+func (th *topHeap) Less(i, j int) bool {
+	a := th.a
+	return a[i].Count < a[j].Count
+}
+
+func (th *topHeap) Swap(i, j int) {
+	a := th.a
+	a[j], a[i] = a[i], a[j]
+}
+
+func (th *topHeap) Push(x interface{}) {
+	// The entry is already appended to th.a in pushIfNonEmpty.
+}
+
+func (th *topHeap) Pop() interface{} {
+	logger.Panicf("BUG: Pop shouldn't be called")
+	return nil
+}
+
 // searchMetricName appends metric name for the given metricID to dst
 // and returns the result.
 func (db *indexDB) searchMetricName(dst []byte, metricID uint64) ([]byte, error) {
@@ -912,7 +1726,7 @@ func (is *indexSearch) loadDeletedMetricIDs() (map[uint64]struct{}, error) {
 }
 
 // searchTSIDs returns tsids matching the given tfss over the given tr.
-func (db *indexDB) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int) ([]TSID, error) {
+func (db *indexDB) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int, stopCh <-chan struct{}) ([]TSID, error) {
 	if len(tfss) == 0 {
 		return nil, nil
 	}
@@ -924,11 +1738,16 @@ func (db *indexDB) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int)
 	tsids, ok := db.getFromTagCache(tfKeyBuf.B)
 	if ok {
 		// Fast path - tsids found in the cache.
+		// The cached tsids may be obtained with bigger maxMetrics, so verify them against maxMetrics.
+		if len(tsids) > maxMetrics {
+			return nil, errTooManyTimeseries(len(tsids), maxMetrics)
+		}
 		return tsids, nil
 	}
 
 	// Slow path - search for tsids in the db and extDB.
 	is := db.getIndexSearch()
+	is.stopCh = stopCh
 	localTSIDs, err := is.searchTSIDs(tfss, tr, maxMetrics)
 	db.putIndexSearch(is)
 	if err != nil {
@@ -943,6 +1762,7 @@ func (db *indexDB) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int)
 			return
 		}
 		is := extDB.getIndexSearch()
+		is.stopCh = stopCh
 		extTSIDs, err = is.searchTSIDs(tfss, tr, maxMetrics)
 		extDB.putIndexSearch(is)
 
@@ -964,6 +1784,10 @@ func (db *indexDB) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int)
 	// Store TSIDs in the cache.
 	db.putToTagCache(tsids, tfKeyBuf.B)
 
+	// The merged tsids from db and extDB may exceed maxMetrics.
+	if len(tsids) > maxMetrics {
+		return nil, errTooManyTimeseries(len(tsids), maxMetrics)
+	}
 	return tsids, err
 }
 
@@ -1069,7 +1893,10 @@ func (is *indexSearch) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics
 	// Obtain TSID values for the given metricIDs.
 	tsids := make([]TSID, len(metricIDs))
 	i := 0
-	for _, metricID := range metricIDs {
+	for loops, metricID := range metricIDs {
+		if loops&stopCheckLoopsMask == 0 && is.isStopped() {
+			return nil, ErrSearchCanceled
+		}
 		// Try obtaining TSIDs from db.tsidCache. This is much faster
 		// than scanning the mergeset if it contains a lot of metricIDs.
 		tsid := &tsids[i]
@@ -1159,7 +1986,10 @@ func (is *indexSearch) updateMetricIDsByMetricNameMatch(metricIDs, srcMetricIDs
 	defer kbPool.Put(metricName)
 	mn := GetMetricName()
 	defer PutMetricName(mn)
-	for _, metricID := range sortedMetricIDs {
+	for loops, metricID := range sortedMetricIDs {
+		if loops&stopCheckLoopsMask == 0 && is.isStopped() {
+			return ErrSearchCanceled
+		}
 		var err error
 		metricName.B, err = is.searchMetricName(metricName.B[:0], metricID)
 		if err != nil {
@@ -1226,6 +2056,25 @@ func (is *indexSearch) getTagFilterWithMinMetricIDsCountAdaptive(tfs *TagFilters
 
 var errTooManyMetrics = errors.New("all the tag filters match too many metrics")
 
+// SetMaxCandidateMetrics sets the maximum number of candidate metrics, which may be scanned
+// when all the tag filters match too many metrics.
+//
+// By default up to 20*maxMetrics candidate metrics are scanned.
+//
+// This function must be called before initializing the storage.
+func SetMaxCandidateMetrics(n int) {
+	maxCandidateMetrics = n
+}
+
+var maxCandidateMetrics = 0
+
+func getMaxCandidateMetrics(maxMetrics int) int {
+	if maxCandidateMetrics > 0 {
+		return maxCandidateMetrics
+	}
+	return 20 * maxMetrics
+}
+
 func (is *indexSearch) getTagFilterWithMinMetricIDsCount(tfs *TagFilters, maxMetrics int) (*tagFilter, map[uint64]struct{}, error) {
 	var minMetricIDs map[uint64]struct{}
 	var minTf *tagFilter
@@ -1332,13 +2181,16 @@ func matchTagFilter(b []byte, tf *tagFilter) (bool, error) {
 func (is *indexSearch) searchMetricIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int) ([]uint64, error) {
 	metricIDs := make(map[uint64]struct{})
 	for _, tfs := range tfss {
+		if is.isStopped() {
+			return nil, ErrSearchCanceled
+		}
 		if len(tfs.tfs) == 0 {
 			// Return all the metric ids
 			if err := is.updateMetricIDsForCommonPrefix(metricIDs, tfs.commonPrefix, maxMetrics+1); err != nil {
 				return nil, err
 			}
 			if len(metricIDs) > maxMetrics {
-				return nil, fmt.Errorf("the number or unique timeseries exceeds %d; either narrow down the search or increase -search.maxUniqueTimeseries", maxMetrics)
+				return nil, errTooManyTimeseries(len(metricIDs), maxMetrics)
 			}
 			// Stop the iteration, since we cannot find more metric ids with the remaining tfss.
 			break
@@ -1347,7 +2199,7 @@ func (is *indexSearch) searchMetricIDs(tfss []*TagFilters, tr TimeRange, maxMetr
 			return nil, err
 		}
 		if len(metricIDs) > maxMetrics {
-			return nil, fmt.Errorf("the number or matching unique timeseries exceeds %d; either narrow down the search or increase -search.maxUniqueTimeseries", maxMetrics)
+			return nil, errTooManyTimeseries(len(metricIDs), maxMetrics)
 		}
 	}
 	if len(metricIDs) == 0 {
@@ -1376,6 +2228,13 @@ func (is *indexSearch) updateMetricIDsForTagFilters(metricIDs map[uint64]struct{
 	// Sort tag filters for faster ts.Seek below.
 	sort.Slice(tfs.tfs, func(i, j int) bool { return bytes.Compare(tfs.tfs[i].prefix, tfs.tfs[j].prefix) < 0 })
 
+	if !tfs.hasPositiveFilter() {
+		// Negative tag filters cannot be used for seeding the candidate metricIDs,
+		// so all the metricIDs must be scanned and filtered by negative tag filters.
+		atomic.AddUint64(&is.db.negativeOnlySearches, 1)
+		logNegativeOnlySearch(tfs)
+	}
+
 	minTf, minMetricIDs, err := is.getTagFilterWithMinMetricIDsCountAdaptive(tfs, maxMetrics)
 	if err != nil {
 		if err != errTooManyMetrics {
@@ -1389,9 +2248,9 @@ func (is *indexSearch) updateMetricIDsForTagFilters(metricIDs map[uint64]struct{
 		// by big number of new metrics. For example, prometheus-operator creates many new
 		// metrics for each new deployment.
 		//
-		// Allow fetching up to 20*maxMetrics metrics for the given time range
+		// Allow fetching up to getMaxCandidateMetrics(maxMetrics) metrics for the given time range
 		// in the hope these metricIDs will be filtered out by other filters below.
-		maxTimeRangeMetrics := 20 * maxMetrics
+		maxTimeRangeMetrics := getMaxCandidateMetrics(maxMetrics)
 		metricIDsForTimeRange, err := is.getMetricIDsForTimeRange(tr, maxTimeRangeMetrics+1)
 		if err == errMissingMetricIDsForDate {
 			return fmt.Errorf("cannot find tag filter matching less up to %d time series; either increase -search.maxUniqueTimeseries or use more specific tag filters",
@@ -1401,8 +2260,8 @@ func (is *indexSearch) updateMetricIDsForTagFilters(metricIDs map[uint64]struct{
 			return err
 		}
 		if len(metricIDsForTimeRange) > maxTimeRangeMetrics {
-			return fmt.Errorf("more than %d time series found on the time range %s; either increase -search.maxUniqueTimeseries or shrink the time range",
-				maxTimeRangeMetrics, tr.String())
+			return fmt.Errorf("query would scan too many series: more than %d time series found on the time range %s; "+
+				"either use more specific tag filters, shrink the time range or increase -search.maxCandidateSeries", maxTimeRangeMetrics, tr.String())
 		}
 		minMetricIDs = metricIDsForTimeRange
 		minTf = nil
@@ -1443,6 +2302,18 @@ func (is *indexSearch) updateMetricIDsForTagFilters(metricIDs map[uint64]struct{
 	return nil
 }
 
+func logNegativeOnlySearch(tfs *TagFilters) {
+	now := uint64(time.Now().Unix())
+	lastLogTime := atomic.LoadUint64(&negativeOnlySearchLastLogTime)
+	if now < lastLogTime+5 || !atomic.CompareAndSwapUint64(&negativeOnlySearchLastLogTime, lastLogTime, now) {
+		return
+	}
+	logger.Warnf("tag filters %s contain only negative filters, so all the time series are scanned; "+
+		"add at least a single positive filter in order to speed up the search", tfs)
+}
+
+var negativeOnlySearchLastLogTime uint64
+
 func (is *indexSearch) getMetricIDsForTagFilter(tf *tagFilter, maxMetrics int) (map[uint64]struct{}, error) {
 	if tf.isNegative {
 		logger.Panicf("BUG: isNegative must be false")
@@ -1466,6 +2337,9 @@ func (is *indexSearch) getMetricIDsForTagFilter(tf *tagFilter, maxMetrics int) (
 		if loops > maxLoops {
 			return nil, errFallbackToMetricNameMatch
 		}
+		if loops&stopCheckLoopsMask == 0 && is.isStopped() {
+			return nil, ErrSearchCanceled
+		}
 
 		k := ts.Item
 		if !bytes.HasPrefix(k, tf.prefix) {
@@ -1541,6 +2415,9 @@ func (is *indexSearch) updateMetricIDsForOrSuffixNoFilter(prefix []byte, maxMetr
 		if loops > maxLoops {
 			return errFallbackToMetricNameMatch
 		}
+		if loops&stopCheckLoopsMask == 0 && is.isStopped() {
+			return ErrSearchCanceled
+		}
 		if !bytes.HasPrefix(ts.Item, prefix) {
 			break
 		}
@@ -1561,12 +2438,17 @@ func (is *indexSearch) updateMetricIDsForOrSuffixNoFilter(prefix []byte, maxMetr
 func (is *indexSearch) updateMetricIDsForOrSuffixWithFilter(prefix []byte, metricIDs map[uint64]struct{}, sortedFilter []uint64, isNegative bool) error {
 	ts := &is.ts
 	kb := &is.kb
+	loops := 0
 	for {
 		// Seek for the next metricID from sortedFilter.
 		if len(sortedFilter) == 0 {
 			// All the sorteFilter entries have been searched.
 			break
 		}
+		loops++
+		if loops&stopCheckLoopsMask == 0 && is.isStopped() {
+			return ErrSearchCanceled
+		}
 		nextMetricID := sortedFilter[0]
 		sortedFilter = sortedFilter[1:]
 		kb.B = append(kb.B[:0], prefix...)
@@ -1740,6 +2622,9 @@ func (is *indexSearch) getMetricIDsForDate(date uint64, metricIDs map[uint64]str
 		if !bytes.HasPrefix(ts.Item, kb.B) {
 			break
 		}
+		if items&stopCheckLoopsMask == 0 && is.isStopped() {
+			return ErrSearchCanceled
+		}
 		// Extract MetricID from ts.Item (the last 8 bytes).
 		v := ts.Item[len(kb.B):]
 		if len(v) != 8 {
@@ -1763,11 +2648,16 @@ func (is *indexSearch) getMetricIDsForDate(date uint64, metricIDs map[uint64]str
 func (is *indexSearch) updateMetricIDsForCommonPrefix(metricIDs map[uint64]struct{}, commonPrefix []byte, maxMetrics int) error {
 	ts := &is.ts
 	ts.Seek(commonPrefix)
+	loops := 0
 	for len(metricIDs) < maxMetrics && ts.NextItem() {
 		k := ts.Item
 		if !bytes.HasPrefix(k, commonPrefix) {
 			break
 		}
+		loops++
+		if loops&stopCheckLoopsMask == 0 && is.isStopped() {
+			return ErrSearchCanceled
+		}
 
 		// Extract MetricID from k (the last 8 bytes).
 		k = k[len(commonPrefix):]
@@ -1784,6 +2674,49 @@ func (is *indexSearch) updateMetricIDsForCommonPrefix(metricIDs map[uint64]struc
 	return nil
 }
 
+// TooManyTimeseriesError is returned from the search matching more unique time series than the limit passed to the search.
+//
+// The search is stopped as soon as the limit is exceeded, so Timeseries is the lower bound for the number of matching time series.
+type TooManyTimeseriesError struct {
+	Timeseries    int
+	MaxTimeseries int
+}
+
+// Error implements error interface.
+//
+// The error refers to -search.maxUniqueTimeseries, since it is the default limit.
+// Callers passing other limits to the search must report them on their own.
+func (e *TooManyTimeseriesError) Error() string {
+	return fmt.Sprintf("the query matches at least %d unique time series, which exceeds the limit of %d unique time series per query; "+
+		"either narrow down the query with more specific label filters or increase -search.maxUniqueTimeseries", e.Timeseries, e.MaxTimeseries)
+}
+
+// errTooManyTimeseries returns an error for the search matching at least n unique time series, which exceeds maxMetrics.
+func errTooManyTimeseries(n, maxMetrics int) error {
+	return &TooManyTimeseriesError{
+		Timeseries:    n,
+		MaxTimeseries: maxMetrics,
+	}
+}
+
+// ErrSearchCanceled is returned from Search when it is canceled via stopCh passed to Search.InitWithStopCh.
+var ErrSearchCanceled = errors.New("the search has been canceled")
+
+// stopCheckLoopsMask determines how frequently index scan loops check whether the search must be stopped.
+//
+// Checking stopCh on every loop is too expensive, so it is checked every stopCheckLoopsMask+1 loops.
+const stopCheckLoopsMask = 1<<10 - 1
+
+// isStopped returns true if the search must be stopped, since is.stopCh is closed.
+func (is *indexSearch) isStopped() bool {
+	select {
+	case <-is.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
 // The maximum number of index scan loops per already found metric.
 // Bigger number of loops is slower than updateMetricIDsByMetricNameMatch
 // over the found metrics.
@@ -1815,6 +2748,9 @@ func (is *indexSearch) intersectMetricIDsWithTagFilter(tf *tagFilter, filter map
 		if loops > maxLoops {
 			return nil, errFallbackToMetricNameMatch
 		}
+		if loops&stopCheckLoopsMask == 0 && is.isStopped() {
+			return nil, ErrSearchCanceled
+		}
 
 		k := ts.Item
 		if !bytes.HasPrefix(k, tf.prefix) {
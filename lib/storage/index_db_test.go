@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -417,7 +418,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		if err := tfs.Add(nil, nil, true, false); err != nil {
 			return fmt.Errorf("cannot add no-op negative filter: %s", err)
 		}
-		tsidsFound, err := db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsFound, err := db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search by exact tag filter: %s", err)
 		}
@@ -426,7 +427,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		}
 
 		// Verify tag cache.
-		tsidsCached, err := db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsCached, err := db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search by exact tag filter: %s", err)
 		}
@@ -438,7 +439,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		if err := tfs.Add(nil, mn.MetricGroup, true, false); err != nil {
 			return fmt.Errorf("cannot add negative filter for zeroing search results: %s", err)
 		}
-		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search by exact tag filter with full negative: %s", err)
 		}
@@ -466,7 +467,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		if err := tfs.Add(nil, nil, true, true); err != nil {
 			return fmt.Errorf("cannot add no-op negative filter with regexp: %s", err)
 		}
-		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search by regexp tag filter: %s", err)
 		}
@@ -476,7 +477,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		if err := tfs.Add(nil, mn.MetricGroup, true, true); err != nil {
 			return fmt.Errorf("cannot add negative filter for zeroing search results: %s", err)
 		}
-		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search by regexp tag filter with full negative: %s", err)
 		}
@@ -492,7 +493,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		if err := tfs.Add(nil, mn.MetricGroup, false, true); err != nil {
 			return fmt.Errorf("cannot create tag filter for MetricGroup matching zero results: %s", err)
 		}
-		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search by non-existing tag filter: %s", err)
 		}
@@ -508,7 +509,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 
 		// Search with empty filter. It should match all the results.
 		tfs.Reset()
-		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search for common prefix: %s", err)
 		}
@@ -521,7 +522,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		if err := tfs.Add(nil, nil, false, false); err != nil {
 			return fmt.Errorf("cannot create tag filter for empty metricGroup: %s", err)
 		}
-		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search for empty metricGroup: %s", err)
 		}
@@ -538,7 +539,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		if err := tfs2.Add(nil, mn.MetricGroup, false, false); err != nil {
 			return fmt.Errorf("cannot create tag filter for MetricGroup: %s", err)
 		}
-		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs1, tfs2}, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs([]*TagFilters{tfs1, tfs2}, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search for empty metricGroup: %s", err)
 		}
@@ -547,7 +548,7 @@ func testIndexDBCheckTSIDByName(db *indexDB, mns []MetricName, tsids []TSID, isC
 		}
 
 		// Verify empty tfss
-		tsidsFound, err = db.searchTSIDs(nil, TimeRange{}, 1e5)
+		tsidsFound, err = db.searchTSIDs(nil, TimeRange{}, 1e5, nil)
 		if err != nil {
 			return fmt.Errorf("cannot search for nil tfss: %s", err)
 		}
@@ -910,3 +911,387 @@ func toTFPointers(tfs []tagFilter) []*tagFilter {
 	}
 	return tfps
 }
+
+func TestIndexDBSearchNegativeFilters(t *testing.T) {
+	metricIDCache := fastcache.New(1234)
+	metricNameCache := fastcache.New(1234)
+	defer metricIDCache.Reset()
+	defer metricNameCache.Reset()
+	const dbName = "test-index-db-negative-filters"
+	db, err := openIndexDB(dbName, metricIDCache, metricNameCache, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot open indexDB: %s", err)
+	}
+	defer func() {
+		db.MustClose()
+		if err := os.RemoveAll(dbName); err != nil {
+			t.Fatalf("cannot remove indexDB: %s", err)
+		}
+	}()
+
+	const jobsCount = 10
+	const instancesCount = 100
+	is := db.getIndexSearch()
+	var mn MetricName
+	var tsid TSID
+	var metricName []byte
+	for i := 0; i < jobsCount; i++ {
+		for j := 0; j < instancesCount; j++ {
+			mn.Reset()
+			mn.MetricGroup = []byte("up")
+			mn.AddTag("job", fmt.Sprintf("job_%d", i))
+			mn.AddTag("instance", fmt.Sprintf("instance_%d", j))
+			mn.sortTags()
+			metricName = mn.Marshal(metricName[:0])
+			if err := is.GetOrCreateTSIDByName(&tsid, metricName); err != nil {
+				t.Fatalf("cannot insert record: %s", err)
+			}
+		}
+	}
+	db.putIndexSearch(is)
+	db.tb.DebugFlush()
+
+	f := func(tfs *TagFilters, tsidsExpected int, negativeOnly bool) {
+		t.Helper()
+		negativeOnlySearchesPrev := atomic.LoadUint64(&db.negativeOnlySearches)
+		db.invalidateTagCache()
+		tsids, err := db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
+		if err != nil {
+			t.Fatalf("unexpected error when searching for tfs=%s: %s", tfs, err)
+		}
+		if len(tsids) != tsidsExpected {
+			t.Fatalf("unexpected number of tsids found for tfs=%s; got %d; want %d", tfs, len(tsids), tsidsExpected)
+		}
+		negativeOnlySearches := atomic.LoadUint64(&db.negativeOnlySearches) - negativeOnlySearchesPrev
+		if negativeOnly != (negativeOnlySearches > 0) {
+			t.Fatalf("unexpected negativeOnlySearches for tfs=%s; got %d; want %v", tfs, negativeOnlySearches, negativeOnly)
+		}
+	}
+	addFilter := func(tfs *TagFilters, key, value string, isNegative, isRegexp bool) {
+		t.Helper()
+		if err := tfs.Add([]byte(key), []byte(value), isNegative, isRegexp); err != nil {
+			t.Fatalf("cannot add tag filter: %s", err)
+		}
+	}
+
+	// A single negative filter.
+	tfs := NewTagFilters()
+	addFilter(tfs, "job", "job_1", true, false)
+	f(tfs, (jobsCount-1)*instancesCount, true)
+
+	// Multiple negative filters.
+	addFilter(tfs, "job", "job_2|job_3", true, true)
+	addFilter(tfs, "instance", "instance_1.*", true, true)
+	f(tfs, (jobsCount-3)*(instancesCount-11), true)
+
+	// A positive filter must seed the search for negative filters.
+	addFilter(tfs, "instance", "instance_2.*", false, true)
+	f(tfs, (jobsCount-3)*11, false)
+	addFilter(tfs, "", "up", false, false)
+	f(tfs, (jobsCount-3)*11, false)
+
+	// Negative filter for an empty value is converted to a positive filter.
+	tfs = NewTagFilters()
+	addFilter(tfs, "job", "", true, false)
+	addFilter(tfs, "job", "job_1", true, false)
+	f(tfs, (jobsCount-1)*instancesCount, false)
+
+	// Negative filters matching all the series.
+	tfs = NewTagFilters()
+	addFilter(tfs, "", "up", false, false)
+	addFilter(tfs, "job", "job_.+", true, true)
+	f(tfs, 0, false)
+
+	// maxMetrics must be respected for tsids found in the tag cache.
+	tfs = NewTagFilters()
+	addFilter(tfs, "job", "job_1", false, false)
+	tsids, err := db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, 1e5, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(tsids) != instancesCount {
+		t.Fatalf("unexpected number of tsids; got %d; want %d", len(tsids), instancesCount)
+	}
+	if _, err := db.searchTSIDs([]*TagFilters{tfs}, TimeRange{}, instancesCount-1, nil); err == nil {
+		t.Fatalf("expecting non-nil error for too many time series found in the tag cache")
+	}
+}
+
+func TestIndexDBSearchMetricNamesWithLimit(t *testing.T) {
+	metricIDCache := fastcache.New(1234)
+	metricNameCache := fastcache.New(1234)
+	defer metricIDCache.Reset()
+	defer metricNameCache.Reset()
+	const dbName = "test-index-db-search-metric-names-with-limit"
+	db, err := openIndexDB(dbName, metricIDCache, metricNameCache, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot open indexDB: %s", err)
+	}
+	defer func() {
+		db.MustClose()
+		if err := os.RemoveAll(dbName); err != nil {
+			t.Fatalf("cannot remove indexDB: %s", err)
+		}
+	}()
+
+	const jobsCount = 10
+	const instancesCount = 1000
+	is := db.getIndexSearch()
+	var mn MetricName
+	var tsid TSID
+	var metricName []byte
+	for i := 0; i < jobsCount; i++ {
+		for j := 0; j < instancesCount; j++ {
+			mn.Reset()
+			mn.MetricGroup = []byte("up")
+			mn.AddTag("job", fmt.Sprintf("job_%d", i))
+			mn.AddTag("instance", fmt.Sprintf("instance_%d", j))
+			mn.sortTags()
+			metricName = mn.Marshal(metricName[:0])
+			if err := is.GetOrCreateTSIDByName(&tsid, metricName); err != nil {
+				t.Fatalf("cannot insert record: %s", err)
+			}
+		}
+	}
+	db.putIndexSearch(is)
+	db.tb.DebugFlush()
+
+	f := func(tfs *TagFilters, limit, maxMetrics, mnsExpected int, isLimitedExpected bool, maxCandidatesExpected uint64) {
+		t.Helper()
+		candidatesPrev := atomic.LoadUint64(&db.limitedSeriesSearchCandidates)
+		mns, isLimited, err := db.SearchMetricNames([]*TagFilters{tfs}, TimeRange{}, limit, maxMetrics)
+		if err != nil {
+			t.Fatalf("unexpected error when searching for tfs=%s: %s", tfs, err)
+		}
+		if len(mns) != mnsExpected {
+			t.Fatalf("unexpected number of metric names found for tfs=%s; got %d; want %d", tfs, len(mns), mnsExpected)
+		}
+		if isLimited != isLimitedExpected {
+			t.Fatalf("unexpected isLimited for tfs=%s; got %v; want %v", tfs, isLimited, isLimitedExpected)
+		}
+		candidates := atomic.LoadUint64(&db.limitedSeriesSearchCandidates) - candidatesPrev
+		if candidates > maxCandidatesExpected {
+			t.Fatalf("too many candidates checked for tfs=%s; got %d; want up to %d", tfs, candidates, maxCandidatesExpected)
+		}
+		seen := make(map[string]bool)
+		for i := range mns {
+			mn := &mns[i]
+			ok, err := matchTagFilters(mn, toTFPointers(tfs.tfs), &bytesutil.ByteBuffer{})
+			if err != nil {
+				t.Fatalf("cannot match %s against tfs=%s: %s", mn, tfs, err)
+			}
+			if !ok {
+				t.Fatalf("unexpected metric name %s for tfs=%s", mn, tfs)
+			}
+			s := mn.String()
+			if seen[s] {
+				t.Fatalf("duplicate metric name %s for tfs=%s", s, tfs)
+			}
+			seen[s] = true
+		}
+	}
+	addFilter := func(tfs *TagFilters, key, value string, isNegative, isRegexp bool) {
+		t.Helper()
+		if err := tfs.Add([]byte(key), []byte(value), isNegative, isRegexp); err != nil {
+			t.Fatalf("cannot add tag filter: %s", err)
+		}
+	}
+
+	// The search must stop early for filters matching much more time series than the limit.
+	tfs := NewTagFilters()
+	addFilter(tfs, "", "up", false, false)
+	f(tfs, 10, 1e5, 10, true, 100)
+	addFilter(tfs, "job", "job_1", false, false)
+	f(tfs, 10, 1e5, 10, true, 100)
+	tfs = NewTagFilters()
+	addFilter(tfs, "instance", "instance_1.*", false, true)
+	f(tfs, 5, 1e5, 5, true, 100)
+	tfs = NewTagFilters()
+	addFilter(tfs, "job", "job_1", true, false)
+	f(tfs, 10, 1e5, 10, true, 100)
+
+	// The limit exceeds the number of matching time series.
+	tfs = NewTagFilters()
+	addFilter(tfs, "job", "job_1", false, false)
+	f(tfs, 2000, 1e5, instancesCount, false, instancesCount)
+	f(tfs, instancesCount, 1e5, instancesCount, false, instancesCount)
+	addFilter(tfs, "instance", "instance_5", false, false)
+	f(tfs, 10, 1e5, 1, false, jobsCount)
+	tfs = NewTagFilters()
+	addFilter(tfs, "instance", "instance_5|instance_7", false, true)
+	f(tfs, 100, 1e5, 2*jobsCount, false, 2*jobsCount)
+
+	// Too many candidates must be checked for finding the matching time series.
+	tfs = NewTagFilters()
+	addFilter(tfs, "", "up", false, false)
+	addFilter(tfs, "instance", "instance_.+", true, true)
+	f(tfs, 10, 100, 0, true, uint64(getMaxCandidateMetrics(100)))
+}
+
+func TestGetMaxCandidateMetrics(t *testing.T) {
+	f := func(n, maxMetrics, resultExpected int) {
+		t.Helper()
+		SetMaxCandidateMetrics(n)
+		defer SetMaxCandidateMetrics(0)
+		result := getMaxCandidateMetrics(maxMetrics)
+		if result != resultExpected {
+			t.Fatalf("unexpected getMaxCandidateMetrics(%d) for n=%d; got %d; want %d", maxMetrics, n, result, resultExpected)
+		}
+	}
+
+	f(0, 1000, 20000)
+	f(0, 1, 20)
+	f(500, 1000, 500)
+	f(1e6, 1000, 1e6)
+}
+
+func TestGetTSDBStatusForDate(t *testing.T) {
+	metricIDCache := fastcache.New(1234)
+	metricNameCache := fastcache.New(1234)
+	defer metricIDCache.Reset()
+	defer metricNameCache.Reset()
+
+	const extDBName = "test-index-db-tsdb-status-ext"
+	extDB, err := openIndexDB(extDBName, metricIDCache, metricNameCache, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot open indexDB: %s", err)
+	}
+	const dbName = "test-index-db-tsdb-status"
+	db, err := openIndexDB(dbName, metricIDCache, metricNameCache, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot open indexDB: %s", err)
+	}
+	db.SetExtDB(extDB)
+	defer func() {
+		// db.MustClose closes extDB too.
+		db.MustClose()
+		if err := os.RemoveAll(dbName); err != nil {
+			t.Fatalf("cannot remove indexDB: %s", err)
+		}
+		if err := os.RemoveAll(extDBName); err != nil {
+			t.Fatalf("cannot remove indexDB: %s", err)
+		}
+	}()
+
+	const date = 18000
+	createSeries := func(db *indexDB, metricGroup string, tags ...string) uint64 {
+		t.Helper()
+		var mn MetricName
+		mn.MetricGroup = []byte(metricGroup)
+		for i := 0; i < len(tags); i += 2 {
+			mn.AddTag(tags[i], tags[i+1])
+		}
+		mn.sortTags()
+		is := db.getIndexSearch()
+		defer db.putIndexSearch(is)
+		var tsid TSID
+		if err := is.GetOrCreateTSIDByName(&tsid, mn.Marshal(nil)); err != nil {
+			t.Fatalf("cannot create series %s: %s", &mn, err)
+		}
+		return tsid.MetricID
+	}
+	addDateEntry := func(date uint64, metricID uint64) {
+		t.Helper()
+		if err := db.storeDateMetricID(date, metricID); err != nil {
+			t.Fatalf("cannot store (date=%d, metricID=%d) entry: %s", date, metricID, err)
+		}
+	}
+
+	// Series from extDB must be taken into account if (date -> metricID) entries exist in db.
+	addDateEntry(date, createSeries(extDB, "foo", "job", "a", "instance", "host1"))
+	addDateEntry(date, createSeries(extDB, "foo", "job", "a", "instance", "host2"))
+	addDateEntry(date, createSeries(db, "foo", "job", "b", "instance", "host1"))
+	addDateEntry(date, createSeries(db, "bar", "job", "a"))
+
+	// Series without entries for the given date must be ignored.
+	addDateEntry(date+1, createSeries(db, "baz", "job", "a", "instance", "host3"))
+	createSeries(db, "qwe", "job", "c")
+
+	// Deleted series must be ignored.
+	deletedMetricID := createSeries(db, "deleted", "job", "a")
+	addDateEntry(date, deletedMetricID)
+	db.updateDeletedMetricIDs([]uint64{deletedMetricID})
+
+	db.tb.DebugFlush()
+	extDB.tb.DebugFlush()
+
+	status, err := db.GetTSDBStatusForDate(date, 2)
+	if err != nil {
+		t.Fatalf("cannot obtain TSDB status: %s", err)
+	}
+	statusExpected := &TSDBStatus{
+		TotalSeries:          4,
+		TotalLabelValuePairs: 11,
+		SeriesCountByMetricName: []TopHeapEntry{
+			{Name: "foo", Count: 3},
+			{Name: "bar", Count: 1},
+		},
+		LabelValueCountByLabelName: []TopHeapEntry{
+			{Name: "__name__", Count: 2},
+			{Name: "instance", Count: 2},
+		},
+		MemoryInBytesByLabelName: []TopHeapEntry{
+			{Name: "instance", Count: 10},
+			{Name: "__name__", Count: 6},
+		},
+		SeriesCountByLabelValuePair: []TopHeapEntry{
+			{Name: "__name__=foo", Count: 3},
+			{Name: "job=a", Count: 3},
+		},
+	}
+	if !reflect.DeepEqual(status, statusExpected) {
+		t.Fatalf("unexpected TSDB status;\ngot\n%+v\nwant\n%+v", status, statusExpected)
+	}
+
+	// Empty status for the date without entries.
+	status, err = db.GetTSDBStatusForDate(date+10, 2)
+	if err != nil {
+		t.Fatalf("cannot obtain TSDB status: %s", err)
+	}
+	if !reflect.DeepEqual(status, &TSDBStatus{}) {
+		t.Fatalf("expecting empty TSDB status; got %+v", status)
+	}
+}
+
+func TestTopHeap(t *testing.T) {
+	th := newTopHeap(3)
+	th.pushIfNonEmpty([]byte("a"), 0)
+	th.pushIfNonEmpty([]byte("b"), 1)
+	th.pushIfNonEmpty([]byte("c"), 5)
+	th.pushIfNonEmpty([]byte("d"), 3)
+	th.pushIfNonEmpty([]byte("e"), 2)
+	th.pushIfNonEmpty([]byte("f"), 4)
+	th.pushIfNonEmpty([]byte("g"), 3)
+	result := th.getSortedResult()
+	resultExpected := []TopHeapEntry{
+		{Name: "c", Count: 5},
+		{Name: "f", Count: 4},
+		{Name: "d", Count: 3},
+	}
+	if !reflect.DeepEqual(result, resultExpected) {
+		t.Fatalf("unexpected result; got %+v; want %+v", result, resultExpected)
+	}
+
+	// Zero topN must result in empty result.
+	th = newTopHeap(0)
+	th.pushIfNonEmpty([]byte("a"), 10)
+	if result := th.getSortedResult(); len(result) != 0 {
+		t.Fatalf("expecting empty result; got %+v", result)
+	}
+}
+
+func TestUnionSortedMetricIDs(t *testing.T) {
+	f := func(a, b, resultExpected []uint64) {
+		t.Helper()
+		result := unionSortedMetricIDs(a, b)
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected result for unionSortedMetricIDs(%v, %v); got %v; want %v", a, b, result, resultExpected)
+		}
+	}
+
+	f(nil, nil, nil)
+	f([]uint64{1}, nil, []uint64{1})
+	f(nil, []uint64{1}, []uint64{1})
+	f([]uint64{1, 3, 5}, []uint64{2, 3, 6, 7}, []uint64{1, 2, 3, 5, 6, 7})
+	f([]uint64{1, 2}, []uint64{1, 2}, []uint64{1, 2})
+}
@@ -130,7 +130,7 @@ func BenchmarkIndexDBSearchTSIDs(b *testing.B) {
 					panic(fmt.Errorf("BUG: unexpected error: %s", err))
 				}
 			}
-			tsids, err := db.searchTSIDs(tfss, TimeRange{}, 1e5)
+			tsids, err := db.searchTSIDs(tfss, TimeRange{}, 1e5, nil)
 			if err != nil {
 				panic(fmt.Errorf("unexpected error in search for tfs=%s: %s", &tfs, err))
 			}
@@ -142,6 +142,83 @@ func BenchmarkIndexDBSearchTSIDs(b *testing.B) {
 	})
 }
 
+func BenchmarkIndexDBSearchTSIDsNegativeFilters(b *testing.B) {
+	metricIDCache := fastcache.New(1234)
+	metricNameCache := fastcache.New(1234)
+	defer metricIDCache.Reset()
+	defer metricNameCache.Reset()
+	const dbName = "bench-index-db-search-tsids-negative-filters"
+	db, err := openIndexDB(dbName, metricIDCache, metricNameCache, nil, nil)
+	if err != nil {
+		b.Fatalf("cannot open indexDB: %s", err)
+	}
+	defer func() {
+		db.MustClose()
+		if err := os.RemoveAll(dbName); err != nil {
+			b.Fatalf("cannot remove indexDB: %s", err)
+		}
+	}()
+
+	const jobsCount = 100
+	const instancesCount = 1000
+
+	// Fill the db with jobsCount*instancesCount records.
+	var mn MetricName
+	var tsid TSID
+	var metricName []byte
+	is := db.getIndexSearch()
+	for i := 0; i < jobsCount; i++ {
+		for j := 0; j < instancesCount; j++ {
+			mn.Reset()
+			mn.MetricGroup = []byte("up")
+			mn.AddTag("job", fmt.Sprintf("job_%d", i))
+			mn.AddTag("instance", fmt.Sprintf("instance_%d", j))
+			mn.sortTags()
+			metricName = mn.Marshal(metricName[:0])
+			if err := is.GetOrCreateTSIDByName(&tsid, metricName); err != nil {
+				b.Fatalf("cannot insert record: %s", err)
+			}
+		}
+	}
+	db.putIndexSearch(is)
+	db.tb.DebugFlush()
+
+	b.SetBytes(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var tfs TagFilters
+		tfss := []*TagFilters{&tfs}
+		is := db.getIndexSearch()
+		defer db.putIndexSearch(is)
+		for pb.Next() {
+			// {job="job_1",instance!="instance_1",instance!="instance_2",instance!~"instance_3.*"}
+			// The positive filter seeds the search, while negative filters are applied to the found metricIDs.
+			tfs.Reset()
+			if err := tfs.Add([]byte("job"), []byte("job_1"), false, false); err != nil {
+				panic(fmt.Errorf("BUG: unexpected error: %s", err))
+			}
+			if err := tfs.Add([]byte("instance"), []byte("instance_1"), true, false); err != nil {
+				panic(fmt.Errorf("BUG: unexpected error: %s", err))
+			}
+			if err := tfs.Add([]byte("instance"), []byte("instance_2"), true, false); err != nil {
+				panic(fmt.Errorf("BUG: unexpected error: %s", err))
+			}
+			if err := tfs.Add([]byte("instance"), []byte("instance_3.*"), true, true); err != nil {
+				panic(fmt.Errorf("BUG: unexpected error: %s", err))
+			}
+			// Use indexSearch directly in order to bypass the tag cache.
+			tsids, err := is.searchTSIDs(tfss, TimeRange{}, 1e5)
+			if err != nil {
+				panic(fmt.Errorf("unexpected error in search for tfs=%s: %s", &tfs, err))
+			}
+			if len(tsids) != instancesCount-113 {
+				panic(fmt.Errorf("unexpected number of tsids found for tfs=%s; got %d; want %d", &tfs, len(tsids), instancesCount-113))
+			}
+		}
+	})
+}
+
 func BenchmarkIndexDBGetTSIDs(b *testing.B) {
 	metricIDCache := fastcache.New(1234)
 	metricNameCache := fastcache.New(1234)
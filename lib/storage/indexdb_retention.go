@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+// SetIndexDBRetention sets the interval for indexdb rotation.
+//
+// Inactive time series are removed from the index searched by default after up to 2*retention,
+// since the rotated-out indexdb tables are searched only for time ranges preceding their rotation.
+// The rotated-out tables are dropped when all the data they refer to falls outside the data retention,
+// so the data remains searchable during the whole retention.
+//
+// indexdb is rotated together with the data retention if retention is 0 or if it exceeds the data retention.
+//
+// This function must be called before initializing the storage.
+func SetIndexDBRetention(retention time.Duration) {
+	indexDBRetentionMsecs = retention.Nanoseconds() / 1e6
+}
+
+var indexDBRetentionMsecs = int64(0)
+
+// archivedIndexDB is an indexdb table rotated out of the curr and prev indexdb tables.
+type archivedIndexDB struct {
+	db *indexDB
+
+	// endTimestamp is the time in milliseconds when db stopped accepting new entries.
+	// db doesn't contain entries for samples newer than endTimestamp.
+	endTimestamp int64
+}
+
+// indexDBTableNameTimestamp returns the creation time in milliseconds for the indexdb table with the given name.
+//
+// See nextIndexDBTableName for details.
+func indexDBTableNameTimestamp(name string) int64 {
+	n, err := strconv.ParseUint(name, 16, 64)
+	if err != nil {
+		logger.Panicf("BUG: unexpected indexdb table name %q: %s", name, err)
+	}
+	return int64(n / 1e6)
+}
+
+// nextIndexDBRotationDuration returns the duration until the next indexdb rotation
+// for the given retentionMsecs.
+//
+// Rotations are aligned to retentionMsecs since Unix epoch.
+func nextIndexDBRotationDuration(retentionMsecs int64) time.Duration {
+	now := timestampFromTime(time.Now())
+	deadline := (now/retentionMsecs + 1) * retentionMsecs
+	return time.Duration(deadline-now) * time.Millisecond
+}
+
+func (s *Storage) archiveIndexDB(db *indexDB, endTimestamp int64) {
+	s.archivedIDBsLock.Lock()
+	s.archivedIDBs = append(s.archivedIDBs, &archivedIndexDB{
+		db:           db,
+		endTimestamp: endTimestamp,
+	})
+	s.archivedIDBsLock.Unlock()
+	logger.Infof("archived indexDB %q; it is searched only for time ranges preceding %s and is dropped after the data retention",
+		db.name, time.Unix(endTimestamp/1e3, 0).UTC().Format(time.RFC3339))
+}
+
+// dropExpiredArchivedIndexDBs drops archived indexdb tables, which refer only to data outside the retention.
+func (s *Storage) dropExpiredArchivedIndexDBs() {
+	minTimestamp := timestampFromTime(time.Now()) - s.retentionMsecs
+	var dropped []*indexDB
+	s.archivedIDBsLock.Lock()
+	archived := make([]*archivedIndexDB, 0, len(s.archivedIDBs))
+	for _, a := range s.archivedIDBs {
+		if a.endTimestamp >= minTimestamp {
+			archived = append(archived, a)
+			continue
+		}
+		dropped = append(dropped, a.db)
+	}
+	s.archivedIDBs = archived
+	s.archivedIDBsLock.Unlock()
+
+	for _, db := range dropped {
+		db.scheduleToDrop()
+		db.MustClose()
+		atomic.AddUint64(&s.archivedIndexDBsDropped, 1)
+	}
+}
+
+// getArchivedIndexDBs returns archived indexdb tables containing entries for samples newer than minTimestamp.
+//
+// The newest tables are returned first. The caller must call putArchivedIndexDBs on the returned tables.
+func (s *Storage) getArchivedIndexDBs(minTimestamp int64) []*indexDB {
+	var dbs []*indexDB
+	s.archivedIDBsLock.Lock()
+	for i := len(s.archivedIDBs) - 1; i >= 0; i-- {
+		a := s.archivedIDBs[i]
+		if a.endTimestamp < minTimestamp {
+			continue
+		}
+		a.db.incRef()
+		dbs = append(dbs, a.db)
+	}
+	s.archivedIDBsLock.Unlock()
+	return dbs
+}
+
+func putArchivedIndexDBs(dbs []*indexDB) {
+	for _, db := range dbs {
+		db.decRef()
+	}
+}
+
+// searchArchivedTSIDs adds TSIDs matching tfss on the given tr from archived indexdb tables to tsids.
+//
+// This is a fallback path for series, which have been rotated out of the curr and prev indexdb tables,
+// while their data is still within the retention.
+func (s *Storage) searchArchivedTSIDs(tsids []TSID, tfss []*TagFilters, tr TimeRange, maxMetrics int, stopCh <-chan struct{}) ([]TSID, error) {
+	if len(tfss) == 0 {
+		return tsids, nil
+	}
+	dbs := s.getArchivedIndexDBs(tr.MinTimestamp)
+	if len(dbs) == 0 {
+		return tsids, nil
+	}
+	defer putArchivedIndexDBs(dbs)
+	atomic.AddUint64(&s.archivedIndexDBSearches, 1)
+
+	tfKeyBuf := tagFiltersKeyBufPool.Get()
+	defer tagFiltersKeyBufPool.Put(tfKeyBuf)
+	tfKeyBuf.B = marshalTagFiltersKeyVersioned(tfKeyBuf.B[:0], tfss)
+	for _, db := range dbs {
+		archivedTSIDs, ok := db.getFromTagCache(tfKeyBuf.B)
+		if !ok {
+			is := db.getIndexSearch()
+			is.stopCh = stopCh
+			var err error
+			archivedTSIDs, err = is.searchTSIDs(tfss, tr, maxMetrics)
+			db.putIndexSearch(is)
+			if err != nil {
+				if _, ok := err.(*TooManyTimeseriesError); ok {
+					return nil, err
+				}
+				return nil, fmt.Errorf("error when searching archived indexDB %q: %s", db.name, err)
+			}
+			db.putToTagCache(archivedTSIDs, tfKeyBuf.B)
+		}
+		tsids = mergeTSIDs(tsids, archivedTSIDs)
+	}
+
+	// The found tsids must be passed to TSID search in the sorted order.
+	sort.Slice(tsids, func(i, j int) bool { return tsids[i].Less(&tsids[j]) })
+	return tsids, nil
+}
+
+// searchArchivedMetricName appends metric name for the given metricID from archived indexdb tables to dst.
+//
+// It returns io.EOF if the metricID isn't found.
+func (s *Storage) searchArchivedMetricName(dst []byte, metricID uint64) ([]byte, error) {
+	dbs := s.getArchivedIndexDBs(0)
+	defer putArchivedIndexDBs(dbs)
+	for _, db := range dbs {
+		is := db.getIndexSearch()
+		var err error
+		dst, err = is.searchMetricName(dst, metricID)
+		db.putIndexSearch(is)
+		if err != io.EOF {
+			return dst, err
+		}
+	}
+	return dst, io.EOF
+}
+
+// searchArchivedStrings adds strings returned by search from archived indexdb tables
+// containing entries for samples newer than minTimestamp to dst.
+//
+// It is used for adding tag keys and tag values for series rotated out of the curr and prev indexdb tables.
+// Up to maxItems unique strings are returned.
+func (s *Storage) searchArchivedStrings(dst []string, minTimestamp int64, maxItems int, search func(db *indexDB) ([]string, error)) ([]string, error) {
+	if len(dst) >= maxItems {
+		return dst, nil
+	}
+	dbs := s.getArchivedIndexDBs(minTimestamp)
+	if len(dbs) == 0 {
+		return dst, nil
+	}
+	defer putArchivedIndexDBs(dbs)
+	atomic.AddUint64(&s.archivedIndexDBSearches, 1)
+
+	m := make(map[string]struct{}, len(dst))
+	for _, v := range dst {
+		m[v] = struct{}{}
+	}
+	for _, db := range dbs {
+		a, err := search(db)
+		if err != nil {
+			return nil, fmt.Errorf("error when searching archived indexDB %q: %s", db.name, err)
+		}
+		for _, v := range a {
+			if len(dst) >= maxItems {
+				return dst, nil
+			}
+			if _, ok := m[v]; ok {
+				continue
+			}
+			m[v] = struct{}{}
+			dst = append(dst, v)
+		}
+	}
+	return dst, nil
+}
+
+// searchArchivedMetricNames adds up to limit metric names for time series matching tfss on the given tr
+// from archived indexdb tables to mns.
+//
+// The returned bool is set to true if more than limit time series match tfss.
+func (s *Storage) searchArchivedMetricNames(mns []MetricName, tfss []*TagFilters, tr TimeRange, limit, maxMetrics int) ([]MetricName, bool, error) {
+	dbs := s.getArchivedIndexDBs(tr.MinTimestamp)
+	if len(dbs) == 0 {
+		return mns, false, nil
+	}
+	defer putArchivedIndexDBs(dbs)
+	atomic.AddUint64(&s.archivedIndexDBSearches, 1)
+
+	seen := make(map[string]struct{}, len(mns))
+	var buf []byte
+	for i := range mns {
+		buf = mns[i].Marshal(buf[:0])
+		seen[string(buf)] = struct{}{}
+	}
+	for _, db := range dbs {
+		if len(mns) >= limit {
+			return mns, true, nil
+		}
+		archivedMNs, isLimited, err := db.SearchMetricNames(tfss, tr, limit-len(mns), maxMetrics)
+		if err != nil {
+			return nil, false, fmt.Errorf("error when searching archived indexDB %q: %s", db.name, err)
+		}
+		for i := range archivedMNs {
+			mn := &archivedMNs[i]
+			buf = mn.Marshal(buf[:0])
+			if _, ok := seen[string(buf)]; ok {
+				continue
+			}
+			seen[string(buf)] = struct{}{}
+			mns = append(mns, *mn)
+		}
+		if isLimited {
+			return mns, true, nil
+		}
+	}
+	return mns, false, nil
+}
+
+// deleteArchivedMetrics deletes metrics matching tfss from archived indexdb tables.
+//
+// The deleted metricIDs are propagated to the curr indexdb, so their data isn't returned from search.
+func (s *Storage) deleteArchivedMetrics(tfss []*TagFilters) (int, error) {
+	dbs := s.getArchivedIndexDBs(0)
+	defer putArchivedIndexDBs(dbs)
+	deletedCount := 0
+	for _, db := range dbs {
+		n, err := db.DeleteTSIDs(tfss)
+		if err != nil {
+			return deletedCount, fmt.Errorf("cannot delete tsids in archived indexDB %q: %s", db.name, err)
+		}
+		deletedCount += n
+		s.mergeArchivedDeletedMetricIDs(db)
+	}
+	return deletedCount, nil
+}
+
+func (s *Storage) mergeArchivedDeletedMetricIDs(db *indexDB) {
+	metricIDs := getSortedMetricIDs(db.getDeletedMetricIDs())
+	s.idb().updateDeletedMetricIDs(metricIDs)
+}
+
+func (s *Storage) updateArchivedIndexDBMetrics(m *Metrics) {
+	m.IndexDBRotations += atomic.LoadUint64(&s.indexDBRotations)
+	m.ArchivedIndexDBsDropped += atomic.LoadUint64(&s.archivedIndexDBsDropped)
+	m.ArchivedIndexDBSearches += atomic.LoadUint64(&s.archivedIndexDBSearches)
+
+	dbs := s.getArchivedIndexDBs(0)
+	defer putArchivedIndexDBs(dbs)
+	m.ArchivedIndexDBs += uint64(len(dbs))
+	for _, db := range dbs {
+		db.tb.UpdateMetrics(&m.ArchivedIndexDBTableMetrics)
+	}
+}
+
+func (s *Storage) mustCloseArchivedIndexDBs() {
+	s.archivedIDBsLock.Lock()
+	archived := s.archivedIDBs
+	s.archivedIDBs = nil
+	s.archivedIDBsLock.Unlock()
+	for _, a := range archived {
+		a.db.MustClose()
+	}
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNextIndexDBRotationDuration(t *testing.T) {
+	for _, retention := range []time.Duration{time.Second, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour} {
+		d := nextIndexDBRotationDuration(retention.Nanoseconds() / 1e6)
+		if d <= 0 || d > retention {
+			t.Fatalf("unexpected rotation duration for retention=%s; got %s; must be in the range (0 ... %s]", retention, d, retention)
+		}
+	}
+}
+
+func TestIndexDBTableNameTimestamp(t *testing.T) {
+	startTimestamp := timestampFromTime(time.Now())
+	prevName := ""
+	for i := 0; i < 100; i++ {
+		name := nextIndexDBTableName()
+		if !indexDBTableNameRegexp.MatchString(name) {
+			t.Fatalf("unexpected indexdb table name: %q", name)
+		}
+		if name <= prevName {
+			t.Fatalf("indexdb table names must increase; got %q after %q", name, prevName)
+		}
+		prevName = name
+		timestamp := indexDBTableNameTimestamp(name)
+		if timestamp < startTimestamp || timestamp > timestampFromTime(time.Now()) {
+			t.Fatalf("unexpected timestamp for indexdb table %q; got %d; must be in the range [%d ... now]", name, timestamp, startTimestamp)
+		}
+	}
+}
+
+func TestStorageIndexDBRetention(t *testing.T) {
+	SetIndexDBRetention(time.Hour)
+	defer SetIndexDBRetention(0)
+
+	path := "TestStorageIndexDBRetention"
+	s, err := OpenStorage(path, 1)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	defer func() {
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	timestamp := timestampFromTime(time.Now()) - 3600*1000
+	addRow := func(job string) {
+		t.Helper()
+		mn := MetricName{
+			MetricGroup: []byte("metric"),
+			Tags: []Tag{
+				{[]byte("job"), []byte(job)},
+			},
+		}
+		mrs := []MetricRow{{
+			MetricNameRaw: mn.marshalRaw(nil),
+			Timestamp:     timestamp,
+			Value:         1,
+		}}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding rows: %s", err)
+		}
+		s.DebugFlush()
+	}
+	newJobFilters := func(job string) []*TagFilters {
+		t.Helper()
+		tfs := NewTagFilters()
+		if err := tfs.Add([]byte("job"), []byte(job), false, false); err != nil {
+			t.Fatalf("cannot add job tag filter: %s", err)
+		}
+		return []*TagFilters{tfs}
+	}
+	tr := TimeRange{
+		MinTimestamp: timestamp - 1000,
+		MaxTimestamp: timestamp + 1000,
+	}
+	// searchRows returns the number of rows for the given job on the given tr.
+	searchRows := func(job string, tr TimeRange) int {
+		t.Helper()
+		rows := 0
+		var sr Search
+		sr.Init(s, newJobFilters(job), tr, 1e5)
+		for sr.NextMetricBlock() {
+			var mn MetricName
+			if err := mn.Unmarshal(sr.MetricBlock.MetricName); err != nil {
+				t.Fatalf("cannot unmarshal metric name: %s", err)
+			}
+			if string(mn.GetTagValue("job")) != job {
+				t.Fatalf("unexpected metric name found: %s", &mn)
+			}
+			rows += sr.MetricBlock.Block.RowsCount()
+		}
+		if err := sr.Error(); err != nil {
+			t.Fatalf("unexpected error in search: %s", err)
+		}
+		sr.MustClose()
+		return rows
+	}
+	searchRowsFallback := func(job string) int {
+		t.Helper()
+		// Reset MetricID -> MetricName cache, so metric names are searched in archived indexdb tables.
+		s.metricNameCache.Reset()
+		return searchRows(job, tr)
+	}
+	checkArchivedIndexDBs := func(nExpected int) {
+		t.Helper()
+		var m Metrics
+		s.UpdateMetrics(&m)
+		if m.ArchivedIndexDBs != uint64(nExpected) {
+			t.Fatalf("unexpected number of archived indexdb tables; got %d; want %d", m.ArchivedIndexDBs, nExpected)
+		}
+	}
+	checkIndexDBDirs := func(nExpected int) {
+		t.Helper()
+		fis, err := ioutil.ReadDir(path + "/indexdb")
+		if err != nil {
+			t.Fatalf("cannot read indexdb dir: %s", err)
+		}
+		n := 0
+		for _, fi := range fis {
+			if indexDBTableNameRegexp.MatchString(fi.Name()) {
+				n++
+			}
+		}
+		if n != nExpected {
+			t.Fatalf("unexpected number of indexdb tables on disk; got %d; want %d", n, nExpected)
+		}
+	}
+
+	addRow("stale")
+	addRow("deleted")
+
+	// Rotate indexdb twice, so the stale series moves from idbCurr to an archived table.
+	s.mustRotateIndexDB()
+	s.mustRotateIndexDB()
+	addRow("active")
+	checkArchivedIndexDBs(2)
+	checkIndexDBDirs(4)
+	tsids, err := s.idb().searchTSIDs(newJobFilters("stale"), tr, 1e5, nil)
+	if err != nil {
+		t.Fatalf("unexpected error when searching tsids: %s", err)
+	}
+	if len(tsids) != 0 {
+		t.Fatalf("stale series must be removed from the curr and prev indexdb; found %d tsids", len(tsids))
+	}
+
+	// The data for the stale series is found via archived indexdb tables.
+	if n := searchRowsFallback("stale"); n != 1 {
+		t.Fatalf("unexpected number of rows for stale series; got %d; want 1", n)
+	}
+	if n := searchRowsFallback("active"); n != 1 {
+		t.Fatalf("unexpected number of rows for active series; got %d; want 1", n)
+	}
+
+	// Tag values and metric names for the stale series are found via archived indexdb tables.
+	hasString := func(a []string, s string) bool {
+		for _, v := range a {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	values, err := s.SearchTagValues([]byte("job"), 1e5)
+	if err != nil {
+		t.Fatalf("cannot search tag values: %s", err)
+	}
+	if !hasString(values, "stale") || !hasString(values, "active") {
+		t.Fatalf("unexpected tag values for job; got %q; want stale and active values", values)
+	}
+	values, err = s.SearchTagValuesOnTimeRange([]byte("job"), nil, tr, 1e5, 1e5)
+	if err != nil {
+		t.Fatalf("cannot search tag values on time range: %s", err)
+	}
+	if !hasString(values, "stale") || !hasString(values, "active") {
+		t.Fatalf("unexpected tag values for job on time range; got %q; want stale and active values", values)
+	}
+	keys, err := s.SearchTagKeysOnTimeRange(newJobFilters("stale"), tr, 1e5, 1e5)
+	if err != nil {
+		t.Fatalf("cannot search tag keys on time range: %s", err)
+	}
+	if !hasString(keys, "job") {
+		t.Fatalf("unexpected tag keys for stale series; got %q; want job key", keys)
+	}
+	mns, _, err := s.SearchMetricNames(newJobFilters("stale"), tr, 1e5, 1e5)
+	if err != nil {
+		t.Fatalf("cannot search metric names: %s", err)
+	}
+	if len(mns) != 1 || string(mns[0].GetTagValue("job")) != "stale" {
+		t.Fatalf("unexpected metric names for stale series; got %v; want a single stale series", mns)
+	}
+
+	// Archived indexdb tables aren't searched for time ranges after their rotation.
+	var m Metrics
+	s.UpdateMetrics(&m)
+	searchesPrev := m.ArchivedIndexDBSearches
+	trRecent := TimeRange{
+		MinTimestamp: timestampFromTime(time.Now()) + 3600*1000,
+		MaxTimestamp: timestampFromTime(time.Now()) + 2*3600*1000,
+	}
+	if n := searchRows("stale", trRecent); n != 0 {
+		t.Fatalf("unexpected number of rows for stale series on recent time range; got %d; want 0", n)
+	}
+	m.Reset()
+	s.UpdateMetrics(&m)
+	if m.ArchivedIndexDBSearches != searchesPrev {
+		t.Fatalf("unexpected search in archived indexdb tables for recent time range")
+	}
+
+	// Series are deleted from archived indexdb tables.
+	if _, err := s.DeleteMetrics(newJobFilters("deleted")); err != nil {
+		t.Fatalf("cannot delete metrics: %s", err)
+	}
+	if n := searchRowsFallback("deleted"); n != 0 {
+		t.Fatalf("unexpected number of rows for deleted series; got %d; want 0", n)
+	}
+
+	// Archived indexdb tables survive restart.
+	s.MustClose()
+	s, err = OpenStorage(path, 1)
+	if err != nil {
+		t.Fatalf("cannot re-open storage: %s", err)
+	}
+	checkArchivedIndexDBs(2)
+	if n := searchRowsFallback("stale"); n != 1 {
+		t.Fatalf("unexpected number of rows for stale series after restart; got %d; want 1", n)
+	}
+	if n := searchRowsFallback("deleted"); n != 0 {
+		t.Fatalf("unexpected number of rows for deleted series after restart; got %d; want 0", n)
+	}
+
+	// Archived indexdb tables are dropped when they refer only to data outside the retention.
+	s.archivedIDBsLock.Lock()
+	for _, a := range s.archivedIDBs {
+		a.endTimestamp -= s.retentionMsecs + 1
+	}
+	s.archivedIDBsLock.Unlock()
+	s.dropExpiredArchivedIndexDBs()
+	checkArchivedIndexDBs(0)
+	checkIndexDBDirs(2)
+	m.Reset()
+	s.UpdateMetrics(&m)
+	if m.ArchivedIndexDBsDropped != 2 {
+		t.Fatalf("unexpected number of dropped archived indexdb tables; got %d; want 2", m.ArchivedIndexDBsDropped)
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+// MaxLabelLenLimit is the maximum value, which may be passed to SetLabelLimits for metric name and label lengths.
+//
+// Metric names and labels are marshaled with 16-bit length prefix, so they cannot exceed 64KB.
+// MarshalMetricNameRaw needs an additional byte for detecting too long names and values.
+const MaxLabelLenLimit = 64*1024 - 2
+
+// SetLabelLimits sets limits on the length of metric name, label name and label value
+// and on the number of labels per each time series.
+//
+// Samples exceeding the limits are dropped instead of being stored.
+// Every limit must be in the range [1 ... MaxLabelLenLimit].
+//
+// This function must be called before initializing the storage.
+func SetLabelLimits(maxMetricNameLength, maxLabelNameLength, maxLabelValueLength, maxLabels int) {
+	maxMetricNameLen = maxMetricNameLength
+	maxLabelNameLen = maxLabelNameLength
+	maxLabelValueLen = maxLabelValueLength
+	maxLabelsPerTimeseries = maxLabels
+}
+
+var (
+	maxMetricNameLen       = 16 * 1024
+	maxLabelNameLen        = 256
+	maxLabelValueLen       = 16 * 1024
+	maxLabelsPerTimeseries = 30
+)
+
+// checkLabelLimits returns false if metricNameRaw exceeds the limits set via SetLabelLimits.
+//
+// It doesn't allocate memory, so oversized metric names are dropped before being unmarshaled.
+// Malformed metricNameRaw passes the check, so the error is reported by MetricName.UnmarshalRaw.
+func (s *Storage) checkLabelLimits(metricNameRaw []byte) bool {
+	labelsCount := 0
+	src := metricNameRaw
+	for len(src) > 0 {
+		tail, key, err := unmarshalBytesFast(src)
+		if err != nil {
+			return true
+		}
+		tail, value, err := unmarshalBytesFast(tail)
+		if err != nil {
+			return true
+		}
+		src = tail
+
+		labelsCount++
+		if labelsCount > maxLabelsPerTimeseries {
+			atomic.AddUint64(&s.tooManyLabelsRowsDropped, 1)
+			logDroppedSample("", nil, "the number of labels exceeds -maxLabelsPerTimeseries", maxLabelsPerTimeseries)
+			return false
+		}
+		if len(key) == 0 {
+			if len(value) > maxMetricNameLen {
+				atomic.AddUint64(&s.tooLongMetricNameRowsDropped, 1)
+				logDroppedSample("__name__", value, "the metric name length exceeds -maxMetricNameLen", maxMetricNameLen)
+				return false
+			}
+			continue
+		}
+		if len(key) > maxLabelNameLen {
+			atomic.AddUint64(&s.tooLongLabelNameRowsDropped, 1)
+			logDroppedSample("", key, "the label name length exceeds -maxLabelNameLen", maxLabelNameLen)
+			return false
+		}
+		if len(value) > maxLabelValueLen {
+			atomic.AddUint64(&s.tooLongLabelValueRowsDropped, 1)
+			logDroppedSample(string(key), value, "the label value length exceeds -maxLabelValueLen", maxLabelValueLen)
+			return false
+		}
+	}
+	return true
+}
+
+// logDroppedSample logs a sample dropped because of the label limits.
+//
+// It logs at most a single sample per 5 seconds in order to prevent from log flooding.
+// Only a short prefix of the oversized data is logged.
+func logDroppedSample(labelName string, data []byte, reason string, limit int) {
+	now := uint64(time.Now().Unix())
+	lastLogTime := atomic.LoadUint64(&droppedSampleLastLogTime)
+	if now < lastLogTime+5 || !atomic.CompareAndSwapUint64(&droppedSampleLastLogTime, lastLogTime, now) {
+		return
+	}
+	if data == nil {
+		logger.Warnf("dropping sample, since %s=%d", reason, limit)
+		return
+	}
+	prefix := data
+	if len(prefix) > maxLoggedPrefixLen {
+		prefix = prefix[:maxLoggedPrefixLen]
+	}
+	if labelName != "" {
+		logger.Warnf("dropping sample with %s=%q... with length %d, since %s=%d", labelName, prefix, len(data), reason, limit)
+		return
+	}
+	logger.Warnf("dropping sample with label name %q... with length %d, since %s=%d", prefix, len(data), reason, limit)
+}
+
+const maxLoggedPrefixLen = 64
+
+var droppedSampleLastLogTime uint64
+
+func (s *Storage) updateLabelLimitsMetrics(m *Metrics) {
+	m.TooLongMetricNameRowsDropped += atomic.LoadUint64(&s.tooLongMetricNameRowsDropped)
+	m.TooLongLabelNameRowsDropped += atomic.LoadUint64(&s.tooLongLabelNameRowsDropped)
+	m.TooLongLabelValueRowsDropped += atomic.LoadUint64(&s.tooLongLabelValueRowsDropped)
+	m.TooManyLabelsRowsDropped += atomic.LoadUint64(&s.tooManyLabelsRowsDropped)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestCheckLabelLimits(t *testing.T) {
+	SetLabelLimits(10, 5, 8, 3)
+	defer SetLabelLimits(16*1024, 256, 16*1024, 30)
+
+	f := func(labels []prompb.Label, okExpected bool, m *Metrics) {
+		t.Helper()
+		var s Storage
+		metricNameRaw := MarshalMetricNameRaw(nil, labels)
+		ok := s.checkLabelLimits(metricNameRaw)
+		if ok != okExpected {
+			t.Fatalf("unexpected checkLabelLimits result for %s; got %v; want %v", labels, ok, okExpected)
+		}
+		var mGot Metrics
+		s.updateLabelLimitsMetrics(&mGot)
+		if mGot.TooLongMetricNameRowsDropped != m.TooLongMetricNameRowsDropped ||
+			mGot.TooLongLabelNameRowsDropped != m.TooLongLabelNameRowsDropped ||
+			mGot.TooLongLabelValueRowsDropped != m.TooLongLabelValueRowsDropped ||
+			mGot.TooManyLabelsRowsDropped != m.TooManyLabelsRowsDropped {
+			t.Fatalf("unexpected metrics for %s; got %+v; want %+v", labels, mGot, m)
+		}
+	}
+	newLabels := func(nameValues ...string) []prompb.Label {
+		var labels []prompb.Label
+		for i := 0; i < len(nameValues); i += 2 {
+			labels = append(labels, prompb.Label{
+				Name:  []byte(nameValues[i]),
+				Value: []byte(nameValues[i+1]),
+			})
+		}
+		return labels
+	}
+
+	// Within limits
+	f(newLabels("", "foo"), true, &Metrics{})
+	f(newLabels("__name__", "0123456789", "abcde", "01234567", "x", "y"), true, &Metrics{})
+
+	// Labels without values aren't counted
+	f(newLabels("", "foo", "a", "b", "c", "", "d", "e"), true, &Metrics{})
+
+	// Too long metric name
+	f(newLabels("", "01234567890"), false, &Metrics{TooLongMetricNameRowsDropped: 1})
+	f(newLabels("__name__", strings.Repeat("x", 1024*1024)), false, &Metrics{TooLongMetricNameRowsDropped: 1})
+
+	// Too long label name
+	f(newLabels("", "foo", "abcdef", "bar"), false, &Metrics{TooLongLabelNameRowsDropped: 1})
+
+	// Too long label value
+	f(newLabels("", "foo", "a", "012345678"), false, &Metrics{TooLongLabelValueRowsDropped: 1})
+	f(newLabels("", "foo", "a", strings.Repeat("x", 1024*1024)), false, &Metrics{TooLongLabelValueRowsDropped: 1})
+
+	// Too many labels
+	f(newLabels("", "foo", "a", "b", "c", "d", "e", "f"), false, &Metrics{TooManyLabelsRowsDropped: 1})
+}
+
+func TestMarshalMetricNameRawTruncatesOversizedLabels(t *testing.T) {
+	SetLabelLimits(10, 5, 8, 3)
+	defer SetLabelLimits(16*1024, 256, 16*1024, 30)
+
+	labels := []prompb.Label{
+		{Name: []byte("__name__"), Value: []byte(strings.Repeat("x", 1024*1024))},
+		{Name: []byte(strings.Repeat("a", 1024)), Value: []byte(strings.Repeat("y", 1024*1024))},
+		{Name: []byte("b"), Value: []byte("c")},
+		{Name: []byte("d"), Value: []byte("e")},
+		{Name: []byte("f"), Value: []byte("g")},
+	}
+	metricNameRaw := MarshalMetricNameRaw(nil, labels)
+
+	// The metric name and two labels must be truncated by a single byte over the limit.
+	// Superfluous labels must be dropped except of a single label over the limit.
+	sizeExpected := (2 + 0 + 2 + 11) + (2 + 6 + 2 + 9) + (2 + 1 + 2 + 1) + (2 + 1 + 2 + 1)
+	if len(metricNameRaw) != sizeExpected {
+		t.Fatalf("unexpected size of marshaled metric name; got %d; want %d", len(metricNameRaw), sizeExpected)
+	}
+	var s Storage
+	if s.checkLabelLimits(metricNameRaw) {
+		t.Fatalf("expecting the truncated metric name to exceed the limits")
+	}
+}
+
+func TestMarshalMetricNameRawSkipsEmptyLabels(t *testing.T) {
+	SetLabelLimits(16*1024, 256, 16*1024, 3)
+	defer SetLabelLimits(16*1024, 256, 16*1024, 30)
+
+	// Labels with empty values are dropped, so they mustn't be counted against the limit on the number of labels.
+	labels := []prompb.Label{
+		{Name: []byte("__name__"), Value: []byte("foo")},
+		{Name: []byte("a"), Value: nil},
+		{Name: []byte("b"), Value: nil},
+		{Name: []byte("c"), Value: nil},
+		{Name: []byte("d"), Value: []byte("e")},
+		{Name: []byte("f"), Value: nil},
+		{Name: []byte("g"), Value: []byte("h")},
+	}
+	metricNameRaw := MarshalMetricNameRaw(nil, labels)
+	var mn MetricName
+	if err := mn.UnmarshalRaw(metricNameRaw); err != nil {
+		t.Fatalf("cannot unmarshal metric name: %s", err)
+	}
+	if s := mn.String(); s != `MetricGroup="foo", tags=["d"="e", "g"="h"]` {
+		t.Fatalf("unexpected metric name; got %s; want %s", s, `MetricGroup="foo", tags=["d"="e", "g"="h"]`)
+	}
+	var s Storage
+	if !s.checkLabelLimits(metricNameRaw) {
+		t.Fatalf("the metric name mustn't exceed the limits")
+	}
+
+	// A single non-empty label over the limit must be marshaled, so the sample is dropped by the storage.
+	labels = append(labels, prompb.Label{Name: []byte("i"), Value: []byte("j")}, prompb.Label{Name: []byte("k"), Value: []byte("l")})
+	metricNameRaw = MarshalMetricNameRaw(nil, labels)
+	mn.Reset()
+	if err := mn.UnmarshalRaw(metricNameRaw); err != nil {
+		t.Fatalf("cannot unmarshal metric name: %s", err)
+	}
+	if s := mn.String(); s != `MetricGroup="foo", tags=["d"="e", "g"="h", "i"="j"]` {
+		t.Fatalf("unexpected metric name; got %s; want %s", s, `MetricGroup="foo", tags=["d"="e", "g"="h", "i"="j"]`)
+	}
+	if s.checkLabelLimits(metricNameRaw) {
+		t.Fatalf("expecting the metric name to exceed the limits")
+	}
+}
+
+func TestStorageLabelLimits(t *testing.T) {
+	SetLabelLimits(16*1024, 256, 16, 30)
+	defer SetLabelLimits(16*1024, 256, 16*1024, 30)
+
+	path := "TestStorageLabelLimits"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	now := timestampFromTime(time.Now())
+	var mrs []MetricRow
+	for _, job := range []string{"job_1", strings.Repeat("x", 1024*1024), "job_2"} {
+		labels := []prompb.Label{
+			{Name: []byte("__name__"), Value: []byte("metric")},
+			{Name: []byte("job"), Value: []byte(job)},
+		}
+		mrs = append(mrs, MetricRow{
+			MetricNameRaw: MarshalMetricNameRaw(nil, labels),
+			Timestamp:     now,
+			Value:         1,
+		})
+	}
+	if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+		t.Fatalf("unexpected error when adding mrs: %s", err)
+	}
+	s.DebugFlush()
+
+	timestamps, err := getTimestampsByJob(s)
+	if err != nil {
+		t.Fatalf("cannot obtain timestamps: %s", err)
+	}
+	if len(timestamps) != 2 {
+		t.Fatalf("unexpected number of series; got %d; want 2; series: %v", len(timestamps), timestamps)
+	}
+	for _, job := range []string{"job_1", "job_2"} {
+		if len(timestamps[job]) != 1 {
+			t.Fatalf("unexpected number of samples for %q; got %d; want 1", job, len(timestamps[job]))
+		}
+	}
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if m.TooLongLabelValueRowsDropped != 1 {
+		t.Fatalf("unexpected number of rows dropped because of too long label value; got %d; want 1", m.TooLongLabelValueRowsDropped)
+	}
+	s.MustClose()
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
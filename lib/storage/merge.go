@@ -3,6 +3,7 @@ package storage
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
@@ -13,13 +14,17 @@ import (
 // mergeBlockStreams returns immediately if stopCh is closed.
 //
 // rowsMerged is atomically updated with the number of merged rows during the merge.
+//
+// Blocks for deletedMetricIDs and rows outside rd are dropped during the merge.
+// rd may be nil. Samples are downsampled according to SetDownsamplingPeriods
+// and per-metricID downsampling filters from md. md may be nil.
 func mergeBlockStreams(ph *partHeader, bsw *blockStreamWriter, bsrs []*blockStreamReader, stopCh <-chan struct{}, rowsMerged *uint64,
-	deletedMetricIDs map[uint64]struct{}, rowsDeleted *uint64) error {
+	deletedMetricIDs map[uint64]struct{}, rd *retentionDeadlines, md *metricIDDownsampling, rowsDeleted *uint64) error {
 	ph.Reset()
 
 	bsm := bsmPool.Get().(*blockStreamMerger)
 	bsm.Init(bsrs)
-	err := mergeBlockStreamsInternal(ph, bsw, bsm, stopCh, rowsMerged, deletedMetricIDs, rowsDeleted)
+	err := mergeBlockStreamsInternal(ph, bsw, bsm, stopCh, rowsMerged, deletedMetricIDs, rd, md, rowsDeleted)
 	bsm.reset()
 	bsmPool.Put(bsm)
 	bsw.MustClose()
@@ -41,7 +46,7 @@ var bsmPool = &sync.Pool{
 var errForciblyStopped = fmt.Errorf("forcibly stopped")
 
 func mergeBlockStreamsInternal(ph *partHeader, bsw *blockStreamWriter, bsm *blockStreamMerger, stopCh <-chan struct{}, rowsMerged *uint64,
-	deletedMetricIDs map[uint64]struct{}, rowsDeleted *uint64) error {
+	deletedMetricIDs map[uint64]struct{}, rd *retentionDeadlines, md *metricIDDownsampling, rowsDeleted *uint64) error {
 	// Search for the first block to merge
 	var pendingBlock *Block
 	for bsm.NextBlock() {
@@ -55,6 +60,14 @@ func mergeBlockStreamsInternal(ph *partHeader, bsw *blockStreamWriter, bsm *bloc
 			*rowsDeleted += uint64(bsm.Block.bh.RowsCount)
 			continue
 		}
+		expired, err := bsm.Block.dropExpiredRows(rd, rowsDeleted)
+		if err != nil {
+			return fmt.Errorf("cannot drop expired rows: %s", err)
+		}
+		if expired {
+			// Skip blocks with all the rows outside the retention.
+			continue
+		}
 		pendingBlock = getBlock()
 		pendingBlock.CopyFrom(bsm.Block)
 		break
@@ -63,6 +76,13 @@ func mergeBlockStreamsInternal(ph *partHeader, bsw *blockStreamWriter, bsm *bloc
 		defer putBlock(pendingBlock)
 	}
 
+	// Blocks are downsampled before writing to bsw, so old samples are collapsed according to downsampling periods.
+	now := timestampFromTime(time.Now())
+	writeBlock := func(b *Block) {
+		b.downsampleSamplesDuringMerge(md.getPeriods(b.bh.TSID.MetricID), now)
+		bsw.WriteExternalBlock(b, ph, rowsMerged)
+	}
+
 	// Merge blocks.
 	tmpBlock := getBlock()
 	defer putBlock(tmpBlock)
@@ -77,6 +97,14 @@ func mergeBlockStreamsInternal(ph *partHeader, bsw *blockStreamWriter, bsm *bloc
 			*rowsDeleted += uint64(bsm.Block.bh.RowsCount)
 			continue
 		}
+		expired, err := bsm.Block.dropExpiredRows(rd, rowsDeleted)
+		if err != nil {
+			return fmt.Errorf("cannot drop expired rows: %s", err)
+		}
+		if expired {
+			// Skip blocks with all the rows outside the retention.
+			continue
+		}
 
 		// Verify whether pendingBlock may be merged with bsm.Block (the current block).
 		if pendingBlock.bh.TSID.MetricID != bsm.Block.bh.TSID.MetricID {
@@ -85,14 +113,14 @@ func mergeBlockStreamsInternal(ph *partHeader, bsw *blockStreamWriter, bsm *bloc
 			if bsm.Block.bh.TSID.Less(&pendingBlock.bh.TSID) {
 				logger.Panicf("BUG: the next TSID=%+v is smaller than the current TSID=%+v", &bsm.Block.bh.TSID, &pendingBlock.bh.TSID)
 			}
-			bsw.WriteExternalBlock(pendingBlock, ph, rowsMerged)
+			writeBlock(pendingBlock)
 			pendingBlock.CopyFrom(bsm.Block)
 			continue
 		}
 		if pendingBlock.tooBig() && pendingBlock.bh.MaxTimestamp <= bsm.Block.bh.MinTimestamp {
 			// Fast path - pendingBlock is too big and it doesn't overlap with bsm.Block.
 			// Write the pendingBlock and then deal with bsm.Block.
-			bsw.WriteExternalBlock(pendingBlock, ph, rowsMerged)
+			writeBlock(pendingBlock)
 			pendingBlock.CopyFrom(bsm.Block)
 			continue
 		}
@@ -106,6 +134,10 @@ func mergeBlockStreamsInternal(ph *partHeader, bsw *blockStreamWriter, bsm *bloc
 		tmpBlock.bh.TSID = bsm.Block.bh.TSID
 		tmpBlock.bh.Scale = bsm.Block.bh.Scale
 		tmpBlock.bh.PrecisionBits = minUint8(pendingBlock.bh.PrecisionBits, bsm.Block.bh.PrecisionBits)
+		if tmpBlock.bh.Scale == decimal.ExactScale {
+			// Raw float64 bits cannot be stored with reduced precision.
+			tmpBlock.bh.PrecisionBits = 64
+		}
 		mergeBlocks(tmpBlock, pendingBlock, bsm.Block)
 		if len(tmpBlock.timestamps) <= maxRowsPerBlock {
 			// More entries may be added to tmpBlock. Swap it with pendingBlock,
@@ -124,13 +156,13 @@ func mergeBlockStreamsInternal(ph *partHeader, bsw *blockStreamWriter, bsm *bloc
 		tmpBlock.timestamps = tmpBlock.timestamps[:maxRowsPerBlock]
 		tmpBlock.values = tmpBlock.values[:maxRowsPerBlock]
 		tmpBlock.fixupTimestamps()
-		bsw.WriteExternalBlock(tmpBlock, ph, rowsMerged)
+		writeBlock(tmpBlock)
 	}
 	if err := bsm.Error(); err != nil {
 		return fmt.Errorf("cannot read block to be merged: %s", err)
 	}
 	if pendingBlock != nil {
-		bsw.WriteExternalBlock(pendingBlock, ph, rowsMerged)
+		writeBlock(pendingBlock)
 	}
 	return nil
 }
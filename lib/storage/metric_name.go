@@ -272,26 +272,33 @@ func (mn *MetricName) GetTagValue(tagKey string) []byte {
 	return nil
 }
 
-// AddMissingTags adds tags from src with keys matching addTags.
-func (mn *MetricName) AddMissingTags(addTags []string, src *MetricName) {
-	if hasTag(addTags, metricGroupTagKey) {
-		mn.MetricGroup = append(mn.MetricGroup[:0], src.MetricGroup...)
-	}
-	for i := range src.Tags {
-		srcTag := &src.Tags[i]
-		if !hasTag(addTags, srcTag.Key) {
+// SetTags sets tags from src with keys matching addTags.
+//
+// Existing tags in mn are overwritten by tags from src. Tags missing in src are removed from mn
+// in the same way as Prometheus does for group_left and group_right.
+func (mn *MetricName) SetTags(addTags []string, src *MetricName) {
+	for _, tagKey := range addTags {
+		if tagKey == string(metricGroupTagKey) {
+			mn.MetricGroup = append(mn.MetricGroup[:0], src.MetricGroup...)
+			continue
+		}
+		srcValue := src.GetTagValue(tagKey)
+		if len(srcValue) == 0 {
+			mn.RemoveTag(tagKey)
 			continue
 		}
 		found := false
-		for j := range mn.Tags {
-			tag := &mn.Tags[j]
-			if string(tag.Key) == string(srcTag.Key) {
+		for i := range mn.Tags {
+			tag := &mn.Tags[i]
+			if string(tag.Key) == tagKey {
+				// Do not modify tag.Value in place, since it may be shared with other metric names.
+				tag.Value = append([]byte{}, srcValue...)
 				found = true
 				break
 			}
 		}
 		if !found {
-			mn.AddTagBytes(srcTag.Key, srcTag.Value)
+			mn.AddTagBytes([]byte(tagKey), srcValue)
 		}
 	}
 }
@@ -375,46 +382,41 @@ func (mn *MetricName) Unmarshal(src []byte) error {
 	return nil
 }
 
-// The maximum length of label name.
-//
-// Longer names are truncated.
-const maxLabelNameLen = 256
-
-// The maximum length of label value.
-//
-// Longer values are truncated.
-const maxLabelValueLen = 16 * 1024
-
-// The maximum number of labels per each timeseries.
-//
-// Superflouos lables are dropped.
-const maxLabelsPerTimeseries = 30
-
 // MarshalMetricNameRaw marshals labels to dst and returns the result.
 //
-// The result must be unmarshaled with MetricName.unmarshalRaw
+// The result must be unmarshaled with MetricName.UnmarshalRaw.
+//
+// Labels exceeding the limits set via SetLabelLimits are truncated to the limit plus a single byte,
+// so the space required for dst is bounded, while the storage drops such samples.
+// Only labels with non-empty values are counted against the limit on the number of labels, since empty labels are skipped.
 func MarshalMetricNameRaw(dst []byte, labels []prompb.Label) []byte {
 	// Calculate the required space for dst.
 	dstLen := len(dst)
 	dstSize := dstLen
+	labelsCount := 0
 	for i := range labels {
-		if i >= maxLabelsPerTimeseries {
-			break
-		}
 		label := &labels[i]
-		if len(label.Name) > maxLabelNameLen {
-			label.Name = label.Name[:maxLabelNameLen]
-		}
-		if len(label.Value) > maxLabelValueLen {
-			label.Value = label.Value[:maxLabelValueLen]
-		}
 		if len(label.Value) == 0 {
 			// Skip labels without values, since they have no sense in prometheus.
 			continue
 		}
+		if labelsCount > maxLabelsPerTimeseries {
+			break
+		}
+		labelsCount++
 		if string(label.Name) == "__name__" {
 			label.Name = label.Name[:0]
 		}
+		if len(label.Name) > maxLabelNameLen {
+			label.Name = label.Name[:maxLabelNameLen+1]
+		}
+		valueLenLimit := maxLabelValueLen
+		if len(label.Name) == 0 {
+			valueLenLimit = maxMetricNameLen
+		}
+		if len(label.Value) > valueLenLimit {
+			label.Value = label.Value[:valueLenLimit+1]
+		}
 		dstSize += len(label.Name)
 		dstSize += len(label.Value)
 		dstSize += 4
@@ -422,15 +424,17 @@ func MarshalMetricNameRaw(dst []byte, labels []prompb.Label) []byte {
 	dst = bytesutil.Resize(dst, dstSize)[:dstLen]
 
 	// Marshal labels to dst.
+	labelsCount = 0
 	for i := range labels {
-		if i >= maxLabelsPerTimeseries {
-			break
-		}
 		label := &labels[i]
 		if len(label.Value) == 0 {
 			// Skip labels without values, since they have no sense in prometheus.
 			continue
 		}
+		if labelsCount > maxLabelsPerTimeseries {
+			break
+		}
+		labelsCount++
 		dst = marshalBytesFast(dst, label.Name)
 		dst = marshalBytesFast(dst, label.Value)
 	}
@@ -439,7 +443,7 @@ func MarshalMetricNameRaw(dst []byte, labels []prompb.Label) []byte {
 
 // marshalRaw marshals mn to dst and returns the result.
 //
-// The results may be unmarshaled with MetricName.unmarshalRaw.
+// The results may be unmarshaled with MetricName.UnmarshalRaw.
 //
 // This function is for testing purposes. MarshalMetricNameRaw must be used
 // in prod instead.
@@ -456,8 +460,8 @@ func (mn *MetricName) marshalRaw(dst []byte) []byte {
 	return dst
 }
 
-// unmarshalRaw unmarshals mn encoded with MarshalMetricNameRaw.
-func (mn *MetricName) unmarshalRaw(src []byte) error {
+// UnmarshalRaw unmarshals mn encoded with MarshalMetricNameRaw.
+func (mn *MetricName) UnmarshalRaw(src []byte) error {
 	mn.Reset()
 	for len(src) > 0 {
 		tail, key, err := unmarshalBytesFast(src)
@@ -87,7 +87,7 @@ func TestMetricNameMarshalUnmarshalRaw(t *testing.T) {
 			}
 			data := mn.marshalRaw(nil)
 			var mn1 MetricName
-			if err := mn1.unmarshalRaw(data); err != nil {
+			if err := mn1.UnmarshalRaw(data); err != nil {
 				t.Fatalf("cannot unmarshal mn %s: %s", &mn, err)
 			}
 			if !reflect.DeepEqual(&mn, &mn1) {
@@ -96,13 +96,13 @@ func TestMetricNameMarshalUnmarshalRaw(t *testing.T) {
 
 			// Try unmarshaling MetricName without tag value.
 			brokenData := marshalTagValue(data, []byte("foobar"))
-			if err := mn1.unmarshalRaw(brokenData); err == nil {
+			if err := mn1.UnmarshalRaw(brokenData); err == nil {
 				t.Fatalf("expecting non-zero error when unmarshaling MetricName without tag value")
 			}
 
 			// Try unmarshaling MetricName with invalid tag key.
 			brokenData[len(brokenData)-1] = 123
-			if err := mn1.unmarshalRaw(brokenData); err == nil {
+			if err := mn1.UnmarshalRaw(brokenData); err == nil {
 				t.Fatalf("expecting non-zero error when unmarshaling MetricName with invalid tag key")
 			}
 
@@ -110,9 +110,36 @@ func TestMetricNameMarshalUnmarshalRaw(t *testing.T) {
 			brokenData = marshalTagValue(data, []byte("foobar"))
 			brokenData = marshalTagValue(brokenData, []byte("aaa"))
 			brokenData[len(brokenData)-1] = 123
-			if err := mn1.unmarshalRaw(brokenData); err == nil {
+			if err := mn1.UnmarshalRaw(brokenData); err == nil {
 				t.Fatalf("expecting non-zero error when unmarshaling MetricName with invalid tag value")
 			}
 		}
 	}
 }
+
+func TestMetricNameSetTags(t *testing.T) {
+	newMetricName := func(metricGroup string, tags ...string) *MetricName {
+		var mn MetricName
+		mn.MetricGroup = []byte(metricGroup)
+		for i := 0; i < len(tags); i += 2 {
+			mn.AddTag(tags[i], tags[i+1])
+		}
+		return &mn
+	}
+	f := func(dst, src, resultExpected *MetricName, addTags []string) {
+		t.Helper()
+		dst.SetTags(addTags, src)
+		if dst.String() != resultExpected.String() {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", dst, resultExpected)
+		}
+	}
+	f(newMetricName("foo", "a", "b"), newMetricName("bar", "c", "d"), newMetricName("foo", "a", "b"), nil)
+	f(newMetricName("foo", "a", "b"), newMetricName("bar", "c", "d"), newMetricName("foo", "a", "b", "c", "d"), []string{"c"})
+	f(newMetricName("foo", "a", "b", "c", "x"), newMetricName("bar", "c", "d"), newMetricName("foo", "a", "b", "c", "d"), []string{"c"})
+	f(newMetricName("foo", "a", "b"), newMetricName("bar", "c", "d"), newMetricName("bar", "a", "b"), []string{"__name__"})
+
+	// Tags missing in src must be removed from dst.
+	f(newMetricName("foo", "a", "b", "c", "x"), newMetricName("bar", "d", "e"), newMetricName("foo", "a", "b"), []string{"c"})
+	f(newMetricName("foo", "a", "b", "c", "x"), newMetricName("bar", "d", "e"), newMetricName("foo", "a", "b", "d", "e"), []string{"c", "d", "e"})
+	f(newMetricName("foo", "a", "b"), newMetricName("", "d", "e"), newMetricName("", "a", "b"), []string{"__name__"})
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/fastcache"
+)
+
+// SetMaxOutOfOrderWindow sets the maximum duration samples may lag behind
+// the latest ingested sample for the same series.
+//
+// Samples lagging behind by more than window are dropped. Samples inside
+// the window are accepted and are put in order with the remaining samples
+// before being flushed to parts.
+//
+// Samples are accepted regardless of their order if window is 0.
+//
+// This function must be called before initializing the storage.
+func SetMaxOutOfOrderWindow(window time.Duration) {
+	maxOutOfOrderWindow = window.Nanoseconds() / 1e6
+}
+
+var maxOutOfOrderWindow = int64(0)
+
+// filterOutOfOrderRows removes rows lagging behind the latest timestamp
+// for the corresponding series by more than maxOutOfOrderWindow.
+//
+// The remaining rows are put in order with the already ingested rows for the same series
+// when raw rows are converted to parts, since parts keep rows sorted by (TSID, timestamp).
+//
+// The latest timestamps are tracked in s.latestTimestampCache, so the memory
+// usage is bounded by 16 bytes per series and by the cache size.
+// Series evicted from the cache are handled as new series.
+func (s *Storage) filterOutOfOrderRows(rows []rawRow) []rawRow {
+	// The latest timestamp cannot exceed the current time, so a single sample with a timestamp
+	// in the future doesn't lead to dropping the subsequent samples lagging behind the current time
+	// by less than maxOutOfOrderWindow.
+	maxLatestTimestamp := timestampFromTime(time.Now())
+	dst := rows[:0]
+	for i := range rows {
+		r := &rows[i]
+		timestamp := r.Timestamp
+		if timestamp > maxLatestTimestamp {
+			timestamp = maxLatestTimestamp
+		}
+		latestTimestamp, ok := s.updateLatestTimestamp(r.TSID.MetricID, timestamp)
+		if ok {
+			if r.Timestamp < latestTimestamp-maxOutOfOrderWindow {
+				atomic.AddUint64(&s.outOfOrderRowsDropped, 1)
+				continue
+			}
+			if r.Timestamp < latestTimestamp {
+				atomic.AddUint64(&s.outOfOrderRowsReordered, 1)
+			}
+		}
+		dst = append(dst, *r)
+	}
+	return dst
+}
+
+// updateLatestTimestamp atomically updates the latest timestamp for the given metricID to timestamp
+// if it exceeds the latest timestamp.
+//
+// It returns the latest timestamp before the update. false is returned if the latest timestamp for metricID is missing.
+func (s *Storage) updateLatestTimestamp(metricID uint64, timestamp int64) (int64, bool) {
+	var kb, vb [8]byte
+	key := encoding.MarshalUint64(kb[:0], metricID)
+
+	// fastcache.Cache doesn't support compare-and-swap, so serialize updates for the same metricID
+	// in order to prevent from overwriting bigger latest timestamp by concurrent AddRows calls.
+	mu := &latestTimestampLocks[metricID%uint64(len(latestTimestampLocks))]
+	mu.Lock()
+	defer mu.Unlock()
+
+	v := s.latestTimestampCache.Get(vb[:0], key)
+	if len(v) != 8 {
+		s.latestTimestampCache.Set(key, encoding.MarshalInt64(vb[:0], timestamp))
+		return 0, false
+	}
+	latestTimestamp := encoding.UnmarshalInt64(v)
+	if timestamp > latestTimestamp {
+		s.latestTimestampCache.Set(key, encoding.MarshalInt64(vb[:0], timestamp))
+	}
+	return latestTimestamp, true
+}
+
+var latestTimestampLocks [256]sync.Mutex
+
+func (s *Storage) updateOutOfOrderMetrics(m *Metrics) {
+	m.OutOfOrderRowsReordered += atomic.LoadUint64(&s.outOfOrderRowsReordered)
+	m.OutOfOrderRowsDropped += atomic.LoadUint64(&s.outOfOrderRowsDropped)
+	if s.latestTimestampCache == nil {
+		return
+	}
+	var cs fastcache.Stats
+	s.latestTimestampCache.UpdateStats(&cs)
+	m.LatestTimestampCacheSize += cs.EntriesCount
+	m.LatestTimestampCacheBytesSize += cs.BytesSize
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageMaxOutOfOrderWindow(t *testing.T) {
+	SetMaxOutOfOrderWindow(time.Minute)
+	defer SetMaxOutOfOrderWindow(0)
+
+	path := "TestStorageMaxOutOfOrderWindow"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+
+	now := timestampFromTime(time.Now())
+	addRows := func(job string, offsets ...int64) {
+		t.Helper()
+		var mn MetricName
+		mn.MetricGroup = []byte("metric")
+		mn.Tags = []Tag{{[]byte("job"), []byte(job)}}
+		metricNameRaw := mn.marshalRaw(nil)
+		var mrs []MetricRow
+		for _, offset := range offsets {
+			mrs = append(mrs, MetricRow{
+				MetricNameRaw: metricNameRaw,
+				Timestamp:     now - offset*1000,
+				Value:         float64(offset),
+			})
+		}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding mrs: %s", err)
+		}
+	}
+
+	// Samples lagging behind the latest sample by less than a minute must be accepted,
+	// while the remaining out-of-order samples must be dropped.
+	addRows("late", 100, 50, 70, 200, 109)
+	addRows("late", 40, 99, 101)
+	// Out-of-order samples for distinct series mustn't affect each other.
+	addRows("ordered", 200, 150, 100)
+	s.DebugFlush()
+
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if m.OutOfOrderRowsReordered != 3 {
+		t.Fatalf("unexpected number of reordered rows; got %d; want %d", m.OutOfOrderRowsReordered, 3)
+	}
+	if m.OutOfOrderRowsDropped != 2 {
+		t.Fatalf("unexpected number of dropped rows; got %d; want %d", m.OutOfOrderRowsDropped, 2)
+	}
+	if m.LatestTimestampCacheSize != 2 {
+		t.Fatalf("unexpected number of entries in latestTimestamp cache; got %d; want %d", m.LatestTimestampCacheSize, 2)
+	}
+
+	timestamps, err := getTimestampsByJob(s)
+	if err != nil {
+		t.Fatalf("cannot obtain timestamps: %s", err)
+	}
+	timestampsExpected := map[string][]int64{
+		"late":    {now - 109e3, now - 100e3, now - 99e3, now - 70e3, now - 50e3, now - 40e3},
+		"ordered": {now - 200e3, now - 150e3, now - 100e3},
+	}
+	if !reflect.DeepEqual(timestamps, timestampsExpected) {
+		t.Fatalf("unexpected timestamps;\ngot\n%v\nwant\n%v", timestamps, timestampsExpected)
+	}
+	s.MustClose()
+
+	// The latest timestamps must be preserved after the restart.
+	s, err = OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot re-open storage: %s", err)
+	}
+	addRows("late", 120)
+	m.Reset()
+	s.UpdateMetrics(&m)
+	if m.OutOfOrderRowsDropped != 1 {
+		t.Fatalf("unexpected number of dropped rows after the restart; got %d; want %d", m.OutOfOrderRowsDropped, 1)
+	}
+	s.MustClose()
+
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
+
+func TestStorageMaxOutOfOrderWindowFutureTimestamp(t *testing.T) {
+	SetMaxOutOfOrderWindow(time.Minute)
+	defer SetMaxOutOfOrderWindow(0)
+
+	path := "TestStorageMaxOutOfOrderWindowFutureTimestamp"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	defer func() {
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	now := timestampFromTime(time.Now())
+	var mn MetricName
+	mn.MetricGroup = []byte("metric")
+	metricNameRaw := mn.marshalRaw(nil)
+	addRow := func(timestamp int64) {
+		t.Helper()
+		mrs := []MetricRow{{
+			MetricNameRaw: metricNameRaw,
+			Timestamp:     timestamp,
+			Value:         1,
+		}}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding mrs: %s", err)
+		}
+	}
+
+	// A sample with a timestamp in the future mustn't lead to dropping the subsequent samples
+	// lagging behind the current time by less than the window.
+	addRow(now + 3600e3)
+	addRow(now - 10e3)
+	addRow(now - 50e3)
+
+	// Samples lagging behind the current time by more than the window are dropped.
+	addRow(now - 130e3)
+
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if m.OutOfOrderRowsReordered != 2 {
+		t.Fatalf("unexpected number of reordered rows; got %d; want %d", m.OutOfOrderRowsReordered, 2)
+	}
+	if m.OutOfOrderRowsDropped != 1 {
+		t.Fatalf("unexpected number of dropped rows; got %d; want %d", m.OutOfOrderRowsDropped, 1)
+	}
+}
+
+func TestStorageUpdateLatestTimestampConcurrent(t *testing.T) {
+	SetMaxOutOfOrderWindow(time.Minute)
+	defer SetMaxOutOfOrderWindow(0)
+
+	path := "TestStorageUpdateLatestTimestampConcurrent"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	defer func() {
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	const workers = 8
+	const timestampsPerWorker = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for j := 0; j < timestampsPerWorker; j++ {
+				s.updateLatestTimestamp(1, int64(j*workers+workerID))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The latest timestamp must be the maximum timestamp passed to updateLatestTimestamp
+	// regardless of the order of concurrent updates.
+	latestTimestamp, ok := s.updateLatestTimestamp(1, 0)
+	if !ok {
+		t.Fatalf("missing the latest timestamp")
+	}
+	if latestTimestampExpected := int64(workers*timestampsPerWorker - 1); latestTimestamp != latestTimestampExpected {
+		t.Fatalf("unexpected latest timestamp; got %d; want %d", latestTimestamp, latestTimestampExpected)
+	}
+}
+
+func getTimestampsByJob(s *Storage) (map[string][]int64, error) {
+	tr := TimeRange{
+		MinTimestamp: 0,
+		MaxTimestamp: timestampFromTime(time.Now()),
+	}
+	return getTimestampsByJobOnTimeRange(s, tr)
+}
+
+func getTimestampsByJobOnTimeRange(s *Storage, tr TimeRange) (map[string][]int64, error) {
+	tfs := NewTagFilters()
+	if err := tfs.Add(nil, []byte("metric"), false, false); err != nil {
+		return nil, fmt.Errorf("cannot add tag filter: %s", err)
+	}
+	m := make(map[string][]int64)
+	var sr Search
+	sr.Init(s, []*TagFilters{tfs}, tr, 1e5)
+	defer sr.MustClose()
+	var mn MetricName
+	for sr.NextMetricBlock() {
+		if err := mn.Unmarshal(sr.MetricBlock.MetricName); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal metric name: %s", err)
+		}
+		b := sr.MetricBlock.Block
+		if err := b.UnmarshalData(); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal block: %s", err)
+		}
+		job := string(mn.GetTagValue("job"))
+		m[job] = append(m[job], b.Timestamps()...)
+	}
+	if err := sr.Error(); err != nil {
+		return nil, fmt.Errorf("search error: %s", err)
+	}
+	return m, nil
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/memory"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/mergeset"
 	"golang.org/x/sys/unix"
 )
 
@@ -85,16 +86,48 @@ const rawRowsFlushInterval = time.Second
 
 // The interval for flushing inmemory parts to persistent storage,
 // so they survive process crash.
-const inmemoryPartsFlushInterval = 5 * time.Second
+//
+// It may be changed via SetInmemoryDataFlushInterval.
+var inmemoryPartsFlushInterval = 5 * time.Second
+
+// SetInmemoryDataFlushInterval sets the interval for flushing in-memory data to persistent storage.
+//
+// Lower intervals reduce the amount of data lost on unclean shutdown at the cost of higher disk IO.
+// All the in-memory parts ready for flushing are merged into a single part on disk per each flush,
+// while small on-disk parts are merged by background merge workers. Intervals smaller than a second
+// would create too many tiny parts, so they are rounded up to a second.
+// The default interval is used if d is 0.
+//
+// This function must be called before initializing the storage.
+func SetInmemoryDataFlushInterval(d time.Duration) {
+	switch {
+	case d <= 0:
+		d = 5 * time.Second
+	case d < rawRowsFlushInterval:
+		d = rawRowsFlushInterval
+	}
+	inmemoryPartsFlushInterval = d
+}
 
 // partition represents a partition.
 type partition struct {
 	smallPartsPath string
 	bigPartsPath   string
 
+	// coldPartsPath is the path to parts stored at cold storage.
+	//
+	// It is empty if cold storage is disabled. See SetColdStorage.
+	coldPartsPath string
+
 	// The callack that returns deleted metric ids which must be skipped during merge.
 	getDeletedMetricIDs func() map[uint64]struct{}
 
+	// The callback that returns per-metricID retentions, which must be applied during merge.
+	getMetricIDRetentions func() *metricIDRetentions
+
+	// The callback that returns per-metricID downsampling filters, which must be applied during merge.
+	getMetricIDDownsampling func() *metricIDDownsampling
+
 	// Name is the name of the partition in the form YYYY_MM.
 	name string
 
@@ -109,6 +142,7 @@ type partition struct {
 	smallParts []*partWrapper
 
 	// Contains file-based parts with big number of items.
+	// It also contains parts stored at coldPartsPath.
 	bigParts []*partWrapper
 
 	// rawRowsLock protects rawRows.
@@ -122,6 +156,14 @@ type partition struct {
 	// rawRowsLastFlushTime is the last time rawRows are flushed.
 	rawRowsLastFlushTime time.Time
 
+	// rawRowsPendingFlushes is the number of rawRows batches taken from rawRows, which aren't converted into parts yet.
+	//
+	// It is protected by rawRowsLock.
+	rawRowsPendingFlushes int
+
+	// rawRowsPendingFlushesCond is signaled when rawRowsPendingFlushes drops to zero.
+	rawRowsPendingFlushesCond sync.Cond
+
 	mergeIdx uint64
 
 	snapshotLock sync.RWMutex
@@ -143,6 +185,8 @@ type partition struct {
 	smallRowsDeleted  uint64
 
 	smallAssistedMerges uint64
+
+	coldPartsMoved uint64
 }
 
 // partWrapper is a wrapper for the part.
@@ -182,12 +226,18 @@ func (pw *partWrapper) decRef() {
 }
 
 // createPartition creates new partition for the given timestamp and the given paths
-// to small and big partitions.
-func createPartition(timestamp int64, smallPartitionsPath, bigPartitionsPath string, getDeletedMetricIDs func() map[uint64]struct{}) (*partition, error) {
+// to small, big and cold partitions.
+//
+// coldPartitionsPath may be empty if cold storage is disabled.
+func createPartition(timestamp int64, smallPartitionsPath, bigPartitionsPath, coldPartitionsPath string, getDeletedMetricIDs func() map[uint64]struct{}, getMetricIDRetentions func() *metricIDRetentions, getMetricIDDownsampling func() *metricIDDownsampling) (*partition, error) {
 	name := timestampToPartitionName(timestamp)
 	smallPartsPath := filepath.Clean(smallPartitionsPath) + "/" + name
 	bigPartsPath := filepath.Clean(bigPartitionsPath) + "/" + name
-	logger.Infof("creating a partition %q with smallPartsPath=%q, bigPartsPath=%q", name, smallPartsPath, bigPartsPath)
+	coldPartsPath := ""
+	if len(coldPartitionsPath) > 0 {
+		coldPartsPath = filepath.Clean(coldPartitionsPath) + "/" + name
+	}
+	logger.Infof("creating a partition %q with smallPartsPath=%q, bigPartsPath=%q, coldPartsPath=%q", name, smallPartsPath, bigPartsPath, coldPartsPath)
 
 	if err := createPartitionDirs(smallPartsPath); err != nil {
 		return nil, fmt.Errorf("cannot create directories for small parts %q: %s", smallPartsPath, err)
@@ -195,8 +245,13 @@ func createPartition(timestamp int64, smallPartitionsPath, bigPartitionsPath str
 	if err := createPartitionDirs(bigPartsPath); err != nil {
 		return nil, fmt.Errorf("cannot create directories for big parts %q: %s", bigPartsPath, err)
 	}
+	if len(coldPartsPath) > 0 {
+		if err := createPartitionDirs(coldPartsPath); err != nil {
+			return nil, fmt.Errorf("cannot create directories for cold parts %q: %s", coldPartsPath, err)
+		}
+	}
 
-	pt := newPartition(name, smallPartsPath, bigPartsPath, getDeletedMetricIDs)
+	pt := newPartition(name, smallPartsPath, bigPartsPath, coldPartsPath, getDeletedMetricIDs, getMetricIDRetentions, getMetricIDDownsampling)
 	pt.tr.fromPartitionTimestamp(timestamp)
 	pt.startMergeWorkers()
 	pt.startRawRowsFlusher()
@@ -211,16 +266,24 @@ func createPartition(timestamp int64, smallPartitionsPath, bigPartitionsPath str
 //
 // The pt must be detached from table before calling pt.Drop.
 func (pt *partition) Drop() {
-	logger.Infof("dropping partition %q at smallPartsPath=%q, bigPartsPath=%q", pt.name, pt.smallPartsPath, pt.bigPartsPath)
+	logger.Infof("dropping partition %q at smallPartsPath=%q, bigPartsPath=%q, coldPartsPath=%q", pt.name, pt.smallPartsPath, pt.bigPartsPath, pt.coldPartsPath)
+	if len(pt.coldPartsPath) > 0 {
+		fs.MustRemoveAll(pt.coldPartsPath)
+	}
 	fs.MustRemoveAll(pt.smallPartsPath)
 	fs.MustRemoveAll(pt.bigPartsPath)
 	logger.Infof("partition %q has been dropped", pt.name)
 }
 
 // openPartition opens the existing partition from the given paths.
-func openPartition(smallPartsPath, bigPartsPath string, getDeletedMetricIDs func() map[uint64]struct{}) (*partition, error) {
+//
+// coldPartsPath may be empty if cold storage is disabled.
+func openPartition(smallPartsPath, bigPartsPath, coldPartsPath string, getDeletedMetricIDs func() map[uint64]struct{}, getMetricIDRetentions func() *metricIDRetentions, getMetricIDDownsampling func() *metricIDDownsampling) (*partition, error) {
 	smallPartsPath = filepath.Clean(smallPartsPath)
 	bigPartsPath = filepath.Clean(bigPartsPath)
+	if len(coldPartsPath) > 0 {
+		coldPartsPath = filepath.Clean(coldPartsPath)
+	}
 
 	n := strings.LastIndexByte(smallPartsPath, '/')
 	if n < 0 {
@@ -232,19 +295,43 @@ func openPartition(smallPartsPath, bigPartsPath string, getDeletedMetricIDs func
 		return nil, fmt.Errorf("patititon name in bigPartsPath %q doesn't match smallPartsPath %q; want %q", bigPartsPath, smallPartsPath, name)
 	}
 
-	smallParts, err := openParts(smallPartsPath, bigPartsPath, smallPartsPath)
+	if len(coldPartsPath) > 0 && !strings.HasSuffix(coldPartsPath, "/"+name) {
+		return nil, fmt.Errorf("patititon name in coldPartsPath %q doesn't match smallPartsPath %q; want %q", coldPartsPath, smallPartsPath, name)
+	}
+
+	pathPrefixes := getPartitionPathPrefixes(smallPartsPath, bigPartsPath, coldPartsPath)
+
+	// Cold parts must be opened first, since transactions for moving parts to cold storage
+	// are stored at coldPartsPath and they may remove the moved parts from smallPartsPath and bigPartsPath.
+	var coldParts []*partWrapper
+	if len(coldPartsPath) > 0 {
+		if !fs.IsPathExist(coldPartsPath) {
+			// Cold storage has been enabled after the partition creation.
+			if err := createPartitionDirs(coldPartsPath); err != nil {
+				return nil, fmt.Errorf("cannot create directories for cold parts %q: %s", coldPartsPath, err)
+			}
+		}
+		var err error
+		coldParts, err = openParts(pathPrefixes, coldPartsPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open cold parts from %q: %s", coldPartsPath, err)
+		}
+	}
+	smallParts, err := openParts(pathPrefixes, smallPartsPath)
 	if err != nil {
+		mustCloseParts(coldParts)
 		return nil, fmt.Errorf("cannot open small parts from %q: %s", smallPartsPath, err)
 	}
-	bigParts, err := openParts(smallPartsPath, bigPartsPath, bigPartsPath)
+	bigParts, err := openParts(pathPrefixes, bigPartsPath)
 	if err != nil {
+		mustCloseParts(coldParts)
 		mustCloseParts(smallParts)
 		return nil, fmt.Errorf("cannot open big parts from %q: %s", bigPartsPath, err)
 	}
 
-	pt := newPartition(name, smallPartsPath, bigPartsPath, getDeletedMetricIDs)
+	pt := newPartition(name, smallPartsPath, bigPartsPath, coldPartsPath, getDeletedMetricIDs, getMetricIDRetentions, getMetricIDDownsampling)
 	pt.smallParts = smallParts
-	pt.bigParts = bigParts
+	pt.bigParts = append(bigParts, coldParts...)
 	if err := pt.tr.fromPartitionName(name); err != nil {
 		return nil, fmt.Errorf("cannot obtain partition time range from smallPartsPath %q: %s", smallPartsPath, err)
 	}
@@ -255,19 +342,24 @@ func openPartition(smallPartsPath, bigPartsPath string, getDeletedMetricIDs func
 	return pt, nil
 }
 
-func newPartition(name, smallPartsPath, bigPartsPath string, getDeletedMetricIDs func() map[uint64]struct{}) *partition {
-	return &partition{
+func newPartition(name, smallPartsPath, bigPartsPath, coldPartsPath string, getDeletedMetricIDs func() map[uint64]struct{}, getMetricIDRetentions func() *metricIDRetentions, getMetricIDDownsampling func() *metricIDDownsampling) *partition {
+	pt := &partition{
 		name:           name,
 		smallPartsPath: smallPartsPath,
 		bigPartsPath:   bigPartsPath,
+		coldPartsPath:  coldPartsPath,
 
-		getDeletedMetricIDs: getDeletedMetricIDs,
+		getDeletedMetricIDs:     getDeletedMetricIDs,
+		getMetricIDRetentions:   getMetricIDRetentions,
+		getMetricIDDownsampling: getMetricIDDownsampling,
 
 		rawRows: getRawRowsMaxSize().rows,
 
 		mergeIdx: uint64(time.Now().UnixNano()),
 		stopCh:   make(chan struct{}),
 	}
+	pt.rawRowsPendingFlushesCond.L = &pt.rawRowsLock
+	return pt
 }
 
 // partitionMetrics contains essential metrics for the partition.
@@ -291,6 +383,12 @@ type partitionMetrics struct {
 	BigPartsCount   uint64
 	SmallPartsCount uint64
 
+	InmemoryRowsCount  uint64
+	InmemoryPartsCount uint64
+
+	BigPartsNotInMerge   uint64
+	SmallPartsNotInMerge uint64
+
 	ActiveBigMerges   uint64
 	ActiveSmallMerges uint64
 
@@ -307,6 +405,11 @@ type partitionMetrics struct {
 	SmallPartsRefCount uint64
 
 	SmallAssistedMerges uint64
+
+	ColdRowsCount   uint64
+	ColdBlocksCount uint64
+	ColdPartsCount  uint64
+	ColdPartsMoved  uint64
 }
 
 // UpdateMetrics updates m with metrics from pt.
@@ -327,6 +430,14 @@ func (pt *partition) UpdateMetrics(m *partitionMetrics) {
 		m.BigRowsCount += p.ph.RowsCount
 		m.BigBlocksCount += p.ph.BlocksCount
 		m.BigPartsRefCount += atomic.LoadUint64(&pw.refCount)
+		if !pw.isInMerge {
+			m.BigPartsNotInMerge++
+		}
+		if pt.isColdPart(pw) {
+			m.ColdRowsCount += p.ph.RowsCount
+			m.ColdBlocksCount += p.ph.BlocksCount
+			m.ColdPartsCount++
+		}
 	}
 
 	for _, pw := range pt.smallParts {
@@ -338,6 +449,13 @@ func (pt *partition) UpdateMetrics(m *partitionMetrics) {
 		m.SmallRowsCount += p.ph.RowsCount
 		m.SmallBlocksCount += p.ph.BlocksCount
 		m.SmallPartsRefCount += atomic.LoadUint64(&pw.refCount)
+		if !pw.isInMerge {
+			m.SmallPartsNotInMerge++
+		}
+		if pw.mp != nil {
+			m.InmemoryRowsCount += p.ph.RowsCount
+			m.InmemoryPartsCount++
+		}
 	}
 
 	m.BigPartsCount += uint64(len(pt.bigParts))
@@ -364,6 +482,8 @@ func (pt *partition) UpdateMetrics(m *partitionMetrics) {
 	m.SmallRowsDeleted += atomic.LoadUint64(&pt.smallRowsDeleted)
 
 	m.SmallAssistedMerges += atomic.LoadUint64(&pt.smallAssistedMerges)
+
+	m.ColdPartsMoved += atomic.LoadUint64(&pt.coldPartsMoved)
 }
 
 // AddRows adds the given rows to the partition pt.
@@ -406,14 +526,26 @@ func (pt *partition) AddRows(rows []rawRow) {
 		rrs = append(rrs, rr)
 		pt.rawRowsLastFlushTime = time.Now()
 	}
+	pt.rawRowsPendingFlushes += len(rrs)
 	pt.rawRowsLock.Unlock()
 
 	for _, rr := range rrs {
 		pt.addRowsPart(rr.rows)
 		putRawRows(rr)
+		pt.finishRawRowsFlush()
 	}
 }
 
+// finishRawRowsFlush must be called after a batch of rows taken from pt.rawRows is converted into a part.
+func (pt *partition) finishRawRowsFlush() {
+	pt.rawRowsLock.Lock()
+	pt.rawRowsPendingFlushes--
+	if pt.rawRowsPendingFlushes == 0 {
+		pt.rawRowsPendingFlushesCond.Broadcast()
+	}
+	pt.rawRowsLock.Unlock()
+}
+
 type rawRows struct {
 	rows []rawRow
 }
@@ -649,15 +781,77 @@ func (pt *partition) flushRawRows(newRawRows []rawRow, isFinal bool) []rawRow {
 		oldRawRows = pt.rawRows
 		pt.rawRows = newRawRows[:0]
 		pt.rawRowsLastFlushTime = currentTime
+		pt.rawRowsPendingFlushes++
 	}
 	pt.rawRowsLock.Unlock()
 
 	if mustFlush {
 		pt.addRowsPart(oldRawRows)
+		pt.finishRawRowsFlush()
 	}
 	return oldRawRows
 }
 
+// flushRawRowsSync converts all the raw rows into inmemory parts and appends all the inmemory parts of pt to dst.
+//
+// It waits until concurrent raw rows flushes are finished, so the returned parts contain all the rows
+// added to pt before the call.
+func (pt *partition) flushRawRowsSync(dst []*partWrapper) []*partWrapper {
+	pt.flushRawRows(nil, true)
+	pt.rawRowsLock.Lock()
+	for pt.rawRowsPendingFlushes > 0 {
+		pt.rawRowsPendingFlushesCond.Wait()
+	}
+	pt.rawRowsLock.Unlock()
+
+	pt.partsLock.Lock()
+	for _, pw := range pt.smallParts {
+		if pw.mp != nil {
+			dst = append(dst, pw)
+		}
+	}
+	pt.partsLock.Unlock()
+	return dst
+}
+
+// flushInmemoryPartsSync flushes inmemory parts to files and waits until all the pws are converted to file parts.
+//
+// pws must be obtained via flushRawRowsSync. False is returned if stopCh is closed before pws are flushed.
+func (pt *partition) flushInmemoryPartsSync(pws []*partWrapper, stopCh <-chan struct{}) (bool, error) {
+	if _, err := pt.flushInmemoryParts(nil, true); err != nil {
+		return false, err
+	}
+	// Some of pws may be merged by background mergers, so wait until they are removed from smallParts.
+	for {
+		if !pt.hasSmallParts(pws) {
+			return true, nil
+		}
+		select {
+		case <-stopCh:
+			return false, nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (pt *partition) hasSmallParts(pws []*partWrapper) bool {
+	if len(pws) == 0 {
+		return false
+	}
+	m := make(map[*partWrapper]bool, len(pws))
+	for _, pw := range pws {
+		m[pw] = true
+	}
+	pt.partsLock.Lock()
+	defer pt.partsLock.Unlock()
+	for _, pw := range pt.smallParts {
+		if m[pw] {
+			return true
+		}
+	}
+	return false
+}
+
 func (pt *partition) startInmemoryPartsFlusher() {
 	pt.inmemoryPartsFlusherWG.Add(1)
 	go func() {
@@ -722,13 +916,31 @@ func (pt *partition) mergePartsOptimal(pws []*partWrapper) error {
 	return nil
 }
 
-var mergeWorkers = func() int {
+// SetMergeConcurrency sets the number of concurrent merge workers per each partition and per each indexdb table.
+//
+// Partitions have n workers for small parts and n workers for big parts.
+// The default number of workers is used if n is 0. Lower n reduces disk and CPU usage by background merges
+// at the cost of slower merges, so more parts may accumulate during heavy ingestion.
+//
+// This function must be called before initializing the storage.
+func SetMergeConcurrency(n int) {
+	if n <= 0 {
+		mergeWorkers = getDefaultMergeWorkers()
+	} else {
+		mergeWorkers = n
+	}
+	mergeset.SetMergeConcurrency(n)
+}
+
+var mergeWorkers = getDefaultMergeWorkers()
+
+func getDefaultMergeWorkers() int {
 	n := runtime.GOMAXPROCS(-1) / 2
 	if n <= 0 {
 		n = 1
 	}
 	return n
-}()
+}
 
 func (pt *partition) startMergeWorkers() {
 	for i := 0; i < mergeWorkers; i++ {
@@ -809,7 +1021,11 @@ func (pt *partition) partsMerger(mergerFunc func(isFinal bool) error) error {
 }
 
 func (pt *partition) maxOutPartRows() uint64 {
-	freeSpace := mustGetFreeDiskSpace(pt.bigPartsPath)
+	path := pt.bigPartsPath
+	if pt.isCold() {
+		path = pt.coldPartsPath
+	}
+	freeSpace := mustGetFreeDiskSpace(path)
 
 	// Calculate the maximum number of rows in the output merge part
 	// by dividing the freeSpace by the number of concurrent
@@ -861,6 +1077,13 @@ type freeSpaceEntry struct {
 }
 
 func (pt *partition) mergeBigParts(isFinal bool) error {
+	if pt.isCold() {
+		err := pt.moveHotPartsToCold()
+		if err != errNothingToMerge {
+			return err
+		}
+	}
+
 	maxRows := pt.maxOutPartRows()
 	if maxRows > maxRowsPerBigPart {
 		maxRows = maxRowsPerBigPart
@@ -901,6 +1124,84 @@ func (pt *partition) mergeSmallParts(isFinal bool) error {
 	return err
 }
 
+// moveHotPartsToCold moves file-based parts stored outside pt.coldPartsPath to pt.coldPartsPath.
+//
+// The parts are moved by merging them into a new part at pt.coldPartsPath,
+// so the move is atomic and crash-safe in the same way as ordinary merges.
+// It doesn't block data ingestion and search.
+func (pt *partition) moveHotPartsToCold() error {
+	maxRows := pt.maxOutPartRows()
+	if maxRows > maxRowsPerBigPart {
+		maxRows = maxRowsPerBigPart
+	}
+
+	pt.partsLock.Lock()
+	pws := pt.getHotPartsToMove(maxRows)
+	pt.partsLock.Unlock()
+
+	if len(pws) == 0 {
+		return errNothingToMerge
+	}
+
+	atomic.AddUint64(&pt.bigMergesCount, 1)
+	atomic.AddUint64(&pt.activeBigMerges, 1)
+	err := pt.mergeParts(pws, pt.stopCh)
+	atomic.AddUint64(&pt.activeBigMerges, ^uint64(0))
+	if err == nil {
+		atomic.AddUint64(&pt.coldPartsMoved, uint64(len(pws)))
+	}
+
+	return err
+}
+
+// getHotPartsToMove returns up to defaultPartsToMerge file-based parts
+// stored outside pt.coldPartsPath with up to maxRows rows in total.
+//
+// The returned parts are marked with isInMerge flag.
+//
+// pt.partsLock must be locked during the call.
+func (pt *partition) getHotPartsToMove(maxRows uint64) []*partWrapper {
+	var pws []*partWrapper
+	rowsCount := uint64(0)
+	appendParts := func(src []*partWrapper) {
+		for _, pw := range src {
+			if len(pws) >= defaultPartsToMerge {
+				return
+			}
+			if pw.mp != nil || pw.isInMerge || pt.isColdPart(pw) {
+				continue
+			}
+			if rowsCount+pw.p.ph.RowsCount > maxRows {
+				continue
+			}
+			rowsCount += pw.p.ph.RowsCount
+			pws = append(pws, pw)
+		}
+	}
+	appendParts(pt.smallParts)
+	appendParts(pt.bigParts)
+	for _, pw := range pws {
+		pw.isInMerge = true
+	}
+	return pws
+}
+
+// isCold returns true if pt data must be stored at cold storage.
+func (pt *partition) isCold() bool {
+	if len(pt.coldPartsPath) == 0 {
+		return false
+	}
+	return pt.tr.MaxTimestamp < timestampFromTime(time.Now())-coldStorageAge
+}
+
+// isColdPart returns true if pw is stored at cold storage.
+func (pt *partition) isColdPart(pw *partWrapper) bool {
+	if len(pt.coldPartsPath) == 0 || pw.mp != nil {
+		return false
+	}
+	return strings.HasPrefix(pw.p.path, pt.coldPartsPath+"/")
+}
+
 var errNothingToMerge = fmt.Errorf("nothing to merge")
 
 func (pt *partition) mergeParts(pws []*partWrapper, stopCh <-chan struct{}) error {
@@ -954,6 +1255,13 @@ func (pt *partition) mergeParts(pws []*partWrapper, stopCh <-chan struct{}) erro
 	if isBigPart {
 		ptPath = pt.bigPartsPath
 	}
+	if pt.isCold() {
+		// All the merged data for cold partitions goes to cold storage.
+		// Parts at cold storage are treated as big parts, so they aren't merged by small parts merger.
+		isBigPart = true
+		nocache = true
+		ptPath = pt.coldPartsPath
+	}
 	ptPath = filepath.Clean(ptPath)
 	mergeIdx := pt.nextMergeIdx()
 	tmpPartPath := fmt.Sprintf("%s/tmp/%016X", ptPath, mergeIdx)
@@ -972,7 +1280,9 @@ func (pt *partition) mergeParts(pws []*partWrapper, stopCh <-chan struct{}) erro
 		rowsDeleted = &pt.bigRowsDeleted
 	}
 	dmis := pt.getDeletedMetricIDs()
-	err := mergeBlockStreams(&ph, bsw, bsrs, stopCh, rowsMerged, dmis, rowsDeleted)
+	rd := newRetentionDeadlines(pt.getMetricIDRetentions(), timestampFromTime(time.Now()))
+	md := pt.getMetricIDDownsampling()
+	err := mergeBlockStreams(&ph, bsw, bsrs, stopCh, rowsMerged, dmis, rd, md, rowsDeleted)
 	putBlockStreamWriter(bsw)
 	if err != nil {
 		if err == errForciblyStopped {
@@ -998,7 +1308,7 @@ func (pt *partition) mergeParts(pws []*partWrapper, stopCh <-chan struct{}) erro
 	dstPartPath := ""
 	if ph.RowsCount > 0 {
 		// The destination part may have no rows if they are deleted
-		// during the merge due to dmis.
+		// during the merge due to dmis or rd.
 		dstPartPath = ph.Path(ptPath, mergeIdx)
 	}
 	fmt.Fprintf(&bb, "%s -> %s\n", tmpPartPath, dstPartPath)
@@ -1008,7 +1318,7 @@ func (pt *partition) mergeParts(pws []*partWrapper, stopCh <-chan struct{}) erro
 	}
 
 	// Run the created transaction.
-	if err := runTransaction(&pt.snapshotLock, pt.smallPartsPath, pt.bigPartsPath, txnPath); err != nil {
+	if err := runTransaction(&pt.snapshotLock, pt.pathPrefixes(), txnPath); err != nil {
 		return fmt.Errorf("cannot execute transaction %q: %s", txnPath, err)
 	}
 
@@ -1064,6 +1374,9 @@ func (pt *partition) mergeParts(pws []*partWrapper, stopCh <-chan struct{}) erro
 }
 
 func getCompressLevelForRowsCount(rowsCount uint64) int {
+	if compressLevel := encoding.GetCompressLevel(); compressLevel != 0 {
+		return compressLevel
+	}
 	if rowsCount <= 1<<19 {
 		return 1
 	}
@@ -1201,7 +1514,19 @@ func appendPartsToMerge(dst, src []*partWrapper, maxPartsToMerge int, maxRows ui
 	return append(dst, pws...)
 }
 
-func openParts(pathPrefix1, pathPrefix2, path string) ([]*partWrapper, error) {
+func (pt *partition) pathPrefixes() []string {
+	return getPartitionPathPrefixes(pt.smallPartsPath, pt.bigPartsPath, pt.coldPartsPath)
+}
+
+func getPartitionPathPrefixes(smallPartsPath, bigPartsPath, coldPartsPath string) []string {
+	pathPrefixes := []string{smallPartsPath, bigPartsPath}
+	if len(coldPartsPath) > 0 {
+		pathPrefixes = append(pathPrefixes, coldPartsPath)
+	}
+	return pathPrefixes
+}
+
+func openParts(pathPrefixes []string, path string) ([]*partWrapper, error) {
 	// Verify that the directory for the parts exists.
 	d, err := os.Open(path)
 	if err != nil {
@@ -1212,7 +1537,7 @@ func openParts(pathPrefix1, pathPrefix2, path string) ([]*partWrapper, error) {
 	// Run remaining transactions and cleanup /txn and /tmp directories.
 	// Snapshots cannot be created yet, so use fakeSnapshotLock.
 	var fakeSnapshotLock sync.RWMutex
-	if err := runTransactions(&fakeSnapshotLock, pathPrefix1, pathPrefix2, path); err != nil {
+	if err := runTransactions(&fakeSnapshotLock, pathPrefixes, path); err != nil {
 		return nil, fmt.Errorf("cannot run transactions from %q: %s", path, err)
 	}
 
@@ -1270,11 +1595,13 @@ func mustCloseParts(pws []*partWrapper) {
 	}
 }
 
-// CreateSnapshotAt creates pt snapshot at the given smallPath and bigPath dirs.
+// CreateSnapshotAt creates pt snapshot at the given smallPath, bigPath and coldPath dirs.
+//
+// coldPath must be empty if cold storage is disabled.
 //
 // Snapshot is created using linux hard links, so it is usually created
 // very quickly.
-func (pt *partition) CreateSnapshotAt(smallPath, bigPath string) error {
+func (pt *partition) CreateSnapshotAt(smallPath, bigPath, coldPath string) error {
 	logger.Infof("creating partition snapshot of %q and %q...", pt.smallPartsPath, pt.bigPartsPath)
 	startTime := time.Now()
 
@@ -1295,6 +1622,11 @@ func (pt *partition) CreateSnapshotAt(smallPath, bigPath string) error {
 	if err := pt.createSnapshot(pt.bigPartsPath, bigPath); err != nil {
 		return fmt.Errorf("cannot create snapshot for %q: %s", pt.bigPartsPath, err)
 	}
+	if len(pt.coldPartsPath) > 0 && len(coldPath) > 0 {
+		if err := pt.createSnapshot(pt.coldPartsPath, coldPath); err != nil {
+			return fmt.Errorf("cannot create snapshot for %q: %s", pt.coldPartsPath, err)
+		}
+	}
 
 	logger.Infof("created partition snapshot of %q and %q at %q and %q in %s", pt.smallPartsPath, pt.bigPartsPath, smallPath, bigPath, time.Since(startTime))
 	return nil
@@ -1338,7 +1670,7 @@ func (pt *partition) createSnapshot(srcDir, dstDir string) error {
 	return nil
 }
 
-func runTransactions(txnLock *sync.RWMutex, pathPrefix1, pathPrefix2, path string) error {
+func runTransactions(txnLock *sync.RWMutex, pathPrefixes []string, path string) error {
 	txnDir := path + "/txn"
 	d, err := os.Open(txnDir)
 	if err != nil {
@@ -1361,14 +1693,14 @@ func runTransactions(txnLock *sync.RWMutex, pathPrefix1, pathPrefix2, path strin
 
 	for _, fi := range fis {
 		txnPath := txnDir + "/" + fi.Name()
-		if err := runTransaction(txnLock, pathPrefix1, pathPrefix2, txnPath); err != nil {
+		if err := runTransaction(txnLock, pathPrefixes, txnPath); err != nil {
 			return fmt.Errorf("cannot run transaction from %q: %s", txnPath, err)
 		}
 	}
 	return nil
 }
 
-func runTransaction(txnLock *sync.RWMutex, pathPrefix1, pathPrefix2, txnPath string) error {
+func runTransaction(txnLock *sync.RWMutex, pathPrefixes []string, txnPath string) error {
 	// The transaction must be run under read lock in order to provide
 	// consistent snapshots with partition.CreateSnapshot().
 	txnLock.RLock()
@@ -1394,7 +1726,7 @@ func runTransaction(txnLock *sync.RWMutex, pathPrefix1, pathPrefix2, txnPath str
 
 	// Remove old paths. It is OK if certain paths don't exist.
 	for _, path := range rmPaths {
-		path, err := validatePath(pathPrefix1, pathPrefix2, path)
+		path, err := validatePath(pathPrefixes, path)
 		if err != nil {
 			return fmt.Errorf("invalid path to remove: %s", err)
 		}
@@ -1404,13 +1736,13 @@ func runTransaction(txnLock *sync.RWMutex, pathPrefix1, pathPrefix2, txnPath str
 	// Move the new part to new directory.
 	srcPath := mvPaths[0]
 	dstPath := mvPaths[1]
-	srcPath, err = validatePath(pathPrefix1, pathPrefix2, srcPath)
+	srcPath, err = validatePath(pathPrefixes, srcPath)
 	if err != nil {
 		return fmt.Errorf("invalid source path to rename: %s", err)
 	}
 	if len(dstPath) > 0 {
 		// Move srcPath to dstPath.
-		dstPath, err = validatePath(pathPrefix1, pathPrefix2, dstPath)
+		dstPath, err = validatePath(pathPrefixes, dstPath)
 		if err != nil {
 			return fmt.Errorf("invalid destination path to rename: %s", err)
 		}
@@ -1429,9 +1761,10 @@ func runTransaction(txnLock *sync.RWMutex, pathPrefix1, pathPrefix2, txnPath str
 		fs.MustRemoveAll(srcPath)
 	}
 
-	// Flush pathPrefix* directory metadata to the underying storage.
-	fs.MustSyncPath(pathPrefix1)
-	fs.MustSyncPath(pathPrefix2)
+	// Flush pathPrefixes directory metadata to the underying storage.
+	for _, pathPrefix := range pathPrefixes {
+		fs.MustSyncPath(pathPrefix)
+	}
 
 	// Remove the transaction file.
 	if err := os.Remove(txnPath); err != nil {
@@ -1441,26 +1774,21 @@ func runTransaction(txnLock *sync.RWMutex, pathPrefix1, pathPrefix2, txnPath str
 	return nil
 }
 
-func validatePath(pathPrefix1, pathPrefix2, path string) (string, error) {
-	var err error
-
-	pathPrefix1, err = filepath.Abs(pathPrefix1)
-	if err != nil {
-		return path, fmt.Errorf("cannot determine absolute path for pathPrefix1=%q: %s", pathPrefix1, err)
-	}
-	pathPrefix2, err = filepath.Abs(pathPrefix2)
-	if err != nil {
-		return path, fmt.Errorf("cannot determine absolute path for pathPrefix2=%q: %s", pathPrefix2, err)
-	}
-
-	path, err = filepath.Abs(path)
+func validatePath(pathPrefixes []string, path string) (string, error) {
+	path, err := filepath.Abs(path)
 	if err != nil {
 		return path, fmt.Errorf("cannot determine absolute path for %q: %s", path, err)
 	}
-	if !strings.HasPrefix(path, pathPrefix1+"/") && !strings.HasPrefix(path, pathPrefix2+"/") {
-		return path, fmt.Errorf("invalid path %q; must start with either %q or %q", path, pathPrefix1+"/", pathPrefix2+"/")
+	for _, pathPrefix := range pathPrefixes {
+		pathPrefix, err = filepath.Abs(pathPrefix)
+		if err != nil {
+			return path, fmt.Errorf("cannot determine absolute path for pathPrefix=%q: %s", pathPrefix, err)
+		}
+		if strings.HasPrefix(path, pathPrefix+"/") {
+			return path, nil
+		}
 	}
-	return path, nil
+	return path, fmt.Errorf("invalid path %q; must start with one of %q", path, pathPrefixes)
 }
 
 func createPartitionDirs(path string) error {
@@ -165,7 +165,7 @@ func testPartitionSearchEx(t *testing.T, ptt int64, tr TimeRange, partsCount, ma
 	})
 
 	// Create partition from rowss and test search on it.
-	pt, err := createPartition(ptt, "./small-table", "./big-table", nilGetDeletedMetricIDs)
+	pt, err := createPartition(ptt, "./small-table", "./big-table", "", nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 	if err != nil {
 		t.Fatalf("cannot create partition: %s", err)
 	}
@@ -189,7 +189,7 @@ func testPartitionSearchEx(t *testing.T, ptt int64, tr TimeRange, partsCount, ma
 	pt.MustClose()
 
 	// Open the created partition and test search on it.
-	pt, err = openPartition(smallPartsPath, bigPartsPath, nilGetDeletedMetricIDs)
+	pt, err = openPartition(smallPartsPath, bigPartsPath, "", nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 	if err != nil {
 		t.Fatalf("cannot open partition: %s", err)
 	}
@@ -277,3 +277,11 @@ func testPartitionSearchSerial(pt *partition, tsids []TSID, tr TimeRange, rbsExp
 func nilGetDeletedMetricIDs() map[uint64]struct{} {
 	return nil
 }
+
+func nilGetMetricIDRetentions() *metricIDRetentions {
+	return nil
+}
+
+func nilGetMetricIDDownsampling() *metricIDDownsampling {
+	return nil
+}
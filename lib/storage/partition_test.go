@@ -2,8 +2,11 @@ package storage
 
 import (
 	"math/rand"
+	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPartitionMaxOutPartRows(t *testing.T) {
@@ -16,6 +19,70 @@ func TestPartitionMaxOutPartRows(t *testing.T) {
 	}
 }
 
+func TestPartitionFlushRawRowsSyncConcurrent(t *testing.T) {
+	ptt := timestampFromTime(time.Now())
+	pt, err := createPartition(ptt, "./small-table-flush-sync", "./big-table-flush-sync", "", nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
+	if err != nil {
+		t.Fatalf("cannot create partition: %s", err)
+	}
+	defer func() {
+		pt.MustClose()
+		if err := os.RemoveAll("./small-table-flush-sync"); err != nil {
+			t.Fatalf("cannot remove small parts directory: %s", err)
+		}
+		if err := os.RemoveAll("./big-table-flush-sync"); err != nil {
+			t.Fatalf("cannot remove big parts directory: %s", err)
+		}
+	}()
+
+	// Flush raw rows concurrently with flushRawRowsSync calls like the background flusher does.
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var rawRows []rawRow
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			rawRows = pt.flushRawRows(rawRows[:0], true)
+		}
+	}()
+
+	var ptr TimeRange
+	ptr.fromPartitionTimestamp(ptt)
+	rowsAdded := uint64(0)
+	for i := 0; i < 100; i++ {
+		var rows []rawRow
+		for j := 0; j < 100; j++ {
+			rows = append(rows, rawRow{
+				TSID:          TSID{MetricID: uint64(j)},
+				Timestamp:     ptr.MinTimestamp + int64(i*100+j),
+				Value:         float64(j),
+				PrecisionBits: 64,
+			})
+		}
+		pt.AddRows(rows)
+		rowsAdded += uint64(len(rows))
+
+		// All the added rows must be converted into parts after flushRawRowsSync returns.
+		_ = pt.flushRawRowsSync(nil)
+		var m partitionMetrics
+		pt.UpdateMetrics(&m)
+		if m.PendingRows != 0 {
+			t.Fatalf("unexpected pending rows after flushRawRowsSync; got %d; want 0", m.PendingRows)
+		}
+		if rowsCount := m.SmallRowsCount + m.BigRowsCount; rowsCount != rowsAdded {
+			t.Fatalf("unexpected number of rows in parts after flushRawRowsSync; got %d; want %d", rowsCount, rowsAdded)
+		}
+	}
+	close(stopCh)
+	wg.Wait()
+}
+
 func TestAppendPartsToMerge(t *testing.T) {
 	testAppendPartsToMerge(t, 2, []int{}, nil)
 	testAppendPartsToMerge(t, 2, []int{123}, nil)
@@ -24,6 +24,11 @@ type rawRow struct {
 	// 1 means max. 50% error, 2 - 25%, 3 - 12.5%, 64 means no error, i.e.
 	// Value stored without information loss.
 	PrecisionBits uint8
+
+	// ExactValue is set to true if the Value must be stored as raw float64 bits
+	// instead of a decimal value, so it is restored bit-for-bit.
+	// See SetExactValuesMetricNameRegexp for details.
+	ExactValue bool
 }
 
 type rawRowsMarshaler struct {
@@ -110,11 +115,11 @@ func (rrm *rawRowsMarshaler) marshalToInmemoryPart(mp *inmemoryPart, rows []rawR
 	}
 
 	// Group rows into blocks.
-	var scale int16
 	var rowsMerged uint64
 	r := &rows[0]
 	tsid := &r.TSID
 	precisionBits := r.PrecisionBits
+	exactValue := r.ExactValue
 	tmpBlock := getBlock()
 	defer putBlock(tmpBlock)
 	for i := range rows {
@@ -125,25 +130,38 @@ func (rrm *rawRowsMarshaler) marshalToInmemoryPart(mp *inmemoryPart, rows []rawR
 			continue
 		}
 
-		rrm.auxValues, scale = decimal.AppendFloatToDecimal(rrm.auxValues[:0], rrm.auxFloatValues)
-		tmpBlock.Init(tsid, rrm.auxTimestamps, rrm.auxValues, scale, precisionBits)
-		rrm.bsw.WriteExternalBlock(tmpBlock, ph, &rowsMerged)
+		rrm.writeBlock(tmpBlock, ph, &rowsMerged, tsid, precisionBits, exactValue)
 
 		tsid = &r.TSID
 		precisionBits = r.PrecisionBits
+		exactValue = r.ExactValue
 		rrm.auxTimestamps = append(rrm.auxTimestamps[:0], r.Timestamp)
 		rrm.auxFloatValues = append(rrm.auxFloatValues[:0], r.Value)
 	}
 
-	rrm.auxValues, scale = decimal.AppendFloatToDecimal(rrm.auxValues[:0], rrm.auxFloatValues)
-	tmpBlock.Init(tsid, rrm.auxTimestamps, rrm.auxValues, scale, precisionBits)
-	rrm.bsw.WriteExternalBlock(tmpBlock, ph, &rowsMerged)
+	rrm.writeBlock(tmpBlock, ph, &rowsMerged, tsid, precisionBits, exactValue)
 	if rowsMerged != uint64(len(rows)) {
 		logger.Panicf("BUG: unexpected rowsMerged; got %d; want %d", rowsMerged, len(rows))
 	}
 	rrm.bsw.MustClose()
 }
 
+// writeBlock writes rrm.auxTimestamps and rrm.auxFloatValues for the given tsid to rrm.bsw via tmpBlock.
+//
+// Values are stored as raw float64 bits with decimal.ExactScale if exactValue is set.
+func (rrm *rawRowsMarshaler) writeBlock(tmpBlock *Block, ph *partHeader, rowsMerged *uint64, tsid *TSID, precisionBits uint8, exactValue bool) {
+	var scale int16
+	if exactValue {
+		rrm.auxValues = decimal.AppendFloatToExact(rrm.auxValues[:0], rrm.auxFloatValues)
+		scale = decimal.ExactScale
+		precisionBits = 64
+	} else {
+		rrm.auxValues, scale = decimal.AppendFloatToDecimal(rrm.auxValues[:0], rrm.auxFloatValues)
+	}
+	tmpBlock.Init(tsid, rrm.auxTimestamps, rrm.auxValues, scale, precisionBits)
+	rrm.bsw.WriteExternalBlock(tmpBlock, ph, rowsMerged)
+}
+
 func getRawRowsMarshaler() *rawRowsMarshaler {
 	v := rrmPool.Get()
 	if v == nil {
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+// RetentionFilter sets Retention for time series matching TagFilters.
+type RetentionFilter struct {
+	TagFilters []TagFilter
+	Retention  time.Duration
+}
+
+// String returns string representation of rf.
+func (rf *RetentionFilter) String() string {
+	var bb bytesutil.ByteBuffer
+	for i := range rf.TagFilters {
+		bb.B = append(bb.B, rf.TagFilters[i].String()...)
+	}
+	fmt.Fprintf(&bb, " %s", rf.Retention)
+	return string(bb.B)
+}
+
+type retentionFilter struct {
+	tfs            *TagFilters
+	retentionMsecs int64
+}
+
+// SetRetentionFilters sets per-series retention filters for s.
+//
+// The first filter matching the time series determines its retention.
+// Time series not matching any filter are kept for the global retention period
+// passed to OpenStorage. Filters cannot increase the global retention period.
+//
+// Samples outside the retention are dropped during background merges.
+// The filters are applied in background, so SetRetentionFilters returns immediately.
+func (s *Storage) SetRetentionFilters(rfs []RetentionFilter) error {
+	maxRetentionMsecs := int64(s.retentionMonths) * 31 * 24 * 3600 * 1e3
+	filters := make([]retentionFilter, 0, len(rfs))
+	for i := range rfs {
+		rf := &rfs[i]
+		retentionMsecs := int64(rf.Retention / time.Millisecond)
+		if retentionMsecs <= 0 {
+			return fmt.Errorf("retention must be positive for the filter %s", rf)
+		}
+		if retentionMsecs > maxRetentionMsecs {
+			return fmt.Errorf("retention for the filter %s cannot exceed the global retention of %d months", rf, s.retentionMonths)
+		}
+		tfs := NewTagFilters()
+		for j := range rf.TagFilters {
+			tf := &rf.TagFilters[j]
+			if err := tfs.Add(tf.Key, tf.Value, tf.IsNegative, tf.IsRegexp); err != nil {
+				return fmt.Errorf("cannot parse tag filter %s: %s", tf, err)
+			}
+		}
+		if len(tfs.tfs) == 0 {
+			return fmt.Errorf("the filter %s must contain at least a single non-empty tag filter", rf)
+		}
+		filters = append(filters, retentionFilter{
+			tfs:            tfs,
+			retentionMsecs: retentionMsecs,
+		})
+	}
+
+	s.retentionFiltersLock.Lock()
+	s.retentionFilters = filters
+	s.retentionFiltersLock.Unlock()
+
+	// Notify retentionFiltersUpdater about the new filters.
+	select {
+	case s.retentionFiltersUpdateCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Storage) getMetricIDRetentions() *metricIDRetentions {
+	return s.metricIDRetentions.Load().(*metricIDRetentions)
+}
+
+func (s *Storage) startRetentionFiltersUpdater() {
+	s.retentionFiltersUpdaterWG.Add(1)
+	go func() {
+		s.retentionFiltersUpdater()
+		s.retentionFiltersUpdaterWG.Done()
+	}()
+}
+
+// retentionFiltersUpdateInterval is the interval for matching new time series
+// against retention filters and dropping expired samples from parts
+// not touched by background merges.
+var retentionFiltersUpdateInterval = time.Hour
+
+func (s *Storage) retentionFiltersUpdater() {
+	t := time.NewTimer(retentionFiltersUpdateInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			t.Reset(retentionFiltersUpdateInterval)
+		case <-s.retentionFiltersUpdateCh:
+		}
+		if err := s.updateMetricIDRetentions(); err != nil {
+			logger.Errorf("cannot apply retention filters: %s", err)
+			continue
+		}
+		if err := s.tb.mergeExpiredParts(s.stop); err != nil {
+			logger.Errorf("cannot drop samples outside retention filters: %s", err)
+		}
+	}
+}
+
+// updateMetricIDRetentions matches all the time series against the current retention filters.
+func (s *Storage) updateMetricIDRetentions() error {
+	s.retentionFiltersLock.Lock()
+	filters := s.retentionFilters
+	s.retentionFiltersLock.Unlock()
+
+	mr := &metricIDRetentions{
+		m: make(map[uint64]int64),
+	}
+	if len(filters) > 0 {
+		mr.minRetentionMsecs = math.MaxInt64
+	}
+	idb := s.idb()
+	for i := range filters {
+		rf := &filters[i]
+		metricIDs, err := idb.searchAllMetricIDs(rf.tfs)
+		if err != nil {
+			return fmt.Errorf("cannot search time series for retention filter %s: %s", rf.tfs, err)
+		}
+		for _, metricID := range metricIDs {
+			if _, ok := mr.m[metricID]; ok {
+				// The time series already matches the previous filter.
+				continue
+			}
+			mr.m[metricID] = rf.retentionMsecs
+		}
+		if rf.retentionMsecs < mr.minRetentionMsecs {
+			mr.minRetentionMsecs = rf.retentionMsecs
+		}
+	}
+	s.metricIDRetentions.Store(mr)
+	return nil
+}
+
+// searchAllMetricIDs returns metricIDs for all the time series matching tfs in db and in its extDB.
+func (db *indexDB) searchAllMetricIDs(tfs *TagFilters) ([]uint64, error) {
+	tfss := []*TagFilters{tfs}
+	is := db.getIndexSearch()
+	metricIDs, err := is.searchMetricIDs(tfss, TimeRange{}, 1e9)
+	db.putIndexSearch(is)
+	if err != nil {
+		return nil, err
+	}
+	var extMetricIDs []uint64
+	if db.doExtDB(func(extDB *indexDB) {
+		is := extDB.getIndexSearch()
+		extMetricIDs, err = is.searchMetricIDs(tfss, TimeRange{}, 1e9)
+		extDB.putIndexSearch(is)
+	}) {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(metricIDs, extMetricIDs...), nil
+}
+
+// metricIDRetentions contains per-metricID retentions obtained from retention filters.
+type metricIDRetentions struct {
+	// m maps metricID to retention in milliseconds.
+	m map[uint64]int64
+
+	// minRetentionMsecs is the minimum retention among the retention filters.
+	minRetentionMsecs int64
+}
+
+// retentionDeadlines returns the minimum timestamps to keep for time series
+// matching retention filters at the given time.
+type retentionDeadlines struct {
+	mr  *metricIDRetentions
+	now int64
+}
+
+// newRetentionDeadlines returns retentionDeadlines for mr at the given timestamp now.
+//
+// nil is returned if mr is empty.
+func newRetentionDeadlines(mr *metricIDRetentions, now int64) *retentionDeadlines {
+	if mr == nil || len(mr.m) == 0 {
+		return nil
+	}
+	return &retentionDeadlines{
+		mr:  mr,
+		now: now,
+	}
+}
+
+// minTimestamp returns the minimum timestamp to keep for the given metricID.
+//
+// false is returned if the metricID doesn't match retention filters.
+func (rd *retentionDeadlines) minTimestamp(metricID uint64) (int64, bool) {
+	if rd == nil {
+		return 0, false
+	}
+	retentionMsecs, ok := rd.mr.m[metricID]
+	if !ok {
+		return 0, false
+	}
+	return rd.now - retentionMsecs, true
+}
+
+// maxMinTimestamp returns the timestamp starting from which rows cannot expire.
+func (rd *retentionDeadlines) maxMinTimestamp() int64 {
+	return rd.now - rd.mr.minRetentionMsecs
+}
+
+// hasExpiredRows returns true if p contains rows outside rd.
+func (p *part) hasExpiredRows(rd *retentionDeadlines) (bool, error) {
+	if rd == nil || p.ph.MinTimestamp >= rd.maxMinTimestamp() {
+		// Fast path - the part contains only fresh rows.
+		return false, nil
+	}
+	var compressedIndexBuf, indexBuf []byte
+	var bhs []blockHeader
+	for i := range p.metaindex {
+		mr := &p.metaindex[i]
+		if mr.MinTimestamp >= rd.maxMinTimestamp() {
+			continue
+		}
+		compressedIndexBuf = bytesutil.Resize(compressedIndexBuf[:0], int(mr.IndexBlockSize))
+		p.indexFile.ReadAt(compressedIndexBuf, int64(mr.IndexBlockOffset))
+		var err error
+		indexBuf, err = encoding.DecompressZSTD(indexBuf[:0], compressedIndexBuf)
+		if err != nil {
+			return false, fmt.Errorf("cannot decompress index block in the part %q: %s", p, err)
+		}
+		bhs, err = unmarshalBlockHeaders(bhs[:0], indexBuf, int(mr.BlockHeadersCount))
+		if err != nil {
+			return false, fmt.Errorf("cannot unmarshal index block in the part %q: %s", p, err)
+		}
+		for j := range bhs {
+			bh := &bhs[j]
+			if minTimestamp, ok := rd.minTimestamp(bh.TSID.MetricID); ok && bh.MinTimestamp < minTimestamp {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// dropExpiredRows drops rows outside rd from b.
+//
+// true is returned if b has no more rows.
+func (b *Block) dropExpiredRows(rd *retentionDeadlines, rowsDeleted *uint64) (bool, error) {
+	minTimestamp, ok := rd.minTimestamp(b.bh.TSID.MetricID)
+	if !ok || b.bh.MinTimestamp >= minTimestamp {
+		// Fast path - the block has no expired rows.
+		return false, nil
+	}
+	if b.bh.MaxTimestamp < minTimestamp {
+		// Fast path - all the block rows are expired.
+		*rowsDeleted += uint64(b.bh.RowsCount)
+		return true, nil
+	}
+
+	// Slow path - drop the expired rows.
+	if err := b.UnmarshalData(); err != nil {
+		return false, fmt.Errorf("cannot unmarshal block: %s", err)
+	}
+	n := 0
+	timestamps := b.timestamps[b.nextIdx:]
+	for n < len(timestamps) && timestamps[n] < minTimestamp {
+		n++
+	}
+	*rowsDeleted += uint64(n)
+	b.nextIdx += n
+	b.fixupTimestamps()
+	return false, nil
+}
+
+// mergeExpiredParts merges parts with time series containing rows outside retention filters,
+// so these rows are dropped.
+//
+// Parts without expired rows aren't rewritten.
+func (tb *table) mergeExpiredParts(stopCh <-chan struct{}) error {
+	rd := newRetentionDeadlines(tb.getMetricIDRetentions(), timestampFromTime(time.Now()))
+	if rd == nil {
+		// Nothing to drop.
+		return nil
+	}
+	ptws := tb.GetPartitions(nil)
+	defer tb.PutPartitions(ptws)
+	for _, ptw := range ptws {
+		if err := ptw.pt.mergeExpiredParts(rd, stopCh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pt *partition) mergeExpiredParts(rd *retentionDeadlines, stopCh <-chan struct{}) error {
+	pws := pt.GetParts(nil)
+	defer pt.PutParts(pws)
+	for _, pw := range pws {
+		ok, err := pw.p.hasExpiredRows(rd)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		// Rewrite the part if it isn't merged right now.
+		pt.partsLock.Lock()
+		canMerge := !pw.isInMerge && pt.hasPartNolock(pw)
+		if canMerge {
+			pw.isInMerge = true
+		}
+		pt.partsLock.Unlock()
+		if !canMerge {
+			// The part is already merged, so expired rows are dropped by the merge.
+			continue
+		}
+		if err := pt.mergeParts([]*partWrapper{pw}, stopCh); err != nil {
+			if err == errForciblyStopped {
+				return nil
+			}
+			return fmt.Errorf("cannot drop expired rows from the part %q: %s", pw.p, err)
+		}
+	}
+	return nil
+}
+
+func (pt *partition) hasPartNolock(pw *partWrapper) bool {
+	for _, x := range pt.smallParts {
+		if x == pw {
+			return true
+		}
+	}
+	for _, x := range pt.bigParts {
+		if x == pw {
+			return true
+		}
+	}
+	return false
+}
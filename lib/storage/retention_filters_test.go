@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMergeBlockStreamsWithRetentionDeadlines(t *testing.T) {
+	var bsrs []*blockStreamReader
+	var r rawRow
+	r.PrecisionBits = defaultPrecisionBits
+	for i := 0; i < 5; i++ {
+		var rows []rawRow
+		for j := 0; j < 3000; j++ {
+			r.TSID.MetricID = uint64(j%3) + 1
+			r.Timestamp = int64(rand.Intn(2000))
+			r.Value = rand.NormFloat64()
+			rows = append(rows, r)
+		}
+		bsrs = append(bsrs, newTestBlockStreamReader(t, rows))
+	}
+	mr := &metricIDRetentions{
+		m: map[uint64]int64{
+			1: 100,
+			2: 1000,
+		},
+		minRetentionMsecs: 100,
+	}
+	rd := newRetentionDeadlines(mr, 2000)
+
+	var mp inmemoryPart
+	var bsw blockStreamWriter
+	bsw.InitFromInmemoryPart(&mp)
+	var rowsMerged, rowsDeleted uint64
+	if err := mergeBlockStreams(&mp.ph, &bsw, bsrs, nil, &rowsMerged, nil, rd, nil, &rowsDeleted); err != nil {
+		t.Fatalf("unexpected error in mergeBlockStreams: %s", err)
+	}
+	if rowsMerged+rowsDeleted != 5*3000 {
+		t.Fatalf("unexpected rowsMerged+rowsDeleted; got %d; want %d", rowsMerged+rowsDeleted, 5*3000)
+	}
+	if rowsMerged != mp.ph.RowsCount {
+		t.Fatalf("unexpected rowsMerged; got %d; want %d", rowsMerged, mp.ph.RowsCount)
+	}
+
+	// Verify the merged data doesn't contain expired rows.
+	minTimestamps := map[uint64]int64{
+		1: 1900,
+		2: 1000,
+		3: 0,
+	}
+	var rowsCount uint64
+	var bsr blockStreamReader
+	bsr.InitFromInmemoryPart(&mp)
+	for bsr.NextBlock() {
+		b := &bsr.Block
+		if err := b.UnmarshalData(); err != nil {
+			t.Fatalf("cannot unmarshal block data: %s", err)
+		}
+		metricID := b.bh.TSID.MetricID
+		minTimestamp, ok := minTimestamps[metricID]
+		if !ok {
+			t.Fatalf("unexpected metricID=%d", metricID)
+		}
+		for _, timestamp := range b.timestamps {
+			if timestamp < minTimestamp {
+				t.Fatalf("unexpected timestamp=%d for metricID=%d; it must be dropped, since it is smaller than %d", timestamp, metricID, minTimestamp)
+			}
+		}
+		rowsCount += uint64(len(b.timestamps))
+	}
+	if err := bsr.Error(); err != nil {
+		t.Fatalf("unexpected error when reading merged data: %s", err)
+	}
+	if rowsCount != rowsMerged {
+		t.Fatalf("unexpected number of rows read; got %d; want %d", rowsCount, rowsMerged)
+	}
+}
+
+func TestPartHasExpiredRows(t *testing.T) {
+	var rows []rawRow
+	var r rawRow
+	r.PrecisionBits = defaultPrecisionBits
+	for i := 0; i < 1000; i++ {
+		r.TSID.MetricID = uint64(i%2) + 1
+		r.Timestamp = int64(i) + 1000
+		r.Value = float64(i)
+		rows = append(rows, r)
+	}
+	var mp inmemoryPart
+	mp.InitFromRows(rows)
+	p, err := mp.NewPart()
+	if err != nil {
+		t.Fatalf("cannot create part: %s", err)
+	}
+
+	f := func(retentions map[uint64]int64, now int64, resultExpected bool) {
+		t.Helper()
+		mr := &metricIDRetentions{
+			m:                 retentions,
+			minRetentionMsecs: 1 << 62,
+		}
+		for _, retentionMsecs := range retentions {
+			if retentionMsecs < mr.minRetentionMsecs {
+				mr.minRetentionMsecs = retentionMsecs
+			}
+		}
+		rd := newRetentionDeadlines(mr, now)
+		result, err := p.hasExpiredRows(rd)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for retentions=%v, now=%d; got %v; want %v", retentions, now, result, resultExpected)
+		}
+	}
+
+	// No retention filters
+	f(nil, 1e6, false)
+
+	// The retention covers all the rows
+	f(map[uint64]int64{1: 1e3, 2: 1e3}, 2000, false)
+
+	// Expired rows for metricID=1
+	f(map[uint64]int64{1: 1e3}, 2001, true)
+
+	// Expired rows for metricID=2, while metricID=1 has no expired rows
+	f(map[uint64]int64{1: 1e4, 2: 500}, 2000, true)
+
+	// Expired rows only for missing metricID
+	f(map[uint64]int64{3: 1}, 1e6, false)
+}
+
+func TestStorageRetentionFilters(t *testing.T) {
+	path := "TestStorageRetentionFilters"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+
+	// Add samples for the last 10 days.
+	const msecsPerDay = 24 * 3600 * 1000
+	now := timestampFromTime(time.Now())
+	var mrs []MetricRow
+	for _, job := range []string{"debug", "billing", "other"} {
+		var mn MetricName
+		mn.MetricGroup = []byte("metric")
+		mn.Tags = []Tag{{[]byte("job"), []byte(job)}}
+		metricNameRaw := mn.marshalRaw(nil)
+		for i := 0; i < 10; i++ {
+			mrs = append(mrs, MetricRow{
+				MetricNameRaw: metricNameRaw,
+				Timestamp:     now - int64(i)*msecsPerDay - 3600*1000,
+				Value:         float64(i),
+			})
+		}
+	}
+	if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+		t.Fatalf("unexpected error when adding mrs: %s", err)
+	}
+	s.DebugFlush()
+
+	// The first matching filter must be applied, so job=debug must be kept for 3 days,
+	// while job=billing must be kept for 7 days.
+	rfs := []RetentionFilter{
+		{
+			TagFilters: []TagFilter{{
+				Key:   []byte("job"),
+				Value: []byte("debug"),
+			}},
+			Retention: 3 * 24 * time.Hour,
+		},
+		{
+			TagFilters: []TagFilter{{
+				Key:      []byte("job"),
+				Value:    []byte("debug|billing"),
+				IsRegexp: true,
+			}},
+			Retention: 7 * 24 * time.Hour,
+		},
+	}
+	if err := s.SetRetentionFilters(rfs); err != nil {
+		t.Fatalf("cannot set retention filters: %s", err)
+	}
+
+	rowsCountsExpected := map[string]int{
+		"debug":   3,
+		"billing": 7,
+		"other":   10,
+	}
+	var rowsCounts map[string]int
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		rowsCounts, err = getRowsCountsByJob(s)
+		if err != nil {
+			t.Fatalf("cannot obtain rows counts: %s", err)
+		}
+		if fmt.Sprintf("%v", rowsCounts) == fmt.Sprintf("%v", rowsCountsExpected) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fmt.Sprintf("%v", rowsCounts) != fmt.Sprintf("%v", rowsCountsExpected) {
+		t.Fatalf("unexpected rows counts after applying retention filters; got %v; want %v", rowsCounts, rowsCountsExpected)
+	}
+
+	// Invalid filters
+	f := func(rf RetentionFilter) {
+		t.Helper()
+		if err := s.SetRetentionFilters([]RetentionFilter{rf}); err == nil {
+			t.Fatalf("expecting non-nil error for retention filter %s", &rf)
+		}
+	}
+	tfs := []TagFilter{{
+		Key:   []byte("job"),
+		Value: []byte("foo"),
+	}}
+	f(RetentionFilter{
+		TagFilters: tfs,
+		Retention:  0,
+	})
+	f(RetentionFilter{
+		TagFilters: tfs,
+		Retention:  time.Duration(maxRetentionMonths+1) * 31 * 24 * time.Hour,
+	})
+	f(RetentionFilter{
+		TagFilters: nil,
+		Retention:  time.Hour,
+	})
+
+	s.MustClose()
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
+
+func getRowsCountsByJob(s *Storage) (map[string]int, error) {
+	tfs := NewTagFilters()
+	if err := tfs.Add(nil, []byte("metric"), false, false); err != nil {
+		return nil, fmt.Errorf("cannot add tag filter: %s", err)
+	}
+	tr := TimeRange{
+		MinTimestamp: 0,
+		MaxTimestamp: timestampFromTime(time.Now()),
+	}
+	m := make(map[string]int)
+	var sr Search
+	sr.Init(s, []*TagFilters{tfs}, tr, 1e5)
+	defer sr.MustClose()
+	var mn MetricName
+	for sr.NextMetricBlock() {
+		if err := mn.Unmarshal(sr.MetricBlock.MetricName); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal metric name: %s", err)
+		}
+		m[string(mn.GetTagValue("job"))] += sr.MetricBlock.Block.RowsCount()
+	}
+	if err := sr.Error(); err != nil {
+		return nil, fmt.Errorf("search error: %s", err)
+	}
+	return m, nil
+}
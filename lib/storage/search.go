@@ -86,6 +86,9 @@ type Search struct {
 
 	ts tableSearch
 
+	// stopCh is closed when the search must be stopped. It may be nil.
+	stopCh <-chan struct{}
+
 	err error
 
 	needClosing bool
@@ -102,6 +105,7 @@ func (s *Search) reset() {
 
 	s.storage = nil
 	s.ts.reset()
+	s.stopCh = nil
 	s.err = nil
 	s.needClosing = false
 	s.MissingMetricNamesForMetricID = 0
@@ -111,14 +115,25 @@ func (s *Search) reset() {
 //
 // MustClose must be called when the search is done.
 func (s *Search) Init(storage *Storage, tfss []*TagFilters, tr TimeRange, maxMetrics int) {
+	s.InitWithStopCh(storage, tfss, tr, maxMetrics, nil)
+}
+
+// InitWithStopCh initializes s from the given storage, tfss and tr.
+//
+// The search is stopped with ErrSearchCanceled error as soon as stopCh is closed.
+// This allows aborting index scans and data fetches for queries canceled by clients.
+//
+// MustClose must be called when the search is done.
+func (s *Search) InitWithStopCh(storage *Storage, tfss []*TagFilters, tr TimeRange, maxMetrics int, stopCh <-chan struct{}) {
 	if s.needClosing {
 		logger.Panicf("BUG: missing MustClose call before the next call to Init")
 	}
 
 	s.reset()
 	s.needClosing = true
+	s.stopCh = stopCh
 
-	tsids, err := storage.searchTSIDs(tfss, tr, maxMetrics)
+	tsids, err := storage.searchTSIDs(tfss, tr, maxMetrics, stopCh)
 
 	// It is ok to call Init on error from storage.searchTSIDs.
 	// Init must be called before returning because it will fail
@@ -156,6 +171,10 @@ func (s *Search) NextMetricBlock() bool {
 		return false
 	}
 	for s.ts.NextBlock() {
+		if s.isStopped() {
+			s.err = ErrSearchCanceled
+			return false
+		}
 		tsid := &s.ts.Block.bh.TSID
 		var err error
 		s.MetricBlock.MetricName, err = s.storage.searchMetricName(s.MetricBlock.MetricName[:0], tsid.MetricID)
@@ -180,11 +199,26 @@ func (s *Search) NextMetricBlock() bool {
 	return false
 }
 
+func (s *Search) isStopped() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
 // SearchQuery is used for sending search queries from vmselect to vmstorage.
 type SearchQuery struct {
 	MinTimestamp int64
 	MaxTimestamp int64
 	TagFilterss  [][]TagFilter
+
+	// MaxMetrics is the maximum number of unique time series the search may return.
+	//
+	// The default limit is used if MaxMetrics is zero.
+	// MaxMetrics isn't marshaled, since it is set by the querier for each request.
+	MaxMetrics int
 }
 
 // TagFilter represents a single tag filter from SearchQuery.
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"regexp"
 	"sort"
+	"strings"
 	"testing"
 	"testing/quick"
 	"time"
@@ -132,6 +133,57 @@ func TestSearch(t *testing.T) {
 		MaxTimestamp: endTimestamp - int64(rowsCount)/3,
 	}
 
+	// The canceled search must run before other searches, so they verify
+	// the canceled search doesn't leave partial results in caches.
+	t.Run("canceled", func(t *testing.T) {
+		tfs := NewTagFilters()
+		if err := tfs.Add(nil, []byte(`metric_\d+`), false, true); err != nil {
+			t.Fatalf("cannot add tag filter: %s", err)
+		}
+		stopCh := make(chan struct{})
+		close(stopCh)
+		var s Search
+		s.InitWithStopCh(st, []*TagFilters{tfs}, tr, 1e5, stopCh)
+		if s.NextMetricBlock() {
+			t.Fatalf("unexpected block found in canceled search")
+		}
+		err := s.Error()
+		s.MustClose()
+		if err == nil {
+			t.Fatalf("expecting non-nil error for canceled search")
+		}
+		if !strings.Contains(err.Error(), ErrSearchCanceled.Error()) {
+			t.Fatalf("unexpected error for canceled search: %s", err)
+		}
+	})
+
+	t.Run("too-many-timeseries", func(t *testing.T) {
+		tfs := NewTagFilters()
+		if err := tfs.Add(nil, []byte(`metric_\d+`), false, true); err != nil {
+			t.Fatalf("cannot add tag filter: %s", err)
+		}
+		var s Search
+		s.Init(st, []*TagFilters{tfs}, tr, 1000)
+		if s.NextMetricBlock() {
+			t.Fatalf("unexpected block found in search exceeding the limit on unique time series")
+		}
+		err := s.Error()
+		s.MustClose()
+		if err == nil {
+			t.Fatalf("expecting non-nil error for search exceeding the limit on unique time series")
+		}
+		if !strings.Contains(err.Error(), "exceeds the limit of 1000 unique time series") {
+			t.Fatalf("unexpected error for search exceeding the limit on unique time series: %s", err)
+		}
+		e, ok := err.(*TooManyTimeseriesError)
+		if !ok {
+			t.Fatalf("unexpected error type for search exceeding the limit on unique time series; got %T; want %T", err, e)
+		}
+		if e.MaxTimeseries != 1000 || e.Timeseries <= 1000 {
+			t.Fatalf("unexpected error for search exceeding the limit on unique time series: %+v", e)
+		}
+	})
+
 	t.Run("serial", func(t *testing.T) {
 		if err := testSearch(st, tr, mrs, accountsCount); err != nil {
 			t.Fatalf("unexpected error: %s", err)
@@ -183,7 +235,7 @@ func testSearch(st *Storage, tr TimeRange, mrs []MetricRow, accountsCount int) e
 			if mr.Timestamp < tr.MinTimestamp || mr.Timestamp > tr.MaxTimestamp {
 				continue
 			}
-			if err := mn.unmarshalRaw(mr.MetricNameRaw); err != nil {
+			if err := mn.UnmarshalRaw(mr.MetricNameRaw); err != nil {
 				return fmt.Errorf("cannot unmarshal MetricName: %s", err)
 			}
 			if !metricGroupRegexp.Match(mn.MetricGroup) {
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bloomfilter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// SetSeriesLimits sets limits on the number of new series, which may be created
+// during an hour and during a day.
+//
+// Samples for new series exceeding the limits are dropped, while samples
+// for already existing series are accepted. The corresponding limit is disabled if it is 0.
+//
+// This function must be called before initializing the storage.
+func SetSeriesLimits(maxHourly, maxDaily int) {
+	maxHourlySeries = maxHourly
+	maxDailySeries = maxDaily
+}
+
+var (
+	maxHourlySeries = 0
+	maxDailySeries  = 0
+)
+
+func (s *Storage) initSeriesLimiters() {
+	if maxHourlySeries > 0 {
+		s.hourlySeriesLimiter = bloomfilter.NewLimiter(maxHourlySeries, time.Hour)
+	}
+	if maxDailySeries > 0 {
+		s.dailySeriesLimiter = bloomfilter.NewLimiter(maxDailySeries, 24*time.Hour)
+	}
+}
+
+func (s *Storage) stopSeriesLimiters() {
+	if s.hourlySeriesLimiter != nil {
+		s.hourlySeriesLimiter.MustStop()
+	}
+	if s.dailySeriesLimiter != nil {
+		s.dailySeriesLimiter.MustStop()
+	}
+}
+
+func (s *Storage) hasSeriesLimits() bool {
+	return s.hourlySeriesLimiter != nil || s.dailySeriesLimiter != nil
+}
+
+// getOrCreateTSIDWithLimits puts TSID for the given metricName to dst.
+//
+// It creates new TSID only if the series limits aren't exceeded.
+// false is returned if the series must be dropped because of the limits.
+func (s *Storage) getOrCreateTSIDWithLimits(is *indexSearch, dst *TSID, metricName []byte, mn *MetricName) (bool, error) {
+	err := is.getTSIDByMetricName(dst, metricName)
+	if err == nil {
+		return true, nil
+	}
+	if err != io.EOF {
+		return false, fmt.Errorf("cannot search TSID by MetricName %q: %s", metricName, err)
+	}
+	h := xxhash.Sum64(metricName)
+	// Check the daily limit before adding the series to the hourly limiter,
+	// so the series rejected by the daily limit isn't counted by the hourly limiter.
+	if s.dailySeriesLimiter != nil && !s.dailySeriesLimiter.CanAdd(h) {
+		atomic.AddUint64(&s.dailySeriesLimitRowsDropped, 1)
+		logSkippedSeries(mn, "-storage.maxDailySeries", s.dailySeriesLimiter.MaxItems())
+		return false, nil
+	}
+	if s.hourlySeriesLimiter != nil && !s.hourlySeriesLimiter.Add(h) {
+		atomic.AddUint64(&s.hourlySeriesLimitRowsDropped, 1)
+		logSkippedSeries(mn, "-storage.maxHourlySeries", s.hourlySeriesLimiter.MaxItems())
+		return false, nil
+	}
+	if s.dailySeriesLimiter != nil && !s.dailySeriesLimiter.Add(h) {
+		// The daily limit has been reached by concurrent goroutines after the CanAdd check above.
+		atomic.AddUint64(&s.dailySeriesLimitRowsDropped, 1)
+		logSkippedSeries(mn, "-storage.maxDailySeries", s.dailySeriesLimiter.MaxItems())
+		return false, nil
+	}
+	if err := is.db.createTSIDByName(dst, metricName); err != nil {
+		return false, fmt.Errorf("cannot create TSID by MetricName %q: %s", metricName, err)
+	}
+	return true, nil
+}
+
+// logSkippedSeries logs a sample series dropped because of the series limit.
+//
+// It logs at most a single series per 5 seconds in order to prevent from log flooding.
+func logSkippedSeries(mn *MetricName, flagName string, limit int) {
+	now := uint64(time.Now().Unix())
+	lastLogTime := atomic.LoadUint64(&skippedSeriesLastLogTime)
+	if now < lastLogTime+5 || !atomic.CompareAndSwapUint64(&skippedSeriesLastLogTime, lastLogTime, now) {
+		return
+	}
+	logger.Errorf("WARNING: skipping samples for series %s, since the limit on new series %s=%d is exceeded", mn, flagName, limit)
+}
+
+var skippedSeriesLastLogTime uint64
+
+func (s *Storage) updateSeriesLimitsMetrics(m *Metrics) {
+	m.HourlySeriesLimitRowsDropped += atomic.LoadUint64(&s.hourlySeriesLimitRowsDropped)
+	m.DailySeriesLimitRowsDropped += atomic.LoadUint64(&s.dailySeriesLimitRowsDropped)
+	if l := s.hourlySeriesLimiter; l != nil {
+		m.HourlySeriesLimitMaxSeries += uint64(l.MaxItems())
+		m.HourlySeriesLimitCurrentSeries += uint64(l.CurrentItems())
+	}
+	if l := s.dailySeriesLimiter; l != nil {
+		m.DailySeriesLimitMaxSeries += uint64(l.MaxItems())
+		m.DailySeriesLimitCurrentSeries += uint64(l.CurrentItems())
+	}
+}
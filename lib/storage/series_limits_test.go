@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorageSeriesLimits(t *testing.T) {
+	f := func(maxHourly, maxDaily int, hourlyDroppedExpected, dailyDroppedExpected uint64) {
+		t.Helper()
+		SetSeriesLimits(maxHourly, maxDaily)
+		defer SetSeriesLimits(0, 0)
+
+		path := "TestStorageSeriesLimits"
+		s, err := OpenStorage(path, 0)
+		if err != nil {
+			t.Fatalf("cannot open storage: %s", err)
+		}
+		now := timestampFromTime(time.Now())
+		addRows := func(jobsCount int, timestamp int64) {
+			t.Helper()
+			var mrs []MetricRow
+			var mn MetricName
+			mn.MetricGroup = []byte("metric")
+			for i := 0; i < jobsCount; i++ {
+				mn.Tags = []Tag{{[]byte("job"), []byte(fmt.Sprintf("job_%d", i))}}
+				mrs = append(mrs, MetricRow{
+					MetricNameRaw: mn.marshalRaw(nil),
+					Timestamp:     timestamp,
+					Value:         float64(i),
+				})
+			}
+			if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+				t.Fatalf("unexpected error when adding mrs: %s", err)
+			}
+		}
+
+		// Only the first 3 series must be created.
+		addRows(5, now-2000)
+		// Samples for already existing series must be accepted after reaching the limit.
+		addRows(3, now-1000)
+		s.DebugFlush()
+
+		timestamps, err := getTimestampsByJob(s)
+		if err != nil {
+			t.Fatalf("cannot obtain timestamps: %s", err)
+		}
+		if len(timestamps) != 3 {
+			t.Fatalf("unexpected number of series; got %d; want 3; series: %v", len(timestamps), timestamps)
+		}
+		for job, tss := range timestamps {
+			if len(tss) != 2 {
+				t.Fatalf("unexpected number of samples for %q; got %d; want 2", job, len(tss))
+			}
+		}
+
+		var m Metrics
+		s.UpdateMetrics(&m)
+		if maxHourly > 0 {
+			if m.HourlySeriesLimitRowsDropped != hourlyDroppedExpected {
+				t.Fatalf("unexpected number of rows dropped by hourly limit; got %d; want %d", m.HourlySeriesLimitRowsDropped, hourlyDroppedExpected)
+			}
+			// Only accepted series must be counted.
+			if m.HourlySeriesLimitCurrentSeries != 3 {
+				t.Fatalf("unexpected number of series for hourly limit; got %d; want 3", m.HourlySeriesLimitCurrentSeries)
+			}
+			if m.HourlySeriesLimitMaxSeries != uint64(maxHourly) {
+				t.Fatalf("unexpected hourly limit; got %d; want %d", m.HourlySeriesLimitMaxSeries, maxHourly)
+			}
+		}
+		if maxDaily > 0 {
+			if m.DailySeriesLimitRowsDropped != dailyDroppedExpected {
+				t.Fatalf("unexpected number of rows dropped by daily limit; got %d; want %d", m.DailySeriesLimitRowsDropped, dailyDroppedExpected)
+			}
+			// Only accepted series must be counted.
+			if m.DailySeriesLimitCurrentSeries != 3 {
+				t.Fatalf("unexpected number of series for daily limit; got %d; want 3", m.DailySeriesLimitCurrentSeries)
+			}
+		}
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}
+	f(3, 0, 2, 0)
+	f(0, 3, 0, 2)
+	// The daily limit doesn't drop rows if the hourly limit is stricter.
+	f(3, 100, 2, 0)
+	// The daily limit is checked first, so the series dropped by it aren't counted by the hourly limit.
+	f(100, 3, 0, 2)
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
@@ -14,11 +15,14 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bloomfilter"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/memory"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/mergeset"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/timerpool"
 	"github.com/VictoriaMetrics/fastcache"
 	"golang.org/x/sys/unix"
@@ -31,12 +35,31 @@ type Storage struct {
 	path            string
 	cachePath       string
 	retentionMonths int
+	retentionMsecs  int64
+
+	// The interval for indexdb rotation. It is 0 if indexdb is rotated together with the data retention.
+	// See SetIndexDBRetention.
+	indexDBRetentionMsecs int64
 
 	// lock file for exclusive access to the storage on the given path.
 	flockF *os.File
 
 	idbCurr atomic.Value
 
+	// indexdb tables rotated out of idbCurr and its extDB. They are kept until the data they refer to
+	// falls outside the retention. See SetIndexDBRetention.
+	archivedIDBsLock sync.Mutex
+	archivedIDBs     []*archivedIndexDB
+
+	// The number of indexdb rotations.
+	indexDBRotations uint64
+
+	// The number of dropped archived indexdb tables.
+	archivedIndexDBsDropped uint64
+
+	// The number of searches in archived indexdb tables.
+	archivedIndexDBSearches uint64
+
 	tb *table
 
 	// tsidCache is MetricName -> TSID cache.
@@ -51,6 +74,43 @@ type Storage struct {
 	// dateMetricIDCache is (Date, MetricID) cache.
 	dateMetricIDCache *fastcache.Cache
 
+	// The maximum sizes in bytes for the caches above.
+	tsidCacheMaxBytes         int
+	metricIDCacheMaxBytes     int
+	metricNameCacheMaxBytes   int
+	dateMetricIDCacheMaxBytes int
+
+	// latestTimestampCache is MetricID -> the latest ingested timestamp cache.
+	//
+	// It is used for dropping samples outside the window set via SetMaxOutOfOrderWindow.
+	// It is nil if the window isn't set.
+	latestTimestampCache *fastcache.Cache
+
+	// The number of accepted out-of-order rows.
+	outOfOrderRowsReordered uint64
+
+	// The number of dropped out-of-order rows.
+	outOfOrderRowsDropped uint64
+
+	// Limiters for the number of new series set via SetSeriesLimits.
+	// They are nil if the corresponding limits aren't set.
+	hourlySeriesLimiter *bloomfilter.Limiter
+	dailySeriesLimiter  *bloomfilter.Limiter
+
+	// The number of rows dropped because of the series limits.
+	hourlySeriesLimitRowsDropped uint64
+	dailySeriesLimitRowsDropped  uint64
+
+	// The number of rows with timestamps exceeding the limit set via SetMaxFutureSampleTimestamp.
+	futureTimestampRowsDropped uint64
+	futureTimestampRowsClamped uint64
+
+	// The number of rows dropped because of the label limits set via SetLabelLimits.
+	tooLongMetricNameRowsDropped uint64
+	tooLongLabelNameRowsDropped  uint64
+	tooLongLabelValueRowsDropped uint64
+	tooManyLabelsRowsDropped     uint64
+
 	// Fast cache for MetricID values occured during the current hour.
 	currHourMetricIDs atomic.Value
 
@@ -61,10 +121,53 @@ type Storage struct {
 	pendingHourMetricIDsLock sync.Mutex
 	pendingHourMetricIDs     map[uint64]struct{}
 
+	// Per-series retention filters set via SetRetentionFilters.
+	retentionFiltersLock sync.Mutex
+	retentionFilters     []retentionFilter
+
+	// metricIDRetentions contains per-metricID retentions obtained from retentionFilters.
+	metricIDRetentions atomic.Value
+
+	// retentionFiltersUpdateCh is used for notifying retentionFiltersUpdater about retentionFilters change.
+	retentionFiltersUpdateCh chan struct{}
+
+	// metricIDDownsampling contains per-metricID downsampling filters obtained from downsampling periods with series selectors.
+	metricIDDownsampling atomic.Value
+
+	// isReadOnly is set to 1 when free disk space drops below the limit set via SetMinFreeDiskSpaceBytes.
+	isReadOnly uint32
+
+	// wal is the write-ahead log for the added rows. It is nil if the log is disabled via SetWAL.
+	wal *wal
+
+	// The number of rows replayed from the wal on startup.
+	walRowsReplayed uint64
+
 	stop chan struct{}
 
 	currHourMetricIDsUpdaterWG sync.WaitGroup
+	freeDiskSpaceWatcherWG     sync.WaitGroup
 	retentionWatcherWG         sync.WaitGroup
+	retentionFiltersUpdaterWG  sync.WaitGroup
+	downsamplingUpdaterWG      sync.WaitGroup
+	walWG                      sync.WaitGroup
+}
+
+// SetOpenPhaseCallback sets f, which is called with the name of every phase OpenStorage goes through.
+//
+// This allows reporting the progress of slow storage opening.
+//
+// This function must be called before initializing the storage.
+func SetOpenPhaseCallback(f func(phase string)) {
+	openPhaseCallback = f
+}
+
+var openPhaseCallback func(phase string)
+
+func reportOpenPhase(phase string) {
+	if openPhaseCallback != nil {
+		openPhaseCallback(phase)
+	}
 }
 
 // OpenStorage opens storage on the given path with the given number of retention months.
@@ -84,6 +187,9 @@ func OpenStorage(path string, retentionMonths int) (*Storage, error) {
 		path:            path,
 		cachePath:       path + "/cache",
 		retentionMonths: retentionMonths,
+		retentionMsecs:  int64(retentionMonths) * 31 * 24 * 3600 * 1e3,
+
+		retentionFiltersUpdateCh: make(chan struct{}, 1),
 
 		stop: make(chan struct{}),
 	}
@@ -107,11 +213,19 @@ func OpenStorage(path string, retentionMonths int) (*Storage, error) {
 	s.flockF = flockF
 
 	// Load caches.
+	reportOpenPhase("loading caches")
 	mem := memory.Allowed()
-	s.tsidCache = s.mustLoadCache("MetricName->TSID", "metricName_tsid", mem/3)
-	s.metricIDCache = s.mustLoadCache("MetricID->TSID", "metricID_tsid", mem/16)
-	s.metricNameCache = s.mustLoadCache("MetricID->MetricName", "metricID_metricName", mem/8)
-	s.dateMetricIDCache = s.mustLoadCache("Date->MetricID", "date_metricID", mem/32)
+	s.tsidCacheMaxBytes = getCacheSize(tsidCacheSize, mem/3)
+	s.metricIDCacheMaxBytes = getCacheSize(metricIDCacheSize, mem/16)
+	s.metricNameCacheMaxBytes = getCacheSize(metricNameCacheSize, mem/8)
+	s.dateMetricIDCacheMaxBytes = getCacheSize(dateMetricIDCacheSize, mem/32)
+	s.tsidCache = s.mustLoadCache("MetricName->TSID", "metricName_tsid", s.tsidCacheMaxBytes)
+	s.metricIDCache = s.mustLoadCache("MetricID->TSID", "metricID_tsid", s.metricIDCacheMaxBytes)
+	s.metricNameCache = s.mustLoadCache("MetricID->MetricName", "metricID_metricName", s.metricNameCacheMaxBytes)
+	s.dateMetricIDCache = s.mustLoadCache("Date->MetricID", "date_metricID", s.dateMetricIDCacheMaxBytes)
+	if maxOutOfOrderWindow > 0 {
+		s.latestTimestampCache = s.mustLoadCache("MetricID->LatestTimestamp", "metricID_latestTimestamp", mem/32)
+	}
 
 	hour := uint64(timestampFromTime(time.Now())) / msecPerHour
 	hmCurr := s.mustLoadHourMetricIDs(hour, "curr_hour_metric_ids")
@@ -121,35 +235,61 @@ func OpenStorage(path string, retentionMonths int) (*Storage, error) {
 	s.pendingHourMetricIDs = make(map[uint64]struct{})
 
 	// Load indexdb
+	reportOpenPhase("opening indexdb")
 	idbPath := path + "/indexdb"
 	idbSnapshotsPath := idbPath + "/snapshots"
 	if err := fs.MkdirAllIfNotExist(idbSnapshotsPath); err != nil {
 		return nil, fmt.Errorf("cannot create %q: %s", idbSnapshotsPath, err)
 	}
-	idbCurr, idbPrev, err := openIndexDBTables(idbPath, s.metricIDCache, s.metricNameCache, &s.currHourMetricIDs, &s.prevHourMetricIDs)
+	if indexDBRetentionMsecs > 0 && indexDBRetentionMsecs < s.retentionMsecs {
+		s.indexDBRetentionMsecs = indexDBRetentionMsecs
+	}
+	idbCurr, idbPrev, archived, err := openIndexDBTables(idbPath, s.retentionMsecs, s.metricIDCache, s.metricNameCache, &s.currHourMetricIDs, &s.prevHourMetricIDs)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open indexdb tables at %q: %s", idbPath, err)
 	}
 	idbCurr.SetExtDB(idbPrev)
 	s.idbCurr.Store(idbCurr)
+	s.archivedIDBs = archived
+	for _, a := range archived {
+		s.mergeArchivedDeletedMetricIDs(a.db)
+	}
 
 	// Load data
+	reportOpenPhase("opening partitions")
 	tablePath := path + "/data"
-	tb, err := openTable(tablePath, retentionMonths, s.getDeletedMetricIDs)
+	s.metricIDRetentions.Store(&metricIDRetentions{})
+	s.metricIDDownsampling.Store((*metricIDDownsampling)(nil))
+	tb, err := openTable(tablePath, retentionMonths, s.getDeletedMetricIDs, s.getMetricIDRetentions, s.getMetricIDDownsampling)
 	if err != nil {
 		s.idb().MustClose()
+		s.mustCloseArchivedIndexDBs()
 		return nil, fmt.Errorf("cannot open table at %q: %s", tablePath, err)
 	}
 	s.tb = tb
 
+	reportOpenPhase("replaying wal")
+	if err := s.mustOpenWAL(); err != nil {
+		s.tb.MustClose()
+		s.idb().MustClose()
+		s.mustCloseArchivedIndexDBs()
+		return nil, fmt.Errorf("cannot open wal: %s", err)
+	}
+
 	s.startCurrHourMetricIDsUpdater()
 	s.startRetentionWatcher()
+	s.startRetentionFiltersUpdater()
+	s.startDownsamplingUpdater()
+	s.initSeriesLimiters()
+	s.startFreeDiskSpaceWatcher()
 
 	return s, nil
 }
 
-// debugFlush flushes recently added storage data, so it becomes visible to search.
-func (s *Storage) debugFlush() {
+// DebugFlush flushes recently added storage data, so it becomes visible to search.
+//
+// This function is only for debugging and testing.
+func (s *Storage) DebugFlush() {
 	s.tb.flushRawRows()
 	s.idb().tb.DebugFlush()
 }
@@ -174,7 +314,7 @@ func (s *Storage) CreateSnapshot() (string, error) {
 		return "", fmt.Errorf("cannot create dir %q: %s", dstDataDir, err)
 	}
 
-	smallDir, bigDir, err := s.tb.CreateSnapshot(snapshotName)
+	smallDir, bigDir, coldDir, err := s.tb.CreateSnapshot(snapshotName)
 	if err != nil {
 		return "", fmt.Errorf("cannot create table snapshot: %s", err)
 	}
@@ -186,6 +326,12 @@ func (s *Storage) CreateSnapshot() (string, error) {
 	if err := fs.SymlinkRelative(bigDir, dstBigDir); err != nil {
 		return "", fmt.Errorf("cannot create symlink from %q to %q: %s", bigDir, dstBigDir, err)
 	}
+	if len(coldDir) > 0 {
+		dstColdDir := dstDataDir + "/cold"
+		if err := fs.SymlinkRelative(coldDir, dstColdDir); err != nil {
+			return "", fmt.Errorf("cannot create symlink from %q to %q: %s", coldDir, dstColdDir, err)
+		}
+	}
 	fs.MustSyncPath(dstDataDir)
 
 	idbSnapshot := fmt.Sprintf("%s/indexdb/snapshots/%s", s.path, snapshotName)
@@ -201,6 +347,14 @@ func (s *Storage) CreateSnapshot() (string, error) {
 	if ok && err != nil {
 		return "", fmt.Errorf("cannot create prev indexDB snapshot: %s", err)
 	}
+	archivedIDBs := s.getArchivedIndexDBs(0)
+	for _, db := range archivedIDBs {
+		if err := db.tb.CreateSnapshotAt(idbSnapshot + "/" + db.name); err != nil {
+			putArchivedIndexDBs(archivedIDBs)
+			return "", fmt.Errorf("cannot create archived indexDB snapshot: %s", err)
+		}
+	}
+	putArchivedIndexDBs(archivedIDBs)
 	dstIdbDir := dstDir + "/indexdb"
 	if err := fs.SymlinkRelative(idbSnapshot, dstIdbDir); err != nil {
 		return "", fmt.Errorf("cannot create symlink from %q to %q: %s", idbSnapshot, dstIdbDir, err)
@@ -271,29 +425,66 @@ func (s *Storage) idb() *indexDB {
 
 // Metrics contains essential metrics for the Storage.
 type Metrics struct {
-	TSIDCacheSize       uint64
-	TSIDCacheBytesSize  uint64
-	TSIDCacheRequests   uint64
-	TSIDCacheMisses     uint64
-	TSIDCacheCollisions uint64
-
-	MetricIDCacheSize       uint64
-	MetricIDCacheBytesSize  uint64
-	MetricIDCacheRequests   uint64
-	MetricIDCacheMisses     uint64
-	MetricIDCacheCollisions uint64
-
-	MetricNameCacheSize       uint64
-	MetricNameCacheBytesSize  uint64
-	MetricNameCacheRequests   uint64
-	MetricNameCacheMisses     uint64
-	MetricNameCacheCollisions uint64
-
-	DateMetricIDCacheSize       uint64
-	DateMetricIDCacheBytesSize  uint64
-	DateMetricIDCacheRequests   uint64
-	DateMetricIDCacheMisses     uint64
-	DateMetricIDCacheCollisions uint64
+	TSIDCacheSize         uint64
+	TSIDCacheBytesSize    uint64
+	TSIDCacheMaxBytesSize uint64
+	TSIDCacheRequests     uint64
+	TSIDCacheMisses       uint64
+	TSIDCacheCollisions   uint64
+
+	MetricIDCacheSize         uint64
+	MetricIDCacheBytesSize    uint64
+	MetricIDCacheMaxBytesSize uint64
+	MetricIDCacheRequests     uint64
+	MetricIDCacheMisses       uint64
+	MetricIDCacheCollisions   uint64
+
+	MetricNameCacheSize         uint64
+	MetricNameCacheBytesSize    uint64
+	MetricNameCacheMaxBytesSize uint64
+	MetricNameCacheRequests     uint64
+	MetricNameCacheMisses       uint64
+	MetricNameCacheCollisions   uint64
+
+	DateMetricIDCacheSize         uint64
+	DateMetricIDCacheBytesSize    uint64
+	DateMetricIDCacheMaxBytesSize uint64
+	DateMetricIDCacheRequests     uint64
+	DateMetricIDCacheMisses       uint64
+	DateMetricIDCacheCollisions   uint64
+
+	LatestTimestampCacheSize      uint64
+	LatestTimestampCacheBytesSize uint64
+
+	OutOfOrderRowsReordered uint64
+	OutOfOrderRowsDropped   uint64
+
+	FutureTimestampRowsDropped uint64
+	FutureTimestampRowsClamped uint64
+
+	HourlySeriesLimitRowsDropped   uint64
+	HourlySeriesLimitMaxSeries     uint64
+	HourlySeriesLimitCurrentSeries uint64
+	DailySeriesLimitRowsDropped    uint64
+	DailySeriesLimitMaxSeries      uint64
+	DailySeriesLimitCurrentSeries  uint64
+
+	TooLongMetricNameRowsDropped uint64
+	TooLongLabelNameRowsDropped  uint64
+	TooLongLabelValueRowsDropped uint64
+	TooManyLabelsRowsDropped     uint64
+
+	IsReadOnly uint64
+
+	WALBytesWritten uint64
+	WALSyncs        uint64
+	WALRowsReplayed uint64
+
+	IndexDBRotations            uint64
+	ArchivedIndexDBs            uint64
+	ArchivedIndexDBsDropped     uint64
+	ArchivedIndexDBSearches     uint64
+	ArchivedIndexDBTableMetrics mergeset.TableMetrics
 
 	IndexDBMetrics IndexDBMetrics
 	TableMetrics   TableMetrics
@@ -310,6 +501,7 @@ func (s *Storage) UpdateMetrics(m *Metrics) {
 	s.tsidCache.UpdateStats(&cs)
 	m.TSIDCacheSize += cs.EntriesCount
 	m.TSIDCacheBytesSize += cs.BytesSize
+	m.TSIDCacheMaxBytesSize += uint64(s.tsidCacheMaxBytes)
 	m.TSIDCacheRequests += cs.GetCalls
 	m.TSIDCacheMisses += cs.Misses
 	m.TSIDCacheCollisions += cs.Collisions
@@ -318,6 +510,7 @@ func (s *Storage) UpdateMetrics(m *Metrics) {
 	s.metricIDCache.UpdateStats(&cs)
 	m.MetricIDCacheSize += cs.EntriesCount
 	m.MetricIDCacheBytesSize += cs.BytesSize
+	m.MetricIDCacheMaxBytesSize += uint64(s.metricIDCacheMaxBytes)
 	m.MetricIDCacheRequests += cs.GetCalls
 	m.MetricIDCacheMisses += cs.Misses
 	m.MetricIDCacheCollisions += cs.Collisions
@@ -326,6 +519,7 @@ func (s *Storage) UpdateMetrics(m *Metrics) {
 	s.metricNameCache.UpdateStats(&cs)
 	m.MetricNameCacheSize += cs.EntriesCount
 	m.MetricNameCacheBytesSize += cs.BytesSize
+	m.MetricNameCacheMaxBytesSize += uint64(s.metricNameCacheMaxBytes)
 	m.MetricNameCacheRequests += cs.GetCalls
 	m.MetricNameCacheMisses += cs.Misses
 	m.MetricNameCacheCollisions += cs.Collisions
@@ -334,10 +528,22 @@ func (s *Storage) UpdateMetrics(m *Metrics) {
 	s.dateMetricIDCache.UpdateStats(&cs)
 	m.DateMetricIDCacheSize += cs.EntriesCount
 	m.DateMetricIDCacheBytesSize += cs.BytesSize
+	m.DateMetricIDCacheMaxBytesSize += uint64(s.dateMetricIDCacheMaxBytes)
 	m.DateMetricIDCacheRequests += cs.GetCalls
 	m.DateMetricIDCacheMisses += cs.Misses
 	m.DateMetricIDCacheCollisions += cs.Collisions
 
+	if s.IsReadOnly() {
+		m.IsReadOnly = 1
+	}
+
+	s.updateOutOfOrderMetrics(m)
+	s.updateFutureTimestampMetrics(m)
+	s.updateSeriesLimitsMetrics(m)
+	s.updateWALMetrics(m)
+	s.updateLabelLimitsMetrics(m)
+	s.updateArchivedIndexDBMetrics(m)
+
 	s.idb().UpdateMetrics(&m.IndexDBMetrics)
 	s.tb.UpdateMetrics(&m.TableMetrics)
 }
@@ -353,6 +559,9 @@ func (s *Storage) startRetentionWatcher() {
 func (s *Storage) retentionWatcher() {
 	for {
 		d := nextRetentionDuration(s.retentionMonths)
+		if s.indexDBRetentionMsecs > 0 {
+			d = nextIndexDBRotationDuration(s.indexDBRetentionMsecs)
+		}
 		select {
 		case <-s.stop:
 			return
@@ -394,9 +603,15 @@ func (s *Storage) mustRotateIndexDB() {
 		logger.Panicf("FATAL: cannot create new indexDB at %q: %s", idbNewPath, err)
 	}
 
-	// Drop extDB
+	// Drop extDB. It is archived instead if indexdb is rotated more frequently than the data retention,
+	// since the data it refers to may be still within the retention.
 	idbCurr := s.idb()
 	idbCurr.doExtDB(func(extDB *indexDB) {
+		if s.indexDBRetentionMsecs > 0 {
+			extDB.incRef()
+			s.archiveIndexDB(extDB, indexDBTableNameTimestamp(idbCurr.name))
+			return
+		}
 		extDB.scheduleToDrop()
 	})
 	idbCurr.SetExtDB(nil)
@@ -416,6 +631,9 @@ func (s *Storage) mustRotateIndexDB() {
 
 	// Do not flush metricIDCache and metricNameCache, since all the metricIDs
 	// from prev idb remain valid after the rotation.
+
+	atomic.AddUint64(&s.indexDBRotations, 1)
+	s.dropExpiredArchivedIndexDBs()
 }
 
 // MustClose closes the storage.
@@ -424,15 +642,27 @@ func (s *Storage) MustClose() {
 
 	s.retentionWatcherWG.Wait()
 	s.currHourMetricIDsUpdaterWG.Wait()
+	s.retentionFiltersUpdaterWG.Wait()
+	s.downsamplingUpdaterWG.Wait()
+	s.freeDiskSpaceWatcherWG.Wait()
+	s.walWG.Wait()
+	s.stopSeriesLimiters()
 
 	s.tb.MustClose()
 	s.idb().MustClose()
+	s.mustCloseArchivedIndexDBs()
+
+	// All the data is flushed to disk, so the wal is no longer needed.
+	s.mustCloseWAL()
 
 	// Save caches.
 	s.mustSaveCache(s.tsidCache, "MetricName->TSID", "metricName_tsid")
 	s.mustSaveCache(s.metricIDCache, "MetricID->TSID", "metricID_tsid")
 	s.mustSaveCache(s.metricNameCache, "MetricID->MetricName", "metricID_metricName")
 	s.mustSaveCache(s.dateMetricIDCache, "Date->MetricID", "date_metricID")
+	if s.latestTimestampCache != nil {
+		s.mustSaveCache(s.latestTimestampCache, "MetricID->LatestTimestamp", "metricID_latestTimestamp")
+	}
 
 	hmCurr := s.currHourMetricIDs.Load().(*hourMetricIDs)
 	s.mustSaveHourMetricIDs(hmCurr, "curr_hour_metric_ids")
@@ -511,6 +741,33 @@ func (s *Storage) mustSaveHourMetricIDs(hm *hourMetricIDs, name string) {
 	logger.Infof("saved %s to %q in %s; entriesCount: %d; bytesSize: %d", name, path, time.Since(startTime), len(hm.m), len(dst))
 }
 
+// SetCacheSizes overrides the maximum sizes in bytes for the storage caches.
+//
+// The cache size is automatically calculated from the allowed memory if the corresponding size is 0.
+// Too small caches result in more disk reads, so they may slow down data ingestion and querying.
+//
+// This function must be called before initializing the storage.
+func SetCacheSizes(tsidCacheBytes, metricIDCacheBytes, metricNameCacheBytes, dateMetricIDCacheBytes int) {
+	tsidCacheSize = tsidCacheBytes
+	metricIDCacheSize = metricIDCacheBytes
+	metricNameCacheSize = metricNameCacheBytes
+	dateMetricIDCacheSize = dateMetricIDCacheBytes
+}
+
+var (
+	tsidCacheSize         = 0
+	metricIDCacheSize     = 0
+	metricNameCacheSize   = 0
+	dateMetricIDCacheSize = 0
+)
+
+func getCacheSize(size, autoSize int) int {
+	if size > 0 {
+		return size
+	}
+	return autoSize
+}
+
 func (s *Storage) mustLoadCache(info, name string, bytesSize int) *fastcache.Cache {
 	path := s.cachePath + "/" + name
 	logger.Infof("loading %s cache from %q...", info, path)
@@ -549,16 +806,30 @@ func nextRetentionDuration(retentionMonths int) time.Duration {
 }
 
 // searchTSIDs returns TSIDs for the given tfss and the given tr.
-func (s *Storage) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int) ([]TSID, error) {
+func (s *Storage) searchTSIDs(tfss []*TagFilters, tr TimeRange, maxMetrics int, stopCh <-chan struct{}) ([]TSID, error) {
 	// Do not cache tfss -> tsids here, since the caching is performed
 	// on idb level.
-	tsids, err := s.idb().searchTSIDs(tfss, tr, maxMetrics)
+	tsids, err := s.idb().searchTSIDs(tfss, tr, maxMetrics, stopCh)
 	if err != nil {
-		return nil, fmt.Errorf("error when searching tsids for tfss %q: %s", tfss, err)
+		return nil, wrapSearchTSIDsError(err, tfss)
+	}
+	tsids, err = s.searchArchivedTSIDs(tsids, tfss, tr, maxMetrics, stopCh)
+	if err != nil {
+		return nil, wrapSearchTSIDsError(err, tfss)
 	}
 	return tsids, nil
 }
 
+// wrapSearchTSIDsError adds tfss to err.
+//
+// *TooManyTimeseriesError is returned as is, so the caller could report the limit it passed to the search.
+func wrapSearchTSIDsError(err error, tfss []*TagFilters) error {
+	if _, ok := err.(*TooManyTimeseriesError); ok {
+		return err
+	}
+	return fmt.Errorf("error when searching tsids for tfss %q: %s", tfss, err)
+}
+
 // DeleteMetrics deletes all the metrics matching the given tfss.
 //
 // Returns the number of metrics deleted.
@@ -567,6 +838,11 @@ func (s *Storage) DeleteMetrics(tfss []*TagFilters) (int, error) {
 	if err != nil {
 		return deletedCount, fmt.Errorf("cannot delete tsids: %s", err)
 	}
+	n, err := s.deleteArchivedMetrics(tfss)
+	deletedCount += n
+	if err != nil {
+		return deletedCount, err
+	}
 	// Do not reset MetricName -> TSID cache (tsidCache), since the obtained
 	// entries must be checked against deleted metricIDs.
 	// See Storage.add for details.
@@ -579,23 +855,75 @@ func (s *Storage) DeleteMetrics(tfss []*TagFilters) (int, error) {
 // searchMetricName appends metric name for the given metricID to dst
 // and returns the result.
 func (s *Storage) searchMetricName(dst []byte, metricID uint64) ([]byte, error) {
-	return s.idb().searchMetricName(dst, metricID)
+	dst, err := s.idb().searchMetricName(dst, metricID)
+	if err != io.EOF {
+		return dst, err
+	}
+	return s.searchArchivedMetricName(dst, metricID)
 }
 
 // SearchTagKeys searches for tag keys
 func (s *Storage) SearchTagKeys(maxTagKeys int) ([]string, error) {
-	return s.idb().SearchTagKeys(maxTagKeys)
+	keys, err := s.idb().SearchTagKeys(maxTagKeys)
+	if err != nil {
+		return nil, err
+	}
+	return s.searchArchivedStrings(keys, 0, maxTagKeys, func(db *indexDB) ([]string, error) {
+		return db.SearchTagKeys(maxTagKeys)
+	})
 }
 
 // SearchTagValues searches for tag values for the given tagKey
 func (s *Storage) SearchTagValues(tagKey []byte, maxTagValues int) ([]string, error) {
-	return s.idb().SearchTagValues(tagKey, maxTagValues)
+	values, err := s.idb().SearchTagValues(tagKey, maxTagValues)
+	if err != nil {
+		return nil, err
+	}
+	return s.searchArchivedStrings(values, 0, maxTagValues, func(db *indexDB) ([]string, error) {
+		return db.SearchTagValues(tagKey, maxTagValues)
+	})
+}
+
+// SearchTagKeysOnTimeRange searches for tag keys for time series matching tfss on the given tr.
+//
+// All the tag keys are returned if neither tfss nor tr are set.
+func (s *Storage) SearchTagKeysOnTimeRange(tfss []*TagFilters, tr TimeRange, maxTagKeys, maxMetrics int) ([]string, error) {
+	keys, err := s.idb().SearchTagKeysOnTimeRange(tfss, tr, maxTagKeys, maxMetrics)
+	if err != nil {
+		return nil, err
+	}
+	return s.searchArchivedStrings(keys, tr.MinTimestamp, maxTagKeys, func(db *indexDB) ([]string, error) {
+		return db.SearchTagKeysOnTimeRange(tfss, tr, maxTagKeys, maxMetrics)
+	})
+}
+
+// SearchTagValuesOnTimeRange searches for tag values for the given tagKey for time series matching tfss on the given tr.
+//
+// All the tag values for the given tagKey are returned if neither tfss nor tr are set.
+func (s *Storage) SearchTagValuesOnTimeRange(tagKey []byte, tfss []*TagFilters, tr TimeRange, maxTagValues, maxMetrics int) ([]string, error) {
+	values, err := s.idb().SearchTagValuesOnTimeRange(tagKey, tfss, tr, maxTagValues, maxMetrics)
+	if err != nil {
+		return nil, err
+	}
+	return s.searchArchivedStrings(values, tr.MinTimestamp, maxTagValues, func(db *indexDB) ([]string, error) {
+		return db.SearchTagValuesOnTimeRange(tagKey, tfss, tr, maxTagValues, maxMetrics)
+	})
+}
+
+// SearchMetricNames returns up to limit metric names for time series matching tfss on the given tr.
+//
+// The returned bool is set to true if more than limit time series match tfss.
+func (s *Storage) SearchMetricNames(tfss []*TagFilters, tr TimeRange, limit, maxMetrics int) ([]MetricName, bool, error) {
+	mns, isLimited, err := s.idb().SearchMetricNames(tfss, tr, limit, maxMetrics)
+	if err != nil || isLimited {
+		return mns, isLimited, err
+	}
+	return s.searchArchivedMetricNames(mns, tfss, tr, limit, maxMetrics)
 }
 
 // SearchTagEntries returns a list of (tagName -> tagValues) for (accountID, projectID).
 func (s *Storage) SearchTagEntries(maxTagKeys, maxTagValues int) ([]TagEntry, error) {
-	idb := s.idb()
-	keys, err := idb.SearchTagKeys(maxTagKeys)
+	keys, err := s.SearchTagKeys(maxTagKeys)
 	if err != nil {
 		return nil, fmt.Errorf("cannot search tag keys: %s", err)
 	}
@@ -605,7 +933,7 @@ func (s *Storage) SearchTagEntries(maxTagKeys, maxTagValues int) ([]TagEntry, er
 
 	tes := make([]TagEntry, len(keys))
 	for i, key := range keys {
-		values, err := idb.SearchTagValues([]byte(key), maxTagValues)
+		values, err := s.SearchTagValues([]byte(key), maxTagValues)
 		if err != nil {
 			return nil, fmt.Errorf("cannot search values for tag %q: %s", key, err)
 		}
@@ -625,10 +953,19 @@ type TagEntry struct {
 	Values []string
 }
 
+// GetTSDBStatusForDate returns TSDB status data for /api/v1/status/tsdb for the given date.
+//
+// Archived indexdb tables aren't taken into account.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#tsdb-stats
+func (s *Storage) GetTSDBStatusForDate(date uint64, topN int) (*TSDBStatus, error) {
+	return s.idb().GetTSDBStatusForDate(date, topN)
+}
+
 // GetSeriesCount returns the approximate number of unique time series.
 //
 // It includes the deleted series too and may count the same series
-// up to two times - in db and extDB.
+// up to two times - in db and extDB. Series in archived indexdb tables aren't counted.
 func (s *Storage) GetSeriesCount() (uint64, error) {
 	return s.idb().GetSeriesCount()
 }
@@ -636,7 +973,7 @@ func (s *Storage) GetSeriesCount() (uint64, error) {
 // MetricRow is a metric to insert into storage.
 type MetricRow struct {
 	// MetricNameRaw contains raw metric name, which must be decoded
-	// with MetricName.unmarshalRaw.
+	// with MetricName.UnmarshalRaw.
 	MetricNameRaw []byte
 
 	Timestamp int64
@@ -654,7 +991,7 @@ func (mr *MetricRow) CopyFrom(src *MetricRow) {
 func (mr *MetricRow) String() string {
 	metricName := string(mr.MetricNameRaw)
 	var mn MetricName
-	if err := mn.unmarshalRaw(mr.MetricNameRaw); err == nil {
+	if err := mn.UnmarshalRaw(mr.MetricNameRaw); err == nil {
 		metricName = mn.String()
 	}
 	return fmt.Sprintf("MetricName=%s, Timestamp=%d, Value=%f\n",
@@ -699,6 +1036,9 @@ func (s *Storage) AddRows(mrs []MetricRow, precisionBits uint8) error {
 	if len(mrs) == 0 {
 		return nil
 	}
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
 
 	// Limit the number of concurrent goroutines that may add rows to the storage.
 	// This should prevent from out of memory errors and CPU trashing when too many
@@ -715,6 +1055,13 @@ func (s *Storage) AddRows(mrs []MetricRow, precisionBits uint8) error {
 	}
 
 	// Add rows to the storage.
+	if s.wal != nil {
+		return s.addRowsWithWAL(mrs, precisionBits)
+	}
+	return s.addRows(mrs, precisionBits)
+}
+
+func (s *Storage) addRows(mrs []MetricRow, precisionBits uint8) error {
 	var err error
 	rr := getRawRowsWithSize(len(mrs))
 	rr.rows, err = s.add(rr.rows, mrs, precisionBits)
@@ -741,19 +1088,26 @@ func (s *Storage) add(rows []rawRow, mrs []MetricRow, precisionBits uint8) ([]ra
 		rows = append(rows[:cap(rows)], make([]rawRow, n)...)
 	}
 	rows = rows[:rowsLen+len(mrs)]
+	maxTimestamp := getMaxSampleTimestamp()
 	j := 0
 	for i := range mrs {
 		mr := &mrs[i]
-		if math.IsNaN(mr.Value) {
-			// Just skip NaNs, since the underlying encoding
+		if math.IsNaN(mr.Value) && !decimal.IsStaleNaN(mr.Value) {
+			// Just skip NaNs other than Prometheus staleness marks, since the underlying encoding
 			// doesn't know how to work with them.
 			continue
 		}
+		timestamp := mr.Timestamp
+		if !s.adjustFutureTimestamp(&timestamp, maxTimestamp) {
+			// Drop the row with too big timestamp.
+			continue
+		}
 		r := &rows[rowsLen+j]
 		j++
-		r.Timestamp = mr.Timestamp
+		r.Timestamp = timestamp
 		r.Value = mr.Value
 		r.PrecisionBits = precisionBits
+		r.ExactValue = isExactValuesMetric(mr.MetricNameRaw)
 		if s.getTSIDFromCache(&r.TSID, mr.MetricNameRaw) {
 			if len(dmis) == 0 {
 				// Fast path - the TSID for the given MetricName has been found in cache and isn't deleted.
@@ -766,12 +1120,17 @@ func (s *Storage) add(rows []rawRow, mrs []MetricRow, precisionBits uint8) ([]ra
 		}
 
 		// Slow path - the TSID is missing in the cache. Search for it in the index.
+		if !s.checkLabelLimits(mr.MetricNameRaw) {
+			// Drop the row, since it exceeds the label limits.
+			j--
+			continue
+		}
 		if is == nil {
 			is = idb.getIndexSearch()
 			mn = GetMetricName()
 			kb = kbPool.Get()
 		}
-		if err := mn.unmarshalRaw(mr.MetricNameRaw); err != nil {
+		if err := mn.UnmarshalRaw(mr.MetricNameRaw); err != nil {
 			// Do not stop adding rows on error - just skip invalid row.
 			// This guarantees that invalid rows don't prevent
 			// from adding valid rows into the storage.
@@ -782,6 +1141,22 @@ func (s *Storage) add(rows []rawRow, mrs []MetricRow, precisionBits uint8) ([]ra
 		}
 		mn.sortTags()
 		kb.B = mn.Marshal(kb.B[:0])
+		if s.hasSeriesLimits() {
+			ok, err := s.getOrCreateTSIDWithLimits(is, &r.TSID, kb.B, mn)
+			if err != nil {
+				// Do not stop adding rows on error - just skip invalid row.
+				errors = append(errors, err)
+				j--
+				continue
+			}
+			if !ok {
+				// Drop the row for the new series, since it exceeds the series limits.
+				j--
+				continue
+			}
+			s.putTSIDToCache(&r.TSID, mr.MetricNameRaw)
+			continue
+		}
 		if err := is.GetOrCreateTSIDByName(&r.TSID, kb.B); err != nil {
 			// Do not stop adding rows on error - just skip invalid row.
 			// This guarantees that invalid rows don't prevent
@@ -799,6 +1174,10 @@ func (s *Storage) add(rows []rawRow, mrs []MetricRow, precisionBits uint8) ([]ra
 		idb.putIndexSearch(is)
 	}
 	rows = rows[:rowsLen+j]
+	if s.latestTimestampCache != nil {
+		rowsFiltered := s.filterOutOfOrderRows(rows[rowsLen:])
+		rows = rows[:rowsLen+len(rowsFiltered)]
+	}
 
 	if err := s.tb.AddRows(rows); err != nil {
 		err = fmt.Errorf("cannot add rows to table: %s", err)
@@ -920,14 +1299,18 @@ func (s *Storage) putTSIDToCache(tsid *TSID, metricName []byte) {
 	s.tsidCache.Set(metricName, buf)
 }
 
-func openIndexDBTables(path string, metricIDCache, metricNameCache *fastcache.Cache, currHourMetricIDs, prevHourMetricIDs *atomic.Value) (curr, prev *indexDB, err error) {
+// openIndexDBTables opens indexdb tables at the given path.
+//
+// Older tables are returned in archived if they may refer to data within retentionMsecs. Other tables are removed.
+func openIndexDBTables(path string, retentionMsecs int64, metricIDCache, metricNameCache *fastcache.Cache,
+	currHourMetricIDs, prevHourMetricIDs *atomic.Value) (curr, prev *indexDB, archived []*archivedIndexDB, err error) {
 	if err := fs.MkdirAllIfNotExist(path); err != nil {
-		return nil, nil, fmt.Errorf("cannot create directory %q: %s", path, err)
+		return nil, nil, nil, fmt.Errorf("cannot create directory %q: %s", path, err)
 	}
 
 	d, err := os.Open(path)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot open directory: %s", err)
+		return nil, nil, nil, fmt.Errorf("cannot open directory: %s", err)
 	}
 	defer fs.MustClose(d)
 
@@ -935,7 +1318,7 @@ func openIndexDBTables(path string, metricIDCache, metricNameCache *fastcache.Ca
 	// the previous one contains backup data.
 	fis, err := d.Readdir(-1)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot read directory: %s", err)
+		return nil, nil, nil, fmt.Errorf("cannot read directory: %s", err)
 	}
 	var tableNames []string
 	for _, fi := range fis {
@@ -965,8 +1348,15 @@ func openIndexDBTables(path string, metricIDCache, metricNameCache *fastcache.Ca
 
 	// Invariant: len(tableNames) >= 2
 
-	// Remove all the tables except two last tables.
-	for _, tn := range tableNames[:len(tableNames)-2] {
+	// Remove all the tables except two last tables and archived tables, which may refer to data within the retention.
+	// The table stops accepting new entries when the next table is created.
+	minTimestamp := timestampFromTime(time.Now()) - retentionMsecs
+	var archivedNames []string
+	for i, tn := range tableNames[:len(tableNames)-2] {
+		if indexDBTableNameTimestamp(tableNames[i+1]) >= minTimestamp {
+			archivedNames = append(archivedNames, tn)
+			continue
+		}
 		pathToRemove := path + "/" + tn
 		logger.Infof("removing obsolete indexdb dir %q...", pathToRemove)
 		fs.MustRemoveAll(pathToRemove)
@@ -981,23 +1371,57 @@ func openIndexDBTables(path string, metricIDCache, metricNameCache *fastcache.Ca
 
 	curr, err = openIndexDB(currPath, metricIDCache, metricNameCache, currHourMetricIDs, prevHourMetricIDs)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot open curr indexdb table at %q: %s", currPath, err)
+		return nil, nil, nil, fmt.Errorf("cannot open curr indexdb table at %q: %s", currPath, err)
 	}
 	prevPath := path + "/" + tableNames[len(tableNames)-2]
 	prev, err = openIndexDB(prevPath, metricIDCache, metricNameCache, currHourMetricIDs, prevHourMetricIDs)
 	if err != nil {
 		curr.MustClose()
-		return nil, nil, fmt.Errorf("cannot open prev indexdb table at %q: %s", prevPath, err)
+		return nil, nil, nil, fmt.Errorf("cannot open prev indexdb table at %q: %s", prevPath, err)
 	}
 
-	return curr, prev, nil
+	// Open archived tables.
+	for i, tn := range archivedNames {
+		archivedPath := path + "/" + tn
+		db, err := openIndexDB(archivedPath, metricIDCache, metricNameCache, currHourMetricIDs, prevHourMetricIDs)
+		if err != nil {
+			curr.MustClose()
+			prev.MustClose()
+			for _, a := range archived {
+				a.db.MustClose()
+			}
+			return nil, nil, nil, fmt.Errorf("cannot open archived indexdb table at %q: %s", archivedPath, err)
+		}
+		nextName := tableNames[len(tableNames)-2]
+		if i+1 < len(archivedNames) {
+			nextName = archivedNames[i+1]
+		}
+		archived = append(archived, &archivedIndexDB{
+			db:           db,
+			endTimestamp: indexDBTableNameTimestamp(nextName),
+		})
+	}
+
+	return curr, prev, archived, nil
 }
 
 var indexDBTableNameRegexp = regexp.MustCompile("^[0-9A-F]{16}$")
 
+// nextIndexDBTableName returns a name for the new indexdb table.
+//
+// The name contains the creation time in nanoseconds, so the time may be obtained via indexDBTableNameTimestamp.
+// Names are monotonically increasing.
 func nextIndexDBTableName() string {
-	n := atomic.AddUint64(&indexDBTableIdx, 1)
-	return fmt.Sprintf("%016X", n)
+	for {
+		n := atomic.LoadUint64(&indexDBTableIdx)
+		nNext := uint64(time.Now().UnixNano())
+		if nNext <= n {
+			nNext = n + 1
+		}
+		if atomic.CompareAndSwapUint64(&indexDBTableIdx, n, nNext) {
+			return fmt.Sprintf("%016X", nNext)
+		}
+	}
 }
 
 var indexDBTableIdx = uint64(time.Now().UnixNano())
@@ -5,10 +5,13 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"testing/quick"
 	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/memory"
 )
 
 func TestUpdateCurrHourMetricIDs(t *testing.T) {
@@ -251,6 +254,48 @@ func TestStorageOpenClose(t *testing.T) {
 	}
 }
 
+func TestStorageCacheSizes(t *testing.T) {
+	defer SetCacheSizes(0, 0, 0, 0)
+
+	path := "TestStorageCacheSizes"
+	f := func(tsidCacheBytes, metricIDCacheBytes, metricNameCacheBytes, dateMetricIDCacheBytes int) {
+		t.Helper()
+		SetCacheSizes(tsidCacheBytes, metricIDCacheBytes, metricNameCacheBytes, dateMetricIDCacheBytes)
+
+		// The storage must be opened even if the caches saved on the previous run have distinct sizes.
+		s, err := OpenStorage(path, -1)
+		if err != nil {
+			t.Fatalf("cannot open storage: %s", err)
+		}
+		var m Metrics
+		s.UpdateMetrics(&m)
+		s.MustClose()
+
+		mem := memory.Allowed()
+		check := func(name string, size uint64, sizeExpected, autoSize int) {
+			t.Helper()
+			if sizeExpected == 0 {
+				sizeExpected = autoSize
+			}
+			if size != uint64(sizeExpected) {
+				t.Fatalf("unexpected max size for %s cache; got %d; want %d", name, size, sizeExpected)
+			}
+		}
+		check("tsid", m.TSIDCacheMaxBytesSize, tsidCacheBytes, mem/3)
+		check("metricID", m.MetricIDCacheMaxBytesSize, metricIDCacheBytes, mem/16)
+		check("metricName", m.MetricNameCacheMaxBytesSize, metricNameCacheBytes, mem/8)
+		check("dateMetricID", m.DateMetricIDCacheMaxBytesSize, dateMetricIDCacheBytes, mem/32)
+	}
+	f(0, 0, 0, 0)
+	f(1, 2, 3, 4)
+	f(64<<20, 0, 32<<20, 0)
+	f(0, 0, 0, 0)
+
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
+
 func TestStorageOpenMultipleTimes(t *testing.T) {
 	path := "TestStorageOpenMultipleTimes"
 	s1, err := OpenStorage(path, -1)
@@ -437,6 +482,104 @@ func TestStorageDeleteMetrics(t *testing.T) {
 	}
 }
 
+func TestStorageDeleteMetricsReIngest(t *testing.T) {
+	path := "TestStorageDeleteMetricsReIngest"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	defer func() {
+		s.MustClose()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+
+	addRows := func(job string, timestamp int64, value float64) {
+		t.Helper()
+		mn := MetricName{
+			MetricGroup: []byte("metric"),
+			Tags: []Tag{
+				{[]byte("job"), []byte(job)},
+			},
+		}
+		mrs := []MetricRow{{
+			MetricNameRaw: mn.marshalRaw(nil),
+			Timestamp:     timestamp,
+			Value:         value,
+		}}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding rows: %s", err)
+		}
+		s.DebugFlush()
+	}
+	tr := TimeRange{
+		MinTimestamp: 0,
+		MaxTimestamp: 2e10,
+	}
+	newJobFilter := func(job string) *TagFilters {
+		t.Helper()
+		tfs := NewTagFilters()
+		if err := tfs.Add([]byte("job"), []byte(job), false, false); err != nil {
+			t.Fatalf("cannot add job tag filter: %s", err)
+		}
+		return tfs
+	}
+	// searchRows returns metricIDs and timestamps of all the rows matching the job.
+	searchRows := func(job string) ([]uint64, []int64) {
+		t.Helper()
+		var metricIDs []uint64
+		var timestamps []int64
+		var sr Search
+		sr.Init(s, []*TagFilters{newJobFilter(job)}, tr, 1e5)
+		for sr.NextMetricBlock() {
+			b := sr.MetricBlock.Block
+			if err := b.UnmarshalData(); err != nil {
+				t.Fatalf("cannot unmarshal block: %s", err)
+			}
+			metricIDs = append(metricIDs, b.bh.TSID.MetricID)
+			timestamps = append(timestamps, b.Timestamps()...)
+		}
+		if err := sr.Error(); err != nil {
+			t.Fatalf("unexpected error in search: %s", err)
+		}
+		sr.MustClose()
+		return metricIDs, timestamps
+	}
+
+	// Series with label values sharing the same prefix.
+	addRows("foo", 1000, 1)
+	addRows("foobar", 1000, 2)
+
+	deletedCount, err := s.DeleteMetrics([]*TagFilters{newJobFilter("foo")})
+	if err != nil {
+		t.Fatalf("cannot delete metrics: %s", err)
+	}
+	if deletedCount != 1 {
+		t.Fatalf("unexpected number of deleted metrics; got %d; want 1", deletedCount)
+	}
+	if metricIDs, _ := searchRows("foo"); len(metricIDs) != 0 {
+		t.Fatalf("expecting zero blocks for the deleted series; got %d blocks", len(metricIDs))
+	}
+	metricIDs, _ := searchRows("foobar")
+	if len(metricIDs) != 1 {
+		t.Fatalf("the series sharing label prefix with the deleted series mustn't be deleted; got %d blocks", len(metricIDs))
+	}
+
+	// Re-ingest the deleted series. It must get new TSID without the deleted data.
+	addRows("foo", 2000, 3)
+	metricIDs, timestamps := searchRows("foo")
+	if len(metricIDs) != 1 {
+		t.Fatalf("expecting a single block for the re-ingested series; got %d blocks", len(metricIDs))
+	}
+	if !reflect.DeepEqual(timestamps, []int64{2000}) {
+		t.Fatalf("the re-ingested series mustn't contain the deleted data; got timestamps %d; want [2000]", timestamps)
+	}
+	if _, deleted := s.idb().getDeletedMetricIDs()[metricIDs[0]]; deleted {
+		t.Fatalf("the re-ingested series must get new metricID instead of the deleted metricID %d", metricIDs[0])
+	}
+}
+
 func testStorageDeleteMetrics(s *Storage, workerNum int) error {
 	const rowsPerMetric = 100
 	const metricsCount = 30
@@ -476,7 +619,7 @@ func testStorageDeleteMetrics(s *Storage, workerNum int) error {
 			return fmt.Errorf("unexpected error when adding mrs: %s", err)
 		}
 	}
-	s.debugFlush()
+	s.DebugFlush()
 
 	// Verify tag values exist
 	tvs, err := s.SearchTagValues(workerTag, 1e5)
@@ -700,6 +843,119 @@ func testStorageAddRows(s *Storage) error {
 	return nil
 }
 
+func TestStorageSnapshotRestart(t *testing.T) {
+	path := "TestStorageSnapshotRestart"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	const rowsCount = 1000
+	mrs := make([]MetricRow, rowsCount)
+	var mn MetricName
+	for i := range mrs {
+		mn.MetricGroup = []byte(fmt.Sprintf("metric_%d", i%10))
+		mrs[i] = MetricRow{
+			MetricNameRaw: mn.marshalRaw(nil),
+			Timestamp:     int64(i) * 1000,
+			Value:         float64(i),
+		}
+	}
+	if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+		t.Fatalf("unexpected error when adding mrs: %s", err)
+	}
+	snapshotName, err := s.CreateSnapshot()
+	if err != nil {
+		t.Fatalf("cannot create snapshot: %s", err)
+	}
+	s.MustClose()
+
+	// Verify the snapshot survives storage restart.
+	s, err = OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot re-open storage: %s", err)
+	}
+	snapshots, err := s.ListSnapshots()
+	if err != nil {
+		t.Fatalf("cannot list snapshots: %s", err)
+	}
+	if !containsString(snapshots, snapshotName) {
+		t.Fatalf("cannot find snapshot %q in %q after restart", snapshotName, snapshots)
+	}
+
+	// Verify snapshot deletion doesn't touch live data.
+	if err := s.DeleteSnapshot(snapshotName); err != nil {
+		t.Fatalf("cannot delete snapshot %q: %s", snapshotName, err)
+	}
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if n := m.TableMetrics.SmallRowsCount + m.TableMetrics.BigRowsCount; n != rowsCount {
+		t.Fatalf("unexpected number of rows after snapshot deletion; got %d; want %d", n, rowsCount)
+	}
+	s.MustClose()
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
+
+func TestStorageInmemoryDataFlushInterval(t *testing.T) {
+	SetInmemoryDataFlushInterval(time.Millisecond)
+	if inmemoryPartsFlushInterval != rawRowsFlushInterval {
+		t.Fatalf("too small flush interval must be rounded up to %s; got %s", rawRowsFlushInterval, inmemoryPartsFlushInterval)
+	}
+	SetInmemoryDataFlushInterval(time.Second)
+	defer SetInmemoryDataFlushInterval(0)
+
+	path := "TestStorageInmemoryDataFlushInterval"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	const rowsCount = 1000
+	now := timestampFromTime(time.Now())
+	var mn MetricName
+	for i := 0; i < rowsCount; i += 100 {
+		mrs := make([]MetricRow, 100)
+		for j := range mrs {
+			mn.MetricGroup = []byte(fmt.Sprintf("metric_%d", j%10))
+			mrs[j] = MetricRow{
+				MetricNameRaw: mn.marshalRaw(nil),
+				Timestamp:     now + int64(i+j),
+				Value:         float64(i + j),
+			}
+		}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding mrs: %s", err)
+		}
+		// Convert the added rows into a separate in-memory part.
+		s.DebugFlush()
+	}
+
+	// All the in-memory parts must be flushed to disk in a few seconds.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var m Metrics
+		s.UpdateMetrics(&m)
+		tm := &m.TableMetrics
+		if tm.InmemoryPartsCount == 0 && tm.InmemoryRowsCount == 0 {
+			if n := tm.SmallRowsCount + tm.BigRowsCount; n != rowsCount {
+				t.Fatalf("unexpected number of rows after flush; got %d; want %d", n, rowsCount)
+			}
+			if tm.SmallPartsCount >= rowsCount/100 {
+				t.Fatalf("in-memory parts must be merged on flush; got %d small parts", tm.SmallPartsCount)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout when waiting for flushing %d in-memory parts with %d rows", tm.InmemoryPartsCount, tm.InmemoryRowsCount)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.MustClose()
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
+
 func TestStorageRotateIndexDB(t *testing.T) {
 	path := "TestStorageRotateIndexDB"
 	s, err := OpenStorage(path, 0)
@@ -792,3 +1048,99 @@ func containsString(a []string, s string) bool {
 	}
 	return false
 }
+
+func TestStorageSearchTagsOnTimeRange(t *testing.T) {
+	path := "TestStorageSearchTagsOnTimeRange"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	addRow := func(metricGroup string, tags []Tag, day int64) {
+		t.Helper()
+		mn := MetricName{
+			MetricGroup: []byte(metricGroup),
+			Tags:        tags,
+		}
+		mrs := []MetricRow{{
+			MetricNameRaw: mn.marshalRaw(nil),
+			Timestamp:     day*msecPerDay + 1000,
+			Value:         1,
+		}}
+		if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+			t.Fatalf("unexpected error when adding rows: %s", err)
+		}
+	}
+	addRow("foo", []Tag{{[]byte("job"), []byte("aaa")}}, 10)
+	addRow("foo", []Tag{{[]byte("job"), []byte("bbb")}}, 20)
+	addRow("bar", []Tag{{[]byte("instance"), []byte("ccc")}}, 20)
+	s.DebugFlush()
+
+	newTfss := func(metricGroup string) []*TagFilters {
+		t.Helper()
+		if metricGroup == "" {
+			return nil
+		}
+		tfs := NewTagFilters()
+		if err := tfs.Add(nil, []byte(metricGroup), false, false); err != nil {
+			t.Fatalf("cannot add tag filter: %s", err)
+		}
+		return []*TagFilters{tfs}
+	}
+	dayRange := func(minDay, maxDay int64) TimeRange {
+		return TimeRange{
+			MinTimestamp: minDay * msecPerDay,
+			MaxTimestamp: (maxDay+1)*msecPerDay - 1,
+		}
+	}
+	fKeys := func(metricGroup string, tr TimeRange, keysExpected []string) {
+		t.Helper()
+		keys, err := s.SearchTagKeysOnTimeRange(newTfss(metricGroup), tr, 1e5, 1e5)
+		if err != nil {
+			t.Fatalf("unexpected error in SearchTagKeysOnTimeRange: %s", err)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, keysExpected) {
+			t.Fatalf("unexpected tag keys for metricGroup=%q, tr=%s; got %q; want %q", metricGroup, &tr, keys, keysExpected)
+		}
+	}
+	fValues := func(tagKey, metricGroup string, tr TimeRange, valuesExpected []string) {
+		t.Helper()
+		values, err := s.SearchTagValuesOnTimeRange([]byte(tagKey), newTfss(metricGroup), tr, 1e5, 1e5)
+		if err != nil {
+			t.Fatalf("unexpected error in SearchTagValuesOnTimeRange: %s", err)
+		}
+		sort.Strings(values)
+		if !reflect.DeepEqual(values, valuesExpected) {
+			t.Fatalf("unexpected tag values for tagKey=%q, metricGroup=%q, tr=%s; got %q; want %q", tagKey, metricGroup, &tr, values, valuesExpected)
+		}
+	}
+
+	// Zero time range without filters returns all the tags.
+	fKeys("", TimeRange{}, []string{"", "instance", "job"})
+	fValues("job", "", TimeRange{}, []string{"aaa", "bbb"})
+	fValues("", "", TimeRange{}, []string{"bar", "foo"})
+
+	// Time range filtering.
+	fKeys("", dayRange(10, 10), []string{"", "job"})
+	fKeys("", dayRange(20, 20), []string{"", "instance", "job"})
+	fKeys("", dayRange(11, 19), []string{})
+	fValues("job", "", dayRange(10, 10), []string{"aaa"})
+	fValues("job", "", dayRange(9, 20), []string{"aaa", "bbb"})
+	fValues("", "", dayRange(10, 10), []string{"foo"})
+	fValues("job", "", dayRange(11, 19), []string{})
+
+	// Time range filtering with tag filters.
+	fKeys("bar", dayRange(20, 20), []string{"", "instance"})
+	fKeys("bar", dayRange(10, 10), []string{})
+	fValues("job", "foo", dayRange(20, 20), []string{"bbb"})
+	fValues("job", "bar", dayRange(20, 20), []string{})
+
+	// Tag filters without time range.
+	fKeys("foo", TimeRange{}, []string{"", "job"})
+	fValues("job", "foo", TimeRange{}, []string{"aaa", "bbb"})
+
+	s.MustClose()
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
@@ -19,12 +19,19 @@ type table struct {
 	smallPartitionsPath string
 	bigPartitionsPath   string
 
-	getDeletedMetricIDs func() map[uint64]struct{}
+	// coldPath and coldPartitionsPath are empty if cold storage is disabled.
+	coldPath           string
+	coldPartitionsPath string
+
+	getDeletedMetricIDs     func() map[uint64]struct{}
+	getMetricIDRetentions   func() *metricIDRetentions
+	getMetricIDDownsampling func() *metricIDDownsampling
 
 	ptws     []*partitionWrapper
 	ptwsLock sync.Mutex
 
-	flockF *os.File
+	flockF     *os.File
+	coldFlockF *os.File
 
 	stop chan struct{}
 
@@ -76,7 +83,7 @@ func (ptw *partitionWrapper) scheduleToDrop() {
 // The table is created if it doesn't exist.
 //
 // Data older than the retentionMonths may be dropped at any time.
-func openTable(path string, retentionMonths int, getDeletedMetricIDs func() map[uint64]struct{}) (*table, error) {
+func openTable(path string, retentionMonths int, getDeletedMetricIDs func() map[uint64]struct{}, getMetricIDRetentions func() *metricIDRetentions, getMetricIDDownsampling func() *metricIDDownsampling) (*table, error) {
 	path = filepath.Clean(path)
 
 	// Create a directory for the table if it doesn't exist yet.
@@ -111,19 +118,56 @@ func openTable(path string, retentionMonths int, getDeletedMetricIDs func() map[
 		return nil, fmt.Errorf("cannot create %q: %s", bigSnapshotsPath, err)
 	}
 
+	// Create directories for cold partitions if cold storage is enabled.
+	coldPath := ""
+	coldPartitionsPath := ""
+	var coldFlockF *os.File
+	if len(coldStoragePath) > 0 {
+		coldStorageAbsPath, err := filepath.Abs(coldStoragePath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine absolute path for cold storage %q: %s", coldStoragePath, err)
+		}
+		coldPath = coldStorageAbsPath + "/" + filepath.Base(path)
+		if err := fs.MkdirAllIfNotExist(coldPath); err != nil {
+			return nil, fmt.Errorf("cannot create directory for cold table %q: %s", coldPath, err)
+		}
+		coldFlockFile := coldPath + "/flock.lock"
+		coldFlockF, err = os.Create(coldFlockFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create lock file %q: %s", coldFlockFile, err)
+		}
+		if err := unix.Flock(int(coldFlockF.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+			return nil, fmt.Errorf("cannot acquire lock on file %q: %s", coldFlockFile, err)
+		}
+		coldPartitionsPath = coldPath + "/big"
+		if err := fs.MkdirAllIfNotExist(coldPartitionsPath); err != nil {
+			return nil, fmt.Errorf("cannot create directory for cold partitions %q: %s", coldPartitionsPath, err)
+		}
+		coldSnapshotsPath := coldPartitionsPath + "/snapshots"
+		if err := fs.MkdirAllIfNotExist(coldSnapshotsPath); err != nil {
+			return nil, fmt.Errorf("cannot create %q: %s", coldSnapshotsPath, err)
+		}
+	}
+
 	// Open partitions.
-	pts, err := openPartitions(smallPartitionsPath, bigPartitionsPath, getDeletedMetricIDs)
+	pts, err := openPartitions(smallPartitionsPath, bigPartitionsPath, coldPartitionsPath, getDeletedMetricIDs, getMetricIDRetentions, getMetricIDDownsampling)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open partitions in the table %q: %s", path, err)
 	}
 
 	tb := &table{
-		path:                path,
-		smallPartitionsPath: smallPartitionsPath,
-		bigPartitionsPath:   bigPartitionsPath,
-		getDeletedMetricIDs: getDeletedMetricIDs,
+		path:                  path,
+		smallPartitionsPath:   smallPartitionsPath,
+		bigPartitionsPath:     bigPartitionsPath,
+		coldPath:              coldPath,
+		coldPartitionsPath:    coldPartitionsPath,
+		getDeletedMetricIDs:   getDeletedMetricIDs,
+		getMetricIDRetentions: getMetricIDRetentions,
+
+		getMetricIDDownsampling: getMetricIDDownsampling,
 
-		flockF: flockF,
+		flockF:     flockF,
+		coldFlockF: coldFlockF,
 
 		stop: make(chan struct{}),
 	}
@@ -139,8 +183,10 @@ func openTable(path string, retentionMonths int, getDeletedMetricIDs func() map[
 	return tb, nil
 }
 
-// CreateSnapshot creates tb snapshot and returns paths to small and big parts of it.
-func (tb *table) CreateSnapshot(snapshotName string) (string, string, error) {
+// CreateSnapshot creates tb snapshot and returns paths to small, big and cold parts of it.
+//
+// The returned path to cold parts is empty if cold storage is disabled.
+func (tb *table) CreateSnapshot(snapshotName string) (string, string, string, error) {
 	logger.Infof("creating table snapshot of %q...", tb.path)
 	startTime := time.Now()
 
@@ -149,18 +195,30 @@ func (tb *table) CreateSnapshot(snapshotName string) (string, string, error) {
 
 	dstSmallDir := fmt.Sprintf("%s/small/snapshots/%s", tb.path, snapshotName)
 	if err := fs.MkdirAllFailIfExist(dstSmallDir); err != nil {
-		return "", "", fmt.Errorf("cannot create dir %q: %s", dstSmallDir, err)
+		return "", "", "", fmt.Errorf("cannot create dir %q: %s", dstSmallDir, err)
 	}
 	dstBigDir := fmt.Sprintf("%s/big/snapshots/%s", tb.path, snapshotName)
 	if err := fs.MkdirAllFailIfExist(dstBigDir); err != nil {
-		return "", "", fmt.Errorf("cannot create dir %q: %s", dstBigDir, err)
+		return "", "", "", fmt.Errorf("cannot create dir %q: %s", dstBigDir, err)
+	}
+	dstColdDir := ""
+	if len(tb.coldPath) > 0 {
+		// Cold parts cannot be hard-linked to the snapshot at tb.path, since they may be located on another filesystem.
+		dstColdDir = fmt.Sprintf("%s/big/snapshots/%s", tb.coldPath, snapshotName)
+		if err := fs.MkdirAllFailIfExist(dstColdDir); err != nil {
+			return "", "", "", fmt.Errorf("cannot create dir %q: %s", dstColdDir, err)
+		}
 	}
 
 	for _, ptw := range ptws {
 		smallPath := dstSmallDir + "/" + ptw.pt.name
 		bigPath := dstBigDir + "/" + ptw.pt.name
-		if err := ptw.pt.CreateSnapshotAt(smallPath, bigPath); err != nil {
-			return "", "", fmt.Errorf("cannot create snapshot for partition %q in %q: %s", ptw.pt.name, tb.path, err)
+		coldPath := ""
+		if len(dstColdDir) > 0 {
+			coldPath = dstColdDir + "/" + ptw.pt.name
+		}
+		if err := ptw.pt.CreateSnapshotAt(smallPath, bigPath, coldPath); err != nil {
+			return "", "", "", fmt.Errorf("cannot create snapshot for partition %q in %q: %s", ptw.pt.name, tb.path, err)
 		}
 	}
 
@@ -168,9 +226,13 @@ func (tb *table) CreateSnapshot(snapshotName string) (string, string, error) {
 	fs.MustSyncPath(dstBigDir)
 	fs.MustSyncPath(filepath.Dir(dstSmallDir))
 	fs.MustSyncPath(filepath.Dir(dstBigDir))
+	if len(dstColdDir) > 0 {
+		fs.MustSyncPath(dstColdDir)
+		fs.MustSyncPath(filepath.Dir(dstColdDir))
+	}
 
-	logger.Infof("created table snapshot for %q at (%q, %q) in %s", tb.path, dstSmallDir, dstBigDir, time.Since(startTime))
-	return dstSmallDir, dstBigDir, nil
+	logger.Infof("created table snapshot for %q at (%q, %q, %q) in %s", tb.path, dstSmallDir, dstBigDir, dstColdDir, time.Since(startTime))
+	return dstSmallDir, dstBigDir, dstColdDir, nil
 }
 
 // MustDeleteSnapshot deletes snapshot with the given snapshotName.
@@ -179,6 +241,10 @@ func (tb *table) MustDeleteSnapshot(snapshotName string) {
 	fs.MustRemoveAll(smallDir)
 	bigDir := fmt.Sprintf("%s/big/snapshots/%s", tb.path, snapshotName)
 	fs.MustRemoveAll(bigDir)
+	if len(tb.coldPath) > 0 {
+		coldDir := fmt.Sprintf("%s/big/snapshots/%s", tb.coldPath, snapshotName)
+		fs.MustRemoveAll(coldDir)
+	}
 }
 
 func (tb *table) addPartitionNolock(pt *partition) {
@@ -209,6 +275,11 @@ func (tb *table) MustClose() {
 	if err := tb.flockF.Close(); err != nil {
 		logger.Panicf("FATAL: cannot release lock on %q: %s", tb.flockF.Name(), err)
 	}
+	if tb.coldFlockF != nil {
+		if err := tb.coldFlockF.Close(); err != nil {
+			logger.Panicf("FATAL: cannot release lock on %q: %s", tb.coldFlockF.Name(), err)
+		}
+	}
 }
 
 // flushRawRows flushes all the pending rows, so they become visible to search.
@@ -342,7 +413,7 @@ func (tb *table) AddRows(rows []rawRow) error {
 			continue
 		}
 
-		pt, err := createPartition(r.Timestamp, tb.smallPartitionsPath, tb.bigPartitionsPath, tb.getDeletedMetricIDs)
+		pt, err := createPartition(r.Timestamp, tb.smallPartitionsPath, tb.bigPartitionsPath, tb.coldPartitionsPath, tb.getDeletedMetricIDs, tb.getMetricIDRetentions, tb.getMetricIDDownsampling)
 		if err != nil {
 			errors = append(errors, err)
 			continue
@@ -428,7 +499,7 @@ func (tb *table) PutPartitions(ptws []*partitionWrapper) {
 	}
 }
 
-func openPartitions(smallPartitionsPath, bigPartitionsPath string, getDeletedMetricIDs func() map[uint64]struct{}) ([]*partition, error) {
+func openPartitions(smallPartitionsPath, bigPartitionsPath, coldPartitionsPath string, getDeletedMetricIDs func() map[uint64]struct{}, getMetricIDRetentions func() *metricIDRetentions, getMetricIDDownsampling func() *metricIDDownsampling) ([]*partition, error) {
 	smallD, err := os.Open(smallPartitionsPath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open directory with small partitions %q: %s", smallPartitionsPath, err)
@@ -452,7 +523,11 @@ func openPartitions(smallPartitionsPath, bigPartitionsPath string, getDeletedMet
 		}
 		smallPartsPath := smallPartitionsPath + "/" + ptName
 		bigPartsPath := bigPartitionsPath + "/" + ptName
-		pt, err := openPartition(smallPartsPath, bigPartsPath, getDeletedMetricIDs)
+		coldPartsPath := ""
+		if len(coldPartitionsPath) > 0 {
+			coldPartsPath = coldPartitionsPath + "/" + ptName
+		}
+		pt, err := openPartition(smallPartsPath, bigPartsPath, coldPartsPath, getDeletedMetricIDs, getMetricIDRetentions, getMetricIDDownsampling)
 		if err != nil {
 			mustClosePartitions(pts)
 			return nil, fmt.Errorf("cannot open partition %q: %s", ptName, err)
@@ -43,7 +43,7 @@ func openBenchTable(b *testing.B, startTimestamp int64, rowsPerInsert, rowsCount
 		createBenchTable(b, path, startTimestamp, rowsPerInsert, rowsCount, tsidsCount)
 		createdBenchTables[path] = true
 	}
-	tb, err := openTable(path, -1, nilGetDeletedMetricIDs)
+	tb, err := openTable(path, -1, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 	if err != nil {
 		b.Fatalf("cnanot open table %q: %s", path, err)
 	}
@@ -66,7 +66,7 @@ var createdBenchTables = make(map[string]bool)
 func createBenchTable(b *testing.B, path string, startTimestamp int64, rowsPerInsert, rowsCount, tsidsCount int) {
 	b.Helper()
 
-	tb, err := openTable(path, -1, nilGetDeletedMetricIDs)
+	tb, err := openTable(path, -1, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 	if err != nil {
 		b.Fatalf("cannot open table %q: %s", path, err)
 	}
@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestTableOpenClose(t *testing.T) {
@@ -17,7 +20,7 @@ func TestTableOpenClose(t *testing.T) {
 	}()
 
 	// Create a new table
-	tb, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs)
+	tb, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 	if err != nil {
 		t.Fatalf("cannot create new table: %s", err)
 	}
@@ -27,7 +30,7 @@ func TestTableOpenClose(t *testing.T) {
 
 	// Re-open created table multiple times.
 	for i := 0; i < 10; i++ {
-		tb, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs)
+		tb, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 		if err != nil {
 			t.Fatalf("cannot open created table: %s", err)
 		}
@@ -43,17 +46,208 @@ func TestTableOpenMultipleTimes(t *testing.T) {
 		_ = os.RemoveAll(path)
 	}()
 
-	tb1, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs)
+	tb1, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 	if err != nil {
 		t.Fatalf("cannot open table the first time: %s", err)
 	}
 	defer tb1.MustClose()
 
 	for i := 0; i < 10; i++ {
-		tb2, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs)
+		tb2, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
 		if err == nil {
 			tb2.MustClose()
 			t.Fatalf("expecting non-nil error when opening already opened table")
 		}
 	}
 }
+
+func TestTableMergeConcurrencyOne(t *testing.T) {
+	const path = "TestTableMergeConcurrencyOne"
+	const retentionMonths = 123
+
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	SetMergeConcurrency(1)
+	defer SetMergeConcurrency(0)
+
+	tb, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
+	if err != nil {
+		t.Fatalf("cannot create new table: %s", err)
+	}
+
+	// Create many small parts, so a single merge worker must merge them in multiple passes.
+	now := timestampFromTime(time.Now())
+	const partsCount = 5 * defaultPartsToMerge
+	const rowsPerPart = 100
+	for i := 0; i < partsCount; i++ {
+		var rows []rawRow
+		for j := 0; j < rowsPerPart; j++ {
+			var r rawRow
+			r.TSID.MetricID = uint64(j % 10)
+			r.Timestamp = now + int64(i*rowsPerPart+j)
+			r.Value = float64(j)
+			r.PrecisionBits = 64
+			rows = append(rows, r)
+		}
+		if err := tb.AddRows(rows); err != nil {
+			t.Fatalf("cannot add rows: %s", err)
+		}
+		tb.flushRawRows()
+	}
+
+	// Wait until the parts are merged.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var m TableMetrics
+		tb.UpdateMetrics(&m)
+		if m.SmallPartsNotInMerge > m.SmallPartsCount || m.BigPartsNotInMerge > m.BigPartsCount {
+			t.Fatalf("parts not in merge cannot exceed parts; got %d small and %d big parts not in merge for %d small and %d big parts",
+				m.SmallPartsNotInMerge, m.BigPartsNotInMerge, m.SmallPartsCount, m.BigPartsCount)
+		}
+		if m.SmallPartsCount+m.BigPartsCount < defaultPartsToMerge && m.SmallRowsCount+m.BigRowsCount == partsCount*rowsPerPart {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout when waiting for merging %d parts; %d small and %d big parts left", partsCount, m.SmallPartsCount, m.BigPartsCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Verify that the table is closed without deadlocks.
+	tb.MustClose()
+}
+
+func TestTableColdStorage(t *testing.T) {
+	const path = "TestTableColdStorage"
+	const coldPath = "TestTableColdStorage-cold"
+	const retentionMonths = 123
+
+	defer func() {
+		_ = os.RemoveAll(path)
+		_ = os.RemoveAll(coldPath)
+	}()
+
+	SetColdStorage(coldPath, 0)
+	defer SetColdStorage("", 0)
+
+	tb, err := openTable(path, retentionMonths, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
+	if err != nil {
+		t.Fatalf("cannot create new table: %s", err)
+	}
+
+	// Add rows to the previous month, which must be moved to cold storage,
+	// and to the current time, which must remain at hot storage.
+	now := timestampFromTime(time.Now())
+	var ptr TimeRange
+	ptr.fromPartitionTimestamp(now)
+	coldTimestamp := ptr.MinTimestamp - 24*3600*1000
+	const rowsCount = 1000
+	var rows []rawRow
+	for i := 0; i < rowsCount; i++ {
+		var r rawRow
+		r.TSID.MetricID = uint64(i % 10)
+		r.Timestamp = coldTimestamp + int64(i)
+		r.Value = float64(i)
+		r.PrecisionBits = 64
+		rows = append(rows, r)
+	}
+	if err := tb.AddRows(rows); err != nil {
+		t.Fatalf("cannot add rows to cold partition: %s", err)
+	}
+	for i := range rows {
+		rows[i].Timestamp = now + int64(i)
+	}
+	if err := tb.AddRows(rows); err != nil {
+		t.Fatalf("cannot add rows to hot partition: %s", err)
+	}
+	tb.flushRawRows()
+
+	// Wait until the data is moved to cold storage.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var m TableMetrics
+		tb.UpdateMetrics(&m)
+		if m.ColdRowsCount == rowsCount {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout when waiting for moving rows to cold storage; moved %d rows out of %d", m.ColdRowsCount, rowsCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	coldPartsPath := fmt.Sprintf("%s/%s/big/%s", coldPath, path, timestampToPartitionName(coldTimestamp))
+	if n := testCountPartDirs(t, coldPartsPath); n == 0 {
+		t.Fatalf("missing parts at %q", coldPartsPath)
+	}
+	for _, hotPath := range []string{tb.smallPartitionsPath, tb.bigPartitionsPath} {
+		hotPartsPath := hotPath + "/" + timestampToPartitionName(coldTimestamp)
+		if n := testCountPartDirs(t, hotPartsPath); n > 0 {
+			t.Fatalf("unexpected %d parts left at %q", n, hotPartsPath)
+		}
+	}
+	testTableColdStorageSearch(t, tb, 2*rowsCount)
+	tb.MustClose()
+
+	// Re-open the table and verify that the data is searchable at both storages.
+	tb, err = openTable(path, retentionMonths, nilGetDeletedMetricIDs, nilGetMetricIDRetentions, nilGetMetricIDDownsampling)
+	if err != nil {
+		t.Fatalf("cannot open created table: %s", err)
+	}
+	var m TableMetrics
+	tb.UpdateMetrics(&m)
+	if m.ColdRowsCount != rowsCount {
+		t.Fatalf("unexpected number of cold rows after re-opening the table; got %d; want %d", m.ColdRowsCount, rowsCount)
+	}
+	if n := m.BigRowsCount + m.SmallRowsCount; n != 2*rowsCount {
+		t.Fatalf("unexpected number of rows after re-opening the table; got %d; want %d", n, 2*rowsCount)
+	}
+	testTableColdStorageSearch(t, tb, 2*rowsCount)
+	tb.MustClose()
+}
+
+func testTableColdStorageSearch(t *testing.T, tb *table, rowsCountExpected int) {
+	t.Helper()
+	var tsids []TSID
+	for i := 0; i < 10; i++ {
+		tsids = append(tsids, TSID{
+			MetricID: uint64(i),
+		})
+	}
+	tr := TimeRange{
+		MinTimestamp: 0,
+		MaxTimestamp: timestampFromTime(time.Now()) + 3600*1000,
+	}
+	var ts tableSearch
+	ts.Init(tb, tsids, tr)
+	rowsCount := 0
+	for ts.NextBlock() {
+		if err := ts.Block.UnmarshalData(); err != nil {
+			t.Fatalf("cannot unmarshal block: %s", err)
+		}
+		rowsCount += ts.Block.RowsCount()
+	}
+	if err := ts.Error(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ts.MustClose()
+	if rowsCount != rowsCountExpected {
+		t.Fatalf("unexpected number of rows found; got %d; want %d", rowsCount, rowsCountExpected)
+	}
+}
+
+func testCountPartDirs(t *testing.T, path string) int {
+	t.Helper()
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", path, err)
+	}
+	n := 0
+	for _, fi := range fis {
+		if fi.IsDir() && fi.Name() != "tmp" && fi.Name() != "txn" {
+			n++
+		}
+	}
+	return n
+}
@@ -81,6 +81,16 @@ func (tfs *TagFilters) Reset() {
 	tfs.commonPrefix = marshalCommonPrefix(tfs.commonPrefix[:0], nsPrefixTagToMetricID)
 }
 
+// hasPositiveFilter returns true if tfs contains at least a single positive tag filter.
+func (tfs *TagFilters) hasPositiveFilter() bool {
+	for i := range tfs.tfs {
+		if !tfs.tfs[i].isNegative {
+			return true
+		}
+	}
+	return false
+}
+
 func (tfs *TagFilters) marshal(dst []byte) []byte {
 	for i := range tfs.tfs {
 		dst = tfs.tfs[i].Marshal(dst)
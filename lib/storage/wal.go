@@ -0,0 +1,471 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// SetWAL enables or disables the write-ahead log for the ingested rows.
+//
+// When the log is enabled, AddRows writes the rows to the log before adding them to the storage,
+// so they may be recovered after unclean shutdown. The log is truncated after the logged rows
+// are flushed to parts on disk.
+//
+// syncInterval is the interval between fsync calls for the log. If it is 0, then AddRows returns
+// only after the log is synced to disk. Concurrent AddRows calls share a single fsync.
+//
+// This function must be called before initializing the storage.
+func SetWAL(enabled bool, syncInterval time.Duration) {
+	walEnabled = enabled
+	walSyncInterval = syncInterval
+}
+
+var (
+	walEnabled      bool
+	walSyncInterval time.Duration
+)
+
+// The size of the header for each wal record.
+//
+// The header contains payload length (4 bytes) and xxhash of the payload (8 bytes).
+const walRecordHeaderSize = 12
+
+// The maximum size of a single wal record payload.
+const maxWALRecordSize = 1 << 30
+
+// wal is the write-ahead log for the rows added to the storage.
+//
+// The log consists of segment files. A new segment is started on each checkpoint,
+// while older segments are removed after the rows they contain are flushed to parts.
+type wal struct {
+	path string
+
+	// mu is held in read mode while rows are written to the log and added to the storage.
+	// It is held in write mode when the log is rotated, so the rotation happens between AddRows calls.
+	mu sync.RWMutex
+
+	// fLock protects the fields below.
+	fLock sync.Mutex
+	f     *os.File
+	bw    *bufio.Writer
+	seq   uint64
+
+	// The number of records written to the log.
+	writtenRecords uint64
+
+	// syncLock serializes fsync calls, so concurrent writers may share a single fsync.
+	syncLock sync.Mutex
+
+	// The number of records synced to disk.
+	syncedRecords uint64
+
+	bytesWritten uint64
+	syncs        uint64
+}
+
+func openWAL(path string, seq uint64) (*wal, error) {
+	w := &wal{
+		path: path,
+		seq:  seq,
+	}
+	if err := w.createSegment(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wal) createSegment() error {
+	segmentPath := walSegmentPath(w.path, w.seq)
+	f, err := os.Create(segmentPath)
+	if err != nil {
+		return fmt.Errorf("cannot create wal segment: %s", err)
+	}
+	fs.MustSyncPath(w.path)
+	w.f = f
+	if w.bw == nil {
+		w.bw = bufio.NewWriterSize(f, 64*1024)
+	} else {
+		w.bw.Reset(f)
+	}
+	return nil
+}
+
+// write writes the given mrs to the log and returns the number of records written so far.
+func (w *wal) write(mrs []MetricRow, precisionBits uint8) (uint64, error) {
+	bb := walBufPool.Get()
+	bb.B = append(bb.B[:0], make([]byte, walRecordHeaderSize)...)
+	bb.B = append(bb.B, precisionBits)
+	for i := range mrs {
+		bb.B = mrs[i].Marshal(bb.B)
+	}
+	payload := bb.B[walRecordHeaderSize:]
+	if len(payload) > maxWALRecordSize {
+		walBufPool.Put(bb)
+		return 0, fmt.Errorf("too big wal record for %d rows; got %d bytes; cannot exceed %d bytes", len(mrs), len(payload), maxWALRecordSize)
+	}
+	header := encoding.MarshalUint32(bb.B[:0], uint32(len(payload)))
+	encoding.MarshalUint64(header, xxhash.Sum64(payload))
+
+	w.fLock.Lock()
+	_, err := w.bw.Write(bb.B)
+	w.writtenRecords++
+	n := w.writtenRecords
+	w.fLock.Unlock()
+	atomic.AddUint64(&w.bytesWritten, uint64(len(bb.B)))
+	walBufPool.Put(bb)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot write %d rows to wal at %q: %s", len(mrs), w.path, err)
+	}
+	return n, nil
+}
+
+var walBufPool bytesutil.ByteBufferPool
+
+// syncRecords makes sure the first n records written to the log are synced to disk.
+func (w *wal) syncRecords(n uint64) error {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+	if w.syncedRecords >= n {
+		// The records have been already synced by concurrent goroutine.
+		return nil
+	}
+	return w.syncLocked()
+}
+
+func (w *wal) syncLocked() error {
+	w.fLock.Lock()
+	n := w.writtenRecords
+	err := w.bw.Flush()
+	f := w.f
+	w.fLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot flush wal segment %q: %s", f.Name(), err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync wal segment %q: %s", f.Name(), err)
+	}
+	w.syncedRecords = n
+	atomic.AddUint64(&w.syncs, 1)
+	return nil
+}
+
+// mustRotate starts a new segment and returns paths to the previous segments.
+//
+// w.mu must be locked in write mode.
+func (w *wal) mustRotate() []string {
+	w.mustCloseSegment()
+	w.seq++
+	if err := w.createSegment(); err != nil {
+		logger.Panicf("FATAL: %s", err)
+	}
+	segments, err := listWALSegments(w.path)
+	if err != nil {
+		logger.Panicf("FATAL: %s", err)
+	}
+	return segments[:len(segments)-1]
+}
+
+func (w *wal) mustCloseSegment() {
+	w.syncLock.Lock()
+	err := w.syncLocked()
+	w.syncLock.Unlock()
+	if err != nil {
+		logger.Panicf("FATAL: %s", err)
+	}
+	fs.MustClose(w.f)
+}
+
+func walSegmentPath(path string, seq uint64) string {
+	return fmt.Sprintf("%s/%016X", path, seq)
+}
+
+// listWALSegments returns sorted paths to wal segments at the given path.
+func listWALSegments(path string) ([]string, error) {
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read wal directory: %s", err)
+	}
+	var segments []string
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if _, err := strconv.ParseUint(fi.Name(), 16, 64); err != nil || len(fi.Name()) != 16 {
+			logger.Errorf("skipping unexpected file %q in wal directory %q", fi.Name(), path)
+			continue
+		}
+		segments = append(segments, path+"/"+fi.Name())
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// readWALSegment calls f for each record in the wal segment at the given path.
+//
+// The reading stops at the first incomplete or corrupted record, since it may be left after unclean shutdown.
+func readWALSegment(path string, f func(mrs []MetricRow, precisionBits uint8)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open wal segment: %s", err)
+	}
+	defer fs.MustClose(file)
+	br := bufio.NewReaderSize(file, 64*1024)
+	var header [walRecordHeaderSize]byte
+	var payload []byte
+	var mrs []MetricRow
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if err != io.EOF {
+				logger.Errorf("skipping incomplete record header at the end of wal segment %q", path)
+			}
+			return nil
+		}
+		payloadLen := encoding.UnmarshalUint32(header[:])
+		if payloadLen == 0 || payloadLen > maxWALRecordSize {
+			logger.Errorf("skipping the tail of wal segment %q with invalid record length %d", path, payloadLen)
+			return nil
+		}
+		payload = bytesutil.Resize(payload, int(payloadLen))
+		if _, err := io.ReadFull(br, payload); err != nil {
+			logger.Errorf("skipping incomplete record at the end of wal segment %q", path)
+			return nil
+		}
+		if xxhash.Sum64(payload) != encoding.UnmarshalUint64(header[4:]) {
+			logger.Errorf("skipping the tail of wal segment %q with corrupted record", path)
+			return nil
+		}
+		precisionBits := payload[0]
+		tail := payload[1:]
+		mrs = mrs[:0]
+		for len(tail) > 0 {
+			if cap(mrs) > len(mrs) {
+				mrs = mrs[:len(mrs)+1]
+			} else {
+				mrs = append(mrs, MetricRow{})
+			}
+			tail, err = mrs[len(mrs)-1].Unmarshal(tail)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal rows from wal segment %q: %s", path, err)
+			}
+		}
+		f(mrs, precisionBits)
+	}
+}
+
+func (s *Storage) mustOpenWAL() error {
+	walPath := s.path + "/wal"
+	if err := fs.MkdirAllIfNotExist(walPath); err != nil {
+		return fmt.Errorf("cannot create wal directory %q: %s", walPath, err)
+	}
+	segments, err := listWALSegments(walPath)
+	if err != nil {
+		return err
+	}
+	seq := uint64(0)
+	if len(segments) > 0 {
+		// The wal segments are left after unclean shutdown. Recover the rows from them.
+		logger.Infof("replaying %d wal segments from %q...", len(segments), walPath)
+		startTime := time.Now()
+		for _, segment := range segments {
+			if err := s.replayWALSegment(segment); err != nil {
+				return err
+			}
+		}
+		if ok, err := s.flushRowsToParts(nil, nil); !ok {
+			return fmt.Errorf("cannot flush rows replayed from wal: %s", err)
+		}
+		for _, segment := range segments {
+			fs.MustRemoveAll(segment)
+		}
+		lastSegment := segments[len(segments)-1]
+		seq, err = strconv.ParseUint(lastSegment[len(lastSegment)-16:], 16, 64)
+		if err != nil {
+			logger.Panicf("BUG: cannot parse wal segment sequence number from %q: %s", lastSegment, err)
+		}
+		seq++
+		logger.Infof("replayed %d rows from %d wal segments at %q in %s",
+			atomic.LoadUint64(&s.walRowsReplayed), len(segments), walPath, time.Since(startTime))
+	}
+	if !walEnabled {
+		return nil
+	}
+	w, err := openWAL(walPath, seq)
+	if err != nil {
+		return err
+	}
+	s.wal = w
+	s.startWALCheckpointer()
+	if walSyncInterval > 0 {
+		s.startWALSyncer()
+	}
+	return nil
+}
+
+func (s *Storage) replayWALSegment(segment string) error {
+	return readWALSegment(segment, func(mrs []MetricRow, precisionBits uint8) {
+		if err := s.addRows(mrs, precisionBits); err != nil {
+			logger.Errorf("cannot add rows replayed from wal segment %q: %s", segment, err)
+		}
+		atomic.AddUint64(&s.walRowsReplayed, uint64(len(mrs)))
+	})
+}
+
+func (s *Storage) addRowsWithWAL(mrs []MetricRow, precisionBits uint8) error {
+	w := s.wal
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	n, err := w.write(mrs, precisionBits)
+	if err != nil {
+		return err
+	}
+	err = s.addRows(mrs, precisionBits)
+	if walSyncInterval <= 0 {
+		// Make sure the rows are persisted before returning to the caller.
+		if errSync := w.syncRecords(n); errSync != nil {
+			return errSync
+		}
+	}
+	return err
+}
+
+func (s *Storage) startWALCheckpointer() {
+	s.walWG.Add(1)
+	go func() {
+		s.walCheckpointer()
+		s.walWG.Done()
+	}()
+}
+
+func (s *Storage) walCheckpointer() {
+	t := time.NewTicker(inmemoryPartsFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.walCheckpoint()
+		}
+	}
+}
+
+// walCheckpoint flushes the rows added to s to parts on disk and removes wal segments containing these rows.
+func (s *Storage) walCheckpoint() {
+	w := s.wal
+	var segments []string
+	ok, err := s.flushRowsToParts(&w.mu, func() {
+		segments = w.mustRotate()
+	})
+	if !ok {
+		if err != nil {
+			logger.Errorf("cannot flush rows for wal checkpoint; the checkpoint will be retried later: %s", err)
+		}
+		return
+	}
+	for _, segment := range segments {
+		fs.MustRemoveAll(segment)
+	}
+}
+
+// flushRowsToParts makes sure all the rows added to s before the call are stored in file parts
+// together with the indexdb entries for them.
+//
+// If lock isn't nil, then raw rows are converted into inmemory parts under the lock and rotate is called
+// under the lock before that. False is returned if s is stopped or on error.
+func (s *Storage) flushRowsToParts(lock sync.Locker, rotate func()) (bool, error) {
+	if lock != nil {
+		lock.Lock()
+	}
+	if rotate != nil {
+		rotate()
+	}
+	ptws := s.tb.GetPartitions(nil)
+	pwss := make([][]*partWrapper, len(ptws))
+	for i, ptw := range ptws {
+		pwss[i] = ptw.pt.flushRawRowsSync(nil)
+	}
+	if lock != nil {
+		lock.Unlock()
+	}
+	defer s.tb.PutPartitions(ptws)
+
+	for i, ptw := range ptws {
+		ok, err := ptw.pt.flushInmemoryPartsSync(pwss[i], s.stop)
+		if !ok {
+			return false, err
+		}
+	}
+	s.idb().tb.DebugFlush()
+	return true, nil
+}
+
+func (s *Storage) startWALSyncer() {
+	s.walWG.Add(1)
+	go func() {
+		s.walSyncer()
+		s.walWG.Done()
+	}()
+}
+
+func (s *Storage) walSyncer() {
+	w := s.wal
+	t := time.NewTicker(walSyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			w.mu.RLock()
+			w.fLock.Lock()
+			n := w.writtenRecords
+			w.fLock.Unlock()
+			if err := w.syncRecords(n); err != nil {
+				logger.Errorf("cannot sync wal: %s", err)
+			}
+			w.mu.RUnlock()
+		}
+	}
+}
+
+// mustCloseWAL closes the wal and removes its segments.
+//
+// It must be called after all the data is flushed to disk.
+func (s *Storage) mustCloseWAL() {
+	w := s.wal
+	if w == nil {
+		return
+	}
+	w.mustCloseSegment()
+	segments, err := listWALSegments(w.path)
+	if err != nil {
+		logger.Panicf("FATAL: %s", err)
+	}
+	for _, segment := range segments {
+		fs.MustRemoveAll(segment)
+	}
+}
+
+func (s *Storage) updateWALMetrics(m *Metrics) {
+	m.WALRowsReplayed += atomic.LoadUint64(&s.walRowsReplayed)
+	if w := s.wal; w != nil {
+		m.WALBytesWritten += atomic.LoadUint64(&w.bytesWritten)
+		m.WALSyncs += atomic.LoadUint64(&w.syncs)
+	}
+}
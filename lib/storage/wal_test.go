@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestWALReadSegment(t *testing.T) {
+	path := "TestWALReadSegment"
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("cannot create %q: %s", path, err)
+	}
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("cannot remove %q: %s", path, err)
+		}
+	}()
+	w, err := openWAL(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open wal: %s", err)
+	}
+	mrs := newTestWALRows("metric", 10, 1000)
+	for i := 0; i < 3; i++ {
+		n, err := w.write(mrs, uint8(10+i))
+		if err != nil {
+			t.Fatalf("unexpected error when writing to wal: %s", err)
+		}
+		if err := w.syncRecords(n); err != nil {
+			t.Fatalf("unexpected error when syncing wal: %s", err)
+		}
+	}
+	w.mustCloseSegment()
+
+	f := func(segment string, recordsExpected int) {
+		t.Helper()
+		records := 0
+		err := readWALSegment(segment, func(mrsRead []MetricRow, precisionBits uint8) {
+			if precisionBits != uint8(10+records) {
+				t.Fatalf("unexpected precisionBits for record #%d; got %d; want %d", records, precisionBits, 10+records)
+			}
+			if len(mrsRead) != len(mrs) {
+				t.Fatalf("unexpected number of rows in record #%d; got %d; want %d", records, len(mrsRead), len(mrs))
+			}
+			for i := range mrs {
+				if mrsRead[i].String() != mrs[i].String() {
+					t.Fatalf("unexpected row #%d in record #%d; got %s; want %s", i, records, &mrsRead[i], &mrs[i])
+				}
+			}
+			records++
+		})
+		if err != nil {
+			t.Fatalf("unexpected error when reading wal segment: %s", err)
+		}
+		if records != recordsExpected {
+			t.Fatalf("unexpected number of records read; got %d; want %d", records, recordsExpected)
+		}
+	}
+	segment := walSegmentPath(path, 0)
+	f(segment, 3)
+
+	// The torn record at the end of the segment must be skipped.
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatalf("cannot read wal segment: %s", err)
+	}
+	recordSize := len(data) / 3
+	if err := ioutil.WriteFile(segment, data[:len(data)-recordSize/2], 0644); err != nil {
+		t.Fatalf("cannot truncate wal segment: %s", err)
+	}
+	f(segment, 2)
+
+	// The corrupted record must be skipped together with the tail of the segment.
+	data[recordSize+walRecordHeaderSize+5]++
+	if err := ioutil.WriteFile(segment, data, 0644); err != nil {
+		t.Fatalf("cannot corrupt wal segment: %s", err)
+	}
+	f(segment, 1)
+}
+
+func TestStorageWALCrashRecovery(t *testing.T) {
+	SetWAL(true, 0)
+	defer SetWAL(false, 0)
+
+	path := "TestStorageWALCrashRecovery"
+	crashPath := path + "-crashed"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	now := timestampFromTime(time.Now())
+	const rowsCount = 100
+	mrs := newTestWALRows("metric", rowsCount, now-rowsCount*1000)
+	for i := 0; i < rowsCount; i += 10 {
+		if err := s.AddRows(mrs[i:i+10], 64); err != nil {
+			t.Fatalf("unexpected error when adding mrs: %s", err)
+		}
+	}
+
+	// Simulate a crash by copying the wal to an empty storage before the rows are flushed to disk.
+	// AddRows must return only after the rows are synced to the wal.
+	crashWALPath := crashPath + "/wal"
+	if err := os.MkdirAll(crashWALPath, 0755); err != nil {
+		t.Fatalf("cannot create %q: %s", crashWALPath, err)
+	}
+	segments, err := listWALSegments(s.wal.path)
+	if err != nil {
+		t.Fatalf("cannot list wal segments: %s", err)
+	}
+	for _, segment := range segments {
+		data, err := ioutil.ReadFile(segment)
+		if err != nil {
+			t.Fatalf("cannot read wal segment: %s", err)
+		}
+		if err := ioutil.WriteFile(crashWALPath+"/"+filepath.Base(segment), data, 0644); err != nil {
+			t.Fatalf("cannot copy wal segment: %s", err)
+		}
+	}
+	s.MustClose()
+	segments, err = listWALSegments(path + "/wal")
+	if err != nil {
+		t.Fatalf("cannot list wal segments: %s", err)
+	}
+	if len(segments) != 0 {
+		t.Fatalf("wal segments must be removed on clean shutdown; got %q", segments)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+
+	// The rows must be recovered from the wal on startup.
+	s, err = OpenStorage(crashPath, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if m.WALRowsReplayed != rowsCount {
+		t.Fatalf("unexpected number of replayed rows; got %d; want %d", m.WALRowsReplayed, rowsCount)
+	}
+	checkWALRows(t, s, "metric", mrs)
+
+	// The replayed segments must be removed after the rows are flushed to disk.
+	segments, err = listWALSegments(s.wal.path)
+	if err != nil {
+		t.Fatalf("cannot list wal segments: %s", err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("expecting a single wal segment after the replay; got %q", segments)
+	}
+
+	// The checkpoint must remove segments with the rows flushed to disk.
+	mrs = newTestWALRows("metric_new", 10, now-10*1000)
+	if err := s.AddRows(mrs, 64); err != nil {
+		t.Fatalf("unexpected error when adding mrs: %s", err)
+	}
+	s.walCheckpoint()
+	segmentsNew, err := listWALSegments(s.wal.path)
+	if err != nil {
+		t.Fatalf("cannot list wal segments: %s", err)
+	}
+	if len(segmentsNew) != 1 || segmentsNew[0] == segments[0] {
+		t.Fatalf("expecting a single new wal segment after the checkpoint; got %q", segmentsNew)
+	}
+	checkWALRows(t, s, "metric_new", mrs)
+
+	s.MustClose()
+	if err := os.RemoveAll(crashPath); err != nil {
+		t.Fatalf("cannot remove %q: %s", crashPath, err)
+	}
+}
+
+func newTestWALRows(metricGroup string, rowsCount int, startTimestamp int64) []MetricRow {
+	var mrs []MetricRow
+	for i := 0; i < rowsCount; i++ {
+		labels := []prompb.Label{
+			{Name: []byte("__name__"), Value: []byte(metricGroup)},
+			{Name: []byte("instance"), Value: []byte(fmt.Sprintf("host-%d", i%3))},
+		}
+		mrs = append(mrs, MetricRow{
+			MetricNameRaw: MarshalMetricNameRaw(nil, labels),
+			Timestamp:     startTimestamp + int64(i)*1000,
+			Value:         float64(i),
+		})
+	}
+	return mrs
+}
+
+func checkWALRows(t *testing.T, s *Storage, metricGroup string, mrs []MetricRow) {
+	t.Helper()
+	values, err := getValuesByMetricGroup(s, metricGroup)
+	if err != nil {
+		t.Fatalf("cannot obtain values: %s", err)
+	}
+	if len(values) != len(mrs) {
+		t.Fatalf("unexpected number of values for %q; got %d; want %d", metricGroup, len(values), len(mrs))
+	}
+	for i := range mrs {
+		mr := &mrs[i]
+		if values[mr.Timestamp] != mr.Value {
+			t.Fatalf("unexpected value at timestamp %d; got %v; want %v", mr.Timestamp, values[mr.Timestamp], mr.Value)
+		}
+	}
+}
@@ -0,0 +1,727 @@
+// Package streamaggr implements streaming aggregation for the ingested samples.
+package streamaggr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/selector"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is a configuration for a single streaming aggregation rule.
+type Config struct {
+	// Match is a series selector for the input samples.
+	Match string `yaml:"match"`
+
+	// Interval is the interval for writing the aggregated output samples.
+	Interval time.Duration `yaml:"interval"`
+
+	// Window is an optional sliding window for the aggregation.
+	//
+	// The output samples written once per Interval are calculated over the input samples
+	// received during the last Window. Window must be a multiple of Interval.
+	// By default Window equals to Interval, e.g. the input samples are aggregated over non-overlapping intervals.
+	Window time.Duration `yaml:"window,omitempty"`
+
+	// By is an optional list of labels for grouping the input samples.
+	By []string `yaml:"by,omitempty"`
+
+	// Without is an optional list of labels to remove from the input samples before grouping.
+	Without []string `yaml:"without,omitempty"`
+
+	// Outputs is a list of aggregation functions to apply to the input samples.
+	//
+	// Supported functions: sum, count, avg, min, max, last, count_series and quantiles(phi1, ..., phiN).
+	Outputs []string `yaml:"outputs"`
+
+	// DropInput instructs dropping the input samples matching Match after the aggregation.
+	DropInput bool `yaml:"drop_input,omitempty"`
+
+	// DropLateSamples instructs dropping the input samples with timestamps older than the start
+	// of the current aggregation window. By default such samples are counted in the current interval.
+	DropLateSamples bool `yaml:"drop_late_samples,omitempty"`
+}
+
+// PushFunc must write mrs to the storage.
+//
+// mrs cannot be used after returning from PushFunc.
+type PushFunc func(mrs []storage.MetricRow)
+
+// Aggregators aggregates the input samples according to the list of rules.
+type Aggregators struct {
+	as []*aggregator
+
+	pushFunc PushFunc
+}
+
+// LoadFromFile loads Aggregators from the YAML file at the given path.
+//
+// The aggregated samples are passed to pushFunc.
+// MustStop must be called on the returned Aggregators when they are no longer needed.
+func LoadFromFile(path string, pushFunc PushFunc) (*Aggregators, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", path, err)
+	}
+	return LoadFromData(data, pushFunc)
+}
+
+// LoadFromData loads Aggregators from the YAML data.
+//
+// The aggregated samples are passed to pushFunc.
+// MustStop must be called on the returned Aggregators when they are no longer needed.
+func LoadFromData(data []byte, pushFunc PushFunc) (*Aggregators, error) {
+	var a Aggregators
+	a.pushFunc = pushFunc
+	return a.reload(data)
+}
+
+// Reload returns new Aggregators for the given YAML data.
+//
+// The state of aggregators with unchanged rules is preserved in the returned Aggregators.
+// The aggregators for removed rules remain running, so a may be used until in-flight Push calls finish.
+// a.MustStopRemoved must be called with the returned Aggregators after that. a remains unchanged on error.
+func (a *Aggregators) Reload(data []byte) (*Aggregators, error) {
+	return a.reload(data)
+}
+
+// MustStopRemoved stops aggregators from a, which are missing in aNew, and flushes their state.
+//
+// a mustn't be used after the call.
+func (a *Aggregators) MustStopRemoved(aNew *Aggregators) {
+	used := make(map[*aggregator]bool, len(aNew.as))
+	for _, ag := range aNew.as {
+		used[ag] = true
+	}
+	for _, ag := range a.as {
+		if !used[ag] {
+			ag.MustStop()
+		}
+	}
+}
+
+func (a *Aggregators) reload(data []byte) (*Aggregators, error) {
+	var cfgs []*Config
+	if err := yaml.UnmarshalStrict(data, &cfgs); err != nil {
+		return nil, fmt.Errorf("cannot parse stream aggregation config: %s", err)
+	}
+	prevAggregators := make(map[string]*aggregator, len(a.as))
+	for _, ag := range a.as {
+		prevAggregators[ag.key] = ag
+	}
+	var as, newAggregators []*aggregator
+	reused := make(map[*aggregator]bool)
+	for i, cfg := range cfgs {
+		key, err := configKey(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if ag := prevAggregators[key]; ag != nil && !reused[ag] {
+			reused[ag] = true
+			as = append(as, ag)
+			continue
+		}
+		ag, err := newAggregator(cfg, a.pushFunc)
+		if err != nil {
+			for _, ag := range newAggregators {
+				ag.MustStop()
+			}
+			return nil, fmt.Errorf("cannot initialize aggregator #%d: %s", i+1, err)
+		}
+		ag.key = key
+		as = append(as, ag)
+		newAggregators = append(newAggregators, ag)
+	}
+	return &Aggregators{
+		as:       as,
+		pushFunc: a.pushFunc,
+	}, nil
+}
+
+func configKey(cfg *Config) (string, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal config: %s", err)
+	}
+	return string(data), nil
+}
+
+// MustStop stops a and flushes the aggregated state.
+func (a *Aggregators) MustStop() {
+	for _, ag := range a.as {
+		ag.MustStop()
+	}
+}
+
+// Push pushes mrs to a and returns mrs, which mustn't be dropped.
+//
+// The returned rows are stored in mrs.
+func (a *Aggregators) Push(mrs []storage.MetricRow) []storage.MetricRow {
+	if len(a.as) == 0 {
+		return mrs
+	}
+	mn := storage.GetMetricName()
+	defer storage.PutMetricName(mn)
+	dst := mrs[:0]
+	for i := range mrs {
+		mr := &mrs[i]
+		if err := mn.UnmarshalRaw(mr.MetricNameRaw); err != nil {
+			// Leave the row as is, so the storage reports the error.
+			dst = append(dst, *mr)
+			continue
+		}
+		dropInput := false
+		for _, ag := range a.as {
+			if !ag.match.Match(mn) {
+				continue
+			}
+			ag.push(mn, mr)
+			if ag.dropInput {
+				dropInput = true
+			}
+		}
+		if !dropInput {
+			dst = append(dst, *mr)
+		}
+	}
+	return dst
+}
+
+type aggregator struct {
+	key string
+
+	match           *selector.Matcher
+	by              []string
+	without         []string
+	dropInput       bool
+	dropLateSamples bool
+	interval        time.Duration
+
+	// windowPanes is the number of intervals in the sliding window.
+	windowPanes int
+
+	// suffix is added to the metric name of the output series.
+	suffix string
+
+	outputs   []string
+	quantiles []float64
+
+	needSamples bool
+	needSeries  bool
+
+	pushFunc PushFunc
+
+	mu sync.Mutex
+
+	// m contains the aggregation state for the current interval, which started at intervalStart.
+	m             map[string]*aggrState
+	intervalStart int64
+
+	// panes contains the aggregation states for the previous intervals in the sliding window from the oldest to the newest.
+	panes []aggrPane
+
+	// rng is used for sampling values for quantiles.
+	rng *rand.Rand
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	keyBuf []byte
+}
+
+type aggrPane struct {
+	start int64
+	m     map[string]*aggrState
+}
+
+type aggrState struct {
+	sum           float64
+	count         uint64
+	min           float64
+	max           float64
+	last          float64
+	lastTimestamp int64
+	series        map[string]struct{}
+
+	// samples contains up to maxQuantileSamples uniformly sampled values for quantiles.
+	samples []float64
+}
+
+// maxQuantileSamples is the maximum number of values per aggregation state used for quantiles calculation.
+const maxQuantileSamples = 1000
+
+func newAggregator(cfg *Config, pushFunc PushFunc) (*aggregator, error) {
+	if len(cfg.Match) == 0 {
+		return nil, fmt.Errorf("missing `match` option")
+	}
+	tfs, err := selector.Parse(cfg.Match)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `match: %q`: %s", cfg.Match, err)
+	}
+	match, err := selector.NewMatcher(tfs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `match: %q`: %s", cfg.Match, err)
+	}
+	if cfg.Interval < time.Second {
+		return nil, fmt.Errorf("`interval` must be at least 1s; got %s", cfg.Interval)
+	}
+	window := cfg.Window
+	if window == 0 {
+		window = cfg.Interval
+	}
+	if window < cfg.Interval || window%cfg.Interval != 0 {
+		return nil, fmt.Errorf("`window` must be a multiple of `interval`=%s; got %s", cfg.Interval, window)
+	}
+	if len(cfg.By) > 0 && len(cfg.Without) > 0 {
+		return nil, fmt.Errorf("`by` and `without` cannot be set simultaneously")
+	}
+	if len(cfg.Outputs) == 0 {
+		return nil, fmt.Errorf("`outputs` cannot be empty")
+	}
+
+	ag := &aggregator{
+		match:           match,
+		by:              sortedLabels(cfg.By),
+		without:         sortedLabels(cfg.Without),
+		dropInput:       cfg.DropInput,
+		dropLateSamples: cfg.DropLateSamples,
+		interval:        cfg.Interval,
+		windowPanes:     int(window / cfg.Interval),
+		pushFunc:        pushFunc,
+		m:               make(map[string]*aggrState),
+		intervalStart:   timestampFromTime(time.Now()),
+		rng:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		stopCh:          make(chan struct{}),
+	}
+	seenOutputs := make(map[string]bool)
+	for _, output := range cfg.Outputs {
+		output = strings.TrimSpace(output)
+		if strings.HasPrefix(output, "quantiles(") {
+			phis, err := parseQuantiles(output)
+			if err != nil {
+				return nil, err
+			}
+			ag.quantiles = phis
+			ag.needSamples = true
+			output = "quantiles"
+		} else {
+			switch output {
+			case "sum", "count", "avg", "min", "max", "last":
+			case "count_series":
+				ag.needSeries = true
+			default:
+				return nil, fmt.Errorf("unsupported output %q; supported outputs: sum, count, avg, min, max, last, count_series, quantiles(...)", output)
+			}
+		}
+		if seenOutputs[output] {
+			return nil, fmt.Errorf("duplicate output %q", output)
+		}
+		seenOutputs[output] = true
+		ag.outputs = append(ag.outputs, output)
+	}
+
+	suffix := ":" + durationString(window)
+	if len(ag.by) > 0 {
+		suffix += "_by_" + strings.Join(ag.by, "_")
+	}
+	if len(ag.without) > 0 {
+		suffix += "_without_" + strings.Join(ag.without, "_")
+	}
+	ag.suffix = suffix + "_"
+
+	ag.wg.Add(1)
+	go func() {
+		defer ag.wg.Done()
+		ag.runFlusher()
+	}()
+	return ag, nil
+}
+
+func sortedLabels(labels []string) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	a := append([]string{}, labels...)
+	sort.Strings(a)
+	return a
+}
+
+func parseQuantiles(s string) ([]float64, error) {
+	args := strings.TrimPrefix(s, "quantiles(")
+	if !strings.HasSuffix(args, ")") {
+		return nil, fmt.Errorf("missing closing `)` in %q", s)
+	}
+	args = args[:len(args)-1]
+	if len(strings.TrimSpace(args)) == 0 {
+		return nil, fmt.Errorf("%q must contain at least a single phi", s)
+	}
+	var phis []float64
+	for _, arg := range strings.Split(args, ",") {
+		phi, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse phi in %q: %s", s, err)
+		}
+		if phi < 0 || phi > 1 {
+			return nil, fmt.Errorf("phi in %q must be in the range [0..1]; got %v", s, phi)
+		}
+		phis = append(phis, phi)
+	}
+	return phis, nil
+}
+
+// durationString returns compact string representation for d such as 30s, 1m or 1h.
+func durationString(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	default:
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+}
+
+// MustStop stops ag and flushes its state.
+func (ag *aggregator) MustStop() {
+	close(ag.stopCh)
+	ag.wg.Wait()
+	ag.flush()
+}
+
+func (ag *aggregator) runFlusher() {
+	t := time.NewTicker(ag.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ag.stopCh:
+			return
+		case <-t.C:
+			ag.flush()
+		}
+	}
+}
+
+func (ag *aggregator) push(mn *storage.MetricName, mr *storage.MetricRow) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	if ag.dropLateSamples && mr.Timestamp < ag.windowStartLocked() {
+		lateSamplesDropped.Inc()
+		return
+	}
+
+	// Build the output series key from mn.
+	var tags []storage.Tag
+	for i := range mn.Tags {
+		tag := &mn.Tags[i]
+		if len(ag.by) > 0 && !hasLabel(ag.by, tag.Key) {
+			continue
+		}
+		if hasLabel(ag.without, tag.Key) {
+			continue
+		}
+		tags = append(tags, *tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return string(tags[i].Key) < string(tags[j].Key)
+	})
+	key := marshalLabel(ag.keyBuf[:0], nil, mn.MetricGroup)
+	for i := range tags {
+		key = marshalLabel(key, tags[i].Key, tags[i].Value)
+	}
+	ag.keyBuf = key
+
+	as := ag.m[string(key)]
+	if as == nil {
+		as = &aggrState{
+			min:           math.Inf(1),
+			max:           math.Inf(-1),
+			lastTimestamp: math.MinInt64,
+		}
+		if ag.needSeries {
+			as.series = make(map[string]struct{})
+		}
+		ag.m[string(key)] = as
+	}
+	v := mr.Value
+	as.sum += v
+	as.count++
+	if v < as.min {
+		as.min = v
+	}
+	if v > as.max {
+		as.max = v
+	}
+	if mr.Timestamp >= as.lastTimestamp {
+		as.last = v
+		as.lastTimestamp = mr.Timestamp
+	}
+	if ag.needSamples {
+		if len(as.samples) < maxQuantileSamples {
+			as.samples = append(as.samples, v)
+		} else if n := ag.rng.Int63n(int64(as.count)); n < int64(len(as.samples)) {
+			// Reservoir sampling keeps uniformly distributed samples.
+			as.samples[n] = v
+		}
+	}
+	if as.series != nil {
+		if _, ok := as.series[string(mr.MetricNameRaw)]; !ok {
+			as.series[string(mr.MetricNameRaw)] = struct{}{}
+		}
+	}
+}
+
+// windowStartLocked returns the start of the current sliding window.
+//
+// ag.mu must be locked by the caller.
+func (ag *aggregator) windowStartLocked() int64 {
+	if len(ag.panes) > 0 {
+		return ag.panes[0].start
+	}
+	return ag.intervalStart
+}
+
+func hasLabel(labels []string, key []byte) bool {
+	for _, label := range labels {
+		if label == string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func marshalLabel(dst, key, value []byte) []byte {
+	dst = strconv.AppendQuote(dst, string(key))
+	dst = strconv.AppendQuote(dst, string(value))
+	return dst
+}
+
+func unmarshalLabels(src string) ([]prompb.Label, error) {
+	var labels []prompb.Label
+	for len(src) > 0 {
+		var kv [2]string
+		for i := range kv {
+			quoted, err := strconv.QuotedPrefix(src)
+			if err != nil {
+				return nil, fmt.Errorf("cannot unmarshal labels: %s", err)
+			}
+			kv[i], err = strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("cannot unquote label: %s", err)
+			}
+			src = src[len(quoted):]
+		}
+		labels = append(labels, prompb.Label{
+			Name:  []byte(kv[0]),
+			Value: []byte(kv[1]),
+		})
+	}
+	return labels, nil
+}
+
+// flush writes the aggregated samples for the current sliding window via pushFunc and starts the next interval.
+func (ag *aggregator) flush() {
+	ag.mu.Lock()
+	panes := append(ag.panes, aggrPane{
+		start: ag.intervalStart,
+		m:     ag.m,
+	})
+	if len(panes) > ag.windowPanes {
+		panes = panes[len(panes)-ag.windowPanes:]
+	}
+	// The next window contains the last windowPanes-1 panes.
+	// The closed panes aren't modified, so they may be read without the lock below.
+	n := len(panes) - (ag.windowPanes - 1)
+	if n < 0 {
+		n = 0
+	}
+	ag.panes = append([]aggrPane{}, panes[n:]...)
+	ag.m = make(map[string]*aggrState, len(ag.m))
+	now := timestampFromTime(time.Now())
+	ag.intervalStart = now
+	ag.mu.Unlock()
+
+	// Collect per-key states over the sliding window.
+	m := make(map[string][]*aggrState)
+	for _, pane := range panes {
+		for key, as := range pane.m {
+			m[key] = append(m[key], as)
+		}
+	}
+	if len(m) == 0 {
+		return
+	}
+	var mrs []storage.MetricRow
+	var metricNamesBuf []byte
+	addRow := func(labels []prompb.Label, output string, value float64) {
+		metricGroup := labels[0].Value
+		labels[0].Value = append(append([]byte{}, metricGroup...), ag.suffix+output...)
+		start := len(metricNamesBuf)
+		metricNamesBuf = storage.MarshalMetricNameRaw(metricNamesBuf, labels)
+		labels[0].Value = metricGroup
+		mrs = append(mrs, storage.MetricRow{
+			MetricNameRaw: metricNamesBuf[start:len(metricNamesBuf):len(metricNamesBuf)],
+			Timestamp:     now,
+			Value:         value,
+		})
+	}
+	var phiValues []float64
+	var ws []weightedSample
+	for key, states := range m {
+		labels, err := unmarshalLabels(key)
+		if err != nil {
+			// This shouldn't happen, since key is generated by push.
+			panic(fmt.Errorf("BUG: %s", err))
+		}
+		as := mergeAggrStates(states)
+		for _, output := range ag.outputs {
+			switch output {
+			case "sum":
+				addRow(labels, output, as.sum)
+			case "count":
+				addRow(labels, output, float64(as.count))
+			case "avg":
+				addRow(labels, output, as.sum/float64(as.count))
+			case "min":
+				addRow(labels, output, as.min)
+			case "max":
+				addRow(labels, output, as.max)
+			case "last":
+				addRow(labels, output, as.last)
+			case "count_series":
+				addRow(labels, output, float64(len(as.series)))
+			case "quantiles":
+				ws = appendWeightedSamples(ws[:0], states)
+				phiValues = weightedQuantiles(phiValues[:0], ws, ag.quantiles, as.min, as.max)
+				n := len(labels)
+				for i, phi := range ag.quantiles {
+					labels = append(labels[:n], prompb.Label{
+						Name:  []byte("quantile"),
+						Value: []byte(strconv.FormatFloat(phi, 'g', -1, 64)),
+					})
+					addRow(labels, output, phiValues[i])
+				}
+				labels = labels[:n]
+			}
+		}
+	}
+	ag.pushFunc(mrs)
+}
+
+// mergeAggrStates merges states for the same output series from the panes of the sliding window.
+//
+// The samples aren't merged, since they are weighted separately for each state by appendWeightedSamples.
+func mergeAggrStates(states []*aggrState) *aggrState {
+	if len(states) == 1 {
+		// Fast path - the window contains a single state.
+		return states[0]
+	}
+	as := &aggrState{
+		min:           math.Inf(1),
+		max:           math.Inf(-1),
+		lastTimestamp: math.MinInt64,
+	}
+	for _, x := range states {
+		as.sum += x.sum
+		as.count += x.count
+		if x.min < as.min {
+			as.min = x.min
+		}
+		if x.max > as.max {
+			as.max = x.max
+		}
+		if x.lastTimestamp >= as.lastTimestamp {
+			as.last = x.last
+			as.lastTimestamp = x.lastTimestamp
+		}
+		if x.series != nil {
+			if as.series == nil {
+				as.series = make(map[string]struct{}, len(x.series))
+			}
+			for k := range x.series {
+				as.series[k] = struct{}{}
+			}
+		}
+	}
+	return as
+}
+
+type weightedSample struct {
+	value  float64
+	weight float64
+}
+
+// appendWeightedSamples appends samples from states to dst.
+//
+// Every sample is weighted by the number of values it represents in the state.
+func appendWeightedSamples(dst []weightedSample, states []*aggrState) []weightedSample {
+	for _, as := range states {
+		if len(as.samples) == 0 {
+			continue
+		}
+		weight := float64(as.count) / float64(len(as.samples))
+		for _, v := range as.samples {
+			dst = append(dst, weightedSample{
+				value:  v,
+				weight: weight,
+			})
+		}
+	}
+	return dst
+}
+
+// weightedQuantiles appends quantiles for the given phis over ws to dst.
+//
+// min and max are returned for phi=0 and phi=1. ws is sorted by values during the call.
+func weightedQuantiles(dst []float64, ws []weightedSample, phis []float64, min, max float64) []float64 {
+	sort.Slice(ws, func(i, j int) bool {
+		return ws[i].value < ws[j].value
+	})
+	totalWeight := float64(0)
+	for i := range ws {
+		totalWeight += ws[i].weight
+	}
+	for _, phi := range phis {
+		switch {
+		case len(ws) == 0 || math.IsNaN(phi):
+			dst = append(dst, math.NaN())
+		case phi <= 0:
+			dst = append(dst, min)
+		case phi >= 1:
+			dst = append(dst, max)
+		default:
+			// Select the sample covering the phi*(totalWeight-1) position rounded to the nearest sample.
+			pos := phi*(totalWeight-1) + 0.5
+			q := ws[len(ws)-1].value
+			weight := float64(0)
+			for i := range ws {
+				weight += ws[i].weight
+				if pos < weight {
+					q = ws[i].value
+					break
+				}
+			}
+			dst = append(dst, q)
+		}
+	}
+	return dst
+}
+
+func timestampFromTime(t time.Time) int64 {
+	return t.UnixNano() / 1e6
+}
+
+var lateSamplesDropped = metrics.NewCounter(`vm_streamaggr_late_samples_dropped_total`)
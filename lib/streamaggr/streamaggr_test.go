@@ -0,0 +1,559 @@
+package streamaggr
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestLoadFromDataFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		pushFunc := func(mrs []storage.MetricRow) {}
+		a, err := LoadFromData([]byte(s), pushFunc)
+		if err == nil {
+			t.Fatalf("expecting non-nil error for config\n%s", s)
+		}
+		if a != nil {
+			t.Fatalf("expecting nil Aggregators")
+		}
+	}
+
+	// Invalid yaml
+	f(`foo`)
+	f(`- match: foo
+  unknown_option: bar`)
+
+	// Missing match
+	f(`- interval: 1m
+  outputs: [sum]`)
+
+	// Invalid match
+	f(`- match: '{foo'
+  interval: 1m
+  outputs: [sum]`)
+
+	// Missing interval
+	f(`- match: foo
+  outputs: [sum]`)
+
+	// Too small interval
+	f(`- match: foo
+  interval: 10ms
+  outputs: [sum]`)
+
+	// Window isn't a multiple of interval
+	f(`- match: foo
+  interval: 1m
+  window: 30s
+  outputs: [sum]`)
+	f(`- match: foo
+  interval: 1m
+  window: 90s
+  outputs: [sum]`)
+
+	// by and without at the same time
+	f(`- match: foo
+  interval: 1m
+  by: [job]
+  without: [instance]
+  outputs: [sum]`)
+
+	// Missing outputs
+	f(`- match: foo
+  interval: 1m`)
+
+	// Unknown output
+	f(`- match: foo
+  interval: 1m
+  outputs: [foobar]`)
+
+	// Duplicate output
+	f(`- match: foo
+  interval: 1m
+  outputs: [sum, sum]`)
+
+	// Invalid quantiles
+	f(`- match: foo
+  interval: 1m
+  outputs: ["quantiles("]`)
+	f(`- match: foo
+  interval: 1m
+  outputs: ["quantiles()"]`)
+	f(`- match: foo
+  interval: 1m
+  outputs: ["quantiles(2)"]`)
+	f(`- match: foo
+  interval: 1m
+  outputs: ["quantiles(x)"]`)
+}
+
+func TestAggregatorsSuccess(t *testing.T) {
+	f := func(config, inputMetrics, outputMetricsExpected, inputMetricsExpected string) {
+		t.Helper()
+
+		var tpr testPushedRows
+		a, err := LoadFromData([]byte(config), tpr.push)
+		if err != nil {
+			t.Fatalf("cannot initialize aggregators: %s", err)
+		}
+		mrs := mustParseMetrics(inputMetrics, timestampFromTime(time.Now()))
+		mrs = a.Push(mrs)
+		inputMetricsResult := metricRowsToString(mrs)
+		if inputMetricsResult != inputMetricsExpected {
+			t.Fatalf("unexpected input metrics left after aggregation;\ngot\n%s\nwant\n%s", inputMetricsResult, inputMetricsExpected)
+		}
+
+		// Flush the aggregated state.
+		a.MustStop()
+		outputMetricsResult := tpr.String()
+		if outputMetricsResult != outputMetricsExpected {
+			t.Fatalf("unexpected output metrics;\ngot\n%s\nwant\n%s", outputMetricsResult, outputMetricsExpected)
+		}
+	}
+
+	// Empty config
+	f(``, `foo 1`, ``, "foo 1\n")
+
+	// Non-matching series are left untouched.
+	f(`
+- match: bar
+  interval: 1h
+  outputs: [sum]
+  drop_input: true
+`, `foo 1
+foo{a="b"} 2
+`, ``, `foo 1
+foo{a="b"} 2
+`)
+
+	// Aggregate all the labels
+	f(`
+- match: '{__name__=~"foo|bar"}'
+  interval: 1h
+  outputs: [sum, count, avg, min, max, last, count_series]
+`, `foo{job="a"} 1
+foo{job="a"} 3
+foo{job="b"} -2
+bar 10
+baz 100
+`, `bar:1h_avg 10
+bar:1h_count 1
+bar:1h_count_series 1
+bar:1h_last 10
+bar:1h_max 10
+bar:1h_min 10
+bar:1h_sum 10
+foo:1h_avg{job="a"} 2
+foo:1h_avg{job="b"} -2
+foo:1h_count_series{job="a"} 1
+foo:1h_count_series{job="b"} 1
+foo:1h_count{job="a"} 2
+foo:1h_count{job="b"} 1
+foo:1h_last{job="a"} 3
+foo:1h_last{job="b"} -2
+foo:1h_max{job="a"} 3
+foo:1h_max{job="b"} -2
+foo:1h_min{job="a"} 1
+foo:1h_min{job="b"} -2
+foo:1h_sum{job="a"} 4
+foo:1h_sum{job="b"} -2
+`, `foo{job="a"} 1
+foo{job="a"} 3
+foo{job="b"} -2
+bar 10
+baz 100
+`)
+
+	// Aggregate by job and drop the input
+	f(`
+- match: foo
+  interval: 1m
+  by: [job]
+  outputs: [sum, count_series]
+  drop_input: true
+`, `foo{job="a",instance="x"} 1
+foo{job="a",instance="y"} 3
+foo{job="b",instance="x"} 5
+foo{instance="x"} 7
+bar{job="a"} 10
+`, `foo:1m_by_job_count_series 1
+foo:1m_by_job_count_series{job="a"} 2
+foo:1m_by_job_count_series{job="b"} 1
+foo:1m_by_job_sum 7
+foo:1m_by_job_sum{job="a"} 4
+foo:1m_by_job_sum{job="b"} 5
+`, `bar{job="a"} 10
+`)
+
+	// Aggregate without instance
+	f(`
+- match: '{job="a"}'
+  interval: 30s
+  without: [instance]
+  outputs: [max]
+`, `foo{job="a",instance="x",env="prod"} 1
+foo{job="a",instance="y",env="prod"} 3
+bar{job="a",instance="x"} 5
+`, `bar:30s_without_instance_max{job="a"} 5
+foo:30s_without_instance_max{env="prod",job="a"} 3
+`, `foo{job="a",instance="x",env="prod"} 1
+foo{job="a",instance="y",env="prod"} 3
+bar{job="a",instance="x"} 5
+`)
+
+	// Quantiles
+	f(`
+- match: foo
+  interval: 1m
+  outputs: ["quantiles(0, 0.5, 1)"]
+`, `foo 1
+foo 2
+foo 3
+`, `foo:1m_quantiles{quantile="0"} 1
+foo:1m_quantiles{quantile="0.5"} 2
+foo:1m_quantiles{quantile="1"} 3
+`, `foo 1
+foo 2
+foo 3
+`)
+
+	// Multiple rules matching the same series
+	f(`
+- match: foo
+  interval: 1m
+  outputs: [sum]
+- match: '{job="a"}'
+  interval: 5m
+  outputs: [count]
+  drop_input: true
+`, `foo{job="a"} 1
+foo{job="b"} 2
+`, `foo:1m_sum{job="a"} 1
+foo:1m_sum{job="b"} 2
+foo:5m_count{job="a"} 1
+`, `foo{job="b"} 2
+`)
+}
+
+func TestAggregatorsLateSamples(t *testing.T) {
+	f := func(config, outputMetricsExpected string) {
+		t.Helper()
+
+		var tpr testPushedRows
+		a, err := LoadFromData([]byte(config), tpr.push)
+		if err != nil {
+			t.Fatalf("cannot initialize aggregators: %s", err)
+		}
+		now := timestampFromTime(time.Now())
+		mrs := mustParseMetrics("foo 1\n", now)
+		mrs = append(mrs, mustParseMetrics("foo 2\n", now-3600*1000)...)
+		mrs = append(mrs, mustParseMetrics("foo 4\n", now+3600*1000)...)
+		a.Push(mrs)
+		a.MustStop()
+		outputMetricsResult := tpr.String()
+		if outputMetricsResult != outputMetricsExpected {
+			t.Fatalf("unexpected output metrics;\ngot\n%s\nwant\n%s", outputMetricsResult, outputMetricsExpected)
+		}
+	}
+
+	// Late samples are counted in the current interval by default.
+	f(`
+- match: foo
+  interval: 1m
+  outputs: [sum, last]
+`, `foo:1m_last 4
+foo:1m_sum 7
+`)
+
+	// Late samples are dropped.
+	f(`
+- match: foo
+  interval: 1m
+  outputs: [sum, last]
+  drop_late_samples: true
+`, `foo:1m_last 4
+foo:1m_sum 5
+`)
+}
+
+func TestAggregatorsReload(t *testing.T) {
+	var tpr testPushedRows
+	a, err := LoadFromData([]byte(`
+- match: foo
+  interval: 1h
+  outputs: [sum]
+- match: bar
+  interval: 1h
+  outputs: [sum]
+`), tpr.push)
+	if err != nil {
+		t.Fatalf("cannot initialize aggregators: %s", err)
+	}
+	now := timestampFromTime(time.Now())
+	a.Push(mustParseMetrics("foo 1\nbar 10\n", now))
+
+	// Invalid config must leave a untouched.
+	if _, err := a.Reload([]byte(`- match: foo`)); err == nil {
+		t.Fatalf("expecting non-nil error for invalid config")
+	}
+
+	// The state for the unchanged rule for foo must be preserved.
+	// The removed rule for bar must remain usable by in-flight pushes until MustStopRemoved is called.
+	aNew, err := a.Reload([]byte(`
+- match: foo
+  interval: 1h
+  outputs: [sum]
+- match: baz
+  interval: 1h
+  outputs: [count]
+`))
+	if err != nil {
+		t.Fatalf("cannot reload aggregators: %s", err)
+	}
+	a.Push(mustParseMetrics("bar 5\n", now))
+	if s := tpr.String(); s != "" {
+		t.Fatalf("unexpected output metrics after reload;\ngot\n%s\nwant empty output", s)
+	}
+
+	// The state for the removed rule for bar must be flushed by MustStopRemoved.
+	a.MustStopRemoved(aNew)
+	a = aNew
+	outputMetricsExpected := "bar:1h_sum 15\n"
+	if s := tpr.String(); s != outputMetricsExpected {
+		t.Fatalf("unexpected output metrics after stopping removed aggregators;\ngot\n%s\nwant\n%s", s, outputMetricsExpected)
+	}
+
+	a.Push(mustParseMetrics("foo 2\nbar 20\nbaz 30\n", now))
+	a.MustStop()
+	outputMetricsExpected = `bar:1h_sum 15
+baz:1h_count 1
+foo:1h_sum 3
+`
+	if s := tpr.String(); s != outputMetricsExpected {
+		t.Fatalf("unexpected output metrics after stop;\ngot\n%s\nwant\n%s", s, outputMetricsExpected)
+	}
+}
+
+func TestAggregatorsSlidingWindow(t *testing.T) {
+	var tpr testPushedRows
+	a, err := LoadFromData([]byte(`
+- match: foo
+  interval: 1h
+  window: 3h
+  without: [job]
+  outputs: [sum, count, min, max, last, count_series, "quantiles(0.5)"]
+`), tpr.push)
+	if err != nil {
+		t.Fatalf("cannot initialize aggregators: %s", err)
+	}
+	defer a.MustStop()
+	ag := a.as[0]
+
+	// flush writes the outputs over the last 3 intervals.
+	f := func(input, outputMetricsExpected string) {
+		t.Helper()
+		if len(input) > 0 {
+			a.Push(mustParseMetrics(input, timestampFromTime(time.Now())))
+		}
+		tpr.mu.Lock()
+		tpr.lines = nil
+		tpr.mu.Unlock()
+		ag.flush()
+		if s := tpr.String(); s != outputMetricsExpected {
+			t.Fatalf("unexpected output metrics;\ngot\n%s\nwant\n%s", s, outputMetricsExpected)
+		}
+	}
+	f(`foo{job="a"} 1`, `foo:3h_without_job_count 1
+foo:3h_without_job_count_series 1
+foo:3h_without_job_last 1
+foo:3h_without_job_max 1
+foo:3h_without_job_min 1
+foo:3h_without_job_quantiles{quantile="0.5"} 1
+foo:3h_without_job_sum 1
+`)
+	f(`foo{job="b"} 2`, `foo:3h_without_job_count 2
+foo:3h_without_job_count_series 2
+foo:3h_without_job_last 2
+foo:3h_without_job_max 2
+foo:3h_without_job_min 1
+foo:3h_without_job_quantiles{quantile="0.5"} 2
+foo:3h_without_job_sum 3
+`)
+	f(`foo{job="a"} 4`, `foo:3h_without_job_count 3
+foo:3h_without_job_count_series 2
+foo:3h_without_job_last 4
+foo:3h_without_job_max 4
+foo:3h_without_job_min 1
+foo:3h_without_job_quantiles{quantile="0.5"} 2
+foo:3h_without_job_sum 7
+`)
+
+	// The samples from the first interval leave the window.
+	f(`foo{job="c"} 8`, `foo:3h_without_job_count 3
+foo:3h_without_job_count_series 3
+foo:3h_without_job_last 8
+foo:3h_without_job_max 8
+foo:3h_without_job_min 2
+foo:3h_without_job_quantiles{quantile="0.5"} 4
+foo:3h_without_job_sum 14
+`)
+	f(``, `foo:3h_without_job_count 2
+foo:3h_without_job_count_series 2
+foo:3h_without_job_last 8
+foo:3h_without_job_max 8
+foo:3h_without_job_min 4
+foo:3h_without_job_quantiles{quantile="0.5"} 8
+foo:3h_without_job_sum 12
+`)
+	f(``, `foo:3h_without_job_count 1
+foo:3h_without_job_count_series 1
+foo:3h_without_job_last 8
+foo:3h_without_job_max 8
+foo:3h_without_job_min 8
+foo:3h_without_job_quantiles{quantile="0.5"} 8
+foo:3h_without_job_sum 8
+`)
+	f(``, ``)
+}
+
+func TestAggregatorsSlidingWindowLateSamples(t *testing.T) {
+	var tpr testPushedRows
+	a, err := LoadFromData([]byte(`
+- match: foo
+  interval: 1h
+  window: 2h
+  outputs: [sum]
+  drop_late_samples: true
+`), tpr.push)
+	if err != nil {
+		t.Fatalf("cannot initialize aggregators: %s", err)
+	}
+	ag := a.as[0]
+	ag.mu.Lock()
+	windowStart := ag.intervalStart
+	ag.mu.Unlock()
+
+	// Start the next interval, so the window spans two intervals.
+	time.Sleep(2 * time.Millisecond)
+	ag.flush()
+
+	// Samples older than the current interval are counted if they are within the window.
+	a.Push(mustParseMetrics("foo 1\n", windowStart))
+	a.Push(mustParseMetrics("foo 2\n", windowStart-1))
+	a.MustStop()
+	outputMetricsExpected := "foo:2h_sum 1\n"
+	if s := tpr.String(); s != outputMetricsExpected {
+		t.Fatalf("unexpected output metrics;\ngot\n%s\nwant\n%s", s, outputMetricsExpected)
+	}
+}
+
+func TestWeightedQuantiles(t *testing.T) {
+	f := func(ws []weightedSample, phis, resultExpected []float64) {
+		t.Helper()
+		result := weightedQuantiles(nil, ws, phis, -100, 100)
+		if fmt.Sprintf("%v", result) != fmt.Sprintf("%v", resultExpected) {
+			t.Fatalf("unexpected quantiles for %v; got %v; want %v", phis, result, resultExpected)
+		}
+	}
+	f(nil, []float64{0.5}, []float64{math.NaN()})
+
+	// Equal weights
+	ws := []weightedSample{{3, 1}, {1, 1}, {2, 1}}
+	f(ws, []float64{0, 0.2, 0.25, 0.5, 0.9, 1}, []float64{-100, 1, 2, 2, 3, 100})
+
+	// The sample with bigger weight represents more values
+	ws = []weightedSample{{1, 1}, {2, 8}, {3, 1}}
+	f(ws, []float64{0.05, 0.5, 0.95}, []float64{1, 2, 3})
+}
+
+type testPushedRows struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (tpr *testPushedRows) push(mrs []storage.MetricRow) {
+	s := metricRowsToString(mrs)
+	tpr.mu.Lock()
+	tpr.lines = append(tpr.lines, strings.Split(strings.TrimSuffix(s, "\n"), "\n")...)
+	tpr.mu.Unlock()
+}
+
+func (tpr *testPushedRows) String() string {
+	tpr.mu.Lock()
+	defer tpr.mu.Unlock()
+	if len(tpr.lines) == 0 {
+		return ""
+	}
+	lines := append([]string{}, tpr.lines...)
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func metricRowsToString(mrs []storage.MetricRow) string {
+	var a []string
+	var mn storage.MetricName
+	for i := range mrs {
+		mr := &mrs[i]
+		if err := mn.UnmarshalRaw(mr.MetricNameRaw); err != nil {
+			panic(fmt.Errorf("cannot unmarshal metric name: %s", err))
+		}
+		a = append(a, fmt.Sprintf("%s %v", metricNameString(&mn), mr.Value))
+	}
+	if len(a) == 0 {
+		return ""
+	}
+	return strings.Join(a, "\n") + "\n"
+}
+
+func metricNameString(mn *storage.MetricName) string {
+	if len(mn.Tags) == 0 {
+		return string(mn.MetricGroup)
+	}
+	var tags []string
+	for i := range mn.Tags {
+		tag := &mn.Tags[i]
+		tags = append(tags, fmt.Sprintf("%s=%q", tag.Key, tag.Value))
+	}
+	return fmt.Sprintf("%s{%s}", mn.MetricGroup, strings.Join(tags, ","))
+}
+
+// mustParseMetrics parses metrics in the form `name{label="value",...} value` per line.
+func mustParseMetrics(s string, timestamp int64) []storage.MetricRow {
+	var mrs []storage.MetricRow
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		n := strings.LastIndexByte(line, ' ')
+		var value float64
+		if _, err := fmt.Sscanf(line[n+1:], "%g", &value); err != nil {
+			panic(fmt.Errorf("cannot parse value in %q: %s", line, err))
+		}
+		name := line[:n]
+		labels := []prompb.Label{{
+			Name: []byte("__name__"),
+		}}
+		if k := strings.IndexByte(name, '{'); k >= 0 {
+			for _, kv := range strings.Split(name[k+1:len(name)-1], ",") {
+				m := strings.IndexByte(kv, '=')
+				labels = append(labels, prompb.Label{
+					Name:  []byte(kv[:m]),
+					Value: []byte(strings.Trim(kv[m+1:], `"`)),
+				})
+			}
+			name = name[:k]
+		}
+		labels[0].Value = []byte(name)
+		mrs = append(mrs, storage.MetricRow{
+			MetricNameRaw: storage.MarshalMetricNameRaw(nil, labels),
+			Timestamp:     timestamp,
+			Value:         value,
+		})
+	}
+	return mrs
+}
@@ -0,0 +1,71 @@
+// Package tenant implements lightweight multi-tenancy for single-node VictoriaMetrics.
+//
+// Tenants are isolated via Label, which is injected into all the series ingested by the tenant
+// and into all the searches performed by the tenant.
+package tenant
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var extractTenantFromPath = flag.Bool("insert.extractTenantFromPath", false, "Whether to serve data ingestion and query endpoints only at /insert/<accountID>/... and /select/<accountID>/... paths. "+
+	"Series ingested via /insert/<accountID>/... get vm_account_id=<accountID> label, while queries via /select/<accountID>/... see only the series with this label. "+
+	"accountID must be an integer in the range [0 ... 4294967295]")
+
+// Label is the name of the label containing tenant's accountID.
+const Label = "vm_account_id"
+
+// IsEnabled returns true if -insert.extractTenantFromPath is set.
+func IsEnabled() bool {
+	return *extractTenantFromPath
+}
+
+type contextKey struct{}
+
+// NewRequest returns a copy of r scoped to the tenant from r.URL.Path.
+//
+// r.URL.Path must start with prefix followed by "<accountID>/". The prefix and the accountID are stripped
+// from the path of the returned request.
+func NewRequest(r *http.Request, prefix string) (*http.Request, error) {
+	accountID, path, err := parsePath(r.URL.Path, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.WithValue(r.Context(), contextKey{}, accountID)
+	rNew := r.WithContext(ctx)
+	u := *r.URL
+	u.Path = path
+	rNew.URL = &u
+	return rNew, nil
+}
+
+// parsePath returns accountID and the remaining path from "<prefix><accountID>/<path>".
+func parsePath(path, prefix string) (string, string, error) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", "", fmt.Errorf("path %q must start with %q", path, prefix)
+	}
+	tail := path[len(prefix):]
+	n := strings.IndexByte(tail, '/')
+	if n < 0 {
+		return "", "", fmt.Errorf("missing path after accountID in %q; the path must look like %s<accountID>/...", path, prefix)
+	}
+	accountID, err := strconv.ParseUint(tail[:n], 10, 32)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse accountID from %q: %s", path, err)
+	}
+	// Canonicalize accountID, so different representations of the same number refer to the same tenant.
+	return strconv.FormatUint(accountID, 10), tail[n:], nil
+}
+
+// GetAccountID returns tenant's accountID stored in ctx by NewRequest.
+//
+// Empty string is returned if ctx isn't scoped to a tenant.
+func GetAccountID(ctx context.Context) string {
+	accountID, _ := ctx.Value(contextKey{}).(string)
+	return accountID
+}
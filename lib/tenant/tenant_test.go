@@ -0,0 +1,68 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestNewRequestSuccess(t *testing.T) {
+	f := func(path, prefix, accountIDExpected, pathExpected string) {
+		t.Helper()
+		r, err := http.NewRequest("GET", "http://localhost"+path+"?query=up", nil)
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		rNew, err := NewRequest(r, prefix)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if accountID := GetAccountID(rNew.Context()); accountID != accountIDExpected {
+			t.Fatalf("unexpected accountID; got %q; want %q", accountID, accountIDExpected)
+		}
+		if rNew.URL.Path != pathExpected {
+			t.Fatalf("unexpected path; got %q; want %q", rNew.URL.Path, pathExpected)
+		}
+		if rNew.FormValue("query") != "up" {
+			t.Fatalf("query args must be preserved; got %q", rNew.URL.RawQuery)
+		}
+		// The original request mustn't be modified.
+		if r.URL.Path != path {
+			t.Fatalf("unexpected modification of the original path; got %q; want %q", r.URL.Path, path)
+		}
+		if accountID := GetAccountID(r.Context()); accountID != "" {
+			t.Fatalf("the original request mustn't be scoped to a tenant; got accountID %q", accountID)
+		}
+	}
+	f("/insert/0/api/v1/write", "/insert/", "0", "/api/v1/write")
+	f("/insert/42/api/v1/import", "/insert/", "42", "/api/v1/import")
+	f("/select/007/api/v1/query", "/select/", "7", "/api/v1/query")
+	f("/select/4294967295/", "/select/", "4294967295", "/")
+}
+
+func TestNewRequestFailure(t *testing.T) {
+	f := func(path, prefix string) {
+		t.Helper()
+		r, err := http.NewRequest("GET", "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		if _, err := NewRequest(r, prefix); err == nil {
+			t.Fatalf("expecting non-nil error for path %q", path)
+		}
+	}
+	f("/api/v1/write", "/insert/")
+	f("/select/1/api/v1/query", "/insert/")
+	f("/insert/", "/insert/")
+	f("/insert/1", "/insert/")
+	f("/insert//api/v1/write", "/insert/")
+	f("/insert/foo/api/v1/write", "/insert/")
+	f("/insert/-1/api/v1/write", "/insert/")
+	f("/insert/4294967296/api/v1/write", "/insert/")
+}
+
+func TestGetAccountIDMissing(t *testing.T) {
+	if accountID := GetAccountID(context.Background()); accountID != "" {
+		t.Fatalf("unexpected accountID; got %q; want empty string", accountID)
+	}
+}